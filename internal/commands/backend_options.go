@@ -0,0 +1,279 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+	"github.com/spf13/pflag"
+)
+
+const defaultBackend = "s3"
+
+// backendOptions selects the sidecar's storage backend and holds the flags of every backend.
+type backendOptions struct {
+	kind string
+
+	bucketName       string
+	deploymentPrefix string
+	prefix           string
+	readPrefixes     []string
+	bucketRoutes     []string
+	s3Endpoint       string
+	s3Region         string
+	s3PathStyle      optionalBool
+	hashLongKeys     bool
+
+	fsDir string
+}
+
+// backendFactory constructs one kind of storage backend from backendOptions.
+type backendFactory struct {
+	// validate reports missing or conflicting flags before anything is constructed.
+	validate func(opts *backendOptions) error
+	// name identifies the backend instance in logs, e.g. the bucket name.
+	name func(opts *backendOptions) string
+	// new returns the backend and a function that releases it. server is nil for
+	// commands that don't serve, which use the default S3 options.
+	new func(ctx context.Context, opts *backendOptions, server *serverOptions) (storage.MultipartBlobStorageBackend, func(), error)
+}
+
+// backendFactories are the storage backends selectable with --backend.
+var backendFactories = map[string]backendFactory{
+	"s3": {
+		validate: func(opts *backendOptions) error {
+			if strings.TrimSpace(opts.bucketName) == "" {
+				return fmt.Errorf("missing required bucket: set --bucket")
+			}
+			if _, err := storage.NormalizeKeyPrefix(opts.deploymentPrefix, opts.prefix); err != nil {
+				return fmt.Errorf("invalid --deployment-prefix or --prefix: %w", err)
+			}
+			for _, readPrefix := range opts.readPrefixes {
+				if _, err := storage.NormalizeKeyPrefix(opts.deploymentPrefix, readPrefix); err != nil {
+					return fmt.Errorf("invalid --read-prefix: %w", err)
+				}
+			}
+			if _, err := parseBucketRoutes(opts.bucketRoutes); err != nil {
+				return err
+			}
+			return nil
+		},
+		name: func(opts *backendOptions) string {
+			return strings.TrimSpace(opts.bucketName)
+		},
+		new: func(ctx context.Context, opts *backendOptions, server *serverOptions) (storage.MultipartBlobStorageBackend, func(), error) {
+			bucketName := strings.TrimSpace(opts.bucketName)
+			clientOpts := opts.s3Client()
+			prefix, err := storage.NormalizeKeyPrefix(opts.deploymentPrefix, opts.prefix)
+			if err != nil {
+				return nil, nil, err
+			}
+			readPrefixes := make([]string, 0, len(opts.readPrefixes))
+			longestPrefix := prefix
+			for _, readPrefix := range opts.readPrefixes {
+				readPrefix, err := storage.NormalizeKeyPrefix(opts.deploymentPrefix, readPrefix)
+				if err != nil {
+					return nil, nil, err
+				}
+				readPrefixes = append(readPrefixes, readPrefix)
+				if len(readPrefix) > len(longestPrefix) {
+					longestPrefix = readPrefix
+				}
+			}
+
+			// Objects under the read prefixes are served on misses but never written to.
+			// They live in the same deployment and bucket as --prefix.
+			newBucket := func(bucketName string) (storage.MultipartBlobStorageBackend, error) {
+				backend, err := newS3Backend(ctx, bucketName, prefix, clientOpts, server.s3Options()...)
+				if err != nil {
+					return nil, err
+				}
+				var readLayers []storage.BlobStorageBackend
+				for _, readPrefix := range readPrefixes {
+					readLayer, err := newS3Backend(ctx, bucketName, readPrefix, clientOpts, server.s3Options()...)
+					if err != nil {
+						return nil, fmt.Errorf("read prefix %q: %w", readPrefix, err)
+					}
+					readLayers = append(readLayers, readLayer)
+				}
+				return storage.NewLayeredStorage(backend, readLayers...), nil
+			}
+
+			backend, err := newBucket(bucketName)
+			if err != nil {
+				return nil, nil, err
+			}
+			routes, err := parseBucketRoutes(opts.bucketRoutes)
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(routes) > 0 {
+				backends := []storage.MultipartBlobStorageBackend{backend}
+				backendIndexes := map[string]int{bucketName: 0}
+				keyRoutes := map[string]int{}
+				for _, route := range routes {
+					index, ok := backendIndexes[route.bucket]
+					if !ok {
+						routed, err := newBucket(route.bucket)
+						if err != nil {
+							return nil, nil, fmt.Errorf("bucket %q: %w", route.bucket, err)
+						}
+						index = len(backends)
+						backends = append(backends, routed)
+						backendIndexes[route.bucket] = index
+					}
+					keyRoutes[route.prefix] = index
+				}
+				if backend, err = storage.NewRoutingStorage(storage.RouteByPrefix(keyRoutes, 0), backends...); err != nil {
+					return nil, nil, err
+				}
+			}
+
+			// S3's key length limit includes the prefix and the slash after it.
+			maxKeyBytes := storage.MaxS3KeyBytes
+			if longestPrefix != "" {
+				maxKeyBytes -= len(longestPrefix) + 1
+			}
+			if maxKeyBytes <= 0 {
+				return nil, nil, fmt.Errorf("key prefix %q leaves no room for keys", longestPrefix)
+			}
+			return storage.NewLongKeyStorage(backend, maxKeyBytes, opts.hashLongKeys), func() {}, nil
+		},
+	},
+	"filesystem": {
+		validate: func(opts *backendOptions) error {
+			if strings.TrimSpace(opts.fsDir) == "" {
+				return fmt.Errorf("missing required directory: set --fs-dir")
+			}
+			return nil
+		},
+		name: func(opts *backendOptions) string {
+			return strings.TrimSpace(opts.fsDir)
+		},
+		new: func(_ context.Context, opts *backendOptions, _ *serverOptions) (storage.MultipartBlobStorageBackend, func(), error) {
+			backend, err := storage.NewFilesystemStorage(strings.TrimSpace(opts.fsDir))
+			if err != nil {
+				return nil, nil, err
+			}
+			return backend, func() { _ = backend.Close() }, nil
+		},
+	},
+	"memory": {
+		validate: func(*backendOptions) error {
+			return nil
+		},
+		name: func(*backendOptions) string {
+			return "memory"
+		},
+		new: func(context.Context, *backendOptions, *serverOptions) (storage.MultipartBlobStorageBackend, func(), error) {
+			backend, err := storage.NewMemoryStorage()
+			if err != nil {
+				return nil, nil, err
+			}
+			return backend, func() { _ = backend.Close() }, nil
+		},
+	},
+}
+
+func backendKinds() []string {
+	kinds := make([]string, 0, len(backendFactories))
+	for kind := range backendFactories {
+		kinds = append(kinds, kind)
+	}
+	slices.Sort(kinds)
+	return kinds
+}
+
+func (opts *backendOptions) addFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&opts.kind, "backend", defaultBackend, "Storage backend: "+strings.Join(backendKinds(), ", "))
+	flags.StringVar(&opts.bucketName, "bucket", opts.bucketName, "S3 bucket name (s3 backend)")
+	flags.StringVar(&opts.deploymentPrefix, "deployment-prefix", os.Getenv("OMNI_CACHE_DEPLOYMENT_PREFIX"),
+		"Top-level S3 key prefix, e.g. staging, that --prefix and --read-prefix are nested under, keeping deployments sharing a bucket apart (defaults to $OMNI_CACHE_DEPLOYMENT_PREFIX; s3 backend)")
+	setFlagEnv(flags, "deployment-prefix", "OMNI_CACHE_DEPLOYMENT_PREFIX")
+	flags.StringVar(&opts.prefix, "prefix", opts.prefix, "S3 object key prefix (s3 backend)")
+	flags.StringArrayVar(&opts.readPrefixes, "read-prefix", opts.readPrefixes,
+		"S3 object key prefix to fall back to on cache misses, without writing to it; repeatable, checked in order (s3 backend)")
+	flags.StringArrayVar(&opts.bucketRoutes, "bucket-route", opts.bucketRoutes,
+		"Store cache keys starting with a prefix in another bucket, as prefix=bucket (e.g. gha/=ci-cache-gha); repeatable, the longest matching prefix wins (s3 backend)")
+	flags.BoolVar(&opts.hashLongKeys, "hash-long-keys", opts.hashLongKeys,
+		"Store cache keys too long for S3 under a hash of the full key instead of rejecting them (s3 backend)")
+	flags.StringVar(&opts.s3Endpoint, "s3-endpoint", os.Getenv("OMNI_CACHE_S3_ENDPOINT"),
+		"S3 endpoint override, e.g. https://s3.example.com (defaults to $OMNI_CACHE_S3_ENDPOINT; s3 backend)")
+	setFlagEnv(flags, "s3-endpoint", "OMNI_CACHE_S3_ENDPOINT")
+	flags.StringVar(&opts.s3Region, "s3-region", opts.s3Region, "S3 region, overriding $AWS_REGION and the shared AWS config (s3 backend)")
+	optionalBoolVar(flags, &opts.s3PathStyle, "s3-path-style",
+		"Address buckets in the URL path instead of the host name (defaults to true with --s3-endpoint and false for AWS; s3 backend)")
+	flags.StringVar(&opts.fsDir, "fs-dir", opts.fsDir, "Directory to store objects in (filesystem backend)")
+}
+
+// s3Client returns the options of the S3 clients of the s3 backend.
+func (opts *backendOptions) s3Client() s3ClientOptions {
+	return s3ClientOptions{endpoint: opts.s3Endpoint, region: opts.s3Region, pathStyle: opts.s3PathStyle}
+}
+
+// kvNamespace returns the kvNamespace of the storage the options select.
+func (opts *backendOptions) kvNamespace() string {
+	kind := strings.TrimSpace(opts.kind)
+	if kind == "" {
+		kind = defaultBackend
+	}
+	// The flags were validated by factory.
+	prefix, _ := storage.NormalizeKeyPrefix(opts.deploymentPrefix, opts.prefix)
+	return kvNamespace(kind, backendFactories[kind].name(opts), prefix)
+}
+
+// factory returns the factory selected with --backend after validating its flags.
+func (opts *backendOptions) factory() (backendFactory, error) {
+	kind := strings.TrimSpace(opts.kind)
+	if kind == "" {
+		kind = defaultBackend
+	}
+
+	factory, ok := backendFactories[kind]
+	if !ok {
+		return backendFactory{}, fmt.Errorf("unknown --backend %q: expected one of %s", kind, strings.Join(backendKinds(), ", "))
+	}
+	if len(opts.bucketRoutes) > 0 && kind != "s3" {
+		return backendFactory{}, fmt.Errorf("--bucket-route is only supported by the s3 backend")
+	}
+	if len(opts.readPrefixes) > 0 && kind != "s3" {
+		return backendFactory{}, fmt.Errorf("--read-prefix is only supported by the s3 backend")
+	}
+	if strings.TrimSpace(opts.deploymentPrefix) != "" && kind != "s3" {
+		return backendFactory{}, fmt.Errorf("--deployment-prefix is only supported by the s3 backend")
+	}
+	if opts.hashLongKeys && kind != "s3" {
+		return backendFactory{}, fmt.Errorf("--hash-long-keys is only supported by the s3 backend")
+	}
+	if err := factory.validate(opts); err != nil {
+		return backendFactory{}, fmt.Errorf("%s backend: %w", kind, err)
+	}
+	return factory, nil
+}
+
+// bucketRoute stores the keys starting with prefix in bucket.
+type bucketRoute struct {
+	prefix string
+	bucket string
+}
+
+func parseBucketRoutes(rawRoutes []string) ([]bucketRoute, error) {
+	routes := make([]bucketRoute, 0, len(rawRoutes))
+	seen := map[string]struct{}{}
+	for _, raw := range rawRoutes {
+		prefix, bucket, ok := strings.Cut(raw, "=")
+		prefix, bucket = strings.TrimPrefix(strings.TrimSpace(prefix), "/"), strings.TrimSpace(bucket)
+		if !ok || prefix == "" || bucket == "" {
+			return nil, fmt.Errorf("invalid --bucket-route %q: expected prefix=bucket", raw)
+		}
+		if _, ok := seen[prefix]; ok {
+			return nil, fmt.Errorf("invalid --bucket-route %q: prefix %q is routed twice", raw, prefix)
+		}
+		seen[prefix] = struct{}{}
+		routes = append(routes, bucketRoute{prefix: prefix, bucket: bucket})
+	}
+	return routes, nil
+}
@@ -0,0 +1,164 @@
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+const configFlagName = "config"
+
+// envFlagAnnotation records the environment variable a flag defaults to, so that a set
+// environment variable takes precedence over the config file.
+const envFlagAnnotation = "omni-cache/env"
+
+// setFlagEnv marks the flag name as defaulting to envVar.
+func setFlagEnv(flags *pflag.FlagSet, name string, envVar string) {
+	_ = flags.SetAnnotation(name, envFlagAnnotation, []string{envVar})
+}
+
+// addConfigFlag adds the --config flag, to be applied with applyConfigFile once the
+// command line is parsed.
+func addConfigFlag(flags *pflag.FlagSet, path *string) {
+	flags.StringVar(path, configFlagName, "",
+		"YAML file with flag values keyed by flag name, e.g. \"bucket: ci-cache\"; flags and their environment variables take precedence")
+}
+
+// applyConfigFile sets the flags that weren't passed on the command line to the values
+// in the YAML config file at path. Keys are flag names; repeatable flags take lists.
+// Flags defaulting to an environment variable that is set keep its value. Unknown keys
+// are rejected, so that typos don't go unnoticed.
+func applyConfigFile(flags *pflag.FlagSet, path string) error {
+	if path == "" {
+		return nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("--config: %w", err)
+	}
+
+	var values map[string]any
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	if err := decoder.Decode(&values); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("--config: parse %s: %w", path, err)
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		flag := flags.Lookup(name)
+		if flag == nil || name == configFlagName {
+			return fmt.Errorf("--config: unknown key %q in %s", name, path)
+		}
+		if flag.Changed || envIsSet(flag) {
+			continue
+		}
+		if err := setFlagFromConfig(flags, flag, values[name]); err != nil {
+			return fmt.Errorf("--config: key %q in %s: %w", name, path, err)
+		}
+	}
+
+	return nil
+}
+
+func envIsSet(flag *pflag.Flag) bool {
+	return slices.ContainsFunc(flag.Annotations[envFlagAnnotation], func(envVar string) bool {
+		return os.Getenv(envVar) != ""
+	})
+}
+
+func setFlagFromConfig(flags *pflag.FlagSet, flag *pflag.Flag, value any) error {
+	list, isList := value.([]any)
+	if !isList {
+		scalar, err := configScalar(value)
+		if err != nil {
+			return err
+		}
+		return flags.Set(flag.Name, scalar)
+	}
+
+	sliceValue, ok := flag.Value.(pflag.SliceValue)
+	if !ok {
+		return fmt.Errorf("expected a single value, got a list")
+	}
+	items := make([]string, 0, len(list))
+	for _, item := range list {
+		scalar, err := configScalar(item)
+		if err != nil {
+			return err
+		}
+		items = append(items, scalar)
+	}
+	if err := sliceValue.Replace(items); err != nil {
+		return err
+	}
+	flag.Changed = true
+	return nil
+}
+
+func configScalar(value any) (string, error) {
+	switch value := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return value, nil
+	case bool, int, float64:
+		return fmt.Sprint(value), nil
+	default:
+		return "", fmt.Errorf("expected a scalar value or a list of them")
+	}
+}
+
+// optionalBool is a boolean flag value that tells apart not being set, for flags whose
+// default depends on other flags.
+type optionalBool struct {
+	value bool
+	set   bool
+}
+
+// optionalBoolVar defines a boolean flag that, like pflag's own, may be passed without a value.
+func optionalBoolVar(flags *pflag.FlagSet, p *optionalBool, name string, usage string) {
+	flags.Var(p, name, usage)
+	flags.Lookup(name).NoOptDefVal = "true"
+}
+
+func (b *optionalBool) Set(value string) error {
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	b.value, b.set = parsed, true
+	return nil
+}
+
+func (b *optionalBool) String() string {
+	if !b.set {
+		return ""
+	}
+	return strconv.FormatBool(b.value)
+}
+
+func (b *optionalBool) Type() string {
+	return "bool"
+}
+
+// get returns the flag's value, or fallback when it wasn't set.
+func (b optionalBool) get(fallback bool) bool {
+	if !b.set {
+		return fallback
+	}
+	return b.value
+}
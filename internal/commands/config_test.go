@@ -0,0 +1,86 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/require"
+)
+
+func parseSidecarFlags(t *testing.T, config string, args ...string) (*sidecarOptions, error) {
+	t.Helper()
+
+	configPath := filepath.Join(t.TempDir(), "omni-cache.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(config), 0o600))
+
+	opts := &sidecarOptions{listenAddr: defaultListenAddr}
+	flags := pflag.NewFlagSet("sidecar", pflag.ContinueOnError)
+	opts.addFlags(flags)
+	require.NoError(t, flags.Parse(append([]string{"--config", configPath}, args...)))
+
+	return opts, applyConfigFile(flags, opts.configPath)
+}
+
+func TestConfigFile(t *testing.T) {
+	t.Setenv("OMNI_CACHE_AUTH_TOKEN", "")
+
+	opts, err := parseSidecarFlags(t, `
+bucket: ci-cache
+prefix: my-repo
+s3-endpoint: https://s3.example.com
+hash-long-keys: true
+cache-ttl: 72h
+max-download-urls: 3
+auth-token: from-config
+route:
+  - /gha=gha-cache
+  - /bazel=bazel
+`)
+	require.NoError(t, err)
+	require.Equal(t, "ci-cache", opts.backend.bucketName)
+	require.Equal(t, "my-repo", opts.backend.prefix)
+	require.Equal(t, "https://s3.example.com", opts.backend.s3Endpoint)
+	require.True(t, opts.backend.hashLongKeys)
+	require.Equal(t, 72*time.Hour, opts.server.cacheTTL)
+	require.Equal(t, 3, opts.server.maxDownloadURLs)
+	require.Equal(t, "from-config", opts.server.authToken)
+	require.Equal(t, []string{"/gha=gha-cache", "/bazel=bazel"}, opts.server.routes)
+	require.Equal(t, defaultListenAddr, opts.listenAddr)
+}
+
+func TestConfigFilePrecedence(t *testing.T) {
+	t.Setenv("OMNI_CACHE_AUTH_TOKEN", "from-env")
+
+	opts, err := parseSidecarFlags(t, `
+bucket: ci-cache
+prefix: my-repo
+auth-token: from-config
+route: [/gha=gha-cache]
+`, "--prefix", "from-flag", "--route", "/bazel=bazel")
+	require.NoError(t, err)
+	require.Equal(t, "ci-cache", opts.backend.bucketName)
+	require.Equal(t, "from-flag", opts.backend.prefix)
+	require.Equal(t, "from-env", opts.server.authToken)
+	require.Equal(t, []string{"/bazel=bazel"}, opts.server.routes)
+}
+
+func TestConfigFileRejectsInvalidKeys(t *testing.T) {
+	_, err := parseSidecarFlags(t, "bucket: ci-cache\nbuckte: typo\n")
+	require.ErrorContains(t, err, `unknown key "buckte"`)
+
+	_, err = parseSidecarFlags(t, "config: other.yaml\n")
+	require.ErrorContains(t, err, `unknown key "config"`)
+
+	_, err = parseSidecarFlags(t, "bucket: [a, b]\n")
+	require.ErrorContains(t, err, `key "bucket"`)
+
+	_, err = parseSidecarFlags(t, "cache-ttl: soon\n")
+	require.ErrorContains(t, err, `key "cache-ttl"`)
+
+	opts, err := parseSidecarFlags(t, "")
+	require.NoError(t, err)
+	require.Empty(t, opts.backend.bucketName)
+}
@@ -33,6 +33,7 @@ type devOptions struct {
 	bucketName      string
 	prefix          string
 	localstackImage string
+	server          serverOptions
 }
 
 func newDevCmd() *cobra.Command {
@@ -57,6 +58,7 @@ func newDevCmd() *cobra.Command {
 	cmd.Flags().StringVar(&opts.bucketName, "bucket", opts.bucketName, "S3 bucket name")
 	cmd.Flags().StringVar(&opts.prefix, "prefix", opts.prefix, "S3 object key prefix")
 	cmd.Flags().StringVar(&opts.localstackImage, "localstack-image", opts.localstackImage, "LocalStack container image")
+	opts.server.addFlags(cmd.Flags())
 
 	return cmd
 }
@@ -96,12 +98,16 @@ func runDev(ctx context.Context, opts *devOptions) error {
 		return err
 	}
 
-	backend, err := newS3BackendForClient(ctx, client, bucketName, prefixValue)
+	backend, err := newS3BackendForClient(ctx, client, bucketName, prefixValue, opts.server.s3Options()...)
+	if err != nil {
+		return err
+	}
+	backend, err = opts.server.quotas.wrap(backend, opts.server.protocols.bazelKeyPrefix)
 	if err != nil {
 		return err
 	}
 
-	return runServer(ctx, listenAddr, bucketName, backend)
+	return runServer(ctx, listenAddr, bucketName, kvNamespace("dev", bucketName, prefixValue), backend, &opts.server)
 }
 
 func startLocalstack(ctx context.Context, image string) (testcontainers.Container, string, error) {
@@ -164,16 +170,13 @@ func newLocalstackS3Client(ctx context.Context, endpoint string) (*s3.Client, er
 	}), nil
 }
 
-func newS3BackendForClient(ctx context.Context, client *s3.Client, bucketName, prefix string) (storage.MultipartBlobStorageBackend, error) {
+func newS3BackendForClient(ctx context.Context, client *s3.Client, bucketName, prefix string, s3Opts ...storage.S3Option) (storage.MultipartBlobStorageBackend, error) {
 	if client == nil {
 		return nil, fmt.Errorf("s3 client is nil")
 	}
 
 	prefix = strings.TrimSpace(prefix)
-	if prefix == "" {
-		return storage.NewS3Storage(ctx, client, bucketName)
-	}
-	return storage.NewS3Storage(ctx, client, bucketName, prefix)
+	return storage.NewS3StorageWithOptions(ctx, client, bucketName, append(s3Opts, storage.WithS3Prefix(prefix))...)
 }
 
 func terminateLocalstack(container testcontainers.Container) {
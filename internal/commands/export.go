@@ -0,0 +1,221 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+const exportManifestName = "manifest.json"
+
+type exportOptions struct {
+	backend   backendOptions
+	keyPrefix string
+	outDir    string
+}
+
+// exportManifest describes the objects written by the export command. Replay checks the
+// export directory against it.
+type exportManifest struct {
+	CreatedAt time.Time              `json:"created_at"`
+	Source    string                 `json:"source"`
+	KeyPrefix string                 `json:"key_prefix"`
+	Objects   []exportManifestObject `json:"objects"`
+}
+
+type exportManifestObject struct {
+	Key       string `json:"key"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
+func newExportCmd() *cobra.Command {
+	opts := &exportOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Download cache objects into a local directory for offline replay",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			// https://github.com/spf13/cobra/issues/340#issuecomment-374617413
+			cmd.SilenceUsage = true
+
+			return runExport(cmd.Context(), opts)
+		},
+	}
+
+	opts.backend.addFlags(cmd.Flags())
+	cmd.Flags().StringVar(&opts.keyPrefix, "key-prefix", opts.keyPrefix, "Export only cache keys starting with this prefix")
+	cmd.Flags().StringVar(&opts.outDir, "out", opts.outDir, "Directory to write the export into")
+
+	return cmd
+}
+
+func runExport(ctx context.Context, opts *exportOptions) error {
+	if opts == nil {
+		return fmt.Errorf("export options are nil")
+	}
+
+	factory, err := opts.backend.factory()
+	if err != nil {
+		return err
+	}
+	outDir := strings.TrimSpace(opts.outDir)
+	if outDir == "" {
+		return fmt.Errorf("missing required output directory: set --out")
+	}
+
+	source, release, err := factory.new(ctx, &opts.backend, nil)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	target, err := storage.NewFilesystemStorage(outDir)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	manifest, err := exportObjects(ctx, source, target, strings.TrimSpace(opts.keyPrefix))
+	if err != nil {
+		return err
+	}
+	manifest.Source = factory.name(&opts.backend)
+
+	if err := writeExportManifest(outDir, manifest); err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "export finished", "dir", outDir, "objects", len(manifest.Objects))
+	return nil
+}
+
+// exportObjects copies every object whose key starts with keyPrefix from source into target.
+func exportObjects(ctx context.Context, source storage.BlobStorageBackend, target *storage.FilesystemStorage, keyPrefix string) (*exportManifest, error) {
+	listable, ok := source.(storage.ListableBlobStorageBackend)
+	if !ok {
+		return nil, fmt.Errorf("storage backend does not support listing")
+	}
+
+	var keys []string
+	if err := listable.List(ctx, keyPrefix, func(object storage.ObjectInfo) error {
+		keys = append(keys, object.Key)
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("list %q: %w", keyPrefix, err)
+	}
+
+	manifest := &exportManifest{
+		CreatedAt: time.Now().UTC(),
+		KeyPrefix: keyPrefix,
+		Objects:   make([]exportManifestObject, 0, len(keys)),
+	}
+
+	for _, key := range keys {
+		sizeBytes, err := exportObject(ctx, source, target, key)
+		if err != nil {
+			return nil, fmt.Errorf("export %q: %w", key, err)
+		}
+		manifest.Objects = append(manifest.Objects, exportManifestObject{Key: key, SizeBytes: sizeBytes})
+	}
+
+	return manifest, nil
+}
+
+// exportObject copies the stored bytes of key as they are, keeping the Content-Encoding
+// they were uploaded with, so that replay serves compressed objects like storage does.
+func exportObject(ctx context.Context, source storage.BlobStorageBackend, target *storage.FilesystemStorage, key string) (int64, error) {
+	info, err := source.CacheInfo(ctx, key, nil)
+	if err != nil {
+		return 0, err
+	}
+	urls, err := source.DownloadURLs(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	if len(urls) == 0 {
+		return 0, storage.ErrCacheNotFound
+	}
+
+	downloadReq, err := http.NewRequestWithContext(ctx, http.MethodGet, urls[0].URL, nil)
+	if err != nil {
+		return 0, err
+	}
+	for name, value := range urls[0].ExtraHeaders {
+		downloadReq.Header.Set(name, value)
+	}
+	// Asking for the identity encoding keeps the HTTP client from decoding gzip bodies.
+	downloadReq.Header.Set("Accept-Encoding", "identity")
+	download, err := http.DefaultClient.Do(downloadReq)
+	if err != nil {
+		return 0, err
+	}
+	defer download.Body.Close()
+	if download.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("download returned status %d", download.StatusCode)
+	}
+
+	upload, err := target.UploadURL(ctx, key, info.Metadata)
+	if err != nil {
+		return 0, err
+	}
+	uploadReq, err := http.NewRequestWithContext(ctx, http.MethodPut, upload.URL, download.Body)
+	if err != nil {
+		return 0, err
+	}
+	uploadReq.ContentLength = download.ContentLength
+	if encoding := download.Header.Get("Content-Encoding"); encoding != "" {
+		uploadReq.Header.Set("Content-Encoding", encoding)
+	}
+	resp, err := http.DefaultClient.Do(uploadReq)
+	if err != nil {
+		return 0, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("writing the export returned status %d", resp.StatusCode)
+	}
+
+	return info.SizeBytes, nil
+}
+
+func writeExportManifest(dir string, manifest *exportManifest) error {
+	payload, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, exportManifestName), append(payload, '\n'), 0o644)
+}
+
+// checkExportManifest reports objects listed in the manifest of the export in dir that
+// are missing from backend or have a different size, such as after an interrupted copy.
+func checkExportManifest(ctx context.Context, dir string, backend storage.BlobStorageBackend) error {
+	payload, err := os.ReadFile(filepath.Join(dir, exportManifestName))
+	if err != nil {
+		return fmt.Errorf("export manifest: %w", err)
+	}
+	var manifest exportManifest
+	if err := json.Unmarshal(payload, &manifest); err != nil {
+		return fmt.Errorf("export manifest: %w", err)
+	}
+
+	for _, object := range manifest.Objects {
+		info, err := backend.CacheInfo(ctx, object.Key, nil)
+		if err != nil {
+			return fmt.Errorf("exported object %q: %w", object.Key, err)
+		}
+		if info.SizeBytes != object.SizeBytes {
+			return fmt.Errorf("exported object %q is %d bytes, but the manifest lists %d", object.Key, info.SizeBytes, object.SizeBytes)
+		}
+	}
+	return nil
+}
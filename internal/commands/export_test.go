@@ -0,0 +1,118 @@
+package commands
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/cirruslabs/omni-cache/internal/testutil"
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestFilesystemStorage(t *testing.T, dir string) *storage.FilesystemStorage {
+	t.Helper()
+
+	backend, err := storage.NewFilesystemStorage(dir)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = backend.Close()
+	})
+	return backend
+}
+
+// getStored fetches the stored bytes of key and their Content-Encoding.
+func getStored(t *testing.T, backend storage.BlobStorageBackend, key string) (string, string) {
+	t.Helper()
+
+	urls, err := backend.DownloadURLs(t.Context(), key)
+	require.NoError(t, err)
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, urls[0].URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept-Encoding", "identity")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body), resp.Header.Get("Content-Encoding")
+}
+
+func TestExportAndReplayManifest(t *testing.T) {
+	sourceDir, outDir := t.TempDir(), t.TempDir()
+	source := newTestFilesystemStorage(t, sourceDir)
+
+	require.NoError(t, source.Put(t.Context(), "bazel/plain", strings.NewReader("plain"), map[string]string{"origin": "ci"}))
+	require.NoError(t, source.Put(t.Context(), "other/skipped", strings.NewReader("skipped"), nil))
+	upload, err := source.UploadURL(t.Context(), "bazel/compressed", nil)
+	require.NoError(t, err)
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodPut, upload.URL, strings.NewReader("zstd frames"))
+	require.NoError(t, err)
+	req.Header.Set("Content-Encoding", "zstd")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	cmd := newExportCmd()
+	cmd.SetArgs([]string{"--backend", "filesystem", "--fs-dir", sourceDir, "--key-prefix", "bazel/", "--out", outDir})
+	require.NoError(t, cmd.ExecuteContext(t.Context()))
+
+	exported := newTestFilesystemStorage(t, outDir)
+	info, err := exported.CacheInfo(t.Context(), "bazel/plain", nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"origin": "ci"}, info.Metadata)
+	body, encoding := getStored(t, exported, "bazel/compressed")
+	require.Equal(t, "zstd frames", body)
+	require.Equal(t, "zstd", encoding)
+	_, err = exported.CacheInfo(t.Context(), "other/skipped", nil)
+	require.ErrorIs(t, err, storage.ErrCacheNotFound)
+
+	require.NoError(t, checkExportManifest(t.Context(), outDir, exported))
+	require.NoError(t, exported.Delete(t.Context(), "bazel/plain"))
+	require.ErrorContains(t, checkExportManifest(t.Context(), outDir, exported), `exported object "bazel/plain"`)
+}
+
+func TestExportRejectsInvalidDeploymentPrefix(t *testing.T) {
+	t.Setenv("OMNI_CACHE_DEPLOYMENT_PREFIX", "../staging")
+
+	cmd := newExportCmd()
+	cmd.SetArgs([]string{"--bucket", "ci-cache", "--out", t.TempDir()})
+	require.ErrorContains(t, cmd.ExecuteContext(t.Context()), "invalid --deployment-prefix or --prefix")
+}
+
+func TestExportUsesDeploymentPrefix(t *testing.T) {
+	endpoint := testutil.S3Endpoint(t)
+	t.Setenv("AWS_ACCESS_KEY_ID", "id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "us-east-1")
+
+	client, err := newS3Client(aws.Config{}, s3ClientOptions{endpoint: endpoint})
+	require.NoError(t, err)
+	for prefix, key := range map[string]string{"staging/my-repo": "bazel/staging", "my-repo": "bazel/production"} {
+		backend, err := newS3BackendForClient(t.Context(), client, "ci-cache", prefix)
+		require.NoError(t, err)
+		upload, err := backend.UploadURL(t.Context(), key, nil)
+		require.NoError(t, err)
+		req, err := http.NewRequestWithContext(t.Context(), http.MethodPut, upload.URL, strings.NewReader(key))
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	outDir := t.TempDir()
+	cmd := newExportCmd()
+	cmd.SetArgs([]string{"--bucket", "ci-cache", "--s3-endpoint", endpoint, "--deployment-prefix", "/staging/",
+		"--prefix", "my-repo", "--key-prefix", "bazel/", "--out", outDir})
+	require.NoError(t, cmd.ExecuteContext(t.Context()))
+
+	exported := newTestFilesystemStorage(t, outDir)
+	body, _ := getStored(t, exported, "bazel/staging")
+	require.Equal(t, "bazel/staging", body)
+	_, err = exported.CacheInfo(t.Context(), "bazel/production", nil)
+	require.ErrorIs(t, err, storage.ErrCacheNotFound)
+}
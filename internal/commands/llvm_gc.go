@@ -0,0 +1,88 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/cirruslabs/omni-cache/internal/protocols/llvm_cache"
+	"github.com/spf13/cobra"
+)
+
+type llvmGCOptions struct {
+	backend     backendOptions
+	keyPrefix   string
+	rootsMaxAge time.Duration
+	gracePeriod time.Duration
+	dryRun      bool
+}
+
+func newLLVMGCCmd() *cobra.Command {
+	opts := &llvmGCOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "llvm-gc",
+		Short: "Delete LLVM compilation cache objects that no key-value entry reaches",
+		Long: "Marks the LLVM CAS objects reachable from the CAS IDs in key-value entries, following their " +
+			"references, and deletes the rest. It lists and reads the whole LLVM cache, so run it occasionally, " +
+			"e.g. from a scheduled job. Objects written within --grace-period are kept, so it's safe to run " +
+			"while sidecars serve builds.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			// https://github.com/spf13/cobra/issues/340#issuecomment-374617413
+			cmd.SilenceUsage = true
+
+			return runLLVMGC(cmd.Context(), opts)
+		},
+	}
+
+	opts.backend.addFlags(cmd.Flags())
+	cmd.Flags().StringVar(&opts.keyPrefix, "llvm-key-prefix", llvm_cache.DefaultKeyPrefix, "Top-level storage prefix for LLVM compilation cache objects (same as the sidecar's)")
+	cmd.Flags().DurationVar(&opts.rootsMaxAge, "roots-max-age", opts.rootsMaxAge, "Only keep objects reachable from key-value entries written within this long, and delete older entries (0 keeps every entry)")
+	cmd.Flags().DurationVar(&opts.gracePeriod, "grace-period", llvm_cache.DefaultGCGracePeriod, "Keep objects written within this long before the collection, and what they reference")
+	cmd.Flags().BoolVar(&opts.dryRun, "dry-run", opts.dryRun, "Report what would be deleted without deleting anything")
+
+	return cmd
+}
+
+func runLLVMGC(ctx context.Context, opts *llvmGCOptions) error {
+	if opts == nil {
+		return fmt.Errorf("llvm-gc options are nil")
+	}
+
+	factory, err := opts.backend.factory()
+	if err != nil {
+		return err
+	}
+	if opts.gracePeriod <= 0 {
+		return fmt.Errorf("--grace-period must be positive")
+	}
+
+	backend, release, err := factory.new(ctx, &opts.backend, nil)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	result, err := llvm_cache.CollectGarbage(ctx, backend, nil, llvm_cache.GCOptions{
+		KeyPrefix:   strings.TrimSpace(opts.keyPrefix),
+		RootsMaxAge: opts.rootsMaxAge,
+		GracePeriod: opts.gracePeriod,
+		DryRun:      opts.dryRun,
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "llvm-cache garbage collection finished",
+		"dry_run", opts.dryRun,
+		"roots", result.Roots,
+		"objects", result.Objects,
+		"reachable", result.Reachable,
+		"deleted_objects", result.DeletedObjects,
+		"deleted_bytes", result.DeletedBytes,
+		"deleted_values", result.DeletedValues)
+	return nil
+}
@@ -0,0 +1,30 @@
+package commands
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cirruslabs/omni-cache/internal/protocols/llvm_cache"
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLLVMGCUsesBackendFlags(t *testing.T) {
+	dir := t.TempDir()
+	backend := newTestFilesystemStorage(t, dir)
+	key := llvm_cache.DefaultKeyPrefix + "/cas/" + strings.Repeat("ab", 32)
+	require.NoError(t, backend.Put(t.Context(), key, strings.NewReader("unreachable"), nil))
+	time.Sleep(10 * time.Millisecond)
+
+	cmd := newLLVMGCCmd()
+	cmd.SetArgs([]string{"--backend", "filesystem", "--fs-dir", dir, "--grace-period", "1ms"})
+	require.NoError(t, cmd.ExecuteContext(t.Context()))
+
+	_, err := backend.CacheInfo(t.Context(), key, nil)
+	require.ErrorIs(t, err, storage.ErrCacheNotFound)
+
+	cmd = newLLVMGCCmd()
+	cmd.SetArgs([]string{"--bucket", "ci-cache", "--deployment-prefix", "staging/..", "--grace-period", "1ms"})
+	require.ErrorContains(t, cmd.ExecuteContext(t.Context()), "invalid --deployment-prefix or --prefix")
+}
@@ -0,0 +1,161 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/cirruslabs/omni-cache/internal/protocols/azureblob"
+	"github.com/cirruslabs/omni-cache/internal/protocols/bazel_remote"
+	"github.com/cirruslabs/omni-cache/internal/protocols/ghacache"
+	"github.com/cirruslabs/omni-cache/internal/protocols/ghacachev2"
+	"github.com/cirruslabs/omni-cache/internal/protocols/http_cache"
+	"github.com/cirruslabs/omni-cache/internal/protocols/llvm_cache"
+	"github.com/cirruslabs/omni-cache/internal/protocols/tuist_cache"
+	"github.com/cirruslabs/omni-cache/pkg/protocols/builtin"
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+	urlproxy "github.com/cirruslabs/omni-cache/pkg/url-proxy"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/pflag"
+)
+
+// protocolOptions holds per-protocol flags shared by the sidecar and dev commands.
+type protocolOptions struct {
+	bazelKeyPrefix           string
+	bazelUsageReportInterval time.Duration
+	bazelSpoolThreshold      string
+	bazelSkipDigestCheck     bool
+	bazelOriginTimeouts      bazel_remote.OriginTimeouts
+	bazelOriginPolicy        bazel_remote.OriginPolicy
+	bazelOriginRetries       storage.RetryPolicy
+	redisURL                 string
+	casExistingBlobs         string
+	ghaKeyPrefix             string
+	ghaRejectEmptyVersion    bool
+	llvmKeyPrefix            string
+	llvmMaxInlineBlobSize    string
+	tuistKeyPrefix           string
+	tuistAsyncPartUploads    int
+	tuistPartReadTimeout     time.Duration
+	tuistMaxPartSize         string
+	tuistPersistSessions     bool
+	downloadFlushInterval    time.Duration
+	httpContentDisposition   bool
+	downloadFlushBytes       string
+	commitRetries            int
+	commitRetryDelay         time.Duration
+}
+
+func (opts *protocolOptions) addFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&opts.bazelKeyPrefix, "bazel-key-prefix", bazel_remote.DefaultKeyPrefix, "Top-level storage prefix for Bazel CAS blobs and asset mappings")
+	flags.StringVar(&opts.ghaKeyPrefix, "gha-key-prefix", "", "Top-level storage prefix for GitHub Actions cache entries (v1 and v2); empty stores them at the bucket root")
+	flags.BoolVar(&opts.ghaRejectEmptyVersion, "gha-reject-empty-version", opts.ghaRejectEmptyVersion, "Reject GitHub Actions cache requests without a cache version instead of storing them under the \""+ghacache.EmptyVersionSentinel+"\" version")
+	flags.StringVar(&opts.llvmKeyPrefix, "llvm-key-prefix", llvm_cache.DefaultKeyPrefix, "Top-level storage prefix for LLVM compilation cache objects")
+	flags.StringVar(&opts.llvmMaxInlineBlobSize, "llvm-max-inline-blob-size", "0", "Reject LLVM CAS blobs sent inline that are larger than this, e.g. 1MiB; clients can still send them as file paths. gRPC already rejects requests over 4MiB, so larger values have no effect (0 disables)")
+	flags.DurationVar(&opts.downloadFlushInterval, "download-flush-interval", urlproxy.DefaultFlushPolicy.Interval, "Flush streamed downloads to the client at least this often (0 disables)")
+	flags.StringVar(&opts.downloadFlushBytes, "download-flush-bytes", humanize.IBytes(uint64(urlproxy.DefaultFlushPolicy.Bytes)), "Flush streamed downloads to the client after this many bytes (0 disables)")
+	flags.BoolVar(&opts.httpContentDisposition, "http-cache-content-disposition", opts.httpContentDisposition, "Record a filename on HTTP cache uploads and serve it as Content-Disposition: attachment on downloads")
+	flags.StringVar(&opts.tuistKeyPrefix, "tuist-key-prefix", "", "Top-level storage prefix for Tuist module artifacts; empty stores them at the bucket root")
+	flags.IntVar(&opts.tuistAsyncPartUploads, "tuist-async-part-uploads", opts.tuistAsyncPartUploads, "Acknowledge Tuist multipart parts before they reach storage, uploading up to this many in the background (0 uploads inline)")
+	flags.BoolVar(&opts.tuistPersistSessions, "tuist-persist-sessions", opts.tuistPersistSessions, "Keep Tuist multipart upload sessions in --redis-url too, so uploads can be completed after a sidecar restart")
+	flags.DurationVar(&opts.tuistPartReadTimeout, "tuist-part-read-timeout", time.Minute, "Fail Tuist part uploads with 408 when the client takes longer than this to send the part body (0 disables)")
+	flags.IntVar(&opts.commitRetries, "commit-retries", storage.DefaultCommitRetryPolicy.Retries, "Retry committing Tuist and GitHub Actions cache multipart uploads this many times after a transient storage failure (0 disables)")
+	flags.DurationVar(&opts.commitRetryDelay, "commit-retry-delay", storage.DefaultCommitRetryPolicy.BaseDelay, "Backoff before the first commit retry, doubled for every following retry")
+	flags.StringVar(&opts.tuistMaxPartSize, "tuist-max-part-size", humanize.IBytes(uint64(tuist_cache.DefaultMaxPartSizeBytes)), "Reject Tuist multipart parts larger than this with 413, e.g. 32MiB")
+	flags.StringVar(&opts.casExistingBlobs, "cas-existing-blobs", opts.casExistingBlobs, "What to do when a Bazel or LLVM CAS upload targets an already stored key: "+
+		string(storage.OverwriteExisting)+", "+string(storage.SkipExisting)+" or "+string(storage.SkipExistingVerifySize)+
+		" (empty uses "+string(storage.OverwriteExisting)+"; keep it for LLVM when running llvm-gc)")
+	flags.StringVar(&opts.redisURL, "redis-url", os.Getenv("OMNI_CACHE_REDIS_URL"), "Redis URL, e.g. redis://localhost:6379/0, to cache Bazel Remote Asset mappings in front of the storage backend, and to persist Tuist upload sessions with --tuist-persist-sessions (defaults to $OMNI_CACHE_REDIS_URL; empty disables)")
+	setFlagEnv(flags, "redis-url", "OMNI_CACHE_REDIS_URL")
+	flags.StringVar(&opts.bazelSpoolThreshold, "bazel-spool-threshold", humanize.IBytes(uint64(bazel_remote.DefaultSpoolThresholdBytes)), "Buffer Bazel ByteStream uploads up to this size in memory instead of spooling them to a temp file (0 spools every upload)")
+	flags.BoolVar(&opts.bazelSkipDigestCheck, "bazel-skip-digest-verification", false, "Trust the digest of Bazel ByteStream uploads instead of hashing them to verify it; only for trusted clients (sizes are still verified)")
+	flags.DurationVar(&opts.bazelOriginTimeouts.Dial, "bazel-origin-dial-timeout", bazel_remote.DefaultOriginTimeouts.Dial, "Timeout for connecting to origins fetched with the Bazel Remote Asset API (0 disables)")
+	flags.DurationVar(&opts.bazelOriginTimeouts.TLSHandshake, "bazel-origin-tls-timeout", bazel_remote.DefaultOriginTimeouts.TLSHandshake, "Timeout for the TLS handshake with origins fetched with the Bazel Remote Asset API (0 disables)")
+	flags.DurationVar(&opts.bazelOriginTimeouts.ResponseHeader, "bazel-origin-response-header-timeout", bazel_remote.DefaultOriginTimeouts.ResponseHeader, "Timeout for origins fetched with the Bazel Remote Asset API to send response headers (0 disables)")
+	flags.IntVar(&opts.bazelOriginRetries.Retries, "bazel-origin-retries", bazel_remote.DefaultOriginRetryPolicy.Retries, "Retry Bazel Remote Asset origin fetches this many times after a 429, 5xx or transient network error (0 disables)")
+	flags.DurationVar(&opts.bazelOriginRetries.BaseDelay, "bazel-origin-retry-delay", bazel_remote.DefaultOriginRetryPolicy.BaseDelay, "Backoff before the first Bazel origin fetch retry, doubled for every following retry")
+	flags.StringSliceVar(&opts.bazelOriginPolicy.Allow, "fetch-allow", nil, "Only fetch Bazel Remote Asset origins matching these hostnames (including subdomains), IPs or CIDR ranges; also allows loopback and link-local origins that match (repeatable)")
+	flags.StringSliceVar(&opts.bazelOriginPolicy.Deny, "fetch-deny", nil, "Refuse to fetch Bazel Remote Asset origins matching these hostnames (including subdomains), IPs or CIDR ranges (repeatable)")
+	flags.DurationVar(&opts.bazelUsageReportInterval, "bazel-usage-report-interval", opts.bazelUsageReportInterval, "Serve a per-instance Bazel CAS usage report at "+bazel_remote.UsageReportPath+", regenerated at most once per interval (0 disables)")
+}
+
+func (opts *protocolOptions) config() (builtin.Config, error) {
+	flushBytes, err := humanize.ParseBytes(opts.downloadFlushBytes)
+	if err != nil {
+		return builtin.Config{}, fmt.Errorf("invalid --download-flush-bytes %q: %w", opts.downloadFlushBytes, err)
+	}
+	llvmMaxInlineBlobBytes, err := humanize.ParseBytes(opts.llvmMaxInlineBlobSize)
+	if err != nil {
+		return builtin.Config{}, fmt.Errorf("invalid --llvm-max-inline-blob-size %q: %w", opts.llvmMaxInlineBlobSize, err)
+	}
+	bazelSpoolThreshold, err := humanize.ParseBytes(opts.bazelSpoolThreshold)
+	if err != nil {
+		return builtin.Config{}, fmt.Errorf("invalid --bazel-spool-threshold %q: %w", opts.bazelSpoolThreshold, err)
+	}
+	if opts.tuistPersistSessions && opts.redisURL == "" {
+		return builtin.Config{}, fmt.Errorf("--tuist-persist-sessions requires --redis-url")
+	}
+	tuistMaxPartSize, err := humanize.ParseBytes(opts.tuistMaxPartSize)
+	if err != nil {
+		return builtin.Config{}, fmt.Errorf("invalid --tuist-max-part-size %q: %w", opts.tuistMaxPartSize, err)
+	}
+	// Left empty, each protocol picks its own default.
+	var casExistingBlobs storage.ExistingObjectPolicy
+	if opts.casExistingBlobs != "" {
+		casExistingBlobs, err = storage.ParseExistingObjectPolicy(opts.casExistingBlobs)
+		if err != nil {
+			return builtin.Config{}, fmt.Errorf("invalid --cas-existing-blobs: %w", err)
+		}
+	}
+	flushPolicy := &urlproxy.FlushPolicy{
+		Interval: opts.downloadFlushInterval,
+		Bytes:    int64(flushBytes),
+	}
+	commitRetries := storage.RetryPolicy{
+		Retries:   opts.commitRetries,
+		BaseDelay: opts.commitRetryDelay,
+	}
+
+	return builtin.Config{
+		AzureBlob: azureblob.Options{
+			FlushPolicy:   flushPolicy,
+			CommitRetries: commitRetries,
+		},
+		BazelRemote: bazel_remote.Options{
+			KeyPrefix:              opts.bazelKeyPrefix,
+			UsageReportInterval:    opts.bazelUsageReportInterval,
+			ExistingBlobs:          casExistingBlobs,
+			SpoolThresholdBytes:    int64(bazelSpoolThreshold),
+			SkipDigestVerification: opts.bazelSkipDigestCheck,
+			OriginTimeouts:         opts.bazelOriginTimeouts,
+			OriginPolicy:           opts.bazelOriginPolicy,
+			OriginRetries:          opts.bazelOriginRetries,
+		},
+		GHACache: ghacache.Options{
+			KeyPrefix:          opts.ghaKeyPrefix,
+			RejectEmptyVersion: opts.ghaRejectEmptyVersion,
+			CommitRetries:      commitRetries,
+		},
+		GHACacheV2: ghacachev2.Options{
+			KeyPrefix:          opts.ghaKeyPrefix,
+			RejectEmptyVersion: opts.ghaRejectEmptyVersion,
+		},
+		HTTPCache: http_cache.Options{
+			FlushPolicy:        flushPolicy,
+			ContentDisposition: opts.httpContentDisposition,
+		},
+		LLVMCache: llvm_cache.Options{
+			KeyPrefix:          opts.llvmKeyPrefix,
+			MaxInlineBlobBytes: int64(llvmMaxInlineBlobBytes),
+			ExistingObjects:    casExistingBlobs,
+		},
+		TuistCache: tuist_cache.Options{
+			KeyPrefix:        opts.tuistKeyPrefix,
+			FlushPolicy:      flushPolicy,
+			AsyncPartUploads: opts.tuistAsyncPartUploads,
+			PartReadTimeout:  opts.tuistPartReadTimeout,
+			MaxPartSizeBytes: int64(tuistMaxPartSize),
+			CommitRetries:    commitRetries,
+		},
+	}, nil
+}
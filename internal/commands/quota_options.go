@@ -0,0 +1,82 @@
+package commands
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cirruslabs/omni-cache/internal/protocols/bazel_remote"
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/pflag"
+)
+
+const defaultQuotaRefreshInterval = time.Minute
+
+// quotaOptions holds storage quota flags shared by the sidecar and dev commands.
+type quotaOptions struct {
+	prefixQuotas        []string
+	bazelInstanceQuotas []string
+	refreshInterval     time.Duration
+}
+
+func (opts *quotaOptions) addFlags(flags *pflag.FlagSet) {
+	opts.refreshInterval = defaultQuotaRefreshInterval
+
+	flags.StringArrayVar(&opts.prefixQuotas, "quota", opts.prefixQuotas, "Storage quota for a key prefix as prefix=size (e.g. gha=50GiB); repeatable")
+	flags.StringArrayVar(&opts.bazelInstanceQuotas, "bazel-instance-quota", opts.bazelInstanceQuotas, "Storage quota for a Bazel instance name's CAS as instance=size; repeatable")
+	flags.DurationVar(&opts.refreshInterval, "quota-refresh-interval", opts.refreshInterval, "How often quota usage is re-measured by listing the bucket")
+}
+
+func (opts *quotaOptions) quotas(bazelKeyPrefix string) ([]storage.Quota, error) {
+	quotas := make([]storage.Quota, 0, len(opts.prefixQuotas)+len(opts.bazelInstanceQuotas))
+
+	for _, raw := range opts.prefixQuotas {
+		prefix, limit, err := parseQuota(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --quota %q: %w", raw, err)
+		}
+		quotas = append(quotas, storage.Quota{Prefix: strings.TrimPrefix(prefix, "/"), LimitBytes: limit})
+	}
+
+	for _, raw := range opts.bazelInstanceQuotas {
+		instanceName, limit, err := parseQuota(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --bazel-instance-quota %q: %w", raw, err)
+		}
+		quotas = append(quotas, storage.Quota{Prefix: bazel_remote.CASInstancePrefix(bazelKeyPrefix, instanceName), LimitBytes: limit})
+	}
+
+	return quotas, nil
+}
+
+// wrap applies the configured quotas to backend, returning it unchanged when none are set.
+// Bazel instance quotas are resolved against bazelKeyPrefix.
+func (opts *quotaOptions) wrap(backend storage.MultipartBlobStorageBackend, bazelKeyPrefix string) (storage.MultipartBlobStorageBackend, error) {
+	quotas, err := opts.quotas(bazelKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if len(quotas) == 0 {
+		return backend, nil
+	}
+
+	return storage.NewQuotaStorage(backend, opts.refreshInterval, quotas...)
+}
+
+func parseQuota(raw string) (string, int64, error) {
+	name, size, ok := strings.Cut(raw, "=")
+	if !ok {
+		return "", 0, fmt.Errorf("expected name=size")
+	}
+
+	limit, err := humanize.ParseBytes(strings.TrimSpace(size))
+	if err != nil {
+		return "", 0, err
+	}
+	if limit == 0 {
+		return "", 0, fmt.Errorf("size must be positive")
+	}
+
+	return strings.TrimSpace(name), int64(limit), nil
+}
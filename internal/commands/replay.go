@@ -0,0 +1,79 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+type replayOptions struct {
+	listenAddr string
+	fromDir    string
+	server     serverOptions
+}
+
+func newReplayCmd() *cobra.Command {
+	opts := &replayOptions{
+		listenAddr: defaultListenAddr,
+	}
+
+	cmd := &cobra.Command{
+		Use:   "replay",
+		Short: "Start the cache daemon backed by a directory written by export",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			// https://github.com/spf13/cobra/issues/340#issuecomment-374617413
+			cmd.SilenceUsage = true
+
+			return runReplay(cmd.Context(), opts)
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.listenAddr, "listen-addr", opts.listenAddr, "Listen address for HTTP/gRPC (host, host:port, or http(s)://host:port)")
+	cmd.Flags().StringVar(&opts.fromDir, "from", opts.fromDir, "Directory previously written by the export command")
+	opts.server.addFlags(cmd.Flags())
+
+	return cmd
+}
+
+func runReplay(ctx context.Context, opts *replayOptions) error {
+	if opts == nil {
+		return fmt.Errorf("replay options are nil")
+	}
+
+	fromDir := strings.TrimSpace(opts.fromDir)
+	if fromDir == "" {
+		return fmt.Errorf("missing required export directory: set --from")
+	}
+	if _, err := os.Stat(fromDir); err != nil {
+		return fmt.Errorf("export directory: %w", err)
+	}
+
+	listenAddr, err := resolveListenAddr(opts.listenAddr)
+	if err != nil {
+		return err
+	}
+
+	fsBackend, err := storage.NewFilesystemStorage(fromDir)
+	if err != nil {
+		return err
+	}
+	defer fsBackend.Close()
+	if err := checkExportManifest(ctx, fromDir, fsBackend); err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "replaying cache from export", "dir", fromDir)
+
+	backend, err := opts.server.quotas.wrap(fsBackend, opts.server.protocols.bazelKeyPrefix)
+	if err != nil {
+		return err
+	}
+
+	return runServer(ctx, listenAddr, fromDir, kvNamespace("replay", fromDir), backend, &opts.server)
+}
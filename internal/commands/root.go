@@ -16,6 +16,10 @@ func NewRootCmd() *cobra.Command {
 
 	cmd.AddCommand(newSidecarCmd())
 	cmd.AddCommand(newDevCmd())
+	cmd.AddCommand(newExportCmd())
+	cmd.AddCommand(newReplayCmd())
+	cmd.AddCommand(newLLVMGCCmd())
+	cmd.AddCommand(newVersionCmd())
 
 	return cmd
 }
@@ -4,8 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -16,11 +18,17 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/cirruslabs/omni-cache/internal/protocols/bazel_remote"
+	"github.com/cirruslabs/omni-cache/internal/protocols/tuist_cache"
+	"github.com/cirruslabs/omni-cache/pkg/backpressure"
+	"github.com/cirruslabs/omni-cache/pkg/errdetail"
+	"github.com/cirruslabs/omni-cache/pkg/kvstore"
 	"github.com/cirruslabs/omni-cache/pkg/protocols/builtin"
 	"github.com/cirruslabs/omni-cache/pkg/server"
 	"github.com/cirruslabs/omni-cache/pkg/stats"
 	"github.com/cirruslabs/omni-cache/pkg/storage"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 const (
@@ -32,10 +40,10 @@ const (
 )
 
 type sidecarOptions struct {
+	configPath string
 	listenAddr string
-	bucketName string
-	prefix     string
-	s3Endpoint string
+	backend    backendOptions
+	server     serverOptions
 }
 
 func newSidecarCmd() *cobra.Command {
@@ -51,50 +59,87 @@ func newSidecarCmd() *cobra.Command {
 			// https://github.com/spf13/cobra/issues/340#issuecomment-374617413
 			cmd.SilenceUsage = true
 
+			if err := applyConfigFile(cmd.Flags(), opts.configPath); err != nil {
+				return err
+			}
+
 			return runSidecar(cmd.Context(), opts)
 		},
 	}
 
-	cmd.Flags().StringVar(&opts.listenAddr, "listen-addr", opts.listenAddr, "Listen address for HTTP/gRPC (host, host:port, or http(s)://host:port)")
-	cmd.Flags().StringVar(&opts.bucketName, "bucket", opts.bucketName, "S3 bucket name")
-	cmd.Flags().StringVar(&opts.prefix, "prefix", opts.prefix, "S3 object key prefix")
-	cmd.Flags().StringVar(&opts.s3Endpoint, "s3-endpoint", opts.s3Endpoint, "S3 endpoint override (e.g. https://s3.example.com)")
+	opts.addFlags(cmd.Flags())
 
 	return cmd
 }
 
+func (opts *sidecarOptions) addFlags(flags *pflag.FlagSet) {
+	addConfigFlag(flags, &opts.configPath)
+	flags.StringVar(&opts.listenAddr, "listen-addr", opts.listenAddr, "Listen address for HTTP/gRPC (host, host:port, or http(s)://host:port)")
+	opts.backend.addFlags(flags)
+	opts.server.addFlags(flags)
+}
+
 func runSidecar(ctx context.Context, opts *sidecarOptions) error {
 	if opts == nil {
 		return fmt.Errorf("sidecar options are nil")
 	}
 
-	bucketName := strings.TrimSpace(opts.bucketName)
-	if bucketName == "" {
-		return fmt.Errorf("missing required bucket: set --bucket")
+	factory, err := opts.backend.factory()
+	if err != nil {
+		return err
 	}
-	prefixValue := strings.TrimSpace(opts.prefix)
-	s3Endpoint := strings.TrimSpace(opts.s3Endpoint)
 
 	listenAddr, err := resolveListenAddr(opts.listenAddr)
 	if err != nil {
 		return err
 	}
 
-	backend, err := newS3Backend(ctx, bucketName, prefixValue, s3Endpoint)
+	backend, release, err := factory.new(ctx, &opts.backend, &opts.server)
+	if err != nil {
+		return err
+	}
+	defer release()
+	backend, err = opts.server.quotas.wrap(backend, opts.server.protocols.bazelKeyPrefix)
 	if err != nil {
 		return err
 	}
 
-	return runServer(ctx, listenAddr, bucketName, backend)
+	return runServer(ctx, listenAddr, factory.name(&opts.backend), opts.backend.kvNamespace(), backend, &opts.server)
 }
 
-func runServer(ctx context.Context, listenAddr, bucketName string, backend storage.MultipartBlobStorageBackend) error {
+// kvNamespace returns the prefix of the keys a sidecar keeps in --redis-url, made of parts
+// identifying its storage, so that sidecars sharing a Redis server but not their storage
+// don't serve each other's entries.
+func kvNamespace(parts ...string) string {
+	namespace := "omni-cache/"
+	for _, part := range parts {
+		if part = strings.Trim(part, "/"); part != "" {
+			namespace += part + "/"
+		}
+	}
+	return namespace
+}
+
+// runServer serves backend. bucketName names it in logs, and namespace is the kvNamespace
+// of the storage.
+func runServer(ctx context.Context, listenAddr, bucketName, namespace string, backend storage.MultipartBlobStorageBackend, opts *serverOptions) error {
 	if strings.TrimSpace(listenAddr) == "" {
 		return fmt.Errorf("listen address is empty")
 	}
 	if backend == nil {
 		return fmt.Errorf("storage backend is nil")
 	}
+	if opts == nil {
+		opts = &serverOptions{}
+	}
+	if opts.noSocket && (opts.socketPath != "" || opts.socketMode != "") {
+		return fmt.Errorf("--no-socket can't be combined with --socket-path or --socket-mode")
+	}
+	logger, err := opts.logger(os.Stderr)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
 
 	listeners := make([]net.Listener, 0, 2)
 	tcpListener, err := net.Listen("tcp", listenAddr)
@@ -108,8 +153,14 @@ func runServer(ctx context.Context, listenAddr, bucketName string, backend stora
 	actualAddr := tcpListener.Addr().String()
 
 	var socketPath string
-	if runtime.GOOS != "windows" {
-		unixListener, path, cleanup, err := listenUnixSocket()
+	if opts.noSocket {
+		slog.Info("unix socket disabled with --no-socket")
+	} else if runtime.GOOS != "windows" {
+		socketMode, err := opts.unixSocketMode()
+		if err != nil {
+			return err
+		}
+		unixListener, path, cleanup, err := listenUnixSocket(opts.socketPath, socketMode)
 		if err != nil {
 			return err
 		}
@@ -123,9 +174,75 @@ func runServer(ctx context.Context, listenAddr, bucketName string, backend stora
 		slog.Info("skipping unix socket on windows")
 	}
 
-	factories := builtin.Factories()
+	protocolConfig, err := opts.protocols.config()
+	if err != nil {
+		return err
+	}
+	if opts.protocols.redisURL != "" {
+		redisStore, err := kvstore.NewRedisStoreFromURL(opts.protocols.redisURL, 0)
+		if err != nil {
+			return fmt.Errorf("--redis-url: %w", err)
+		}
+		defer func() {
+			_ = redisStore.Close()
+		}()
+		protocolConfig.BazelRemote.MappingStore = kvstore.WithPrefix(redisStore.WithTTL(bazel_remote.DefaultMappingStoreTTL), namespace)
+		if opts.protocols.tuistPersistSessions {
+			protocolConfig.TuistCache.SessionStore = kvstore.WithPrefix(redisStore.WithTTL(tuist_cache.DefaultUploadSessionTTL), namespace)
+		}
+	}
+	errorDetail, err := errdetail.ParseMode(opts.errorDetail)
+	if err != nil {
+		return fmt.Errorf("invalid --error-detail: %w", err)
+	}
+	routes, err := opts.serverRoutes()
+	if err != nil {
+		return err
+	}
+	maxAges, err := opts.serverMaxAges()
+	if err != nil {
+		return err
+	}
+	maxUploads, err := opts.serverMaxConcurrentUploads()
+	if err != nil {
+		return err
+	}
+	hitMiss, err := opts.serverHitMiss()
+	if err != nil {
+		return err
+	}
+	proxyOpts, err := opts.proxyOptions()
+	if err != nil {
+		return err
+	}
+	urlSigner, err := opts.urlSigner()
+	if err != nil {
+		return err
+	}
+	if opts.topKeys > 0 && opts.adminToken == "" {
+		return fmt.Errorf("--top-keys requires --admin-token")
+	}
+	factories := builtin.FactoriesWithConfig(protocolConfig)
 	serverCtx := context.WithoutCancel(ctx)
-	srv, err := server.Start(serverCtx, listeners, backend, factories...)
+	backend = storage.NewExpiringStorage(backend, opts.cacheTTL)
+	backend = storage.NewURLLimitStorage(backend, opts.maxDownloadURLs)
+	monitor := backpressure.NewMonitor(opts.backpressure())
+	srv, err := server.StartWithOptions(serverCtx, listeners, monitor.Storage(backend), server.Options{
+		Middleware:           []func(http.Handler) http.Handler{monitor.Handler},
+		ErrorDetail:          errorDetail,
+		ProxyOptions:         proxyOpts,
+		Routes:               routes,
+		MaxAge:               maxAges,
+		HitMiss:              hitMiss,
+		AdminToken:           opts.adminToken,
+		TopKeys:              opts.topKeys,
+		AuthToken:            opts.authToken,
+		ReadOnly:             opts.readOnly,
+		URLSigner:            urlSigner,
+		AccessLog:            opts.logRequests,
+		MaxConcurrentUploads: maxUploads,
+		AssertObjectProtocol: opts.assertObjectProtocol,
+	}, factories...)
 	if err != nil {
 		return err
 	}
@@ -145,6 +262,9 @@ func runServer(ctx context.Context, listenAddr, bucketName string, backend stora
 
 	shutdownErr := srv.Shutdown(shutdownCtx)
 	stats.Default().LogSummary()
+	if opts.report {
+		_, _ = io.WriteString(os.Stderr, stats.FormatReport(stats.Default().Snapshot()))
+	}
 	if shutdownErr != nil {
 		return fmt.Errorf("shutdown: %w", shutdownErr)
 	}
@@ -178,60 +298,87 @@ func resolveListenAddr(rawAddr string) (string, error) {
 	return addr, nil
 }
 
-func newS3Backend(ctx context.Context, bucketName, prefix, s3Endpoint string) (storage.MultipartBlobStorageBackend, error) {
+// s3ClientOptions configure how the S3 client reaches the bucket.
+type s3ClientOptions struct {
+	// endpoint overrides the S3 endpoint URL.
+	endpoint string
+	// region overrides the region resolved by the AWS SDK.
+	region string
+	// pathStyle addresses buckets as part of the path instead of the host name. Defaults
+	// to path-style for custom endpoints and virtual-hosted style for AWS.
+	pathStyle optionalBool
+}
+
+func newS3Backend(ctx context.Context, bucketName, prefix string, clientOpts s3ClientOptions, s3Opts ...storage.S3Option) (storage.MultipartBlobStorageBackend, error) {
 	cfg, err := config.LoadDefaultConfig(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("load aws config: %w", err)
 	}
-	if cfg.Region == "" {
-		cfg.Region = defaultAWSRegion
-	}
 
-	client, err := newS3Client(cfg, s3Endpoint)
+	client, err := newS3Client(cfg, clientOpts)
 	if err != nil {
 		return nil, err
 	}
-	if prefix == "" {
-		return storage.NewS3Storage(ctx, client, bucketName)
-	}
-	return storage.NewS3Storage(ctx, client, bucketName, prefix)
+	return storage.NewS3StorageWithOptions(ctx, client, bucketName, append(s3Opts, storage.WithS3Prefix(prefix))...)
 }
 
-func newS3Client(cfg aws.Config, s3Endpoint string) (*s3.Client, error) {
-	s3Endpoint = strings.TrimSpace(s3Endpoint)
-	if s3Endpoint == "" {
-		return s3.NewFromConfig(cfg), nil
+func newS3Client(cfg aws.Config, clientOpts s3ClientOptions) (*s3.Client, error) {
+	if region := strings.TrimSpace(clientOpts.region); region != "" {
+		cfg.Region = region
+	}
+	if cfg.Region == "" {
+		cfg.Region = defaultAWSRegion
 	}
 
-	parsed, err := url.Parse(s3Endpoint)
-	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
-		return nil, fmt.Errorf("s3 endpoint must be a full URL, got %q", s3Endpoint)
+	s3Endpoint := strings.TrimSpace(clientOpts.endpoint)
+	if s3Endpoint != "" {
+		parsed, err := url.Parse(s3Endpoint)
+		if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			return nil, fmt.Errorf("s3 endpoint must be a full URL, got %q", s3Endpoint)
+		}
 	}
 
+	// Most S3-compatible servers only route path-style requests, while AWS prefers
+	// virtual-hosted style.
+	usePathStyle := clientOpts.pathStyle.get(s3Endpoint != "")
+
 	client := s3.NewFromConfig(cfg, func(options *s3.Options) {
-		options.BaseEndpoint = aws.String(s3Endpoint)
-		options.UsePathStyle = true
+		if s3Endpoint != "" {
+			options.BaseEndpoint = aws.String(s3Endpoint)
+		}
+		options.UsePathStyle = usePathStyle
 	})
 	return client, nil
 }
 
-func listenUnixSocket() (net.Listener, string, func(), error) {
-	socketPath, err := server.DefaultSocketPath()
-	if err != nil {
-		return nil, "", nil, err
+// listenUnixSocket listens on the unix socket at socketPath, or the default path when
+// empty, and applies mode to it unless it's zero.
+func listenUnixSocket(socketPath string, mode os.FileMode) (net.Listener, string, func(), error) {
+	if socketPath == "" {
+		var err error
+		socketPath, err = server.DefaultSocketPath()
+		if err != nil {
+			return nil, "", nil, err
+		}
 	}
 
 	if err := os.MkdirAll(filepath.Dir(socketPath), 0o700); err != nil {
 		return nil, "", nil, fmt.Errorf("create socket dir: %w", err)
 	}
-	if err := os.Remove(socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
-		return nil, "", nil, fmt.Errorf("remove stale socket: %w", err)
+	if err := removeStaleSocket(socketPath); err != nil {
+		return nil, "", nil, err
 	}
 
 	listener, err := net.Listen("unix", socketPath)
 	if err != nil {
 		return nil, "", nil, fmt.Errorf("listen on unix socket: %w", err)
 	}
+	if mode != 0 {
+		if err := os.Chmod(socketPath, mode); err != nil {
+			_ = listener.Close()
+			return nil, "", nil, fmt.Errorf("set unix socket mode: %w", err)
+		}
+	}
 
 	cleanup := func() {
 		_ = os.Remove(socketPath)
@@ -239,3 +386,27 @@ func listenUnixSocket() (net.Listener, string, func(), error) {
 
 	return listener, socketPath, cleanup, nil
 }
+
+// removeStaleSocket removes a socket left behind at socketPath by a previous run. Since
+// the path may be user-provided, anything else at it is left alone, and so is a socket
+// that another process is still serving.
+func removeStaleSocket(socketPath string) error {
+	info, err := os.Lstat(socketPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("check stale socket: %w", err)
+	}
+	if info.Mode().Type() != os.ModeSocket {
+		return fmt.Errorf("socket path %s exists and is not a unix socket", socketPath)
+	}
+	if conn, err := net.DialTimeout("unix", socketPath, time.Second); err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("socket path %s is in use by another process", socketPath)
+	}
+	if err := os.Remove(socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove stale socket: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+//go:build !windows
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSidecarOptions(t *testing.T, args ...string) *sidecarOptions {
+	t.Helper()
+
+	opts := &sidecarOptions{listenAddr: defaultListenAddr}
+	flags := pflag.NewFlagSet("sidecar", pflag.ContinueOnError)
+	opts.addFlags(flags)
+	require.NoError(t, flags.Parse(append([]string{"--backend", "memory", "--listen-addr", "127.0.0.1:0"}, args...)))
+	return opts
+}
+
+// shortSocketDir returns a directory for unix sockets, whose paths are limited to about
+// 100 bytes.
+func shortSocketDir(t *testing.T) string {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("/tmp", "omni-cache-")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+	return dir
+}
+
+func TestSidecarCustomSocket(t *testing.T) {
+	socketPath := filepath.Join(shortSocketDir(t), "nested", "cache.sock")
+	opts := newTestSidecarOptions(t, "--socket-path", socketPath, "--socket-mode", "0600")
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan error, 1)
+	go func() {
+		done <- runSidecar(ctx, opts)
+	}()
+
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(socketPath)
+		return err == nil
+	}, 10*time.Second, 10*time.Millisecond)
+
+	info, err := os.Stat(socketPath)
+	require.NoError(t, err)
+	require.Equal(t, os.ModeSocket, info.Mode().Type())
+	require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socketPath)
+		},
+	}}
+	response, err := client.Get("http://omni-cache/_omni/health")
+	require.NoError(t, err)
+	require.NoError(t, response.Body.Close())
+	require.Equal(t, http.StatusOK, response.StatusCode)
+
+	// A second sidecar doesn't take over the socket of a running one.
+	require.ErrorContains(t, runSidecar(t.Context(), newTestSidecarOptions(t, "--socket-path", socketPath)), "in use")
+
+	cancel()
+	require.NoError(t, <-done)
+	_, err = os.Stat(socketPath)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestListenUnixSocketReplacesStaleSockets(t *testing.T) {
+	socketPath := filepath.Join(shortSocketDir(t), "stale.sock")
+
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+	require.NoError(t, err)
+	stale.SetUnlinkOnClose(false)
+	require.NoError(t, stale.Close())
+
+	listener, _, cleanup, err := listenUnixSocket(socketPath, 0)
+	require.NoError(t, err)
+	require.NoError(t, listener.Close())
+	cleanup()
+}
+
+func TestListenUnixSocketKeepsOtherFiles(t *testing.T) {
+	path := filepath.Join(shortSocketDir(t), "not-a-socket")
+	require.NoError(t, os.WriteFile(path, []byte("data"), 0o600))
+
+	_, _, _, err := listenUnixSocket(path, 0)
+	require.ErrorContains(t, err, "not a unix socket")
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "data", string(content))
+}
+
+func TestSocketFlagValidation(t *testing.T) {
+	err := runSidecar(t.Context(), newTestSidecarOptions(t, "--no-socket", "--socket-path", "/tmp/x.sock"))
+	require.ErrorContains(t, err, "--no-socket")
+
+	err = runSidecar(t.Context(), newTestSidecarOptions(t, "--socket-path", filepath.Join(shortSocketDir(t), "x.sock"), "--socket-mode", "rw"))
+	require.ErrorContains(t, err, "--socket-mode")
+}
+
+func TestServerLoggerLevel(t *testing.T) {
+	var buffer bytes.Buffer
+	opts := &serverOptions{logLevel: "warn"}
+	logger, err := opts.logger(&buffer)
+	require.NoError(t, err)
+
+	logger.Info("hidden")
+	logger.Warn("shown")
+	require.NotContains(t, buffer.String(), "hidden")
+	require.Contains(t, buffer.String(), "shown")
+
+	_, err = (&serverOptions{logLevel: "verbose"}).logger(&buffer)
+	require.ErrorContains(t, err, "invalid --log-level")
+}
+
+func TestS3ClientAddressingStyle(t *testing.T) {
+	t.Setenv("OMNI_CACHE_S3_ENDPOINT", "")
+
+	for _, tc := range []struct {
+		name          string
+		args          []string
+		wantPathStyle bool
+		wantEndpoint  string
+	}{
+		{name: "aws", wantPathStyle: false},
+		{name: "aws path-style", args: []string{"--s3-path-style"}, wantPathStyle: true},
+		{name: "custom endpoint", args: []string{"--s3-endpoint", "https://minio.example.com"}, wantPathStyle: true, wantEndpoint: "https://minio.example.com"},
+		{
+			name:          "custom endpoint virtual-hosted",
+			args:          []string{"--s3-endpoint", "https://ceph.example.com", "--s3-path-style=false"},
+			wantPathStyle: false,
+			wantEndpoint:  "https://ceph.example.com",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := newTestSidecarOptions(t, append([]string{"--s3-region", "eu-west-1"}, tc.args...)...)
+			client, err := newS3Client(aws.Config{}, opts.backend.s3Client())
+			require.NoError(t, err)
+
+			options := client.Options()
+			require.Equal(t, tc.wantPathStyle, options.UsePathStyle)
+			require.Equal(t, "eu-west-1", options.Region)
+			require.Equal(t, tc.wantEndpoint, aws.ToString(options.BaseEndpoint))
+		})
+	}
+}
+
+func TestS3EndpointDefaultsToEnvironment(t *testing.T) {
+	t.Setenv("OMNI_CACHE_S3_ENDPOINT", "http://localhost:9000")
+
+	opts := newTestSidecarOptions(t)
+	client, err := newS3Client(aws.Config{}, opts.backend.s3Client())
+	require.NoError(t, err)
+	require.Equal(t, "http://localhost:9000", aws.ToString(client.Options().BaseEndpoint))
+	require.True(t, client.Options().UsePathStyle)
+	require.Equal(t, defaultAWSRegion, client.Options().Region)
+}
+
+func TestBackendKVNamespace(t *testing.T) {
+	staging := backendOptions{bucketName: "ci-cache", deploymentPrefix: "staging", prefix: "/repo/"}
+	require.Equal(t, "omni-cache/s3/ci-cache/staging/repo/", staging.kvNamespace())
+
+	production := backendOptions{bucketName: "ci-cache", prefix: "repo"}
+	require.Equal(t, "omni-cache/s3/ci-cache/repo/", production.kvNamespace())
+
+	filesystem := backendOptions{kind: "filesystem", fsDir: "/var/cache"}
+	require.Equal(t, "omni-cache/filesystem/var/cache/", filesystem.kvNamespace())
+}
+
+func TestTuistPersistSessionsRequiresRedis(t *testing.T) {
+	t.Setenv("OMNI_CACHE_REDIS_URL", "")
+
+	var opts protocolOptions
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	opts.addFlags(flags)
+	require.NoError(t, flags.Parse([]string{"--tuist-persist-sessions"}))
+	_, err := opts.config()
+	require.ErrorContains(t, err, "--tuist-persist-sessions requires --redis-url")
+
+	require.NoError(t, flags.Parse([]string{"--redis-url", "redis://localhost:6379/0"}))
+	_, err = opts.config()
+	require.NoError(t, err)
+}
@@ -0,0 +1,289 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/cirruslabs/omni-cache/pkg/backpressure"
+	"github.com/cirruslabs/omni-cache/pkg/errdetail"
+	"github.com/cirruslabs/omni-cache/pkg/server"
+	"github.com/cirruslabs/omni-cache/pkg/signedurl"
+	"github.com/cirruslabs/omni-cache/pkg/stats"
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+	urlproxy "github.com/cirruslabs/omni-cache/pkg/url-proxy"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/pflag"
+)
+
+// serverOptions holds flags shared by the sidecar and dev commands.
+type serverOptions struct {
+	protocols protocolOptions
+	quotas    quotaOptions
+	report    bool
+
+	s3SkipHeadURL   bool
+	presignTTL      time.Duration
+	s3SSE           string
+	s3SSEKMSKeyID   string
+	s3MaxMetadata   int
+	s3MaxRetries    int
+	s3RetryMode     string
+	maxDownloadURLs int
+	cacheTTL        time.Duration
+	errorDetail     string
+
+	coalesceDownloads bool
+	compression       string
+
+	slowDownloadGracePeriod time.Duration
+	slowDownloadMinRate     string
+	slowDownloadParallelism int
+
+	grpcDialTimeout time.Duration
+
+	routes     []string
+	maxAges    []string
+	maxUploads []string
+	hitMiss    []string
+	adminToken string
+	topKeys    int
+	authToken  string
+	readOnly   bool
+
+	assertObjectProtocol bool
+
+	signedURLTTL  time.Duration
+	urlSigningKey string
+
+	backpressureLatencyThreshold time.Duration
+	backpressureCooldown         time.Duration
+
+	socketPath string
+	socketMode string
+	noSocket   bool
+
+	logLevel    string
+	logRequests bool
+}
+
+func (opts *serverOptions) addFlags(flags *pflag.FlagSet) {
+	opts.protocols.addFlags(flags)
+	opts.quotas.addFlags(flags)
+	flags.BoolVar(&opts.report, "report", opts.report, "Print a human-readable cache report to stderr on exit")
+	flags.StringVar(&opts.logLevel, "log-level", "info", "Minimum level of logged messages: debug, info, warn or error")
+	flags.BoolVar(&opts.logRequests, "log-requests", opts.logRequests, "Log every HTTP request and gRPC call at info level, with its request ID, cache key, hit or miss, bytes and duration")
+	flags.StringVar(&opts.socketPath, "socket-path", opts.socketPath, "Path of the unix socket to listen on (empty uses ~/.cirruslabs/omni-cache.sock)")
+	flags.StringVar(&opts.socketMode, "socket-mode", opts.socketMode, "Octal file mode to set on the unix socket, e.g. 0600 (empty keeps the default)")
+	flags.BoolVar(&opts.noSocket, "no-socket", opts.noSocket, "Only listen on --listen-addr, without a unix socket, e.g. in containers")
+	flags.DurationVar(&opts.backpressureLatencyThreshold, "backpressure-latency-threshold", opts.backpressureLatencyThreshold, "Shed requests with 503/UNAVAILABLE while the smoothed storage backend latency exceeds this (0 disables)")
+	flags.DurationVar(&opts.backpressureCooldown, "backpressure-cooldown", backpressure.DefaultCooldown, "How long to shed requests once the backend latency threshold is exceeded")
+	flags.BoolVar(&opts.s3SkipHeadURL, "s3-skip-head-url", opts.s3SkipHeadURL, "Only presign GET URLs for downloads, skipping the fallback HEAD URL")
+	flags.DurationVar(&opts.presignTTL, "presign-ttl", 10*time.Minute, "How long presigned S3 URLs stay valid (at most 168h)")
+	flags.StringVar(&opts.s3SSE, "s3-sse", opts.s3SSE, "Server-side encryption for stored objects: AES256, aws:kms or aws:kms:dsse (empty uses the bucket default)")
+	flags.StringVar(&opts.s3SSEKMSKeyID, "s3-sse-kms-key-id", opts.s3SSEKMSKeyID, "KMS key ID or ARN used with --s3-sse aws:kms or aws:kms:dsse")
+	flags.IntVar(&opts.s3MaxRetries, "s3-max-retries", -1, "Retry S3 requests that are throttled or fail with a 5xx up to this many times (-1 uses the AWS SDK default of 2, or $AWS_MAX_ATTEMPTS)")
+	flags.StringVar(&opts.s3RetryMode, "s3-retry-mode", opts.s3RetryMode, "How S3 requests are retried: standard, or adaptive to also slow down while S3 throttles (empty uses $AWS_RETRY_MODE or standard)")
+	flags.IntVar(&opts.s3MaxMetadata, "s3-max-metadata-bytes", storage.DefaultS3MaxMetadataBytes, "Reject uploads whose object metadata exceeds this many bytes before they reach S3 (0 disables)")
+	flags.StringVar(&opts.errorDetail, "error-detail", string(errdetail.Internal), "Error detail returned to clients: \"internal\" includes backend error text, \"public\" returns generic messages and only logs the detail")
+	flags.BoolVar(&opts.coalesceDownloads, "coalesce-downloads", opts.coalesceDownloads, "Share one storage download between concurrent requests for the same object")
+	flags.StringVar(&opts.compression, "compression", opts.compression, "Compress objects that Omni Cache uploads itself (Bazel gRPC, LLVM) with this algorithm: zstd (empty disables)")
+	flags.DurationVar(&opts.slowDownloadGracePeriod, "slow-download-grace-period", opts.slowDownloadGracePeriod, "Switch proxied downloads slower than --slow-download-min-rate over this period to parallel ranged requests (0 disables)")
+	flags.StringVar(&opts.slowDownloadMinRate, "slow-download-min-rate", "1MiB", "Download throughput per second below which --slow-download-grace-period switches to ranged requests")
+	flags.IntVar(&opts.slowDownloadParallelism, "slow-download-parallelism", 4, "Number of parallel ranged requests used for the rest of a slow download")
+	flags.DurationVar(&opts.grpcDialTimeout, "grpc-dial-timeout", urlproxy.DefaultGRPCDialTimeout, "How long proxied ByteStream transfers wait to connect to a gRPC or unix socket URL before failing (0 connects lazily on the first call)")
+	flags.StringArrayVar(&opts.routes, "route", opts.routes, "Serve protocols under a URL path prefix, as /prefix=protocol[,protocol...] (repeatable; when set, unrouted protocols are not served)")
+	flags.StringArrayVar(&opts.hitMiss, "stats-hit-miss", opts.hitMiss, "How a protocol's cache hits and misses are counted in stats, as protocol=mode with mode totals, label (left out of the totals) or off (repeatable)")
+	flags.StringArrayVar(&opts.maxUploads, "max-concurrent-uploads", opts.maxUploads, "Limit how many uploads to storage a protocol runs at once, as protocol=count; further uploads wait for a slot (repeatable)")
+	flags.StringArrayVar(&opts.maxAges, "max-age", opts.maxAges, "Treat entries last modified longer ago than this as misses for a protocol, as protocol=duration (repeatable)")
+	flags.BoolVar(&opts.assertObjectProtocol, "assert-object-protocol", opts.assertObjectProtocol, "Tag uploaded objects with the protocol that wrote them and fail reads by protocols that don't share objects with it, to catch cross-protocol key collisions during development")
+	flags.StringVar(&opts.adminToken, "admin-token", opts.adminToken, "Bearer token that enables the /_admin/* diagnostic endpoints (empty disables them)")
+	flags.BoolVar(&opts.readOnly, "read-only", opts.readOnly, "Serve cache hits but reject every upload, commit and delete with HTTP 403 or gRPC PERMISSION_DENIED")
+	flags.IntVar(&opts.topKeys, "top-keys", opts.topKeys, "Track up to this many of the most requested cache keys and serve them at /_admin/top-keys (requires --admin-token; 0 disables)")
+	flags.StringVar(&opts.authToken, "auth-token", os.Getenv("OMNI_CACHE_AUTH_TOKEN"), "Bearer token that clients must send with every HTTP and gRPC request (defaults to $OMNI_CACHE_AUTH_TOKEN; empty disables authentication)")
+	setFlagEnv(flags, "auth-token", "OMNI_CACHE_AUTH_TOKEN")
+	flags.DurationVar(&opts.signedURLTTL, "signed-url-ttl", opts.signedURLTTL, "Sign the cache URLs handed out to GitHub Actions clients, valid for this long, so they work without --auth-token (0 disables)")
+	flags.StringVar(&opts.urlSigningKey, "url-signing-key", os.Getenv("OMNI_CACHE_URL_SIGNING_KEY"), "Key used with --signed-url-ttl; set the same key on replicas behind a load balancer (defaults to $OMNI_CACHE_URL_SIGNING_KEY; empty uses a random key)")
+	setFlagEnv(flags, "url-signing-key", "OMNI_CACHE_URL_SIGNING_KEY")
+	flags.DurationVar(&opts.cacheTTL, "cache-ttl", opts.cacheTTL, "Treat cache entries as missing once they are older than this (0 disables expiration)")
+	flags.IntVar(&opts.maxDownloadURLs, "max-download-urls", opts.maxDownloadURLs, "Maximum number of candidate download URLs tried per object, best first (0 means no limit)")
+}
+
+// logger returns the logger configured by --log-level. Records logged while serving a
+// request carry its request ID.
+func (opts *serverOptions) logger(w io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+	if opts.logLevel != "" {
+		if err := level.UnmarshalText([]byte(opts.logLevel)); err != nil {
+			return nil, fmt.Errorf("invalid --log-level %q: expected debug, info, warn or error", opts.logLevel)
+		}
+	}
+	handler := slog.NewTextHandler(w, &slog.HandlerOptions{Level: level})
+	return slog.New(server.NewRequestIDLogHandler(handler)), nil
+}
+
+// unixSocketMode parses --socket-mode, returning zero when it's unset.
+func (opts *serverOptions) unixSocketMode() (os.FileMode, error) {
+	if opts.socketMode == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(opts.socketMode, 8, 32)
+	if err != nil || mode == 0 || mode > 0o777 {
+		return 0, fmt.Errorf("invalid --socket-mode %q: expected permission bits in octal, e.g. 0600", opts.socketMode)
+	}
+	return os.FileMode(mode), nil
+}
+
+func (opts *serverOptions) s3Options() []storage.S3Option {
+	if opts == nil {
+		return nil
+	}
+	s3Opts := []storage.S3Option{
+		storage.WithPresignExpiration(opts.presignTTL),
+		storage.WithMaxMetadataBytes(opts.s3MaxMetadata),
+	}
+	if opts.s3SkipHeadURL {
+		s3Opts = append(s3Opts, storage.WithoutHeadURL())
+	}
+	if opts.s3SSE != "" || opts.s3SSEKMSKeyID != "" {
+		s3Opts = append(s3Opts, storage.WithServerSideEncryption(opts.s3SSE, opts.s3SSEKMSKeyID))
+	}
+	if opts.s3MaxRetries >= 0 || opts.s3RetryMode != "" {
+		policy := storage.S3RetryPolicy{Mode: aws.RetryMode(opts.s3RetryMode)}
+		if opts.s3MaxRetries >= 0 {
+			policy.MaxAttempts = opts.s3MaxRetries + 1
+		}
+		s3Opts = append(s3Opts, storage.WithS3Retries(policy))
+	}
+	return s3Opts
+}
+
+func (opts *serverOptions) proxyOptions() ([]urlproxy.ProxyOption, error) {
+	proxyOpts := []urlproxy.ProxyOption{urlproxy.WithGRPCDialTimeout(opts.grpcDialTimeout)}
+	if opts.coalesceDownloads {
+		proxyOpts = append(proxyOpts, urlproxy.WithDownloadCoalescing(""))
+	}
+	if opts.compression != "" {
+		if err := urlproxy.ValidateCompression(opts.compression); err != nil {
+			return nil, fmt.Errorf("invalid --compression: %w", err)
+		}
+		if opts.protocols.casExistingBlobs == string(storage.SkipExistingVerifySize) {
+			return nil, fmt.Errorf("--cas-existing-blobs=%s compares uncompressed sizes and can't be used with --compression",
+				storage.SkipExistingVerifySize)
+		}
+		proxyOpts = append(proxyOpts, urlproxy.WithCompression(opts.compression))
+	}
+	if opts.slowDownloadGracePeriod > 0 {
+		minRate, err := humanize.ParseBytes(opts.slowDownloadMinRate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --slow-download-min-rate %q: %w", opts.slowDownloadMinRate, err)
+		}
+		proxyOpts = append(proxyOpts, urlproxy.WithSlowDownloadFallback(urlproxy.SlowDownloadPolicy{
+			GracePeriod:       opts.slowDownloadGracePeriod,
+			MinBytesPerSecond: int64(minRate),
+			Parallelism:       opts.slowDownloadParallelism,
+		}))
+	}
+	return proxyOpts, nil
+}
+
+func (opts *serverOptions) urlSigner() (*signedurl.Signer, error) {
+	if opts.signedURLTTL <= 0 {
+		return nil, nil
+	}
+	if opts.urlSigningKey == "" {
+		return signedurl.NewRandomSigner(opts.signedURLTTL)
+	}
+	return signedurl.NewSigner([]byte(opts.urlSigningKey), opts.signedURLTTL)
+}
+
+func (opts *serverOptions) serverRoutes() ([]server.Route, error) {
+	var routes []server.Route
+	for _, value := range opts.routes {
+		prefix, ids, ok := strings.Cut(value, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid --route %q: expected /prefix=protocol[,protocol...]", value)
+		}
+
+		route := server.Route{Prefix: strings.TrimSpace(prefix)}
+		for _, id := range strings.Split(ids, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				route.Protocols = append(route.Protocols, id)
+			}
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+func (opts *serverOptions) serverMaxAges() (map[string]time.Duration, error) {
+	if len(opts.maxAges) == 0 {
+		return nil, nil
+	}
+
+	maxAges := make(map[string]time.Duration, len(opts.maxAges))
+	for _, value := range opts.maxAges {
+		id, rawMaxAge, ok := strings.Cut(value, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid --max-age %q: expected protocol=duration", value)
+		}
+		maxAge, err := time.ParseDuration(strings.TrimSpace(rawMaxAge))
+		if err != nil {
+			return nil, fmt.Errorf("invalid --max-age %q: %w", value, err)
+		}
+		maxAges[strings.TrimSpace(id)] = maxAge
+	}
+	return maxAges, nil
+}
+
+func (opts *serverOptions) serverMaxConcurrentUploads() (map[string]int, error) {
+	if len(opts.maxUploads) == 0 {
+		return nil, nil
+	}
+
+	limits := make(map[string]int, len(opts.maxUploads))
+	for _, value := range opts.maxUploads {
+		id, rawLimit, ok := strings.Cut(value, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid --max-concurrent-uploads %q: expected protocol=count", value)
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(rawLimit))
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid --max-concurrent-uploads %q: count must be a positive integer", value)
+		}
+		limits[strings.TrimSpace(id)] = limit
+	}
+	return limits, nil
+}
+
+func (opts *serverOptions) serverHitMiss() (map[string]stats.HitMissMode, error) {
+	if len(opts.hitMiss) == 0 {
+		return nil, nil
+	}
+
+	modes := make(map[string]stats.HitMissMode, len(opts.hitMiss))
+	for _, value := range opts.hitMiss {
+		id, rawMode, ok := strings.Cut(value, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid --stats-hit-miss %q: expected protocol=mode", value)
+		}
+		mode, err := stats.ParseHitMissMode(strings.TrimSpace(rawMode))
+		if err != nil {
+			return nil, fmt.Errorf("invalid --stats-hit-miss %q: %w", value, err)
+		}
+		modes[strings.TrimSpace(id)] = mode
+	}
+	return modes, nil
+}
+
+func (opts *serverOptions) backpressure() backpressure.Options {
+	return backpressure.Options{
+		LatencyThreshold: opts.backpressureLatencyThreshold,
+		Cooldown:         opts.backpressureCooldown,
+	}
+}
@@ -0,0 +1,65 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/cirruslabs/omni-cache/internal/version"
+	"github.com/cirruslabs/omni-cache/pkg/protocols"
+	"github.com/cirruslabs/omni-cache/pkg/protocols/builtin"
+	"github.com/spf13/cobra"
+)
+
+type versionOptions struct {
+	json bool
+}
+
+func newVersionCmd() *cobra.Command {
+	opts := &versionOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "version",
+		Short: "Print the version and the built-in protocols",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			return runVersion(cmd.OutOrStdout(), opts)
+		},
+	}
+
+	cmd.Flags().BoolVar(&opts.json, "json", opts.json, "Print machine-readable JSON instead of text")
+
+	return cmd
+}
+
+func runVersion(w io.Writer, opts *versionOptions) error {
+	var descriptions []protocols.Description
+	for _, factory := range builtin.Factories() {
+		descriptions = append(descriptions, protocols.Describe(factory))
+	}
+
+	if opts.json {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(struct {
+			Version   string                  `json:"version"`
+			Protocols []protocols.Description `json:"protocols"`
+		}{Version: version.FullVersion, Protocols: descriptions})
+	}
+
+	fmt.Fprintf(w, "omni-cache %s\n\nProtocols:\n", version.FullVersion)
+	for _, description := range descriptions {
+		fmt.Fprintf(w, "  %s: %s\n", description.ID, description.Summary)
+		for _, route := range description.HTTPRoutes {
+			fmt.Fprintf(w, "    HTTP %s\n", route)
+		}
+		for _, service := range description.GRPCServices {
+			fmt.Fprintf(w, "    gRPC %s\n", service)
+		}
+		if len(description.Features) != 0 {
+			fmt.Fprintf(w, "    features: %s\n", strings.Join(description.Features, ", "))
+		}
+	}
+	return nil
+}
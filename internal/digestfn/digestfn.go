@@ -0,0 +1,110 @@
+// Package digestfn is a registry of content hash functions shared by the
+// content-addressable protocols, so that a digest function is defined once
+// and computed the same way everywhere.
+package digestfn
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/zeebo/blake3"
+)
+
+// Function describes a content hash function.
+type Function struct {
+	// Name is the lower-case identifier of the function, e.g. "sha256".
+	Name string
+	// Size is the length of a digest in bytes.
+	Size int
+	// New returns a fresh hasher.
+	New func() hash.Hash
+}
+
+// BLAKE3Size is the length of a default-length BLAKE3 digest in bytes.
+const BLAKE3Size = 32
+
+var (
+	SHA256 = Function{Name: "sha256", Size: sha256.Size, New: sha256.New}
+	BLAKE3 = Function{Name: "blake3", Size: BLAKE3Size, New: func() hash.Hash { return blake3.New() }}
+)
+
+var (
+	mu        sync.RWMutex
+	functions = map[string]Function{}
+)
+
+func init() {
+	Register(SHA256)
+	Register(BLAKE3)
+}
+
+// Register makes fn available via Lookup, replacing any function with the same name.
+func Register(fn Function) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	functions[strings.ToLower(fn.Name)] = fn
+}
+
+// Lookup returns the function registered under name (case-insensitive).
+func Lookup(name string) (Function, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	fn, ok := functions[strings.ToLower(name)]
+	return fn, ok
+}
+
+// Names returns the names of all registered functions in sorted order.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	names := make([]string, 0, len(functions))
+	for name := range functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HexLen returns the length of a hex-encoded digest.
+func (fn Function) HexLen() int {
+	return fn.Size * 2
+}
+
+// Sum returns the digest of data.
+func (fn Function) Sum(data []byte) []byte {
+	hasher := fn.New()
+	_, _ = hasher.Write(data)
+	return hasher.Sum(nil)
+}
+
+// SumHex returns the lower-case hex-encoded digest of data.
+func (fn Function) SumHex(data []byte) string {
+	return hex.EncodeToString(fn.Sum(data))
+}
+
+// EmptyHex returns the lower-case hex-encoded digest of empty input.
+func (fn Function) EmptyHex() string {
+	return fn.SumHex(nil)
+}
+
+// ValidateHex checks that value is a lower-case hex digest of this function.
+func (fn Function) ValidateHex(value string) error {
+	if len(value) != fn.HexLen() {
+		return fmt.Errorf("unsupported hash length %d; expected %d for %s", len(value), fn.HexLen(), fn.Name)
+	}
+	if strings.ToLower(value) != value {
+		return fmt.Errorf("digest hash must be lower-case hex")
+	}
+	if _, err := hex.DecodeString(value); err != nil {
+		return fmt.Errorf("digest hash must be lower-case hex: %w", err)
+	}
+	return nil
+}
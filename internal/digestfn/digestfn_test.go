@@ -0,0 +1,30 @@
+package digestfn_test
+
+import (
+	"testing"
+
+	"github.com/cirruslabs/omni-cache/internal/digestfn"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuiltinFunctions(t *testing.T) {
+	require.Equal(t, []string{"blake3", "sha256"}, digestfn.Names())
+
+	sha256, ok := digestfn.Lookup("SHA256")
+	require.True(t, ok)
+	require.Equal(t, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", sha256.EmptyHex())
+	require.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", sha256.SumHex([]byte("hello")))
+
+	blake3, ok := digestfn.Lookup("blake3")
+	require.True(t, ok)
+	require.Equal(t, "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262", blake3.EmptyHex())
+
+	_, ok = digestfn.Lookup("md5")
+	require.False(t, ok)
+}
+
+func TestValidateHex(t *testing.T) {
+	require.NoError(t, digestfn.SHA256.ValidateHex(digestfn.SHA256.EmptyHex()))
+	require.Error(t, digestfn.SHA256.ValidateHex("abcd"))
+	require.Error(t, digestfn.SHA256.ValidateHex(digestfn.BLAKE3.EmptyHex()[:62]+"zz"))
+}
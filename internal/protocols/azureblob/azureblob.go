@@ -10,9 +10,10 @@ import (
 	"strings"
 
 	uploadablepkg "github.com/cirruslabs/omni-cache/internal/protocols/azureblob/uploadable"
+	"github.com/cirruslabs/omni-cache/pkg/errdetail"
 	omnistorage "github.com/cirruslabs/omni-cache/pkg/storage"
+	urlproxy "github.com/cirruslabs/omni-cache/pkg/url-proxy"
 	"github.com/getsentry/sentry-go"
-	"github.com/go-chi/render"
 	"github.com/google/uuid"
 	"github.com/puzpuzpuz/xsync/v3"
 	"github.com/samber/lo"
@@ -25,6 +26,7 @@ const APIMountPoint = "/_azureblob/cirrus-runners-cache"
 // [1]: https://learn.microsoft.com/en-us/rest/api/storageservices/status-and-error-codes2
 type statusAndError struct {
 	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
 	Message string   `xml:"Message"`
 }
 
@@ -34,14 +36,20 @@ type AzureBlob struct {
 	httpClient              *http.Client
 	storageBackend          omnistorage.MultipartBlobStorageBackend
 	withUnexpectedEOFReader bool
+	flushPolicy             urlproxy.FlushPolicy
 }
 
 func New(storageBackend omnistorage.MultipartBlobStorageBackend, httpClient *http.Client, opts ...Option) *AzureBlob {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
 	azureBlobContainer := &AzureBlob{
 		mux:            http.NewServeMux(),
 		uploadables:    xsync.NewMapOf[string, *uploadablepkg.Uploadable](),
 		httpClient:     httpClient,
 		storageBackend: storageBackend,
+		flushPolicy:    urlproxy.DefaultFlushPolicy,
 	}
 
 	// Apply opts
@@ -52,6 +60,7 @@ func New(storageBackend omnistorage.MultipartBlobStorageBackend, httpClient *htt
 	azureBlobContainer.mux.HandleFunc("GET /{key...}", azureBlobContainer.getBlobAbstract)
 	azureBlobContainer.mux.HandleFunc("HEAD /{key...}", azureBlobContainer.headBlobAbstract)
 	azureBlobContainer.mux.HandleFunc("PUT /{key...}", azureBlobContainer.putBlobAbstract)
+	azureBlobContainer.mux.HandleFunc("/{key...}", azureBlobContainer.unsupportedOperation)
 
 	return azureBlobContainer
 }
@@ -70,6 +79,9 @@ func (azureBlob *AzureBlob) ServeHTTP(writer http.ResponseWriter, request *http.
 func fail(writer http.ResponseWriter, request *http.Request, status int, msg string, args ...any) {
 	// Report failure to the Sentry
 	hub := sentry.GetHubFromContext(request.Context())
+	if hub == nil {
+		hub = sentry.CurrentHub()
+	}
 
 	hub.WithScope(func(scope *sentry.Scope) {
 		scope.AddEventProcessor(func(event *sentry.Event, hint *sentry.EventHint) *sentry.Event {
@@ -108,10 +120,7 @@ func fail(writer http.ResponseWriter, request *http.Request, status int, msg str
 	}
 
 	// Report failure to the caller
-	writer.WriteHeader(status)
-	render.XML(writer, request, &statusAndError{
-		Message: message,
-	})
+	writeError(writer, request, status, errorCodeForStatus(status), errdetail.Message(request.Context(), message, msg))
 }
 
 func craftAndLogMessage(level slog.Level, msg string, args ...any) string {
@@ -0,0 +1,90 @@
+package azureblob
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/render"
+)
+
+// Error codes as documented in "Blob Storage error codes"[1] and "Common REST API error
+// codes"[2]. Azure SDKs match on these rather than on the HTTP status, e.g. to treat a
+// missing blob as a cache miss.
+//
+// [1]: https://learn.microsoft.com/en-us/rest/api/storageservices/blob-service-error-codes
+// [2]: https://learn.microsoft.com/en-us/rest/api/storageservices/common-rest-api-error-codes
+const (
+	errorCodeBlobNotFound               = "BlobNotFound"
+	errorCodeInvalidInput               = "InvalidInput"
+	errorCodeInvalidQueryParameterValue = "InvalidQueryParameterValue"
+	errorCodeUnsupportedHTTPVerb        = "UnsupportedHttpVerb"
+	errorCodeAuthorizationFailure       = "AuthorizationFailure"
+	errorCodeRequestBodyTooLarge        = "RequestBodyTooLarge"
+	errorCodeInvalidRange               = "InvalidRange"
+	errorCodeInternalError              = "InternalError"
+	errorCodeServerBusy                 = "ServerBusy"
+)
+
+// supportedMethods are the methods served under APIMountPoint, reported in the Allow
+// header of UnsupportedHttpVerb errors.
+var supportedMethods = []string{http.MethodGet, http.MethodHead, http.MethodPut}
+
+// errorCodeForStatus picks the error code for failures that don't have a more specific one.
+func errorCodeForStatus(status int) string {
+	switch {
+	case status == http.StatusNotFound:
+		return errorCodeBlobNotFound
+	case status == http.StatusForbidden:
+		return errorCodeAuthorizationFailure
+	case status == http.StatusRequestEntityTooLarge:
+		return errorCodeRequestBodyTooLarge
+	case status == http.StatusRequestedRangeNotSatisfiable:
+		return errorCodeInvalidRange
+	case status == http.StatusServiceUnavailable:
+		return errorCodeServerBusy
+	case status >= http.StatusInternalServerError:
+		return errorCodeInternalError
+	default:
+		return errorCodeInvalidInput
+	}
+}
+
+// writeError responds with an error the way Azure Blob Storage does: the error code in the
+// x-ms-error-code header and, except for HEAD requests, an XML body with the code and
+// message.
+func writeError(writer http.ResponseWriter, request *http.Request, status int, code string, message string) {
+	writer.Header().Set("x-ms-error-code", code)
+
+	if request.Method == http.MethodHead {
+		writer.WriteHeader(status)
+
+		return
+	}
+
+	render.Status(request, status)
+	render.XML(writer, request, &statusAndError{
+		Code:    code,
+		Message: message,
+	})
+}
+
+// unsupportedOperation rejects requests for Blob Storage operations that aren't
+// implemented, so that SDK clients see a regular Azure error instead of the request being
+// mistaken for another operation. Such requests are expected from clients probing for
+// features, so they're logged but not reported to Sentry.
+func (azureBlob *AzureBlob) unsupportedOperation(writer http.ResponseWriter, request *http.Request) {
+	slog.WarnContext(request.Context(), "unsupported Azure Blob Storage operation",
+		"method", request.Method, "comp", request.URL.Query().Get("comp"), "key", request.PathValue("key"))
+
+	switch request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut:
+		writeError(writer, request, http.StatusBadRequest, errorCodeInvalidQueryParameterValue,
+			"Value for one of the query parameters specified in the request URI is invalid.\n"+
+				"QueryParameterName:comp\nQueryParameterValue:"+request.URL.Query().Get("comp"))
+	default:
+		writer.Header().Set("Allow", strings.Join(supportedMethods, ", "))
+		writeError(writer, request, http.StatusMethodNotAllowed, errorCodeUnsupportedHTTPVerb,
+			"The resource doesn't support the specified HTTP verb.")
+	}
+}
@@ -0,0 +1,99 @@
+package azureblob_test
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/cirruslabs/omni-cache/internal/protocols/azureblob"
+	"github.com/cirruslabs/omni-cache/internal/testutil"
+	"github.com/cirruslabs/omni-cache/pkg/protocols"
+	"github.com/stretchr/testify/require"
+)
+
+const testContainer = "cirrus-runners-cache"
+
+func newTestClient(t *testing.T) (*azblob.Client, string) {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	protocol, err := azureblob.Factory{}.New(protocols.Dependencies{Storage: testutil.NewMemoryStorage(t)})
+	require.NoError(t, err)
+	require.NoError(t, protocol.Register(protocols.NewRegistrar(mux, nil)))
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	client, err := azblob.NewClientWithNoCredential(server.URL+"/_azureblob", nil)
+	require.NoError(t, err)
+	return client, server.URL + azureblob.APIMountPoint
+}
+
+func TestMissingBlobErrors(t *testing.T) {
+	client, _ := newTestClient(t)
+	blobClient := client.ServiceClient().NewContainerClient(testContainer).NewBlobClient("missing")
+
+	_, err := blobClient.GetProperties(t.Context(), nil)
+	require.True(t, bloberror.HasCode(err, bloberror.BlobNotFound), err)
+
+	_, err = client.DownloadStream(t.Context(), testContainer, "missing", nil)
+	require.True(t, bloberror.HasCode(err, bloberror.BlobNotFound), err)
+}
+
+func TestUnsupportedOperationErrors(t *testing.T) {
+	client, _ := newTestClient(t)
+	ctx := t.Context()
+
+	_, err := client.UploadBuffer(ctx, testContainer, "key", []byte("payload"), nil)
+	require.NoError(t, err)
+	blobClient := client.ServiceClient().NewContainerClient(testContainer).NewBlobClient("key")
+
+	value := "value"
+	_, err = blobClient.SetMetadata(ctx, map[string]*string{"name": &value}, nil)
+	require.True(t, bloberror.HasCode(err, bloberror.InvalidQueryParameterValue), err)
+
+	_, err = blobClient.GetTags(ctx, nil)
+	require.True(t, bloberror.HasCode(err, bloberror.InvalidQueryParameterValue), err)
+
+	_, err = blobClient.Delete(ctx, &blob.DeleteOptions{})
+	require.True(t, bloberror.HasCode(err, bloberror.UnsupportedHTTPVerb), err)
+	var responseErr *azcore.ResponseError
+	require.ErrorAs(t, err, &responseErr)
+	require.Equal(t, http.StatusMethodNotAllowed, responseErr.StatusCode)
+
+	// The unsupported PUT didn't overwrite the blob.
+	response, err := client.DownloadStream(ctx, testContainer, "key", nil)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+	require.Equal(t, "payload", string(body))
+}
+
+func TestErrorResponseShape(t *testing.T) {
+	_, baseURL := newTestClient(t)
+
+	response, err := http.Get(baseURL + "/missing")
+	require.NoError(t, err)
+	defer response.Body.Close()
+
+	require.Equal(t, http.StatusNotFound, response.StatusCode)
+	require.Equal(t, "BlobNotFound", response.Header.Get("x-ms-error-code"))
+	require.True(t, strings.HasPrefix(response.Header.Get("Content-Type"), "application/xml"))
+
+	var azureError struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}
+	require.NoError(t, xml.NewDecoder(response.Body).Decode(&azureError))
+	require.Equal(t, "BlobNotFound", azureError.Code)
+	require.NotEmpty(t, azureError.Message)
+}
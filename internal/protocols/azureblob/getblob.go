@@ -13,6 +13,8 @@ import (
 	"github.com/cirruslabs/omni-cache/internal/protocols/azureblob/simplerange"
 	"github.com/cirruslabs/omni-cache/internal/protocols/azureblob/unexpectedeofreader"
 	"github.com/cirruslabs/omni-cache/pkg/stats"
+	omnistorage "github.com/cirruslabs/omni-cache/pkg/storage"
+	urlproxy "github.com/cirruslabs/omni-cache/pkg/url-proxy"
 	"github.com/dustin/go-humanize"
 )
 
@@ -21,17 +23,28 @@ const PROXY_DOWNLOAD_PROGRESS_LOG_INTERVAL = 60 * time.Second
 
 func (azureBlob *AzureBlob) getBlobAbstract(writer http.ResponseWriter, request *http.Request) {
 	switch request.URL.Query().Get("comp") {
-	default:
+	case "":
 		azureBlob.getBlob(writer, request)
+	default:
+		azureBlob.unsupportedOperation(writer, request)
 	}
 }
 
 func (azureBlob *AzureBlob) getBlob(writer http.ResponseWriter, request *http.Request) {
+	writer = urlproxy.NewFlushingResponseWriter(writer, azureBlob.flushPolicy)
 	key := request.PathValue("key")
 	recordHitMiss := !stats.ShouldSkipHitMiss(request)
 
 	// Generate cache entry download URL
 	urls, err := azureBlob.storageBackend.DownloadURLs(request.Context(), key)
+	if omnistorage.IsNotFoundError(err) {
+		if recordHitMiss {
+			protocolStats.RecordCacheMiss()
+		}
+		writeError(writer, request, http.StatusNotFound, errorCodeBlobNotFound, "The specified blob does not exist.")
+
+		return
+	}
 	if err != nil {
 		fail(writer, request, http.StatusInternalServerError, "failed to generate cache download URLs",
 			"key", key, "err", err)
@@ -106,7 +119,7 @@ func (azureBlob *AzureBlob) proxyCacheEntryDownload(
 	switch resp.StatusCode {
 	case http.StatusOK, http.StatusPartialContent:
 		if recordHitMiss {
-			stats.Default().RecordCacheHit()
+			protocolStats.RecordCacheHit()
 		}
 		// Proceed with proxying
 	case http.StatusNotFound:
@@ -114,10 +127,10 @@ func (azureBlob *AzureBlob) proxyCacheEntryDownload(
 			return false
 		}
 		if recordHitMiss {
-			stats.Default().RecordCacheMiss()
+			protocolStats.RecordCacheMiss()
 		}
 
-		writer.WriteHeader(http.StatusNotFound)
+		writeError(writer, request, http.StatusNotFound, errorCodeBlobNotFound, "The specified blob does not exist.")
 
 		return true
 	default:
@@ -176,7 +189,7 @@ func (azureBlob *AzureBlob) proxyCacheEntryDownload(
 		return true
 	}
 
-	stats.Default().RecordDownload(bytesRead, time.Since(startProxyingAt))
+	protocolStats.RecordDownload(bytesRead, time.Since(startProxyingAt))
 	return true
 }
 
@@ -6,12 +6,15 @@ import (
 	"net/http"
 
 	"github.com/cirruslabs/omni-cache/pkg/stats"
+	omnistorage "github.com/cirruslabs/omni-cache/pkg/storage"
 )
 
 func (azureBlob *AzureBlob) headBlobAbstract(writer http.ResponseWriter, request *http.Request) {
 	switch request.URL.Query().Get("comp") {
-	default:
+	case "":
 		azureBlob.headBlob(writer, request)
+	default:
+		azureBlob.unsupportedOperation(writer, request)
 	}
 }
 
@@ -21,6 +24,14 @@ func (azureBlob *AzureBlob) headBlob(writer http.ResponseWriter, request *http.R
 
 	// Generate cache entry download URL
 	urls, err := azureBlob.storageBackend.DownloadURLs(request.Context(), key)
+	if omnistorage.IsNotFoundError(err) {
+		if recordHitMiss {
+			protocolStats.RecordCacheMiss()
+		}
+		writeError(writer, request, http.StatusNotFound, errorCodeBlobNotFound, "The specified blob does not exist.")
+
+		return
+	}
 	if err != nil {
 		fail(writer, request, http.StatusInternalServerError, "failed to generate cache download URLs",
 			"key", key, "err", err)
@@ -86,12 +97,18 @@ func (azureBlob *AzureBlob) retrieveCacheEntryInfo(
 	if recordHitMiss {
 		switch resp.StatusCode {
 		case http.StatusOK, http.StatusPartialContent, http.StatusNoContent:
-			stats.Default().RecordCacheHit()
+			protocolStats.RecordCacheHit()
 		case http.StatusNotFound:
-			stats.Default().RecordCacheMiss()
+			protocolStats.RecordCacheMiss()
 		}
 	}
 
+	if resp.StatusCode == http.StatusNotFound {
+		writeError(writer, request, http.StatusNotFound, errorCodeBlobNotFound, "The specified blob does not exist.")
+
+		return true
+	}
+
 	if contentLength := resp.Header.Get("Content-Length"); contentLength != "" {
 		writer.Header().Set("Content-Length", contentLength)
 	}
@@ -1,5 +1,7 @@
 package azureblob
 
+import urlproxy "github.com/cirruslabs/omni-cache/pkg/url-proxy"
+
 type Option func(azureBlob *AzureBlob)
 
 func WithUnexpectedEOFReader() Option {
@@ -7,3 +9,11 @@ func WithUnexpectedEOFReader() Option {
 		azureBlob.withUnexpectedEOFReader = true
 	}
 }
+
+// WithFlushPolicy sets how often blob downloads are flushed to the client.
+// Defaults to urlproxy.DefaultFlushPolicy.
+func WithFlushPolicy(policy urlproxy.FlushPolicy) Option {
+	return func(azureBlob *AzureBlob) {
+		azureBlob.flushPolicy = policy
+	}
+}
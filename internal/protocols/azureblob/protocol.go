@@ -6,6 +6,7 @@ import (
 
 	"github.com/cirruslabs/omni-cache/pkg/protocols"
 	"github.com/cirruslabs/omni-cache/pkg/storage"
+	urlproxy "github.com/cirruslabs/omni-cache/pkg/url-proxy"
 )
 
 // Factory wires the azure-blob compatibility protocol used by GHA cache v2 clients.
@@ -14,29 +15,64 @@ import (
 //	GET /_azureblob/cirrus-runners-cache/{key...} (supports range requests)
 //	HEAD /_azureblob/cirrus-runners-cache/{key...}
 //	PUT /_azureblob/cirrus-runners-cache/{key...}
-type Factory struct{}
+//
+// DELETE, POST and PATCH requests, and Blob Storage operations selected with a "comp"
+// query parameter other than block and blocklist, fail with the error codes Azure SDKs
+// expect.
+type Factory struct {
+	Options Options
+}
+
+// Options configures the azure-blob protocol.
+type Options struct {
+	// FlushPolicy overrides urlproxy.DefaultFlushPolicy for blob downloads when set.
+	FlushPolicy *urlproxy.FlushPolicy
+	// CommitRetries retries committing multipart uploads after failures that may be
+	// transient before reporting them to the client. The zero value doesn't retry.
+	CommitRetries storage.RetryPolicy
+}
 
 func (Factory) ID() string {
 	return "azure-blob"
 }
 
-func (Factory) New(deps protocols.Dependencies) (protocols.Protocol, error) {
+func (Factory) Describe() protocols.Description {
+	return protocols.Description{
+		Summary: "Azure Blob Storage subset used by GitHub Actions cache v2 clients",
+		HTTPRoutes: []string{
+			"GET " + APIMountPoint + "/{key...}",
+			"HEAD " + APIMountPoint + "/{key...}",
+			"PUT " + APIMountPoint + "/{key...}",
+			"DELETE " + APIMountPoint + "/{key...}",
+			"POST " + APIMountPoint + "/{key...}",
+			"PATCH " + APIMountPoint + "/{key...}",
+		},
+		Features: []string{"range-requests", "block-uploads"},
+	}
+}
+
+var protocolStats = protocols.Stats(Factory{}.ID())
+
+func (f Factory) New(deps protocols.Dependencies) (protocols.Protocol, error) {
 	deps = deps.WithDefaults()
 
 	backend, ok := deps.Storage.(storage.MultipartBlobStorageBackend)
 	if !ok {
 		return nil, fmt.Errorf("azure-blob requires multipart storage backend")
 	}
+	backend = storage.NewCommitRetryStorage(backend, f.Options.CommitRetries)
 
 	return &protocol{
 		backend: backend,
 		http:    deps.HTTP,
+		options: f.Options,
 	}, nil
 }
 
 type protocol struct {
 	backend storage.MultipartBlobStorageBackend
 	http    *http.Client
+	options Options
 }
 
 func (p *protocol) Register(registrar *protocols.Registrar) error {
@@ -45,11 +81,21 @@ func (p *protocol) Register(registrar *protocols.Registrar) error {
 		return fmt.Errorf("http mux is nil")
 	}
 
-	azure := New(p.backend, p.http)
+	var opts []Option
+	if p.options.FlushPolicy != nil {
+		opts = append(opts, WithFlushPolicy(*p.options.FlushPolicy))
+	}
+
+	azure := New(p.backend, p.http, opts...)
 	handler := http.StripPrefix(APIMountPoint, azure)
 
 	mux.Handle("GET "+APIMountPoint+"/{key...}", handler)
 	mux.Handle("HEAD "+APIMountPoint+"/{key...}", handler)
 	mux.Handle("PUT "+APIMountPoint+"/{key...}", handler)
+	// Claimed so that they're rejected with Azure errors rather than falling through to
+	// protocols serving the root, such as the HTTP cache.
+	for _, method := range []string{http.MethodDelete, http.MethodPost, http.MethodPatch} {
+		mux.Handle(method+" "+APIMountPoint+"/{key...}", handler)
+	}
 	return nil
 }
@@ -2,6 +2,7 @@ package azureblob
 
 import (
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -10,7 +11,6 @@ import (
 	"time"
 
 	uploadablepkg "github.com/cirruslabs/omni-cache/internal/protocols/azureblob/uploadable"
-	"github.com/cirruslabs/omni-cache/pkg/stats"
 	omnistorage "github.com/cirruslabs/omni-cache/pkg/storage"
 	"github.com/dustin/go-humanize"
 	"github.com/go-chi/render"
@@ -28,12 +28,14 @@ type blockList struct {
 
 func (azureBlob *AzureBlob) putBlobAbstract(writer http.ResponseWriter, request *http.Request) {
 	switch request.URL.Query().Get("comp") {
+	case "":
+		azureBlob.putBlob(writer, request)
 	case "block":
 		azureBlob.putBlock(writer, request)
 	case "blocklist":
 		azureBlob.putBlockList(writer, request)
 	default:
-		azureBlob.putBlob(writer, request)
+		azureBlob.unsupportedOperation(writer, request)
 	}
 }
 
@@ -52,7 +54,7 @@ func (azureBlob *AzureBlob) putBlob(writer http.ResponseWriter, request *http.Re
 	// Generate cache upload URL
 	urlInfo, err := azureBlob.storageBackend.UploadURL(request.Context(), key, nil)
 	if err != nil {
-		fail(writer, request, http.StatusInternalServerError, "failed to generate cache upload URL",
+		fail(writer, request, uploadFailureStatus(err), "failed to generate cache upload URL",
 			"key", key, "err", err)
 
 		return
@@ -78,7 +80,7 @@ func (azureBlob *AzureBlob) putBlob(writer http.ResponseWriter, request *http.Re
 	req.ContentLength = int64(contentLength)
 
 	startedAt := time.Now()
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := azureBlob.httpClient.Do(req)
 	if err != nil {
 		fail(writer, request, http.StatusInternalServerError, "failed to perform request to proxy "+
 			"cache entry upload", "key", key, "err", err)
@@ -98,7 +100,7 @@ func (azureBlob *AzureBlob) putBlob(writer http.ResponseWriter, request *http.Re
 		return
 	}
 
-	stats.Default().RecordUpload(int64(contentLength), time.Since(startedAt))
+	protocolStats.RecordUpload(int64(contentLength), time.Since(startedAt))
 	writer.WriteHeader(http.StatusCreated)
 }
 
@@ -158,7 +160,7 @@ func (azureBlob *AzureBlob) putBlock(writer http.ResponseWriter, request *http.R
 		return azureBlob.storageBackend.CreateMultipartUpload(request.Context(), key, nil)
 	})
 	if err != nil {
-		fail(writer, request, http.StatusInternalServerError, "failed to create new multipart upload",
+		fail(writer, request, uploadFailureStatus(err), "failed to create new multipart upload",
 			"key", key, "blockid", blockID, "err", err)
 
 		return
@@ -166,7 +168,7 @@ func (azureBlob *AzureBlob) putBlock(writer http.ResponseWriter, request *http.R
 
 	urlInfo, err := azureBlob.storageBackend.UploadPartURL(request.Context(), key, uploadID, partNumber, contentLength)
 	if err != nil {
-		fail(writer, request, http.StatusInternalServerError, "failed to create new multipart upload part",
+		fail(writer, request, uploadFailureStatus(err), "failed to create new multipart upload part",
 			"key", key, "blockid", blockID, "uploadid", uploadID, "err", err)
 
 		return
@@ -189,7 +191,7 @@ func (azureBlob *AzureBlob) putBlock(writer http.ResponseWriter, request *http.R
 		req.Header.Set(key, value)
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := azureBlob.httpClient.Do(req)
 	if err != nil {
 		fail(writer, request, http.StatusInternalServerError, "failed to perform request to proxy "+
 			"cache multipart entry upload", "key", key, "blockid", blockID, "err", err)
@@ -285,7 +287,7 @@ func (azureBlob *AzureBlob) putBlockList(writer http.ResponseWriter, request *ht
 	if uploadable.Local() {
 		urlInfo, err := azureBlob.storageBackend.UploadURL(request.Context(), key, nil)
 		if err != nil {
-			fail(writer, request, http.StatusInternalServerError, "failed to generate cache upload URL "+
+			fail(writer, request, uploadFailureStatus(err), "failed to generate cache upload URL "+
 				"for local part upload", "key", key, "uploadid", uploadID, "err", err)
 
 			return
@@ -309,7 +311,7 @@ func (azureBlob *AzureBlob) putBlockList(writer http.ResponseWriter, request *ht
 		// Content-Length is required to avoid HTTP 411
 		uploadReq.ContentLength = localPartReadersTotalBytes
 
-		uploadResp, err := http.DefaultClient.Do(uploadReq)
+		uploadResp, err := azureBlob.httpClient.Do(uploadReq)
 		if err != nil {
 			fail(writer, request, http.StatusInternalServerError, "failed to perform request to cache upload URL "+
 				"for local part upload", "key", key, "uploadid", uploadID, "err", err)
@@ -326,7 +328,7 @@ func (azureBlob *AzureBlob) putBlockList(writer http.ResponseWriter, request *ht
 		}
 
 		if totalBytes, startedAt := uploadable.Stats(); !startedAt.IsZero() {
-			stats.Default().RecordUpload(totalBytes, time.Since(startedAt))
+			protocolStats.RecordUpload(totalBytes, time.Since(startedAt))
 		}
 		azureBlob.uploadables.Delete(key)
 		writer.WriteHeader(http.StatusCreated)
@@ -336,15 +338,28 @@ func (azureBlob *AzureBlob) putBlockList(writer http.ResponseWriter, request *ht
 
 	err := azureBlob.storageBackend.CommitMultipartUpload(request.Context(), key, uploadID, multipartParts)
 	if err != nil {
-		fail(writer, request, http.StatusInternalServerError, "failed to commit a multipart upload",
+		fail(writer, request, uploadFailureStatus(err), "failed to commit a multipart upload",
 			"key", key, "uploadid", uploadID, "err", err)
 
 		return
 	}
 
 	if totalBytes, startedAt := uploadable.Stats(); !startedAt.IsZero() {
-		stats.Default().RecordUpload(totalBytes, time.Since(startedAt))
+		protocolStats.RecordUpload(totalBytes, time.Since(startedAt))
 	}
 	azureBlob.uploadables.Delete(key)
 	writer.WriteHeader(http.StatusCreated)
 }
+
+// uploadFailureStatus maps errors from initiating an upload to an HTTP status,
+// reporting storage quota rejections as HTTP 413 and writes to a read-only cache
+// as HTTP 403.
+func uploadFailureStatus(err error) int {
+	if errors.Is(err, omnistorage.ErrQuotaExceeded) {
+		return http.StatusRequestEntityTooLarge
+	}
+	if errors.Is(err, omnistorage.ErrReadOnly) {
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
@@ -3,22 +3,29 @@ package bazel_remote
 import (
 	"bytes"
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"sort"
 	"strings"
 
 	remoteasset "github.com/cirruslabs/omni-cache/internal/api/build/bazel/remote/asset/v1"
 	remoteexecution "github.com/cirruslabs/omni-cache/internal/api/build/bazel/remote/execution/v2"
+	"github.com/cirruslabs/omni-cache/internal/digestfn"
+	"github.com/cirruslabs/omni-cache/pkg/kvstore"
 	"github.com/cirruslabs/omni-cache/pkg/storage"
 	urlproxy "github.com/cirruslabs/omni-cache/pkg/url-proxy"
 )
 
 type assetStore struct {
-	backend storage.BlobStorageBackend
-	proxy   *urlproxy.Proxy
+	backend   storage.BlobStorageBackend
+	proxy     *urlproxy.Proxy
+	keyPrefix string
+
+	// mappings, when set, caches blob mappings in front of the backend, which stays
+	// the source of truth: mappings are written to both, and read from the backend
+	// only when they are missing from mappings.
+	mappings kvstore.Store
 }
 
 type blobMapping struct {
@@ -28,8 +35,8 @@ type blobMapping struct {
 	DigestFunction string `json:"digest_function"`
 }
 
-func newAssetStore(backend storage.BlobStorageBackend, proxy *urlproxy.Proxy) *assetStore {
-	return &assetStore{backend: backend, proxy: proxy}
+func newAssetStore(backend storage.BlobStorageBackend, proxy *urlproxy.Proxy, keyPrefix string) *assetStore {
+	return &assetStore{backend: backend, proxy: proxy, keyPrefix: keyPrefixOrDefault(keyPrefix)}
 }
 
 func (s *assetStore) PutBlobMapping(
@@ -63,13 +70,17 @@ func (s *assetStore) PutBlobMapping(
 		return err
 	}
 
-	key := blobMappingObjectKey(instanceName, uri, qualifiers)
+	key := blobMappingObjectKey(s.keyPrefix, instanceName, uri, qualifiers)
 	info, err := s.backend.UploadURL(ctx, key, nil)
 	if err != nil {
 		return err
 	}
 
-	return s.proxy.UploadFromReader(ctx, info, key, bytes.NewReader(payload), int64(len(payload)))
+	if err := s.proxy.UploadFromReader(ctx, info, key, bytes.NewReader(payload), int64(len(payload))); err != nil {
+		return err
+	}
+	s.cacheMapping(ctx, key, payload)
+	return nil
 }
 
 func (s *assetStore) GetBlobMapping(
@@ -85,7 +96,11 @@ func (s *assetStore) GetBlobMapping(
 		return nil, false, fmt.Errorf("uri is empty")
 	}
 
-	key := blobMappingObjectKey(instanceName, uri, qualifiers)
+	key := blobMappingObjectKey(s.keyPrefix, instanceName, uri, qualifiers)
+	if digest, ok := s.cachedMapping(ctx, instanceName, key); ok {
+		return digest, true, nil
+	}
+
 	infos, err := s.backend.DownloadURLs(ctx, key)
 	if err != nil {
 		if storage.IsNotFoundError(err) {
@@ -114,8 +129,63 @@ func (s *assetStore) GetBlobMapping(
 		return nil, false, nil
 	}
 
+	digest, found, err := decodeBlobMapping(payload.Bytes())
+	if err == nil {
+		s.cacheMapping(ctx, key, payload.Bytes())
+	}
+	return digest, found, err
+}
+
+// cachedMapping returns the digest that the mapping store maps key to, as long as that
+// blob is still in storage: the store bypasses the backend, so the backend's expiry and
+// deletes only apply through the blob.
+func (s *assetStore) cachedMapping(ctx context.Context, instanceName string, key string) (*remoteexecution.Digest, bool) {
+	if s.mappings == nil {
+		return nil, false
+	}
+	payload, found, err := s.mappings.Get(ctx, key)
+	if err != nil {
+		slog.WarnContext(ctx, "failed to look up blob mapping in the mapping store, falling back to storage",
+			"key", key, "err", err)
+		return nil, false
+	}
+	if !found {
+		return nil, false
+	}
+	digest, _, err := decodeBlobMapping(payload)
+	if err != nil {
+		slog.WarnContext(ctx, "invalid blob mapping in the mapping store, falling back to storage", "key", key, "err", err)
+		return nil, false
+	}
+
+	_, err = s.backend.CacheInfo(ctx, casObjectKey(s.keyPrefix, instanceName, digest), nil)
+	if storage.IsNotFoundError(err) {
+		if err := s.mappings.Delete(ctx, key); err != nil {
+			slog.WarnContext(ctx, "failed to delete stale blob mapping from the mapping store", "key", key, "err", err)
+		}
+		return nil, false
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "failed to check the blob of a cached mapping, falling back to storage", "key", key, "err", err)
+		return nil, false
+	}
+	return digest, true
+}
+
+// cacheMapping stores a mapping payload in the mapping store, if any. Failures only cost
+// a slower lookup later, so they are logged rather than returned.
+func (s *assetStore) cacheMapping(ctx context.Context, key string, payload []byte) {
+	if s.mappings == nil {
+		return
+	}
+	if err := s.mappings.Put(ctx, key, payload); err != nil {
+		slog.WarnContext(ctx, "failed to store blob mapping in the mapping store", "key", key, "err", err)
+	}
+}
+
+func decodeBlobMapping(payload []byte) (*remoteexecution.Digest, bool, error) {
 	var mapping blobMapping
-	if err := json.Unmarshal(payload.Bytes(), &mapping); err != nil {
+	if err := json.Unmarshal(payload, &mapping); err != nil {
 		return nil, false, err
 	}
 
@@ -133,10 +203,9 @@ func (s *assetStore) GetBlobMapping(
 	return digest, true, nil
 }
 
-func blobMappingObjectKey(instanceName string, uri string, qualifiers []*remoteasset.Qualifier) string {
+func blobMappingObjectKey(keyPrefix string, instanceName string, uri string, qualifiers []*remoteasset.Qualifier) string {
 	key := canonicalAssetKey("blob", instanceName, uri, qualifiers, remoteexecution.DigestFunction_SHA256)
-	sum := sha256.Sum256([]byte(key))
-	return fmt.Sprintf("bazel/asset/v1/%s/blob/%s.json", encodeInstance(instanceName), hex.EncodeToString(sum[:]))
+	return fmt.Sprintf("%s/asset/v1/%s/blob/%s.json", keyPrefix, encodeInstance(instanceName), digestfn.SHA256.SumHex([]byte(key)))
 }
 
 func canonicalAssetKey(
@@ -0,0 +1,84 @@
+package bazel_remote
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	remoteasset "github.com/cirruslabs/omni-cache/internal/api/build/bazel/remote/asset/v1"
+	remoteexecution "github.com/cirruslabs/omni-cache/internal/api/build/bazel/remote/execution/v2"
+	"github.com/cirruslabs/omni-cache/pkg/kvstore"
+	urlproxy "github.com/cirruslabs/omni-cache/pkg/url-proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAssetStoreMappingStore(t *testing.T) {
+	ctx := context.Background()
+	redisServer := miniredis.RunT(t)
+	mappings, err := kvstore.NewRedisStoreFromURL("redis://"+redisServer.Addr(), 0)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = mappings.Close()
+	})
+
+	backend := newMemoryHTTPBackend(t)
+	proxy := urlproxy.NewProxy(urlproxy.WithHTTPClient(backend.server.Client()))
+	assets := newAssetStore(backend, proxy, "")
+	assets.mappings = mappings
+
+	qualifiers := []*remoteasset.Qualifier{{Name: "checksum.sri", Value: "sha256-abc"}}
+	digest := &remoteexecution.Digest{Hash: strings.Repeat("a", 64), SizeBytes: 42}
+	blobKey := casObjectKey(assets.keyPrefix, "", digest)
+	backend.mu.Lock()
+	backend.objects[blobKey] = make([]byte, digest.GetSizeBytes())
+	backend.mu.Unlock()
+
+	// Mappings are written through to both the backend and Redis.
+	require.NoError(t, assets.PutBlobMapping(ctx, "", "https://example.com/a.tar.gz", qualifiers, digest))
+	key := blobMappingObjectKey(assets.keyPrefix, "", "https://example.com/a.tar.gz", qualifiers)
+	require.True(t, redisServer.Exists(key))
+
+	// Lookups are served from Redis without downloading the mapping from the backend.
+	backend.mu.Lock()
+	delete(backend.objects, key)
+	backend.mu.Unlock()
+	found, ok, err := assets.GetBlobMapping(ctx, "", "https://example.com/a.tar.gz", qualifiers)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, digest.GetHash(), found.GetHash())
+	require.Equal(t, digest.GetSizeBytes(), found.GetSizeBytes())
+
+	// Mappings missing from Redis fall back to the backend and are cached.
+	withoutRedis := newAssetStore(backend, proxy, "")
+	require.NoError(t, withoutRedis.PutBlobMapping(ctx, "", "https://example.com/b.tar.gz", nil, digest))
+	found, ok, err = assets.GetBlobMapping(ctx, "", "https://example.com/b.tar.gz", nil)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, digest.GetHash(), found.GetHash())
+	require.True(t, redisServer.Exists(blobMappingObjectKey(assets.keyPrefix, "", "https://example.com/b.tar.gz", nil)))
+
+	// Mappings missing from both are reported as absent.
+	_, ok, err = assets.GetBlobMapping(ctx, "", "https://example.com/missing.tar.gz", nil)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// Mappings whose blob is gone aren't served from Redis, and are dropped from it.
+	backend.mu.Lock()
+	delete(backend.objects, blobKey)
+	backend.mu.Unlock()
+	_, ok, err = assets.GetBlobMapping(ctx, "", "https://example.com/a.tar.gz", qualifiers)
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.False(t, redisServer.Exists(key))
+	backend.mu.Lock()
+	backend.objects[blobKey] = make([]byte, digest.GetSizeBytes())
+	backend.mu.Unlock()
+
+	// Redis outages degrade to backend lookups.
+	redisServer.Close()
+	found, ok, err = assets.GetBlobMapping(ctx, "", "https://example.com/b.tar.gz", nil)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, digest.GetHash(), found.GetHash())
+}
@@ -1,14 +1,19 @@
 package bazel_remote
 
 import (
+	"bytes"
 	"context"
-	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"hash"
 	"io"
 	"os"
 
+	remoteexecution "github.com/cirruslabs/omni-cache/internal/api/build/bazel/remote/execution/v2"
+	"github.com/cirruslabs/omni-cache/internal/digestfn"
 	"github.com/cirruslabs/omni-cache/pkg/storage"
+	"github.com/klauspost/compress/zstd"
 	bytestream "google.golang.org/genproto/googleapis/bytestream"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -19,6 +24,13 @@ const bytestreamChunkSize = 64 * 1024
 type byteStreamServer struct {
 	bytestream.UnimplementedByteStreamServer
 	store *casStore
+
+	// spoolThreshold is the largest upload, by declared size, that is buffered in
+	// memory rather than spooled to a temp file. Zero spools every upload.
+	spoolThreshold int64
+	// skipDigestVerification trusts the digest in the resource name instead of hashing
+	// uploads to check it. The size is still checked.
+	skipDigestVerification bool
 }
 
 func newByteStreamServer(store *casStore) *byteStreamServer {
@@ -42,6 +54,11 @@ func (s *byteStreamServer) Read(req *bytestream.ReadRequest, stream bytestream.B
 		return status.Errorf(codes.Internal, "download blob: %v", err)
 	}
 
+	// For compressed-blobs, read_offset and read_limit apply to the compressed stream.
+	if parsed.compressor == remoteexecution.Compressor_ZSTD {
+		data = zstdEncoder.EncodeAll(data, nil)
+	}
+
 	offset := req.GetReadOffset()
 	if offset < 0 {
 		return status.Error(codes.InvalidArgument, "read_offset must be non-negative")
@@ -70,6 +87,15 @@ func (s *byteStreamServer) Read(req *bytestream.ReadRequest, stream bytestream.B
 	return nil
 }
 
+// Write stores a CAS blob. The resource name must carry the full digest, including a
+// known, non-negative size, and the upload is rejected unless the byte count matches it.
+// The hash is checked too unless skipDigestVerification is set, in which case the digest
+// is trusted and only the size of stored blobs is verified. There is no unknown-size (-1)
+// mode that validates only the hash.
+//
+// Uploads to compressed-blobs resources are decompressed as they arrive, and the digest
+// is checked against the decompressed data, which is what gets stored. write_offset and
+// the returned committed_size count compressed bytes.
 func (s *byteStreamServer) Write(stream bytestream.ByteStream_WriteServer) error {
 	first, err := stream.Recv()
 	if err != nil {
@@ -92,16 +118,19 @@ func (s *byteStreamServer) Write(stream bytestream.ByteStream_WriteServer) error
 		return status.Errorf(codes.InvalidArgument, "invalid write resource name: %v", err)
 	}
 
-	tmpFile, err := os.CreateTemp("", "omni-cache-bazel-upload-*")
+	spool, err := newWriteSpool(parsed.digest.GetSizeBytes(), s.spoolThreshold)
 	if err != nil {
 		return status.Errorf(codes.Internal, "create temp file: %v", err)
 	}
-	defer func() {
-		_ = tmpFile.Close()
-		_ = os.Remove(tmpFile.Name())
-	}()
+	defer spool.Close()
+
+	blob := &blobWriter{spool: spool, limit: parsed.digest.GetSizeBytes()}
+	if !s.skipDigestVerification {
+		blob.hasher = digestfn.SHA256.New()
+	}
+	sink := newWriteSink(parsed.compressor, blob)
+	defer sink.Close()
 
-	hasher := sha256.New()
 	written := int64(0)
 	finished := false
 
@@ -113,13 +142,9 @@ func (s *byteStreamServer) Write(stream bytestream.ByteStream_WriteServer) error
 			return status.Errorf(codes.InvalidArgument, "invalid write_offset %d, expected %d", current.GetWriteOffset(), written)
 		}
 
-		chunk := current.GetData()
-		if len(chunk) > 0 {
-			if _, err := tmpFile.Write(chunk); err != nil {
-				return status.Errorf(codes.Internal, "write temp file: %v", err)
-			}
-			if _, err := hasher.Write(chunk); err != nil {
-				return status.Errorf(codes.Internal, "hash chunk: %v", err)
+		if chunk := current.GetData(); len(chunk) > 0 {
+			if _, err := sink.Write(chunk); err != nil {
+				return writeErrorStatus(err, parsed.digest.GetSizeBytes())
 			}
 			written += int64(len(chunk))
 		}
@@ -142,20 +167,23 @@ func (s *byteStreamServer) Write(stream bytestream.ByteStream_WriteServer) error
 	if !finished {
 		return status.Error(codes.InvalidArgument, "finish_write was not set")
 	}
-	if written != parsed.digest.GetSizeBytes() {
-		return status.Errorf(codes.InvalidArgument, "uploaded size %d does not match expected %d", written, parsed.digest.GetSizeBytes())
+	if err := sink.Close(); err != nil {
+		return writeErrorStatus(err, parsed.digest.GetSizeBytes())
+	}
+	if blob.written != parsed.digest.GetSizeBytes() {
+		return status.Errorf(codes.InvalidArgument, "uploaded size %d does not match expected %d", blob.written, parsed.digest.GetSizeBytes())
 	}
 
-	sum := hex.EncodeToString(hasher.Sum(nil))
-	if sum != parsed.digest.GetHash() {
+	if blob.hasher != nil && hex.EncodeToString(blob.hasher.Sum(nil)) != parsed.digest.GetHash() {
 		return status.Error(codes.InvalidArgument, "uploaded digest does not match resource name digest")
 	}
 
-	if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
+	body, err := spool.Reader()
+	if err != nil {
 		return status.Errorf(codes.Internal, "seek temp file: %v", err)
 	}
-	if err := s.store.Upload(stream.Context(), parsed.instanceName, parsed.digest, tmpFile); err != nil {
-		return status.Errorf(codes.Internal, "upload blob: %v", err)
+	if err := s.store.Upload(stream.Context(), parsed.instanceName, parsed.digest, body); err != nil {
+		return status.Errorf(uploadErrorCode(err), "upload blob: %v", err)
 	}
 
 	return stream.SendAndClose(&bytestream.WriteResponse{CommittedSize: written})
@@ -182,3 +210,168 @@ func (s *byteStreamServer) QueryWriteStatus(ctx context.Context, req *bytestream
 }
 
 var _ bytestream.ByteStreamServer = (*byteStreamServer)(nil)
+
+// zstdEncoder compresses compressed-blobs reads. EncodeAll is safe for concurrent use.
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+
+var (
+	errUploadTooLarge = errors.New("uploaded size exceeds expected size")
+	errSpoolWrite     = errors.New("write temp file")
+)
+
+// writeErrorStatus maps an error from a writeSink to a gRPC status. Anything that isn't
+// a size or spool failure comes from the decompressor, i.e. the client sent a corrupt
+// stream.
+func writeErrorStatus(err error, expectedSize int64) error {
+	switch {
+	case errors.Is(err, errUploadTooLarge):
+		return status.Errorf(codes.InvalidArgument, "uploaded size exceeds expected %d", expectedSize)
+	case errors.Is(err, errSpoolWrite):
+		return status.Errorf(codes.Internal, "%v", err)
+	default:
+		return status.Errorf(codes.InvalidArgument, "decompress upload: %v", err)
+	}
+}
+
+// blobWriter receives the uncompressed blob, spooling and hashing it. It refuses to
+// grow past limit, which also bounds how much a compressed upload may expand to.
+type blobWriter struct {
+	spool   *writeSpool
+	hasher  hash.Hash
+	limit   int64
+	written int64
+}
+
+func (w *blobWriter) Write(p []byte) (int, error) {
+	if w.written+int64(len(p)) > w.limit {
+		return 0, errUploadTooLarge
+	}
+	if _, err := w.spool.Write(p); err != nil {
+		return 0, fmt.Errorf("%w: %w", errSpoolWrite, err)
+	}
+	if w.hasher != nil {
+		// hash.Hash writes never fail.
+		_, _ = w.hasher.Write(p)
+	}
+	w.written += int64(len(p))
+	return len(p), nil
+}
+
+// writeSink takes the data of a Write stream as sent on the wire. Close flushes it and
+// reports any error left over; it may be called more than once.
+type writeSink interface {
+	io.Writer
+	Close() error
+}
+
+func newWriteSink(compressor remoteexecution.Compressor_Value, blob *blobWriter) writeSink {
+	if compressor == remoteexecution.Compressor_ZSTD {
+		return newZstdSink(blob)
+	}
+	return identitySink{blob}
+}
+
+type identitySink struct {
+	io.Writer
+}
+
+func (identitySink) Close() error {
+	return nil
+}
+
+// zstdSink decompresses a zstd stream into a blobWriter. The decoder pulls from a pipe
+// in its own goroutine, so compressed chunks are decoded as they arrive rather than
+// after the whole upload has been received.
+type zstdSink struct {
+	pipe *io.PipeWriter
+	done chan error
+
+	closed bool
+	err    error
+}
+
+func newZstdSink(blob *blobWriter) *zstdSink {
+	reader, writer := io.Pipe()
+	sink := &zstdSink{pipe: writer, done: make(chan error, 1)}
+
+	go func() {
+		decoder, err := zstd.NewReader(reader, zstd.WithDecoderConcurrency(1))
+		if err == nil {
+			_, err = io.Copy(blob, decoder)
+			decoder.Close()
+		}
+		// Fail further writes with the decoding error, or, once the stream ended
+		// cleanly, with io.ErrClosedPipe.
+		_ = reader.CloseWithError(err)
+		sink.done <- err
+	}()
+
+	return sink
+}
+
+func (s *zstdSink) Write(p []byte) (int, error) {
+	n, err := s.pipe.Write(p)
+	if err != nil {
+		// Prefer the decoder's error, which says why the pipe was closed.
+		if closeErr := s.Close(); closeErr != nil {
+			return n, closeErr
+		}
+	}
+	return n, err
+}
+
+// Close waits for the decoder to finish, so the blobWriter is no longer in use once it
+// returns.
+func (s *zstdSink) Close() error {
+	if !s.closed {
+		s.closed = true
+		_ = s.pipe.Close()
+		s.err = <-s.done
+	}
+	return s.err
+}
+
+// writeSpool holds a ByteStream upload while its digest is verified, in memory when it
+// is small enough and in a temp file otherwise.
+type writeSpool struct {
+	buffer *bytes.Buffer
+	file   *os.File
+}
+
+func newWriteSpool(sizeBytes int64, threshold int64) (*writeSpool, error) {
+	if sizeBytes <= threshold {
+		return &writeSpool{buffer: bytes.NewBuffer(make([]byte, 0, sizeBytes))}, nil
+	}
+
+	file, err := os.CreateTemp("", "omni-cache-bazel-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	return &writeSpool{file: file}, nil
+}
+
+func (s *writeSpool) Write(p []byte) (int, error) {
+	if s.file != nil {
+		return s.file.Write(p)
+	}
+	return s.buffer.Write(p)
+}
+
+// Reader returns the spooled upload from its start.
+func (s *writeSpool) Reader() (io.Reader, error) {
+	if s.file == nil {
+		return bytes.NewReader(s.buffer.Bytes()), nil
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return s.file, nil
+}
+
+// Close removes the temp file, if any.
+func (s *writeSpool) Close() {
+	if s.file != nil {
+		_ = s.file.Close()
+		_ = os.Remove(s.file.Name())
+	}
+}
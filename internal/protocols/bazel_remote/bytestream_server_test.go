@@ -1,11 +1,13 @@
 package bazel_remote
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"testing"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/require"
 	bytestream "google.golang.org/genproto/googleapis/bytestream"
 	"google.golang.org/grpc"
@@ -54,6 +56,129 @@ func TestByteStreamWriteReadRoundTrip(t *testing.T) {
 	require.Equal(t, data, downloaded)
 }
 
+func TestByteStreamWriteSpoolThreshold(t *testing.T) {
+	cas, _ := newTestStores(t)
+	conn := newGRPCConn(t, func(server *grpc.Server) {
+		byteStream := newByteStreamServer(cas)
+		byteStream.spoolThreshold = 16
+		bytestream.RegisterByteStreamServer(server, byteStream)
+	})
+
+	client := bytestream.NewByteStreamClient(conn)
+	ctx := context.Background()
+
+	// Uploads at or below the threshold are buffered in memory, larger ones spooled.
+	for _, data := range [][]byte{[]byte("small blob"), []byte("a blob larger than the spool threshold")} {
+		digest := digestForData(data)
+		resourceName := fmt.Sprintf("instance/uploads/u-1/blobs/%s/%d", digest.GetHash(), digest.GetSizeBytes())
+
+		writeStream, err := client.Write(ctx)
+		require.NoError(t, err)
+		require.NoError(t, writeStream.Send(&bytestream.WriteRequest{ResourceName: resourceName, Data: data[:4]}))
+		require.NoError(t, writeStream.Send(&bytestream.WriteRequest{WriteOffset: 4, Data: data[4:], FinishWrite: true}))
+		writeResponse, err := writeStream.CloseAndRecv()
+		require.NoError(t, err)
+		require.EqualValues(t, len(data), writeResponse.GetCommittedSize())
+
+		downloaded, err := cas.DownloadBytes(ctx, "instance", digest)
+		require.NoError(t, err)
+		require.Equal(t, data, downloaded)
+	}
+}
+
+func TestByteStreamWriteDigestVerification(t *testing.T) {
+	for _, skip := range []bool{false, true} {
+		t.Run(fmt.Sprintf("skip=%t", skip), func(t *testing.T) {
+			cas, _ := newTestStores(t)
+			conn := newGRPCConn(t, func(server *grpc.Server) {
+				byteStream := newByteStreamServer(cas)
+				byteStream.skipDigestVerification = skip
+				bytestream.RegisterByteStreamServer(server, byteStream)
+			})
+			client := bytestream.NewByteStreamClient(conn)
+
+			write := func(digest string, sizeBytes int64, data []byte) error {
+				resourceName := fmt.Sprintf("instance/uploads/u-1/blobs/%s/%d", digest, sizeBytes)
+				writeStream, err := client.Write(context.Background())
+				require.NoError(t, err)
+				require.NoError(t, writeStream.Send(&bytestream.WriteRequest{ResourceName: resourceName, Data: data, FinishWrite: true}))
+				_, err = writeStream.CloseAndRecv()
+				return err
+			}
+
+			// The data doesn't hash to the declared digest.
+			data := []byte("hello")
+			mismatched := digestForData([]byte("world"))
+			err := write(mismatched.GetHash(), mismatched.GetSizeBytes(), data)
+			if skip {
+				require.NoError(t, err)
+			} else {
+				require.Equal(t, codes.InvalidArgument, status.Code(err))
+			}
+
+			// Sizes are verified either way.
+			err = write(mismatched.GetHash(), mismatched.GetSizeBytes()+1, data)
+			require.Equal(t, codes.InvalidArgument, status.Code(err))
+		})
+	}
+}
+
+func TestByteStreamWriteRejectsOversizedUpload(t *testing.T) {
+	cas, _ := newTestStores(t)
+	conn := newGRPCConn(t, func(server *grpc.Server) {
+		byteStream := newByteStreamServer(cas)
+		byteStream.spoolThreshold = DefaultSpoolThresholdBytes
+		bytestream.RegisterByteStreamServer(server, byteStream)
+	})
+
+	client := bytestream.NewByteStreamClient(conn)
+	data := []byte("hello")
+	digest := digestForData(data)
+	resourceName := fmt.Sprintf("instance/uploads/u-1/blobs/%s/%d", digest.GetHash(), digest.GetSizeBytes())
+
+	writeStream, err := client.Write(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, writeStream.Send(&bytestream.WriteRequest{ResourceName: resourceName, Data: []byte("hello, and then some")}))
+	_, err = writeStream.CloseAndRecv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+// BenchmarkWriteSpool compares holding a small ByteStream upload in memory against
+// spooling it to a temp file, as done for each of the many small blobs Bazel uploads
+// when populating the CAS.
+func BenchmarkWriteSpool(b *testing.B) {
+	data := make([]byte, 4*1024)
+
+	for _, bc := range []struct {
+		name      string
+		threshold int64
+	}{
+		{"memory", DefaultSpoolThresholdBytes},
+		{"tempfile", 0},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for b.Loop() {
+				spool, err := newWriteSpool(int64(len(data)), bc.threshold)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := spool.Write(data); err != nil {
+					b.Fatal(err)
+				}
+				body, err := spool.Reader()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(io.Discard, body); err != nil {
+					b.Fatal(err)
+				}
+				spool.Close()
+			}
+		})
+	}
+}
+
 func TestByteStreamWriteRejectsNonSequentialOffsets(t *testing.T) {
 	cas, _ := newTestStores(t)
 	conn := newGRPCConn(t, func(server *grpc.Server) {
@@ -78,3 +203,100 @@ func TestByteStreamWriteRejectsNonSequentialOffsets(t *testing.T) {
 	require.True(t, ok)
 	require.Equal(t, codes.InvalidArgument, st.Code())
 }
+
+func TestByteStreamCompressedRoundTrip(t *testing.T) {
+	cas, _ := newTestStores(t)
+	conn := newGRPCConn(t, func(server *grpc.Server) {
+		bytestream.RegisterByteStreamServer(server, newByteStreamServer(cas))
+	})
+
+	client := bytestream.NewByteStreamClient(conn)
+	ctx := context.Background()
+
+	data := bytes.Repeat([]byte("hello compressed bytestream "), 10_000)
+	digest := digestForData(data)
+	compressed := zstdEncoder.EncodeAll(data, nil)
+	require.Less(t, len(compressed), len(data))
+
+	// Send the compressed stream in several chunks, so it's decoded across writes.
+	resourceName := fmt.Sprintf("instance/uploads/u-1/compressed-blobs/zstd/%s/%d", digest.GetHash(), digest.GetSizeBytes())
+	writeStream, err := client.Write(ctx)
+	require.NoError(t, err)
+	for offset := 0; offset < len(compressed); offset += 100 {
+		end := min(offset+100, len(compressed))
+		require.NoError(t, writeStream.Send(&bytestream.WriteRequest{
+			ResourceName: resourceName,
+			WriteOffset:  int64(offset),
+			Data:         compressed[offset:end],
+			FinishWrite:  end == len(compressed),
+		}))
+	}
+	writeResponse, err := writeStream.CloseAndRecv()
+	require.NoError(t, err)
+	require.EqualValues(t, len(compressed), writeResponse.GetCommittedSize())
+
+	// The blob is stored uncompressed.
+	require.Equal(t, data, readAll(t, client, fmt.Sprintf("instance/blobs/%s/%d", digest.GetHash(), digest.GetSizeBytes())))
+
+	decoder, err := zstd.NewReader(nil)
+	require.NoError(t, err)
+	defer decoder.Close()
+
+	downloaded := readAll(t, client, fmt.Sprintf("instance/compressed-blobs/zstd/%s/%d", digest.GetHash(), digest.GetSizeBytes()))
+	decompressed, err := decoder.DecodeAll(downloaded, nil)
+	require.NoError(t, err)
+	require.Equal(t, data, decompressed)
+}
+
+func TestByteStreamCompressedWriteRejectsBadUploads(t *testing.T) {
+	cas, _ := newTestStores(t)
+	conn := newGRPCConn(t, func(server *grpc.Server) {
+		bytestream.RegisterByteStreamServer(server, newByteStreamServer(cas))
+	})
+
+	client := bytestream.NewByteStreamClient(conn)
+	ctx := context.Background()
+
+	data := []byte("hello compressed bytestream")
+	digest := digestForData(data)
+	otherDigest := digestForData([]byte("something else entirely"))
+
+	testCases := []struct {
+		name       string
+		hash       string
+		sizeBytes  int64
+		compressed []byte
+	}{
+		{"digest mismatch", otherDigest.GetHash(), digest.GetSizeBytes(), zstdEncoder.EncodeAll(data, nil)},
+		{"decompresses past size", digest.GetHash(), digest.GetSizeBytes() - 1, zstdEncoder.EncodeAll(data, nil)},
+		{"corrupt stream", digest.GetHash(), digest.GetSizeBytes(), data},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resourceName := fmt.Sprintf("instance/uploads/u-1/compressed-blobs/zstd/%s/%d", tc.hash, tc.sizeBytes)
+			writeStream, err := client.Write(ctx)
+			require.NoError(t, err)
+			require.NoError(t, writeStream.Send(&bytestream.WriteRequest{ResourceName: resourceName, Data: tc.compressed, FinishWrite: true}))
+			_, err = writeStream.CloseAndRecv()
+			require.Equal(t, codes.InvalidArgument, status.Code(err))
+		})
+	}
+}
+
+func readAll(t *testing.T, client bytestream.ByteStreamClient, resourceName string) []byte {
+	t.Helper()
+
+	readStream, err := client.Read(context.Background(), &bytestream.ReadRequest{ResourceName: resourceName})
+	require.NoError(t, err)
+
+	var downloaded []byte
+	for {
+		msg, err := readStream.Recv()
+		if err == io.EOF {
+			return downloaded
+		}
+		require.NoError(t, err)
+		downloaded = append(downloaded, msg.GetData()...)
+	}
+}
@@ -7,6 +7,22 @@ import (
 	semver "github.com/cirruslabs/omni-cache/internal/api/build/bazel/semver"
 )
 
+// supportedCompressors lists the compressors accepted by ByteStream compressed-blobs
+// resources. REAPI requires IDENTITY to be supported either way; it's listed so that
+// clients don't have to rely on that.
+var supportedCompressors = []remoteexecution.Compressor_Value{
+	remoteexecution.Compressor_IDENTITY,
+	remoteexecution.Compressor_ZSTD,
+}
+
+// supportedBatchCompressors lists the compressors accepted by BatchUpdateBlobs, which
+// only takes uncompressed data.
+var supportedBatchCompressors = []remoteexecution.Compressor_Value{
+	remoteexecution.Compressor_IDENTITY,
+}
+
+// capabilitiesServer advertises what the CAS accepts, so that clients can negotiate the
+// digest function and batch sizes instead of being configured with explicit flags.
 type capabilitiesServer struct {
 	remoteexecution.UnimplementedCapabilitiesServer
 }
@@ -18,13 +34,13 @@ func newCapabilitiesServer() *capabilitiesServer {
 func (s *capabilitiesServer) GetCapabilities(context.Context, *remoteexecution.GetCapabilitiesRequest) (*remoteexecution.ServerCapabilities, error) {
 	return &remoteexecution.ServerCapabilities{
 		CacheCapabilities: &remoteexecution.CacheCapabilities{
-			DigestFunctions: []remoteexecution.DigestFunction_Value{remoteexecution.DigestFunction_SHA256},
+			DigestFunctions: supportedDigestFunctions,
 			ActionCacheUpdateCapabilities: &remoteexecution.ActionCacheUpdateCapabilities{
 				UpdateEnabled: false,
 			},
-			MaxBatchTotalSizeBytes:          0,
-			SupportedCompressors:            nil,
-			SupportedBatchUpdateCompressors: nil,
+			MaxBatchTotalSizeBytes:          maxBatchTotalSizeBytes,
+			SupportedCompressors:            supportedCompressors,
+			SupportedBatchUpdateCompressors: supportedBatchCompressors,
 			SplitBlobSupport:                false,
 			SpliceBlobSupport:               false,
 		},
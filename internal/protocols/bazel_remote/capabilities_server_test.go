@@ -0,0 +1,27 @@
+package bazel_remote
+
+import (
+	"testing"
+
+	remoteexecution "github.com/cirruslabs/omni-cache/internal/api/build/bazel/remote/execution/v2"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+func TestGetCapabilities(t *testing.T) {
+	conn := newGRPCConn(t, func(server *grpc.Server) {
+		remoteexecution.RegisterCapabilitiesServer(server, newCapabilitiesServer())
+	})
+	client := remoteexecution.NewCapabilitiesClient(conn)
+
+	capabilities, err := client.GetCapabilities(t.Context(), &remoteexecution.GetCapabilitiesRequest{InstanceName: "instance"})
+	require.NoError(t, err)
+
+	cacheCapabilities := capabilities.GetCacheCapabilities()
+	require.Equal(t, []remoteexecution.DigestFunction_Value{remoteexecution.DigestFunction_SHA256}, cacheCapabilities.GetDigestFunctions())
+	require.Equal(t, []remoteexecution.Compressor_Value{remoteexecution.Compressor_IDENTITY, remoteexecution.Compressor_ZSTD}, cacheCapabilities.GetSupportedCompressors())
+	require.Equal(t, []remoteexecution.Compressor_Value{remoteexecution.Compressor_IDENTITY}, cacheCapabilities.GetSupportedBatchUpdateCompressors())
+	require.EqualValues(t, maxBatchTotalSizeBytes, cacheCapabilities.GetMaxBatchTotalSizeBytes())
+	require.False(t, cacheCapabilities.GetActionCacheUpdateCapabilities().GetUpdateEnabled())
+	require.Equal(t, int32(2), capabilities.GetHighApiVersion().GetMajor())
+}
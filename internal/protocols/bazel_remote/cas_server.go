@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strconv"
 
 	remoteexecution "github.com/cirruslabs/omni-cache/internal/api/build/bazel/remote/execution/v2"
 	"github.com/cirruslabs/omni-cache/pkg/storage"
@@ -11,8 +12,18 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
+// maxBatchTotalSizeBytes bounds the combined size of blobs read with BatchReadBlobs. It
+// leaves room for message overhead under gRPC's default 4 MiB message size limit; larger
+// reads go through ByteStream.
+const maxBatchTotalSizeBytes = 4*1024*1024 - 64*1024
+
+// maxGetTreePageSize caps the number of directories in a GetTree page, and is the page
+// size used when the client doesn't ask for one.
+const maxGetTreePageSize = 1000
+
 type casServer struct {
 	remoteexecution.UnimplementedContentAddressableStorageServer
 	store *casStore
@@ -42,7 +53,18 @@ func (s *casServer) FindMissingBlobs(ctx context.Context, req *remoteexecution.F
 	return &remoteexecution.FindMissingBlobsResponse{MissingBlobDigests: missing}, nil
 }
 
+// BatchUpdateBlobs writes blobs sent inline. A batch carrying more than
+// maxBatchTotalSizeBytes of data is rejected as a whole with InvalidArgument.
 func (s *casServer) BatchUpdateBlobs(ctx context.Context, req *remoteexecution.BatchUpdateBlobsRequest) (*remoteexecution.BatchUpdateBlobsResponse, error) {
+	var totalSizeBytes int64
+	for _, request := range req.GetRequests() {
+		totalSizeBytes += int64(len(request.GetData()))
+	}
+	if totalSizeBytes > maxBatchTotalSizeBytes {
+		return nil, status.Errorf(codes.InvalidArgument, "batch writes %d bytes, which exceeds the limit of %d bytes; "+
+			"split it or use ByteStream", totalSizeBytes, maxBatchTotalSizeBytes)
+	}
+
 	responses := make([]*remoteexecution.BatchUpdateBlobsResponse_Response, 0, len(req.GetRequests()))
 	for _, request := range req.GetRequests() {
 		response := &remoteexecution.BatchUpdateBlobsResponse_Response{
@@ -71,7 +93,7 @@ func (s *casServer) BatchUpdateBlobs(ctx context.Context, req *remoteexecution.B
 		}
 
 		if err := s.store.UploadBytes(ctx, req.GetInstanceName(), digest, request.GetData()); err != nil {
-			response.Status = rpcStatus(codes.Internal, fmt.Sprintf("upload failed: %v", err))
+			response.Status = rpcStatus(uploadErrorCode(err), fmt.Sprintf("upload failed: %v", err))
 		}
 		responses = append(responses, response)
 	}
@@ -79,15 +101,40 @@ func (s *casServer) BatchUpdateBlobs(ctx context.Context, req *remoteexecution.B
 	return &remoteexecution.BatchUpdateBlobsResponse{Responses: responses}, nil
 }
 
+// BatchReadBlobs reads blobs inline. Blobs that alone exceed maxBatchTotalSizeBytes get an
+// InvalidArgument status so the client reads them with ByteStream instead, and a batch whose
+// remaining blobs add up to more than the limit is rejected as a whole with InvalidArgument,
+// before anything is downloaded.
 func (s *casServer) BatchReadBlobs(ctx context.Context, req *remoteexecution.BatchReadBlobsRequest) (*remoteexecution.BatchReadBlobsResponse, error) {
-	responses := make([]*remoteexecution.BatchReadBlobsResponse_Response, 0, len(req.GetDigests()))
-	for _, requested := range req.GetDigests() {
+	responses := make([]*remoteexecution.BatchReadBlobsResponse_Response, len(req.GetDigests()))
+	digests := make([]*remoteexecution.Digest, len(req.GetDigests()))
+	var totalSizeBytes int64
+	for i, requested := range req.GetDigests() {
 		digest, err := normalizeDigest(requested, req.GetDigestFunction())
-		if err != nil {
-			responses = append(responses, &remoteexecution.BatchReadBlobsResponse_Response{
+		switch {
+		case err != nil:
+			responses[i] = &remoteexecution.BatchReadBlobsResponse_Response{
 				Digest: requested,
 				Status: rpcStatus(codes.InvalidArgument, fmt.Sprintf("invalid digest: %v", err)),
-			})
+			}
+		case digest.GetSizeBytes() > maxBatchTotalSizeBytes:
+			responses[i] = &remoteexecution.BatchReadBlobsResponse_Response{
+				Digest: digest,
+				Status: rpcStatus(codes.InvalidArgument, fmt.Sprintf("blob of %d bytes exceeds the batch limit "+
+					"of %d bytes; read it with ByteStream", digest.GetSizeBytes(), maxBatchTotalSizeBytes)),
+			}
+		default:
+			digests[i] = digest
+			totalSizeBytes += digest.GetSizeBytes()
+		}
+	}
+	if totalSizeBytes > maxBatchTotalSizeBytes {
+		return nil, status.Errorf(codes.InvalidArgument, "batch reads %d bytes, which exceeds the limit of %d bytes; "+
+			"split it or use ByteStream", totalSizeBytes, maxBatchTotalSizeBytes)
+	}
+
+	for i, digest := range digests {
+		if digest == nil {
 			continue
 		}
 
@@ -95,6 +142,7 @@ func (s *casServer) BatchReadBlobs(ctx context.Context, req *remoteexecution.Bat
 			Digest:     digest,
 			Compressor: remoteexecution.Compressor_IDENTITY,
 		}
+		responses[i] = response
 
 		data, err := s.store.DownloadBytes(ctx, req.GetInstanceName(), digest)
 		if err != nil {
@@ -103,20 +151,107 @@ func (s *casServer) BatchReadBlobs(ctx context.Context, req *remoteexecution.Bat
 			} else {
 				response.Status = rpcStatus(codes.Internal, fmt.Sprintf("read failed: %v", err))
 			}
-			responses = append(responses, response)
 			continue
 		}
 
 		response.Data = data
 		response.Status = rpcStatus(codes.OK, "")
-		responses = append(responses, response)
 	}
 
 	return &remoteexecution.BatchReadBlobsResponse{Responses: responses}, nil
 }
 
-func (s *casServer) GetTree(*remoteexecution.GetTreeRequest, grpc.ServerStreamingServer[remoteexecution.GetTreeResponse]) error {
-	return status.Error(codes.Unimplemented, "GetTree is not implemented")
+// GetTree streams the Directory messages of the tree rooted at root_digest in breadth-first
+// order, each distinct directory once. Pages hold at most page_size directories (or
+// maxGetTreePageSize, whichever is smaller) and maxBatchTotalSizeBytes of them; each page
+// but the last carries the page_token that resumes the walk at the page after it. The
+// tree has to be walked from the root again to resume, as the token is only an offset.
+// A directory missing from the CAS fails the call with NotFound.
+func (s *casServer) GetTree(req *remoteexecution.GetTreeRequest, stream grpc.ServerStreamingServer[remoteexecution.GetTreeResponse]) error {
+	ctx := stream.Context()
+
+	root, err := normalizeDigest(req.GetRootDigest(), req.GetDigestFunction())
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid root digest: %v", err)
+	}
+
+	offset := 0
+	if token := req.GetPageToken(); token != "" {
+		offset, err = strconv.Atoi(token)
+		if err != nil || offset < 0 {
+			return status.Errorf(codes.InvalidArgument, "invalid page_token %q", token)
+		}
+	}
+
+	pageSize := int(req.GetPageSize())
+	if pageSize <= 0 || pageSize > maxGetTreePageSize {
+		pageSize = maxGetTreePageSize
+	}
+
+	queue := []*remoteexecution.Digest{root}
+	seen := map[string]bool{root.GetHash(): true}
+	var page []*remoteexecution.Directory
+	var pageBytes int64
+
+	for index := 0; index < len(queue); index++ {
+		directory, err := s.getDirectory(ctx, req.GetInstanceName(), queue[index])
+		if err != nil {
+			return err
+		}
+
+		for _, child := range directory.GetDirectories() {
+			digest, err := normalizeDigest(child.GetDigest(), req.GetDigestFunction())
+			if err != nil {
+				return status.Errorf(codes.InvalidArgument, "directory %s/%d has an invalid child %q: %v",
+					queue[index].GetHash(), queue[index].GetSizeBytes(), child.GetName(), err)
+			}
+			if !seen[digest.GetHash()] {
+				seen[digest.GetHash()] = true
+				queue = append(queue, digest)
+			}
+		}
+
+		if index < offset {
+			continue
+		}
+		if len(page) == pageSize || (len(page) > 0 && pageBytes+queue[index].GetSizeBytes() > maxBatchTotalSizeBytes) {
+			response := &remoteexecution.GetTreeResponse{Directories: page, NextPageToken: strconv.Itoa(index)}
+			if err := stream.Send(response); err != nil {
+				return err
+			}
+			page, pageBytes = nil, 0
+		}
+		page = append(page, directory)
+		pageBytes += queue[index].GetSizeBytes()
+	}
+
+	if offset > 0 && offset >= len(queue) {
+		return status.Errorf(codes.InvalidArgument, "page_token %q is past the end of the tree", req.GetPageToken())
+	}
+
+	return stream.Send(&remoteexecution.GetTreeResponse{Directories: page})
+}
+
+func (s *casServer) getDirectory(ctx context.Context, instanceName string, digest *remoteexecution.Digest) (*remoteexecution.Directory, error) {
+	if digest.GetSizeBytes() > maxBatchTotalSizeBytes {
+		return nil, status.Errorf(codes.InvalidArgument, "directory %s/%d exceeds %d bytes",
+			digest.GetHash(), digest.GetSizeBytes(), maxBatchTotalSizeBytes)
+	}
+
+	data, err := s.store.DownloadBytes(ctx, instanceName, digest)
+	if err != nil {
+		if errors.Is(err, storage.ErrCacheNotFound) {
+			return nil, status.Errorf(codes.NotFound, "directory %s/%d not found", digest.GetHash(), digest.GetSizeBytes())
+		}
+		return nil, status.Errorf(codes.Internal, "read directory %s/%d: %v", digest.GetHash(), digest.GetSizeBytes(), err)
+	}
+
+	var directory remoteexecution.Directory
+	if err := proto.Unmarshal(data, &directory); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "directory %s/%d is not a Directory message: %v",
+			digest.GetHash(), digest.GetSizeBytes(), err)
+	}
+	return &directory, nil
 }
 
 func (s *casServer) SplitBlob(context.Context, *remoteexecution.SplitBlobRequest) (*remoteexecution.SplitBlobResponse, error) {
@@ -127,6 +262,21 @@ func (s *casServer) SpliceBlob(context.Context, *remoteexecution.SpliceBlobReque
 	return nil, status.Error(codes.Unimplemented, "SpliceBlob is not implemented")
 }
 
+// uploadErrorCode reports storage quota rejections as ResourceExhausted and writes to
+// a read-only cache as PermissionDenied.
+func uploadErrorCode(err error) codes.Code {
+	if errors.Is(err, storage.ErrQuotaExceeded) {
+		return codes.ResourceExhausted
+	}
+	if errors.Is(err, storage.ErrReadOnly) {
+		return codes.PermissionDenied
+	}
+	if errors.Is(err, storage.ErrExistingSizeMismatch) {
+		return codes.DataLoss
+	}
+	return codes.Internal
+}
+
 func rpcStatus(code codes.Code, message string) *statuspb.Status {
 	return &statuspb.Status{Code: int32(code), Message: message}
 }
@@ -1,11 +1,15 @@
 package bazel_remote
 
 import (
+	"io"
 	"testing"
 
 	remoteexecution "github.com/cirruslabs/omni-cache/internal/api/build/bazel/remote/execution/v2"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestCASBatchUpdateBlobsRejectsHashMismatch(t *testing.T) {
@@ -47,3 +51,142 @@ func TestCASFindMissingBlobs(t *testing.T) {
 	require.Len(t, response.GetMissingBlobDigests(), 1)
 	require.Equal(t, missingDigest.GetHash(), response.GetMissingBlobDigests()[0].GetHash())
 }
+
+func TestCASBatchReadBlobsEnforcesSizeLimit(t *testing.T) {
+	cas, _ := newTestStores(t)
+	server := newCASServer(cas)
+
+	data := []byte("small")
+	digest := digestForData(data)
+	require.NoError(t, cas.UploadBytes(t.Context(), "instance", digest, data))
+
+	oversize := &remoteexecution.Digest{Hash: digest.GetHash(), SizeBytes: maxBatchTotalSizeBytes + 1}
+	response, err := server.BatchReadBlobs(t.Context(), &remoteexecution.BatchReadBlobsRequest{
+		InstanceName:   "instance",
+		DigestFunction: remoteexecution.DigestFunction_SHA256,
+		Digests:        []*remoteexecution.Digest{oversize, digest},
+	})
+	require.NoError(t, err)
+	require.Len(t, response.GetResponses(), 2)
+	require.Equal(t, int32(codes.InvalidArgument), response.GetResponses()[0].GetStatus().GetCode())
+	require.Equal(t, int32(codes.OK), response.GetResponses()[1].GetStatus().GetCode())
+	require.Equal(t, data, response.GetResponses()[1].GetData())
+
+	half := &remoteexecution.Digest{Hash: digest.GetHash(), SizeBytes: maxBatchTotalSizeBytes/2 + 1}
+	_, err = server.BatchReadBlobs(t.Context(), &remoteexecution.BatchReadBlobsRequest{
+		InstanceName:   "instance",
+		DigestFunction: remoteexecution.DigestFunction_SHA256,
+		Digests:        []*remoteexecution.Digest{half, half},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestCASBatchUpdateBlobsEnforcesSizeLimit(t *testing.T) {
+	cas, _ := newTestStores(t)
+	server := newCASServer(cas)
+
+	data := make([]byte, maxBatchTotalSizeBytes/2+1)
+	digest := digestForData(data)
+	_, err := server.BatchUpdateBlobs(t.Context(), &remoteexecution.BatchUpdateBlobsRequest{
+		InstanceName:   "instance",
+		DigestFunction: remoteexecution.DigestFunction_SHA256,
+		Requests: []*remoteexecution.BatchUpdateBlobsRequest_Request{
+			{Digest: digest, Data: data},
+			{Digest: digest, Data: data},
+		},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestCASGetTree(t *testing.T) {
+	cas, _ := newTestStores(t)
+	conn := newGRPCConn(t, func(server *grpc.Server) {
+		remoteexecution.RegisterContentAddressableStorageServer(server, newCASServer(cas))
+	})
+	client := remoteexecution.NewContentAddressableStorageClient(conn)
+
+	uploadDirectory := func(directory *remoteexecution.Directory) *remoteexecution.Digest {
+		data, err := proto.Marshal(directory)
+		require.NoError(t, err)
+		digest := digestForData(data)
+		require.NoError(t, cas.UploadBytes(t.Context(), "instance", digest, data))
+		return digest
+	}
+
+	// root has children a and b, which share the child c, returned only once.
+	c := &remoteexecution.Directory{Files: []*remoteexecution.FileNode{{Name: "c.txt", Digest: digestForData([]byte("c"))}}}
+	cDigest := uploadDirectory(c)
+	a := &remoteexecution.Directory{Directories: []*remoteexecution.DirectoryNode{{Name: "c", Digest: cDigest}}}
+	b := &remoteexecution.Directory{
+		Files:       []*remoteexecution.FileNode{{Name: "b.txt", Digest: digestForData([]byte("b"))}},
+		Directories: []*remoteexecution.DirectoryNode{{Name: "c", Digest: cDigest}},
+	}
+	root := &remoteexecution.Directory{Directories: []*remoteexecution.DirectoryNode{
+		{Name: "a", Digest: uploadDirectory(a)},
+		{Name: "b", Digest: uploadDirectory(b)},
+	}}
+	rootDigest := uploadDirectory(root)
+
+	getTree := func(pageSize int32, pageToken string) ([]*remoteexecution.GetTreeResponse, error) {
+		stream, err := client.GetTree(t.Context(), &remoteexecution.GetTreeRequest{
+			InstanceName:   "instance",
+			RootDigest:     rootDigest,
+			PageSize:       pageSize,
+			PageToken:      pageToken,
+			DigestFunction: remoteexecution.DigestFunction_SHA256,
+		})
+		require.NoError(t, err)
+
+		var pages []*remoteexecution.GetTreeResponse
+		for {
+			page, err := stream.Recv()
+			if err == io.EOF {
+				return pages, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			pages = append(pages, page)
+		}
+	}
+
+	pages, err := getTree(0, "")
+	require.NoError(t, err)
+	require.Len(t, pages, 1)
+	requireDirectories(t, []*remoteexecution.Directory{root, a, b, c}, pages[0].GetDirectories())
+	require.Empty(t, pages[0].GetNextPageToken())
+
+	pages, err = getTree(3, "")
+	require.NoError(t, err)
+	require.Len(t, pages, 2)
+	requireDirectories(t, []*remoteexecution.Directory{root, a, b}, pages[0].GetDirectories())
+	requireDirectories(t, []*remoteexecution.Directory{c}, pages[1].GetDirectories())
+	require.Equal(t, "3", pages[0].GetNextPageToken())
+	require.Empty(t, pages[1].GetNextPageToken())
+
+	// Resuming from a page token streams the remaining pages.
+	pages, err = getTree(1, pages[0].GetNextPageToken())
+	require.NoError(t, err)
+	require.Len(t, pages, 1)
+	requireDirectories(t, []*remoteexecution.Directory{c}, pages[0].GetDirectories())
+
+	_, err = getTree(1, "not-a-token")
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// A missing directory anywhere in the tree fails the call.
+	missing := &remoteexecution.Directory{Directories: []*remoteexecution.DirectoryNode{
+		{Name: "gone", Digest: digestForData([]byte("not a stored directory"))},
+	}}
+	rootDigest = uploadDirectory(missing)
+	_, err = getTree(0, "")
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func requireDirectories(t *testing.T, expected, actual []*remoteexecution.Directory) {
+	t.Helper()
+
+	require.Len(t, actual, len(expected))
+	for i := range expected {
+		require.True(t, proto.Equal(expected[i], actual[i]), "directory %d differs", i)
+	}
+}
@@ -10,18 +10,20 @@ import (
 	"strings"
 
 	remoteexecution "github.com/cirruslabs/omni-cache/internal/api/build/bazel/remote/execution/v2"
-	"github.com/cirruslabs/omni-cache/pkg/stats"
 	"github.com/cirruslabs/omni-cache/pkg/storage"
 	urlproxy "github.com/cirruslabs/omni-cache/pkg/url-proxy"
 )
 
 type casStore struct {
-	backend storage.BlobStorageBackend
-	proxy   *urlproxy.Proxy
+	backend   storage.BlobStorageBackend
+	proxy     *urlproxy.Proxy
+	keyPrefix string
+	// existingBlobs decides whether blobs that are already stored are uploaded again.
+	existingBlobs storage.ExistingObjectPolicy
 }
 
-func newCASStore(backend storage.BlobStorageBackend, proxy *urlproxy.Proxy) *casStore {
-	return &casStore{backend: backend, proxy: proxy}
+func newCASStore(backend storage.BlobStorageBackend, proxy *urlproxy.Proxy, keyPrefix string) *casStore {
+	return &casStore{backend: backend, proxy: proxy, keyPrefix: keyPrefixOrDefault(keyPrefix)}
 }
 
 func (s *casStore) Exists(ctx context.Context, instanceName string, digest *remoteexecution.Digest) (bool, error) {
@@ -37,15 +39,15 @@ func (s *casStore) Exists(ctx context.Context, instanceName string, digest *remo
 		return true, nil
 	}
 
-	if _, err := s.backend.CacheInfo(ctx, casObjectKey(instanceName, digest), nil); err != nil {
+	if _, err := s.backend.CacheInfo(ctx, casObjectKey(s.keyPrefix, instanceName, digest), nil); err != nil {
 		if storage.IsNotFoundError(err) {
-			stats.Default().RecordCacheMiss()
+			protocolStats.RecordCacheMiss()
 			return false, nil
 		}
 		return false, err
 	}
 
-	stats.Default().RecordCacheHit()
+	protocolStats.RecordCacheHit()
 	return true, nil
 }
 
@@ -73,7 +75,12 @@ func (s *casStore) Upload(ctx context.Context, instanceName string, digest *remo
 		return nil
 	}
 
-	key := casObjectKey(instanceName, digest)
+	key := casObjectKey(s.keyPrefix, instanceName, digest)
+	skip, err := s.existingBlobs.SkipUpload(ctx, s.backend, key, digest.GetSizeBytes())
+	if err != nil || skip {
+		return err
+	}
+
 	info, err := s.backend.UploadURL(ctx, key, nil)
 	if err != nil {
 		return err
@@ -111,17 +118,17 @@ func (s *casStore) DownloadToWriter(ctx context.Context, instanceName string, di
 		return nil
 	}
 
-	key := casObjectKey(instanceName, digest)
+	key := casObjectKey(s.keyPrefix, instanceName, digest)
 	infos, err := s.backend.DownloadURLs(ctx, key)
 	if err != nil {
 		if storage.IsNotFoundError(err) {
-			stats.Default().RecordCacheMiss()
+			protocolStats.RecordCacheMiss()
 			return storage.ErrCacheNotFound
 		}
 		return err
 	}
 	if len(infos) == 0 {
-		stats.Default().RecordCacheMiss()
+		protocolStats.RecordCacheMiss()
 		return storage.ErrCacheNotFound
 	}
 
@@ -132,7 +139,7 @@ func (s *casStore) DownloadToWriter(ctx context.Context, instanceName string, di
 			if _, err := io.Copy(w, &retryBuffer); err != nil {
 				return err
 			}
-			stats.Default().RecordCacheHit()
+			protocolStats.RecordCacheHit()
 			return nil
 		} else {
 			lastErr = err
@@ -140,23 +147,43 @@ func (s *casStore) DownloadToWriter(ctx context.Context, instanceName string, di
 	}
 
 	if lastErr == nil {
-		stats.Default().RecordCacheMiss()
+		protocolStats.RecordCacheMiss()
 		return storage.ErrCacheNotFound
 	}
 	if errors.Is(lastErr, storage.ErrCacheNotFound) {
-		stats.Default().RecordCacheMiss()
+		protocolStats.RecordCacheMiss()
 		return storage.ErrCacheNotFound
 	}
 	if strings.Contains(strings.ToLower(lastErr.Error()), "404") {
-		stats.Default().RecordCacheMiss()
+		protocolStats.RecordCacheMiss()
 		return storage.ErrCacheNotFound
 	}
 
 	return lastErr
 }
 
-func casObjectKey(instanceName string, digest *remoteexecution.Digest) string {
-	return fmt.Sprintf("bazel/cas/v2/%s/sha256/%s/%d", encodeInstance(instanceName), digest.GetHash(), digest.GetSizeBytes())
+func casObjectKey(keyPrefix string, instanceName string, digest *remoteexecution.Digest) string {
+	return fmt.Sprintf("%s%s/sha256/%s/%d", casKeyPrefix(keyPrefix), encodeInstance(instanceName), digest.GetHash(), digest.GetSizeBytes())
+}
+
+func casKeyPrefix(keyPrefix string) string {
+	return keyPrefixOrDefault(keyPrefix) + "/cas/v2/"
+}
+
+// CASInstancePrefix returns the storage key prefix holding CAS blobs of instanceName
+// when the protocol is configured with keyPrefix (empty means DefaultKeyPrefix).
+func CASInstancePrefix(keyPrefix string, instanceName string) string {
+	return casKeyPrefix(keyPrefix) + encodeInstance(instanceName) + "/"
+}
+
+// keyPrefixOrDefault returns keyPrefix without leading and trailing slashes, or
+// DefaultKeyPrefix when nothing is left.
+func keyPrefixOrDefault(keyPrefix string) string {
+	keyPrefix = strings.Trim(keyPrefix, "/")
+	if keyPrefix == "" {
+		return DefaultKeyPrefix
+	}
+	return keyPrefix
 }
 
 func encodeInstance(instanceName string) string {
@@ -12,6 +12,7 @@ import (
 	"github.com/cirruslabs/omni-cache/pkg/storage"
 	urlproxy "github.com/cirruslabs/omni-cache/pkg/url-proxy"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
 )
 
 type staticDownloadBackend struct {
@@ -86,7 +87,7 @@ func TestCASStoreDownloadToWriterRetriesDoNotAppendPartialData(t *testing.T) {
 	proxy := urlproxy.NewProxy(urlproxy.WithHTTPClient(&http.Client{
 		Transport: transport,
 	}))
-	store := newCASStore(backend, proxy)
+	store := newCASStore(backend, proxy, "")
 
 	var result bytes.Buffer
 	err := store.DownloadToWriter(
@@ -166,3 +167,37 @@ func TestCASStoreDownloadToWriterRecordsHitMiss(t *testing.T) {
 }
 
 var _ storage.BlobStorageBackend = (*staticDownloadBackend)(nil)
+
+func TestCASStoreExistingBlobs(t *testing.T) {
+	backend := newMemoryHTTPBackend(t)
+	proxy := urlproxy.NewProxy(urlproxy.WithHTTPClient(backend.server.Client()))
+	store := newCASStore(backend, proxy, "")
+
+	data := []byte("content")
+	digest := digestForData(data)
+	key := casObjectKey(store.keyPrefix, "instance", digest)
+	require.NoError(t, store.UploadBytes(t.Context(), "instance", digest, data))
+
+	// Mark the stored object so that a re-upload is visible.
+	backend.objects[key] = []byte("CONTENT")
+
+	store.existingBlobs = storage.SkipExisting
+	require.NoError(t, store.UploadBytes(t.Context(), "instance", digest, data))
+	require.Equal(t, []byte("CONTENT"), backend.objects[key])
+
+	store.existingBlobs = storage.OverwriteExisting
+	require.NoError(t, store.UploadBytes(t.Context(), "instance", digest, data))
+	require.Equal(t, data, backend.objects[key])
+
+	backend.objects[key] = []byte("truncated")
+	store.existingBlobs = storage.SkipExistingVerifySize
+	err := store.UploadBytes(t.Context(), "instance", digest, data)
+	require.ErrorIs(t, err, storage.ErrExistingSizeMismatch)
+	require.Equal(t, codes.DataLoss, uploadErrorCode(err))
+}
+
+func TestKeyPrefixSlashesAreTrimmed(t *testing.T) {
+	require.Equal(t, "bazel/cas/v2/_/", CASInstancePrefix("/bazel/", ""))
+	require.Equal(t, "ci/bazel/cas/v2/_/", CASInstancePrefix("ci/bazel/", ""))
+	require.Equal(t, DefaultKeyPrefix+"/cas/v2/_/", CASInstancePrefix("/", ""))
+}
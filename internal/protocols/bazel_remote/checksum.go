@@ -0,0 +1,96 @@
+package bazel_remote
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strings"
+
+	remoteasset "github.com/cirruslabs/omni-cache/internal/api/build/bazel/remote/asset/v1"
+)
+
+// checksumSRIQualifier carries the expected checksum of a fetched blob as a Subresource
+// Integrity[1] string, e.g. "sha256-<base64 digest>". Bazel sends it for downloads with
+// a known checksum.
+//
+// [1]: https://www.w3.org/TR/SRI/
+const checksumSRIQualifier = "checksum.sri"
+
+// sriAlgorithms are the supported SRI hash algorithms, weakest first.
+var sriAlgorithms = []struct {
+	name string
+	new  func() hash.Hash
+	size int
+}{
+	{"sha256", sha256.New, sha256.Size},
+	{"sha384", sha512.New384, sha512.Size384},
+	{"sha512", sha512.New, sha512.Size},
+}
+
+// sriChecksum is the parsed value of a checksum.sri qualifier.
+type sriChecksum struct {
+	algorithm string
+	new       func() hash.Hash
+	// expected holds the acceptable digests; content matching any of them is valid.
+	expected [][]byte
+}
+
+// checksumFromQualifiers parses the checksum.sri qualifier, if any. When it lists hashes
+// for several algorithms, only the strongest supported one is checked, as browsers do;
+// hashes for unknown algorithms are ignored.
+func checksumFromQualifiers(qualifiers []*remoteasset.Qualifier) (*sriChecksum, error) {
+	var value string
+	for _, qualifier := range qualifiers {
+		if qualifier.GetName() == checksumSRIQualifier {
+			value = qualifier.GetValue()
+		}
+	}
+	if value == "" {
+		return nil, nil
+	}
+
+	strongest := -1
+	digests := map[int][][]byte{}
+	for _, token := range strings.Fields(value) {
+		name, encoded, ok := strings.Cut(token, "-")
+		if !ok {
+			return nil, fmt.Errorf("%s: malformed hash %q", checksumSRIQualifier, token)
+		}
+		// Options such as "?ct=..." follow the digest and aren't relevant here.
+		encoded, _, _ = strings.Cut(encoded, "?")
+
+		for index, algorithm := range sriAlgorithms {
+			if algorithm.name != strings.ToLower(name) {
+				continue
+			}
+			digest, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil || len(digest) != algorithm.size {
+				return nil, fmt.Errorf("%s: malformed %s digest %q", checksumSRIQualifier, algorithm.name, encoded)
+			}
+			digests[index] = append(digests[index], digest)
+			strongest = max(strongest, index)
+		}
+	}
+	if strongest < 0 {
+		return nil, fmt.Errorf("%s: no supported hash algorithm in %q", checksumSRIQualifier, value)
+	}
+
+	return &sriChecksum{
+		algorithm: sriAlgorithms[strongest].name,
+		new:       sriAlgorithms[strongest].new,
+		expected:  digests[strongest],
+	}, nil
+}
+
+// matches reports whether sum, computed with c.new, is one of the expected digests.
+func (c *sriChecksum) matches(sum []byte) bool {
+	for _, expected := range c.expected {
+		if bytes.Equal(sum, expected) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,32 +1,54 @@
 package bazel_remote
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
 	"strings"
 
 	remoteexecution "github.com/cirruslabs/omni-cache/internal/api/build/bazel/remote/execution/v2"
+	"github.com/cirruslabs/omni-cache/internal/digestfn"
 )
 
-const (
-	sha256HexLen    = 64
-	emptySHA256Hash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
-)
+// supportedDigestFunctions lists the REAPI digest functions the CAS accepts,
+// in the order advertised through GetCapabilities.
+var supportedDigestFunctions = []remoteexecution.DigestFunction_Value{
+	remoteexecution.DigestFunction_SHA256,
+}
+
+var emptySHA256Hash = digestfn.SHA256.EmptyHex()
+
+// digestFunction resolves a REAPI digest function to its implementation.
+// UNKNOWN selects SHA256, as mandated by REAPI for legacy clients.
+func digestFunction(value remoteexecution.DigestFunction_Value) (digestfn.Function, error) {
+	if value == remoteexecution.DigestFunction_UNKNOWN {
+		value = remoteexecution.DigestFunction_SHA256
+	}
+
+	for _, supported := range supportedDigestFunctions {
+		if supported != value {
+			continue
+		}
+		if fn, ok := digestfn.Lookup(value.String()); ok {
+			return fn, nil
+		}
+	}
+
+	return digestfn.Function{}, fmt.Errorf("unsupported digest function %s", value.String())
+}
 
 func normalizeDigestFunction(value remoteexecution.DigestFunction_Value, hash string) (remoteexecution.DigestFunction_Value, error) {
-	switch value {
-	case remoteexecution.DigestFunction_UNKNOWN, remoteexecution.DigestFunction_SHA256:
-		// Supported.
-	default:
-		return 0, fmt.Errorf("unsupported digest function %s", value.String())
+	fn, err := digestFunction(value)
+	if err != nil {
+		return 0, err
 	}
 
-	if hash != "" && len(hash) != sha256HexLen {
-		return 0, fmt.Errorf("unsupported hash length %d; only SHA256 is supported", len(hash))
+	if hash != "" && len(hash) != fn.HexLen() {
+		return 0, fmt.Errorf("unsupported hash length %d; expected %d for %s", len(hash), fn.HexLen(), fn.Name)
 	}
 
-	return remoteexecution.DigestFunction_SHA256, nil
+	if value == remoteexecution.DigestFunction_UNKNOWN {
+		return remoteexecution.DigestFunction_SHA256, nil
+	}
+	return value, nil
 }
 
 func normalizeDigest(digest *remoteexecution.Digest, value remoteexecution.DigestFunction_Value) (*remoteexecution.Digest, error) {
@@ -41,14 +63,12 @@ func normalizeDigest(digest *remoteexecution.Digest, value remoteexecution.Diges
 	if hash == "" {
 		return nil, fmt.Errorf("digest hash is empty")
 	}
-	if len(hash) != sha256HexLen {
-		return nil, fmt.Errorf("unsupported hash length %d; only SHA256 is supported", len(hash))
-	}
-	if _, err := hex.DecodeString(hash); err != nil {
-		return nil, fmt.Errorf("digest hash must be lower-case hex: %w", err)
-	}
 
-	if _, err := normalizeDigestFunction(value, hash); err != nil {
+	fn, err := digestFunction(value)
+	if err != nil {
+		return nil, err
+	}
+	if err := fn.ValidateHex(hash); err != nil {
 		return nil, err
 	}
 
@@ -59,9 +79,8 @@ func normalizeDigest(digest *remoteexecution.Digest, value remoteexecution.Diges
 }
 
 func digestForData(data []byte) *remoteexecution.Digest {
-	sum := sha256.Sum256(data)
 	return &remoteexecution.Digest{
-		Hash:      hex.EncodeToString(sum[:]),
+		Hash:      digestfn.SHA256.SumHex(data),
 		SizeBytes: int64(len(data)),
 	}
 }
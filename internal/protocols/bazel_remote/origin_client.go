@@ -0,0 +1,89 @@
+package bazel_remote
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+)
+
+// OriginTimeouts bounds the phases of a Remote Asset fetch from an origin, so that an
+// origin that hangs while connecting or before responding fails fast instead of using
+// up the whole fetch timeout. A zero value leaves the phase bounded by the fetch
+// timeout alone.
+type OriginTimeouts struct {
+	// Dial bounds establishing the TCP connection.
+	Dial time.Duration
+	// TLSHandshake bounds the TLS handshake of https origins.
+	TLSHandshake time.Duration
+	// ResponseHeader bounds waiting for the response headers once the request is sent.
+	ResponseHeader time.Duration
+}
+
+// DefaultOriginTimeouts are the suggested Options.OriginTimeouts.
+var DefaultOriginTimeouts = OriginTimeouts{
+	Dial:           10 * time.Second,
+	TLSHandshake:   10 * time.Second,
+	ResponseHeader: 30 * time.Second,
+}
+
+// DefaultOriginRetryPolicy is the suggested Options.OriginRetries.
+var DefaultOriginRetryPolicy = storage.RetryPolicy{
+	Retries:   2,
+	BaseDelay: 500 * time.Millisecond,
+}
+
+// originHTTPClient returns a client for origin fetches that applies timeouts and, when
+// filter isn't nil, an origin policy on top of a copy of base's transport. base is
+// returned as is when neither is set. When base's transport isn't an *http.Transport,
+// timeouts are skipped with a warning, but a policy can't be skipped and is an error.
+func originHTTPClient(base *http.Client, timeouts OriginTimeouts, filter *originFilter) (*http.Client, error) {
+	if timeouts == (OriginTimeouts{}) && filter == nil {
+		return base, nil
+	}
+
+	// Origin fetches are downloads from outside the cache, so wrappers that only act on
+	// uploads to storage, such as the server's upload limit, are looked through.
+	baseTransport := base.Transport
+	for {
+		wrapper, ok := baseTransport.(interface{ Unwrap() http.RoundTripper })
+		if !ok {
+			break
+		}
+		baseTransport = wrapper.Unwrap()
+	}
+
+	var transport *http.Transport
+	switch baseTransport := baseTransport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = baseTransport.Clone()
+	default:
+		if filter != nil {
+			return nil, fmt.Errorf("bazel origin policy is not supported by the HTTP client's transport %T", baseTransport)
+		}
+		slog.Warn("bazel origin timeouts are not supported by the HTTP client's transport", "transport", baseTransport)
+		return base, nil
+	}
+
+	dialer := &net.Dialer{Timeout: timeouts.Dial, KeepAlive: 30 * time.Second}
+	if filter != nil {
+		transport.DialContext = filter.dialContext(dialer)
+	} else if timeouts.Dial > 0 {
+		transport.DialContext = dialer.DialContext
+	}
+	if timeouts.TLSHandshake > 0 {
+		transport.TLSHandshakeTimeout = timeouts.TLSHandshake
+	}
+	if timeouts.ResponseHeader > 0 {
+		transport.ResponseHeaderTimeout = timeouts.ResponseHeader
+	}
+
+	client := *base
+	client.Transport = transport
+	return &client, nil
+}
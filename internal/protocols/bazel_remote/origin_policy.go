@@ -0,0 +1,179 @@
+package bazel_remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// OriginPolicy restricts the origins that the Remote Asset API fetches from, since build
+// requests can otherwise make the cache fetch arbitrary URIs on its network.
+//
+// Entries are hostnames, which also match their subdomains, IP addresses or CIDR ranges.
+// A fetch is refused when the origin matches a Deny entry, or when Allow isn't empty and
+// the origin matches none of its entries. Loopback, link-local and cloud metadata
+// addresses are refused unless an Allow entry matches them explicitly.
+//
+// Addresses are checked after DNS resolution, when dialing, so that a hostname can't
+// sneak in an internal address, including through redirects.
+type OriginPolicy struct {
+	Allow []string
+	Deny  []string
+}
+
+var errOriginForbidden = errors.New("origin is not allowed")
+
+// metadataPrefixes are cloud metadata addresses outside the link-local ranges that are
+// blocked by default anyway.
+var metadataPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("fd00:ec2::254/128"),
+}
+
+type originRules struct {
+	hosts    []string
+	prefixes []netip.Prefix
+}
+
+func parseOriginRules(entries []string) (originRules, error) {
+	var rules originRules
+	for _, entry := range entries {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+			continue
+		case strings.Contains(entry, "/"):
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return originRules{}, fmt.Errorf("invalid CIDR range %q: %w", entry, err)
+			}
+			rules.prefixes = append(rules.prefixes, prefix.Masked())
+		default:
+			if addr, err := netip.ParseAddr(strings.Trim(entry, "[]")); err == nil {
+				rules.prefixes = append(rules.prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+				continue
+			}
+			rules.hosts = append(rules.hosts, strings.TrimPrefix(strings.TrimSuffix(entry, "."), "."))
+		}
+	}
+	return rules, nil
+}
+
+func (r originRules) empty() bool {
+	return len(r.hosts) == 0 && len(r.prefixes) == 0
+}
+
+func (r originRules) matchesHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, candidate := range r.hosts {
+		if host == candidate || strings.HasSuffix(host, "."+candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r originRules) matchesAddr(addr netip.Addr) bool {
+	for _, prefix := range r.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// originFilter enforces an OriginPolicy.
+type originFilter struct {
+	allow originRules
+	deny  originRules
+}
+
+func newOriginFilter(policy OriginPolicy) (*originFilter, error) {
+	allow, err := parseOriginRules(policy.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("origin allowlist: %w", err)
+	}
+	deny, err := parseOriginRules(policy.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("origin denylist: %w", err)
+	}
+	return &originFilter{allow: allow, deny: deny}, nil
+}
+
+// checkHost checks the host of a URI before it's fetched. Hostnames can only be checked
+// against hostname entries here; their addresses are checked by checkAddr when dialing.
+func (f *originFilter) checkHost(host string) error {
+	if addr, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+		return f.checkAddr(host, addr)
+	}
+	if f.deny.matchesHost(host) {
+		return fmt.Errorf("%w: %s", errOriginForbidden, host)
+	}
+	return nil
+}
+
+// checkAddr checks an address that host resolved to.
+func (f *originFilter) checkAddr(host string, addr netip.Addr) error {
+	addr = addr.Unmap()
+	if f.deny.matchesHost(host) || f.deny.matchesAddr(addr) {
+		return fmt.Errorf("%w: %s", errOriginForbidden, host)
+	}
+
+	allowed := f.allow.matchesHost(host) || f.allow.matchesAddr(addr)
+	if !allowed && !f.allow.empty() {
+		return fmt.Errorf("%w: %s is not in the allowlist", errOriginForbidden, host)
+	}
+	if !allowed && isInternalAddr(addr) {
+		return fmt.Errorf("%w: %s resolves to internal address %s", errOriginForbidden, host, addr)
+	}
+	return nil
+}
+
+func isInternalAddr(addr netip.Addr) bool {
+	if addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() || addr.IsUnspecified() {
+		return true
+	}
+	for _, prefix := range metadataPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialContext resolves the host being dialed and only connects to the addresses that
+// pass checkAddr.
+func (f *originFilter) dialContext(dialer *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+
+		addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+
+		var lastErr error
+		for _, addr := range addrs {
+			if err := f.checkAddr(host, addr); err != nil {
+				lastErr = err
+				continue
+			}
+
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(addr.Unmap().String(), port))
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			return conn, nil
+		}
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no addresses found for %s", host)
+		}
+		return nil, lastErr
+	}
+}
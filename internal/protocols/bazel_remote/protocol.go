@@ -3,9 +3,11 @@ package bazel_remote
 import (
 	"fmt"
 	"net/http"
+	"time"
 
 	remoteasset "github.com/cirruslabs/omni-cache/internal/api/build/bazel/remote/asset/v1"
 	remoteexecution "github.com/cirruslabs/omni-cache/internal/api/build/bazel/remote/execution/v2"
+	"github.com/cirruslabs/omni-cache/pkg/kvstore"
 	"github.com/cirruslabs/omni-cache/pkg/protocols"
 	"github.com/cirruslabs/omni-cache/pkg/storage"
 	urlproxy "github.com/cirruslabs/omni-cache/pkg/url-proxy"
@@ -13,19 +15,117 @@ import (
 	"google.golang.org/grpc"
 )
 
+// Options configures the bazel-remote protocol.
+type Options struct {
+	// KeyPrefix is the top-level storage prefix for CAS blobs and asset
+	// mappings. Defaults to DefaultKeyPrefix.
+	KeyPrefix string
+
+	// UsageReportInterval enables the per-instance usage report served at
+	// UsageReportPath. The report is regenerated at most once per interval.
+	// Zero disables the report.
+	UsageReportInterval time.Duration
+
+	// ExistingBlobs decides whether CAS blobs that are already stored are uploaded
+	// again. Defaults to storage.OverwriteExisting.
+	ExistingBlobs storage.ExistingObjectPolicy
+
+	// SpoolThresholdBytes is the largest ByteStream upload, by declared size, that is
+	// buffered in memory while its digest is verified. Larger uploads are spooled to a
+	// temp file. Zero spools every upload.
+	SpoolThresholdBytes int64
+
+	// SkipDigestVerification trusts the digest of ByteStream uploads instead of hashing
+	// them to verify it, which saves CPU on large blobs from trusted clients. A client
+	// sending data that doesn't match its digest then poisons the CAS entry. Sizes are
+	// always verified.
+	SkipDigestVerification bool
+
+	// OriginTimeouts bounds connecting to origins and waiting for their response headers
+	// when fetching with the Remote Asset API. The zero value only applies the fetch
+	// timeout.
+	OriginTimeouts OriginTimeouts
+
+	// OriginRetries controls retrying Remote Asset origin fetches that fail with a 429 or
+	// 5xx response or a transient network error. Retries happen within the fetch timeout.
+	// The zero value doesn't retry.
+	OriginRetries storage.RetryPolicy
+
+	// OriginPolicy restricts the origins fetched from with the Remote Asset API. Even
+	// the zero value refuses loopback, link-local and cloud metadata addresses.
+	OriginPolicy OriginPolicy
+
+	// MappingStore, when set, caches Remote Asset blob mappings, such as in Redis, so
+	// that lookups don't each cost a request to the storage backend. Sidecars sharing it
+	// must use their own key prefix unless they share their storage too (see
+	// kvstore.WithPrefix), and its entries should expire, e.g. after
+	// DefaultMappingStoreTTL. Mappings served from it still need their blob in storage.
+	MappingStore kvstore.Store
+}
+
+// DefaultMappingStoreTTL is the suggested expiry of Options.MappingStore entries. A
+// mapping that stays in storage is cached again on its next lookup.
+const DefaultMappingStoreTTL = 24 * time.Hour
+
+// DefaultSpoolThresholdBytes is the suggested Options.SpoolThresholdBytes: it keeps the
+// many small blobs of a typical Bazel build off disk while bounding the memory held by
+// concurrent uploads.
+const DefaultSpoolThresholdBytes int64 = 1024 * 1024
+
+// DefaultKeyPrefix is the top-level storage prefix used when Options.KeyPrefix is empty.
+const DefaultKeyPrefix = "bazel"
+
+// UsageReportPath is the HTTP endpoint serving the per-instance CAS usage report.
+const UsageReportPath = "/metrics/bazel/instances"
+
 // Factory wires Bazel REAPI cache and Remote Asset services.
-type Factory struct{}
+type Factory struct {
+	Options Options
+}
 
 func (Factory) ID() string {
 	return "bazel-remote"
 }
 
-func (Factory) New(deps protocols.Dependencies) (protocols.Protocol, error) {
+func (f Factory) Describe() protocols.Description {
+	description := protocols.Description{
+		Summary: "Bazel remote cache (REAPI CAS and ByteStream) and Remote Asset API",
+		GRPCServices: []string{
+			remoteexecution.ContentAddressableStorage_ServiceDesc.ServiceName,
+			remoteexecution.Capabilities_ServiceDesc.ServiceName,
+			"google.bytestream.ByteStream",
+			remoteasset.Fetch_ServiceDesc.ServiceName,
+			remoteasset.Push_ServiceDesc.ServiceName,
+		},
+		Limits: map[string]int64{"maxBatchTotalSizeBytes": maxBatchTotalSizeBytes},
+	}
+	if f.Options.UsageReportInterval > 0 {
+		description.HTTPRoutes = []string{"GET " + UsageReportPath}
+		description.Features = append(description.Features, "usage-report")
+	}
+	if f.Options.SkipDigestVerification {
+		description.Features = append(description.Features, "skip-digest-verification")
+	}
+	if policy := f.Options.ExistingBlobs; policy != "" && policy != storage.OverwriteExisting {
+		description.Features = append(description.Features, "existing-blobs-"+string(policy))
+	}
+	return description
+}
+
+var protocolStats = protocols.Stats(Factory{}.ID())
+
+func (f Factory) New(deps protocols.Dependencies) (protocols.Protocol, error) {
 	deps = deps.WithDefaults()
+	origins, err := newOriginFilter(f.Options.OriginPolicy)
+	if err != nil {
+		return nil, err
+	}
 	return &protocol{
 		backend: deps.Storage,
 		proxy:   deps.URLProxy,
 		http:    deps.HTTP,
+		origins: origins,
+		options: f.Options,
 	}, nil
 }
 
@@ -33,6 +133,8 @@ type protocol struct {
 	backend storage.BlobStorageBackend
 	proxy   *urlproxy.Proxy
 	http    *http.Client
+	origins *originFilter
+	options Options
 }
 
 func (p *protocol) Register(registrar *protocols.Registrar) error {
@@ -46,16 +148,39 @@ func (p *protocol) Register(registrar *protocols.Registrar) error {
 		return fmt.Errorf("grpc registrar is not *grpc.Server")
 	}
 
-	cas := newCASStore(p.backend, p.proxy)
-	assets := newAssetStore(p.backend, p.proxy)
+	cas := newCASStore(p.backend, p.proxy, p.options.KeyPrefix)
+	cas.existingBlobs = p.options.ExistingBlobs
+	assets := newAssetStore(p.backend, p.proxy, p.options.KeyPrefix)
+	assets.mappings = p.options.MappingStore
 
 	remoteexecution.RegisterContentAddressableStorageServer(grpcRegistrar, newCASServer(cas))
 	remoteexecution.RegisterCapabilitiesServer(grpcRegistrar, newCapabilitiesServer())
-	bytestream.RegisterByteStreamServer(grpcServer, newByteStreamServer(cas))
+	byteStream := newByteStreamServer(cas)
+	byteStream.spoolThreshold = p.options.SpoolThresholdBytes
+	byteStream.skipDigestVerification = p.options.SkipDigestVerification
+	bytestream.RegisterByteStreamServer(grpcServer, byteStream)
 
-	assetServer := newRemoteAssetServer(cas, assets, p.http)
+	originClient, err := originHTTPClient(p.http, p.options.OriginTimeouts, p.origins)
+	if err != nil {
+		return err
+	}
+	assetServer := newRemoteAssetServer(cas, assets, originClient)
+	assetServer.origins = p.origins
+	assetServer.retries = p.options.OriginRetries
 	remoteasset.RegisterFetchServer(grpcRegistrar, assetServer)
 	remoteasset.RegisterPushServer(grpcRegistrar, assetServer)
 
+	if p.options.UsageReportInterval > 0 {
+		listable, ok := p.backend.(storage.ListableBlobStorageBackend)
+		if !ok {
+			return fmt.Errorf("usage report requires a storage backend with listing support")
+		}
+		mux := registrar.HTTP()
+		if mux == nil {
+			return fmt.Errorf("http mux is nil")
+		}
+		mux.Handle("GET "+UsageReportPath, newUsageReporter(listable, p.options.KeyPrefix, p.options.UsageReportInterval))
+	}
+
 	return nil
 }
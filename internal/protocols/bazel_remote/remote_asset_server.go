@@ -2,19 +2,24 @@ package bazel_remote
 
 import (
 	"context"
-	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"strings"
+	"syscall"
 	"time"
 
 	remoteasset "github.com/cirruslabs/omni-cache/internal/api/build/bazel/remote/asset/v1"
 	remoteexecution "github.com/cirruslabs/omni-cache/internal/api/build/bazel/remote/execution/v2"
+	"github.com/cirruslabs/omni-cache/internal/digestfn"
+	"github.com/cirruslabs/omni-cache/pkg/storage"
 	statuspb "google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -29,6 +34,11 @@ type remoteAssetServer struct {
 	cas    *casStore
 	assets *assetStore
 	http   *http.Client
+	// origins, when set, is checked before fetching from an origin. The http client is
+	// expected to enforce it when dialing too.
+	origins *originFilter
+	// retries controls retrying origin fetches after transient failures.
+	retries storage.RetryPolicy
 }
 
 func newRemoteAssetServer(cas *casStore, assets *assetStore, httpClient *http.Client) *remoteAssetServer {
@@ -49,6 +59,10 @@ func (s *remoteAssetServer) FetchBlob(ctx context.Context, req *remoteasset.Fetc
 	if err := validateQualifierNames(req.GetQualifiers()); err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "invalid qualifiers: %v", err)
 	}
+	checksum, err := checksumFromQualifiers(req.GetQualifiers())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid qualifiers: %v", err)
+	}
 	if _, err := normalizeDigestFunction(req.GetDigestFunction(), ""); err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "invalid digest function: %v", err)
 	}
@@ -101,7 +115,7 @@ func (s *remoteAssetServer) FetchBlob(ctx context.Context, req *remoteasset.Fetc
 		sawHTTPURI = true
 		attempted = true
 
-		digest, fetchStatus, err := s.fetchAndStoreFromOrigin(ctx, req, candidate)
+		digest, fetchStatus, err := s.fetchAndStoreFromOrigin(ctx, req, candidate, checksum)
 		if err != nil {
 			return nil, status.Errorf(codes.Internal, "origin fetch failed: %v", err)
 		}
@@ -159,7 +173,7 @@ func (s *remoteAssetServer) PushBlob(ctx context.Context, req *remoteasset.PushB
 			return nil, status.Error(codes.InvalidArgument, "URI must not be empty")
 		}
 		if err := s.assets.PutBlobMapping(ctx, req.GetInstanceName(), uri, req.GetQualifiers(), digest); err != nil {
-			return nil, status.Errorf(codes.Internal, "store mapping for %q: %v", uri, err)
+			return nil, status.Errorf(uploadErrorCode(err), "store mapping for %q: %v", uri, err)
 		}
 	}
 
@@ -170,40 +184,23 @@ func (s *remoteAssetServer) PushDirectory(context.Context, *remoteasset.PushDire
 	return nil, status.Error(codes.Unimplemented, "PushDirectory is not implemented")
 }
 
+// fetchAndStoreFromOrigin fetches uri into the CAS. Transient failures are retried
+// according to s.retries, within the fetch timeout of req, or maxOriginFetchTimeout when
+// req has none. When checksum is set, content that doesn't match it is rejected with
+// DataLoss and never stored.
 func (s *remoteAssetServer) fetchAndStoreFromOrigin(
 	ctx context.Context,
 	req *remoteasset.FetchBlobRequest,
 	uri string,
+	checksum *sriChecksum,
 ) (*remoteexecution.Digest, *statuspb.Status, error) {
-	requestContext := ctx
-	cancel := func() {}
+	timeout := maxOriginFetchTimeout
 	if req.GetTimeout() != nil {
-		requested := req.GetTimeout().AsDuration()
-		if requested > maxOriginFetchTimeout {
-			requested = maxOriginFetchTimeout
-		}
-		requestContext, cancel = context.WithTimeout(ctx, requested)
+		timeout = min(req.GetTimeout().AsDuration(), maxOriginFetchTimeout)
 	}
+	requestContext, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	httpRequest, err := http.NewRequestWithContext(requestContext, http.MethodGet, uri, nil)
-	if err != nil {
-		return nil, nil, fmt.Errorf("invalid URI %q: %w", uri, err)
-	}
-
-	response, err := s.http.Do(httpRequest)
-	if err != nil {
-		if errors.Is(requestContext.Err(), context.DeadlineExceeded) {
-			return nil, rpcStatus(codes.DeadlineExceeded, requestContext.Err().Error()), nil
-		}
-		return nil, rpcStatus(codes.Unavailable, err.Error()), nil
-	}
-	defer response.Body.Close()
-
-	if response.StatusCode < http.StatusOK || response.StatusCode >= http.StatusMultipleChoices {
-		return nil, statusFromOriginHTTP(response.StatusCode), nil
-	}
-
 	tmpFile, err := os.CreateTemp("", "omni-cache-bazel-origin-*")
 	if err != nil {
 		return nil, nil, err
@@ -213,30 +210,126 @@ func (s *remoteAssetServer) fetchAndStoreFromOrigin(
 		_ = os.Remove(tmpFile.Name())
 	}()
 
-	hasher := sha256.New()
-	size, err := io.Copy(io.MultiWriter(tmpFile, hasher), response.Body)
-	if err != nil {
-		if errors.Is(requestContext.Err(), context.DeadlineExceeded) {
-			return nil, rpcStatus(codes.DeadlineExceeded, requestContext.Err().Error()), nil
+	var digest *remoteexecution.Digest
+	for attempt := 0; ; attempt++ {
+		var fetchStatus *statuspb.Status
+		var retryable bool
+		digest, fetchStatus, retryable, err = s.fetchFromOrigin(requestContext, uri, tmpFile, checksum)
+		if err != nil {
+			return nil, nil, err
+		}
+		if fetchStatus.GetCode() == int32(codes.OK) {
+			break
+		}
+		if !retryable || attempt >= s.retries.Retries {
+			return nil, fetchStatus, nil
 		}
-		return nil, rpcStatus(codes.Unavailable, err.Error()), nil
-	}
 
-	digest := &remoteexecution.Digest{
-		Hash:      hex.EncodeToString(hasher.Sum(nil)),
-		SizeBytes: size,
+		// Don't wait for a retry that the fetch timeout wouldn't leave time for.
+		delay := s.retries.Delay(attempt)
+		if deadline, ok := requestContext.Deadline(); ok && time.Until(deadline) <= delay {
+			return nil, fetchStatus, nil
+		}
+		slog.WarnContext(ctx, "retrying bazel origin fetch after transient failure",
+			"uri", uri, "attempt", attempt+1, "status", fetchStatus.GetMessage())
+		if err := storage.SleepContext(requestContext, delay); err != nil {
+			return nil, rpcStatus(codes.DeadlineExceeded, err.Error()), nil
+		}
 	}
 
 	if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
 		return nil, nil, err
 	}
 	if err := s.cas.Upload(requestContext, req.GetInstanceName(), digest, tmpFile); err != nil {
+		if code := uploadErrorCode(err); code == codes.ResourceExhausted || code == codes.PermissionDenied {
+			return nil, rpcStatus(code, err.Error()), nil
+		}
 		return nil, nil, err
 	}
 
 	return digest, rpcStatus(codes.OK, ""), nil
 }
 
+// fetchFromOrigin makes a single attempt at downloading uri into tmpFile, replacing
+// whatever an earlier attempt left there. A non-OK status reports why the attempt failed
+// and whether it's worth retrying.
+func (s *remoteAssetServer) fetchFromOrigin(
+	ctx context.Context,
+	uri string,
+	tmpFile *os.File,
+	checksum *sriChecksum,
+) (digest *remoteexecution.Digest, fetchStatus *statuspb.Status, retryable bool, err error) {
+	if err := tmpFile.Truncate(0); err != nil {
+		return nil, nil, false, err
+	}
+	if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, false, err
+	}
+
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("invalid URI %q: %w", uri, err)
+	}
+	if s.origins != nil {
+		if err := s.origins.checkHost(httpRequest.URL.Hostname()); err != nil {
+			return nil, rpcStatus(codes.PermissionDenied, err.Error()), false, nil
+		}
+	}
+
+	response, err := s.http.Do(httpRequest)
+	if err != nil {
+		if errors.Is(err, errOriginForbidden) {
+			return nil, rpcStatus(codes.PermissionDenied, err.Error()), false, nil
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, rpcStatus(codes.DeadlineExceeded, ctx.Err().Error()), false, nil
+		}
+		return nil, rpcStatus(codes.Unavailable, err.Error()), transientOriginError(err), nil
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < http.StatusOK || response.StatusCode >= http.StatusMultipleChoices {
+		retryable := response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= http.StatusInternalServerError
+		return nil, statusFromOriginHTTP(response.StatusCode), retryable, nil
+	}
+
+	hasher := digestfn.SHA256.New()
+	writers := []io.Writer{tmpFile, hasher}
+	var checksumHasher hash.Hash
+	if checksum != nil {
+		checksumHasher = checksum.new()
+		writers = append(writers, checksumHasher)
+	}
+	size, err := io.Copy(io.MultiWriter(writers...), response.Body)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, rpcStatus(codes.DeadlineExceeded, ctx.Err().Error()), false, nil
+		}
+		return nil, rpcStatus(codes.Unavailable, err.Error()), transientOriginError(err), nil
+	}
+	if checksum != nil && !checksum.matches(checksumHasher.Sum(nil)) {
+		return nil, rpcStatus(codes.DataLoss, fmt.Sprintf("content of %s doesn't match the %s %s checksum",
+			uri, checksumSRIQualifier, checksum.algorithm)), false, nil
+	}
+
+	digest = &remoteexecution.Digest{
+		Hash:      hex.EncodeToString(hasher.Sum(nil)),
+		SizeBytes: size,
+	}
+	return digest, rpcStatus(codes.OK, ""), false, nil
+}
+
+// transientOriginError reports whether a failure to reach an origin or to read its
+// response may go away by retrying.
+func transientOriginError(err error) bool {
+	var netErr net.Error
+	return (errors.As(err, &netErr) && netErr.Timeout()) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF)
+}
+
 func validateQualifierNames(qualifiers []*remoteasset.Qualifier) error {
 	seen := make(map[string]struct{}, len(qualifiers))
 	for _, qualifier := range qualifiers {
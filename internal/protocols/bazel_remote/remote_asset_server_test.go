@@ -1,15 +1,25 @@
 package bazel_remote
 
 import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	remoteasset "github.com/cirruslabs/omni-cache/internal/api/build/bazel/remote/asset/v1"
 	remoteexecution "github.com/cirruslabs/omni-cache/internal/api/build/bazel/remote/execution/v2"
+	"github.com/cirruslabs/omni-cache/pkg/storage"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
 func TestRemoteAssetFetchBlobCachesOriginResult(t *testing.T) {
@@ -90,3 +100,285 @@ func TestRemoteAssetPushBlobAndFetchWithExactQualifiers(t *testing.T) {
 	require.EqualValues(t, 1, originHits.Load())
 	require.NotEqual(t, pushedDigest.GetHash(), second.GetBlobDigest().GetHash())
 }
+
+func TestRemoteAssetFetchBlobOriginResponseHeaderTimeout(t *testing.T) {
+	cas, assets := newTestStores(t)
+
+	released := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-released
+	}))
+	t.Cleanup(origin.Close)
+	t.Cleanup(func() {
+		close(released)
+	})
+
+	client, err := originHTTPClient(origin.Client(), OriginTimeouts{ResponseHeader: 100 * time.Millisecond}, nil)
+	require.NoError(t, err)
+	server := newRemoteAssetServer(cas, assets, client)
+
+	started := time.Now()
+	response, err := server.FetchBlob(t.Context(), &remoteasset.FetchBlobRequest{
+		InstanceName:   "instance",
+		Uris:           []string{origin.URL},
+		Timeout:        durationpb.New(time.Minute),
+		DigestFunction: remoteexecution.DigestFunction_SHA256,
+	})
+	require.NoError(t, err)
+	require.Equal(t, int32(codes.Unavailable), response.GetStatus().GetCode())
+	require.Less(t, time.Since(started), 10*time.Second)
+}
+
+func TestOriginHTTPClient(t *testing.T) {
+	base := &http.Client{Timeout: time.Minute}
+	client, err := originHTTPClient(base, OriginTimeouts{}, nil)
+	require.NoError(t, err)
+	require.Same(t, base, client)
+
+	client, err = originHTTPClient(base, DefaultOriginTimeouts, nil)
+	require.NoError(t, err)
+	require.NotSame(t, base, client)
+	require.Nil(t, base.Transport)
+	require.Equal(t, time.Minute, client.Timeout)
+
+	transport, ok := client.Transport.(*http.Transport)
+	require.True(t, ok)
+	require.Equal(t, DefaultOriginTimeouts.TLSHandshake, transport.TLSHandshakeTimeout)
+	require.Equal(t, DefaultOriginTimeouts.ResponseHeader, transport.ResponseHeaderTimeout)
+	require.NotNil(t, transport.DialContext)
+}
+
+func TestRemoteAssetFetchBlobOriginPolicy(t *testing.T) {
+	var byIP, byName string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, byName, http.StatusFound)
+			return
+		}
+		_, _ = w.Write([]byte("origin payload"))
+	}))
+	t.Cleanup(origin.Close)
+
+	port := origin.Listener.Addr().(*net.TCPAddr).Port
+	byIP = fmt.Sprintf("http://127.0.0.1:%d/", port)
+	byName = fmt.Sprintf("http://localhost:%d/", port)
+
+	testCases := []struct {
+		name   string
+		policy OriginPolicy
+		uri    string
+		code   codes.Code
+	}{
+		{"loopback blocked by default", OriginPolicy{}, byIP, codes.PermissionDenied},
+		{"hostname resolving to loopback blocked by default", OriginPolicy{}, byName, codes.PermissionDenied},
+		{"loopback allowed by CIDR", OriginPolicy{Allow: []string{"127.0.0.0/8"}}, byName, codes.OK},
+		{"loopback allowed by hostname", OriginPolicy{Allow: []string{"localhost"}}, byName, codes.OK},
+		{"host outside allowlist", OriginPolicy{Allow: []string{"example.com"}}, byName, codes.PermissionDenied},
+		{"denylist wins over allowlist", OriginPolicy{Allow: []string{"localhost"}, Deny: []string{"127.0.0.1"}}, byName, codes.PermissionDenied},
+		{"redirect to denied host", OriginPolicy{Allow: []string{"127.0.0.1"}, Deny: []string{"localhost"}}, byIP + "redirect", codes.PermissionDenied},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cas, assets := newTestStores(t)
+
+			filter, err := newOriginFilter(tc.policy)
+			require.NoError(t, err)
+			client, err := originHTTPClient(origin.Client(), OriginTimeouts{}, filter)
+			require.NoError(t, err)
+			server := newRemoteAssetServer(cas, assets, client)
+			server.origins = filter
+
+			response, err := server.FetchBlob(t.Context(), &remoteasset.FetchBlobRequest{
+				InstanceName:   "instance",
+				Uris:           []string{tc.uri},
+				DigestFunction: remoteexecution.DigestFunction_SHA256,
+			})
+			require.NoError(t, err)
+			require.Equal(t, int32(tc.code), response.GetStatus().GetCode(), response.GetStatus().GetMessage())
+		})
+	}
+}
+
+func TestOriginFilter(t *testing.T) {
+	_, err := newOriginFilter(OriginPolicy{Allow: []string{"10.0.0.0/33"}})
+	require.Error(t, err)
+
+	filter, err := newOriginFilter(OriginPolicy{Allow: []string{"example.com", "10.0.0.0/8"}})
+	require.NoError(t, err)
+	require.NoError(t, filter.checkAddr("cdn.example.com", netip.MustParseAddr("93.184.216.34")))
+	require.NoError(t, filter.checkAddr("internal.corp", netip.MustParseAddr("10.1.2.3")))
+	require.ErrorIs(t, filter.checkAddr("notexample.com", netip.MustParseAddr("93.184.216.34")), errOriginForbidden)
+
+	filter, err = newOriginFilter(OriginPolicy{})
+	require.NoError(t, err)
+	require.NoError(t, filter.checkAddr("example.com", netip.MustParseAddr("93.184.216.34")))
+	for _, addr := range []string{"127.0.0.1", "::1", "169.254.169.254", "fe80::1", "fd00:ec2::254", "0.0.0.0", "::ffff:127.0.0.1"} {
+		require.ErrorIs(t, filter.checkAddr("example.com", netip.MustParseAddr(addr)), errOriginForbidden, addr)
+	}
+	require.ErrorIs(t, filter.checkHost("169.254.169.254"), errOriginForbidden)
+}
+
+func TestRemoteAssetFetchBlobRetriesOrigin(t *testing.T) {
+	testCases := []struct {
+		name     string
+		failures int64
+		code     codes.Code
+		requests int64
+	}{
+		{"succeeds after transient failures", 2, codes.OK, 3},
+		{"exhausts retries", 10, codes.Unavailable, 3},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cas, assets := newTestStores(t)
+
+			var requests atomic.Int64
+			origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				request := requests.Add(1)
+				switch {
+				case request > tc.failures:
+				case request%2 == 0:
+					// A truncated body, which a retry must not leave behind in the blob.
+					w.Header().Set("Content-Length", "100")
+					_, _ = w.Write([]byte("partial"))
+					return
+				default:
+					w.WriteHeader(http.StatusBadGateway)
+					return
+				}
+				_, _ = w.Write([]byte("origin payload"))
+			}))
+			t.Cleanup(origin.Close)
+
+			server := newRemoteAssetServer(cas, assets, origin.Client())
+			server.retries = storage.RetryPolicy{Retries: 2, BaseDelay: time.Millisecond}
+
+			response, err := server.FetchBlob(t.Context(), &remoteasset.FetchBlobRequest{
+				InstanceName:   "instance",
+				Uris:           []string{origin.URL},
+				DigestFunction: remoteexecution.DigestFunction_SHA256,
+			})
+			require.NoError(t, err)
+			require.Equal(t, int32(tc.code), response.GetStatus().GetCode(), response.GetStatus().GetMessage())
+			require.Equal(t, tc.requests, requests.Load())
+			if tc.code == codes.OK {
+				require.Equal(t, digestForData([]byte("origin payload")).GetHash(), response.GetBlobDigest().GetHash())
+			}
+		})
+	}
+}
+
+func TestRemoteAssetFetchBlobDoesNotRetryClientErrors(t *testing.T) {
+	cas, assets := newTestStores(t)
+
+	var requests atomic.Int64
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(origin.Close)
+
+	server := newRemoteAssetServer(cas, assets, origin.Client())
+	server.retries = storage.RetryPolicy{Retries: 2, BaseDelay: time.Millisecond}
+
+	response, err := server.FetchBlob(t.Context(), &remoteasset.FetchBlobRequest{
+		InstanceName:   "instance",
+		Uris:           []string{origin.URL},
+		DigestFunction: remoteexecution.DigestFunction_SHA256,
+	})
+	require.NoError(t, err)
+	require.Equal(t, int32(codes.NotFound), response.GetStatus().GetCode())
+	require.EqualValues(t, 1, requests.Load())
+}
+
+func TestRemoteAssetFetchBlobVerifiesChecksumSRI(t *testing.T) {
+	cas, assets := newTestStores(t)
+
+	originData := []byte("origin payload")
+	poisonedData := []byte("poisoned payload")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/poisoned" {
+			_, _ = w.Write(poisonedData)
+			return
+		}
+		_, _ = w.Write(originData)
+	}))
+	t.Cleanup(origin.Close)
+
+	server := newRemoteAssetServer(cas, assets, origin.Client())
+
+	sum := sha256.Sum256(originData)
+	matchingSRI := "sha256-" + base64.StdEncoding.EncodeToString(sum[:])
+	fetch := func(sri string, uris ...string) *remoteasset.FetchBlobResponse {
+		response, err := server.FetchBlob(t.Context(), &remoteasset.FetchBlobRequest{
+			InstanceName:   "instance",
+			Uris:           uris,
+			Qualifiers:     []*remoteasset.Qualifier{{Name: checksumSRIQualifier, Value: sri}},
+			DigestFunction: remoteexecution.DigestFunction_SHA256,
+		})
+		require.NoError(t, err)
+		return response
+	}
+
+	response := fetch(matchingSRI, origin.URL+"/good")
+	require.Equal(t, int32(codes.OK), response.GetStatus().GetCode())
+	require.Equal(t, digestForData(originData).GetHash(), response.GetBlobDigest().GetHash())
+
+	// A mirror serving other content is rejected and its content isn't stored.
+	response = fetch(matchingSRI, origin.URL+"/poisoned")
+	require.Equal(t, int32(codes.DataLoss), response.GetStatus().GetCode())
+	exists, err := cas.Exists(t.Context(), "instance", digestForData(poisonedData))
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	// The next URI is tried instead.
+	response = fetch(matchingSRI, origin.URL+"/poisoned", origin.URL+"/other")
+	require.Equal(t, int32(codes.OK), response.GetStatus().GetCode())
+	require.Equal(t, origin.URL+"/other", response.GetUri())
+	require.Equal(t, digestForData(originData).GetHash(), response.GetBlobDigest().GetHash())
+
+	poisonedSum := sha256.Sum256(poisonedData)
+	response = fetch("sha256-"+base64.StdEncoding.EncodeToString(poisonedSum[:]), origin.URL+"/good")
+	require.Equal(t, int32(codes.DataLoss), response.GetStatus().GetCode())
+
+	_, err = server.FetchBlob(t.Context(), &remoteasset.FetchBlobRequest{
+		InstanceName:   "instance",
+		Uris:           []string{origin.URL},
+		Qualifiers:     []*remoteasset.Qualifier{{Name: checksumSRIQualifier, Value: "sha256-not-base64"}},
+		DigestFunction: remoteexecution.DigestFunction_SHA256,
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestChecksumFromQualifiers(t *testing.T) {
+	data := []byte("payload")
+	sum256 := sha256.Sum256(data)
+	sum512 := sha512.Sum512(data)
+	sri256 := "sha256-" + base64.StdEncoding.EncodeToString(sum256[:])
+	sri512 := "sha512-" + base64.StdEncoding.EncodeToString(sum512[:])
+
+	qualifiers := func(value string) []*remoteasset.Qualifier {
+		return []*remoteasset.Qualifier{{Name: "resource_type", Value: "application/x-tar"}, {Name: checksumSRIQualifier, Value: value}}
+	}
+
+	checksum, err := checksumFromQualifiers(nil)
+	require.NoError(t, err)
+	require.Nil(t, checksum)
+
+	// The strongest algorithm wins, and unknown ones are ignored.
+	checksum, err = checksumFromQualifiers(qualifiers(sri256 + " md5-AAAA " + sri512 + "?ct=application/x-tar"))
+	require.NoError(t, err)
+	require.Equal(t, "sha512", checksum.algorithm)
+	hasher := checksum.new()
+	_, _ = hasher.Write(data)
+	require.True(t, checksum.matches(hasher.Sum(nil)))
+
+	_, err = checksumFromQualifiers(qualifiers("md5-AAAA"))
+	require.Error(t, err)
+	_, err = checksumFromQualifiers(qualifiers("sha256"))
+	require.Error(t, err)
+	_, err = checksumFromQualifiers(qualifiers("sha256-" + base64.StdEncoding.EncodeToString([]byte("short"))))
+	require.Error(t, err)
+}
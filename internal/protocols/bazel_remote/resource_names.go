@@ -3,18 +3,22 @@ package bazel_remote
 import (
 	"errors"
 	"fmt"
+	"slices"
 	"strconv"
 	"strings"
 
 	remoteexecution "github.com/cirruslabs/omni-cache/internal/api/build/bazel/remote/execution/v2"
 )
 
-var errCompressedBlobsUnsupported = errors.New("compressed blobs are not supported")
+var errCompressedBlobsUnsupported = errors.New("compressor is not supported")
 
 type parsedBlobResource struct {
 	instanceName string
 	digest       *remoteexecution.Digest
-	compressed   bool
+	// compressor is the compression of the data transferred for compressed-blobs
+	// resources, and IDENTITY for blobs resources. The digest is always that of the
+	// uncompressed data.
+	compressor remoteexecution.Compressor_Value
 }
 
 func parseReadResourceName(resourceName string) (*parsedBlobResource, error) {
@@ -29,8 +33,12 @@ func parseReadResourceName(resourceName string) (*parsedBlobResource, error) {
 	}
 
 	rest := segments[blobsIndex+1:]
+	compressor := remoteexecution.Compressor_IDENTITY
 	if compressed {
-		return nil, errCompressedBlobsUnsupported
+		if compressor, err = parseResourceCompressor(rest); err != nil {
+			return nil, err
+		}
+		rest = rest[1:]
 	}
 
 	digest, err := parseResourceDigest(rest)
@@ -41,7 +49,7 @@ func parseReadResourceName(resourceName string) (*parsedBlobResource, error) {
 	return &parsedBlobResource{
 		instanceName: strings.Join(segments[:blobsIndex], "/"),
 		digest:       digest,
-		compressed:   false,
+		compressor:   compressor,
 	}, nil
 }
 
@@ -55,11 +63,16 @@ func parseWriteResourceName(resourceName string) (*parsedBlobResource, error) {
 	if err != nil {
 		return nil, fmt.Errorf("invalid write resource name %q", resourceName)
 	}
+	rest := segments[uploadsIndex+3:]
+	compressor := remoteexecution.Compressor_IDENTITY
 	if compressed {
-		return nil, errCompressedBlobsUnsupported
+		if compressor, err = parseResourceCompressor(rest); err != nil {
+			return nil, err
+		}
+		rest = rest[1:]
 	}
 
-	digest, err := parseResourceDigest(segments[uploadsIndex+3:])
+	digest, err := parseResourceDigest(rest)
 	if err != nil {
 		return nil, err
 	}
@@ -67,7 +80,7 @@ func parseWriteResourceName(resourceName string) (*parsedBlobResource, error) {
 	return &parsedBlobResource{
 		instanceName: strings.Join(segments[:uploadsIndex], "/"),
 		digest:       digest,
-		compressed:   false,
+		compressor:   compressor,
 	}, nil
 }
 
@@ -111,6 +124,21 @@ func locateWriteUploads(segments []string) (uploadsIndex int, compressed bool, e
 	return -1, false, fmt.Errorf("resource name does not reference uploads")
 }
 
+// parseResourceCompressor parses the compressor segment that follows "compressed-blobs".
+// Only the compressors in supportedCompressors other than IDENTITY are accepted.
+func parseResourceCompressor(rest []string) (remoteexecution.Compressor_Value, error) {
+	if len(rest) == 0 {
+		return 0, fmt.Errorf("resource name does not include compressor")
+	}
+
+	value, ok := remoteexecution.Compressor_Value_value[strings.ToUpper(rest[0])]
+	compressor := remoteexecution.Compressor_Value(value)
+	if !ok || compressor == remoteexecution.Compressor_IDENTITY || !slices.Contains(supportedCompressors, compressor) {
+		return 0, fmt.Errorf("%w: %q", errCompressedBlobsUnsupported, rest[0])
+	}
+	return compressor, nil
+}
+
 func parseResourceDigest(rest []string) (*remoteexecution.Digest, error) {
 	if len(rest) < 2 {
 		return nil, fmt.Errorf("resource name does not include digest")
@@ -130,6 +158,8 @@ func parseResourceDigest(rest []string) (*remoteexecution.Digest, error) {
 		sizeToken = rest[1]
 	}
 
+	// Sizes are part of the digest and must be known: a negative size (e.g. -1 for
+	// "unknown") would let a write skip the size check in ByteStream.Write.
 	size, err := strconv.ParseInt(sizeToken, 10, 64)
 	if err != nil || size < 0 {
 		return nil, fmt.Errorf("invalid digest size %q", sizeToken)
@@ -3,6 +3,7 @@ package bazel_remote
 import (
 	"testing"
 
+	remoteexecution "github.com/cirruslabs/omni-cache/internal/api/build/bazel/remote/execution/v2"
 	"github.com/stretchr/testify/require"
 )
 
@@ -24,9 +25,32 @@ func TestParseReadResourceNameUsesTrailingBlobMarker(t *testing.T) {
 	require.EqualValues(t, 0, parsed.digest.GetSizeBytes())
 }
 
-func TestParseWriteResourceNameRejectsCompressed(t *testing.T) {
-	_, err := parseWriteResourceName("instance/uploads/u/compressed-blobs/zstd/" + emptySHA256Hash + "/0")
-	require.ErrorIs(t, err, errCompressedBlobsUnsupported)
+func TestParseCompressedResourceNames(t *testing.T) {
+	parsed, err := parseWriteResourceName("instance/uploads/u/compressed-blobs/zstd/" + emptySHA256Hash + "/0")
+	require.NoError(t, err)
+	require.Equal(t, "instance", parsed.instanceName)
+	require.Equal(t, remoteexecution.Compressor_ZSTD, parsed.compressor)
+	require.Equal(t, emptySHA256Hash, parsed.digest.GetHash())
+
+	parsed, err = parseReadResourceName("instance/compressed-blobs/zstd/sha256/" + emptySHA256Hash + "/0")
+	require.NoError(t, err)
+	require.Equal(t, "instance", parsed.instanceName)
+	require.Equal(t, remoteexecution.Compressor_ZSTD, parsed.compressor)
+	require.Equal(t, emptySHA256Hash, parsed.digest.GetHash())
+
+	parsed, err = parseReadResourceName("instance/blobs/" + emptySHA256Hash + "/0")
+	require.NoError(t, err)
+	require.Equal(t, remoteexecution.Compressor_IDENTITY, parsed.compressor)
+}
+
+func TestParseCompressedResourceNamesRejectUnsupportedCompressors(t *testing.T) {
+	for _, compressor := range []string{"deflate", "identity", "bogus"} {
+		_, err := parseWriteResourceName("instance/uploads/u/compressed-blobs/" + compressor + "/" + emptySHA256Hash + "/0")
+		require.ErrorIs(t, err, errCompressedBlobsUnsupported, compressor)
+
+		_, err = parseReadResourceName("instance/compressed-blobs/" + compressor + "/" + emptySHA256Hash + "/0")
+		require.ErrorIs(t, err, errCompressedBlobsUnsupported, compressor)
+	}
 }
 
 func TestParseWriteResourceNameUsesTrailingUploadsMarker(t *testing.T) {
@@ -37,3 +61,13 @@ func TestParseWriteResourceNameUsesTrailingUploadsMarker(t *testing.T) {
 	require.Equal(t, emptySHA256Hash, parsed.digest.GetHash())
 	require.EqualValues(t, 0, parsed.digest.GetSizeBytes())
 }
+
+func TestParseWriteResourceNameRequiresKnownSize(t *testing.T) {
+	for _, size := range []string{"-1", "unknown"} {
+		_, err := parseWriteResourceName("instance/uploads/u-1/blobs/" + emptySHA256Hash + "/" + size)
+		require.ErrorContains(t, err, "invalid digest size", size)
+
+		_, err = parseReadResourceName("instance/blobs/" + emptySHA256Hash + "/" + size)
+		require.ErrorContains(t, err, "invalid digest size", size)
+	}
+}
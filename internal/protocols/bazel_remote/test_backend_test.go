@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"sync"
 	"testing"
 
@@ -102,13 +103,29 @@ func (b *memoryHTTPBackend) CacheInfo(ctx context.Context, key string, _ []strin
 	}, nil
 }
 
+func (b *memoryHTTPBackend) List(ctx context.Context, prefix string, fn func(storage.ObjectInfo) error) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for key, data := range b.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if err := fn(storage.ObjectInfo{Key: key, SizeBytes: int64(len(data))}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func newTestStores(t *testing.T) (*casStore, *assetStore) {
 	t.Helper()
 
 	backend := newMemoryHTTPBackend(t)
 	proxy := urlproxy.NewProxy(urlproxy.WithHTTPClient(backend.server.Client()))
-	cas := newCASStore(backend, proxy)
-	assets := newAssetStore(backend, proxy)
+	cas := newCASStore(backend, proxy, "")
+	assets := newAssetStore(backend, proxy, "")
 	return cas, assets
 }
 
@@ -0,0 +1,135 @@
+package bazel_remote
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+)
+
+// InstanceUsage describes how much CAS storage a single instance name occupies.
+type InstanceUsage struct {
+	InstanceName string `json:"instance_name"`
+	Objects      int64  `json:"objects"`
+	Bytes        int64  `json:"bytes"`
+}
+
+// UsageReport is a point-in-time breakdown of CAS storage per instance name.
+type UsageReport struct {
+	GeneratedAt time.Time       `json:"generated_at"`
+	Instances   []InstanceUsage `json:"instances"`
+}
+
+// usageReporter lists CAS objects and caches the resulting report for interval,
+// so that repeated scrapes don't turn into repeated full listings.
+type usageReporter struct {
+	backend   storage.ListableBlobStorageBackend
+	casPrefix string
+	interval  time.Duration
+	now       func() time.Time
+
+	mu     sync.Mutex
+	report *UsageReport
+}
+
+func newUsageReporter(backend storage.ListableBlobStorageBackend, keyPrefix string, interval time.Duration) *usageReporter {
+	return &usageReporter{
+		backend:   backend,
+		casPrefix: casKeyPrefix(keyPrefix),
+		interval:  interval,
+		now:       time.Now,
+	}
+}
+
+func (r *usageReporter) Report(ctx context.Context) (*UsageReport, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.report != nil && r.now().Sub(r.report.GeneratedAt) < r.interval {
+		return r.report, nil
+	}
+
+	usage := map[string]*InstanceUsage{}
+	err := r.backend.List(ctx, r.casPrefix, func(info storage.ObjectInfo) error {
+		instanceName, ok := instanceFromCASObjectKey(r.casPrefix, info.Key)
+		if !ok {
+			return nil
+		}
+
+		entry, ok := usage[instanceName]
+		if !ok {
+			entry = &InstanceUsage{InstanceName: instanceName}
+			usage[instanceName] = entry
+		}
+		entry.Objects++
+		entry.Bytes += info.SizeBytes
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report := &UsageReport{
+		GeneratedAt: r.now(),
+		Instances:   make([]InstanceUsage, 0, len(usage)),
+	}
+	for _, entry := range usage {
+		report.Instances = append(report.Instances, *entry)
+	}
+	sort.Slice(report.Instances, func(i, j int) bool {
+		if report.Instances[i].Bytes == report.Instances[j].Bytes {
+			return report.Instances[i].InstanceName < report.Instances[j].InstanceName
+		}
+		return report.Instances[i].Bytes > report.Instances[j].Bytes
+	})
+
+	r.report = report
+	return report, nil
+}
+
+func (r *usageReporter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	report, err := r.Report(req.Context())
+	if err != nil {
+		slog.ErrorContext(req.Context(), "bazel usage report failed", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		slog.ErrorContext(req.Context(), "failed to encode bazel usage report", "err", err)
+	}
+}
+
+func instanceFromCASObjectKey(casPrefix string, key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, casPrefix)
+	if !ok {
+		return "", false
+	}
+
+	encoded, _, ok := strings.Cut(rest, "/")
+	if !ok || encoded == "" {
+		return "", false
+	}
+
+	return decodeInstance(encoded)
+}
+
+func decodeInstance(encoded string) (string, bool) {
+	if encoded == "_" {
+		return "", true
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+	return string(decoded), true
+}
@@ -0,0 +1,56 @@
+package bazel_remote
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	urlproxy "github.com/cirruslabs/omni-cache/pkg/url-proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsageReportGroupsByInstance(t *testing.T) {
+	backend := newMemoryHTTPBackend(t)
+	proxy := urlproxy.NewProxy(urlproxy.WithHTTPClient(backend.server.Client()))
+	cas := newCASStore(backend, proxy, "")
+
+	for instanceName, blobs := range map[string][]string{
+		"team-a": {"one", "two"},
+		"":       {"default"},
+	} {
+		for _, blob := range blobs {
+			data := []byte(blob)
+			require.NoError(t, cas.UploadBytes(t.Context(), instanceName, digestForData(data), data))
+		}
+	}
+
+	reporter := newUsageReporter(backend, "", time.Minute)
+	report, err := reporter.Report(t.Context())
+	require.NoError(t, err)
+	require.Equal(t, []InstanceUsage{
+		{InstanceName: "", Objects: 1, Bytes: 7},
+		{InstanceName: "team-a", Objects: 2, Bytes: 6},
+	}, report.Instances)
+
+	// Reports are cached until the interval elapses.
+	data := []byte("three")
+	require.NoError(t, cas.UploadBytes(t.Context(), "team-a", digestForData(data), data))
+
+	cached, err := reporter.Report(t.Context())
+	require.NoError(t, err)
+	require.Same(t, report, cached)
+
+	reporter.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	recorder := httptest.NewRecorder()
+	reporter.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, UsageReportPath, nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	var refreshed UsageReport
+	require.NoError(t, json.NewDecoder(recorder.Body).Decode(&refreshed))
+	require.Equal(t, []InstanceUsage{
+		{InstanceName: "team-a", Objects: 3, Bytes: 11},
+		{InstanceName: "", Objects: 1, Bytes: 7},
+	}, refreshed.Instances)
+}
@@ -16,6 +16,8 @@ import (
 
 	"github.com/cirruslabs/omni-cache/internal/protocols/ghacache/httprange"
 	"github.com/cirruslabs/omni-cache/internal/protocols/ghacache/uploadable"
+	"github.com/cirruslabs/omni-cache/pkg/errdetail"
+	"github.com/cirruslabs/omni-cache/pkg/signedurl"
 	"github.com/cirruslabs/omni-cache/pkg/stats"
 	"github.com/cirruslabs/omni-cache/pkg/storage"
 )
@@ -25,8 +27,20 @@ const (
 
 	// JavaScript's Number is limited to 2^53-1.
 	jsNumberMaxSafeInteger = 9007199254740991
+
+	// partUploadRetryAfter is the Retry-After hint sent with failed part uploads
+	// when the storage backend didn't provide its own.
+	partUploadRetryAfter = 2 * time.Second
+
+	// EmptyVersionSentinel is the version under which entries are stored when a client
+	// omits the cache version. Real versions are hex digests, so it can't collide with them.
+	EmptyVersionSentinel = "unversioned"
 )
 
+// errMissingHost is returned when an archive location can't be built because neither a
+// cache host is configured nor the request carries a Host header, as with HTTP/1.0 clients.
+var errMissingHost = errors.New("no cache host is configured and the request has no Host header")
+
 type cacheBackend interface {
 	storage.MultipartBlobStorageBackend
 }
@@ -37,9 +51,14 @@ type GHACache struct {
 	httpClient  *http.Client
 	mux         *http.ServeMux
 	uploadables sync.Map // map[int64]*uploadable.Uploadable
+	keyPrefix   string
+
+	entryURLPrefix     string
+	rejectEmptyVersion bool
+	urlSigner          *signedurl.Signer
 }
 
-func New(cacheHost string, backend cacheBackend, httpClient *http.Client) *GHACache {
+func New(cacheHost string, backend cacheBackend, httpClient *http.Client, opts ...Option) *GHACache {
 	if httpClient == nil {
 		httpClient = http.DefaultClient
 	}
@@ -51,6 +70,10 @@ func New(cacheHost string, backend cacheBackend, httpClient *http.Client) *GHACa
 		uploadables: sync.Map{},
 	}
 
+	for _, opt := range opts {
+		opt(cache)
+	}
+
 	cache.mux.HandleFunc("GET /cache", cache.get)
 	cache.mux.HandleFunc("POST /caches", cache.reserveUploadable)
 	cache.mux.HandleFunc("PATCH /caches/{id}", cache.updateUploadable)
@@ -66,17 +89,23 @@ func (cache *GHACache) ServeHTTP(writer http.ResponseWriter, request *http.Reque
 func (cache *GHACache) get(writer http.ResponseWriter, request *http.Request) {
 	keys := strings.Split(request.URL.Query().Get("keys"), ",")
 	version := request.URL.Query().Get("version")
+	if version == "" && cache.rejectEmptyVersion {
+		fail(writer, request, http.StatusBadRequest, "GHA cache requires a non-empty cache version")
+		return
+	}
 
 	keysWithVersions := make([]string, 0, len(keys))
 	for _, key := range keys {
-		keysWithVersions = append(keysWithVersions, httpCacheKey(key, version))
+		keysWithVersions = append(keysWithVersions, cache.httpCacheKey(key, version))
 	}
 
-	cacheKeyPrefixes := keysWithVersions[1:]
-	info, err := cache.backend.CacheInfo(request.Context(), keysWithVersions[0], cacheKeyPrefixes)
+	// Like GitHub, look for the exact primary key, then for the newest entry whose key
+	// starts with the primary key, then with each restore key in order. The entry's own
+	// key is returned, so the client knows whether it got an exact hit.
+	info, err := cache.backend.CacheInfo(request.Context(), keysWithVersions[0], keysWithVersions)
 	if err != nil {
 		if errors.Is(err, storage.ErrCacheNotFound) {
-			stats.Default().RecordCacheMiss()
+			protocolStats.RecordCacheMiss()
 			writer.WriteHeader(http.StatusNoContent)
 			return
 		}
@@ -86,13 +115,24 @@ func (cache *GHACache) get(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	stats.Default().RecordCacheHit()
+	archiveLocation, err := cache.httpCacheURL(request, info.Key)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errMissingHost) {
+			status = http.StatusBadRequest
+		}
+		fail(writer, request, status, "GHA cache failed to build the archive location",
+			"key", info.Key, "err", err)
+		return
+	}
+
+	protocolStats.RecordCacheHit()
 	jsonResp := struct {
 		Key string `json:"cacheKey"`
 		URL string `json:"archiveLocation"`
 	}{
-		Key: strings.TrimPrefix(info.Key, httpCacheKey("", version)),
-		URL: cache.httpCacheURL(request, info.Key),
+		Key: strings.TrimPrefix(info.Key, cache.httpCacheKey("", version)),
+		URL: archiveLocation,
 	}
 
 	writeJSON(writer, request, http.StatusOK, jsonResp)
@@ -109,6 +149,11 @@ func (cache *GHACache) reserveUploadable(writer http.ResponseWriter, request *ht
 			"JSON passed to the reserve uploadable endpoint", "err", err)
 		return
 	}
+	if jsonReq.Version == "" && cache.rejectEmptyVersion {
+		fail(writer, request, http.StatusBadRequest, "GHA cache requires a non-empty cache version",
+			"key", jsonReq.Key)
+		return
+	}
 
 	jsonResp := struct {
 		CacheID int64 `json:"cacheId"`
@@ -116,9 +161,15 @@ func (cache *GHACache) reserveUploadable(writer http.ResponseWriter, request *ht
 		CacheID: rand.Int63n(jsNumberMaxSafeInteger),
 	}
 
-	uploadID, err := cache.backend.CreateMultipartUpload(request.Context(), httpCacheKey(jsonReq.Key, jsonReq.Version), nil)
+	uploadID, err := cache.backend.CreateMultipartUpload(request.Context(), cache.httpCacheKey(jsonReq.Key, jsonReq.Version), nil)
 	if err != nil {
-		fail(writer, request, http.StatusInternalServerError, "GHA cache failed to create "+
+		status := http.StatusInternalServerError
+		if errors.Is(err, storage.ErrQuotaExceeded) {
+			status = http.StatusRequestEntityTooLarge
+		} else if errors.Is(err, storage.ErrReadOnly) {
+			status = http.StatusForbidden
+		}
+		fail(writer, request, status, "GHA cache failed to create "+
 			"multipart upload", "key", jsonReq.Key, "version", jsonReq.Version, "err", err)
 		return
 	}
@@ -166,7 +217,7 @@ func (cache *GHACache) updateUploadable(writer http.ResponseWriter, request *htt
 	}
 
 	urlInfo, err := cache.backend.UploadPartURL(request.Context(),
-		httpCacheKey(currentUploadable.Key(), currentUploadable.Version()),
+		cache.httpCacheKey(currentUploadable.Key(), currentUploadable.Version()),
 		currentUploadable.UploadID(),
 		uint32(partNumber),
 		uint64(httpRanges[0].Length),
@@ -196,6 +247,7 @@ func (cache *GHACache) updateUploadable(writer http.ResponseWriter, request *htt
 	uploadPartResponse, err := cache.httpClient.Do(uploadPartRequest)
 	if err != nil {
 		// Return HTTP 502 to trigger a retry by the Actions Toolkit.
+		setRetryAfter(writer, "")
 		fail(writer, request, http.StatusBadGateway, "GHA cache failed to upload part",
 			"key", currentUploadable.Key(), "version", currentUploadable.Version(), "part_number", partNumber,
 			"err", err)
@@ -205,13 +257,17 @@ func (cache *GHACache) updateUploadable(writer http.ResponseWriter, request *htt
 
 	if uploadPartResponse.StatusCode != http.StatusOK {
 		// Pass through status code to keep Actions Toolkit retry behavior.
+		if retryableStatus(uploadPartResponse.StatusCode) {
+			setRetryAfter(writer, uploadPartResponse.Header.Get("Retry-After"))
+		}
 		fail(writer, request, uploadPartResponse.StatusCode, "GHA cache failed to upload part",
 			"key", currentUploadable.Key(), "version", currentUploadable.Version(), "part_number", partNumber,
 			"unexpected_status_code", uploadPartResponse.StatusCode)
 		return
 	}
 
-	err = currentUploadable.AppendPart(uint32(partNumber), uploadPartResponse.Header.Get("ETag"), httpRanges[0].Length)
+	err = currentUploadable.AppendPart(uint32(partNumber), uploadPartResponse.Header.Get("ETag"),
+		httpRanges[0].Start, httpRanges[0].Length)
 	if err != nil {
 		fail(writer, request, http.StatusInternalServerError, "GHA cache failed to append part",
 			"key", currentUploadable.Key(), "version", currentUploadable.Version(), "part_number", partNumber,
@@ -248,22 +304,21 @@ func (cache *GHACache) commitUploadable(writer http.ResponseWriter, request *htt
 		return
 	}
 
-	parts, partsSize, err := currentUploadable.Finalize()
+	parts, partsSize, err := currentUploadable.Finalize(jsonReq.Size)
 	if err != nil {
+		if errors.Is(err, uploadable.ErrIncompleteUpload) {
+			fail(writer, request, http.StatusBadRequest, fmt.Sprintf("GHA cache failed to "+
+				"finalize uploadable: %v", err), "id", id, "size", jsonReq.Size)
+			return
+		}
+
 		fail(writer, request, http.StatusInternalServerError, "GHA cache failed to "+
 			"finalize uploadable", "id", id, "err", err)
 		return
 	}
 
-	if jsonReq.Size != partsSize {
-		fail(writer, request, http.StatusBadRequest, "GHA cache detected a cache entry "+
-			"size mismatch for uploadable", "id", id, "expected_bytes", partsSize,
-			"actual_bytes", jsonReq.Size)
-		return
-	}
-
 	err = cache.backend.CommitMultipartUpload(request.Context(),
-		httpCacheKey(currentUploadable.Key(), currentUploadable.Version()),
+		cache.httpCacheKey(currentUploadable.Key(), currentUploadable.Version()),
 		currentUploadable.UploadID(),
 		parts,
 	)
@@ -275,7 +330,7 @@ func (cache *GHACache) commitUploadable(writer http.ResponseWriter, request *htt
 	}
 
 	if startedAt, ok := currentUploadable.StartedAt(); ok {
-		stats.Default().RecordUpload(partsSize, time.Since(startedAt))
+		protocolStats.RecordUpload(partsSize, time.Since(startedAt))
 	}
 
 	cache.uploadables.Delete(id)
@@ -283,15 +338,23 @@ func (cache *GHACache) commitUploadable(writer http.ResponseWriter, request *htt
 	writer.WriteHeader(http.StatusCreated)
 }
 
-func httpCacheKey(key string, version string) string {
-	return fmt.Sprintf("%s-%s", url.PathEscape(version), url.PathEscape(key))
+func (cache *GHACache) httpCacheKey(key string, version string) string {
+	if version == "" {
+		version = EmptyVersionSentinel
+	}
+	return fmt.Sprintf("%s%s-%s", cache.keyPrefix, url.PathEscape(version), url.PathEscape(key))
 }
 
-func (cache *GHACache) httpCacheURL(request *http.Request, keyWithVersion string) string {
+// httpCacheURL returns the URL the client downloads the entry from. The configured cache
+// host takes precedence over the request's Host header.
+func (cache *GHACache) httpCacheURL(request *http.Request, keyWithVersion string) (string, error) {
 	host := cache.cacheHost
 	if host == "" {
 		host = request.Host
 	}
+	if host == "" {
+		return "", errMissingHost
+	}
 
 	scheme := "http"
 	if forwarded := request.Header.Get("X-Forwarded-Proto"); forwarded != "" {
@@ -303,13 +366,19 @@ func (cache *GHACache) httpCacheURL(request *http.Request, keyWithVersion string
 		scheme = "https"
 	}
 
-	rawURL := fmt.Sprintf("%s://%s/%s", scheme, host, url.PathEscape(keyWithVersion))
+	rawURL := fmt.Sprintf("%s://%s%s/%s", scheme, host, cache.entryURLPrefix, url.PathEscape(keyWithVersion))
 	parsed, err := url.Parse(rawURL)
 	if err != nil {
-		return rawURL
+		return "", fmt.Errorf("invalid archive location %q: %w", rawURL, err)
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return "", fmt.Errorf("invalid archive location %q: expected an http(s) URL with a host", rawURL)
 	}
 	stats.AddSkipHitMissQuery(parsed)
-	return parsed.String()
+	if cache.urlSigner != nil {
+		cache.urlSigner.Sign(parsed, http.MethodGet)
+	}
+	return parsed.String(), nil
 }
 
 func getID(request *http.Request) (int64, bool) {
@@ -338,10 +407,24 @@ func fail(writer http.ResponseWriter, request *http.Request, status int, msg str
 	writeJSON(writer, request, status, struct {
 		Message string `json:"message"`
 	}{
-		Message: message,
+		Message: errdetail.Message(request.Context(), message, msg),
 	})
 }
 
+// setRetryAfter asks the client to back off before retrying a failed part upload instead
+// of hammering a struggling backend. A Retry-After returned by the backend takes precedence.
+func setRetryAfter(writer http.ResponseWriter, upstream string) {
+	retryAfter := strings.TrimSpace(upstream)
+	if retryAfter == "" {
+		retryAfter = strconv.Itoa(int(partUploadRetryAfter / time.Second))
+	}
+	writer.Header().Set("Retry-After", retryAfter)
+}
+
+func retryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
 func formatMessage(msg string, args ...any) string {
 	var stringBuilder strings.Builder
 	logger := slog.New(slog.NewTextHandler(&stringBuilder, nil))
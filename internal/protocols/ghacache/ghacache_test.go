@@ -0,0 +1,229 @@
+package ghacache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// failingPartBackend hands out part upload URLs that point at a server answering
+// with a fixed error response.
+type failingPartBackend struct {
+	*storage.FilesystemStorage
+
+	partURL string
+}
+
+func (b *failingPartBackend) UploadPartURL(context.Context, string, string, uint32, uint64) (*storage.URLInfo, error) {
+	return &storage.URLInfo{URL: b.partURL}, nil
+}
+
+func uploadPartWithFailingBackend(t *testing.T, partURL string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	fsBackend, err := storage.NewFilesystemStorage(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = fsBackend.Close()
+	})
+
+	cache := New("localhost", &failingPartBackend{FilesystemStorage: fsBackend, partURL: partURL}, nil)
+
+	reserve := httptest.NewRecorder()
+	cache.ServeHTTP(reserve, httptest.NewRequest(http.MethodPost, "/caches",
+		strings.NewReader(`{"key":"key","version":"v1"}`)))
+	require.Equal(t, http.StatusOK, reserve.Code)
+
+	var reserveResp struct {
+		CacheID int64 `json:"cacheId"`
+	}
+	require.NoError(t, json.NewDecoder(reserve.Body).Decode(&reserveResp))
+
+	patch := httptest.NewRequest(http.MethodPatch, fmt.Sprintf("/caches/%d", reserveResp.CacheID),
+		strings.NewReader("data"))
+	patch.Header.Set("Content-Range", "bytes 0-3/*")
+	recorder := httptest.NewRecorder()
+	cache.ServeHTTP(recorder, patch)
+
+	return recorder
+}
+
+func TestUpdateUploadableSetsRetryAfterOnBackendError(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(upstream.Close)
+
+	recorder := uploadPartWithFailingBackend(t, upstream.URL)
+	require.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	require.Equal(t, "2", recorder.Header().Get("Retry-After"))
+}
+
+func TestUpdateUploadablePassesThroughUpstreamRetryAfter(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	t.Cleanup(upstream.Close)
+
+	recorder := uploadPartWithFailingBackend(t, upstream.URL)
+	require.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	require.Equal(t, "7", recorder.Header().Get("Retry-After"))
+}
+
+func TestUpdateUploadableSetsRetryAfterOnTransportError(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	upstreamURL := upstream.URL
+	upstream.Close()
+
+	recorder := uploadPartWithFailingBackend(t, upstreamURL)
+	require.Equal(t, http.StatusBadGateway, recorder.Code)
+	require.Equal(t, "2", recorder.Header().Get("Retry-After"))
+}
+
+func TestUpdateUploadableOmitsRetryAfterOnClientError(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	t.Cleanup(upstream.Close)
+
+	recorder := uploadPartWithFailingBackend(t, upstream.URL)
+	require.Equal(t, http.StatusForbidden, recorder.Code)
+	require.Empty(t, recorder.Header().Get("Retry-After"))
+}
+
+func TestEmptyVersion(t *testing.T) {
+	fsBackend, err := storage.NewFilesystemStorage(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = fsBackend.Close()
+	})
+
+	reserve := func(cache *GHACache) int {
+		recorder := httptest.NewRecorder()
+		cache.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/caches", strings.NewReader(`{"key":"key"}`)))
+		return recorder.Code
+	}
+
+	cache := New("localhost", fsBackend, nil)
+	require.Equal(t, "unversioned-key", cache.httpCacheKey("key", ""))
+	require.Equal(t, http.StatusOK, reserve(cache))
+
+	cache = New("localhost", fsBackend, nil, WithRejectEmptyVersion(true))
+	require.Equal(t, http.StatusBadRequest, reserve(cache))
+
+	recorder := httptest.NewRecorder()
+	cache.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/cache?keys=key", nil))
+	require.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestArchiveLocationWithoutHost(t *testing.T) {
+	fsBackend, err := storage.NewFilesystemStorage(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = fsBackend.Close()
+	})
+	require.NoError(t, fsBackend.Put(context.Background(), "v1-key", strings.NewReader("data"), nil))
+
+	get := func(cache *GHACache, host string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, "/cache?keys=key&version=v1", nil)
+		// HTTP/1.0 clients may omit the Host header.
+		request.Proto, request.ProtoMajor, request.ProtoMinor = "HTTP/1.0", 1, 0
+		request.Host = host
+		recorder := httptest.NewRecorder()
+		cache.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	recorder := get(New("", fsBackend, nil), "")
+	require.Equal(t, http.StatusBadRequest, recorder.Code)
+	require.Contains(t, recorder.Body.String(), "archive location")
+
+	var response struct {
+		URL string `json:"archiveLocation"`
+	}
+	recorder = get(New("cache.local", fsBackend, nil), "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.NoError(t, json.NewDecoder(recorder.Body).Decode(&response))
+	require.True(t, strings.HasPrefix(response.URL, "http://cache.local/"), response.URL)
+
+	recorder = get(New("", fsBackend, nil), "client.local:8080")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.NoError(t, json.NewDecoder(recorder.Body).Decode(&response))
+	require.True(t, strings.HasPrefix(response.URL, "http://client.local:8080/"), response.URL)
+}
+
+func TestGetRestoreKeyPrefixMatching(t *testing.T) {
+	root := t.TempDir()
+	fsBackend, err := storage.NewFilesystemStorage(root)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = fsBackend.Close()
+	})
+
+	// put stores an entry last modified age ago.
+	put := func(key string, age time.Duration) {
+		require.NoError(t, fsBackend.Put(context.Background(), key, strings.NewReader(key), nil))
+		modTime := time.Now().Add(-age)
+		err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() || !strings.HasPrefix(filepath.Base(path), key) {
+				return err
+			}
+			return os.Chtimes(path, modTime, modTime)
+		})
+		require.NoError(t, err)
+	}
+	// The newest entry sorts first, so that a match by name would pick another one.
+	put("v1-linux-deps-b", 3*time.Hour)
+	put("v1-linux-deps-a", time.Hour)
+	put("v1-linux-deps-c", 2*time.Hour)
+	put("v1-linux-tools-z", 4*time.Hour)
+	put("v2-linux-deps-d", 0)
+
+	cache := New("localhost", fsBackend, nil)
+	get := func(keys string) (int, string) {
+		recorder := httptest.NewRecorder()
+		cache.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/cache?version=v1&keys="+keys, nil))
+		if recorder.Code != http.StatusOK {
+			return recorder.Code, ""
+		}
+		var response struct {
+			Key string `json:"cacheKey"`
+		}
+		require.NoError(t, json.NewDecoder(recorder.Body).Decode(&response))
+		return recorder.Code, response.Key
+	}
+
+	for _, tc := range []struct {
+		keys    string
+		wantKey string
+	}{
+		// An exact match wins over newer entries sharing its prefix.
+		{keys: "linux-deps-c", wantKey: "linux-deps-c"},
+		// The primary key is tried as a prefix before the restore keys.
+		{keys: "linux-deps-,linux-tools-", wantKey: "linux-deps-a"},
+		{keys: "linux-deps-missing,linux-deps-", wantKey: "linux-deps-a"},
+		// Restore keys are tried in order, the newest match of the first one wins.
+		{keys: "linux-deps-missing,linux-tools-,linux-deps-", wantKey: "linux-tools-z"},
+		{keys: "linux-deps-missing,linux-", wantKey: "linux-deps-a"},
+	} {
+		status, key := get(tc.keys)
+		require.Equal(t, http.StatusOK, status, tc.keys)
+		require.Equal(t, tc.wantKey, key, tc.keys)
+	}
+
+	// Entries of other versions never match.
+	status, _ := get("linux-deps-d,linux-deps-d")
+	require.Equal(t, http.StatusNoContent, status)
+}
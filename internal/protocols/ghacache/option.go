@@ -0,0 +1,43 @@
+package ghacache
+
+import (
+	"strings"
+
+	"github.com/cirruslabs/omni-cache/pkg/signedurl"
+)
+
+type Option func(cache *GHACache)
+
+// WithRejectEmptyVersion makes requests without a cache version fail instead of being
+// stored under the EmptyVersionSentinel version.
+func WithRejectEmptyVersion(reject bool) Option {
+	return func(cache *GHACache) {
+		cache.rejectEmptyVersion = reject
+	}
+}
+
+// WithKeyPrefix stores cache entries under the given top-level storage prefix.
+func WithKeyPrefix(prefix string) Option {
+	return func(cache *GHACache) {
+		prefix = strings.Trim(prefix, "/")
+		if prefix != "" {
+			prefix += "/"
+		}
+		cache.keyPrefix = prefix
+	}
+}
+
+// WithEntryURLPrefix sets the URL path prefix under which the http-cache protocol serves
+// the entries that this protocol hands out as archive locations.
+func WithEntryURLPrefix(prefix string) Option {
+	return func(cache *GHACache) {
+		cache.entryURLPrefix = strings.TrimRight(prefix, "/")
+	}
+}
+
+// WithURLSigner signs the URLs that this protocol hands out with signer.
+func WithURLSigner(signer *signedurl.Signer) Option {
+	return func(cache *GHACache) {
+		cache.urlSigner = signer
+	}
+}
@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/cirruslabs/omni-cache/internal/protocols/http_cache"
 	"github.com/cirruslabs/omni-cache/pkg/protocols"
+	"github.com/cirruslabs/omni-cache/pkg/signedurl"
+	"github.com/cirruslabs/omni-cache/pkg/storage"
 )
 
 // Factory wires the gha-cache (GitHub Actions cache v1) protocol.
@@ -14,29 +17,79 @@ import (
 //	POST /_apis/artifactcache/caches
 //	PATCH /_apis/artifactcache/caches/{id}
 //	POST /_apis/artifactcache/caches/{id}
-type Factory struct{}
+type Factory struct {
+	Options Options
+}
+
+// Options configures the gha-cache protocol.
+type Options struct {
+	// KeyPrefix is the top-level storage prefix for cache entries.
+	// Empty stores entries at the bucket root, as before.
+	KeyPrefix string
+
+	// RejectEmptyVersion fails requests that don't specify a cache version. By default
+	// they are stored under the EmptyVersionSentinel version.
+	RejectEmptyVersion bool
+
+	// CommitRetries retries committing multipart uploads after failures that may be
+	// transient before reporting them to the client. The zero value doesn't retry.
+	CommitRetries storage.RetryPolicy
+}
 
 func (Factory) ID() string {
 	return "gha-cache"
 }
 
-func (Factory) New(deps protocols.Dependencies) (protocols.Protocol, error) {
+func (f Factory) Describe() protocols.Description {
+	description := protocols.Description{
+		Summary: "GitHub Actions cache v1 API",
+		HTTPRoutes: []string{
+			"GET " + APIMountPoint + "/cache",
+			"POST " + APIMountPoint + "/caches",
+			"PATCH " + APIMountPoint + "/caches/{id}",
+			"POST " + APIMountPoint + "/caches/{id}",
+		},
+		// Archives are downloaded from the http-cache protocol.
+		SharesObjectsWith: []string{http_cache.Factory{}.ID()},
+	}
+	if f.Options.RejectEmptyVersion {
+		description.Features = []string{"reject-empty-version"}
+	}
+	return description
+}
+
+var protocolStats = protocols.Stats(Factory{}.ID())
+
+func (f Factory) New(deps protocols.Dependencies) (protocols.Protocol, error) {
 	deps = deps.WithDefaults()
 
 	backend, ok := deps.Storage.(cacheBackend)
 	if !ok {
 		return nil, fmt.Errorf("gha-cache requires multipart storage backend with cache info support")
 	}
+	backend = storage.NewCommitRetryStorage(backend, f.Options.CommitRetries)
+
+	// Archive locations point at entries served by the http-cache protocol.
+	entryURLPrefix, ok := deps.MountPrefix(http_cache.Factory{}.ID())
+	if !ok {
+		return nil, fmt.Errorf("gha-cache requires the http-cache protocol to be served")
+	}
 
 	return &protocol{
-		backend: backend,
-		http:    deps.HTTP,
+		backend:        backend,
+		http:           deps.HTTP,
+		options:        f.Options,
+		entryURLPrefix: entryURLPrefix,
+		urlSigner:      deps.URLSigner,
 	}, nil
 }
 
 type protocol struct {
-	backend cacheBackend
-	http    *http.Client
+	backend        cacheBackend
+	http           *http.Client
+	options        Options
+	entryURLPrefix string
+	urlSigner      *signedurl.Signer
 }
 
 func (p *protocol) Register(registrar *protocols.Registrar) error {
@@ -45,7 +98,12 @@ func (p *protocol) Register(registrar *protocols.Registrar) error {
 		return fmt.Errorf("http mux is nil")
 	}
 
-	ghaCache := New("", p.backend, p.http)
+	ghaCache := New("", p.backend, p.http,
+		WithKeyPrefix(p.options.KeyPrefix),
+		WithRejectEmptyVersion(p.options.RejectEmptyVersion),
+		WithEntryURLPrefix(p.entryURLPrefix),
+		WithURLSigner(p.urlSigner),
+	)
 	handler := http.StripPrefix(APIMountPoint, ghaCache)
 	mux.Handle("GET "+APIMountPoint+"/cache", handler)
 	mux.Handle("POST "+APIMountPoint+"/caches", handler)
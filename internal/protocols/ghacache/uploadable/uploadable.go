@@ -2,6 +2,7 @@ package uploadable
 
 import (
 	"cmp"
+	"errors"
 	"fmt"
 	"slices"
 	"sync"
@@ -11,6 +12,10 @@ import (
 	"github.com/cirruslabs/omni-cache/pkg/storage"
 )
 
+// ErrIncompleteUpload is returned by Finalize when the appended parts
+// don't form a contiguous range covering the whole cache entry.
+var ErrIncompleteUpload = errors.New("uploaded parts don't cover the cache entry")
+
 type Uploadable struct {
 	key      string
 	version  string
@@ -27,6 +32,7 @@ type Uploadable struct {
 type Part struct {
 	Number uint32
 	ETag   string
+	Offset int64
 	Size   int64
 }
 
@@ -73,17 +79,21 @@ func (uploadable *Uploadable) StartedAt() (time.Time, bool) {
 	return uploadable.startedAt, true
 }
 
-func (uploadable *Uploadable) AppendPart(number uint32, etag string, size int64) error {
+// AppendPart records an uploaded part. It is idempotent per part number: when the
+// Actions Toolkit retries a PATCH for the same range, the retried part replaces the
+// earlier one (including its ETag) instead of being counted twice.
+func (uploadable *Uploadable) AppendPart(number uint32, etag string, offset int64, size int64) error {
 	uploadable.mtx.Lock()
 	defer uploadable.mtx.Unlock()
 
 	if uploadable.finalized {
-		return fmt.Errorf("cannot finalize the uploadable twice")
+		return fmt.Errorf("cannot append a part to a finalized uploadable")
 	}
 
 	uploadable.parts[number] = &Part{
 		Number: number,
 		ETag:   etag,
+		Offset: offset,
 		Size:   size,
 	}
 	if uploadable.startedAt.IsZero() {
@@ -93,7 +103,10 @@ func (uploadable *Uploadable) AppendPart(number uint32, etag string, size int64)
 	return nil
 }
 
-func (uploadable *Uploadable) Finalize() ([]storage.MultipartUploadPart, int64, error) {
+// Finalize returns the parts to commit, ordered by part number, and their total size.
+// The parts must cover [0, size) without gaps or overlaps, otherwise an error wrapping
+// ErrIncompleteUpload describes the offending range and the uploadable stays open.
+func (uploadable *Uploadable) Finalize(size int64) ([]storage.MultipartUploadPart, int64, error) {
 	uploadable.mtx.Lock()
 	defer uploadable.mtx.Unlock()
 
@@ -101,13 +114,28 @@ func (uploadable *Uploadable) Finalize() ([]storage.MultipartUploadPart, int64,
 		return nil, 0, fmt.Errorf("cannot finalize the uploadable twice")
 	}
 
-	// Mark the uploadable as finalized.
-	uploadable.finalized = true
+	// Parts are appended by concurrent PATCH handlers in no particular order,
+	// but S3 requires them in ascending order when completing the upload.
+	sortedParts := make([]*Part, 0, len(uploadable.parts))
+	for _, part := range uploadable.parts {
+		sortedParts = append(sortedParts, part)
+	}
+	slices.SortFunc(sortedParts, func(a, b *Part) int {
+		return cmp.Compare(a.Number, b.Number)
+	})
 
 	var parts []storage.MultipartUploadPart
 	var partsSize int64
 
-	for _, part := range uploadable.parts {
+	for _, part := range sortedParts {
+		switch {
+		case part.Offset > partsSize:
+			return nil, 0, fmt.Errorf("%w: missing range %d-%d", ErrIncompleteUpload, partsSize, part.Offset-1)
+		case part.Offset < partsSize:
+			return nil, 0, fmt.Errorf("%w: part %d at range %d-%d overlaps the previous part",
+				ErrIncompleteUpload, part.Number, part.Offset, part.Offset+part.Size-1)
+		}
+
 		parts = append(parts, storage.MultipartUploadPart{
 			PartNumber: part.Number,
 			ETag:       part.ETag,
@@ -116,9 +144,16 @@ func (uploadable *Uploadable) Finalize() ([]storage.MultipartUploadPart, int64,
 		partsSize += part.Size
 	}
 
-	slices.SortFunc(parts, func(a, b storage.MultipartUploadPart) int {
-		return cmp.Compare(a.PartNumber, b.PartNumber)
-	})
+	switch {
+	case partsSize < size:
+		return nil, 0, fmt.Errorf("%w: missing range %d-%d", ErrIncompleteUpload, partsSize, size-1)
+	case partsSize > size:
+		return nil, 0, fmt.Errorf("%w: uploaded %d bytes, but the cache entry size is %d bytes",
+			ErrIncompleteUpload, partsSize, size)
+	}
+
+	// Mark the uploadable as finalized.
+	uploadable.finalized = true
 
 	return parts, partsSize, nil
 }
@@ -1,9 +1,20 @@
 package uploadable_test
 
 import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/cirruslabs/omni-cache/internal/protocols/ghacache/uploadable"
+	"github.com/cirruslabs/omni-cache/internal/testutil"
 	"github.com/cirruslabs/omni-cache/pkg/storage"
 	"github.com/stretchr/testify/require"
 )
@@ -11,11 +22,11 @@ import (
 func TestPartsAreOrdered(t *testing.T) {
 	uploadable := uploadable.New("key", "version", "upload-id")
 
-	require.NoError(t, uploadable.AppendPart(2, "etag-2", 42))
-	require.NoError(t, uploadable.AppendPart(1, "etag-1", 12))
-	require.NoError(t, uploadable.AppendPart(3, "etag-3", 46))
+	require.NoError(t, uploadable.AppendPart(2, "etag-2", 12, 42))
+	require.NoError(t, uploadable.AppendPart(1, "etag-1", 0, 12))
+	require.NoError(t, uploadable.AppendPart(3, "etag-3", 54, 46))
 
-	parts, size, err := uploadable.Finalize()
+	parts, size, err := uploadable.Finalize(100)
 	require.NoError(t, err)
 
 	require.Equal(t, []storage.MultipartUploadPart{
@@ -25,3 +36,124 @@ func TestPartsAreOrdered(t *testing.T) {
 	}, parts)
 	require.EqualValues(t, 100, size)
 }
+
+func TestFinalizeDetectsMissingRanges(t *testing.T) {
+	upload := uploadable.New("key", "version", "upload-id")
+
+	require.NoError(t, upload.AppendPart(1, "etag-1", 0, 10))
+	require.NoError(t, upload.AppendPart(3, "etag-3", 20, 10))
+
+	_, _, err := upload.Finalize(30)
+	require.ErrorIs(t, err, uploadable.ErrIncompleteUpload)
+	require.ErrorContains(t, err, "missing range 10-19")
+
+	// The uploadable stays open, so the client can upload the missing part and retry.
+	require.NoError(t, upload.AppendPart(2, "etag-2", 10, 10))
+
+	_, _, err = upload.Finalize(40)
+	require.ErrorContains(t, err, "missing range 30-39")
+
+	parts, size, err := upload.Finalize(30)
+	require.NoError(t, err)
+	require.Len(t, parts, 3)
+	require.EqualValues(t, 30, size)
+}
+
+func TestAppendPartIsIdempotentPerPartNumber(t *testing.T) {
+	upload := uploadable.New("key", "version", "upload-id")
+
+	require.NoError(t, upload.AppendPart(1, "etag-1", 0, 10))
+	require.NoError(t, upload.AppendPart(2, "etag-2-first", 10, 10))
+	// The Toolkit retried the PATCH for the second range.
+	require.NoError(t, upload.AppendPart(2, "etag-2-retry", 10, 10))
+
+	parts, size, err := upload.Finalize(20)
+	require.NoError(t, err)
+	require.Equal(t, []storage.MultipartUploadPart{
+		{PartNumber: 1, ETag: "etag-1"},
+		{PartNumber: 2, ETag: "etag-2-retry"},
+	}, parts)
+	require.EqualValues(t, 20, size)
+
+	require.Error(t, upload.AppendPart(3, "etag-3", 20, 10))
+}
+
+func TestConcurrentlyAppendedPartsCommitInOrder(t *testing.T) {
+	ctx := t.Context()
+	stor := testutil.NewMemoryStorage(t)
+	upload := uploadable.New("key", "version", "upload-id")
+
+	uploadID, err := stor.CreateMultipartUpload(ctx, "key", nil)
+	require.NoError(t, err)
+
+	const numParts = 16
+	const partSize = 8
+
+	var expected bytes.Buffer
+	for number := 1; number <= numParts; number++ {
+		expected.WriteString(strings.Repeat(strconv.Itoa(number%10), partSize))
+	}
+
+	// Upload the parts concurrently, with later parts tending to be appended first,
+	// the way parallel PATCH requests from the Actions Toolkit can finish out of order.
+	errs := make(chan error, numParts)
+	var wg sync.WaitGroup
+	for number := numParts; number >= 1; number-- {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			offset := int64(number-1) * partSize
+			etag, err := uploadPart(ctx, stor, uploadID, uint32(number), expected.Bytes()[offset:offset+partSize])
+			if err == nil {
+				err = upload.AppendPart(uint32(number), etag, offset, partSize)
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	parts, size, err := upload.Finalize(int64(expected.Len()))
+	require.NoError(t, err)
+	require.EqualValues(t, expected.Len(), size)
+	require.True(t, slices.IsSortedFunc(parts, func(a, b storage.MultipartUploadPart) int {
+		return cmp.Compare(a.PartNumber, b.PartNumber)
+	}))
+
+	require.NoError(t, stor.CommitMultipartUpload(ctx, "key", uploadID, parts))
+
+	urls, err := stor.DownloadURLs(ctx, "key")
+	require.NoError(t, err)
+	resp, err := http.Get(urls[0].URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	actual, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, expected.String(), string(actual))
+}
+
+// uploadPart uploads body as the given part and returns its ETag. It doesn't fail the
+// test itself, so that it can run outside of the test goroutine.
+func uploadPart(ctx context.Context, stor storage.MultipartBlobStorageBackend, uploadID string, number uint32, body []byte) (string, error) {
+	partURL, err := stor.UploadPartURL(ctx, "key", uploadID, number, uint64(len(body)))
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, partURL.URL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("uploading part %d returned status %d", number, resp.StatusCode)
+	}
+	return resp.Header.Get("ETag"), nil
+}
@@ -5,12 +5,15 @@ import (
 	"errors"
 	"fmt"
 	"hash/fnv"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"strings"
 
 	"github.com/cirruslabs/omni-cache/internal/api/gharesults"
 	"github.com/cirruslabs/omni-cache/internal/protocols/azureblob"
+	"github.com/cirruslabs/omni-cache/pkg/errdetail"
+	"github.com/cirruslabs/omni-cache/pkg/signedurl"
 	"github.com/cirruslabs/omni-cache/pkg/stats"
 	"github.com/cirruslabs/omni-cache/pkg/storage"
 	"github.com/samber/lo"
@@ -24,13 +27,22 @@ var _ gharesults.CacheService = (*Cache)(nil)
 
 const APIMountPoint = "/twirp"
 
+// EmptyVersionSentinel is the version under which entries are stored when a client omits
+// the cache version. Real versions are hex digests, so it can't collide with them.
+const EmptyVersionSentinel = "unversioned"
+
 type Cache struct {
 	cacheHost   string
 	backend     storage.BlobStorageBackend
 	twirpServer gharesults.TwirpServer
+	keyPrefix   string
+
+	blobURLPrefix      string
+	rejectEmptyVersion bool
+	urlSigner          *signedurl.Signer
 }
 
-func New(cacheHost string, backend storage.BlobStorageBackend) *Cache {
+func New(cacheHost string, backend storage.BlobStorageBackend, opts ...Option) *Cache {
 	if backend == nil {
 		panic("ghacachev2.New: backend is required")
 	}
@@ -39,7 +51,12 @@ func New(cacheHost string, backend storage.BlobStorageBackend) *Cache {
 		backend:   backend,
 	}
 
-	cache.twirpServer = gharesults.NewCacheServiceServer(cache)
+	for _, opt := range opts {
+		opt(cache)
+	}
+
+	cache.twirpServer = gharesults.NewCacheServiceServer(cache,
+		twirp.WithServerInterceptors(errdetail.TwirpInterceptor()))
 
 	return cache
 }
@@ -53,13 +70,17 @@ func (cache *Cache) ServeHTTP(writer http.ResponseWriter, request *http.Request)
 }
 
 func (cache *Cache) GetCacheEntryDownloadURL(ctx context.Context, request *gharesults.GetCacheEntryDownloadURLRequest) (*gharesults.GetCacheEntryDownloadURLResponse, error) {
+	if err := cache.checkVersion(request.Version); err != nil {
+		return nil, err
+	}
+
 	cacheKeyPrefixes := lo.Map(request.RestoreKeys, func(restoreKey string, _ int) string {
-		return httpCacheKey(restoreKey, request.Version)
+		return cache.httpCacheKey(restoreKey, request.Version)
 	})
-	info, err := cache.backend.CacheInfo(ctx, httpCacheKey(request.Key, request.Version), cacheKeyPrefixes)
+	info, err := cache.backend.CacheInfo(ctx, cache.httpCacheKey(request.Key, request.Version), cacheKeyPrefixes)
 	if err != nil {
 		if errors.Is(err, storage.ErrCacheNotFound) {
-			stats.Default().RecordCacheMiss()
+			protocolStats.RecordCacheMiss()
 			return &gharesults.GetCacheEntryDownloadURLResponse{
 				Ok: false,
 			}, nil
@@ -69,22 +90,62 @@ func (cache *Cache) GetCacheEntryDownloadURL(ctx context.Context, request *ghare
 			"about cache entry with key %q and version %q: %v", request.Key, request.Version, err)
 	}
 
-	stats.Default().RecordCacheHit()
+	protocolStats.RecordCacheHit()
 	return &gharesults.GetCacheEntryDownloadURLResponse{
 		Ok:                true,
 		SignedDownloadUrl: cache.azureBlobURL(info.Key, true),
-		MatchedKey:        strings.TrimPrefix(info.Key, httpCacheKey("", request.Version)),
+		MatchedKey:        strings.TrimPrefix(info.Key, cache.httpCacheKey("", request.Version)),
 	}, nil
 }
 
 func (cache *Cache) CreateCacheEntry(ctx context.Context, request *gharesults.CreateCacheEntryRequest) (*gharesults.CreateCacheEntryResponse, error) {
+	if err := cache.checkVersion(request.Version); err != nil {
+		return nil, err
+	}
+
+	// The entry is uploaded through the azure-blob protocol, which asks storage for the
+	// upload itself. Asking here as well rejects namespaces over their storage quota
+	// before the client sends anything; other errors are left for that upload to report.
+	key := cache.httpCacheKey(request.Key, request.Version)
+	if _, err := cache.backend.UploadURL(ctx, key, nil); errors.Is(err, storage.ErrQuotaExceeded) {
+		return nil, twirp.NewErrorf(twirp.ResourceExhausted, "GHA cache v2 failed to create cache entry "+
+			"with key %q and version %q: %v", request.Key, request.Version, err)
+	}
+
 	return &gharesults.CreateCacheEntryResponse{
 		Ok:              true,
-		SignedUploadUrl: cache.azureBlobURL(httpCacheKey(request.Key, request.Version), false),
+		SignedUploadUrl: cache.azureBlobURL(key, false),
 	}, nil
 }
 
+// FinalizeCacheEntryUpload confirms an upload made to the URL from CreateCacheEntry. Large
+// entries arrive as Azure blocks, which the azure-blob protocol stores as parts of a native
+// multipart upload and commits with the block list, so by now the entry must be stored
+// with the size the client reports. Otherwise the upload is reported as failed, which
+// the toolkit surfaces instead of believing the entry was saved.
 func (cache *Cache) FinalizeCacheEntryUpload(ctx context.Context, request *gharesults.FinalizeCacheEntryUploadRequest) (*gharesults.FinalizeCacheEntryUploadResponse, error) {
+	if err := cache.checkVersion(request.Version); err != nil {
+		return nil, err
+	}
+
+	key := cache.httpCacheKey(request.Key, request.Version)
+	info, err := cache.backend.CacheInfo(ctx, key, nil)
+	if err != nil {
+		if errors.Is(err, storage.ErrCacheNotFound) {
+			slog.WarnContext(ctx, "GHA cache v2 finalized an entry that wasn't uploaded",
+				"key", request.Key, "version", request.Version)
+			return &gharesults.FinalizeCacheEntryUploadResponse{Ok: false}, nil
+		}
+
+		return nil, twirp.NewErrorf(twirp.Internal, "GHA cache v2 failed to retrieve information "+
+			"about cache entry with key %q and version %q: %v", request.Key, request.Version, err)
+	}
+	if request.SizeBytes > 0 && info.SizeBytes != request.SizeBytes {
+		slog.WarnContext(ctx, "GHA cache v2 finalized an entry whose stored size differs from the uploaded size",
+			"key", request.Key, "version", request.Version, "size", request.SizeBytes, "stored_size", info.SizeBytes)
+		return &gharesults.FinalizeCacheEntryUploadResponse{Ok: false}, nil
+	}
+
 	hash := fnv.New64a()
 
 	_, _ = hash.Write([]byte(request.Key))
@@ -97,13 +158,25 @@ func (cache *Cache) FinalizeCacheEntryUpload(ctx context.Context, request *ghare
 	}, nil
 }
 
-func httpCacheKey(key string, version string) string {
-	return fmt.Sprintf("%s-%s", version, key)
+func (cache *Cache) checkVersion(version string) error {
+	if version == "" && cache.rejectEmptyVersion {
+		return twirp.RequiredArgumentError("version")
+	}
+	return nil
+}
+
+func (cache *Cache) httpCacheKey(key string, version string) string {
+	if version == "" {
+		version = EmptyVersionSentinel
+	}
+	return fmt.Sprintf("%s%s-%s", cache.keyPrefix, version, key)
 }
 
-func (cache *Cache) azureBlobURL(keyWithVersion string, skipHitMiss bool) string {
-	rawURL := fmt.Sprintf("http://%s%s/%s", cache.cacheHost, azureblob.APIMountPoint, url.PathEscape(keyWithVersion))
-	if !skipHitMiss {
+// azureBlobURL returns the download URL of an entry, or its upload URL when download is
+// false. Downloads skip hit/miss accounting, which the lookup already did.
+func (cache *Cache) azureBlobURL(keyWithVersion string, download bool) string {
+	rawURL := fmt.Sprintf("http://%s%s%s/%s", cache.cacheHost, cache.blobURLPrefix, azureblob.APIMountPoint, url.PathEscape(keyWithVersion))
+	if !download && cache.urlSigner == nil {
 		return rawURL
 	}
 
@@ -111,6 +184,13 @@ func (cache *Cache) azureBlobURL(keyWithVersion string, skipHitMiss bool) string
 	if err != nil {
 		return rawURL
 	}
-	stats.AddSkipHitMissQuery(parsed)
+	method := http.MethodPut
+	if download {
+		stats.AddSkipHitMissQuery(parsed)
+		method = http.MethodGet
+	}
+	if cache.urlSigner != nil {
+		cache.urlSigner.Sign(parsed, method)
+	}
 	return parsed.String()
 }
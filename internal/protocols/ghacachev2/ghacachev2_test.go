@@ -7,6 +7,7 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"sync/atomic"
 	"testing"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
@@ -14,6 +15,7 @@ import (
 	"github.com/cirruslabs/omni-cache/internal/testutil"
 	"github.com/cirruslabs/omni-cache/pkg/protocols/builtin"
 	"github.com/cirruslabs/omni-cache/pkg/server"
+	"github.com/cirruslabs/omni-cache/pkg/storage"
 	"github.com/dustin/go-humanize"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/require"
@@ -181,14 +183,106 @@ func TestGHACacheV2UploadStream(t *testing.T) {
 	}
 }
 
+// commitCountingStorage counts the multipart uploads committed to the wrapped storage.
+type commitCountingStorage struct {
+	storage.MultipartBlobStorageBackend
+	commits atomic.Int64
+}
+
+func (s *commitCountingStorage) CommitMultipartUpload(ctx context.Context, key string, uploadID string, parts []storage.MultipartUploadPart) error {
+	s.commits.Add(1)
+	return s.MultipartBlobStorageBackend.CommitMultipartUpload(ctx, key, uploadID, parts)
+}
+
+func TestGHACacheV2MultipartUploadIsFinalized(t *testing.T) {
+	backend, err := storage.NewFilesystemStorage(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = backend.Close()
+	})
+	counting := &commitCountingStorage{MultipartBlobStorageBackend: backend}
+	client := gharesults.NewCacheServiceJSONClient(startServerWithStorage(t, counting), &http.Client{})
+
+	cacheKey := uuid.NewString()
+	cacheValue := make([]byte, 24*humanize.MiByte)
+	_, err = cryptorand.Read(cacheValue)
+	require.NoError(t, err)
+
+	createCacheEntryRes, err := client.CreateCacheEntry(t.Context(), &gharesults.CreateCacheEntryRequest{
+		Key:     cacheKey,
+		Version: "v1",
+	})
+	require.NoError(t, err)
+	require.True(t, createCacheEntryRes.Ok)
+
+	url, err := azblob.ParseURL(createCacheEntryRes.SignedUploadUrl)
+	require.NoError(t, err)
+	blockBlobClient, err := azblob.NewClientWithNoCredential(url.Scheme+"://"+url.Host+"/_azureblob", nil)
+	require.NoError(t, err)
+
+	// Blocks of at least 5 MiB are stored as parts of a native multipart upload, which
+	// the block list commits.
+	_, err = blockBlobClient.UploadStream(t.Context(), url.ContainerName, url.BlobName, bytes.NewReader(cacheValue),
+		&azblob.UploadStreamOptions{BlockSize: 5 * humanize.MiByte})
+	require.NoError(t, err)
+	require.EqualValues(t, 1, counting.commits.Load())
+
+	finalizeRes, err := client.FinalizeCacheEntryUpload(t.Context(), &gharesults.FinalizeCacheEntryUploadRequest{
+		Key:       cacheKey,
+		Version:   "v1",
+		SizeBytes: int64(len(cacheValue)),
+	})
+	require.NoError(t, err)
+	require.True(t, finalizeRes.Ok)
+	require.NotZero(t, finalizeRes.EntryId)
+
+	getCacheEntryDownloadURLResp, err := client.GetCacheEntryDownloadURL(t.Context(), &gharesults.GetCacheEntryDownloadURLRequest{
+		Key:     cacheKey,
+		Version: "v1",
+	})
+	require.NoError(t, err)
+	require.True(t, getCacheEntryDownloadURLResp.Ok)
+	require.Equal(t, cacheKey, getCacheEntryDownloadURLResp.MatchedKey)
+
+	downloadResp, err := http.Get(getCacheEntryDownloadURLResp.SignedDownloadUrl)
+	require.NoError(t, err)
+	defer downloadResp.Body.Close()
+	require.Equal(t, http.StatusOK, downloadResp.StatusCode)
+	downloaded, err := io.ReadAll(downloadResp.Body)
+	require.NoError(t, err)
+	require.Equal(t, cacheValue, downloaded)
+
+	// Finalizing an entry that wasn't uploaded, or with another size, is reported as failed.
+	finalizeRes, err = client.FinalizeCacheEntryUpload(t.Context(), &gharesults.FinalizeCacheEntryUploadRequest{
+		Key:       uuid.NewString(),
+		Version:   "v1",
+		SizeBytes: 1,
+	})
+	require.NoError(t, err)
+	require.False(t, finalizeRes.Ok)
+
+	finalizeRes, err = client.FinalizeCacheEntryUpload(t.Context(), &gharesults.FinalizeCacheEntryUploadRequest{
+		Key:       cacheKey,
+		Version:   "v1",
+		SizeBytes: int64(len(cacheValue)) + 1,
+	})
+	require.NoError(t, err)
+	require.False(t, finalizeRes.Ok)
+}
+
 func startServer(t *testing.T) string {
 	t.Helper()
 
-	storage := testutil.NewMultipartStorage(t)
+	return startServerWithStorage(t, testutil.NewMultipartStorage(t))
+}
+
+func startServerWithStorage(t *testing.T, backend storage.MultipartBlobStorageBackend) string {
+	t.Helper()
+
 	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	require.NoError(t, err)
 
-	srv, err := server.Start(t.Context(), []net.Listener{listener}, storage, builtin.Factories()...)
+	srv, err := server.Start(t.Context(), []net.Listener{listener}, backend, builtin.Factories()...)
 	require.NoError(t, err)
 	t.Cleanup(func() {
 		_ = srv.Shutdown(context.Background())
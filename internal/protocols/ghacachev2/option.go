@@ -0,0 +1,43 @@
+package ghacachev2
+
+import (
+	"strings"
+
+	"github.com/cirruslabs/omni-cache/pkg/signedurl"
+)
+
+type Option func(cache *Cache)
+
+// WithRejectEmptyVersion makes requests without a cache version fail instead of being
+// stored under the EmptyVersionSentinel version.
+func WithRejectEmptyVersion(reject bool) Option {
+	return func(cache *Cache) {
+		cache.rejectEmptyVersion = reject
+	}
+}
+
+// WithKeyPrefix stores cache entries under the given top-level storage prefix.
+func WithKeyPrefix(prefix string) Option {
+	return func(cache *Cache) {
+		prefix = strings.Trim(prefix, "/")
+		if prefix != "" {
+			prefix += "/"
+		}
+		cache.keyPrefix = prefix
+	}
+}
+
+// WithBlobURLPrefix sets the URL path prefix under which the azure-blob protocol serves
+// the signed URLs that this protocol hands out.
+func WithBlobURLPrefix(prefix string) Option {
+	return func(cache *Cache) {
+		cache.blobURLPrefix = strings.TrimRight(prefix, "/")
+	}
+}
+
+// WithURLSigner signs the URLs that this protocol hands out with signer.
+func WithURLSigner(signer *signedurl.Signer) Option {
+	return func(cache *Cache) {
+		cache.urlSigner = signer
+	}
+}
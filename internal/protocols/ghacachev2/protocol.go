@@ -3,7 +3,9 @@ package ghacachev2
 import (
 	"fmt"
 
+	"github.com/cirruslabs/omni-cache/internal/protocols/azureblob"
 	"github.com/cirruslabs/omni-cache/pkg/protocols"
+	"github.com/cirruslabs/omni-cache/pkg/signedurl"
 	"github.com/cirruslabs/omni-cache/pkg/storage"
 )
 
@@ -13,20 +15,63 @@ import (
 //	POST /twirp/github.actions.results.api.v1.CacheService/CreateCacheEntry
 //	POST /twirp/github.actions.results.api.v1.CacheService/FinalizeCacheEntryUpload
 //	POST /twirp/github.actions.results.api.v1.CacheService/GetCacheEntryDownloadURL
-type Factory struct{}
+type Factory struct {
+	Options Options
+}
+
+// Options configures the gha-cache-v2 protocol.
+type Options struct {
+	// KeyPrefix is the top-level storage prefix for cache entries.
+	// Empty stores entries at the bucket root, as before.
+	KeyPrefix string
+
+	// RejectEmptyVersion fails requests that don't specify a cache version. By default
+	// they are stored under the EmptyVersionSentinel version.
+	RejectEmptyVersion bool
+}
 
 func (Factory) ID() string {
 	return "gha-cache-v2"
 }
 
-func (Factory) New(deps protocols.Dependencies) (protocols.Protocol, error) {
+func (f Factory) Describe() protocols.Description {
+	description := protocols.Description{
+		Summary:           "GitHub Actions cache v2 Twirp API; blobs are served by the azure-blob protocol",
+		HTTPRoutes:        []string{"POST " + APIMountPoint + "/github.actions.results.api.v1.CacheService/"},
+		SharesObjectsWith: []string{azureblob.Factory{}.ID()},
+	}
+	if f.Options.RejectEmptyVersion {
+		description.Features = []string{"reject-empty-version"}
+	}
+	return description
+}
+
+var protocolStats = protocols.Stats(Factory{}.ID())
+
+func (f Factory) New(deps protocols.Dependencies) (protocols.Protocol, error) {
 	deps = deps.WithDefaults()
-	return &protocol{backend: deps.Storage, host: deps.Host}, nil
+
+	// Download and upload URLs point at the azure-blob protocol.
+	blobURLPrefix, ok := deps.MountPrefix(azureblob.Factory{}.ID())
+	if !ok {
+		return nil, fmt.Errorf("gha-cache-v2 requires the azure-blob protocol to be served")
+	}
+
+	return &protocol{
+		backend:       deps.Storage,
+		host:          deps.Host,
+		options:       f.Options,
+		blobURLPrefix: blobURLPrefix,
+		urlSigner:     deps.URLSigner,
+	}, nil
 }
 
 type protocol struct {
-	backend storage.BlobStorageBackend
-	host    string
+	backend       storage.BlobStorageBackend
+	host          string
+	options       Options
+	blobURLPrefix string
+	urlSigner     *signedurl.Signer
 }
 
 func (p *protocol) Register(registrar *protocols.Registrar) error {
@@ -35,7 +80,12 @@ func (p *protocol) Register(registrar *protocols.Registrar) error {
 		return fmt.Errorf("http mux is nil")
 	}
 
-	cache := New(p.host, p.backend)
+	cache := New(p.host, p.backend,
+		WithKeyPrefix(p.options.KeyPrefix),
+		WithRejectEmptyVersion(p.options.RejectEmptyVersion),
+		WithBlobURLPrefix(p.blobURLPrefix),
+		WithURLSigner(p.urlSigner),
+	)
 	mux.Handle("POST "+cache.PathPrefix(), cache)
 	return nil
 }
@@ -1,11 +1,18 @@
 package ghacachev2
 
 import (
+	"context"
+	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/cirruslabs/omni-cache/internal/api/gharesults"
+	"github.com/cirruslabs/omni-cache/pkg/signedurl"
 	"github.com/cirruslabs/omni-cache/pkg/stats"
+	"github.com/cirruslabs/omni-cache/pkg/storage"
 	"github.com/stretchr/testify/require"
+	"github.com/twitchtv/twirp"
 )
 
 func TestAzureBlobURLSkipHitMiss(t *testing.T) {
@@ -19,3 +26,67 @@ func TestAzureBlobURLSkipHitMiss(t *testing.T) {
 	uploadReq := httptest.NewRequest("GET", uploadURL, nil)
 	require.False(t, stats.ShouldSkipHitMiss(uploadReq))
 }
+
+func TestAzureBlobURLSigned(t *testing.T) {
+	signer, err := signedurl.NewSigner([]byte("key"), time.Minute)
+	require.NoError(t, err)
+	cache := &Cache{cacheHost: "cache.local"}
+	WithURLSigner(signer)(cache)
+
+	downloadReq := httptest.NewRequest(http.MethodGet, cache.azureBlobURL("v-key", true), nil)
+	require.True(t, stats.ShouldSkipHitMiss(downloadReq))
+	require.NoError(t, signer.Verify(downloadReq))
+
+	uploadURL := cache.azureBlobURL("v-key", false)
+	require.NoError(t, signer.Verify(httptest.NewRequest(http.MethodPut, uploadURL, nil)))
+	require.ErrorIs(t, signer.Verify(httptest.NewRequest(http.MethodGet, uploadURL, nil)), signedurl.ErrInvalidSignature)
+}
+
+func TestHTTPCacheKeyWithPrefix(t *testing.T) {
+	cache := &Cache{}
+	require.Equal(t, "v-key", cache.httpCacheKey("key", "v"))
+
+	WithKeyPrefix("/gha/")(cache)
+	require.Equal(t, "gha/v-key", cache.httpCacheKey("key", "v"))
+}
+
+func TestEmptyVersion(t *testing.T) {
+	backend, err := storage.NewFilesystemStorage(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = backend.Close()
+	})
+
+	cache := New("cache.local", backend)
+	require.Equal(t, "unversioned-key", cache.httpCacheKey("key", ""))
+
+	_, err = cache.CreateCacheEntry(context.Background(), &gharesults.CreateCacheEntryRequest{Key: "key"})
+	require.NoError(t, err)
+
+	WithRejectEmptyVersion(true)(cache)
+	_, err = cache.CreateCacheEntry(context.Background(), &gharesults.CreateCacheEntryRequest{Key: "key"})
+	var twirpErr twirp.Error
+	require.ErrorAs(t, err, &twirpErr)
+	require.Equal(t, twirp.InvalidArgument, twirpErr.Code())
+
+	_, err = cache.GetCacheEntryDownloadURL(context.Background(), &gharesults.GetCacheEntryDownloadURLRequest{Key: "key"})
+	require.ErrorAs(t, err, &twirpErr)
+}
+
+// overQuotaStorage rejects every upload as over quota.
+type overQuotaStorage struct {
+	storage.BlobStorageBackend
+}
+
+func (overQuotaStorage) UploadURL(context.Context, string, map[string]string) (*storage.URLInfo, error) {
+	return nil, storage.ErrQuotaExceeded
+}
+
+func TestCreateCacheEntryOverQuota(t *testing.T) {
+	cache := New("cache.local", overQuotaStorage{})
+
+	_, err := cache.CreateCacheEntry(context.Background(), &gharesults.CreateCacheEntryRequest{Key: "key", Version: "v"})
+	var twirpErr twirp.Error
+	require.ErrorAs(t, err, &twirpErr)
+	require.Equal(t, twirp.ResourceExhausted, twirpErr.Code())
+}
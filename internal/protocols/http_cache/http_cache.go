@@ -1,10 +1,18 @@
 package http_cache
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
+	"mime"
 	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
 
+	"github.com/cirruslabs/omni-cache/pkg/errdetail"
 	"github.com/cirruslabs/omni-cache/pkg/protocols"
 	"github.com/cirruslabs/omni-cache/pkg/stats"
 	"github.com/cirruslabs/omni-cache/pkg/storage"
@@ -18,23 +26,101 @@ import (
 //	HEAD /{key...} checks whether a cache entry exists.
 //	PUT or POST /{key...} uploads a cache entry.
 //	DELETE /{key...} removes a cache entry.
-type Factory struct{}
+type Factory struct {
+	Options Options
+}
+
+// Options configures the http-cache protocol.
+type Options struct {
+	// FlushPolicy overrides the URL proxy's flush policy for downloads when set.
+	FlushPolicy *urlproxy.FlushPolicy
+
+	// ContentDisposition records a filename when an entry is uploaded and serves it
+	// back as "Content-Disposition: attachment", so that entries fetched in a browser
+	// are saved with a sensible name. The filename comes from the upload's own
+	// Content-Disposition header, falling back to the last key segment.
+	ContentDisposition bool
+
+	// UploadHTTPClient is the client uploads are streamed to storage with. Defaults to
+	// NewUploadHTTPClient.
+	UploadHTTPClient *http.Client
+}
+
+const (
+	uploadIdleConnsPerHost      = 16
+	uploadWriteBufferSize       = 256 * 1024
+	uploadResponseHeaderTimeout = 5 * time.Minute
+)
+
+// NewUploadHTTPClient returns a client tuned for streaming large cache entries to storage.
+// Unlike the client shared by protocols, it has no overall timeout, which would cut off
+// multi-GB uploads over slow links; a stalled upload is instead bounded by the client
+// request's context and by how long storage takes to respond once the body is sent.
+func NewUploadHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = uploadIdleConnsPerHost
+	transport.WriteBufferSize = uploadWriteBufferSize
+	transport.ResponseHeaderTimeout = uploadResponseHeaderTimeout
+	return &http.Client{Transport: transport}
+}
+
+// filenameMetadataKey is the object metadata key holding the path-escaped download filename.
+const filenameMetadataKey = "filename"
 
 func (Factory) ID() string {
 	return "http-cache"
 }
 
-func (Factory) New(deps protocols.Dependencies) (protocols.Protocol, error) {
+func (f Factory) Describe() protocols.Description {
+	description := protocols.Description{
+		Summary: "Generic HTTP cache keyed by URL path",
+		HTTPRoutes: []string{
+			"GET /{key...}",
+			"HEAD /{key...}",
+			"PUT /{key...}",
+			"POST /{key...}",
+			"DELETE /{key...}",
+		},
+	}
+	if f.Options.ContentDisposition {
+		description.Features = []string{"content-disposition"}
+	}
+	return description
+}
+
+var protocolStats = protocols.Stats(Factory{}.ID())
+
+func (f Factory) New(deps protocols.Dependencies) (protocols.Protocol, error) {
 	deps = deps.WithDefaults()
+
+	urlProxy := deps.URLProxy
+	if f.Options.FlushPolicy != nil {
+		urlProxy = urlProxy.With(urlproxy.WithFlushPolicy(*f.Options.FlushPolicy))
+	}
+
+	uploadHTTPClient := f.Options.UploadHTTPClient
+	if uploadHTTPClient == nil {
+		uploadHTTPClient = NewUploadHTTPClient()
+	}
+	if deps.UploadTransport != nil {
+		limited := *uploadHTTPClient
+		limited.Transport = deps.UploadTransport(uploadHTTPClient.Transport)
+		uploadHTTPClient = &limited
+	}
+
 	return &protocol{
-		storageBackend: deps.Storage,
-		urlProxy:       deps.URLProxy,
+		storageBackend:     deps.Storage,
+		urlProxy:           urlProxy,
+		uploadProxy:        urlProxy.With(urlproxy.WithHTTPClient(uploadHTTPClient)),
+		contentDisposition: f.Options.ContentDisposition,
 	}, nil
 }
 
 type protocol struct {
-	urlProxy       *urlproxy.Proxy
-	storageBackend storage.BlobStorageBackend
+	urlProxy           *urlproxy.Proxy
+	uploadProxy        *urlproxy.Proxy
+	storageBackend     storage.BlobStorageBackend
+	contentDisposition bool
 }
 
 func (p *protocol) Register(registrar *protocols.Registrar) error {
@@ -50,6 +136,8 @@ func (p *protocol) Register(registrar *protocols.Registrar) error {
 	return nil
 }
 
+// downloadCache serves GET, and HEAD, which the GET pattern also matches. HEAD is answered
+// from the object metadata alone, so that existence checks never open the object body.
 func (p *protocol) downloadCache(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodHead {
 		p.headCacheEntry(w, r)
@@ -61,7 +149,7 @@ func (p *protocol) downloadCache(w http.ResponseWriter, r *http.Request) {
 	infos, err := p.storageBackend.DownloadURLs(r.Context(), cacheKey)
 	if err != nil {
 		if !stats.ShouldSkipHitMiss(r) && storage.IsNotFoundError(err) {
-			stats.Default().RecordCacheMiss()
+			protocolStats.RecordCacheMiss()
 		}
 		slog.ErrorContext(r.Context(), "cache download failed", "cacheKey", cacheKey, "err", err)
 		w.WriteHeader(http.StatusNotFound)
@@ -70,7 +158,13 @@ func (p *protocol) downloadCache(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if !stats.ShouldSkipHitMiss(r) {
-		stats.Default().RecordCacheHit()
+		protocolStats.RecordCacheHit()
+	}
+	if p.contentDisposition {
+		// Costs an extra metadata lookup, hence opt-in.
+		if info, err := p.storageBackend.CacheInfo(r.Context(), cacheKey, nil); err == nil {
+			setContentDisposition(w, info)
+		}
 	}
 	slog.InfoContext(r.Context(), "redirecting cache download", "cacheKey", cacheKey)
 	p.proxyDownloadFromURLs(w, r, infos)
@@ -78,19 +172,64 @@ func (p *protocol) downloadCache(w http.ResponseWriter, r *http.Request) {
 
 func (p *protocol) proxyDownloadFromURLs(w http.ResponseWriter, r *http.Request, infos []*storage.URLInfo) {
 	for _, info := range infos {
-		if p.urlProxy.ProxyDownloadFromURL(r.Context(), w, info, r.PathValue("key")) {
+		if p.urlProxy.ProxyDownloadFromURL(r.Context(), w, withRangeHeaders(info, r), r.PathValue("key")) {
 			return
 		}
 	}
 	w.WriteHeader(http.StatusNotFound)
 }
 
+// withRangeHeaders returns info with the client's Range and If-Range headers added, so
+// that the backend serves partial downloads and the proxy passes its 206 response through.
+func withRangeHeaders(info *storage.URLInfo, r *http.Request) *storage.URLInfo {
+	rangeHeader := r.Header.Get("Range")
+	if rangeHeader == "" {
+		return info
+	}
+
+	ranged := *info
+	ranged.ExtraHeaders = maps.Clone(info.ExtraHeaders)
+	if ranged.ExtraHeaders == nil {
+		ranged.ExtraHeaders = map[string]string{}
+	}
+	ranged.ExtraHeaders["Range"] = rangeHeader
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" {
+		ranged.ExtraHeaders["If-Range"] = ifRange
+	}
+	return &ranged
+}
+
 func (p *protocol) uploadCacheEntry(w http.ResponseWriter, r *http.Request) {
 	cacheKey := r.PathValue("key")
 
-	info, err := p.storageBackend.UploadURL(r.Context(), cacheKey, nil)
+	var metadata map[string]string
+	if p.contentDisposition {
+		metadata = map[string]string{filenameMetadataKey: url.PathEscape(uploadFilename(r, cacheKey))}
+	}
+
+	info, err := p.storageBackend.UploadURL(r.Context(), cacheKey, metadata)
+	if errors.Is(err, storage.ErrReadOnly) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if errors.Is(err, storage.ErrMetadataTooLarge) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if errors.Is(err, storage.ErrQuotaExceeded) {
+		slog.WarnContext(r.Context(), "rejecting cache upload over quota", "cacheKey", cacheKey, "err", err)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		if _, writeErr := w.Write([]byte(err.Error())); writeErr != nil {
+			slog.DebugContext(r.Context(), "failed to write quota rejection", "cacheKey", cacheKey, "err", writeErr)
+		}
+		return
+	}
 	if err != nil {
-		errorMsg := fmt.Sprintf("Failed to initialized uploading of %s cache! %s", cacheKey, err)
+		errorMsg := errdetail.Message(r.Context(),
+			fmt.Sprintf("Failed to initialized uploading of %s cache! %s", cacheKey, err),
+			fmt.Sprintf("Failed to initialized uploading of %s cache!", cacheKey))
 		slog.ErrorContext(r.Context(), "failed to initialize cache upload", "cacheKey", cacheKey, "err", err)
 
 		w.WriteHeader(http.StatusInternalServerError)
@@ -98,7 +237,8 @@ func (p *protocol) uploadCacheEntry(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	p.urlProxy.ProxyUploadToURL(r.Context(), w, info, urlproxy.UploadResource{
+	// The body is streamed to storage as it arrives, so memory use doesn't grow with its size.
+	p.uploadProxy.ProxyUploadToURL(r.Context(), w, info, urlproxy.UploadResource{
 		Body:          r.Body,
 		ContentLength: r.ContentLength,
 		ResourceName:  cacheKey,
@@ -109,11 +249,11 @@ func (p *protocol) headCacheEntry(w http.ResponseWriter, r *http.Request) {
 	cacheKey := r.PathValue("key")
 	shouldSkipHitMiss := stats.ShouldSkipHitMiss(r)
 
-	_, err := p.storageBackend.CacheInfo(r.Context(), cacheKey, nil)
+	info, err := p.storageBackend.CacheInfo(r.Context(), cacheKey, nil)
 	if err != nil {
 		if storage.IsNotFoundError(err) {
 			if !shouldSkipHitMiss {
-				stats.Default().RecordCacheMiss()
+				protocolStats.RecordCacheMiss()
 			}
 			w.WriteHeader(http.StatusNotFound)
 			return
@@ -127,11 +267,36 @@ func (p *protocol) headCacheEntry(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if !shouldSkipHitMiss {
-		stats.Default().RecordCacheHit()
+		protocolStats.RecordCacheHit()
 	}
+	if p.contentDisposition {
+		setContentDisposition(w, info)
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(info.SizeBytes, 10))
 	w.WriteHeader(http.StatusOK)
 }
 
+// uploadFilename picks the filename to record for an upload of cacheKey.
+func uploadFilename(r *http.Request, cacheKey string) string {
+	if _, params, err := mime.ParseMediaType(r.Header.Get("Content-Disposition")); err == nil {
+		if filename := path.Base(params["filename"]); filename != "." && filename != "/" {
+			return filename
+		}
+	}
+	return path.Base(cacheKey)
+}
+
+func setContentDisposition(w http.ResponseWriter, info *storage.CacheInfo) {
+	filename, err := url.PathUnescape(info.Metadata[filenameMetadataKey])
+	if err != nil || filename == "" {
+		return
+	}
+	if value := mime.FormatMediaType("attachment", map[string]string{"filename": filename}); value != "" {
+		w.Header().Set("Content-Disposition", value)
+	}
+}
+
 func (p *protocol) deleteCacheEntry(w http.ResponseWriter, r *http.Request) {
 	cacheKey := r.PathValue("key")
 
@@ -141,7 +306,27 @@ func (p *protocol) deleteCacheEntry(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Deleting a missing object succeeds on S3, so look the entry up first to report 404.
+	if _, err := p.storageBackend.CacheInfo(r.Context(), cacheKey, nil); err != nil {
+		if errors.Is(err, storage.ErrCacheNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		slog.ErrorContext(r.Context(), "cache delete lookup failed", "cacheKey", cacheKey, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
 	if err := deletableStorage.Delete(r.Context(), cacheKey); err != nil {
+		if errors.Is(err, errors.ErrUnsupported) {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		if errors.Is(err, storage.ErrReadOnly) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(err.Error()))
+			return
+		}
 		slog.ErrorContext(r.Context(), "cache delete failed", "cacheKey", cacheKey, "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
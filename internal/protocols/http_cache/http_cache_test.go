@@ -7,7 +7,10 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"runtime"
 	"strings"
+	"sync/atomic"
 	"testing"
 
 	protohttpcache "github.com/cirruslabs/omni-cache/internal/protocols/http_cache"
@@ -15,6 +18,7 @@ import (
 	"github.com/cirruslabs/omni-cache/pkg/protocols/builtin"
 	"github.com/cirruslabs/omni-cache/pkg/server"
 	"github.com/cirruslabs/omni-cache/pkg/storage"
+	urlproxy "github.com/cirruslabs/omni-cache/pkg/url-proxy"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/require"
 )
@@ -73,6 +77,12 @@ func TestHTTPCache(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, http.StatusNotFound, resp.StatusCode)
 	require.NoError(t, resp.Body.Close())
+
+	// Deleting an absent entry is reported as a miss.
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
 }
 
 func TestHTTPCacheHeadDoesNotRecordDownloads(t *testing.T) {
@@ -241,3 +251,273 @@ func (s headErrorStorage) UploadURL(context.Context, string, map[string]string)
 func (s headErrorStorage) CacheInfo(context.Context, string, []string) (*storage.CacheInfo, error) {
 	return nil, s.cacheInfoErr
 }
+
+func startFilesystemServer(t *testing.T, options protohttpcache.Options) string {
+	t.Helper()
+
+	backend, err := storage.NewFilesystemStorage(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = backend.Close()
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	testServer, err := server.Start(t.Context(), []net.Listener{listener}, backend, protohttpcache.Factory{
+		Options: options,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		testServer.Shutdown(context.Background())
+	})
+	return "http://" + listener.Addr().String()
+}
+
+func TestHTTPCacheDeleteThenGetIsMiss(t *testing.T) {
+	baseURL := startFilesystemServer(t, protohttpcache.Options{})
+	objectURL := baseURL + "/poisoned/entry"
+
+	resp, err := http.Post(objectURL, "application/octet-stream", strings.NewReader("bad artifact"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	deleteReq, err := http.NewRequest(http.MethodDelete, objectURL, nil)
+	require.NoError(t, err)
+	resp, err = http.DefaultClient.Do(deleteReq)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	resp, err = http.Get(objectURL)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	resp, err = http.DefaultClient.Do(deleteReq)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+}
+
+func TestHTTPCacheContentDisposition(t *testing.T) {
+	baseURL := startFilesystemServer(t, protohttpcache.Options{ContentDisposition: true})
+
+	upload := func(key string, contentDisposition string) {
+		req, err := http.NewRequest(http.MethodPut, baseURL+"/"+key, strings.NewReader("artifact"))
+		require.NoError(t, err)
+		if contentDisposition != "" {
+			req.Header.Set("Content-Disposition", contentDisposition)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		require.NoError(t, resp.Body.Close())
+	}
+
+	upload("builds/123/app.tar.gz", "")
+	upload("builds/124/blob", `attachment; filename="../report.html"`)
+
+	resp, err := http.Get(baseURL + "/builds/123/app.tar.gz")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, `attachment; filename=app.tar.gz`, resp.Header.Get("Content-Disposition"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, "artifact", string(body))
+
+	resp, err = http.Head(baseURL + "/builds/124/blob")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, `attachment; filename=report.html`, resp.Header.Get("Content-Disposition"))
+	require.NoError(t, resp.Body.Close())
+}
+
+func TestHTTPCacheRangeRequests(t *testing.T) {
+	baseURL := startFilesystemServer(t, protohttpcache.Options{})
+	objectURL := baseURL + "/ranged/entry"
+	payload := "0123456789abcdef"
+
+	resp, err := http.Post(objectURL, "application/octet-stream", strings.NewReader(payload))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	req, err := http.NewRequest(http.MethodGet, objectURL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Range", "bytes=4-9")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	require.Equal(t, "456789", string(body))
+	require.Equal(t, "bytes 4-9/16", resp.Header.Get("Content-Range"))
+	require.EqualValues(t, 6, resp.ContentLength)
+
+	// A stale If-Range validator gets the whole object instead of the range.
+	req.Header.Set("If-Range", `"stale"`)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, payload, string(body))
+
+	resp, err = http.Head(objectURL)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.EqualValues(t, len(payload), resp.ContentLength)
+	require.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+}
+
+func TestHTTPCacheRangeRequestOnCompressedEntry(t *testing.T) {
+	backend, err := storage.NewFilesystemStorage(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = backend.Close()
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	testServer, err := server.Start(t.Context(), []net.Listener{listener}, backend, protohttpcache.Factory{})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		testServer.Shutdown(context.Background())
+	})
+
+	// Entries stored by a proxy with compression enabled are zstd-encoded in storage.
+	payload := strings.Repeat("0123456789abcdef", 64)
+	uploadURL, err := backend.UploadURL(t.Context(), "compressed/entry", nil)
+	require.NoError(t, err)
+	compressing := urlproxy.NewProxy(urlproxy.WithCompression(urlproxy.CompressionZstd))
+	require.NoError(t, compressing.UploadFromReader(t.Context(), uploadURL, "compressed/entry", strings.NewReader(payload), int64(len(payload))))
+
+	// The stored range would be of compressed bytes, so the whole decoded entry is served.
+	req, err := http.NewRequest(http.MethodGet, "http://"+listener.Addr().String()+"/compressed/entry", nil)
+	require.NoError(t, err)
+	req.Header.Set("Range", "bytes=4-9")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, payload, string(body))
+	require.Empty(t, resp.Header.Get("Content-Range"))
+	require.Empty(t, resp.Header.Get("Accept-Ranges"))
+}
+
+// metadataOnlyStorage knows about every object but counts attempts to download one.
+type metadataOnlyStorage struct {
+	downloads atomic.Int64
+}
+
+func (s *metadataOnlyStorage) DownloadURLs(context.Context, string) ([]*storage.URLInfo, error) {
+	s.downloads.Add(1)
+	return nil, errors.New("unexpected download")
+}
+
+func (s *metadataOnlyStorage) UploadURL(context.Context, string, map[string]string) (*storage.URLInfo, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (s *metadataOnlyStorage) CacheInfo(_ context.Context, key string, _ []string) (*storage.CacheInfo, error) {
+	return &storage.CacheInfo{Key: key, SizeBytes: 1234}, nil
+}
+
+func TestHTTPCacheHeadAnswersFromMetadataWithoutDownloading(t *testing.T) {
+	backend := &metadataOnlyStorage{}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	testServer, err := server.Start(t.Context(), []net.Listener{listener}, backend, protohttpcache.Factory{})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		testServer.Shutdown(context.Background())
+	})
+
+	req, err := http.NewRequest(http.MethodHead, "http://"+listener.Addr().String()+"/cache/large-artifact", nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.EqualValues(t, 1234, resp.ContentLength)
+	require.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+	require.Zero(t, backend.downloads.Load(), "HEAD must not open the object through its download URLs")
+}
+
+// discardingUploadStorage hands out upload URLs of a server that counts and discards the
+// bytes it receives.
+type discardingUploadStorage struct {
+	uploadURL string
+}
+
+func (s discardingUploadStorage) DownloadURLs(context.Context, string) ([]*storage.URLInfo, error) {
+	return nil, storage.ErrCacheNotFound
+}
+
+func (s discardingUploadStorage) UploadURL(context.Context, string, map[string]string) (*storage.URLInfo, error) {
+	return &storage.URLInfo{URL: s.uploadURL}, nil
+}
+
+func (s discardingUploadStorage) CacheInfo(context.Context, string, []string) (*storage.CacheInfo, error) {
+	return nil, storage.ErrCacheNotFound
+}
+
+// zeroReader produces zeros without allocating.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestHTTPCacheUploadStreamsWithBoundedMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("uploads 256 MiB")
+	}
+	const size = 256 << 20
+
+	var received atomic.Int64
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+		received.Add(n)
+	}))
+	t.Cleanup(target.Close)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	testServer, err := server.Start(t.Context(), []net.Listener{listener},
+		discardingUploadStorage{uploadURL: target.URL + "/object"}, protohttpcache.Factory{})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		testServer.Shutdown(context.Background())
+	})
+
+	req, err := http.NewRequest(http.MethodPut, "http://"+listener.Addr().String()+"/large-artifact",
+		io.LimitReader(zeroReader{}, size))
+	require.NoError(t, err)
+	req.ContentLength = size
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	runtime.ReadMemStats(&after)
+
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.EqualValues(t, size, received.Load())
+	// Everything the client, the protocol and the target allocated, which would include
+	// the whole body at least once if it were buffered anywhere.
+	allocated := after.TotalAlloc - before.TotalAlloc
+	require.Less(t, allocated, uint64(size/8), "uploading %d bytes allocated %d bytes", size, allocated)
+}
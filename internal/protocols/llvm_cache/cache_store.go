@@ -5,64 +5,111 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"strings"
 
-	"github.com/cirruslabs/omni-cache/pkg/stats"
 	"github.com/cirruslabs/omni-cache/pkg/storage"
 	urlproxy "github.com/cirruslabs/omni-cache/pkg/url-proxy"
 )
 
 type cacheStore struct {
-	backend storage.BlobStorageBackend
-	proxy   *urlproxy.Proxy
+	backend   storage.BlobStorageBackend
+	proxy     *urlproxy.Proxy
+	keyPrefix string
+	// existingObjects decides whether content-addressed objects that are already stored
+	// are uploaded again.
+	existingObjects storage.ExistingObjectPolicy
 }
 
-func newCacheStore(backend storage.BlobStorageBackend, proxy *urlproxy.Proxy) *cacheStore {
+func newCacheStore(backend storage.BlobStorageBackend, proxy *urlproxy.Proxy, keyPrefix string) *cacheStore {
+	keyPrefix = strings.Trim(keyPrefix, "/")
+	if keyPrefix == "" {
+		keyPrefix = DefaultKeyPrefix
+	}
 	return &cacheStore{
-		backend: backend,
-		proxy:   proxy,
+		backend:   backend,
+		proxy:     proxy,
+		keyPrefix: keyPrefix,
 	}
 }
 
 func (s *cacheStore) download(ctx context.Context, key string) ([]byte, error) {
+	if _, err := s.lookup(ctx, key); err != nil {
+		return nil, err
+	}
+	return s.read(ctx, key)
+}
+
+// lookup returns the info of the object stored at key, counting a cache hit or miss.
+func (s *cacheStore) lookup(ctx context.Context, key string) (*storage.CacheInfo, error) {
 	if s.backend == nil {
 		return nil, fmt.Errorf("storage backend is nil")
 	}
 
 	// Pre-flight CacheInfo to surface ErrCacheNotFound consistently across backends.
-	if _, err := s.backend.CacheInfo(ctx, key, nil); err != nil {
+	info, err := s.backend.CacheInfo(ctx, key, nil)
+	if err != nil {
 		if errors.Is(err, storage.ErrCacheNotFound) {
-			stats.Default().RecordCacheMiss()
+			protocolStats.RecordCacheMiss()
 			return nil, storage.ErrCacheNotFound
 		}
 		return nil, err
 	}
-	stats.Default().RecordCacheHit()
+	protocolStats.RecordCacheHit()
+	return info, nil
+}
 
-	infos, err := s.backend.DownloadURLs(ctx, key)
+// read downloads the object stored at key, without the lookup and stats of download.
+func (s *cacheStore) read(ctx context.Context, key string) ([]byte, error) {
+	var buffer bytes.Buffer
+	err := s.readTo(ctx, key, func() (io.Writer, error) {
+		buffer.Reset()
+		return &buffer, nil
+	})
 	if err != nil {
 		return nil, err
 	}
+	return buffer.Bytes(), nil
+}
+
+// readTo streams the object stored at key into the writer returned by open, trying each
+// download URL in turn. open is called before every attempt, so that it can discard what
+// a failed attempt wrote.
+func (s *cacheStore) readTo(ctx context.Context, key string, open func() (io.Writer, error)) error {
+	infos, err := s.backend.DownloadURLs(ctx, key)
+	if err != nil {
+		return err
+	}
 	if len(infos) == 0 {
-		return nil, fmt.Errorf("no download URLs returned")
+		return fmt.Errorf("no download URLs returned")
 	}
 
 	var lastErr error
 	for _, info := range infos {
-		var buffer bytes.Buffer
-		if err := s.proxy.DownloadToWriter(ctx, info, key, &buffer); err == nil {
-			return buffer.Bytes(), nil
+		w, err := open()
+		if err != nil {
+			return err
+		}
+		if err := s.proxy.DownloadToWriter(ctx, info, key, w); err == nil {
+			return nil
 		} else {
 			lastErr = err
 		}
 	}
 
 	if lastErr != nil {
-		return nil, lastErr
+		return lastErr
 	}
-	return nil, fmt.Errorf("download failed")
+	return fmt.Errorf("download failed")
 }
 
 func (s *cacheStore) upload(ctx context.Context, key string, data []byte) error {
+	return s.uploadFrom(ctx, key, bytes.NewReader(data), int64(len(data)))
+}
+
+// uploadFrom streams size bytes from body to the object stored at key.
+func (s *cacheStore) uploadFrom(ctx context.Context, key string, body io.Reader, size int64) error {
 	if s.backend == nil {
 		return fmt.Errorf("storage backend is nil")
 	}
@@ -70,5 +117,24 @@ func (s *cacheStore) upload(ctx context.Context, key string, data []byte) error
 	if err != nil {
 		return err
 	}
-	return s.proxy.UploadFromReader(ctx, info, key, bytes.NewReader(data), int64(len(data)))
+	return s.proxy.UploadFromReader(ctx, info, key, body, size)
+}
+
+// uploadContentAddressed uploads size bytes from body to a key derived from their
+// content, honoring the configured policy for objects that are already stored.
+func (s *cacheStore) uploadContentAddressed(ctx context.Context, key string, body io.Reader, size int64) error {
+	if s.backend == nil {
+		return fmt.Errorf("storage backend is nil")
+	}
+	skip, err := s.existingObjects.SkipUpload(ctx, s.backend, key, size)
+	if errors.Is(err, storage.ErrExistingSizeMismatch) {
+		return err
+	}
+	if err != nil {
+		// The lookup only saves an upload, so uploading is still worth a try.
+		slog.WarnContext(ctx, "failed to check for an existing LLVM CAS object, uploading it", "key", key, "err", err)
+	} else if skip {
+		return nil
+	}
+	return s.uploadFrom(ctx, key, body, size)
 }
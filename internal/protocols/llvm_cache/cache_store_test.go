@@ -0,0 +1,89 @@
+package llvm_cache
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	casv1 "github.com/cirruslabs/omni-cache/internal/api/compilation_cache_service/cas/v1"
+	keyvaluev1 "github.com/cirruslabs/omni-cache/internal/api/compilation_cache_service/keyvalue/v1"
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+	urlproxy "github.com/cirruslabs/omni-cache/pkg/url-proxy"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCASSaveOverwritesExistingObjectsByDefault(t *testing.T) {
+	service, backend := newCountingCASService(t)
+	service.store.existingObjects = Options{}.existingObjects()
+	close(backend.release)
+
+	// Uploading again refreshes the object, which garbage collection relies on.
+	for range 2 {
+		resp, err := service.Save(t.Context(), saveRequest([]byte("immutable")))
+		require.NoError(t, err)
+		require.Nil(t, resp.GetError())
+	}
+	require.EqualValues(t, 2, backend.uploads.Load())
+}
+
+func TestCASSaveSkipsExistingObjects(t *testing.T) {
+	service, backend := newCountingCASService(t)
+	service.store.existingObjects = storage.SkipExisting
+	close(backend.release)
+
+	first, err := service.Save(t.Context(), saveRequest([]byte("immutable")))
+	require.NoError(t, err)
+	require.Nil(t, first.GetError())
+	require.EqualValues(t, 1, backend.uploads.Load())
+
+	second, err := service.Save(t.Context(), saveRequest([]byte("immutable")))
+	require.NoError(t, err)
+	require.Nil(t, second.GetError())
+	require.Equal(t, first.GetCasId().GetId(), second.GetCasId().GetId())
+	require.EqualValues(t, 1, backend.uploads.Load())
+}
+
+func TestCASSaveUploadsWhenExistenceCheckFails(t *testing.T) {
+	service, backend := newCountingCASService(t)
+	service.store.existingObjects = storage.SkipExisting
+	close(backend.release)
+	backend.infoErr = errors.New("backend unavailable")
+
+	resp, err := service.Save(t.Context(), saveRequest([]byte("immutable")))
+	require.NoError(t, err)
+	require.Nil(t, resp.GetError())
+	require.EqualValues(t, 1, backend.uploads.Load())
+}
+
+func TestCacheStoreKeyPrefixSlashesAreTrimmed(t *testing.T) {
+	require.Equal(t, "llvm/cas/digest", casStorageKey(newCacheStore(nil, nil, "/llvm/").keyPrefix, "digest"))
+	require.Equal(t, DefaultKeyPrefix, newCacheStore(nil, nil, "/").keyPrefix)
+}
+
+// overQuotaStorage rejects every upload as over quota.
+type overQuotaStorage struct {
+	storage.BlobStorageBackend
+}
+
+func (overQuotaStorage) UploadURL(context.Context, string, map[string]string) (*storage.URLInfo, error) {
+	return nil, storage.ErrQuotaExceeded
+}
+
+func TestUploadsOverQuotaAreResourceExhausted(t *testing.T) {
+	store := newCacheStore(overQuotaStorage{}, urlproxy.NewProxy(), "")
+	cas := newCASService(store, 0)
+	kv := newKVService(store)
+
+	_, err := cas.Save(t.Context(), saveRequest([]byte("object")))
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	_, err = cas.Put(t.Context(), &casv1.CASPutRequest{Data: &casv1.CASObject{
+		Blob: &casv1.CASBytes{Contents: &casv1.CASBytes_Data{Data: []byte("object")}},
+	}})
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	_, err = kv.PutValue(t.Context(), &keyvaluev1.PutValueRequest{Key: []byte("key")})
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
@@ -1,33 +1,41 @@
 package llvm_cache
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"os"
 	"strings"
 
 	casv1 "github.com/cirruslabs/omni-cache/internal/api/compilation_cache_service/cas/v1"
+	"github.com/cirruslabs/omni-cache/internal/digestfn"
 	"github.com/cirruslabs/omni-cache/pkg/storage"
-	"github.com/zeebo/blake3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 )
 
 const (
-	casPrefix    = "llvm-cache/cas/"
 	casIDPrefix  = "llvmcas://"
-	casHashBytes = 32
+	casHashBytes = digestfn.BLAKE3Size
 )
 
 type casService struct {
 	casv1.UnimplementedCASDBServiceServer
 	store *cacheStore
+	// maxInlineBlobBytes limits blobs sent inline to Put and Save; non-positive means no limit.
+	maxInlineBlobBytes int64
+	// uploads collapses concurrent Put and Save calls for the same object into one upload.
+	uploads *uploadGroup
 }
 
-func newCASService(store *cacheStore) *casService {
-	return &casService{store: store}
+func newCASService(store *cacheStore, maxInlineBlobBytes int64) *casService {
+	return &casService{store: store, maxInlineBlobBytes: maxInlineBlobBytes, uploads: newUploadGroup(sharedUploadTimeout)}
 }
 
 func (s *casService) Get(ctx context.Context, req *casv1.CASGetRequest) (*casv1.CASGetResponse, error) {
@@ -41,7 +49,7 @@ func (s *casService) Get(ctx context.Context, req *casv1.CASGetRequest) (*casv1.
 		return casGetError(err), nil
 	}
 
-	obj, err := s.loadCASObject(ctx, hex.EncodeToString(digest))
+	blob, refs, err := s.loadCASObject(ctx, hex.EncodeToString(digest), req.GetWriteToDisk())
 	if err != nil {
 		if errors.Is(err, storage.ErrCacheNotFound) {
 			return &casv1.CASGetResponse{Outcome: casv1.CASGetResponse_OBJECT_NOT_FOUND}, nil
@@ -49,21 +57,11 @@ func (s *casService) Get(ctx context.Context, req *casv1.CASGetRequest) (*casv1.
 		return casGetError(err), nil
 	}
 
-	blobData, err := casBlobData(obj.GetBlob())
-	if err != nil {
-		return casGetError(err), nil
-	}
-
-	blob, err := casBytesForResponse(blobData, req.GetWriteToDisk())
-	if err != nil {
-		return casGetError(err), nil
-	}
-
 	return &casv1.CASGetResponse{
 		Outcome: casv1.CASGetResponse_SUCCESS,
 		Contents: &casv1.CASGetResponse_Data{Data: &casv1.CASObject{
 			Blob:       blob,
-			References: obj.GetReferences(),
+			References: refs,
 		}},
 	}, nil
 }
@@ -73,9 +71,7 @@ func (s *casService) Put(ctx context.Context, req *casv1.CASPutRequest) (*casv1.
 	if obj == nil {
 		return casPutError(fmt.Errorf("missing object data")), nil
 	}
-
-	blobData, err := casBlobData(obj.GetBlob())
-	if err != nil {
+	if err := s.checkInlineBlob(obj.GetBlob()); err != nil {
 		return casPutError(err), nil
 	}
 
@@ -84,22 +80,11 @@ func (s *casService) Put(ctx context.Context, req *casv1.CASPutRequest) (*casv1.
 		return casPutError(err), nil
 	}
 
-	digest, err := hashObject(refDigests, blobData)
+	casID, err := s.storeCASObject(ctx, obj.GetBlob(), refDigests, normalizedRefs)
 	if err != nil {
-		return casPutError(err), nil
-	}
-
-	casID := casIDFromDigest(digest[:])
-	stored := &casv1.CASObject{
-		Blob:       &casv1.CASBytes{Contents: &casv1.CASBytes_Data{Data: blobData}},
-		References: normalizedRefs,
-	}
-	payload, err := proto.Marshal(stored)
-	if err != nil {
-		return casPutError(err), nil
-	}
-
-	if err := s.store.upload(ctx, casStorageKey(hex.EncodeToString(digest[:])), payload); err != nil {
+		if statusErr := quotaStatus(err); statusErr != nil {
+			return nil, statusErr
+		}
 		return casPutError(err), nil
 	}
 
@@ -117,7 +102,7 @@ func (s *casService) Load(ctx context.Context, req *casv1.CASLoadRequest) (*casv
 		return casLoadError(err), nil
 	}
 
-	obj, err := s.loadCASObject(ctx, hex.EncodeToString(digest))
+	blob, _, err := s.loadCASObject(ctx, hex.EncodeToString(digest), req.GetWriteToDisk())
 	if err != nil {
 		if errors.Is(err, storage.ErrCacheNotFound) {
 			return &casv1.CASLoadResponse{Outcome: casv1.CASLoadResponse_OBJECT_NOT_FOUND}, nil
@@ -125,16 +110,6 @@ func (s *casService) Load(ctx context.Context, req *casv1.CASLoadRequest) (*casv
 		return casLoadError(err), nil
 	}
 
-	blobData, err := casBlobData(obj.GetBlob())
-	if err != nil {
-		return casLoadError(err), nil
-	}
-
-	blob, err := casBytesForResponse(blobData, req.GetWriteToDisk())
-	if err != nil {
-		return casLoadError(err), nil
-	}
-
 	return &casv1.CASLoadResponse{
 		Outcome:  casv1.CASLoadResponse_SUCCESS,
 		Contents: &casv1.CASLoadResponse_Data{Data: &casv1.CASBlob{Blob: blob}},
@@ -146,48 +121,190 @@ func (s *casService) Save(ctx context.Context, req *casv1.CASSaveRequest) (*casv
 	if data == nil {
 		return casSaveError(fmt.Errorf("missing CAS blob")), nil
 	}
+	if err := s.checkInlineBlob(data.GetBlob()); err != nil {
+		return casSaveError(err), nil
+	}
 
-	blobData, err := casBlobData(data.GetBlob())
+	casID, err := s.storeCASObject(ctx, data.GetBlob(), nil, nil)
 	if err != nil {
+		if statusErr := quotaStatus(err); statusErr != nil {
+			return nil, statusErr
+		}
 		return casSaveError(err), nil
 	}
 
-	digest, err := hashObject(nil, blobData)
+	return &casv1.CASSaveResponse{Contents: &casv1.CASSaveResponse_CasId{CasId: &casv1.CASDataID{Id: []byte(casID)}}}, nil
+}
+
+// checkInlineBlob rejects inline blobs over the configured limit before they are hashed
+// and copied into the stored object.
+func (s *casService) checkInlineBlob(blob *casv1.CASBytes) error {
+	if s.maxInlineBlobBytes <= 0 {
+		return nil
+	}
+	if size := int64(len(blob.GetData())); size > s.maxInlineBlobBytes {
+		return fmt.Errorf("inline CAS blob of %d bytes exceeds the limit of %d bytes; send it as a file path instead",
+			size, s.maxInlineBlobBytes)
+	}
+	return nil
+}
+
+// storeCASObject uploads the object made of blob and refs, returning its CAS id. Blobs
+// passed as file paths over streamBlobThreshold are streamed from the file.
+func (s *casService) storeCASObject(ctx context.Context, blob *casv1.CASBytes, refDigests [][]byte, refs []*casv1.CASDataID) (string, error) {
+	if path := blob.GetFilePath(); path != "" {
+		if stat, err := os.Stat(path); err == nil && stat.Size() > streamBlobThreshold {
+			return s.storeCASObjectFromFile(ctx, path, refDigests, refs)
+		}
+	}
+
+	blobData, err := casBlobData(blob)
 	if err != nil {
-		return casSaveError(err), nil
+		return "", err
+	}
+
+	digest, err := hashObject(refDigests, blobData)
+	if err != nil {
+		return "", err
 	}
 
-	casID := casIDFromDigest(digest[:])
 	stored := &casv1.CASObject{
-		Blob: &casv1.CASBytes{Contents: &casv1.CASBytes_Data{Data: blobData}},
+		Blob:       &casv1.CASBytes{Contents: &casv1.CASBytes_Data{Data: blobData}},
+		References: refs,
 	}
 	payload, err := proto.Marshal(stored)
 	if err != nil {
-		return casSaveError(err), nil
+		return "", err
 	}
 
-	if err := s.store.upload(ctx, casStorageKey(hex.EncodeToString(digest[:])), payload); err != nil {
-		return casSaveError(err), nil
+	key := casStorageKey(s.store.keyPrefix, hex.EncodeToString(digest[:]))
+	err = s.uploads.do(ctx, key, func(ctx context.Context) error {
+		return s.store.uploadContentAddressed(ctx, key, bytes.NewReader(payload), int64(len(payload)))
+	})
+	if err != nil {
+		return "", err
 	}
+	return casIDFromDigest(digest[:]), nil
+}
 
-	return &casv1.CASSaveResponse{Contents: &casv1.CASSaveResponse_CasId{CasId: &casv1.CASDataID{Id: []byte(casID)}}}, nil
+// storeCASObjectFromFile hashes the blob at path and then streams it into the stored
+// object between casObjectHeader and casObjectReferences.
+func (s *casService) storeCASObjectFromFile(ctx context.Context, path string, refDigests [][]byte, refs []*casv1.CASDataID) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return "", err
+	}
+	size := stat.Size()
+	digest, err := hashObjectFrom(refDigests, file, size)
+	file.Close()
+	if err != nil {
+		return "", err
+	}
+
+	key := casStorageKey(s.store.keyPrefix, hex.EncodeToString(digest[:]))
+	err = s.uploads.do(ctx, key, func(ctx context.Context) error {
+		// The upload may outlive this call, so it reads its own handle of the file. The
+		// client may have changed the file since it was hashed, so the data is hashed
+		// again on the way to storage.
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		blob, err := newVerifyingReader(file, refDigests, size, digest)
+		if err != nil {
+			return err
+		}
+		header := casObjectHeader(size)
+		trailer, err := casObjectReferences(refs)
+		if err != nil {
+			return err
+		}
+		body := io.MultiReader(bytes.NewReader(header), blob, bytes.NewReader(trailer))
+		return s.store.uploadContentAddressed(ctx, key, body, int64(len(header))+size+int64(len(trailer)))
+	})
+	if err != nil {
+		return "", err
+	}
+	return casIDFromDigest(digest[:]), nil
 }
 
-func (s *casService) loadCASObject(ctx context.Context, digestHex string) (*casv1.CASObject, error) {
-	data, err := s.store.download(ctx, casStorageKey(digestHex))
+// loadCASObject returns the blob and references of the stored object, with the blob
+// written to a temp file when writeToDisk is set. Objects over streamBlobThreshold are
+// then streamed to the file instead of being held in memory.
+func (s *casService) loadCASObject(ctx context.Context, digestHex string, writeToDisk bool) (*casv1.CASBytes, []*casv1.CASDataID, error) {
+	key := casStorageKey(s.store.keyPrefix, digestHex)
+	info, err := s.store.lookup(ctx, key)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if writeToDisk && info.SizeBytes > streamBlobThreshold {
+		return s.loadCASObjectToFile(ctx, key)
+	}
+
+	data, err := s.store.read(ctx, key)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	var obj casv1.CASObject
 	if err := proto.Unmarshal(data, &obj); err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	blobData, err := casBlobData(obj.GetBlob())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	blob, err := casBytesForResponse(blobData, writeToDisk)
+	if err != nil {
+		return nil, nil, err
+	}
+	return blob, obj.GetReferences(), nil
+}
+
+// loadCASObjectToFile streams the blob of the object stored at key to a temp file.
+func (s *casService) loadCASObjectToFile(ctx context.Context, key string) (*casv1.CASBytes, []*casv1.CASDataID, error) {
+	file, err := os.CreateTemp("", "omni-cache-*.blob")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var decoder *casObjectWriter
+	err = s.store.readTo(ctx, key, func() (io.Writer, error) {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if err := file.Truncate(0); err != nil {
+			return nil, err
+		}
+		decoder = newCASObjectWriter(file)
+		return decoder, nil
+	})
+
+	var refs []*casv1.CASDataID
+	if err == nil {
+		refs, err = decoder.finish()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return nil, nil, err
 	}
-	return &obj, nil
+	return &casv1.CASBytes{Contents: &casv1.CASBytes_FilePath{FilePath: file.Name()}}, refs, nil
 }
 
-func casStorageKey(digestHex string) string {
-	return casPrefix + digestHex
+func casStorageKey(keyPrefix string, digestHex string) string {
+	return keyPrefix + "/cas/" + digestHex
 }
 
 func parseCASID(raw []byte) ([]byte, string, error) {
@@ -247,14 +364,36 @@ func normalizeRefs(refs []*casv1.CASDataID) ([][]byte, []*casv1.CASDataID, error
 }
 
 func hashObject(refDigests [][]byte, data []byte) ([casHashBytes]byte, error) {
+	return hashObjectFrom(refDigests, bytes.NewReader(data), int64(len(data)))
+}
+
+// hashObjectFrom is hashObject for size bytes of data read from r.
+func hashObjectFrom(refDigests [][]byte, r io.Reader, size int64) ([casHashBytes]byte, error) {
+	hasher, err := newObjectHasher(refDigests, size)
+	if err != nil {
+		return [casHashBytes]byte{}, err
+	}
+	if _, err := io.CopyN(hasher, r, size); err != nil {
+		return [casHashBytes]byte{}, err
+	}
+
+	sum := hasher.Sum(nil)
+	var digest [casHashBytes]byte
+	copy(digest[:], sum)
+	return digest, nil
+}
+
+// newObjectHasher returns a hash that yields the digest of the object made of refDigests
+// and size bytes of data once the data is written to it.
+func newObjectHasher(refDigests [][]byte, size int64) (hash.Hash, error) {
 	for _, ref := range refDigests {
 		if len(ref) != casHashBytes {
-			return [casHashBytes]byte{}, fmt.Errorf("invalid reference size")
+			return nil, fmt.Errorf("invalid reference size")
 		}
 	}
 
 	// Match LLVM's CAS hashing: BLAKE3 over ref count, refs, data length, then data (all little-endian).
-	hasher := blake3.New()
+	hasher := digestfn.BLAKE3.New()
 	var sizeBuf [8]byte
 	binary.LittleEndian.PutUint64(sizeBuf[:], uint64(len(refDigests)))
 	_, _ = hasher.Write(sizeBuf[:])
@@ -263,14 +402,9 @@ func hashObject(refDigests [][]byte, data []byte) ([casHashBytes]byte, error) {
 		_, _ = hasher.Write(ref)
 	}
 
-	binary.LittleEndian.PutUint64(sizeBuf[:], uint64(len(data)))
+	binary.LittleEndian.PutUint64(sizeBuf[:], uint64(size))
 	_, _ = hasher.Write(sizeBuf[:])
-	_, _ = hasher.Write(data)
-
-	sum := hasher.Sum(nil)
-	var digest [casHashBytes]byte
-	copy(digest[:], sum)
-	return digest, nil
+	return hasher, nil
 }
 
 func casBlobData(blob *casv1.CASBytes) ([]byte, error) {
@@ -322,6 +456,15 @@ func writeTempBlob(data []byte) (string, error) {
 	return name, nil
 }
 
+// quotaStatus returns a ResourceExhausted status for uploads rejected by a storage quota,
+// so that clients can tell them apart from failed requests, and nil for other errors.
+func quotaStatus(err error) error {
+	if errors.Is(err, storage.ErrQuotaExceeded) {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	return nil
+}
+
 func casGetError(err error) *casv1.CASGetResponse {
 	return &casv1.CASGetResponse{
 		Outcome:  casv1.CASGetResponse_ERROR,
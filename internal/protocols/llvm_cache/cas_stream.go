@@ -0,0 +1,211 @@
+package llvm_cache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	casv1 "github.com/cirruslabs/omni-cache/internal/api/compilation_cache_service/cas/v1"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// streamBlobThreshold is the blob size above which blobs passed as file paths are
+// streamed between the file and storage instead of being held in memory.
+const streamBlobThreshold = 1 << 20
+
+// errBlobChanged is returned when a blob streamed from a file no longer matches the
+// digest it was stored under.
+var errBlobChanged = errors.New("blob file changed while it was uploaded")
+
+// verifyingReader reads size bytes of blob data from r, hashing them into the digest of
+// their object. It holds back the last bytes read and fails instead when the data turns
+// out not to match digest or size, so a mismatching object never completes its upload.
+type verifyingReader struct {
+	r         io.Reader
+	hasher    hash.Hash
+	remaining int64
+	digest    [casHashBytes]byte
+}
+
+func newVerifyingReader(r io.Reader, refDigests [][]byte, size int64, digest [casHashBytes]byte) (*verifyingReader, error) {
+	hasher, err := newObjectHasher(refDigests, size)
+	if err != nil {
+		return nil, err
+	}
+	return &verifyingReader{r: r, hasher: hasher, remaining: size, digest: digest}, nil
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	if v.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > v.remaining {
+		p = p[:v.remaining]
+	}
+
+	n, err := v.r.Read(p)
+	_, _ = v.hasher.Write(p[:n])
+	v.remaining -= int64(n)
+	if v.remaining == 0 {
+		if !bytes.Equal(v.hasher.Sum(nil), v.digest[:]) {
+			return 0, errBlobChanged
+		}
+		return n, nil
+	}
+	if err == io.EOF {
+		return 0, fmt.Errorf("%w: %w", errBlobChanged, io.ErrUnexpectedEOF)
+	}
+	return n, err
+}
+
+// Field numbers of CASObject.blob and CASBytes.data.
+const (
+	casObjectBlobField protowire.Number = 1
+	casBytesDataField  protowire.Number = 1
+)
+
+// casObjectHeader returns the encoding of a stored CASObject up to its blob's data, which
+// is size bytes long. It's followed by the data and then by casObjectReferences, which
+// together encode the same bytes as proto.Marshal.
+func casObjectHeader(size int64) []byte {
+	header := protowire.AppendTag(nil, casObjectBlobField, protowire.BytesType)
+	header = protowire.AppendVarint(header, uint64(protowire.SizeTag(casBytesDataField)+protowire.SizeBytes(int(size))))
+	header = protowire.AppendTag(header, casBytesDataField, protowire.BytesType)
+	return protowire.AppendVarint(header, uint64(size))
+}
+
+// casObjectReferences returns the encoding of a stored CASObject's references.
+func casObjectReferences(refs []*casv1.CASDataID) ([]byte, error) {
+	return proto.Marshal(&casv1.CASObject{References: refs})
+}
+
+// casObjectWriter decodes a stored CASObject written to it, passing its blob's data
+// through to blob as it arrives and keeping only the rest of the object in memory.
+// Objects that aren't laid out like casObjectHeader are buffered and decoded whole.
+type casObjectWriter struct {
+	blob io.Writer
+
+	// head holds the bytes written before the blob's data, until they are decoded.
+	head []byte
+	// remaining is the number of blob bytes still to pass through once head is decoded.
+	remaining int64
+	// tail holds the bytes written after the blob's data, or the whole object if it
+	// couldn't be streamed.
+	tail      []byte
+	streaming bool
+	buffered  bool
+}
+
+func newCASObjectWriter(blob io.Writer) *casObjectWriter {
+	return &casObjectWriter{blob: blob}
+}
+
+func (w *casObjectWriter) Write(p []byte) (int, error) {
+	written := len(p)
+
+	switch {
+	case w.buffered:
+		w.tail = append(w.tail, p...)
+		return written, nil
+	case !w.streaming:
+		w.head = append(w.head, p...)
+		offset, size, err := decodeCASObjectHeader(w.head)
+		switch {
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			return written, nil
+		case err != nil:
+			w.buffered = true
+			w.tail, w.head = w.head, nil
+			return written, nil
+		}
+		p = w.head[offset:]
+		w.head = nil
+		w.remaining = size
+		w.streaming = true
+	}
+
+	if w.remaining > 0 {
+		n := min(int64(len(p)), w.remaining)
+		if _, err := w.blob.Write(p[:n]); err != nil {
+			return 0, err
+		}
+		w.remaining -= n
+		p = p[n:]
+	}
+	w.tail = append(w.tail, p...)
+	return written, nil
+}
+
+// finish returns the references of the object written so far, once all of it was.
+func (w *casObjectWriter) finish() ([]*casv1.CASDataID, error) {
+	if !w.streaming {
+		// The object was too short or not laid out for streaming.
+		var obj casv1.CASObject
+		if err := proto.Unmarshal(append(w.head, w.tail...), &obj); err != nil {
+			return nil, err
+		}
+		blobData, err := casBlobData(obj.GetBlob())
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.blob.Write(blobData); err != nil {
+			return nil, err
+		}
+		return obj.GetReferences(), nil
+	}
+	if w.remaining > 0 {
+		return nil, fmt.Errorf("CAS object is truncated: %d blob bytes missing", w.remaining)
+	}
+
+	var obj casv1.CASObject
+	if err := proto.Unmarshal(w.tail, &obj); err != nil {
+		return nil, err
+	}
+	if obj.Blob != nil {
+		return nil, fmt.Errorf("CAS object has more than one blob")
+	}
+	return obj.GetReferences(), nil
+}
+
+// decodeCASObjectHeader decodes an encoding that starts like casObjectHeader, returning
+// the offset and size of the blob's data. It returns io.ErrUnexpectedEOF when more bytes
+// are needed to tell.
+func decodeCASObjectHeader(b []byte) (int, int64, error) {
+	num, typ, n := protowire.ConsumeTag(b)
+	if n < 0 {
+		return 0, 0, protowire.ParseError(n)
+	}
+	if num != casObjectBlobField || typ != protowire.BytesType {
+		return 0, 0, fmt.Errorf("CAS object doesn't start with its blob")
+	}
+	offset := n
+
+	blobSize, n := protowire.ConsumeVarint(b[offset:])
+	if n < 0 {
+		return 0, 0, protowire.ParseError(n)
+	}
+	offset += n
+
+	num, typ, n = protowire.ConsumeTag(b[offset:])
+	if n < 0 {
+		return 0, 0, protowire.ParseError(n)
+	}
+	if num != casBytesDataField || typ != protowire.BytesType {
+		return 0, 0, fmt.Errorf("CAS object blob isn't inline data")
+	}
+	offset += n
+
+	size, n := protowire.ConsumeVarint(b[offset:])
+	if n < 0 {
+		return 0, 0, protowire.ParseError(n)
+	}
+	offset += n
+
+	if blobSize != uint64(protowire.SizeTag(casBytesDataField)+protowire.SizeBytes(int(size))) {
+		return 0, 0, fmt.Errorf("CAS object blob has unexpected fields")
+	}
+	return offset, int64(size), nil
+}
@@ -0,0 +1,375 @@
+package llvm_cache
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	casv1 "github.com/cirruslabs/omni-cache/internal/api/compilation_cache_service/cas/v1"
+	keyvaluev1 "github.com/cirruslabs/omni-cache/internal/api/compilation_cache_service/keyvalue/v1"
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+	urlproxy "github.com/cirruslabs/omni-cache/pkg/url-proxy"
+	"google.golang.org/protobuf/proto"
+)
+
+// DefaultGCGracePeriod is how long CAS objects are protected from garbage collection after
+// they are written when GCOptions.GracePeriod is zero.
+const DefaultGCGracePeriod = time.Hour
+
+// gcConcurrency bounds the storage requests a garbage collection makes in parallel.
+const gcConcurrency = 16
+
+// GCOptions configures CollectGarbage.
+type GCOptions struct {
+	// KeyPrefix is the Options.KeyPrefix the protocol is served with. Defaults to
+	// DefaultKeyPrefix.
+	KeyPrefix string
+	// RootsMaxAge limits the roots to key-value entries written within this long. Older
+	// entries are deleted, together with the objects that only they reference. Zero keeps
+	// every entry as a root.
+	RootsMaxAge time.Duration
+	// GracePeriod protects CAS objects written within this long before the collection
+	// starts, or while it runs: they are kept, with everything they reference, since
+	// clients upload objects before the key-value entry that makes them reachable.
+	// Defaults to DefaultGCGracePeriod.
+	GracePeriod time.Duration
+	// DryRun counts what would be deleted without deleting anything.
+	DryRun bool
+}
+
+// GCResult summarizes a garbage collection.
+type GCResult struct {
+	// Roots is the number of CAS IDs the traversal started from.
+	Roots int
+	// Objects is the number of CAS objects stored when the collection started.
+	Objects int
+	// Reachable is the number of those objects that were kept because they are reachable.
+	Reachable      int
+	DeletedObjects int
+	DeletedBytes   int64
+	// DeletedValues is the number of key-value entries older than GCOptions.RootsMaxAge.
+	DeletedValues int
+}
+
+// CollectGarbage deletes the CAS objects that can't be reached by following references
+// from the CAS IDs stored in key-value entries. It lists every object and loads every
+// reachable one, so it's meant to be run occasionally, e.g. from a scheduled job, rather
+// than by the sidecar.
+//
+// Writes made while it runs are handled conservatively: objects written during the grace
+// period are roots, storage is listed again after marking to pick up objects and entries
+// written meanwhile, and every object is checked again right before it's deleted, so that
+// objects uploaded again since are kept. That relies on uploads refreshing the
+// modification time of stored objects, so don't collect a keyspace served with an
+// Options.ExistingObjects policy that skips them. Objects whose modification time the
+// backend doesn't report are never deleted.
+func CollectGarbage(ctx context.Context, backend storage.BlobStorageBackend, proxy *urlproxy.Proxy, options GCOptions) (*GCResult, error) {
+	listable, ok := backend.(storage.ListableBlobStorageBackend)
+	if !ok {
+		return nil, fmt.Errorf("llvm-cache gc: storage backend does not support listing")
+	}
+	deletable, ok := backend.(storage.DeletableBlobStorageBackend)
+	if !ok && !options.DryRun {
+		return nil, fmt.Errorf("llvm-cache gc: storage backend does not support deleting")
+	}
+	if options.GracePeriod <= 0 {
+		options.GracePeriod = DefaultGCGracePeriod
+	}
+	if proxy == nil {
+		proxy = urlproxy.NewProxy()
+	}
+
+	startedAt := time.Now()
+	c := &collector{
+		store:     newCacheStore(backend, proxy, options.KeyPrefix),
+		listable:  listable,
+		deletable: deletable,
+		dryRun:    options.DryRun,
+		cutoff:    startedAt.Add(-options.GracePeriod),
+		known:     map[string]storage.ObjectInfo{},
+		marked:    map[string]struct{}{},
+	}
+	var rootsCutoff time.Time
+	if options.RootsMaxAge > 0 {
+		rootsCutoff = startedAt.Add(-options.RootsMaxAge)
+	}
+
+	candidates, err := c.listObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+	roots, staleValues, err := c.valueRoots(ctx, rootsCutoff)
+	if err != nil {
+		return nil, err
+	}
+	for digest, object := range candidates {
+		if c.recent(object.LastModified) {
+			roots = append(roots, digest)
+		}
+	}
+	if err := c.mark(ctx, roots); err != nil {
+		return nil, err
+	}
+
+	// Catch up with objects and entries written while marking.
+	latest, err := c.listObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var lateRoots []string
+	for digest, object := range latest {
+		if _, ok := candidates[digest]; !ok || c.recent(object.LastModified) {
+			lateRoots = append(lateRoots, digest)
+		}
+	}
+	lateValueRoots, _, err := c.valueRoots(ctx, c.cutoff)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.mark(ctx, append(lateRoots, lateValueRoots...)); err != nil {
+		return nil, err
+	}
+
+	result := &GCResult{Roots: len(roots), Objects: len(candidates)}
+	var garbage []string
+	for digest, object := range candidates {
+		if _, ok := c.marked[digest]; ok {
+			result.Reachable++
+			continue
+		}
+		if !c.recent(object.LastModified) {
+			garbage = append(garbage, digest)
+		}
+	}
+
+	var resultMtx sync.Mutex
+	err = c.parallel(ctx, garbage, func(ctx context.Context, digest string) error {
+		deleted, err := c.deleteIfOlder(ctx, casStorageKey(c.store.keyPrefix, digest), c.cutoff)
+		if err != nil || !deleted {
+			return err
+		}
+		resultMtx.Lock()
+		defer resultMtx.Unlock()
+		result.DeletedObjects++
+		result.DeletedBytes += candidates[digest].SizeBytes
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = c.parallel(ctx, staleValues, func(ctx context.Context, key string) error {
+		deleted, err := c.deleteIfOlder(ctx, key, rootsCutoff)
+		if err != nil || !deleted {
+			return err
+		}
+		resultMtx.Lock()
+		defer resultMtx.Unlock()
+		result.DeletedValues++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+type collector struct {
+	store     *cacheStore
+	listable  storage.ListableBlobStorageBackend
+	deletable storage.DeletableBlobStorageBackend
+	dryRun    bool
+	// cutoff is when the grace period starts; objects written after it are kept.
+	cutoff time.Time
+
+	mtx sync.Mutex
+	// known holds every CAS object listed so far, by digest.
+	known  map[string]storage.ObjectInfo
+	marked map[string]struct{}
+}
+
+// recent reports whether an object modified at lastModified is within the grace period.
+func (c *collector) recent(lastModified time.Time) bool {
+	return lastModified.IsZero() || lastModified.After(c.cutoff)
+}
+
+// listObjects lists the stored CAS objects by digest, and adds them to c.known.
+func (c *collector) listObjects(ctx context.Context) (map[string]storage.ObjectInfo, error) {
+	prefix := casStorageKey(c.store.keyPrefix, "")
+	objects := map[string]storage.ObjectInfo{}
+	err := c.listable.List(ctx, prefix, func(object storage.ObjectInfo) error {
+		objects[strings.TrimPrefix(strings.TrimPrefix(object.Key, "/"), prefix)] = object
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("llvm-cache gc: list CAS objects: %w", err)
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for digest, object := range objects {
+		c.known[digest] = object
+	}
+	return objects, nil
+}
+
+// valueRoots returns the digests of the CAS IDs stored in key-value entries written after
+// since, and the keys of the older entries.
+func (c *collector) valueRoots(ctx context.Context, since time.Time) ([]string, []string, error) {
+	prefix := kvStorageKey(c.store.keyPrefix, nil)
+	var keys, staleKeys []string
+	err := c.listable.List(ctx, prefix, func(object storage.ObjectInfo) error {
+		if !since.IsZero() && !object.LastModified.IsZero() && object.LastModified.Before(since) {
+			staleKeys = append(staleKeys, object.Key)
+		} else {
+			keys = append(keys, object.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("llvm-cache gc: list key-value entries: %w", err)
+	}
+
+	var (
+		rootsMtx sync.Mutex
+		roots    []string
+	)
+	err = c.parallel(ctx, keys, func(ctx context.Context, key string) error {
+		data, err := c.store.read(ctx, key)
+		if storage.IsNotFoundError(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("llvm-cache gc: load key-value entry %q: %w", key, err)
+		}
+		var value keyvaluev1.Value
+		if err := proto.Unmarshal(data, &value); err != nil {
+			// Clients can't read it either, so it doesn't keep anything alive.
+			slog.WarnContext(ctx, "skipping malformed LLVM key-value entry", "key", key, "err", err)
+			return nil
+		}
+
+		rootsMtx.Lock()
+		defer rootsMtx.Unlock()
+		for _, entry := range value.GetEntries() {
+			// Entries can hold other data than CAS IDs, which isn't followed.
+			if digest, _, err := parseCASID(entry); err == nil {
+				roots = append(roots, hex.EncodeToString(digest))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return roots, staleKeys, nil
+}
+
+// mark marks the objects with the given digests and everything they reference.
+func (c *collector) mark(ctx context.Context, digests []string) error {
+	for len(digests) > 0 {
+		var unmarked []string
+		c.mtx.Lock()
+		for _, digest := range digests {
+			if _, ok := c.marked[digest]; ok {
+				continue
+			}
+			c.marked[digest] = struct{}{}
+			// References to objects that aren't stored have nothing to follow.
+			if _, ok := c.known[digest]; ok {
+				unmarked = append(unmarked, digest)
+			}
+		}
+		c.mtx.Unlock()
+
+		var (
+			referencesMtx sync.Mutex
+			references    []string
+		)
+		err := c.parallel(ctx, unmarked, func(ctx context.Context, digest string) error {
+			data, err := c.store.read(ctx, casStorageKey(c.store.keyPrefix, digest))
+			if storage.IsNotFoundError(err) {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("llvm-cache gc: load CAS object %s: %w", digest, err)
+			}
+			var object casv1.CASObject
+			if err := proto.Unmarshal(data, &object); err != nil {
+				return fmt.Errorf("llvm-cache gc: parse CAS object %s: %w", digest, err)
+			}
+
+			referencesMtx.Lock()
+			defer referencesMtx.Unlock()
+			for _, reference := range object.GetReferences() {
+				if referenced, _, err := parseCASID(reference.GetId()); err == nil {
+					references = append(references, hex.EncodeToString(referenced))
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		digests = references
+	}
+	return nil
+}
+
+// deleteIfOlder deletes key unless it was written after cutoff, checking again since it
+// was listed: an object uploaded again since may be referenced by a new entry.
+func (c *collector) deleteIfOlder(ctx context.Context, key string, cutoff time.Time) (bool, error) {
+	info, err := c.store.backend.CacheInfo(ctx, key, nil)
+	if storage.IsNotFoundError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("llvm-cache gc: look up %q: %w", key, err)
+	}
+	if info.LastModified.IsZero() || info.LastModified.After(cutoff) {
+		return false, nil
+	}
+	if c.dryRun {
+		return true, nil
+	}
+	if err := c.deletable.Delete(ctx, key); err != nil && !errors.Is(err, storage.ErrCacheNotFound) {
+		return false, fmt.Errorf("llvm-cache gc: delete %q: %w", key, err)
+	}
+	return true, nil
+}
+
+// parallel calls fn for every item, with at most gcConcurrency calls in flight. The first
+// error cancels the remaining calls and is returned.
+func (c *collector) parallel(ctx context.Context, items []string, fn func(context.Context, string) error) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	slots := make(chan struct{}, gcConcurrency)
+	var wg sync.WaitGroup
+
+	for _, item := range items {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Go(func() {
+			defer func() { <-slots }()
+
+			if err := fn(ctx, item); err != nil {
+				cancel(err)
+			}
+		})
+	}
+	wg.Wait()
+
+	return context.Cause(ctx)
+}
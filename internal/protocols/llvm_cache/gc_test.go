@@ -0,0 +1,167 @@
+package llvm_cache
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	casv1 "github.com/cirruslabs/omni-cache/internal/api/compilation_cache_service/cas/v1"
+	keyvaluev1 "github.com/cirruslabs/omni-cache/internal/api/compilation_cache_service/keyvalue/v1"
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+	urlproxy "github.com/cirruslabs/omni-cache/pkg/url-proxy"
+	"github.com/stretchr/testify/require"
+)
+
+type gcFixture struct {
+	t       *testing.T
+	root    string
+	backend *storage.FilesystemStorage
+	cas     *casService
+	kv      *kvService
+}
+
+func newGCFixture(t *testing.T) *gcFixture {
+	t.Helper()
+
+	root := t.TempDir()
+	backend, err := storage.NewFilesystemStorage(root)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = backend.Close()
+	})
+
+	store := newCacheStore(backend, urlproxy.NewProxy(), "")
+	return &gcFixture{t: t, root: root, backend: backend, cas: newCASService(store, 0), kv: newKVService(store)}
+}
+
+// put stores an object with data and references, and returns its CAS ID.
+func (f *gcFixture) put(data string, references ...string) string {
+	f.t.Helper()
+
+	refs := make([]*casv1.CASDataID, 0, len(references))
+	for _, reference := range references {
+		refs = append(refs, &casv1.CASDataID{Id: []byte(reference)})
+	}
+	resp, err := f.cas.Put(context.Background(), &casv1.CASPutRequest{Data: &casv1.CASObject{
+		Blob:       &casv1.CASBytes{Contents: &casv1.CASBytes_Data{Data: []byte(data)}},
+		References: refs,
+	}})
+	require.NoError(f.t, err)
+	require.Nil(f.t, resp.GetError())
+	return string(resp.GetCasId().GetId())
+}
+
+func (f *gcFixture) putValue(key string, casID string) {
+	f.t.Helper()
+
+	resp, err := f.kv.PutValue(context.Background(), &keyvaluev1.PutValueRequest{
+		Key:   []byte(key),
+		Value: &keyvaluev1.Value{Entries: map[string][]byte{"output": []byte(casID), "note": []byte("not a CAS ID")}},
+	})
+	require.NoError(f.t, err)
+	require.Nil(f.t, resp.GetError())
+}
+
+// backdate sets the modification time of the files stored for keys containing fragment,
+// or of every file when it's empty.
+func (f *gcFixture) backdate(fragment string, age time.Duration) {
+	f.t.Helper()
+
+	modTime := time.Now().Add(-age)
+	err := filepath.WalkDir(f.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || !strings.Contains(path, filepath.FromSlash(fragment)) {
+			return err
+		}
+		return os.Chtimes(path, modTime, modTime)
+	})
+	require.NoError(f.t, err)
+}
+
+func (f *gcFixture) exists(casID string) bool {
+	f.t.Helper()
+
+	_, err := f.backend.CacheInfo(context.Background(), casStorageKey(DefaultKeyPrefix, strings.TrimPrefix(casID, casIDPrefix)), nil)
+	if storage.IsNotFoundError(err) {
+		return false
+	}
+	require.NoError(f.t, err)
+	return true
+}
+
+func TestCollectGarbage(t *testing.T) {
+	f := newGCFixture(t)
+
+	leaf := f.put("leaf")
+	node := f.put("node", leaf)
+	orphan := f.put("orphan")
+	staleNode := f.put("stale node", orphan)
+	adopted := f.put("adopted")
+	f.putValue("live", node)
+	f.putValue("stale", staleNode)
+
+	f.backdate("", 2*time.Hour)
+	f.backdate(kvStorageKey(DefaultKeyPrefix, []byte("stale")), 48*time.Hour)
+
+	// Written within the grace period, e.g. by a build that hasn't stored its entry yet.
+	fresh := f.put("fresh", adopted)
+
+	options := GCOptions{RootsMaxAge: 24 * time.Hour, DryRun: true}
+	result, err := CollectGarbage(t.Context(), f.backend, nil, options)
+	require.NoError(t, err)
+	require.Equal(t, &GCResult{
+		Roots:          2,
+		Objects:        6,
+		Reachable:      4,
+		DeletedObjects: 2,
+		DeletedBytes:   result.DeletedBytes,
+		DeletedValues:  1,
+	}, result)
+	require.Positive(t, result.DeletedBytes)
+	for _, casID := range []string{leaf, node, orphan, staleNode, adopted, fresh} {
+		require.True(t, f.exists(casID), "dry run must not delete %s", casID)
+	}
+
+	options.DryRun = false
+	result, err = CollectGarbage(t.Context(), f.backend, nil, options)
+	require.NoError(t, err)
+	require.Equal(t, 2, result.DeletedObjects)
+	require.Equal(t, 1, result.DeletedValues)
+
+	for _, casID := range []string{leaf, node, adopted, fresh} {
+		require.True(t, f.exists(casID), "reachable object %s was deleted", casID)
+	}
+	for _, casID := range []string{orphan, staleNode} {
+		require.False(t, f.exists(casID), "unreachable object %s was kept", casID)
+	}
+	_, err = f.backend.CacheInfo(t.Context(), kvStorageKey(DefaultKeyPrefix, []byte("stale")), nil)
+	require.ErrorIs(t, err, storage.ErrCacheNotFound)
+	_, err = f.backend.CacheInfo(t.Context(), kvStorageKey(DefaultKeyPrefix, []byte("live")), nil)
+	require.NoError(t, err)
+}
+
+func TestCollectGarbageKeepsEveryValueWithoutRootsMaxAge(t *testing.T) {
+	f := newGCFixture(t)
+
+	leaf := f.put("leaf")
+	f.putValue("old", leaf)
+	f.backdate("", 365*24*time.Hour)
+
+	result, err := CollectGarbage(t.Context(), f.backend, nil, GCOptions{})
+	require.NoError(t, err)
+	require.Zero(t, result.DeletedObjects)
+	require.Zero(t, result.DeletedValues)
+	require.True(t, f.exists(leaf))
+}
+
+func TestCollectGarbageRequiresListing(t *testing.T) {
+	_, err := CollectGarbage(t.Context(), headOnlyStorage{}, nil, GCOptions{})
+	require.ErrorContains(t, err, "does not support listing")
+}
+
+type headOnlyStorage struct {
+	storage.BlobStorageBackend
+}
@@ -10,8 +10,6 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
-const kvPrefix = "llvm-cache/kv/"
-
 type kvService struct {
 	keyvaluev1.UnimplementedKeyValueDBServer
 	store *cacheStore
@@ -22,7 +20,7 @@ func newKVService(store *cacheStore) *kvService {
 }
 
 func (s *kvService) GetValue(ctx context.Context, req *keyvaluev1.GetValueRequest) (*keyvaluev1.GetValueResponse, error) {
-	data, err := s.store.download(ctx, kvStorageKey(req.GetKey()))
+	data, err := s.store.download(ctx, kvStorageKey(s.store.keyPrefix, req.GetKey()))
 	if err != nil {
 		if errors.Is(err, storage.ErrCacheNotFound) {
 			return &keyvaluev1.GetValueResponse{Outcome: keyvaluev1.GetValueResponse_KEY_NOT_FOUND}, nil
@@ -52,15 +50,18 @@ func (s *kvService) PutValue(ctx context.Context, req *keyvaluev1.PutValueReques
 		return kvPutValueError(err), nil
 	}
 
-	if err := s.store.upload(ctx, kvStorageKey(req.GetKey()), data); err != nil {
+	if err := s.store.upload(ctx, kvStorageKey(s.store.keyPrefix, req.GetKey()), data); err != nil {
+		if statusErr := quotaStatus(err); statusErr != nil {
+			return nil, statusErr
+		}
 		return kvPutValueError(err), nil
 	}
 
 	return &keyvaluev1.PutValueResponse{}, nil
 }
 
-func kvStorageKey(key []byte) string {
-	return kvPrefix + base64.RawURLEncoding.EncodeToString(key)
+func kvStorageKey(keyPrefix string, key []byte) string {
+	return keyPrefix + "/kv/" + base64.RawURLEncoding.EncodeToString(key)
 }
 
 func kvGetValueError(err error) *keyvaluev1.GetValueResponse {
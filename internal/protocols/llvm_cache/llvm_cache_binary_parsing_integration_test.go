@@ -68,9 +68,9 @@ func TestBinaryParsingBuildUsesRemoteCache(t *testing.T) {
 	listener, err := net.Listen("unix", socketPath)
 	require.NoError(t, err)
 
-	store := newCacheStore(countingStor, urlproxy.NewProxy())
+	store := newCacheStore(countingStor, urlproxy.NewProxy(), "")
 	grpcServer := grpc.NewServer()
-	casv1.RegisterCASDBServiceServer(grpcServer, newCASService(store))
+	casv1.RegisterCASDBServiceServer(grpcServer, newCASService(store, 0))
 	keyvaluev1.RegisterKeyValueDBServer(grpcServer, newKVService(store))
 	go func() {
 		_ = grpcServer.Serve(listener)
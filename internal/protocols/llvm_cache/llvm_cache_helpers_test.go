@@ -3,12 +3,14 @@ package llvm_cache
 import (
 	"bytes"
 	"encoding/base64"
+	"io"
 	"os"
 	"strings"
 	"testing"
 
 	casv1 "github.com/cirruslabs/omni-cache/internal/api/compilation_cache_service/cas/v1"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestParseCASID(t *testing.T) {
@@ -121,10 +123,62 @@ func TestCASBytesForResponse(t *testing.T) {
 	require.Equal(t, data, read)
 }
 
+func TestCASObjectStreamingEncoding(t *testing.T) {
+	data := bytes.Repeat([]byte("blob"), 100)
+	refs := []*casv1.CASDataID{{Id: []byte(casIDFromDigest(bytes.Repeat([]byte{0x02}, casHashBytes)))}}
+
+	references, err := casObjectReferences(refs)
+	require.NoError(t, err)
+	encoded := append(append(casObjectHeader(int64(len(data))), data...), references...)
+
+	// The streamed encoding is the one stored objects get when held in memory.
+	marshaled, err := proto.Marshal(&casv1.CASObject{
+		Blob:       &casv1.CASBytes{Contents: &casv1.CASBytes_Data{Data: data}},
+		References: refs,
+	})
+	require.NoError(t, err)
+	require.Equal(t, marshaled, encoded)
+
+	// Decode it one byte at a time to cross every boundary.
+	var blob bytes.Buffer
+	decoder := newCASObjectWriter(&blob)
+	for i := range encoded {
+		n, err := decoder.Write(encoded[i : i+1])
+		require.NoError(t, err)
+		require.Equal(t, 1, n)
+	}
+	decodedRefs, err := decoder.finish()
+	require.NoError(t, err)
+	require.Equal(t, data, blob.Bytes())
+	require.Len(t, decodedRefs, 1)
+	require.Equal(t, refs[0].GetId(), decodedRefs[0].GetId())
+
+	t.Run("truncated", func(t *testing.T) {
+		decoder := newCASObjectWriter(io.Discard)
+		_, err := decoder.Write(encoded[:len(encoded)-len(references)-1])
+		require.NoError(t, err)
+		_, err = decoder.finish()
+		require.ErrorContains(t, err, "truncated")
+	})
+
+	t.Run("references-first", func(t *testing.T) {
+		reordered := append(append([]byte{}, references...), marshaled[:len(marshaled)-len(references)]...)
+
+		var blob bytes.Buffer
+		decoder := newCASObjectWriter(&blob)
+		_, err := decoder.Write(reordered)
+		require.NoError(t, err)
+		decodedRefs, err := decoder.finish()
+		require.NoError(t, err)
+		require.Equal(t, data, blob.Bytes())
+		require.Len(t, decodedRefs, 1)
+	})
+}
+
 func TestKVStorageKey(t *testing.T) {
 	key := []byte("key")
-	expected := kvPrefix + base64.RawURLEncoding.EncodeToString(key)
-	require.Equal(t, expected, kvStorageKey(key))
+	expected := "llvm-cache/kv/" + base64.RawURLEncoding.EncodeToString(key)
+	require.Equal(t, expected, kvStorageKey(DefaultKeyPrefix, key))
 }
 
 func writeTempFile(t *testing.T, data []byte) string {
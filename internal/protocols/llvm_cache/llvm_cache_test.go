@@ -2,9 +2,13 @@ package llvm_cache_test
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/hex"
+	"io"
 	"net"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
 	"time"
@@ -14,6 +18,7 @@ import (
 	llvmcache "github.com/cirruslabs/omni-cache/internal/protocols/llvm_cache"
 	"github.com/cirruslabs/omni-cache/internal/testutil"
 	"github.com/cirruslabs/omni-cache/pkg/server"
+	"github.com/cirruslabs/omni-cache/pkg/storage"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
@@ -27,11 +32,22 @@ const (
 func setupGRPCConn(t *testing.T) *grpc.ClientConn {
 	t.Helper()
 
-	storage := testutil.NewStorage(t)
+	return setupGRPCConnWithFactory(t, llvmcache.Factory{})
+}
+
+func setupGRPCConnWithFactory(t *testing.T, factory llvmcache.Factory) *grpc.ClientConn {
+	t.Helper()
+
+	return setupGRPCConnWithStorage(t, testutil.NewStorage(t), factory)
+}
+
+func setupGRPCConnWithStorage(t *testing.T, storage storage.BlobStorageBackend, factory llvmcache.Factory) *grpc.ClientConn {
+	t.Helper()
+
 	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	require.NoError(t, err)
 
-	srv, err := server.Start(t.Context(), []net.Listener{listener}, storage, llvmcache.Factory{})
+	srv, err := server.Start(t.Context(), []net.Listener{listener}, storage, factory)
 	require.NoError(t, err)
 	t.Cleanup(func() {
 		_ = srv.Shutdown(context.Background())
@@ -152,6 +168,126 @@ func TestLLVMCacheCASRoundTrip(t *testing.T) {
 	require.Equal(t, savedID, string(getObjResp.GetData().GetReferences()[0].GetId()))
 }
 
+func TestLLVMCacheCASInlineBlobLimit(t *testing.T) {
+	conn := setupGRPCConnWithFactory(t, llvmcache.Factory{Options: llvmcache.Options{MaxInlineBlobBytes: 8}})
+	client := casv1.NewCASDBServiceClient(conn)
+
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	saveResp, err := client.Save(ctx, &casv1.CASSaveRequest{
+		Data: &casv1.CASBlob{Blob: casBytesData([]byte("too large for inline"))},
+	})
+	require.NoError(t, err)
+	require.Contains(t, saveResp.GetError().GetDescription(), "file path")
+
+	putResp, err := client.Put(ctx, &casv1.CASPutRequest{
+		Data: &casv1.CASObject{Blob: casBytesData([]byte("too large for inline"))},
+	})
+	require.NoError(t, err)
+	require.Contains(t, putResp.GetError().GetDescription(), "file path")
+
+	saveResp, err = client.Save(ctx, &casv1.CASSaveRequest{
+		Data: &casv1.CASBlob{Blob: casBytesData([]byte("small"))},
+	})
+	require.NoError(t, err)
+	require.Nil(t, saveResp.GetError())
+
+	path := t.TempDir() + "/blob"
+	require.NoError(t, os.WriteFile(path, []byte("too large for inline"), 0o600))
+	saveResp, err = client.Save(ctx, &casv1.CASSaveRequest{
+		Data: &casv1.CASBlob{Blob: &casv1.CASBytes{Contents: &casv1.CASBytes_FilePath{FilePath: path}}},
+	})
+	require.NoError(t, err)
+	require.Nil(t, saveResp.GetError())
+	require.True(t, strings.HasPrefix(string(saveResp.GetCasId().GetId()), casIDPrefix))
+}
+
+func TestLLVMCacheCASStreamsLargeFileBlobs(t *testing.T) {
+	const size = 64 << 20
+
+	backend, err := storage.NewFilesystemStorage(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = backend.Close()
+	})
+	conn := setupGRPCConnWithStorage(t, backend, llvmcache.Factory{})
+	client := casv1.NewCASDBServiceClient(conn)
+
+	ctx, cancel := context.WithTimeout(t.Context(), 30*time.Second)
+	t.Cleanup(cancel)
+
+	path := filepath.Join(t.TempDir(), "large.blob")
+	file, err := os.Create(path)
+	require.NoError(t, err)
+	written := sha256.New()
+	_, err = io.Copy(io.MultiWriter(file, written), io.LimitReader(patternReader{}, size))
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	saveResp, err := client.Save(ctx, &casv1.CASSaveRequest{
+		Data: &casv1.CASBlob{Blob: &casv1.CASBytes{Contents: &casv1.CASBytes_FilePath{FilePath: path}}},
+	})
+	require.NoError(t, err)
+	require.Nil(t, saveResp.GetError())
+
+	getResp, err := client.Get(ctx, &casv1.CASGetRequest{
+		CasId:       saveResp.GetCasId(),
+		WriteToDisk: true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, casv1.CASGetResponse_SUCCESS, getResp.GetOutcome(), getResp.GetError().GetDescription())
+
+	runtime.ReadMemStats(&after)
+
+	// Everything the client, the service and the storage allocated, which would include
+	// the whole blob at least once if it were buffered anywhere.
+	allocated := after.TotalAlloc - before.TotalAlloc
+	require.Less(t, allocated, uint64(size/8), "allocated %d bytes for a %d-byte blob", allocated, size)
+
+	loadPath := getResp.GetData().GetBlob().GetFilePath()
+	require.NotEmpty(t, loadPath)
+	t.Cleanup(func() {
+		_ = os.Remove(loadPath)
+	})
+	loaded, err := os.Open(loadPath)
+	require.NoError(t, err)
+	defer loaded.Close()
+	read := sha256.New()
+	counter := &countingReader{r: loaded}
+	_, err = io.Copy(read, counter)
+	require.NoError(t, err)
+	require.EqualValues(t, size, counter.n)
+	require.Equal(t, written.Sum(nil), read.Sum(nil))
+	require.Empty(t, getResp.GetData().GetReferences())
+}
+
+// patternReader yields an endless byte pattern.
+type patternReader struct{}
+
+func (patternReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(i*31 + i/251)
+	}
+	return len(p), nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
 func casBytesData(data []byte) *casv1.CASBytes {
 	return &casv1.CASBytes{Contents: &casv1.CASBytes_Data{Data: data}}
 }
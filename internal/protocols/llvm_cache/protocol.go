@@ -10,6 +10,33 @@ import (
 	urlproxy "github.com/cirruslabs/omni-cache/pkg/url-proxy"
 )
 
+// DefaultKeyPrefix is the top-level storage prefix used when Options.KeyPrefix is empty.
+const DefaultKeyPrefix = "llvm-cache"
+
+// Options configures the llvm-cache protocol.
+type Options struct {
+	// KeyPrefix is the top-level storage prefix for CAS and KV objects.
+	// Defaults to DefaultKeyPrefix.
+	KeyPrefix string
+	// MaxInlineBlobBytes rejects CAS Put and Save requests whose blob is sent inline and
+	// is larger than this, telling the client to send it as a file path instead. Zero
+	// or negative means no limit. The gRPC server rejects requests over its default 4 MiB
+	// message size before they get here, so larger limits have no effect.
+	MaxInlineBlobBytes int64
+	// ExistingObjects decides whether CAS objects that are already stored are uploaded
+	// again. Defaults to storage.OverwriteExisting: uploading again refreshes an object's
+	// modification time, which CollectGarbage relies on to keep objects that become
+	// reachable again while it runs. Key-value entries are always written.
+	ExistingObjects storage.ExistingObjectPolicy
+}
+
+func (o Options) existingObjects() storage.ExistingObjectPolicy {
+	if o.ExistingObjects == "" {
+		return storage.OverwriteExisting
+	}
+	return o.ExistingObjects
+}
+
 // Factory wires the llvm-cache gRPC services.
 // Services:
 //
@@ -17,23 +44,46 @@ import (
 //	compilation_cache_service.keyvalue.v1.KeyValueDB
 //
 // Served over h2c (plaintext HTTP/2) on the sidecar port.
-type Factory struct{}
+type Factory struct {
+	Options Options
+}
 
 func (Factory) ID() string {
 	return "llvm-cache"
 }
 
-func (Factory) New(deps protocols.Dependencies) (protocols.Protocol, error) {
+func (f Factory) Describe() protocols.Description {
+	description := protocols.Description{
+		Summary: "LLVM/Xcode compilation cache",
+		GRPCServices: []string{
+			casv1.CASDBService_ServiceDesc.ServiceName,
+			keyvaluev1.KeyValueDB_ServiceDesc.ServiceName,
+		},
+	}
+	if f.Options.MaxInlineBlobBytes > 0 {
+		description.Limits = map[string]int64{"maxInlineBlobBytes": f.Options.MaxInlineBlobBytes}
+	}
+	if policy := f.Options.existingObjects(); policy != storage.OverwriteExisting {
+		description.Features = []string{"existing-objects-" + string(policy)}
+	}
+	return description
+}
+
+var protocolStats = protocols.Stats(Factory{}.ID())
+
+func (f Factory) New(deps protocols.Dependencies) (protocols.Protocol, error) {
 	deps = deps.WithDefaults()
 	return &protocol{
 		backend:  deps.Storage,
 		urlProxy: deps.URLProxy,
+		options:  f.Options,
 	}, nil
 }
 
 type protocol struct {
 	backend  storage.BlobStorageBackend
 	urlProxy *urlproxy.Proxy
+	options  Options
 }
 
 func (p *protocol) Register(registrar *protocols.Registrar) error {
@@ -42,8 +92,9 @@ func (p *protocol) Register(registrar *protocols.Registrar) error {
 		return fmt.Errorf("grpc registrar is nil")
 	}
 
-	store := newCacheStore(p.backend, p.urlProxy)
-	casv1.RegisterCASDBServiceServer(grpcRegistrar, newCASService(store))
+	store := newCacheStore(p.backend, p.urlProxy, p.options.KeyPrefix)
+	store.existingObjects = p.options.existingObjects()
+	casv1.RegisterCASDBServiceServer(grpcRegistrar, newCASService(store, p.options.MaxInlineBlobBytes))
 	keyvaluev1.RegisterKeyValueDBServer(grpcRegistrar, newKVService(store))
 	return nil
 }
@@ -0,0 +1,66 @@
+package llvm_cache
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sharedUploadTimeout bounds an upload shared by uploadGroup, which no caller can cancel.
+const sharedUploadTimeout = 10 * time.Minute
+
+// uploadGroup shares one upload between concurrent callers uploading the same
+// content-addressed key. Since the key is derived from the content, every caller would
+// upload the same bytes, so the ones that arrive while an upload is in flight wait for
+// it and get its result.
+type uploadGroup struct {
+	timeout time.Duration
+
+	mu       sync.Mutex
+	inflight map[string]*sharedUpload
+}
+
+type sharedUpload struct {
+	done chan struct{}
+	err  error
+}
+
+func newUploadGroup(timeout time.Duration) *uploadGroup {
+	return &uploadGroup{timeout: timeout, inflight: map[string]*sharedUpload{}}
+}
+
+// do runs upload for key unless an upload for it is already in flight, in which case it
+// waits for that one instead. The upload runs detached from ctx, since other callers may
+// be waiting on it, and is canceled after the group's timeout instead. do returns early
+// when ctx is done.
+func (g *uploadGroup) do(ctx context.Context, key string, upload func(context.Context) error) error {
+	g.mu.Lock()
+	shared, ok := g.inflight[key]
+	if !ok {
+		shared = &sharedUpload{done: make(chan struct{})}
+		g.inflight[key] = shared
+	}
+	g.mu.Unlock()
+
+	if !ok {
+		uploadCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), g.timeout)
+		go func() {
+			defer cancel()
+			err := upload(uploadCtx)
+
+			g.mu.Lock()
+			delete(g.inflight, key)
+			g.mu.Unlock()
+
+			shared.err = err
+			close(shared.done)
+		}()
+	}
+
+	select {
+	case <-shared.done:
+		return shared.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,225 @@
+package llvm_cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	casv1 "github.com/cirruslabs/omni-cache/internal/api/compilation_cache_service/cas/v1"
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+	urlproxy "github.com/cirruslabs/omni-cache/pkg/url-proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// countingUploadStorage counts upload URLs and holds each upload until release is closed.
+// Lookups fail with infoErr when it's set.
+type countingUploadStorage struct {
+	storage.BlobStorageBackend
+
+	uploads atomic.Int64
+	release chan struct{}
+	infoErr error
+}
+
+func (s *countingUploadStorage) CacheInfo(ctx context.Context, key string, prefixes []string) (*storage.CacheInfo, error) {
+	if s.infoErr != nil {
+		return nil, s.infoErr
+	}
+	return s.BlobStorageBackend.CacheInfo(ctx, key, prefixes)
+}
+
+func (s *countingUploadStorage) UploadURL(ctx context.Context, key string, metadata map[string]string) (*storage.URLInfo, error) {
+	s.uploads.Add(1)
+	select {
+	case <-s.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return s.BlobStorageBackend.UploadURL(ctx, key, metadata)
+}
+
+// waitingContext closes waiting once a caller starts waiting for it to be done.
+type waitingContext struct {
+	context.Context
+
+	once    sync.Once
+	waiting chan struct{}
+}
+
+func newWaitingContext(ctx context.Context) *waitingContext {
+	return &waitingContext{Context: ctx, waiting: make(chan struct{})}
+}
+
+func (c *waitingContext) Done() <-chan struct{} {
+	c.once.Do(func() {
+		close(c.waiting)
+	})
+	return c.Context.Done()
+}
+
+func newCountingCASService(t *testing.T) (*casService, *countingUploadStorage) {
+	t.Helper()
+
+	fs, err := storage.NewFilesystemStorage(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = fs.Close()
+	})
+
+	backend := &countingUploadStorage{BlobStorageBackend: fs, release: make(chan struct{})}
+	return newCASService(newCacheStore(backend, urlproxy.NewProxy(), ""), 0), backend
+}
+
+func saveRequest(data []byte) *casv1.CASSaveRequest {
+	return &casv1.CASSaveRequest{Data: &casv1.CASBlob{Blob: &casv1.CASBytes{Contents: &casv1.CASBytes_Data{Data: data}}}}
+}
+
+func TestCASConcurrentSavesShareOneUpload(t *testing.T) {
+	service, backend := newCountingCASService(t)
+
+	data := []byte("shared object")
+	digest, err := hashObject(nil, data)
+	require.NoError(t, err)
+
+	const saves = 8
+	ids := make(chan string, saves)
+	var waiting []<-chan struct{}
+	var wg sync.WaitGroup
+	for range saves {
+		ctx := newWaitingContext(t.Context())
+		waiting = append(waiting, ctx.waiting)
+		wg.Go(func() {
+			resp, err := service.Save(ctx, saveRequest(data))
+			if err != nil || resp.GetError() != nil {
+				ids <- ""
+				return
+			}
+			ids <- string(resp.GetCasId().GetId())
+		})
+	}
+
+	// The first upload is held, so every save waiting on an upload waits on that one.
+	for _, ch := range waiting {
+		waitFor(t, ch)
+	}
+	require.EqualValues(t, 1, backend.uploads.Load())
+	close(backend.release)
+	wg.Wait()
+	close(ids)
+
+	for id := range ids {
+		require.Equal(t, casIDFromDigest(digest[:]), id)
+	}
+	require.EqualValues(t, 1, backend.uploads.Load())
+
+	// Only uploads in flight are shared.
+	resp, err := service.Save(t.Context(), saveRequest(data))
+	require.NoError(t, err)
+	require.Nil(t, resp.GetError())
+	require.EqualValues(t, 2, backend.uploads.Load())
+}
+
+func TestCASSharedUploadOutlivesCanceledCaller(t *testing.T) {
+	service, backend := newCountingCASService(t)
+
+	data := []byte("shared object")
+	digest, err := hashObject(nil, data)
+	require.NoError(t, err)
+	key := casStorageKey(DefaultKeyPrefix, hex.EncodeToString(digest[:]))
+
+	ctx, cancel := context.WithCancel(t.Context())
+	canceled := make(chan *casv1.CASSaveResponse, 1)
+	go func() {
+		resp, _ := service.Save(ctx, saveRequest(data))
+		canceled <- resp
+	}()
+	require.Eventually(t, func() bool {
+		return backend.uploads.Load() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	joinedCtx := newWaitingContext(t.Context())
+	joined := make(chan *casv1.CASSaveResponse, 1)
+	go func() {
+		resp, _ := service.Save(joinedCtx, saveRequest(data))
+		joined <- resp
+	}()
+	waitFor(t, joinedCtx.waiting)
+
+	// The caller that started the upload gives up, but the one waiting on it doesn't.
+	cancel()
+	require.Contains(t, (<-canceled).GetError().GetDescription(), context.Canceled.Error())
+
+	close(backend.release)
+	resp := <-joined
+	require.Nil(t, resp.GetError())
+	require.Equal(t, casIDFromDigest(digest[:]), string(resp.GetCasId().GetId()))
+	require.EqualValues(t, 1, backend.uploads.Load())
+
+	info, err := backend.CacheInfo(t.Context(), key, nil)
+	require.NoError(t, err)
+	require.Positive(t, info.SizeBytes)
+}
+
+func waitFor(t *testing.T, ch <-chan struct{}) {
+	t.Helper()
+
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a save to wait on its upload")
+	}
+}
+
+func TestCASSharedUploadTimesOut(t *testing.T) {
+	service, backend := newCountingCASService(t)
+	service.uploads = newUploadGroup(50 * time.Millisecond)
+
+	// The held upload is canceled by the timeout even though its caller keeps waiting.
+	resp, err := service.Save(t.Context(), saveRequest([]byte("stuck object")))
+	require.NoError(t, err)
+	require.Contains(t, resp.GetError().GetDescription(), context.DeadlineExceeded.Error())
+
+	// The timed out upload no longer blocks the key.
+	close(backend.release)
+	resp, err = service.Save(t.Context(), saveRequest([]byte("stuck object")))
+	require.NoError(t, err)
+	require.Nil(t, resp.GetError())
+	require.EqualValues(t, 2, backend.uploads.Load())
+}
+
+func TestCASSaveFromFileRejectsFileChangedDuringUpload(t *testing.T) {
+	service, backend := newCountingCASService(t)
+
+	data := bytes.Repeat([]byte("a"), streamBlobThreshold+1)
+	path := filepath.Join(t.TempDir(), "blob")
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+	digest, err := hashObject(nil, data)
+	require.NoError(t, err)
+	key := casStorageKey(DefaultKeyPrefix, hex.EncodeToString(digest[:]))
+
+	saved := make(chan *casv1.CASSaveResponse, 1)
+	go func() {
+		resp, _ := service.Save(t.Context(), &casv1.CASSaveRequest{
+			Data: &casv1.CASBlob{Blob: &casv1.CASBytes{Contents: &casv1.CASBytes_FilePath{FilePath: path}}},
+		})
+		saved <- resp
+	}()
+	require.Eventually(t, func() bool {
+		return backend.uploads.Load() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The client rewrites the file after it was hashed but before it was uploaded.
+	require.NoError(t, os.WriteFile(path, bytes.Repeat([]byte("b"), len(data)), 0o600))
+	close(backend.release)
+
+	resp := <-saved
+	require.Contains(t, resp.GetError().GetDescription(), errBlobChanged.Error())
+	_, err = backend.CacheInfo(t.Context(), key, nil)
+	require.ErrorIs(t, err, storage.ErrCacheNotFound)
+}
@@ -2,9 +2,13 @@ package tuist_cache
 
 import (
 	"fmt"
+	"slices"
+	"time"
 
+	"github.com/cirruslabs/omni-cache/pkg/kvstore"
 	"github.com/cirruslabs/omni-cache/pkg/protocols"
 	"github.com/cirruslabs/omni-cache/pkg/storage"
+	urlproxy "github.com/cirruslabs/omni-cache/pkg/url-proxy"
 )
 
 // Factory wires the Tuist module cache HTTP protocol.
@@ -15,24 +19,91 @@ import (
 //	POST /tuist/api/cache/module/start
 //	POST /tuist/api/cache/module/part
 //	POST /tuist/api/cache/module/complete
-type Factory struct{}
+//	POST /tuist/api/cache/multi-exists
+//	DELETE /tuist/api/cache/clean
+type Factory struct {
+	Options Options
+}
+
+// Options configures the tuist-cache protocol.
+type Options struct {
+	// KeyPrefix is the top-level storage prefix for module artifacts.
+	// Empty stores artifacts under their account handle at the bucket root, as before.
+	KeyPrefix string
+	// FlushPolicy overrides urlproxy.DefaultFlushPolicy for artifact downloads when set.
+	FlushPolicy *urlproxy.FlushPolicy
+	// AsyncPartUploads, when positive, acknowledges multipart parts as soon as they are
+	// read and uploads them to the backend in the background, with at most this many
+	// in flight. Completing the upload waits for them. Zero uploads each part inline.
+	AsyncPartUploads int
+	// PartReadTimeout, when positive, bounds how long reading a part upload body may
+	// take. Clients that stall past it get a 408 and the connection is freed. Zero
+	// waits for the body as long as the connection stays open.
+	PartReadTimeout time.Duration
+	// MaxPartSizeBytes is the largest multipart part accepted; larger parts get a 413.
+	// Defaults to DefaultMaxPartSizeBytes.
+	MaxPartSizeBytes int64
+	// CommitRetries retries committing multipart uploads after failures that may be
+	// transient before reporting them to the client. The zero value doesn't retry.
+	CommitRetries storage.RetryPolicy
+	// SessionStore, when set, persists multipart upload sessions, such as in Redis, so
+	// that uploads can be completed after a restart or after their session expired from
+	// memory. Sessions are still served from memory while they're there. Sidecars sharing
+	// the store must use their own key prefix unless they share their storage too (see
+	// kvstore.WithPrefix).
+	SessionStore kvstore.Store
+}
 
 func (Factory) ID() string {
 	return "tuist-cache"
 }
 
-func (Factory) New(deps protocols.Dependencies) (protocols.Protocol, error) {
+func (f Factory) Describe() protocols.Description {
+	description := protocols.Description{
+		Summary: "Tuist module cache",
+		HTTPRoutes: []string{
+			"HEAD /tuist/api/cache/module/{id}",
+			"GET /tuist/api/cache/module/{id}",
+			"POST /tuist/api/cache/module/start",
+			"POST /tuist/api/cache/module/part",
+			"POST /tuist/api/cache/module/complete",
+			"POST /tuist/api/cache/multi-exists",
+			"DELETE /tuist/api/cache/clean",
+		},
+	}
+	if f.Options.AsyncPartUploads > 0 {
+		description.Features = []string{"async-part-uploads"}
+		description.Limits = map[string]int64{"asyncPartUploads": int64(f.Options.AsyncPartUploads)}
+	}
+	return description
+}
+
+var protocolStats = protocols.Stats(Factory{}.ID())
+
+func (f Factory) New(deps protocols.Dependencies) (protocols.Protocol, error) {
 	deps = deps.WithDefaults()
 
 	backend, ok := deps.Storage.(storage.MultipartBlobStorageBackend)
 	if !ok {
 		return nil, fmt.Errorf("tuist-cache requires multipart storage backend")
 	}
+	backend = storage.NewCommitRetryStorage(backend, f.Options.CommitRetries)
 
-	cache, err := newTuistCache(backend, deps.HTTP)
+	cache, err := newTuistCache(backend, deps.HTTP, f.Options.KeyPrefix, f.Options.MaxPartSizeBytes)
 	if err != nil {
 		return nil, err
 	}
+	if f.Options.FlushPolicy != nil {
+		cache.flushPolicy = *f.Options.FlushPolicy
+	}
+	if f.Options.AsyncPartUploads > 0 {
+		cache.partUploads = make(chan struct{}, f.Options.AsyncPartUploads)
+	}
+	cache.partReadTimeout = f.Options.PartReadTimeout
+	cache.sharedStorage = slices.ContainsFunc(deps.ServedProtocols, func(id string) bool {
+		return id != f.ID()
+	})
+	cache.uploads.persistent = f.Options.SessionStore
 
 	return &protocol{
 		cache: cache,
@@ -58,5 +129,6 @@ func (p *protocol) Register(registrar *protocols.Registrar) error {
 	} {
 		mux.Handle(method+" /tuist/api/cache/", p.cache)
 	}
+	mux.HandleFunc("POST "+multiExistsPath, p.cache.serveMultiExists)
 	return nil
 }
@@ -8,28 +8,48 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
+	"os"
 	"slices"
 	"strings"
 	"time"
 
 	tuistopenapi "github.com/cirruslabs/omni-cache/internal/protocols/tuist_cache/openapi"
-	"github.com/cirruslabs/omni-cache/pkg/stats"
+	"github.com/cirruslabs/omni-cache/pkg/errdetail"
 	"github.com/cirruslabs/omni-cache/pkg/storage"
+	urlproxy "github.com/cirruslabs/omni-cache/pkg/url-proxy"
+	"github.com/dustin/go-humanize"
+	"github.com/ogen-go/ogen/ogenerrors"
 )
 
+// DefaultMaxPartSizeBytes is the largest multipart part accepted unless configured
+// otherwise.
+const DefaultMaxPartSizeBytes int64 = 10 * 1024 * 1024
+
 const (
 	defaultCacheCategory = "builds"
 
-	maxPartSizeBytes int64 = 10 * 1024 * 1024
+	partPathSuffix = "/api/cache/module/part"
 )
 
 type tuistCache struct {
 	tuistopenapi.UnimplementedHandler
 
-	backend    storage.MultipartBlobStorageBackend
-	httpClient *http.Client
-	uploads    *uploadStore
-	server     *tuistopenapi.Server
+	backend     storage.MultipartBlobStorageBackend
+	httpClient  *http.Client
+	uploads     *uploadStore
+	server      *tuistopenapi.Server
+	keyPrefix   string
+	flushPolicy urlproxy.FlushPolicy
+	maxPartSize int64
+
+	// sharedStorage reports whether other protocols store objects in the same backend.
+	sharedStorage bool
+
+	// partUploads bounds the number of in-flight background part uploads. When nil,
+	// each part is uploaded to the backend before the request is acknowledged.
+	partUploads chan struct{}
+	// partReadTimeout is the read deadline set on part upload requests. Zero sets none.
+	partReadTimeout time.Duration
 }
 
 var _ tuistopenapi.Handler = (*tuistCache)(nil)
@@ -37,18 +57,29 @@ var _ tuistopenapi.Handler = (*tuistCache)(nil)
 func newTuistCache(
 	backend storage.MultipartBlobStorageBackend,
 	httpClient *http.Client,
+	keyPrefix string,
+	maxPartSizeBytes int64,
 ) (*tuistCache, error) {
 	if httpClient == nil {
 		httpClient = http.DefaultClient
 	}
+	if maxPartSizeBytes <= 0 {
+		maxPartSizeBytes = DefaultMaxPartSizeBytes
+	}
 
 	cache := &tuistCache{
-		backend:    backend,
-		httpClient: httpClient,
-		uploads:    newUploadStore(time.Now, 5*time.Minute),
+		backend:     backend,
+		httpClient:  httpClient,
+		uploads:     newUploadStore(time.Now, 5*time.Minute),
+		keyPrefix:   strings.Trim(keyPrefix, "/"),
+		flushPolicy: urlproxy.DefaultFlushPolicy,
+		maxPartSize: maxPartSizeBytes,
 	}
 
-	server, err := tuistopenapi.NewServer(cache, tuistopenapi.WithPathPrefix("/tuist"))
+	server, err := tuistopenapi.NewServer(cache,
+		tuistopenapi.WithPathPrefix("/tuist"),
+		tuistopenapi.WithErrorHandler(handleError),
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -58,14 +89,38 @@ func newTuistCache(
 }
 
 func (t *tuistCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		// Artifact downloads are streamed by the generated server; flush periodically
+		// so clients see steady progress instead of a stall until completion.
+		w = urlproxy.NewFlushingResponseWriter(w, t.flushPolicy)
+	}
+	if r.Method == http.MethodPost && t.partReadTimeout > 0 && strings.HasSuffix(r.URL.Path, partPathSuffix) {
+		// The generated server hands the request body to UploadModuleCachePart as is, so
+		// a deadline on the connection makes a stalled read fail there with a timeout.
+		err := http.NewResponseController(w).SetReadDeadline(time.Now().Add(t.partReadTimeout))
+		if err != nil {
+			slog.WarnContext(r.Context(), "tuist part read deadline not supported", "err", err)
+		}
+	}
 	t.server.ServeHTTP(w, r)
 }
 
+// handleError renders errors returned by handlers, hiding internal detail from
+// clients when the request asks for public error messages.
+func handleError(ctx context.Context, w http.ResponseWriter, r *http.Request, err error) {
+	if ogenerrors.ErrorCode(err) >= http.StatusInternalServerError && errdetail.FromContext(ctx) == errdetail.Public {
+		slog.ErrorContext(ctx, "tuist request failed", "err", err)
+		err = errors.New(errdetail.GenericMessage)
+	}
+	ogenerrors.DefaultErrorHandler(ctx, w, r, err)
+}
+
 func (t *tuistCache) ModuleCacheArtifactExists(
 	ctx context.Context,
 	params tuistopenapi.ModuleCacheArtifactExistsParams,
 ) (tuistopenapi.ModuleCacheArtifactExistsRes, error) {
 	key, err := moduleStorageKey(
+		t.keyPrefix,
 		params.AccountHandle,
 		params.ProjectHandle,
 		params.CacheCategory.Or(defaultCacheCategory),
@@ -78,7 +133,7 @@ func (t *tuistCache) ModuleCacheArtifactExists(
 
 	if _, err := t.backend.CacheInfo(ctx, key, nil); err != nil {
 		if storage.IsNotFoundError(err) {
-			stats.Default().RecordCacheMiss()
+			protocolStats.RecordCacheMiss()
 			return &tuistopenapi.ModuleCacheArtifactExistsNotFound{Message: "artifact not found"}, nil
 		}
 
@@ -86,7 +141,7 @@ func (t *tuistCache) ModuleCacheArtifactExists(
 		return nil, err
 	}
 
-	stats.Default().RecordCacheHit()
+	protocolStats.RecordCacheHit()
 	return &tuistopenapi.ModuleCacheArtifactExistsNoContent{}, nil
 }
 
@@ -95,6 +150,7 @@ func (t *tuistCache) DownloadModuleCacheArtifact(
 	params tuistopenapi.DownloadModuleCacheArtifactParams,
 ) (tuistopenapi.DownloadModuleCacheArtifactRes, error) {
 	key, err := moduleStorageKey(
+		t.keyPrefix,
 		params.AccountHandle,
 		params.ProjectHandle,
 		params.CacheCategory.Or(defaultCacheCategory),
@@ -108,7 +164,7 @@ func (t *tuistCache) DownloadModuleCacheArtifact(
 	infos, err := t.backend.DownloadURLs(ctx, key)
 	if err != nil {
 		if storage.IsNotFoundError(err) {
-			stats.Default().RecordCacheMiss()
+			protocolStats.RecordCacheMiss()
 			return &tuistopenapi.DownloadModuleCacheArtifactNotFound{Message: "artifact not found"}, nil
 		}
 
@@ -122,11 +178,11 @@ func (t *tuistCache) DownloadModuleCacheArtifact(
 		return nil, err
 	}
 	if reader == nil {
-		stats.Default().RecordCacheMiss()
+		protocolStats.RecordCacheMiss()
 		return &tuistopenapi.DownloadModuleCacheArtifactNotFound{Message: "artifact not found"}, nil
 	}
 
-	stats.Default().RecordCacheHit()
+	protocolStats.RecordCacheHit()
 	return &tuistopenapi.DownloadModuleCacheArtifactOK{Data: newStatsReadCloser(reader)}, nil
 }
 
@@ -135,6 +191,7 @@ func (t *tuistCache) StartModuleCacheMultipartUpload(
 	params tuistopenapi.StartModuleCacheMultipartUploadParams,
 ) (tuistopenapi.StartModuleCacheMultipartUploadRes, error) {
 	key, err := moduleStorageKey(
+		t.keyPrefix,
 		params.AccountHandle,
 		params.ProjectHandle,
 		params.CacheCategory.Or(defaultCacheCategory),
@@ -146,7 +203,7 @@ func (t *tuistCache) StartModuleCacheMultipartUpload(
 	}
 
 	if _, err := t.backend.CacheInfo(ctx, key, nil); err == nil {
-		stats.Default().RecordCacheHit()
+		protocolStats.RecordCacheHit()
 		uploadID := tuistopenapi.NilString{}
 		uploadID.SetToNull()
 		return &tuistopenapi.StartMultipartUploadResponse{UploadID: uploadID}, nil
@@ -154,15 +211,19 @@ func (t *tuistCache) StartModuleCacheMultipartUpload(
 		slog.ErrorContext(ctx, "tuist multipart preflight failed", "key", key, "err", err)
 		return nil, err
 	}
-	stats.Default().RecordCacheMiss()
+	protocolStats.RecordCacheMiss()
 
 	backendUploadID, err := t.backend.CreateMultipartUpload(ctx, key, nil)
+	if errors.Is(err, storage.ErrQuotaExceeded) || errors.Is(err, storage.ErrReadOnly) {
+		// The Tuist API has no 413 response for this endpoint.
+		return &tuistopenapi.StartModuleCacheMultipartUploadForbidden{Message: err.Error()}, nil
+	}
 	if err != nil {
 		slog.ErrorContext(ctx, "tuist create multipart upload failed", "key", key, "err", err)
 		return nil, err
 	}
 
-	uploadID := t.uploads.create(key, backendUploadID)
+	uploadID := t.uploads.create(ctx, key, backendUploadID)
 	return &tuistopenapi.StartMultipartUploadResponse{
 		UploadID: tuistopenapi.NewNilString(uploadID),
 	}, nil
@@ -177,12 +238,12 @@ func (t *tuistCache) UploadModuleCachePart(
 		return &tuistopenapi.UploadModuleCachePartBadRequest{Message: "part_number must be a positive integer"}, nil
 	}
 
-	partData, err := readPartBody(req.Data, maxPartSizeBytes)
+	partData, err := readPartBody(req.Data, t.maxPartSize)
 	if err != nil {
 		switch {
 		case errors.Is(err, errPartTooLarge):
-			return &tuistopenapi.UploadModuleCachePartRequestEntityTooLarge{Message: "part exceeds 10MB limit"}, nil
-		case errors.Is(err, context.DeadlineExceeded):
+			return t.partTooLarge(), nil
+		case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
 			return &tuistopenapi.UploadModuleCachePartRequestTimeout{Message: "request body read timed out"}, nil
 		default:
 			slog.ErrorContext(ctx, "tuist read multipart part failed", "uploadID", params.UploadID, "partNumber", params.PartNumber, "err", err)
@@ -190,26 +251,31 @@ func (t *tuistCache) UploadModuleCachePart(
 		}
 	}
 
-	key, backendUploadID, err := t.uploads.preparePart(params.UploadID, int64(len(partData)))
+	t.uploads.restore(ctx, params.UploadID, nil)
+	key, backendUploadID, err := t.uploads.preparePart(params.UploadID, int64(len(partData)), t.maxPartSize)
 	if err != nil {
 		switch {
 		case errors.Is(err, errUploadNotFound):
 			return &tuistopenapi.UploadModuleCachePartNotFound{Message: "upload not found"}, nil
 		case errors.Is(err, errPartTooLarge):
-			return &tuistopenapi.UploadModuleCachePartRequestEntityTooLarge{Message: "part exceeds 10MB limit"}, nil
+			return t.partTooLarge(), nil
 		default:
 			slog.ErrorContext(ctx, "tuist prepare multipart part failed", "uploadID", params.UploadID, "partNumber", params.PartNumber, "err", err)
 			return nil, err
 		}
 	}
 
+	if t.partUploads != nil {
+		return t.enqueuePartUpload(ctx, params, key, backendUploadID, partData)
+	}
+
 	etag, err := t.uploadPartToBackend(ctx, key, backendUploadID, params.PartNumber, partData)
 	if err != nil {
 		slog.ErrorContext(ctx, "tuist upload multipart part failed", "uploadID", params.UploadID, "partNumber", params.PartNumber, "err", err)
 		return nil, err
 	}
 
-	if err := t.uploads.setPart(params.UploadID, params.PartNumber, etag, int64(len(partData))); err != nil {
+	if err := t.uploads.setPart(ctx, params.UploadID, params.PartNumber, etag, int64(len(partData))); err != nil {
 		switch {
 		case errors.Is(err, errUploadNotFound):
 			return &tuistopenapi.UploadModuleCachePartNotFound{Message: "upload not found"}, nil
@@ -236,8 +302,19 @@ func (t *tuistCache) CompleteModuleCacheMultipartUpload(
 		}
 	}
 
+	// Sessions lost to a restart or expiry are restored from the persistent store,
+	// if any. Parts acknowledged before reaching the backend must land before we can
+	// resolve their ETags.
+	t.uploads.restore(ctx, params.UploadID, req.Parts)
+	if err := t.uploads.waitPending(ctx, params.UploadID); err != nil {
+		if errors.Is(err, errUploadNotFound) {
+			return &tuistopenapi.CompleteModuleCacheMultipartUploadNotFound{Message: "upload not found"}, nil
+		}
+		return nil, err
+	}
+
 	// Tuist sends only ordered part numbers here; key/backend upload ID and part
-	// ETags are resolved from the in-memory upload session.
+	// ETags are resolved from the upload session.
 	completion, err := t.uploads.complete(params.UploadID, req.Parts)
 	if err != nil {
 		switch {
@@ -245,6 +322,9 @@ func (t *tuistCache) CompleteModuleCacheMultipartUpload(
 			return &tuistopenapi.CompleteModuleCacheMultipartUploadNotFound{Message: "upload not found"}, nil
 		case errors.Is(err, errPartsMismatch):
 			return &tuistopenapi.CompleteModuleCacheMultipartUploadBadRequest{Message: "parts mismatch or missing parts"}, nil
+		case errors.Is(err, errPartFailed):
+			slog.ErrorContext(ctx, "tuist complete multipart found failed part", "uploadID", params.UploadID, "err", err)
+			return &tuistopenapi.CompleteModuleCacheMultipartUploadInternalServerError{Message: "a part failed to upload; re-upload it and retry"}, nil
 		default:
 			slog.ErrorContext(ctx, "tuist complete multipart pre-commit failed", "uploadID", params.UploadID, "err", err)
 			return &tuistopenapi.CompleteModuleCacheMultipartUploadInternalServerError{Message: "failed to complete multipart upload"}, nil
@@ -255,12 +335,114 @@ func (t *tuistCache) CompleteModuleCacheMultipartUpload(
 		slog.ErrorContext(ctx, "tuist complete multipart commit failed", "uploadID", params.UploadID, "key", completion.key, "err", err)
 		return &tuistopenapi.CompleteModuleCacheMultipartUploadInternalServerError{Message: "failed to complete multipart upload"}, nil
 	}
-	stats.Default().RecordUpload(completion.totalBytes, time.Since(completion.startedAt))
-	t.uploads.finalize(params.UploadID)
+	protocolStats.RecordUpload(completion.totalBytes, time.Since(completion.startedAt))
+	t.uploads.finalize(ctx, params.UploadID)
 
 	return &tuistopenapi.CompleteModuleCacheMultipartUploadNoContent{}, nil
 }
 
+// CleanProjectCache deletes every module artifact stored for the project. Keys are
+// collected before deleting so backends aren't modified while being listed.
+//
+// Without a key prefix, project prefixes can overlap the keys of other protocols sharing
+// the backend, such as bazel/cas/, so cleaning is refused then.
+func (t *tuistCache) CleanProjectCache(
+	ctx context.Context,
+	params tuistopenapi.CleanProjectCacheParams,
+) (tuistopenapi.CleanProjectCacheRes, error) {
+	listable, canList := t.backend.(storage.ListableBlobStorageBackend)
+	deletable, canDelete := t.backend.(storage.DeletableBlobStorageBackend)
+	if !canList || !canDelete {
+		return &tuistopenapi.CleanProjectCacheForbidden{Message: "storage backend does not support cleaning"}, nil
+	}
+	if t.keyPrefix == "" && t.sharedStorage {
+		return &tuistopenapi.CleanProjectCacheForbidden{
+			Message: "cleaning requires a Tuist key prefix when other protocols share the storage",
+		}, nil
+	}
+	for _, handle := range []string{params.AccountHandle, params.ProjectHandle} {
+		if !validHandle(handle) {
+			return &tuistopenapi.CleanProjectCacheForbidden{Message: fmt.Sprintf("invalid handle %q", handle)}, nil
+		}
+	}
+
+	prefix := projectStoragePrefix(t.keyPrefix, params.AccountHandle, params.ProjectHandle) + "module/"
+
+	var keys []string
+	err := listable.List(ctx, prefix, func(info storage.ObjectInfo) error {
+		keys = append(keys, info.Key)
+		return nil
+	})
+	if errors.Is(err, errors.ErrUnsupported) {
+		return &tuistopenapi.CleanProjectCacheForbidden{Message: "storage backend does not support cleaning"}, nil
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "tuist clean listing failed", "prefix", prefix, "err", err)
+		return &tuistopenapi.CleanProjectCacheInternalServerError{Message: "failed to list project cache"}, nil
+	}
+
+	for _, key := range keys {
+		err := deletable.Delete(ctx, key)
+		switch {
+		case err == nil, storage.IsNotFoundError(err):
+		case errors.Is(err, storage.ErrReadOnly), errors.Is(err, errors.ErrUnsupported):
+			return &tuistopenapi.CleanProjectCacheForbidden{Message: err.Error()}, nil
+		default:
+			slog.ErrorContext(ctx, "tuist clean delete failed", "key", key, "err", err)
+			return &tuistopenapi.CleanProjectCacheInternalServerError{Message: "failed to clean project cache"}, nil
+		}
+	}
+
+	return &tuistopenapi.CleanProjectCacheNoContent{}, nil
+}
+
+// enqueuePartUpload acknowledges a buffered part right away and uploads it to the
+// backend in the background. Completion waits for it via the upload session.
+// If the same part number is in flight twice, the upload that finishes last wins,
+// which matches the object S3 ends up holding for that part.
+func (t *tuistCache) enqueuePartUpload(
+	ctx context.Context,
+	params tuistopenapi.UploadModuleCachePartParams,
+	key string,
+	backendUploadID string,
+	partData []byte,
+) (tuistopenapi.UploadModuleCachePartRes, error) {
+	attempt, done, err := t.uploads.beginPart(params.UploadID, params.PartNumber)
+	if err != nil {
+		if errors.Is(err, errUploadNotFound) {
+			return &tuistopenapi.UploadModuleCachePartNotFound{Message: "upload not found"}, nil
+		}
+		return nil, err
+	}
+
+	select {
+	case t.partUploads <- struct{}{}:
+	case <-ctx.Done():
+		done()
+		return nil, ctx.Err()
+	}
+
+	uploadCtx := context.WithoutCancel(ctx)
+	go func() {
+		defer done()
+		defer func() {
+			<-t.partUploads
+		}()
+
+		etag, err := t.uploadPartToBackend(uploadCtx, key, backendUploadID, params.PartNumber, partData)
+		if err != nil {
+			slog.ErrorContext(uploadCtx, "tuist background multipart part upload failed", "uploadID", params.UploadID, "partNumber", params.PartNumber, "err", err)
+			_ = t.uploads.failPart(params.UploadID, params.PartNumber, attempt, err)
+			return
+		}
+		if err := t.uploads.setPart(uploadCtx, params.UploadID, params.PartNumber, etag, int64(len(partData))); err != nil {
+			slog.WarnContext(uploadCtx, "tuist record background multipart part failed", "uploadID", params.UploadID, "partNumber", params.PartNumber, "err", err)
+		}
+	}()
+
+	return &tuistopenapi.UploadModuleCachePartNoContent{}, nil
+}
+
 func (t *tuistCache) openDownloadStream(ctx context.Context, infos []*storage.URLInfo) (io.ReadCloser, error) {
 	var lastErr error
 
@@ -350,7 +532,7 @@ func (t *tuistCache) uploadPartToBackend(
 	return etag, nil
 }
 
-func moduleStorageKey(accountHandle, projectHandle, category, hash, name string) (string, error) {
+func moduleStorageKey(keyPrefix, accountHandle, projectHandle, category, hash, name string) (string, error) {
 	if len(hash) < 4 {
 		return "", fmt.Errorf("hash must be at least 4 characters")
 	}
@@ -358,10 +540,8 @@ func moduleStorageKey(accountHandle, projectHandle, category, hash, name string)
 	shard1 := hash[:2]
 	shard2 := hash[2:4]
 
-	return fmt.Sprintf(
-		"%s/%s/module/%s/%s/%s/%s/%s",
-		accountHandle,
-		projectHandle,
+	return projectStoragePrefix(keyPrefix, accountHandle, projectHandle) + fmt.Sprintf(
+		"module/%s/%s/%s/%s/%s",
 		category,
 		shard1,
 		shard2,
@@ -370,8 +550,29 @@ func moduleStorageKey(accountHandle, projectHandle, category, hash, name string)
 	), nil
 }
 
+// projectStoragePrefix returns the prefix, ending in a slash, under which all of a
+// project's artifacts are stored.
+func projectStoragePrefix(keyPrefix, accountHandle, projectHandle string) string {
+	if keyPrefix != "" {
+		keyPrefix += "/"
+	}
+	return keyPrefix + accountHandle + "/" + projectHandle + "/"
+}
+
+// validHandle reports whether an account or project handle can be used as a single key
+// segment, so that a project prefix can't reach beyond the project.
+func validHandle(handle string) bool {
+	return handle != "" && !strings.ContainsAny(handle, "/.")
+}
+
 var errPartTooLarge = errors.New("part too large")
 
+func (t *tuistCache) partTooLarge() *tuistopenapi.UploadModuleCachePartRequestEntityTooLarge {
+	return &tuistopenapi.UploadModuleCachePartRequestEntityTooLarge{
+		Message: fmt.Sprintf("part exceeds %s limit", humanize.IBytes(uint64(t.maxPartSize))),
+	}
+}
+
 func readPartBody(body io.Reader, maxBytes int64) ([]byte, error) {
 	if body == nil {
 		return nil, nil
@@ -436,5 +637,5 @@ func (r *statsReadCloser) record() {
 		return
 	}
 	r.recorded = true
-	stats.Default().RecordDownload(r.bytesRead, time.Since(r.startedAt))
+	protocolStats.RecordDownload(r.bytesRead, time.Since(r.startedAt))
 }
@@ -1,10 +1,12 @@
 package tuist_cache_test
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
@@ -13,9 +15,13 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	httpcache "github.com/cirruslabs/omni-cache/internal/protocols/http_cache"
 	tuistcache "github.com/cirruslabs/omni-cache/internal/protocols/tuist_cache"
 	"github.com/cirruslabs/omni-cache/internal/testutil"
+	"github.com/cirruslabs/omni-cache/pkg/kvstore"
+	"github.com/cirruslabs/omni-cache/pkg/protocols"
 	"github.com/cirruslabs/omni-cache/pkg/server"
 	"github.com/cirruslabs/omni-cache/pkg/stats"
 	"github.com/cirruslabs/omni-cache/pkg/storage"
@@ -151,6 +157,30 @@ func TestModuleCacheMultipartRoundTrip(t *testing.T) {
 	require.Nil(t, secondUploadID)
 }
 
+func TestModuleCacheMultipartReuploadedPart(t *testing.T) {
+	baseURL := startTuistCacheServer(t)
+	client := &http.Client{}
+
+	query := moduleQuery("acme", "ios-app", "cdef1234", "artifact.zip", "builds")
+	uploadID := startMultipartUpload(t, client, baseURL, query)
+	require.NotNil(t, uploadID)
+
+	// A client retry re-uploads part 1; the latest upload wins on completion.
+	uploadPart(t, client, baseURL, "acme", "ios-app", *uploadID, 1, []byte("first attempt"))
+	uploadPart(t, client, baseURL, "acme", "ios-app", *uploadID, 1, []byte("retry"))
+
+	completeMultipartUpload(t, client, baseURL, "acme", "ios-app", *uploadID, []int{1}, http.StatusNoContent)
+
+	getResp, err := client.Get(baseURL + moduleBasePath + "/cdef1234?" + query.Encode())
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, getResp.StatusCode)
+
+	data, err := io.ReadAll(getResp.Body)
+	require.NoError(t, err)
+	require.NoError(t, getResp.Body.Close())
+	require.Equal(t, []byte("retry"), data)
+}
+
 func TestModuleCacheMultipartErrors(t *testing.T) {
 	baseURL := startTuistCacheServer(t)
 	client := &http.Client{}
@@ -191,6 +221,41 @@ func TestModuleCacheMultipartErrors(t *testing.T) {
 	completeMultipartUpload(t, client, baseURL, "acme", "ios-app", *mismatchUploadID, []int{2}, http.StatusBadRequest)
 }
 
+func TestModuleCacheConfigurableMaxPartSize(t *testing.T) {
+	const configuredMaxPartSizeBytes = 16 * 1024 * 1024
+
+	baseURL := startTuistCacheServerWithFactory(t, testutil.NewMultipartStorage(t), tuistcache.Factory{
+		Options: tuistcache.Options{MaxPartSizeBytes: configuredMaxPartSizeBytes},
+	})
+	client := &http.Client{}
+
+	uploadID := startMultipartUpload(t, client, baseURL, moduleQuery("acme", "ios-app", "dddd1234", "large.zip", "builds"))
+	require.NotNil(t, uploadID)
+
+	// Parts above the default 10MB limit are accepted up to the configured limit.
+	uploadPart(t, client, baseURL, "acme", "ios-app", *uploadID, 1, bytes.Repeat([]byte{'x'}, maxPartSizeBytes+1))
+	completeMultipartUpload(t, client, baseURL, "acme", "ios-app", *uploadID, []int{1}, http.StatusNoContent)
+
+	tooLargeUploadID := startMultipartUpload(t, client, baseURL, moduleQuery("acme", "ios-app", "eeee1234", "big.zip", "builds"))
+	require.NotNil(t, tooLargeUploadID)
+
+	tooLargeReq, err := http.NewRequest(
+		http.MethodPost,
+		baseURL+modulePartPath+"?"+partQuery("acme", "ios-app", *tooLargeUploadID, 1).Encode(),
+		bytes.NewReader(bytes.Repeat([]byte{'x'}, configuredMaxPartSizeBytes+1)),
+	)
+	require.NoError(t, err)
+	tooLargeReq.Header.Set("Content-Type", "application/octet-stream")
+	tooLargeResp, err := client.Do(tooLargeReq)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusRequestEntityTooLarge, tooLargeResp.StatusCode)
+
+	var errResp errorResponse
+	require.NoError(t, json.NewDecoder(tooLargeResp.Body).Decode(&errResp))
+	require.Equal(t, "part exceeds 16 MiB limit", errResp.Message)
+	require.NoError(t, tooLargeResp.Body.Close())
+}
+
 func TestUnimplementedEndpointsReturnNotImplemented(t *testing.T) {
 	baseURL := startTuistCacheServer(t)
 	client := &http.Client{}
@@ -200,7 +265,7 @@ func TestUnimplementedEndpointsReturnNotImplemented(t *testing.T) {
 		"project_handle": []string{"ios-app"},
 	}
 
-	req, err := http.NewRequest(http.MethodDelete, baseURL+tuistPrefix+"/api/cache/clean?"+values.Encode(), nil)
+	req, err := http.NewRequest(http.MethodGet, baseURL+tuistPrefix+"/api/cache/keyvalue/abcd1234?"+values.Encode(), nil)
 	require.NoError(t, err)
 
 	resp, err := client.Do(req)
@@ -209,6 +274,69 @@ func TestUnimplementedEndpointsReturnNotImplemented(t *testing.T) {
 	require.NoError(t, resp.Body.Close())
 }
 
+func TestCleanProjectCache(t *testing.T) {
+	baseURL := startTuistCacheServerWithStorage(t, testutil.NewMemoryStorage(t))
+	client := &http.Client{}
+
+	queries := []url.Values{
+		moduleQuery("acme", "ios-app", "abcd1234", "first.zip", "builds"),
+		moduleQuery("acme", "ios-app", "efab5678", "second.zip", "tests"),
+		moduleQuery("acme", "ios-app-extras", "abcd1234", "first.zip", "builds"),
+	}
+	for _, query := range queries {
+		uploadID := startMultipartUpload(t, client, baseURL, query)
+		require.NotNil(t, uploadID)
+		uploadPart(t, client, baseURL, query.Get("account_handle"), query.Get("project_handle"), *uploadID, 1, []byte("payload"))
+		completeMultipartUpload(t, client, baseURL, query.Get("account_handle"), query.Get("project_handle"), *uploadID, []int{1}, http.StatusNoContent)
+		require.Equal(t, http.StatusNoContent, moduleHeadStatus(t, client, baseURL, query))
+	}
+
+	require.Equal(t, http.StatusNoContent, cleanProjectStatus(t, client, baseURL, "acme", "ios-app"))
+
+	require.Equal(t, http.StatusNotFound, moduleHeadStatus(t, client, baseURL, queries[0]))
+	require.Equal(t, http.StatusNotFound, moduleHeadStatus(t, client, baseURL, queries[1]))
+	// Projects whose handle merely shares the prefix are left alone.
+	require.Equal(t, http.StatusNoContent, moduleHeadStatus(t, client, baseURL, queries[2]))
+}
+
+func TestCleanProjectCacheKeepsOtherProtocolsObjects(t *testing.T) {
+	ctx := context.Background()
+	backend, err := storage.NewMemoryStorage()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = backend.Close()
+	})
+	others := []string{"bazel/cas/abcd1234", "acme/ios-app/notes.txt", "tuist/acme/ios-app/notes.txt"}
+	for _, key := range others {
+		require.NoError(t, backend.Put(ctx, key, strings.NewReader("other"), nil))
+	}
+	client := &http.Client{}
+
+	// Without a Tuist prefix, project prefixes overlap the other protocols' keys.
+	unprefixed := startServerWithFactories(t, backend, tuistcache.Factory{}, httpcache.Factory{})
+	require.Equal(t, http.StatusForbidden, cleanProjectStatus(t, client, unprefixed, "bazel", "cas"))
+
+	prefixed := startServerWithFactories(t, backend, tuistcache.Factory{
+		Options: tuistcache.Options{KeyPrefix: "tuist"},
+	}, httpcache.Factory{})
+	query := moduleQuery("acme", "ios-app", "abcd1234", "first.zip", "builds")
+	uploadID := startMultipartUpload(t, client, prefixed, query)
+	require.NotNil(t, uploadID)
+	uploadPart(t, client, prefixed, "acme", "ios-app", *uploadID, 1, []byte("payload"))
+	completeMultipartUpload(t, client, prefixed, "acme", "ios-app", *uploadID, []int{1}, http.StatusNoContent)
+
+	require.Equal(t, http.StatusForbidden, cleanProjectStatus(t, client, prefixed, "..", "ios-app"))
+	require.Equal(t, http.StatusForbidden, cleanProjectStatus(t, client, prefixed, "acme", "ios-app/module"))
+	require.Equal(t, http.StatusForbidden, cleanProjectStatus(t, client, prefixed, "acme", ""))
+	require.Equal(t, http.StatusNoContent, cleanProjectStatus(t, client, prefixed, "acme", "ios-app"))
+
+	require.Equal(t, http.StatusNotFound, moduleHeadStatus(t, client, prefixed, query))
+	for _, key := range others {
+		_, err := backend.CacheInfo(ctx, key, nil)
+		require.NoError(t, err, key)
+	}
+}
+
 func TestCompleteCanRetryAfterCommitFailure(t *testing.T) {
 	backend := &failOnceCommitBackend{MultipartBlobStorageBackend: testutil.NewMultipartStorage(t)}
 	baseURL := startTuistCacheServerWithStorage(t, backend)
@@ -224,6 +352,65 @@ func TestCompleteCanRetryAfterCommitFailure(t *testing.T) {
 	completeMultipartUpload(t, client, baseURL, "acme", "ios-app", *uploadID, []int{1}, http.StatusNoContent)
 }
 
+func TestModuleCacheAsyncPartUploads(t *testing.T) {
+	backend := &failOncePartBackend{MultipartBlobStorageBackend: testutil.NewMultipartStorage(t), failPart: 2}
+	baseURL := startTuistCacheServerWithFactory(t, backend, tuistcache.Factory{
+		Options: tuistcache.Options{AsyncPartUploads: 2},
+	})
+	client := &http.Client{}
+
+	query := moduleQuery("acme", "ios-app", "dddd1234", "artifact.zip", "builds")
+	uploadID := startMultipartUpload(t, client, baseURL, query)
+	require.NotNil(t, uploadID)
+
+	part1 := bytes.Repeat([]byte("a"), minPartSizeBytes)
+	part2 := []byte("world")
+	uploadPart(t, client, baseURL, "acme", "ios-app", *uploadID, 1, part1)
+	uploadPart(t, client, baseURL, "acme", "ios-app", *uploadID, 2, part2)
+
+	// Part 2 failed in the background, so completion reports it instead of committing.
+	completeMultipartUpload(t, client, baseURL, "acme", "ios-app", *uploadID, []int{1, 2}, http.StatusInternalServerError)
+
+	uploadPart(t, client, baseURL, "acme", "ios-app", *uploadID, 2, part2)
+	completeMultipartUpload(t, client, baseURL, "acme", "ios-app", *uploadID, []int{1, 2}, http.StatusNoContent)
+
+	getResp, err := client.Get(baseURL + moduleBasePath + "/dddd1234?" + query.Encode())
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, getResp.StatusCode)
+
+	data, err := io.ReadAll(getResp.Body)
+	require.NoError(t, err)
+	require.NoError(t, getResp.Body.Close())
+	require.Equal(t, append(append([]byte{}, part1...), part2...), data)
+}
+
+func TestModuleCachePartReadTimeout(t *testing.T) {
+	baseURL := startTuistCacheServerWithFactory(t, testutil.NewMemoryStorage(t), tuistcache.Factory{
+		Options: tuistcache.Options{PartReadTimeout: 200 * time.Millisecond},
+	})
+	client := &http.Client{}
+
+	query := moduleQuery("acme", "ios-app", "eeee1234", "artifact.zip", "builds")
+	uploadID := startMultipartUpload(t, client, baseURL, query)
+	require.NotNil(t, uploadID)
+
+	// Promise a larger body than is sent and stall, like a client that hung mid-upload.
+	conn, err := net.Dial("tcp", strings.TrimPrefix(baseURL, "http://"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	_, err = fmt.Fprintf(conn, "POST %s?%s HTTP/1.1\r\nHost: cache\r\nContent-Type: application/octet-stream\r\nContent-Length: 1024\r\n\r\npartial",
+		modulePartPath, partQuery("acme", "ios-app", *uploadID, 1).Encode())
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(10*time.Second)))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusRequestTimeout, resp.StatusCode)
+}
+
 func startTuistCacheServer(t *testing.T) string {
 	t.Helper()
 
@@ -233,10 +420,22 @@ func startTuistCacheServer(t *testing.T) string {
 func startTuistCacheServerWithStorage(t *testing.T, stor storage.MultipartBlobStorageBackend) string {
 	t.Helper()
 
+	return startTuistCacheServerWithFactory(t, stor, tuistcache.Factory{})
+}
+
+func startTuistCacheServerWithFactory(t *testing.T, stor storage.MultipartBlobStorageBackend, factory tuistcache.Factory) string {
+	t.Helper()
+
+	return startServerWithFactories(t, stor, factory)
+}
+
+func startServerWithFactories(t *testing.T, stor storage.MultipartBlobStorageBackend, factories ...protocols.Factory) string {
+	t.Helper()
+
 	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	require.NoError(t, err)
 
-	srv, err := server.Start(t.Context(), []net.Listener{listener}, stor, tuistcache.Factory{})
+	srv, err := server.Start(t.Context(), []net.Listener{listener}, stor, factories...)
 	require.NoError(t, err)
 	t.Cleanup(func() {
 		_ = srv.Shutdown(context.Background())
@@ -273,6 +472,32 @@ func (b *failOnceCommitBackend) CommitMultipartUpload(
 	return b.MultipartBlobStorageBackend.CommitMultipartUpload(ctx, key, uploadID, parts)
 }
 
+type failOncePartBackend struct {
+	storage.MultipartBlobStorageBackend
+
+	mu       sync.Mutex
+	failPart uint32
+	failed   bool
+}
+
+func (b *failOncePartBackend) UploadPartURL(
+	ctx context.Context,
+	key string,
+	uploadID string,
+	partNumber uint32,
+	contentLength uint64,
+) (*storage.URLInfo, error) {
+	b.mu.Lock()
+	if partNumber == b.failPart && !b.failed {
+		b.failed = true
+		b.mu.Unlock()
+		return nil, errors.New("simulated part upload failure")
+	}
+	b.mu.Unlock()
+
+	return b.MultipartBlobStorageBackend.UploadPartURL(ctx, key, uploadID, partNumber, contentLength)
+}
+
 func moduleQuery(account, project, hash, name, category string) url.Values {
 	values := url.Values{
 		"account_handle": []string{account},
@@ -296,6 +521,123 @@ func partQuery(account, project, uploadID string, partNumber int) url.Values {
 	return values
 }
 
+func TestCompleteAfterLosingUploadSessions(t *testing.T) {
+	backend := testutil.NewMemoryStorage(t)
+	factory := tuistcache.Factory{Options: tuistcache.Options{SessionStore: kvstore.NewMemoryStore()}}
+	client := &http.Client{}
+
+	query := moduleQuery("acme", "ios-app", "abcd1234", "artifact.zip", "builds")
+	baseURL := startTuistCacheServerWithFactory(t, backend, factory)
+	uploadID := startMultipartUpload(t, client, baseURL, query)
+	require.NotNil(t, uploadID)
+	uploadPart(t, client, baseURL, "acme", "ios-app", *uploadID, 1, []byte("first "))
+
+	// A restarted sidecar has no sessions in memory, but restores them from the store.
+	restartedURL := startTuistCacheServerWithFactory(t, backend, factory)
+	uploadPart(t, client, restartedURL, "acme", "ios-app", *uploadID, 2, []byte("second"))
+
+	restartedAgainURL := startTuistCacheServerWithFactory(t, backend, factory)
+	completeMultipartUpload(t, client, restartedAgainURL, "acme", "ios-app", *uploadID, []int{1, 2}, http.StatusNoContent)
+
+	resp, err := client.Get(restartedAgainURL + moduleBasePath + "/abcd1234?" + query.Encode())
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "first second", string(body))
+}
+
+func TestModuleCacheMultiExists(t *testing.T) {
+	baseURL := startTuistCacheServerWithStorage(t, testutil.NewMemoryStorage(t))
+	client := &http.Client{}
+
+	for _, query := range []url.Values{
+		moduleQuery("acme", "ios-app", "abcd1234", "first.zip", "builds"),
+		moduleQuery("acme", "ios-app", "efab5678", "second.zip", "builds"),
+	} {
+		uploadID := startMultipartUpload(t, client, baseURL, query)
+		require.NotNil(t, uploadID)
+		uploadPart(t, client, baseURL, "acme", "ios-app", *uploadID, 1, []byte("payload"))
+		completeMultipartUpload(t, client, baseURL, "acme", "ios-app", *uploadID, []int{1}, http.StatusNoContent)
+	}
+
+	values := url.Values{
+		"account_handle": []string{"acme"},
+		"project_handle": []string{"ios-app"},
+	}
+	multiExists := func(body string) *http.Response {
+		resp, err := client.Post(baseURL+tuistPrefix+"/api/cache/multi-exists?"+values.Encode(), "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = resp.Body.Close()
+		})
+		return resp
+	}
+
+	resp := multiExists(`[
+		{"hash": "abcd1234", "name": "first.zip"},
+		{"hash": "abcd1234", "name": "missing.zip"},
+		{"hash": "efab5678", "name": "second.zip"},
+		{"hash": "99999999", "name": "first.zip"}
+	]`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var result struct {
+		Artifacts []struct {
+			Hash   string `json:"hash"`
+			Name   string `json:"name"`
+			Exists bool   `json:"exists"`
+		} `json:"artifacts"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+
+	presence := map[string]bool{}
+	for _, artifact := range result.Artifacts {
+		presence[artifact.Hash+"/"+artifact.Name] = artifact.Exists
+	}
+	require.Equal(t, map[string]bool{
+		"abcd1234/first.zip":   true,
+		"abcd1234/missing.zip": false,
+		"efab5678/second.zip":  true,
+		"99999999/first.zip":   false,
+	}, presence)
+
+	resp = multiExists(`[{"hash": "ab", "name": "first.zip"}]`)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = multiExists(`{"hash": "abcd1234"}`)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func cleanProjectStatus(t *testing.T, client *http.Client, baseURL string, accountHandle string, projectHandle string) int {
+	t.Helper()
+
+	values := url.Values{
+		"account_handle": []string{accountHandle},
+		"project_handle": []string{projectHandle},
+	}
+	req, err := http.NewRequest(http.MethodDelete, baseURL+tuistPrefix+"/api/cache/clean?"+values.Encode(), nil)
+	require.NoError(t, err)
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	return resp.StatusCode
+}
+
+func moduleHeadStatus(t *testing.T, client *http.Client, baseURL string, query url.Values) int {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodHead, baseURL+moduleBasePath+"/"+query.Get("hash")+"?"+query.Encode(), nil)
+	require.NoError(t, err)
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	return resp.StatusCode
+}
+
 func startMultipartUpload(t *testing.T, client *http.Client, baseURL string, query url.Values) *string {
 	t.Helper()
 
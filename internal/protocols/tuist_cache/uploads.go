@@ -2,11 +2,14 @@ package tuist_cache
 
 import (
 	"cmp"
+	"context"
 	"errors"
+	"fmt"
 	"slices"
 	"sync"
 	"time"
 
+	"github.com/cirruslabs/omni-cache/pkg/kvstore"
 	"github.com/cirruslabs/omni-cache/pkg/storage"
 	"github.com/google/uuid"
 )
@@ -14,6 +17,7 @@ import (
 var (
 	errUploadNotFound = errors.New("upload not found")
 	errPartsMismatch  = errors.New("parts mismatch")
+	errPartFailed     = errors.New("part upload failed")
 )
 
 type uploadStore struct {
@@ -21,6 +25,10 @@ type uploadStore struct {
 	now      func() time.Time
 	ttl      time.Duration
 	sessions map[string]*uploadSession
+
+	// persistent, when set, also records sessions and their parts so that they can be
+	// restored after a restart or after expiring from memory.
+	persistent kvstore.Store
 }
 
 type uploadSession struct {
@@ -30,8 +38,15 @@ type uploadSession struct {
 	backendUploadID string
 	parts           map[int]storage.MultipartUploadPart
 	partSizes       map[int]int64
+	failedParts     map[int]error
+	pendingParts    int
+	drained         chan struct{}
 	startedAt       time.Time
 	lastTouchedAt   time.Time
+
+	// partAttempts counts the background uploads started for each part number, so
+	// that only the latest one's failure is recorded.
+	partAttempts map[int]int
 }
 
 type completedUpload struct {
@@ -57,26 +72,34 @@ func newUploadStore(now func() time.Time, ttl time.Duration) *uploadStore {
 	}
 }
 
-func (s *uploadStore) create(key string, backendUploadID string) string {
+func (s *uploadStore) create(ctx context.Context, key string, backendUploadID string) string {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-
 	s.cleanupExpired()
 
 	uploadID := uuid.NewString()
-	s.sessions[uploadID] = &uploadSession{
+	session := newUploadSession(key, backendUploadID, s.now())
+	s.sessions[uploadID] = session
+	s.mu.Unlock()
+
+	s.persistSession(ctx, uploadID, session)
+
+	return uploadID
+}
+
+func newUploadSession(key string, backendUploadID string, startedAt time.Time) *uploadSession {
+	return &uploadSession{
 		key:             key,
 		backendUploadID: backendUploadID,
 		parts:           map[int]storage.MultipartUploadPart{},
 		partSizes:       map[int]int64{},
-		startedAt:       s.now(),
-		lastTouchedAt:   s.now(),
+		failedParts:     map[int]error{},
+		partAttempts:    map[int]int{},
+		startedAt:       startedAt,
+		lastTouchedAt:   startedAt,
 	}
-
-	return uploadID
 }
 
-func (s *uploadStore) preparePart(uploadID string, partSize int64) (key string, backendUploadID string, err error) {
+func (s *uploadStore) preparePart(uploadID string, partSize int64, maxPartSize int64) (key string, backendUploadID string, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -87,7 +110,7 @@ func (s *uploadStore) preparePart(uploadID string, partSize int64) (key string,
 		return "", "", errUploadNotFound
 	}
 
-	if partSize > maxPartSizeBytes {
+	if partSize > maxPartSize {
 		return "", "", errPartTooLarge
 	}
 	session.lastTouchedAt = s.now()
@@ -95,14 +118,16 @@ func (s *uploadStore) preparePart(uploadID string, partSize int64) (key string,
 	return session.key, session.backendUploadID, nil
 }
 
-func (s *uploadStore) setPart(uploadID string, partNumber int, etag string, sizeBytes int64) error {
+// setPart records the backend ETag of an uploaded part. Re-uploading a part number
+// (e.g. a client retry) replaces the previously recorded ETag and size, matching
+// S3 semantics where the latest upload of a part number wins on commit.
+func (s *uploadStore) setPart(ctx context.Context, uploadID string, partNumber int, etag string, sizeBytes int64) error {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-
 	s.cleanupExpired()
 
 	session, ok := s.sessions[uploadID]
 	if !ok {
+		s.mu.Unlock()
 		return errUploadNotFound
 	}
 
@@ -114,10 +139,92 @@ func (s *uploadStore) setPart(uploadID string, partNumber int, etag string, size
 		sizeBytes = 0
 	}
 	session.partSizes[partNumber] = sizeBytes
+	delete(session.failedParts, partNumber)
+	session.lastTouchedAt = s.now()
+	s.mu.Unlock()
+
+	s.persistPart(ctx, uploadID, partNumber, etag, sizeBytes)
+	return nil
+}
+
+// beginPart registers an upload of partNumber that finishes in the background and
+// returns its attempt, to be passed to failPart. The returned function must be called
+// once the part has been recorded with setPart or failPart.
+func (s *uploadStore) beginPart(uploadID string, partNumber int) (int, func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cleanupExpired()
+
+	session, ok := s.sessions[uploadID]
+	if !ok {
+		return 0, nil, errUploadNotFound
+	}
+	session.partAttempts[partNumber]++
+	attempt := session.partAttempts[partNumber]
+	if session.pendingParts == 0 {
+		session.drained = make(chan struct{})
+	}
+	session.pendingParts++
+	session.lastTouchedAt = s.now()
+
+	var once sync.Once
+	return attempt, func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			session.pendingParts--
+			if session.pendingParts == 0 {
+				close(session.drained)
+			}
+		})
+	}, nil
+}
+
+// failPart records that a background part upload failed, so that complete reports it
+// instead of committing. A later successful upload of the same part number clears it.
+// Failures of attempts superseded by a later beginPart are ignored, so that a slow
+// failing upload can't override the client's retry of the part.
+func (s *uploadStore) failPart(uploadID string, partNumber int, attempt int, err error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[uploadID]
+	if !ok {
+		return errUploadNotFound
+	}
+	if session.partAttempts[partNumber] != attempt {
+		return nil
+	}
+	session.failedParts[partNumber] = err
 	session.lastTouchedAt = s.now()
 	return nil
 }
 
+// waitPending blocks until every part upload started with beginPart has finished.
+func (s *uploadStore) waitPending(ctx context.Context, uploadID string) error {
+	s.mu.Lock()
+	session, ok := s.sessions[uploadID]
+	if !ok {
+		s.mu.Unlock()
+		return errUploadNotFound
+	}
+	if session.pendingParts == 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	drained := session.drained
+	s.mu.Unlock()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (s *uploadStore) complete(uploadID string, requestedParts []int) (*completedUpload, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -129,6 +236,12 @@ func (s *uploadStore) complete(uploadID string, requestedParts []int) (*complete
 		return nil, errUploadNotFound
 	}
 
+	for _, partNumber := range requestedParts {
+		if err, failed := session.failedParts[partNumber]; failed {
+			return nil, fmt.Errorf("%w: part %d: %w", errPartFailed, partNumber, err)
+		}
+	}
+
 	serverParts := make([]int, 0, len(session.parts))
 	for partNumber := range session.parts {
 		serverParts = append(serverParts, partNumber)
@@ -165,11 +278,18 @@ func (s *uploadStore) complete(uploadID string, requestedParts []int) (*complete
 	}, nil
 }
 
-func (s *uploadStore) finalize(uploadID string) {
+func (s *uploadStore) finalize(ctx context.Context, uploadID string) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-
+	var partNumbers []int
+	if session, ok := s.sessions[uploadID]; ok {
+		for partNumber := range session.parts {
+			partNumbers = append(partNumbers, partNumber)
+		}
+	}
 	delete(s.sessions, uploadID)
+	s.mu.Unlock()
+
+	s.forgetPersisted(ctx, uploadID, partNumbers)
 }
 
 func (s *uploadStore) cleanupExpired() {
@@ -0,0 +1,173 @@
+package tuist_cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+)
+
+// DefaultUploadSessionTTL is how long persisted upload sessions are kept. It outlives
+// the in-memory TTL by far, so that slow uploads and sidecar restarts can be resumed.
+const DefaultUploadSessionTTL = 24 * time.Hour
+
+// persistedSession is the part of an upload session needed to resume it: Tuist clients
+// only send our upload ID, which maps to the backend key and upload.
+type persistedSession struct {
+	Key             string    `json:"key"`
+	BackendUploadID string    `json:"backend_upload_id"`
+	StartedAt       time.Time `json:"started_at"`
+}
+
+type persistedPart struct {
+	ETag      string `json:"etag"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
+func persistedSessionKey(uploadID string) string {
+	return "tuist-upload/" + uploadID
+}
+
+// Parts are stored under their own keys, so that concurrent part uploads don't race
+// on a shared record. Completion knows which ones to look up from the request.
+func persistedPartKey(uploadID string, partNumber int) string {
+	return fmt.Sprintf("tuist-upload/%s/part/%d", uploadID, partNumber)
+}
+
+// persistSession records a new session. Persisting is best effort: the in-memory session
+// stays authoritative, so a failure only costs the ability to resume the upload and is
+// logged rather than returned.
+func (s *uploadStore) persistSession(ctx context.Context, uploadID string, session *uploadSession) {
+	if s.persistent == nil {
+		return
+	}
+
+	s.putPersisted(ctx, persistedSessionKey(uploadID), persistedSession{
+		Key:             session.key,
+		BackendUploadID: session.backendUploadID,
+		StartedAt:       session.startedAt,
+	})
+}
+
+func (s *uploadStore) persistPart(ctx context.Context, uploadID string, partNumber int, etag string, sizeBytes int64) {
+	if s.persistent == nil {
+		return
+	}
+
+	s.putPersisted(ctx, persistedPartKey(uploadID, partNumber), persistedPart{ETag: etag, SizeBytes: sizeBytes})
+}
+
+func (s *uploadStore) putPersisted(ctx context.Context, key string, value any) {
+	data, err := json.Marshal(value)
+	if err == nil {
+		err = s.persistent.Put(ctx, key, data)
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "tuist failed to persist upload session", "key", key, "err", err)
+	}
+}
+
+func (s *uploadStore) forgetPersisted(ctx context.Context, uploadID string, partNumbers []int) {
+	if s.persistent == nil {
+		return
+	}
+
+	keys := []string{persistedSessionKey(uploadID)}
+	for _, partNumber := range partNumbers {
+		keys = append(keys, persistedPartKey(uploadID, partNumber))
+	}
+	for _, key := range keys {
+		if err := s.persistent.Delete(ctx, key); err != nil {
+			slog.WarnContext(ctx, "tuist failed to delete persisted upload session", "key", key, "err", err)
+		}
+	}
+}
+
+// restore brings a session that is no longer in memory back from the persistent store,
+// along with those of partNumbers it doesn't know about yet. Sessions still in memory
+// with all of partNumbers recorded are left alone without consulting the store. When
+// nothing can be restored, the session stays unknown and callers report it as not found.
+func (s *uploadStore) restore(ctx context.Context, uploadID string, partNumbers []int) {
+	if s.persistent == nil {
+		return
+	}
+
+	s.mu.Lock()
+	session, inMemory := s.sessions[uploadID]
+	missing := partNumbers
+	if inMemory {
+		missing = nil
+		for _, partNumber := range partNumbers {
+			if _, ok := session.parts[partNumber]; !ok {
+				missing = append(missing, partNumber)
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	if inMemory && len(missing) == 0 {
+		return
+	}
+
+	var restoredSession persistedSession
+	if !inMemory {
+		found, err := s.getPersisted(ctx, persistedSessionKey(uploadID), &restoredSession)
+		if err != nil {
+			slog.WarnContext(ctx, "tuist failed to restore upload session", "uploadID", uploadID, "err", err)
+			return
+		}
+		if !found {
+			return
+		}
+	}
+
+	restoredParts := map[int]persistedPart{}
+	for _, partNumber := range missing {
+		var part persistedPart
+		found, err := s.getPersisted(ctx, persistedPartKey(uploadID, partNumber), &part)
+		if err != nil {
+			slog.WarnContext(ctx, "tuist failed to restore upload part", "uploadID", uploadID, "partNumber", partNumber, "err", err)
+			continue
+		}
+		if found {
+			restoredParts[partNumber] = part
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The session may have been restored concurrently; parts recorded in memory since
+	// are newer than the persisted ones.
+	session, ok := s.sessions[uploadID]
+	if !ok {
+		if inMemory {
+			// Finalized while we were looking up its parts.
+			return
+		}
+		session = newUploadSession(restoredSession.Key, restoredSession.BackendUploadID, restoredSession.StartedAt)
+		s.sessions[uploadID] = session
+	}
+	for partNumber, part := range restoredParts {
+		if _, ok := session.parts[partNumber]; ok {
+			continue
+		}
+		session.parts[partNumber] = storage.MultipartUploadPart{PartNumber: uint32(partNumber), ETag: part.ETag}
+		session.partSizes[partNumber] = part.SizeBytes
+	}
+	session.lastTouchedAt = s.now()
+}
+
+func (s *uploadStore) getPersisted(ctx context.Context, key string, value any) (bool, error) {
+	data, found, err := s.persistent.Get(ctx, key)
+	if err != nil || !found {
+		return false, err
+	}
+	if err := json.Unmarshal(data, value); err != nil {
+		return false, fmt.Errorf("decode %q: %w", key, err)
+	}
+	return true, nil
+}
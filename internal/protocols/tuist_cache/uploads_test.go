@@ -1,9 +1,13 @@
 package tuist_cache
 
 import (
+	"context"
+	"errors"
 	"testing"
 	"time"
 
+	"github.com/cirruslabs/omni-cache/pkg/kvstore"
+	"github.com/cirruslabs/omni-cache/pkg/storage"
 	"github.com/stretchr/testify/require"
 )
 
@@ -11,40 +15,138 @@ func TestUploadStoreRetainsSessionUntilFinalize(t *testing.T) {
 	now := time.Unix(0, 0)
 	store := newUploadStore(func() time.Time { return now }, 5*time.Minute)
 
-	uploadID := store.create("key", "backend-upload")
-	require.NoError(t, store.setPart(uploadID, 1, "etag-1", 10))
+	uploadID := store.create(context.Background(), "key", "backend-upload")
+	require.NoError(t, store.setPart(context.Background(), uploadID, 1, "etag-1", 10))
 
 	completion, err := store.complete(uploadID, []int{1})
 	require.NoError(t, err)
 	require.NotNil(t, completion)
 
-	_, _, err = store.preparePart(uploadID, 1)
+	_, _, err = store.preparePart(uploadID, 1, DefaultMaxPartSizeBytes)
 	require.NoError(t, err)
 
-	store.finalize(uploadID)
+	store.finalize(context.Background(), uploadID)
 
-	_, _, err = store.preparePart(uploadID, 1)
+	_, _, err = store.preparePart(uploadID, 1, DefaultMaxPartSizeBytes)
 	require.ErrorIs(t, err, errUploadNotFound)
 }
 
+func TestUploadStoreReuploadedPartReplacesPrevious(t *testing.T) {
+	store := newUploadStore(time.Now, 5*time.Minute)
+
+	uploadID := store.create(context.Background(), "key", "backend-upload")
+	require.NoError(t, store.setPart(context.Background(), uploadID, 1, "etag-1", 10))
+	require.NoError(t, store.setPart(context.Background(), uploadID, 1, "etag-2", 7))
+
+	completion, err := store.complete(uploadID, []int{1})
+	require.NoError(t, err)
+	require.Len(t, completion.parts, 1)
+	require.Equal(t, "etag-2", completion.parts[0].ETag)
+	require.EqualValues(t, 7, completion.totalBytes)
+}
+
+func TestUploadStoreWaitsForPendingParts(t *testing.T) {
+	store := newUploadStore(time.Now, 5*time.Minute)
+
+	uploadID := store.create(context.Background(), "key", "backend-upload")
+	attempt, done, err := store.beginPart(uploadID, 1)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, store.waitPending(ctx, uploadID), context.DeadlineExceeded)
+
+	require.NoError(t, store.failPart(uploadID, 1, attempt, errors.New("boom")))
+	done()
+	require.NoError(t, store.waitPending(context.Background(), uploadID))
+
+	_, err = store.complete(uploadID, []int{1})
+	require.ErrorIs(t, err, errPartFailed)
+
+	require.NoError(t, store.setPart(context.Background(), uploadID, 1, "etag-1", 10))
+	completion, err := store.complete(uploadID, []int{1})
+	require.NoError(t, err)
+	require.Equal(t, "etag-1", completion.parts[0].ETag)
+}
+
+func TestUploadStoreIgnoresFailuresOfSupersededAttempts(t *testing.T) {
+	store := newUploadStore(time.Now, 5*time.Minute)
+
+	uploadID := store.create(context.Background(), "key", "backend-upload")
+	first, firstDone, err := store.beginPart(uploadID, 1)
+	require.NoError(t, err)
+	_, retryDone, err := store.beginPart(uploadID, 1)
+	require.NoError(t, err)
+
+	// The client's retry succeeds before the first attempt fails.
+	require.NoError(t, store.setPart(context.Background(), uploadID, 1, "etag-retry", 10))
+	retryDone()
+	require.NoError(t, store.failPart(uploadID, 1, first, errors.New("late failure")))
+	firstDone()
+
+	completion, err := store.complete(uploadID, []int{1})
+	require.NoError(t, err)
+	require.Equal(t, "etag-retry", completion.parts[0].ETag)
+}
+
 func TestUploadStoreRefreshesTTLOnActivity(t *testing.T) {
 	now := time.Unix(0, 0)
 	store := newUploadStore(func() time.Time { return now }, 5*time.Minute)
 
-	uploadID := store.create("key", "backend-upload")
+	uploadID := store.create(context.Background(), "key", "backend-upload")
 
 	now = now.Add(4 * time.Minute)
-	_, _, err := store.preparePart(uploadID, 1)
+	_, _, err := store.preparePart(uploadID, 1, DefaultMaxPartSizeBytes)
 	require.NoError(t, err)
 
 	now = now.Add(4 * time.Minute)
-	require.NoError(t, store.setPart(uploadID, 1, "etag-1", 10))
+	require.NoError(t, store.setPart(context.Background(), uploadID, 1, "etag-1", 10))
 
 	now = now.Add(4 * time.Minute)
-	_, _, err = store.preparePart(uploadID, 1)
+	_, _, err = store.preparePart(uploadID, 1, DefaultMaxPartSizeBytes)
 	require.NoError(t, err)
 
 	now = now.Add(6 * time.Minute)
-	_, _, err = store.preparePart(uploadID, 1)
+	_, _, err = store.preparePart(uploadID, 1, DefaultMaxPartSizeBytes)
+	require.ErrorIs(t, err, errUploadNotFound)
+}
+
+func TestUploadStoreRestoresPersistedSession(t *testing.T) {
+	ctx := context.Background()
+	persistent := kvstore.NewMemoryStore()
+
+	original := newUploadStore(time.Now, 5*time.Minute)
+	original.persistent = persistent
+	uploadID := original.create(ctx, "key", "backend-upload")
+	require.NoError(t, original.setPart(ctx, uploadID, 1, "etag-1", 10))
+	require.NoError(t, original.setPart(ctx, uploadID, 2, "etag-2", 5))
+
+	// A fresh store, e.g. after a restart, knows nothing until it restores the session.
+	restarted := newUploadStore(time.Now, 5*time.Minute)
+	restarted.persistent = persistent
+	_, _, err := restarted.preparePart(uploadID, 1, DefaultMaxPartSizeBytes)
+	require.ErrorIs(t, err, errUploadNotFound)
+
+	restarted.restore(ctx, uploadID, []int{1, 2})
+	completion, err := restarted.complete(uploadID, []int{1, 2})
+	require.NoError(t, err)
+	require.Equal(t, "key", completion.key)
+	require.Equal(t, "backend-upload", completion.backendUploadID)
+	require.Equal(t, []storage.MultipartUploadPart{
+		{PartNumber: 1, ETag: "etag-1"},
+		{PartNumber: 2, ETag: "etag-2"},
+	}, completion.parts)
+	require.EqualValues(t, 15, completion.totalBytes)
+
+	restarted.finalize(ctx, uploadID)
+	for _, key := range []string{persistedSessionKey(uploadID), persistedPartKey(uploadID, 1), persistedPartKey(uploadID, 2)} {
+		_, found, err := persistent.Get(ctx, key)
+		require.NoError(t, err)
+		require.False(t, found, key)
+	}
+
+	// Unknown sessions stay unknown.
+	restarted.restore(ctx, "unknown", nil)
+	_, _, err = restarted.preparePart("unknown", 1, DefaultMaxPartSizeBytes)
 	require.ErrorIs(t, err, errUploadNotFound)
 }
@@ -29,9 +29,41 @@ func NewMultipartStorage(t *testing.T) storage.MultipartBlobStorageBackend {
 	return stor
 }
 
+// NewMemoryStorage returns an in-memory backend for tests that don't need S3 semantics,
+// so they run without Docker.
+func NewMemoryStorage(t *testing.T) storage.MultipartBlobStorageBackend {
+	t.Helper()
+
+	stor, err := storage.NewMemoryStorage()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = stor.Close()
+	})
+	return stor
+}
+
 func S3Client(t *testing.T) *s3.Client {
 	t.Helper()
 
+	endpoint := S3Endpoint(t)
+
+	cfg, err := config.LoadDefaultConfig(context.Background(),
+		config.WithRegion("us-east-1"),
+		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider("id", "secret", "")),
+	)
+	require.NoError(t, err)
+
+	return s3.NewFromConfig(cfg, func(options *s3.Options) {
+		options.BaseEndpoint = aws.String(endpoint)
+		options.UsePathStyle = true
+	})
+}
+
+// S3Endpoint starts a LocalStack S3 server and returns its endpoint URL, for tests that
+// build their own clients. It accepts any credentials.
+func S3Endpoint(t *testing.T) string {
+	t.Helper()
+
 	RequireDocker(t)
 
 	ctx := context.Background()
@@ -55,16 +87,5 @@ func S3Client(t *testing.T) *s3.Client {
 	host, err := localstackContainer.Host(ctx)
 	require.NoError(t, err)
 
-	endpoint := fmt.Sprintf("http://%s:%d", host, mappedPort.Int())
-
-	cfg, err := config.LoadDefaultConfig(ctx,
-		config.WithRegion("us-east-1"),
-		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider("id", "secret", "")),
-	)
-	require.NoError(t, err)
-
-	return s3.NewFromConfig(cfg, func(options *s3.Options) {
-		options.BaseEndpoint = aws.String(endpoint)
-		options.UsePathStyle = true
-	})
+	return fmt.Sprintf("http://%s:%d", host, mappedPort.Int())
 }
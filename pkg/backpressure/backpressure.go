@@ -0,0 +1,203 @@
+// Package backpressure sheds incoming requests while the storage backend is slow,
+// so that an overloaded backend doesn't turn into an ever-growing request queue.
+package backpressure
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+)
+
+const (
+	// DefaultCooldown is how long requests are shed once the backend is deemed overloaded.
+	DefaultCooldown = 5 * time.Second
+
+	// smoothing is the weight of the newest sample in the latency moving average.
+	smoothing = 0.2
+)
+
+// Options configures a Monitor.
+type Options struct {
+	// LatencyThreshold is the smoothed backend operation latency above which
+	// requests are shed. Zero disables shedding.
+	LatencyThreshold time.Duration
+	// Cooldown is how long requests are shed after the threshold is exceeded.
+	// Once it elapses, requests are admitted again and latency is re-measured.
+	// Defaults to DefaultCooldown.
+	Cooldown time.Duration
+}
+
+// Monitor tracks a moving average of backend operation latency and decides
+// whether new requests should be shed.
+type Monitor struct {
+	options Options
+	now     func() time.Time
+
+	mu         sync.Mutex
+	average    time.Duration
+	samples    int
+	shedUntil  time.Time
+	isShedding bool
+}
+
+// NewMonitor creates a Monitor with the given options.
+func NewMonitor(options Options) *Monitor {
+	if options.Cooldown <= 0 {
+		options.Cooldown = DefaultCooldown
+	}
+
+	return &Monitor{
+		options: options,
+		now:     time.Now,
+	}
+}
+
+// Enabled reports whether the monitor ever sheds requests.
+func (m *Monitor) Enabled() bool {
+	return m != nil && m.options.LatencyThreshold > 0
+}
+
+// Observe records the latency of a single backend operation.
+func (m *Monitor) Observe(latency time.Duration) {
+	if !m.Enabled() {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.samples == 0 {
+		m.average = latency
+	} else {
+		m.average = time.Duration(smoothing*float64(latency) + (1-smoothing)*float64(m.average))
+	}
+	m.samples++
+
+	if m.average > m.options.LatencyThreshold {
+		if !m.isShedding {
+			slog.Warn("storage backend is slow, shedding requests",
+				"latency", m.average, "threshold", m.options.LatencyThreshold, "cooldown", m.options.Cooldown)
+		}
+		m.isShedding = true
+		m.shedUntil = m.now().Add(m.options.Cooldown)
+	}
+}
+
+// Overloaded reports whether new requests should currently be shed.
+func (m *Monitor) Overloaded() bool {
+	if !m.Enabled() {
+		return false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.isShedding {
+		return false
+	}
+	if m.now().Before(m.shedUntil) {
+		return true
+	}
+
+	// The cooldown has elapsed: start measuring from scratch so that
+	// a recovered backend isn't held back by stale slow samples.
+	slog.Info("resuming requests after backend overload cooldown")
+	m.isShedding = false
+	m.average = 0
+	m.samples = 0
+	return false
+}
+
+// Handler wraps next so that requests are rejected while the monitor is overloaded.
+// HTTP clients get 503 with Retry-After and gRPC clients get UNAVAILABLE.
+// Metrics and gRPC health checks are always served.
+func (m *Monitor) Handler(next http.Handler) http.Handler {
+	if !m.Enabled() {
+		return next
+	}
+
+	retryAfter := strconv.Itoa(int((m.options.Cooldown + time.Second - 1) / time.Second))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if exempt(r) || !m.Overloaded() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			// Trailers-only response carrying the status, as permitted by the gRPC HTTP/2 protocol.
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Header().Set("Grpc-Status", "14") // UNAVAILABLE
+			w.Header().Set("Grpc-Message", "storage backend overloaded")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		w.Header().Set("Retry-After", retryAfter)
+		http.Error(w, "storage backend overloaded", http.StatusServiceUnavailable)
+	})
+}
+
+func exempt(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/metrics/") ||
+		strings.HasPrefix(r.URL.Path, "/_omni/") ||
+		strings.HasPrefix(r.URL.Path, "/grpc.health.v1.Health/")
+}
+
+// Storage wraps backend so that the latency of its remote operations is observed by m:
+// lookups, multipart upload creation and commits, and deletes. URLs are left out, since
+// issuing them is mostly local presigning that says little about backend load.
+func (m *Monitor) Storage(backend storage.MultipartBlobStorageBackend) storage.MultipartBlobStorageBackend {
+	if !m.Enabled() {
+		return backend
+	}
+
+	result := &observedStorage{MultipartBlobStorageBackend: backend, monitor: m, inner: storage.CapabilitiesOf(backend)}
+	capabilities := result.inner
+	if capabilities.Delete != nil {
+		capabilities.Delete = result.delete
+	}
+	return storage.WithCapabilities(result, capabilities)
+}
+
+type observedStorage struct {
+	storage.MultipartBlobStorageBackend
+
+	monitor *Monitor
+	// inner are the optional operations of the wrapped backend.
+	inner storage.Capabilities
+}
+
+func (s *observedStorage) observe(ctx context.Context, startedAt time.Time) {
+	// Operations cut short by the client say nothing about backend latency.
+	if ctx.Err() != nil {
+		return
+	}
+	s.monitor.Observe(time.Since(startedAt))
+}
+
+func (s *observedStorage) CacheInfo(ctx context.Context, key string, prefixes []string) (*storage.CacheInfo, error) {
+	defer s.observe(ctx, time.Now())
+	return s.MultipartBlobStorageBackend.CacheInfo(ctx, key, prefixes)
+}
+
+func (s *observedStorage) CreateMultipartUpload(ctx context.Context, key string, metadata map[string]string) (string, error) {
+	defer s.observe(ctx, time.Now())
+	return s.MultipartBlobStorageBackend.CreateMultipartUpload(ctx, key, metadata)
+}
+
+func (s *observedStorage) CommitMultipartUpload(ctx context.Context, key string, uploadID string, parts []storage.MultipartUploadPart) error {
+	defer s.observe(ctx, time.Now())
+	return s.MultipartBlobStorageBackend.CommitMultipartUpload(ctx, key, uploadID, parts)
+}
+
+func (s *observedStorage) delete(ctx context.Context, key string) error {
+	defer s.observe(ctx, time.Now())
+	return s.inner.Delete(ctx, key)
+}
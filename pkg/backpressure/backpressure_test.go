@@ -0,0 +1,91 @@
+package backpressure
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMonitorShedsUntilCooldownElapses(t *testing.T) {
+	monitor := NewMonitor(Options{LatencyThreshold: 100 * time.Millisecond, Cooldown: time.Second})
+	now := time.Unix(0, 0)
+	monitor.now = func() time.Time { return now }
+
+	monitor.Observe(10 * time.Millisecond)
+	require.False(t, monitor.Overloaded())
+
+	// A single slow sample is smoothed out...
+	monitor.Observe(200 * time.Millisecond)
+	require.False(t, monitor.Overloaded())
+
+	// ...but sustained slowness trips the threshold.
+	for range 10 {
+		monitor.Observe(500 * time.Millisecond)
+	}
+	require.True(t, monitor.Overloaded())
+
+	now = now.Add(time.Second)
+	require.False(t, monitor.Overloaded())
+
+	// Measurement restarts from scratch after the cooldown.
+	monitor.Observe(10 * time.Millisecond)
+	require.False(t, monitor.Overloaded())
+}
+
+func TestDisabledMonitorIsTransparent(t *testing.T) {
+	monitor := NewMonitor(Options{})
+	monitor.Observe(time.Hour)
+	require.False(t, monitor.Overloaded())
+
+	handler := http.NotFoundHandler()
+	require.NotNil(t, monitor.Handler(handler))
+}
+
+func TestHandlerRejectsWhileOverloaded(t *testing.T) {
+	monitor := NewMonitor(Options{LatencyThreshold: time.Millisecond, Cooldown: 1500 * time.Millisecond})
+	monitor.Observe(time.Second)
+
+	handler := monitor.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/some/cache/key", nil))
+	require.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	require.Equal(t, "2", recorder.Header().Get("Retry-After"))
+
+	grpcRequest := httptest.NewRequest(http.MethodPost, "/build.bazel.remote.execution.v2.ContentAddressableStorage/FindMissingBlobs", nil)
+	grpcRequest.ProtoMajor = 2
+	grpcRequest.Header.Set("Content-Type", "application/grpc")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, grpcRequest)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, "14", recorder.Header().Get("Grpc-Status"))
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics/cache", nil))
+	require.Equal(t, http.StatusNoContent, recorder.Code)
+}
+
+func TestStorageObservesOnlyBackendCalls(t *testing.T) {
+	backend, err := storage.NewFilesystemStorage(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = backend.Close()
+	})
+
+	monitor := NewMonitor(Options{LatencyThreshold: time.Second})
+	observed := monitor.Storage(backend)
+
+	_, err = observed.UploadURL(t.Context(), "key", nil)
+	require.NoError(t, err)
+	_, _ = observed.DownloadURLs(t.Context(), "key")
+	require.Zero(t, monitor.samples)
+
+	_, _ = observed.CacheInfo(t.Context(), "key", nil)
+	require.Equal(t, 1, monitor.samples)
+}
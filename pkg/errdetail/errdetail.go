@@ -0,0 +1,140 @@
+// Package errdetail controls how much internal error detail is returned to clients.
+//
+// The mode travels in the request context: the server installs it with Middleware,
+// and protocols consult it when building error responses. Full detail is always
+// logged server-side regardless of the mode.
+package errdetail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/twitchtv/twirp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Mode selects how much error detail reaches clients.
+type Mode string
+
+const (
+	// Internal includes internal error detail (e.g. storage backend errors) in responses.
+	Internal Mode = "internal"
+	// Public replaces internal error detail with generic messages.
+	Public Mode = "public"
+)
+
+// GenericMessage is returned to clients in place of redacted error detail.
+const GenericMessage = "internal server error"
+
+type contextKey struct{}
+
+// ParseMode parses a mode name. An empty value selects Internal.
+func ParseMode(value string) (Mode, error) {
+	switch Mode(strings.ToLower(strings.TrimSpace(value))) {
+	case "", Internal:
+		return Internal, nil
+	case Public:
+		return Public, nil
+	default:
+		return "", fmt.Errorf("unknown error detail mode %q, expected %q or %q", value, Public, Internal)
+	}
+}
+
+// WithMode returns a copy of ctx carrying mode.
+func WithMode(ctx context.Context, mode Mode) context.Context {
+	return context.WithValue(ctx, contextKey{}, mode)
+}
+
+// FromContext returns the mode carried by ctx, defaulting to Internal.
+func FromContext(ctx context.Context) Mode {
+	if mode, ok := ctx.Value(contextKey{}).(Mode); ok && mode != "" {
+		return mode
+	}
+	return Internal
+}
+
+// Middleware stores mode in the context of every request passing through it.
+func Middleware(mode Mode) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(WithMode(r.Context(), mode)))
+		})
+	}
+}
+
+// Message returns detail when ctx allows internal detail and fallback otherwise.
+func Message(ctx context.Context, detail string, fallback string) string {
+	if FromContext(ctx) == Public {
+		return fallback
+	}
+	return detail
+}
+
+// redactedCodes are the gRPC/Twirp codes whose messages carry server-side detail.
+var redactedCodes = map[codes.Code]struct{}{
+	codes.Unknown:  {},
+	codes.Internal: {},
+	codes.DataLoss: {},
+}
+
+// GRPCError replaces the message of server-side gRPC errors with GenericMessage
+// when ctx is in Public mode, logging the original.
+func GRPCError(ctx context.Context, err error) error {
+	if err == nil || FromContext(ctx) != Public {
+		return err
+	}
+
+	st := status.Convert(err)
+	if _, ok := redactedCodes[st.Code()]; !ok {
+		return err
+	}
+
+	slog.ErrorContext(ctx, "redacted gRPC error detail", "code", st.Code().String(), "err", st.Message())
+	return status.Error(st.Code(), GenericMessage)
+}
+
+// UnaryServerInterceptor applies GRPCError to unary handler results.
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		resp, err := handler(ctx, req)
+		return resp, GRPCError(ctx, err)
+	}
+}
+
+// StreamServerInterceptor applies GRPCError to streaming handler results.
+func StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return GRPCError(stream.Context(), handler(srv, stream))
+	}
+}
+
+// TwirpInterceptor redacts server-side Twirp errors when the request is in Public mode.
+func TwirpInterceptor() twirp.Interceptor {
+	return func(next twirp.Method) twirp.Method {
+		return func(ctx context.Context, request any) (any, error) {
+			resp, err := next(ctx, request)
+			if err == nil || FromContext(ctx) != Public {
+				return resp, err
+			}
+
+			var twirpErr twirp.Error
+			if !errors.As(err, &twirpErr) {
+				// Twirp reports plain errors as internal errors with their text.
+				twirpErr = twirp.InternalErrorWith(err)
+			}
+			switch twirpErr.Code() {
+			case twirp.Internal, twirp.Unknown, twirp.DataLoss:
+				slog.ErrorContext(ctx, "redacted Twirp error detail", "code", string(twirpErr.Code()), "err", twirpErr.Msg())
+				return resp, twirp.NewError(twirpErr.Code(), GenericMessage)
+			default:
+				return resp, err
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package errdetail_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cirruslabs/omni-cache/pkg/errdetail"
+	"github.com/stretchr/testify/require"
+	"github.com/twitchtv/twirp"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseMode(t *testing.T) {
+	mode, err := errdetail.ParseMode("")
+	require.NoError(t, err)
+	require.Equal(t, errdetail.Internal, mode)
+
+	mode, err = errdetail.ParseMode(" Public ")
+	require.NoError(t, err)
+	require.Equal(t, errdetail.Public, mode)
+
+	_, err = errdetail.ParseMode("verbose")
+	require.Error(t, err)
+}
+
+func TestMiddlewareSetsMode(t *testing.T) {
+	var seen errdetail.Mode
+	handler := errdetail.Middleware(errdetail.Public)(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		seen = errdetail.FromContext(r.Context())
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, errdetail.Public, seen)
+	require.Equal(t, errdetail.Internal, errdetail.FromContext(context.Background()))
+}
+
+func TestMessage(t *testing.T) {
+	publicCtx := errdetail.WithMode(context.Background(), errdetail.Public)
+
+	require.Equal(t, "detail", errdetail.Message(context.Background(), "detail", "generic"))
+	require.Equal(t, "generic", errdetail.Message(publicCtx, "detail", "generic"))
+}
+
+func TestGRPCError(t *testing.T) {
+	publicCtx := errdetail.WithMode(context.Background(), errdetail.Public)
+	internalErr := status.Error(codes.Internal, "download blob: S3 said no")
+
+	require.Equal(t, internalErr, errdetail.GRPCError(context.Background(), internalErr))
+
+	redacted := status.Convert(errdetail.GRPCError(publicCtx, internalErr))
+	require.Equal(t, codes.Internal, redacted.Code())
+	require.Equal(t, errdetail.GenericMessage, redacted.Message())
+
+	// Client-facing errors keep their message.
+	invalidErr := status.Error(codes.InvalidArgument, "invalid digest")
+	require.Equal(t, invalidErr, errdetail.GRPCError(publicCtx, invalidErr))
+}
+
+func TestTwirpInterceptor(t *testing.T) {
+	publicCtx := errdetail.WithMode(context.Background(), errdetail.Public)
+	method := errdetail.TwirpInterceptor()(func(_ context.Context, request any) (any, error) {
+		return nil, request.(error)
+	})
+
+	_, err := method(publicCtx, errors.New("S3 said no"))
+	var twirpErr twirp.Error
+	require.ErrorAs(t, err, &twirpErr)
+	require.Equal(t, twirp.Internal, twirpErr.Code())
+	require.Equal(t, errdetail.GenericMessage, twirpErr.Msg())
+
+	_, err = method(publicCtx, twirp.NotFoundError("cache entry not found"))
+	require.ErrorAs(t, err, &twirpErr)
+	require.Equal(t, "cache entry not found", twirpErr.Msg())
+
+	_, err = method(context.Background(), errors.New("S3 said no"))
+	require.EqualError(t, err, "S3 said no")
+}
@@ -0,0 +1,87 @@
+package kvstore_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/cirruslabs/omni-cache/pkg/kvstore"
+	"github.com/stretchr/testify/require"
+)
+
+func testStore(t *testing.T, store kvstore.Store) {
+	t.Helper()
+	ctx := context.Background()
+
+	_, found, err := store.Get(ctx, "missing")
+	require.NoError(t, err)
+	require.False(t, found)
+
+	require.NoError(t, store.Put(ctx, "key", []byte("value")))
+	value, found, err := store.Get(ctx, "key")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, []byte("value"), value)
+
+	require.NoError(t, store.Delete(ctx, "key"))
+	require.NoError(t, store.Delete(ctx, "missing"))
+	_, found, err = store.Get(ctx, "key")
+	require.NoError(t, err)
+	require.False(t, found)
+
+	require.NoError(t, store.Put(ctx, "key", []byte("value")))
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, kvstore.NewMemoryStore())
+}
+
+func TestRedisStore(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	store, err := kvstore.NewRedisStoreFromURL("redis://"+server.Addr(), time.Hour)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = store.Close()
+	})
+
+	testStore(t, store)
+	require.Equal(t, time.Hour, server.TTL("key"))
+
+	server.FastForward(time.Hour)
+	_, found, err := store.Get(context.Background(), "key")
+	require.NoError(t, err)
+	require.False(t, found)
+
+	withoutTTL := store.WithTTL(0)
+	require.NoError(t, withoutTTL.Put(context.Background(), "key", []byte("value")))
+	require.Zero(t, server.TTL("key"))
+}
+
+func TestRedisStoreInvalidURL(t *testing.T) {
+	_, err := kvstore.NewRedisStoreFromURL("http://localhost", 0)
+	require.ErrorContains(t, err, "invalid redis URL")
+}
+
+func TestWithPrefix(t *testing.T) {
+	ctx := context.Background()
+	shared := kvstore.NewMemoryStore()
+	first := kvstore.WithPrefix(shared, "first/")
+	second := kvstore.WithPrefix(shared, "second/")
+
+	testStore(t, first)
+
+	require.NoError(t, second.Put(ctx, "key", []byte("other")))
+	value, found, err := first.Get(ctx, "key")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, []byte("value"), value)
+
+	value, found, err = shared.Get(ctx, "second/key")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, []byte("other"), value)
+
+	require.Same(t, shared, kvstore.WithPrefix(shared, ""))
+}
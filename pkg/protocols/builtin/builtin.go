@@ -11,14 +11,30 @@ import (
 	"github.com/cirruslabs/omni-cache/pkg/protocols"
 )
 
+// Config holds per-protocol options for the built-in factories.
+type Config struct {
+	AzureBlob   azureblob.Options
+	BazelRemote bazel_remote.Options
+	GHACache    ghacache.Options
+	GHACacheV2  ghacachev2.Options
+	HTTPCache   http_cache.Options
+	LLVMCache   llvm_cache.Options
+	TuistCache  tuist_cache.Options
+}
+
 func Factories() []protocols.Factory {
+	return FactoriesWithConfig(Config{})
+}
+
+// FactoriesWithConfig returns the built-in factories configured with cfg.
+func FactoriesWithConfig(cfg Config) []protocols.Factory {
 	return []protocols.Factory{
-		azureblob.Factory{},
-		tuist_cache.Factory{},
-		http_cache.Factory{},
-		bazel_remote.Factory{},
-		ghacache.Factory{},
-		ghacachev2.Factory{},
-		llvm_cache.Factory{},
+		azureblob.Factory{Options: cfg.AzureBlob},
+		tuist_cache.Factory{Options: cfg.TuistCache},
+		http_cache.Factory{Options: cfg.HTTPCache},
+		bazel_remote.Factory{Options: cfg.BazelRemote},
+		ghacache.Factory{Options: cfg.GHACache},
+		ghacachev2.Factory{Options: cfg.GHACacheV2},
+		llvm_cache.Factory{Options: cfg.LLVMCache},
 	}
 }
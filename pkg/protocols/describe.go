@@ -0,0 +1,40 @@
+package protocols
+
+// Description reports what a protocol serves, so that the set of enabled protocols can be
+// inspected at runtime instead of documented out of band.
+type Description struct {
+	// ID is the protocol's Factory.ID.
+	ID string `json:"id"`
+	// Summary is a one-line description of the protocol.
+	Summary string `json:"summary,omitempty"`
+	// HTTPRoutes lists the HTTP method and path patterns the protocol serves, relative to
+	// its mount prefix.
+	HTTPRoutes []string `json:"httpRoutes,omitempty"`
+	// GRPCServices lists the fully qualified gRPC services the protocol registers.
+	GRPCServices []string `json:"grpcServices,omitempty"`
+	// Features lists optional behavior enabled by the protocol's options.
+	Features []string `json:"features,omitempty"`
+	// Limits lists size and count limits enforced by the protocol, keyed by name.
+	Limits map[string]int64 `json:"limits,omitempty"`
+	// SharesObjectsWith lists the IDs of protocols that read the objects this protocol
+	// writes, or write the objects it reads, e.g. when it hands out URLs served by them.
+	SharesObjectsWith []string `json:"sharesObjectsWith,omitempty"`
+}
+
+// Describer is implemented by factories that can describe the protocol they create.
+type Describer interface {
+	Describe() Description
+}
+
+// Describe returns factory's description, or one holding only its ID when the factory
+// doesn't implement Describer.
+func Describe(factory Factory) Description {
+	describer, ok := factory.(Describer)
+	if !ok {
+		return Description{ID: factory.ID()}
+	}
+
+	description := describer.Describe()
+	description.ID = factory.ID()
+	return description
+}
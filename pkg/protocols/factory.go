@@ -3,6 +3,7 @@ package protocols
 import (
 	"net/http"
 
+	"github.com/cirruslabs/omni-cache/pkg/signedurl"
 	"github.com/cirruslabs/omni-cache/pkg/storage"
 	urlproxy "github.com/cirruslabs/omni-cache/pkg/url-proxy"
 	"google.golang.org/grpc"
@@ -13,12 +14,43 @@ type Dependencies struct {
 	HTTP     *http.Client
 	URLProxy *urlproxy.Proxy
 	Host     string
+
+	// MountPrefix reports the URL path prefix under which the protocol with the given ID
+	// serves its HTTP routes, and whether that protocol is served at all. Protocols that
+	// hand out URLs pointing at another protocol use it to build them. Defaults to every
+	// protocol being served at the root.
+	MountPrefix func(protocolID string) (prefix string, ok bool)
+
+	// ServedProtocols are the IDs of every protocol the server serves, this one included.
+	// They all share Storage, so protocols use it to keep from touching each other's
+	// objects. Empty when unknown.
+	ServedProtocols []string
+
+	// URLSigner, when set, signs the URLs that protocols hand out to clients, so that
+	// those URLs work without the server's auth token. Nil hands out plain URLs.
+	URLSigner *signedurl.Signer
+
+	// UploadTransport wraps the transport of an HTTP client that uploads to storage, so
+	// that the server can count the protocol's uploads and bound how many run at once.
+	// HTTP and URLProxy already go through it; protocols that build their own clients
+	// wrap their transports with it. Defaults to returning the transport unchanged.
+	UploadTransport func(http.RoundTripper) http.RoundTripper
 }
 
 func (deps Dependencies) WithDefaults() Dependencies {
 	if deps.HTTP == nil {
 		deps.HTTP = http.DefaultClient
 	}
+	if deps.MountPrefix == nil {
+		deps.MountPrefix = func(string) (string, bool) {
+			return "", true
+		}
+	}
+	if deps.UploadTransport == nil {
+		deps.UploadTransport = func(transport http.RoundTripper) http.RoundTripper {
+			return transport
+		}
+	}
 	if deps.URLProxy == nil {
 		deps.URLProxy = urlproxy.NewProxy(
 			urlproxy.WithHTTPClient(deps.HTTP),
@@ -0,0 +1,9 @@
+package protocols
+
+import "github.com/cirruslabs/omni-cache/pkg/stats"
+
+// Stats returns the collector that counts the cache activity of the protocol with the
+// given ID. Everything it records is also included in the stats.Default() totals.
+func Stats(protocolID string) *stats.Collector {
+	return stats.Default().For(protocolID)
+}
@@ -0,0 +1,427 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cirruslabs/omni-cache/pkg/stats"
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// RequestIDHeader carries the request ID of access-logged requests, over HTTP and as gRPC
+// metadata. A request ID sent by the client is kept, so that it can correlate its own
+// logs; otherwise one is generated. Responses echo it back.
+const RequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength bounds client-provided request IDs, which end up in every log line.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// RequestID returns the ID of the access-logged request ctx belongs to, if any.
+func RequestID(ctx context.Context) (string, bool) {
+	record, ok := ctx.Value(requestIDKey{}).(*accessRecord)
+	if !ok || record.id == "" {
+		return "", false
+	}
+	return record.id, true
+}
+
+// NewRequestIDLogHandler wraps next so that records logged with the context of an
+// access-logged request carry its ID as "request_id", which correlates protocol and
+// storage logs with the request's access log line.
+func NewRequestIDLogHandler(next slog.Handler) slog.Handler {
+	return &requestIDLogHandler{Handler: next}
+}
+
+type requestIDLogHandler struct {
+	slog.Handler
+}
+
+func (h *requestIDLogHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id, ok := RequestID(ctx); ok {
+		record = record.Clone()
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *requestIDLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &requestIDLogHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *requestIDLogHandler) WithGroup(name string) slog.Handler {
+	return &requestIDLogHandler{Handler: h.Handler.WithGroup(name)}
+}
+
+// accessRecord collects what a request did, for its access log line and for top keys.
+// The cache keys and hit/miss are recorded by accessLogStorage, from whichever goroutines
+// the protocol uses. Requests that aren't access-logged have no ID.
+type accessRecord struct {
+	id string
+
+	mtx  sync.Mutex
+	key  string
+	hit  *bool
+	keys int
+
+	// topKeys and lookups count the request once for each key it looked up when it
+	// finishes, see recordTopKeys.
+	topKeys *stats.TopKeys
+	lookups map[string]*keyLookup
+}
+
+type keyLookup struct {
+	hit        bool
+	downloaded bool
+}
+
+func (r *accessRecord) recordKey(key string, hit *bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.keys++
+	if r.keys == 1 {
+		r.key = strings.TrimPrefix(key, "/")
+		r.hit = hit
+	}
+}
+
+// recordLookup remembers the outcome of looking up key for topKeys. A key looked up
+// several times, such as checked and then downloaded, keeps its latest outcome.
+func (r *accessRecord) recordLookup(topKeys *stats.TopKeys, key string, hit bool, downloaded bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	key = strings.TrimPrefix(key, "/")
+	r.topKeys = topKeys
+	if r.lookups == nil {
+		r.lookups = map[string]*keyLookup{}
+	}
+	lookup, ok := r.lookups[key]
+	if !ok {
+		lookup = &keyLookup{}
+		r.lookups[key] = lookup
+	}
+	lookup.hit = hit
+	lookup.downloaded = lookup.downloaded || downloaded
+}
+
+// recordTopKeys counts the finished request once for each key it looked up. The bytes
+// it sent count for the key it downloaded; existence checks count none, and neither do
+// requests that download several keys at once, such as Bazel's BatchReadBlobs, since
+// their bytes can't be told apart.
+func (r *accessRecord) recordTopKeys(bytesOut int64) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.topKeys == nil {
+		return
+	}
+	var downloads int
+	for _, lookup := range r.lookups {
+		if lookup.downloaded {
+			downloads++
+		}
+	}
+	for key, lookup := range r.lookups {
+		var bytes int64
+		if lookup.downloaded && downloads == 1 {
+			bytes = bytesOut
+		}
+		r.topKeys.Record(key, lookup.hit, bytes)
+	}
+}
+
+// attrs returns the cache key attributes: the first key the request used, whether
+// that was a hit, and how many keys it used in total when it used several.
+func (r *accessRecord) attrs() []any {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	var attrs []any
+	if r.key != "" {
+		attrs = append(attrs, "key", r.key)
+	}
+	if r.hit != nil {
+		attrs = append(attrs, "hit", *r.hit)
+	}
+	if r.keys > 1 {
+		attrs = append(attrs, "keys", r.keys)
+	}
+	return attrs
+}
+
+func newAccessRecord(clientID string, logged bool) *accessRecord {
+	if !logged {
+		return &accessRecord{}
+	}
+	id := clientID
+	if id == "" || len(id) > maxRequestIDLength || strings.ContainsFunc(id, func(r rune) bool {
+		return r <= ' ' || r > '~'
+	}) {
+		id = uuid.NewString()
+	}
+	return &accessRecord{id: id}
+}
+
+func withAccessRecord(ctx context.Context, record *accessRecord) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, record)
+}
+
+func accessRecordFrom(ctx context.Context) *accessRecord {
+	record, _ := ctx.Value(requestIDKey{}).(*accessRecord)
+	return record
+}
+
+// accessLogHTTP records every HTTP request next serves, logging a line at level for it
+// when logged is set.
+func accessLogHTTP(logged bool, level slog.Level, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		startedAt := time.Now()
+		record := newAccessRecord(r.Header.Get(RequestIDHeader), logged)
+		ctx := withAccessRecord(r.Context(), record)
+		if logged {
+			w.Header().Set(RequestIDHeader, record.id)
+		}
+
+		body := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = body
+		}
+		recorder := &accessLogResponseWriter{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		record.recordTopKeys(recorder.n)
+		if !logged {
+			return
+		}
+		attrs := []any{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", recorder.status,
+		}
+		attrs = append(attrs, record.attrs()...)
+		attrs = append(attrs,
+			"bytes_in", body.n,
+			"bytes_out", recorder.n,
+			"duration", time.Since(startedAt),
+		)
+		slog.Log(ctx, level, "request", attrs...)
+	})
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+type accessLogResponseWriter struct {
+	http.ResponseWriter
+
+	status      int
+	wroteHeader bool
+	n           int64
+}
+
+func (w *accessLogResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader && status >= http.StatusOK {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogResponseWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// Flush keeps streaming responses streaming for handlers that check for http.Flusher.
+func (w *accessLogResponseWriter) Flush() {
+	w.wroteHeader = true
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *accessLogResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// grpcAccessRecord starts the access record of a gRPC call and sends its ID back when the
+// call is logged.
+func grpcAccessRecord(ctx context.Context, logged bool) (context.Context, *accessRecord) {
+	if !logged {
+		record := newAccessRecord("", false)
+		return withAccessRecord(ctx, record), record
+	}
+	var clientID string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(RequestIDHeader); len(values) != 0 {
+			clientID = values[0]
+		}
+	}
+	record := newAccessRecord(clientID, true)
+	_ = grpc.SetHeader(ctx, metadata.Pairs(RequestIDHeader, record.id))
+	return withAccessRecord(ctx, record), record
+}
+
+func logGRPCAccess(ctx context.Context, logged bool, level slog.Level, record *accessRecord, method string, err error, bytesIn, bytesOut int64, startedAt time.Time) {
+	record.recordTopKeys(bytesOut)
+	if !logged {
+		return
+	}
+	attrs := []any{
+		"rpc", method,
+		"code", status.Code(err).String(),
+	}
+	attrs = append(attrs, record.attrs()...)
+	attrs = append(attrs,
+		"bytes_in", bytesIn,
+		"bytes_out", bytesOut,
+		"duration", time.Since(startedAt),
+	)
+	slog.Log(ctx, level, "request", attrs...)
+}
+
+func accessLogUnaryServerInterceptor(logged bool, level slog.Level) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		startedAt := time.Now()
+		ctx, record := grpcAccessRecord(ctx, logged)
+
+		resp, err := handler(ctx, req)
+
+		logGRPCAccess(ctx, logged, level, record, info.FullMethod, err, messageSize(req), messageSize(resp), startedAt)
+		return resp, err
+	}
+}
+
+func accessLogStreamServerInterceptor(logged bool, level slog.Level) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		startedAt := time.Now()
+		ctx, record := grpcAccessRecord(ss.Context(), logged)
+		stream := &accessLogServerStream{ServerStream: ss, ctx: ctx}
+
+		err := handler(srv, stream)
+
+		logGRPCAccess(ctx, logged, level, record, info.FullMethod, err, stream.bytesIn, stream.bytesOut, startedAt)
+		return err
+	}
+}
+
+type accessLogServerStream struct {
+	grpc.ServerStream
+
+	ctx      context.Context
+	bytesIn  int64
+	bytesOut int64
+}
+
+func (s *accessLogServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *accessLogServerStream) SendMsg(m any) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		s.bytesOut += messageSize(m)
+	}
+	return err
+}
+
+func (s *accessLogServerStream) RecvMsg(m any) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		s.bytesIn += messageSize(m)
+	}
+	return err
+}
+
+func messageSize(m any) int64 {
+	message, ok := m.(proto.Message)
+	if !ok {
+		return 0
+	}
+	return int64(proto.Size(message))
+}
+
+// accessLogStorage records the keys that protocols look up, and whether they were hits,
+// in the access record of the request doing the lookup. With topKeys set, it also
+// remembers the lookups for counting the request in topKeys once it finishes.
+type accessLogStorage struct {
+	storage.MultipartBlobStorageBackend
+
+	topKeys *stats.TopKeys
+}
+
+func (s *accessLogStorage) CacheInfo(ctx context.Context, key string, prefixes []string) (*storage.CacheInfo, error) {
+	info, err := s.MultipartBlobStorageBackend.CacheInfo(ctx, key, prefixes)
+	if err == nil {
+		s.recordLookup(ctx, info.Key, nil, false)
+	} else {
+		s.recordLookup(ctx, key, err, false)
+	}
+	return info, err
+}
+
+func (s *accessLogStorage) DownloadURLs(ctx context.Context, key string) ([]*storage.URLInfo, error) {
+	infos, err := s.MultipartBlobStorageBackend.DownloadURLs(ctx, key)
+	s.recordLookup(ctx, key, err, true)
+	return infos, err
+}
+
+func (s *accessLogStorage) recordLookup(ctx context.Context, key string, err error, download bool) {
+	record := accessRecordFrom(ctx)
+	if record == nil {
+		return
+	}
+	switch {
+	case err == nil:
+		record.recordKey(key, boolPtr(true))
+	case storage.IsNotFoundError(err):
+		record.recordKey(key, boolPtr(false))
+	default:
+		record.recordKey(key, nil)
+		return
+	}
+	if s.topKeys != nil {
+		record.recordLookup(s.topKeys, key, err == nil, download && err == nil)
+	}
+}
+
+func (s *accessLogStorage) UploadURL(ctx context.Context, key string, metadata map[string]string) (*storage.URLInfo, error) {
+	if record := accessRecordFrom(ctx); record != nil {
+		record.recordKey(key, nil)
+	}
+	return s.MultipartBlobStorageBackend.UploadURL(ctx, key, metadata)
+}
+
+func (s *accessLogStorage) CreateMultipartUpload(ctx context.Context, key string, metadata map[string]string) (string, error) {
+	if record := accessRecordFrom(ctx); record != nil {
+		record.recordKey(key, nil)
+	}
+	return s.MultipartBlobStorageBackend.CreateMultipartUpload(ctx, key, metadata)
+}
+
+func boolPtr(value bool) *bool {
+	return &value
+}
@@ -0,0 +1,195 @@
+package server_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	remoteexecution "github.com/cirruslabs/omni-cache/internal/api/build/bazel/remote/execution/v2"
+	"github.com/cirruslabs/omni-cache/pkg/protocols"
+	"github.com/cirruslabs/omni-cache/pkg/server"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+type lockedBuffer struct {
+	mtx sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.buf.Write(p)
+}
+
+// records returns the JSON log records written so far.
+func (b *lockedBuffer) records(t *testing.T) []map[string]any {
+	t.Helper()
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	var records []map[string]any
+	scanner := bufio.NewScanner(bytes.NewReader(b.buf.Bytes()))
+	for scanner.Scan() {
+		var record map[string]any
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	return records
+}
+
+// captureLogs makes the default logger write JSON records, with request IDs, to the
+// returned buffer for the rest of the test.
+func captureLogs(t *testing.T) *lockedBuffer {
+	t.Helper()
+
+	buffer := &lockedBuffer{}
+	previous := slog.Default()
+	slog.SetDefault(slog.New(server.NewRequestIDLogHandler(slog.NewJSONHandler(buffer, &slog.HandlerOptions{Level: slog.LevelDebug}))))
+	t.Cleanup(func() {
+		slog.SetDefault(previous)
+	})
+	return buffer
+}
+
+func accessLogRecords(t *testing.T, buffer *lockedBuffer) []map[string]any {
+	t.Helper()
+
+	var records []map[string]any
+	for _, record := range buffer.records(t) {
+		if record["msg"] == "request" {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+func TestAccessLogHTTP(t *testing.T) {
+	logs := captureLogs(t)
+	addr := startBuiltinServer(t, newFilesystemBackend(t), server.Options{AccessLog: true})
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodPut, "http://"+addr+"/logged/entry", strings.NewReader("payload"))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	req, err = http.NewRequestWithContext(t.Context(), http.MethodGet, "http://"+addr+"/logged/entry", nil)
+	require.NoError(t, err)
+	req.Header.Set(server.RequestIDHeader, "client-request-1")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "client-request-1", resp.Header.Get(server.RequestIDHeader))
+
+	records := accessLogRecords(t, logs)
+	require.Len(t, records, 2)
+
+	put := records[0]
+	require.NotEmpty(t, put["request_id"])
+	require.Equal(t, http.MethodPut, put["method"])
+	require.Equal(t, "/logged/entry", put["path"])
+	require.EqualValues(t, http.StatusCreated, put["status"])
+	require.EqualValues(t, len("payload"), put["bytes_in"])
+
+	get := records[1]
+	require.Equal(t, "client-request-1", get["request_id"])
+	require.Equal(t, http.MethodGet, get["method"])
+	require.EqualValues(t, http.StatusOK, get["status"])
+	require.Contains(t, get["key"], "logged/entry")
+	require.Equal(t, true, get["hit"])
+	require.Contains(t, get, "duration")
+}
+
+func TestAccessLogGRPC(t *testing.T) {
+	logs := captureLogs(t)
+	addr := startBuiltinServer(t, newFilesystemBackend(t), server.Options{AccessLog: true})
+
+	client := remoteexecution.NewContentAddressableStorageClient(dialGRPC(t, addr))
+	var header metadata.MD
+	_, err := client.FindMissingBlobs(t.Context(), &remoteexecution.FindMissingBlobsRequest{
+		BlobDigests: []*remoteexecution.Digest{{
+			Hash:      strings.Repeat("a", 64),
+			SizeBytes: 1,
+		}},
+	}, grpc.Header(&header))
+	require.NoError(t, err)
+	require.Len(t, header.Get(server.RequestIDHeader), 1)
+
+	records := accessLogRecords(t, logs)
+	require.Len(t, records, 1)
+	require.Equal(t, header.Get(server.RequestIDHeader)[0], records[0]["request_id"])
+	require.Equal(t, "/build.bazel.remote.execution.v2.ContentAddressableStorage/FindMissingBlobs", records[0]["rpc"])
+	require.Equal(t, "OK", records[0]["code"])
+	require.Equal(t, false, records[0]["hit"])
+	require.NotZero(t, records[0]["bytes_in"])
+}
+
+type loggingProtocol struct{}
+
+func (loggingProtocol) Register(registrar *protocols.Registrar) error {
+	registrar.HTTP().HandleFunc("GET /logging", func(w http.ResponseWriter, r *http.Request) {
+		slog.InfoContext(r.Context(), "handling request")
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return nil
+}
+
+type loggingFactory struct{}
+
+func (loggingFactory) ID() string {
+	return "logging"
+}
+
+func (loggingFactory) New(protocols.Dependencies) (protocols.Protocol, error) {
+	return loggingProtocol{}, nil
+}
+
+func TestAccessLogRequestIDCorrelatesHandlerLogs(t *testing.T) {
+	logs := captureLogs(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv, err := server.StartWithOptions(t.Context(), []net.Listener{listener}, newFilesystemBackend(t),
+		server.Options{AccessLog: true, AccessLogLevel: slog.LevelDebug}, loggingFactory{})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = srv.Close()
+	})
+
+	resp, err := http.Get("http://" + listener.Addr().String() + "/logging")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	requestID := resp.Header.Get(server.RequestIDHeader)
+	require.NotEmpty(t, requestID)
+
+	records := logs.records(t)
+	require.Len(t, records, 2)
+	require.Equal(t, "handling request", records[0]["msg"])
+	require.Equal(t, requestID, records[0]["request_id"])
+	require.Equal(t, "request", records[1]["msg"])
+	require.Equal(t, "DEBUG", records[1]["level"])
+	require.Equal(t, requestID, records[1]["request_id"])
+}
+
+func TestAccessLogDisabledByDefault(t *testing.T) {
+	logs := captureLogs(t)
+	addr := startBuiltinServer(t, newFilesystemBackend(t), server.Options{})
+
+	resp, err := http.Get("http://" + addr + "/logged/missing")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Empty(t, resp.Header.Get(server.RequestIDHeader))
+	require.Empty(t, accessLogRecords(t, logs))
+}
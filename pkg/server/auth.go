@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/cirruslabs/omni-cache/pkg/signedurl"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// AuthMetadataKey is the gRPC metadata key that must carry "Bearer <token>" when
+// Options.AuthToken is set. It matches the Authorization header HTTP clients send.
+const AuthMetadataKey = "authorization"
+
+// adminPathPrefix is exempt from Options.AuthToken, since the admin endpoints are
+// guarded by Options.AdminToken in the same header.
+const adminPathPrefix = "/_admin/"
+
+// authorizeHTTP rejects HTTP requests to signed URLs that signer didn't sign, and other
+// requests that don't carry token as a bearer token.
+func authorizeHTTP(token string, signer *signedurl.Signer, next http.Handler) http.Handler {
+	if token == "" && signer == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if signer != nil && signedurl.Signed(r) {
+			if err := signer.Verify(r); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if token != "" && !authExempt(r.URL.Path) && !bearerTokenMatches(r.Header.Get("Authorization"), token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authExempt reports whether requests to path don't need the auth token: the admin
+// endpoints check the admin token instead, and orchestrator probes can't be expected to
+// carry a token.
+func authExempt(path string) bool {
+	return strings.HasPrefix(path, adminPathPrefix) || path == HealthPath || path == ReadyPath
+}
+
+// requireAdminToken guards an admin endpoint with the admin token.
+func requireAdminToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !bearerTokenMatches(r.Header.Get("Authorization"), token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func authUnaryServerInterceptor(token string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := checkGRPCAuthToken(ctx, info.FullMethod, token); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func authStreamServerInterceptor(token string) grpc.StreamServerInterceptor {
+	return func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := checkGRPCAuthToken(stream.Context(), info.FullMethod, token); err != nil {
+			return err
+		}
+		return handler(srv, stream)
+	}
+}
+
+// checkGRPCAuthToken returns an Unauthenticated error unless the call carries token in
+// AuthMetadataKey. Health checks are always allowed so that probes keep working.
+func checkGRPCAuthToken(ctx context.Context, fullMethod string, token string) error {
+	if token == "" || strings.HasPrefix(fullMethod, "/"+healthpb.Health_ServiceDesc.ServiceName+"/") {
+		return nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get(AuthMetadataKey) {
+		if bearerTokenMatches(value, token) {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "missing or invalid auth token")
+}
+
+func bearerTokenMatches(header string, token string) bool {
+	got, ok := strings.CutPrefix(header, "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
@@ -0,0 +1,138 @@
+package server_test
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	remoteexecution "github.com/cirruslabs/omni-cache/internal/api/build/bazel/remote/execution/v2"
+	"github.com/cirruslabs/omni-cache/internal/api/gharesults"
+	"github.com/cirruslabs/omni-cache/pkg/protocols/builtin"
+	"github.com/cirruslabs/omni-cache/pkg/server"
+	"github.com/cirruslabs/omni-cache/pkg/signedurl"
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+	"github.com/stretchr/testify/require"
+	"github.com/twitchtv/twirp"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func newFilesystemBackend(t *testing.T) *storage.FilesystemStorage {
+	t.Helper()
+
+	backend, err := storage.NewFilesystemStorage(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = backend.Close()
+	})
+	return backend
+}
+
+// startBuiltinServer serves all builtin protocols from backend and returns the
+// listen address.
+func startBuiltinServer(t *testing.T, backend storage.BlobStorageBackend, options server.Options) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv, err := server.StartWithOptions(t.Context(), []net.Listener{listener}, backend, options, builtin.Factories()...)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = srv.Close()
+	})
+
+	return listener.Addr().String()
+}
+
+func TestAuthTokenHTTP(t *testing.T) {
+	addr := startBuiltinServer(t, newFilesystemBackend(t), server.Options{AuthToken: "secret"})
+
+	put := func(authorization string) int {
+		req, err := http.NewRequestWithContext(t.Context(), http.MethodPut, "http://"+addr+"/auth/entry", strings.NewReader("payload"))
+		require.NoError(t, err)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode
+	}
+
+	require.Equal(t, http.StatusUnauthorized, put(""))
+	require.Equal(t, http.StatusUnauthorized, put("Bearer wrong"))
+	require.Equal(t, http.StatusCreated, put("Bearer secret"))
+}
+
+func TestAuthTokenGRPC(t *testing.T) {
+	addr := startBuiltinServer(t, newFilesystemBackend(t), server.Options{AuthToken: "secret"})
+
+	conn := dialGRPC(t, addr)
+	client := remoteexecution.NewCapabilitiesClient(conn)
+
+	_, err := client.GetCapabilities(t.Context(), &remoteexecution.GetCapabilitiesRequest{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	ctx := metadata.AppendToOutgoingContext(t.Context(), server.AuthMetadataKey, "Bearer wrong")
+	_, err = client.GetCapabilities(ctx, &remoteexecution.GetCapabilitiesRequest{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	ctx = metadata.AppendToOutgoingContext(t.Context(), server.AuthMetadataKey, "Bearer secret")
+	_, err = client.GetCapabilities(ctx, &remoteexecution.GetCapabilitiesRequest{})
+	require.NoError(t, err)
+
+	// Health checks stay open so that probes don't need the token.
+	_, err = healthpb.NewHealthClient(conn).Check(t.Context(), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+}
+
+func TestSignedURLsDoNotNeedAuthToken(t *testing.T) {
+	signer, err := signedurl.NewSigner([]byte("signing key"), time.Minute)
+	require.NoError(t, err)
+	addr := startBuiltinServer(t, newFilesystemBackend(t), server.Options{AuthToken: "secret", URLSigner: signer})
+
+	get := func(rawURL string, authorization string) int {
+		req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, rawURL, nil)
+		require.NoError(t, err)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode
+	}
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodPut, "http://"+addr+"/v1-key", strings.NewReader("payload"))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer secret")
+	ctx, err := twirp.WithHTTPRequestHeaders(t.Context(), header)
+	require.NoError(t, err)
+	client := gharesults.NewCacheServiceJSONClient("http://"+addr, http.DefaultClient)
+	entry, err := client.GetCacheEntryDownloadURL(ctx, &gharesults.GetCacheEntryDownloadURLRequest{Key: "key", Version: "v1"})
+	require.NoError(t, err)
+	require.True(t, entry.Ok)
+
+	require.Equal(t, http.StatusOK, get(entry.SignedDownloadUrl, ""))
+
+	unsigned, err := url.Parse(entry.SignedDownloadUrl)
+	require.NoError(t, err)
+	unsigned.RawQuery = ""
+	require.Equal(t, http.StatusUnauthorized, get(unsigned.String(), ""))
+
+	tampered := strings.Replace(entry.SignedDownloadUrl, "v1-key", "v1-other", 1)
+	require.Equal(t, http.StatusForbidden, get(tampered, ""))
+}
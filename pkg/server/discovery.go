@@ -0,0 +1,43 @@
+package server
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/cirruslabs/omni-cache/internal/version"
+	"github.com/cirruslabs/omni-cache/pkg/protocols"
+)
+
+// DiscoveryPath serves a Discovery document describing the running server's protocols.
+const DiscoveryPath = "/_omni/discovery"
+
+// Discovery is the document served at DiscoveryPath.
+type Discovery struct {
+	Version   string               `json:"version"`
+	Protocols []DiscoveredProtocol `json:"protocols"`
+}
+
+// DiscoveredProtocol describes one served protocol and where its HTTP routes are mounted.
+type DiscoveredProtocol struct {
+	protocols.Description
+
+	// Prefix is the route prefix the protocol's HTTP routes are mounted under, empty
+	// when they are served at the root.
+	Prefix string `json:"prefix,omitempty"`
+}
+
+type discoveryHandler struct {
+	discovery Discovery
+}
+
+func (h *discoveryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.discovery); err != nil {
+		slog.ErrorContext(r.Context(), "failed to encode discovery response", "err", err)
+	}
+}
+
+func newDiscovery() Discovery {
+	return Discovery{Version: version.FullVersion, Protocols: []DiscoveredProtocol{}}
+}
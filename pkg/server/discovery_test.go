@@ -0,0 +1,96 @@
+package server
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cirruslabs/omni-cache/pkg/protocols"
+	"github.com/stretchr/testify/require"
+)
+
+type describedEchoFactory struct {
+	echoFactory
+}
+
+func (describedEchoFactory) Describe() protocols.Description {
+	return protocols.Description{
+		Summary:    "echoes the request path",
+		HTTPRoutes: []string{"GET /a/{rest...}"},
+		Limits:     map[string]int64{"maxKeyBytes": 512},
+	}
+}
+
+func TestDiscoveryDescribesServedProtocols(t *testing.T) {
+	options := Options{Routes: []Route{
+		{Prefix: "/team-a", Protocols: []string{"a", "b"}},
+	}}
+
+	mux, _, err := createMuxAndGRPCServer("localhost", nil, options,
+		describedEchoFactory{echoFactory{id: "a"}},
+		echoFactory{id: "b"},
+		echoFactory{id: "c"},
+	)
+	require.NoError(t, err)
+
+	code, body := get(t, mux, DiscoveryPath)
+	require.Equal(t, http.StatusOK, code)
+
+	var discovery Discovery
+	require.NoError(t, json.Unmarshal([]byte(body), &discovery))
+	require.NotEmpty(t, discovery.Version)
+	require.Equal(t, []DiscoveredProtocol{
+		{
+			Description: protocols.Description{
+				ID:         "a",
+				Summary:    "echoes the request path",
+				HTTPRoutes: []string{"GET /a/{rest...}"},
+				Limits:     map[string]int64{"maxKeyBytes": 512},
+			},
+			Prefix: "/team-a",
+		},
+		{
+			Description: protocols.Description{ID: "b"},
+			Prefix:      "/team-a",
+		},
+	}, discovery.Protocols)
+}
+
+func TestInternalEndpointsHonorAcceptEncoding(t *testing.T) {
+	// Enough protocols for the discovery document to be worth compressing.
+	var factories []protocols.Factory
+	for i := range 20 {
+		factories = append(factories, describedEchoFactory{echoFactory{id: fmt.Sprintf("protocol-%d", i)}})
+	}
+	mux, _, err := createMuxAndGRPCServer("localhost", nil, Options{}, factories...)
+	require.NoError(t, err)
+
+	_, plain := get(t, mux, DiscoveryPath)
+
+	req := httptest.NewRequest(http.MethodGet, DiscoveryPath, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	require.Less(t, rec.Body.Len(), len(plain))
+
+	reader, err := gzip.NewReader(rec.Body)
+	require.NoError(t, err)
+	decompressed, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.JSONEq(t, plain, string(decompressed))
+
+	// Protocol routes are served as is.
+	req = httptest.NewRequest(http.MethodGet, "/protocol-0/"+strings.Repeat("x", 2048), nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Empty(t, rec.Header().Get("Content-Encoding"))
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+)
+
+// HealthPath and ReadyPath report whether the storage backend is reachable, for
+// orchestrator liveness and readiness probes. They respond 200 when it is and 503
+// otherwise, with a short JSON diagnostic, and don't require Options.AuthToken.
+const (
+	HealthPath = "/_omni/health"
+	ReadyPath  = "/_omni/ready"
+)
+
+// healthCheckKey is looked up to check the backend. It isn't expected to exist, so a
+// cache miss counts as healthy.
+const healthCheckKey = "omni-cache-health/sentinel"
+
+const (
+	// healthCheckCacheTTL is how long a check result is reused, so that frequent probes
+	// from several orchestrators don't turn into a steady stream of backend requests.
+	healthCheckCacheTTL = 5 * time.Second
+	healthCheckTimeout  = 5 * time.Second
+)
+
+type healthResponse struct {
+	OK         bool      `json:"ok"`
+	CheckedAt  time.Time `json:"checked_at"`
+	DurationMs int64     `json:"duration_ms"`
+	Error      string    `json:"error,omitempty"`
+}
+
+type healthHandler struct {
+	backend storage.BlobStorageBackend
+
+	// mtx is held during checks, so that concurrent probes share a single one.
+	mtx  sync.Mutex
+	last *healthResponse
+}
+
+func (h *healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	response := h.check(r.Context())
+
+	status := http.StatusOK
+	if !response.OK {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		slog.ErrorContext(r.Context(), "failed to encode health check response", "err", err)
+	}
+}
+
+func (h *healthHandler) check(ctx context.Context) healthResponse {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if h.last != nil && time.Since(h.last.CheckedAt) < healthCheckCacheTTL {
+		return *h.last
+	}
+
+	// The result is shared with other probes, so don't let this one's cancellation fail it.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), healthCheckTimeout)
+	defer cancel()
+
+	response := &healthResponse{OK: true, CheckedAt: time.Now()}
+	if err := h.checkBackend(ctx); err != nil {
+		response.OK = false
+		response.Error = err.Error()
+		slog.WarnContext(ctx, "storage backend health check failed", "err", err)
+	}
+	response.DurationMs = time.Since(response.CheckedAt).Milliseconds()
+
+	h.last = response
+	return *response
+}
+
+func (h *healthHandler) checkBackend(ctx context.Context) error {
+	if h.backend == nil {
+		return errors.New("no storage backend configured")
+	}
+
+	_, err := h.backend.CacheInfo(ctx, healthCheckKey, nil)
+	if err != nil && !storage.IsNotFoundError(err) {
+		return err
+	}
+	return nil
+}
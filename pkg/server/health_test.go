@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// unreachableStorage fails every CacheInfo, like a backend that can't be reached.
+type unreachableStorage struct {
+	storage.BlobStorageBackend
+
+	checks atomic.Int32
+}
+
+func (s *unreachableStorage) CacheInfo(context.Context, string, []string) (*storage.CacheInfo, error) {
+	s.checks.Add(1)
+	return nil, errors.New("dial tcp: connection refused")
+}
+
+func TestHealthWithReachableBackend(t *testing.T) {
+	backend, err := storage.NewMemoryStorage()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = backend.Close()
+	})
+
+	mux, _, err := createMuxAndGRPCServer("localhost", backend, Options{}, echoFactory{id: "a"})
+	require.NoError(t, err)
+	handler := authorizeHTTP("secret", nil, mux)
+
+	for _, path := range []string{HealthPath, ReadyPath} {
+		code, body := get(t, handler, path)
+		require.Equal(t, http.StatusOK, code, body)
+
+		var response healthResponse
+		require.NoError(t, json.Unmarshal([]byte(body), &response))
+		require.True(t, response.OK)
+		require.Empty(t, response.Error)
+	}
+}
+
+func TestHealthWithUnreachableBackend(t *testing.T) {
+	backend := &unreachableStorage{}
+	mux, _, err := createMuxAndGRPCServer("localhost", backend, Options{}, echoFactory{id: "a"})
+	require.NoError(t, err)
+
+	code, body := get(t, mux, HealthPath)
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	var response healthResponse
+	require.NoError(t, json.Unmarshal([]byte(body), &response))
+	require.False(t, response.OK)
+	require.Contains(t, response.Error, "connection refused")
+
+	// Results are reused for a while, also across the two paths.
+	code, _ = get(t, mux, ReadyPath)
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.EqualValues(t, 1, backend.checks.Load())
+}
+
+func TestHealthCheckResultExpires(t *testing.T) {
+	backend := &unreachableStorage{}
+	handler := &healthHandler{backend: backend}
+
+	require.False(t, handler.check(t.Context()).OK)
+	require.False(t, handler.check(t.Context()).OK)
+	require.EqualValues(t, 1, backend.checks.Load())
+
+	handler.last.CheckedAt = time.Now().Add(-healthCheckCacheTTL)
+	require.False(t, handler.check(t.Context()).OK)
+	require.EqualValues(t, 2, backend.checks.Load())
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/cirruslabs/omni-cache/pkg/stats"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHitMissModeAppliesPerProtocol(t *testing.T) {
+	stats.Default().Reset()
+	t.Cleanup(stats.Default().Reset)
+
+	_, _, err := createMuxAndGRPCServer("localhost", nil, Options{
+		HitMiss: map[string]stats.HitMissMode{"existence-checks": stats.HitMissLabelOnly},
+	}, echoFactory{id: "existence-checks"}, echoFactory{id: "downloads"})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		stats.Default().For("existence-checks").SetHitMissMode(stats.HitMissTotals)
+	})
+
+	stats.Default().For("existence-checks").RecordCacheMiss()
+	stats.Default().For("downloads").RecordCacheHit()
+
+	snapshot := stats.Default().Snapshot()
+	require.EqualValues(t, 1, snapshot.CacheHits)
+	require.Zero(t, snapshot.CacheMisses)
+	require.EqualValues(t, 1, stats.Default().For("existence-checks").Snapshot().CacheMisses)
+}
+
+func TestHitMissModeRejectsUnknownProtocol(t *testing.T) {
+	_, _, err := createMuxAndGRPCServer("localhost", nil, Options{
+		HitMiss: map[string]stats.HitMissMode{"missing": stats.HitMissOff},
+	}, echoFactory{id: "a"})
+	require.ErrorContains(t, err, `unknown protocol "missing"`)
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// unlistableBackend hides the List support of the wrapped backend.
+type unlistableBackend struct {
+	storage.MultipartBlobStorageBackend
+}
+
+func TestKeyIndexListsUnlistableBackends(t *testing.T) {
+	backend, err := storage.NewFilesystemStorage(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = backend.Close()
+	})
+	unlistable := unlistableBackend{backend}
+
+	var indexed, plain storage.BlobStorageBackend
+	_, _, err = createMuxAndGRPCServer("localhost", unlistable, Options{KeyIndex: true}, storageFactory{id: "a", backend: &indexed})
+	require.NoError(t, err)
+	_, _, err = createMuxAndGRPCServer("localhost", unlistable, Options{}, storageFactory{id: "a", backend: &plain})
+	require.NoError(t, err)
+
+	require.Implements(t, (*storage.ListableBlobStorageBackend)(nil), indexed)
+	require.NotImplements(t, (*storage.ListableBlobStorageBackend)(nil), plain)
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cirruslabs/omni-cache/pkg/protocols"
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// storageFactory records the storage backend handed to the protocol.
+type storageFactory struct {
+	id      string
+	backend *storage.BlobStorageBackend
+}
+
+func (f storageFactory) ID() string {
+	return f.id
+}
+
+func (f storageFactory) New(deps protocols.Dependencies) (protocols.Protocol, error) {
+	*f.backend = deps.Storage
+	return echoProtocol{id: f.id}, nil
+}
+
+func TestMaxAgeAppliesPerProtocol(t *testing.T) {
+	ctx := context.Background()
+	backend, err := storage.NewFilesystemStorage(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = backend.Close()
+	})
+	require.NoError(t, backend.Put(ctx, "entry", strings.NewReader("payload"), nil))
+
+	var fresh, unlimited storage.BlobStorageBackend
+	_, _, err = createMuxAndGRPCServer("localhost", backend, Options{
+		MaxAge: map[string]time.Duration{"fresh": time.Nanosecond},
+	}, storageFactory{id: "fresh", backend: &fresh}, storageFactory{id: "unlimited", backend: &unlimited})
+	require.NoError(t, err)
+
+	_, err = fresh.CacheInfo(ctx, "entry", nil)
+	require.ErrorIs(t, err, storage.ErrCacheNotFound)
+
+	_, err = unlimited.CacheInfo(ctx, "entry", nil)
+	require.NoError(t, err)
+}
+
+func TestMaxAgeRejectsUnknownProtocol(t *testing.T) {
+	_, _, err := createMuxAndGRPCServer("localhost", nil, Options{
+		MaxAge: map[string]time.Duration{"missing": time.Hour},
+	}, echoFactory{id: "a"})
+	require.ErrorContains(t, err, `unknown protocol "missing"`)
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+	urlproxy "github.com/cirruslabs/omni-cache/pkg/url-proxy"
+	"github.com/google/uuid"
+)
+
+// PingBackendPath runs an upload, download and delete of a sentinel object against the
+// storage backend and reports the latency of each step. It is only served when
+// Options.AdminToken is set.
+const PingBackendPath = "/_admin/ping-backend"
+
+const pingBackendKeyPrefix = "omni-cache-ping/"
+
+var pingBackendPayload = []byte("omni-cache ping")
+
+type pingBackendStep struct {
+	Name       string `json:"name"`
+	DurationMs int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+	Skipped    bool   `json:"skipped,omitempty"`
+}
+
+type pingBackendResponse struct {
+	OK         bool              `json:"ok"`
+	Key        string            `json:"key"`
+	DurationMs int64             `json:"duration_ms"`
+	Steps      []pingBackendStep `json:"steps"`
+}
+
+type pingBackendHandler struct {
+	backend storage.BlobStorageBackend
+	proxy   *urlproxy.Proxy
+}
+
+func (h *pingBackendHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	response := h.ping(r.Context())
+
+	status := http.StatusOK
+	if !response.OK {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		slog.ErrorContext(r.Context(), "failed to encode backend ping response", "err", err)
+	}
+}
+
+func (h *pingBackendHandler) ping(ctx context.Context) *pingBackendResponse {
+	response := &pingBackendResponse{
+		OK:  true,
+		Key: pingBackendKeyPrefix + uuid.NewString(),
+	}
+	startedAt := time.Now()
+
+	step := func(name string, fn func() error) bool {
+		if !response.OK {
+			response.Steps = append(response.Steps, pingBackendStep{Name: name, Skipped: true})
+			return false
+		}
+
+		stepStartedAt := time.Now()
+		err := fn()
+		result := pingBackendStep{Name: name, DurationMs: time.Since(stepStartedAt).Milliseconds()}
+		if err != nil {
+			result.Error = err.Error()
+			response.OK = false
+		}
+		response.Steps = append(response.Steps, result)
+		return err == nil
+	}
+
+	var uploadURL *storage.URLInfo
+	step("upload_url", func() (err error) {
+		uploadURL, err = h.backend.UploadURL(ctx, response.Key, nil)
+		return err
+	})
+	uploaded := step("upload", func() error {
+		return h.proxy.UploadFromReader(ctx, uploadURL, response.Key, bytes.NewReader(pingBackendPayload), int64(len(pingBackendPayload)))
+	})
+
+	var downloadURLs []*storage.URLInfo
+	step("download_urls", func() (err error) {
+		downloadURLs, err = h.backend.DownloadURLs(ctx, response.Key)
+		if err == nil && len(downloadURLs) == 0 {
+			err = storage.ErrCacheNotFound
+		}
+		return err
+	})
+	step("download", func() error {
+		var body bytes.Buffer
+		if err := h.proxy.DownloadToWriter(ctx, downloadURLs[0], response.Key, &body); err != nil {
+			return err
+		}
+		if !bytes.Equal(body.Bytes(), pingBackendPayload) {
+			return fmt.Errorf("downloaded %d bytes that differ from the uploaded sentinel", body.Len())
+		}
+		return nil
+	})
+
+	// Clean up the sentinel even if the download failed, as long as it was uploaded.
+	deletable, canDelete := h.backend.(storage.DeletableBlobStorageBackend)
+	if uploaded && canDelete {
+		stepStartedAt := time.Now()
+		err := deletable.Delete(ctx, response.Key)
+		result := pingBackendStep{Name: "delete", DurationMs: time.Since(stepStartedAt).Milliseconds()}
+		if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+			result.Error = err.Error()
+			response.OK = false
+		}
+		response.Steps = append(response.Steps, result)
+	} else {
+		response.Steps = append(response.Steps, pingBackendStep{Name: "delete", Skipped: true})
+	}
+
+	response.DurationMs = time.Since(startedAt).Milliseconds()
+	return response
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPingBackend(t *testing.T) {
+	backend, err := storage.NewFilesystemStorage(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = backend.Close()
+	})
+
+	mux, _, err := createMuxAndGRPCServer("localhost", backend, Options{AdminToken: "secret"}, echoFactory{id: "a"})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, PingBackendPath, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, req)
+
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+	var response pingBackendResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	require.True(t, response.OK)
+
+	var names []string
+	for _, step := range response.Steps {
+		require.Empty(t, step.Error, step.Name)
+		require.False(t, step.Skipped, step.Name)
+		names = append(names, step.Name)
+	}
+	require.Equal(t, []string{"upload_url", "upload", "download_urls", "download", "delete"}, names)
+
+	_, err = backend.CacheInfo(context.Background(), response.Key, nil)
+	require.ErrorIs(t, err, storage.ErrCacheNotFound)
+}
+
+func TestPingBackendRequiresToken(t *testing.T) {
+	mux, _, err := createMuxAndGRPCServer("localhost", nil, Options{AdminToken: "secret"}, echoFactory{id: "a"})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, PingBackendPath, nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, req)
+	require.Equal(t, http.StatusUnauthorized, recorder.Code)
+}
+
+func TestPingBackendDisabledWithoutToken(t *testing.T) {
+	mux, _, err := createMuxAndGRPCServer("localhost", nil, Options{}, echoFactory{id: "a"})
+	require.NoError(t, err)
+
+	code, _ := get(t, mux, PingBackendPath)
+	require.Equal(t, http.StatusNotFound, code)
+}
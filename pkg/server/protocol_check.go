@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"strings"
+
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+)
+
+// ProtocolMetadataKey is the object metadata key holding the ID of the protocol that
+// wrote an object, recorded when Options.AssertObjectProtocol is set.
+const ProtocolMetadataKey = "omni-cache-protocol"
+
+// ErrProtocolMismatch is returned, with Options.AssertObjectProtocol, when a protocol
+// reads an object written by another protocol it doesn't share objects with. It means
+// that the two protocols' keys collide.
+var ErrProtocolMismatch = errors.New("object was written by another protocol")
+
+// protocolCheckStorage tags the objects a protocol writes with its ID and fails reads of
+// objects written by other protocols, so that cross-protocol key collisions surface
+// during development instead of serving the wrong content. Objects without a tag, such
+// as those written before the check was enabled, are served as usual.
+type protocolCheckStorage struct {
+	storage.MultipartBlobStorageBackend
+
+	protocol string
+	// shared are the other protocols whose objects this protocol may read.
+	shared map[string]struct{}
+}
+
+func (s *protocolCheckStorage) UploadURL(ctx context.Context, key string, metadata map[string]string) (*storage.URLInfo, error) {
+	return s.MultipartBlobStorageBackend.UploadURL(ctx, key, s.withProtocol(metadata))
+}
+
+func (s *protocolCheckStorage) CreateMultipartUpload(ctx context.Context, key string, metadata map[string]string) (string, error) {
+	return s.MultipartBlobStorageBackend.CreateMultipartUpload(ctx, key, s.withProtocol(metadata))
+}
+
+func (s *protocolCheckStorage) CacheInfo(ctx context.Context, key string, prefixes []string) (*storage.CacheInfo, error) {
+	info, err := s.MultipartBlobStorageBackend.CacheInfo(ctx, key, prefixes)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.check(ctx, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// DownloadURLs checks the object's protocol first, which costs an extra metadata lookup.
+func (s *protocolCheckStorage) DownloadURLs(ctx context.Context, key string) ([]*storage.URLInfo, error) {
+	if _, err := s.CacheInfo(ctx, key, nil); err != nil {
+		return nil, err
+	}
+	return s.MultipartBlobStorageBackend.DownloadURLs(ctx, key)
+}
+
+func (s *protocolCheckStorage) withProtocol(metadata map[string]string) map[string]string {
+	result := maps.Clone(metadata)
+	if result == nil {
+		result = map[string]string{}
+	}
+	result[ProtocolMetadataKey] = s.protocol
+	return result
+}
+
+func (s *protocolCheckStorage) check(ctx context.Context, info *storage.CacheInfo) error {
+	var writer string
+	for k, v := range info.Metadata {
+		if strings.EqualFold(k, ProtocolMetadataKey) {
+			writer = v
+			break
+		}
+	}
+	if writer == "" || writer == s.protocol {
+		return nil
+	}
+	if _, ok := s.shared[writer]; ok {
+		return nil
+	}
+
+	slog.ErrorContext(ctx, "protocol read an object written by another protocol",
+		"key", info.Key, "protocol", s.protocol, "writer", writer)
+	return fmt.Errorf("%w: %s read %q, which %s wrote", ErrProtocolMismatch, s.protocol, info.Key, writer)
+}
+
+// sharedProtocols returns, for every protocol, the other protocols whose objects it may
+// read: those either of them lists in protocols.Description.SharesObjectsWith.
+func sharedProtocols(sharesWith map[string][]string) map[string]map[string]struct{} {
+	shared := map[string]map[string]struct{}{}
+	add := func(reader, writer string) {
+		if shared[reader] == nil {
+			shared[reader] = map[string]struct{}{}
+		}
+		shared[reader][writer] = struct{}{}
+	}
+	for id, others := range sharesWith {
+		for _, other := range others {
+			add(id, other)
+			add(other, id)
+		}
+	}
+	return shared
+}
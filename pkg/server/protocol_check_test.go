@@ -0,0 +1,70 @@
+package server_test
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cirruslabs/omni-cache/pkg/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAssertObjectProtocol(t *testing.T) {
+	backend := newFilesystemBackend(t)
+	addr := startBuiltinServer(t, backend, server.Options{AssertObjectProtocol: true})
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodPut, "http://"+addr+"/v1-shared", strings.NewReader("payload"))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	info, err := backend.CacheInfo(t.Context(), "v1-shared", nil)
+	require.NoError(t, err)
+	require.Equal(t, "http-cache", info.Metadata[server.ProtocolMetadataKey])
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get("http://" + addr + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	// The writer reads its own objects.
+	status, body := get("/v1-shared")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "payload", body)
+
+	// GitHub Actions cache v1 archives are served by http-cache, so they share objects.
+	status, body = get("/_apis/artifactcache/cache?keys=shared&version=v1")
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, body, `"cacheKey":"shared"`)
+
+	// azure-blob has no business reading http-cache's objects: the keys collide.
+	status, _ = get("/_azureblob/cirrus-runners-cache/v1-shared")
+	require.Equal(t, http.StatusInternalServerError, status)
+}
+
+func TestAssertObjectProtocolDisabledByDefault(t *testing.T) {
+	backend := newFilesystemBackend(t)
+	addr := startBuiltinServer(t, backend, server.Options{})
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodPut, "http://"+addr+"/untagged", strings.NewReader("payload"))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	info, err := backend.CacheInfo(t.Context(), "untagged", nil)
+	require.NoError(t, err)
+	require.NotContains(t, info.Metadata, server.ProtocolMetadataKey)
+
+	resp, err = http.Get("http://" + addr + "/_azureblob/cirrus-runners-cache/untagged")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
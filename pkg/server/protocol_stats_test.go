@@ -0,0 +1,38 @@
+package server_test
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cirruslabs/omni-cache/pkg/protocols"
+	"github.com/cirruslabs/omni-cache/pkg/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProtocolStatsCountProxiedTransfers(t *testing.T) {
+	addr := startBuiltinServer(t, newFilesystemBackend(t), server.Options{})
+	protocolStats := protocols.Stats("http-cache")
+	before := protocolStats.Snapshot()
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodPut, "http://"+addr+"/key", strings.NewReader("payload"))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp, err = http.Get("http://" + addr + "/key")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, "payload", string(body))
+
+	after := protocolStats.Snapshot()
+	require.Equal(t, before.Uploads.Count+1, after.Uploads.Count)
+	require.Equal(t, before.Uploads.Bytes+int64(len("payload")), after.Uploads.Bytes)
+	require.Equal(t, before.Downloads.Count+1, after.Downloads.Count)
+	require.Equal(t, before.Downloads.Bytes+int64(len("payload")), after.Downloads.Bytes)
+}
@@ -0,0 +1,133 @@
+package server_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	remoteexecution "github.com/cirruslabs/omni-cache/internal/api/build/bazel/remote/execution/v2"
+	"github.com/cirruslabs/omni-cache/internal/protocols/bazel_remote"
+	"github.com/cirruslabs/omni-cache/pkg/protocols/builtin"
+	"github.com/cirruslabs/omni-cache/pkg/server"
+	"github.com/stretchr/testify/require"
+	bytestream "google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestReadOnlyHTTP(t *testing.T) {
+	backend := newFilesystemBackend(t)
+	writable := startBuiltinServer(t, backend, server.Options{})
+	readOnly := startBuiltinServer(t, backend, server.Options{ReadOnly: true})
+
+	do := func(method string, url string, body string) (int, string) {
+		req, err := http.NewRequestWithContext(t.Context(), method, url, strings.NewReader(body))
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(data)
+	}
+
+	code, _ := do(http.MethodPut, "http://"+writable+"/read-only/entry", "payload")
+	require.Equal(t, http.StatusCreated, code)
+
+	code, body := do(http.MethodGet, "http://"+readOnly+"/read-only/entry", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "payload", body)
+
+	code, _ = do(http.MethodPut, "http://"+readOnly+"/read-only/other", "payload")
+	require.Equal(t, http.StatusForbidden, code)
+	code, _ = do(http.MethodDelete, "http://"+readOnly+"/read-only/entry", "")
+	require.Equal(t, http.StatusForbidden, code)
+
+	code, _ = do(http.MethodPost, "http://"+readOnly+"/_apis/artifactcache/caches", `{"key":"gha","version":"v1"}`)
+	require.Equal(t, http.StatusForbidden, code)
+
+	code, _ = do(http.MethodPost, "http://"+readOnly+"/tuist/api/cache/module/start?account_handle=acme&project_handle=app&hash=abcd&name=artifact.zip", "")
+	require.Equal(t, http.StatusForbidden, code)
+}
+
+func TestReadOnlyGRPC(t *testing.T) {
+	backend := newFilesystemBackend(t)
+	writable := startBuiltinServer(t, backend, server.Options{})
+	readOnly := startBuiltinServer(t, backend, server.Options{ReadOnly: true})
+
+	data := []byte("blob")
+	sum := sha256.Sum256(data)
+	digest := &remoteexecution.Digest{Hash: hex.EncodeToString(sum[:]), SizeBytes: int64(len(data))}
+
+	writableConn := dialGRPC(t, writable)
+	response, err := remoteexecution.NewContentAddressableStorageClient(writableConn).BatchUpdateBlobs(t.Context(), &remoteexecution.BatchUpdateBlobsRequest{
+		Requests: []*remoteexecution.BatchUpdateBlobsRequest_Request{{Digest: digest, Data: data}},
+	})
+	require.NoError(t, err)
+	require.EqualValues(t, codes.OK, response.GetResponses()[0].GetStatus().GetCode())
+
+	conn := dialGRPC(t, readOnly)
+	cas := remoteexecution.NewContentAddressableStorageClient(conn)
+
+	readResponse, err := cas.BatchReadBlobs(t.Context(), &remoteexecution.BatchReadBlobsRequest{
+		Digests: []*remoteexecution.Digest{digest},
+	})
+	require.NoError(t, err)
+	require.EqualValues(t, codes.OK, readResponse.GetResponses()[0].GetStatus().GetCode())
+	require.Equal(t, data, readResponse.GetResponses()[0].GetData())
+
+	response, err = cas.BatchUpdateBlobs(t.Context(), &remoteexecution.BatchUpdateBlobsRequest{
+		Requests: []*remoteexecution.BatchUpdateBlobsRequest_Request{{Digest: digest, Data: data}},
+	})
+	require.NoError(t, err)
+	require.EqualValues(t, codes.PermissionDenied, response.GetResponses()[0].GetStatus().GetCode())
+
+	stream, err := bytestream.NewByteStreamClient(conn).Write(t.Context())
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&bytestream.WriteRequest{
+		ResourceName: fmt.Sprintf("uploads/read-only/blobs/%s/%d", digest.GetHash(), digest.GetSizeBytes()),
+		Data:         data,
+		FinishWrite:  true,
+	}))
+	_, err = stream.CloseAndRecv()
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func dialGRPC(t *testing.T, addr string) *grpc.ClientConn {
+	t.Helper()
+
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return conn
+}
+
+func TestReadOnlyKeepsListing(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	factories := builtin.FactoriesWithConfig(builtin.Config{
+		BazelRemote: bazel_remote.Options{UsageReportInterval: time.Minute},
+	})
+	srv, err := server.StartWithOptions(t.Context(), []net.Listener{listener}, newFilesystemBackend(t),
+		server.Options{ReadOnly: true}, factories...)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = srv.Close()
+	})
+
+	resp, err := http.Get("http://" + listener.Addr().String() + bazel_remote.UsageReportPath)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cirruslabs/omni-cache/pkg/protocols"
+	"github.com/stretchr/testify/require"
+)
+
+type echoProtocol struct {
+	id string
+}
+
+func (p echoProtocol) Register(registrar *protocols.Registrar) error {
+	registrar.HTTP().HandleFunc("GET /"+p.id+"/{rest...}", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, p.id+":"+r.URL.Path)
+	})
+	return nil
+}
+
+type echoFactory struct {
+	id string
+	// mountPrefixes records what MountPrefix reported for each protocol ID.
+	mountPrefixes map[string]string
+}
+
+func (f echoFactory) ID() string {
+	return f.id
+}
+
+func (f echoFactory) New(deps protocols.Dependencies) (protocols.Protocol, error) {
+	for id := range f.mountPrefixes {
+		prefix, ok := deps.MountPrefix(id)
+		if !ok {
+			prefix = "<not served>"
+		}
+		f.mountPrefixes[id] = prefix
+	}
+	return echoProtocol{id: f.id}, nil
+}
+
+func get(t *testing.T, handler http.Handler, path string) (int, string) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec.Code, rec.Body.String()
+}
+
+func TestRoutesMountProtocolsUnderPrefixes(t *testing.T) {
+	observed := map[string]string{"a": "", "b": "", "c": ""}
+	options := Options{Routes: []Route{
+		{Prefix: "/team-a/", Protocols: []string{"a"}},
+		{Prefix: "/team-b", Protocols: []string{"b"}},
+	}}
+
+	mux, _, err := createMuxAndGRPCServer("localhost", nil, options,
+		echoFactory{id: "a", mountPrefixes: observed},
+		echoFactory{id: "b"},
+		echoFactory{id: "c"},
+	)
+	require.NoError(t, err)
+
+	code, body := get(t, mux, "/team-a/a/key")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "a:/a/key", body)
+
+	code, body = get(t, mux, "/team-b/b/key")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "b:/b/key", body)
+
+	code, _ = get(t, mux, "/team-a/b/key")
+	require.Equal(t, http.StatusNotFound, code)
+	code, _ = get(t, mux, "/a/key")
+	require.Equal(t, http.StatusNotFound, code)
+	code, _ = get(t, mux, "/c/key")
+	require.Equal(t, http.StatusNotFound, code)
+
+	require.Equal(t, map[string]string{"a": "/team-a", "b": "/team-b", "c": "<not served>"}, observed)
+}
+
+func TestRoutesWithoutConfigurationServeAtRoot(t *testing.T) {
+	observed := map[string]string{"b": ""}
+
+	mux, _, err := createMuxAndGRPCServer("localhost", nil, Options{},
+		echoFactory{id: "a", mountPrefixes: observed},
+		echoFactory{id: "b"},
+	)
+	require.NoError(t, err)
+
+	code, body := get(t, mux, "/b/key")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "b:/b/key", body)
+	require.Equal(t, map[string]string{"b": ""}, observed)
+}
+
+func TestRoutesValidation(t *testing.T) {
+	testCases := []struct {
+		name   string
+		routes []Route
+		errMsg string
+	}{
+		{
+			name:   "overlapping prefixes",
+			routes: []Route{{Prefix: "/cache", Protocols: []string{"a"}}, {Prefix: "/cache/v2", Protocols: []string{"b"}}},
+			errMsg: `route prefix "/cache/v2" overlaps with "/cache"`,
+		},
+		{
+			name:   "duplicate prefixes",
+			routes: []Route{{Prefix: "/cache/", Protocols: []string{"a"}}, {Prefix: "/cache", Protocols: []string{"b"}}},
+			errMsg: `route prefix "/cache" overlaps with "/cache"`,
+		},
+		{
+			name:   "root prefix",
+			routes: []Route{{Prefix: "/", Protocols: []string{"a"}}},
+			errMsg: "must not be the root",
+		},
+		{
+			name:   "relative prefix",
+			routes: []Route{{Prefix: "cache", Protocols: []string{"a"}}},
+			errMsg: `must start with "/"`,
+		},
+		{
+			name:   "wildcard prefix",
+			routes: []Route{{Prefix: "/{tenant}", Protocols: []string{"a"}}},
+			errMsg: `must not contain whitespace, "{" or "}"`,
+		},
+		{
+			name:   "prefix with a space",
+			routes: []Route{{Prefix: "/cache v2", Protocols: []string{"a"}}},
+			errMsg: `must not contain whitespace, "{" or "}"`,
+		},
+		{
+			name:   "unclean prefix",
+			routes: []Route{{Prefix: "/cache//v2", Protocols: []string{"a"}}},
+			errMsg: "must be a clean path",
+		},
+		{
+			name:   "unknown protocol",
+			routes: []Route{{Prefix: "/cache", Protocols: []string{"missing"}}},
+			errMsg: `unknown protocol "missing"`,
+		},
+		{
+			name:   "protocol routed twice",
+			routes: []Route{{Prefix: "/x", Protocols: []string{"a"}}, {Prefix: "/y", Protocols: []string{"a"}}},
+			errMsg: `protocol "a" is routed under both "/x" and "/y"`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			_, _, err := createMuxAndGRPCServer("localhost", nil, Options{Routes: testCase.routes},
+				echoFactory{id: "a"},
+				echoFactory{id: "b"},
+			)
+			require.ErrorContains(t, err, testCase.errMsg)
+		})
+	}
+}
+
+func TestRoutePrefixesDoNotOverlapOnPartialSegments(t *testing.T) {
+	_, _, err := createMuxAndGRPCServer("localhost", nil, Options{Routes: []Route{
+		{Prefix: "/cache", Protocols: []string{"a"}},
+		{Prefix: "/cache-v2", Protocols: []string{"b"}},
+	}}, echoFactory{id: "a"}, echoFactory{id: "b"})
+	require.NoError(t, err)
+}
@@ -10,16 +10,24 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
+	"unicode"
 
+	"github.com/cirruslabs/omni-cache/pkg/errdetail"
 	"github.com/cirruslabs/omni-cache/pkg/protocols"
 	"github.com/cirruslabs/omni-cache/pkg/protocols/builtin"
+	"github.com/cirruslabs/omni-cache/pkg/signedurl"
 	"github.com/cirruslabs/omni-cache/pkg/stats"
 	"github.com/cirruslabs/omni-cache/pkg/storage"
+	urlproxy "github.com/cirruslabs/omni-cache/pkg/url-proxy"
+	"github.com/klauspost/compress/gzhttp"
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/h2c"
 	"google.golang.org/grpc"
@@ -27,6 +35,10 @@ import (
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
+// StatsPath serves the live cache stats summary, as JSON unless the Accept header
+// prefers text/plain, regardless of which protocols are enabled.
+const StatsPath = "/_omni/stats"
+
 const (
 	activeRequestsPerLogicalCPU = 4
 
@@ -113,7 +125,85 @@ func isAddrInUse(err error) bool {
 	return strings.Contains(err.Error(), "address already in use")
 }
 
+// Options customizes a server started with StartWithOptions.
+type Options struct {
+	// Middleware wraps the combined HTTP/gRPC handler, outermost first.
+	Middleware []func(http.Handler) http.Handler
+	// ErrorDetail controls whether internal error detail is returned to clients.
+	// Empty means errdetail.Internal.
+	ErrorDetail errdetail.Mode
+	// ProxyOptions configure the URL proxy shared by protocols.
+	ProxyOptions []urlproxy.ProxyOption
+	// Routes mount protocols under URL path prefixes. When empty, every protocol is
+	// served at the root; otherwise only the protocols listed in a route are served.
+	Routes []Route
+	// MaxAge maps protocol IDs to the maximum age of cache entries served to that
+	// protocol. Older entries are treated as misses. Protocols not listed serve entries
+	// of any age.
+	MaxAge map[string]time.Duration
+	// HitMiss maps protocol IDs to how their cache hits and misses are counted in
+	// stats.Default(), e.g. stats.HitMissLabelOnly to keep a protocol dominated by
+	// existence checks out of the aggregate hit rate. Protocols not listed use
+	// stats.HitMissTotals.
+	HitMiss map[string]stats.HitMissMode
+	// KeyIndex keeps an index of the stored keys in a backend that can't list them, so
+	// that listing-based features such as quotas and usage reports work with it. See
+	// storage.NewIndexedStorage. Backends that list natively are used as they are.
+	KeyIndex bool
+	// ReadOnly rejects every write protocols make to storage with storage.ErrReadOnly,
+	// which they report as HTTP 403 or gRPC PermissionDenied. Reads keep working.
+	ReadOnly bool
+	// AuthToken, when set, must be sent as a bearer token with every request: in the
+	// Authorization header over HTTP and in AuthMetadataKey over gRPC. Requests without
+	// it are rejected with 401 or Unauthenticated. The admin endpoints, HealthPath,
+	// ReadyPath and gRPC health checks are exempt.
+	AuthToken string
+	// URLSigner, when set, signs the URLs that protocols hand out to clients, such as
+	// GitHub Actions cache archive locations, and requests to signed URLs are verified
+	// instead of carrying AuthToken. Invalid or expired signatures are rejected with 403.
+	URLSigner *signedurl.Signer
+	// TopKeys, when positive, tracks up to this many of the most requested cache keys
+	// and serves them at TopKeysPath. Each request counts once for every key it looks
+	// up, and its response bytes count for the key it downloads. Keys are only tracked
+	// when AdminToken is set too.
+	TopKeys int
+	// AdminToken enables the admin endpoints, such as PingBackendPath. Requests must
+	// carry it as a bearer token. Empty disables them.
+	AdminToken string
+	// AccessLog logs a line at AccessLogLevel for every HTTP request and gRPC call, with
+	// its cache key, hit or miss, bytes and duration. Each request gets an ID, sent back
+	// in RequestIDHeader and available from RequestID; log with NewRequestIDLogHandler
+	// so that other logs made with the request context carry it too.
+	AccessLog      bool
+	AccessLogLevel slog.Level
+	// MaxConcurrentUploads maps protocol IDs to how many uploads to storage each protocol
+	// may run at once. Further uploads wait for a slot, so that one protocol's burst of
+	// writes can't overwhelm the backend. Protocols not listed are not limited. Uploads
+	// in flight and waiting are reported per protocol in stats.Default(). Uploads count
+	// against the protocol that sends them, so GitHub Actions cache v2 entries, which
+	// are uploaded through azure-blob, are limited by the azure-blob entry.
+	MaxConcurrentUploads map[string]int
+	// AssertObjectProtocol tags every object a protocol writes with its ID, in
+	// ProtocolMetadataKey, and fails reads of objects written by another protocol with
+	// ErrProtocolMismatch, unless one of them lists the other in
+	// protocols.Description.SharesObjectsWith. It's a debugging safeguard that catches
+	// protocols whose keys collide in the shared bucket.
+	AssertObjectProtocol bool
+}
+
+// Route serves the HTTP routes of the listed protocols under Prefix. gRPC services
+// are not path-based and are always registered on the shared gRPC server.
+type Route struct {
+	Prefix    string
+	Protocols []string
+}
+
 func Start(ctx context.Context, listeners []net.Listener, backend storage.BlobStorageBackend, factories ...protocols.Factory) (*http.Server, error) {
+	return StartWithOptions(ctx, listeners, backend, Options{}, factories...)
+}
+
+// StartWithOptions is like Start, but accepts additional server options.
+func StartWithOptions(ctx context.Context, listeners []net.Listener, backend storage.BlobStorageBackend, options Options, factories ...protocols.Factory) (*http.Server, error) {
 	if len(listeners) == 0 {
 		return nil, fmt.Errorf("no listeners provided")
 	}
@@ -127,12 +217,21 @@ func Start(ctx context.Context, listeners []net.Listener, backend storage.BlobSt
 	}
 
 	host := selectHost(listeners)
-	mux, grpcServer, err := createMuxAndGRPCServer(host, backend, factories...)
+	mux, grpcServer, err := createMuxAndGRPCServer(host, backend, options, factories...)
 	if err != nil {
 		return nil, err
 	}
 
-	handler := h2c.NewHandler(grpcOrHTTPHandler(grpcServer, mux), &http2.Server{})
+	httpHandler := authorizeHTTP(options.AuthToken, options.URLSigner, mux)
+	if options.AccessLog || options.tracksTopKeys() {
+		// gRPC calls are recorded by the interceptors instead, which know the RPC outcome.
+		httpHandler = accessLogHTTP(options.AccessLog, options.AccessLogLevel, httpHandler)
+	}
+	var handler http.Handler = errdetail.Middleware(options.ErrorDetail)(grpcOrHTTPHandler(grpcServer, httpHandler))
+	for i := len(options.Middleware) - 1; i >= 0; i-- {
+		handler = options.Middleware[i](handler)
+	}
+	handler = h2c.NewHandler(handler, &http2.Server{})
 
 	httpServer := &http.Server{
 		// Use parent context as a base for the HTTP cache handlers
@@ -170,7 +269,7 @@ func grpcOrHTTPHandler(grpcServer *grpc.Server, httpHandler http.Handler) http.H
 	})
 }
 
-func createMuxAndGRPCServer(host string, backend storage.BlobStorageBackend, factories ...protocols.Factory) (*http.ServeMux, *grpc.Server, error) {
+func createMuxAndGRPCServer(host string, backend storage.BlobStorageBackend, options Options, factories ...protocols.Factory) (*http.ServeMux, *grpc.Server, error) {
 	maxConcurrentConnections := runtime.NumCPU() * activeRequestsPerLogicalCPU
 
 	httpClient := &http.Client{
@@ -181,22 +280,69 @@ func createMuxAndGRPCServer(host string, backend storage.BlobStorageBackend, fac
 		Timeout: 10 * time.Minute,
 	}
 
+	if options.KeyIndex {
+		multipart, ok := backend.(storage.MultipartBlobStorageBackend)
+		if !ok {
+			return nil, nil, fmt.Errorf("the key index requires a multipart storage backend")
+		}
+		backend = storage.NewIndexedStorage(multipart, "", 0)
+	}
+
+	protocolStorage := backend
+	if options.ReadOnly {
+		multipart, ok := backend.(storage.MultipartBlobStorageBackend)
+		if !ok {
+			return nil, nil, fmt.Errorf("read-only mode requires a multipart storage backend")
+		}
+		protocolStorage = storage.NewReadOnlyStorage(multipart)
+	}
+
 	deps := protocols.Dependencies{
-		Storage: backend,
-		HTTP:    httpClient,
-		Host:    host,
+		Storage:  protocolStorage,
+		HTTP:     httpClient,
+		URLProxy: urlproxy.NewProxy(append([]urlproxy.ProxyOption{urlproxy.WithHTTPClient(httpClient)}, options.ProxyOptions...)...),
+		Host:     host,
+
+		URLSigner: options.URLSigner,
 	}.WithDefaults()
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("GET /metrics/cache", statsHandler)
-	mux.HandleFunc("DELETE /metrics/cache", statsResetHandler)
-	grpcServer := grpc.NewServer()
+	mux.Handle("GET /metrics/cache", compressInternal(http.HandlerFunc(statsHandler)))
+	mux.Handle("DELETE /metrics/cache", compressInternal(http.HandlerFunc(statsResetHandler)))
+	mux.Handle("GET "+StatsPath, compressInternal(http.HandlerFunc(statsJSONHandler)))
+	backendHealth := &healthHandler{backend: backend}
+	mux.Handle("GET "+HealthPath, backendHealth)
+	mux.Handle("GET "+ReadyPath, backendHealth)
+	if options.AdminToken != "" {
+		mux.Handle("GET "+PingBackendPath, requireAdminToken(options.AdminToken, &pingBackendHandler{
+			backend: backend,
+			proxy:   deps.URLProxy,
+		}))
+	}
+	var topKeys *stats.TopKeys
+	if options.tracksTopKeys() {
+		topKeys = stats.NewTopKeys(options.TopKeys)
+		handler := requireAdminToken(options.AdminToken, compressInternal(&topKeysHandler{topKeys: topKeys}))
+		mux.Handle("GET "+TopKeysPath, handler)
+		mux.Handle("DELETE "+TopKeysPath, handler)
+	}
+	unaryInterceptors := []grpc.UnaryServerInterceptor{authUnaryServerInterceptor(options.AuthToken), errdetail.UnaryServerInterceptor()}
+	streamInterceptors := []grpc.StreamServerInterceptor{authStreamServerInterceptor(options.AuthToken), errdetail.StreamServerInterceptor()}
+	if options.AccessLog || topKeys != nil {
+		unaryInterceptors = append([]grpc.UnaryServerInterceptor{accessLogUnaryServerInterceptor(options.AccessLog, options.AccessLogLevel)}, unaryInterceptors...)
+		streamInterceptors = append([]grpc.StreamServerInterceptor{accessLogStreamServerInterceptor(options.AccessLog, options.AccessLogLevel)}, streamInterceptors...)
+	}
+	grpcServer := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(unaryInterceptors...),
+		grpc.ChainStreamInterceptor(streamInterceptors...),
+	)
 	healthServer := health.NewServer()
 	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
 	healthpb.RegisterHealthServer(grpcServer, healthServer)
 	registrar := protocols.NewRegistrar(mux, grpcServer)
 
 	seenIDs := map[string]struct{}{}
+	sharesWith := map[string][]string{}
 	for _, factory := range factories {
 		id := factory.ID()
 		if id == "" {
@@ -206,19 +352,184 @@ func createMuxAndGRPCServer(host string, backend storage.BlobStorageBackend, fac
 			return nil, nil, fmt.Errorf("duplicate protocol factory ID %q", id)
 		}
 		seenIDs[id] = struct{}{}
+		sharesWith[id] = protocols.Describe(factory).SharesObjectsWith
+	}
+	sharedWith := sharedProtocols(sharesWith)
 
-		protocol, err := factory.New(deps)
+	for id := range options.MaxAge {
+		if _, ok := seenIDs[id]; !ok {
+			return nil, nil, fmt.Errorf("max age configured for unknown protocol %q", id)
+		}
+	}
+	for id, maxConcurrent := range options.MaxConcurrentUploads {
+		if _, ok := seenIDs[id]; !ok {
+			return nil, nil, fmt.Errorf("max concurrent uploads configured for unknown protocol %q", id)
+		}
+		if maxConcurrent < 0 {
+			return nil, nil, fmt.Errorf("max concurrent uploads for protocol %q must not be negative", id)
+		}
+	}
+	for id := range options.HitMiss {
+		if _, ok := seenIDs[id]; !ok {
+			return nil, nil, fmt.Errorf("hit/miss mode configured for unknown protocol %q", id)
+		}
+	}
+	for id := range seenIDs {
+		protocols.Stats(id).SetHitMissMode(options.HitMiss[id])
+	}
+
+	discovery := newDiscovery()
+	registrars := map[string]*protocols.Registrar{}
+	if len(options.Routes) != 0 {
+		prefixes, err := routePrefixes(options.Routes, seenIDs)
+		if err != nil {
+			return nil, nil, err
+		}
+		deps.MountPrefix = func(protocolID string) (string, bool) {
+			prefix, ok := prefixes[protocolID]
+			return prefix, ok
+		}
+
+		for _, route := range options.Routes {
+			prefix := normalizeRoutePrefix(route.Prefix)
+			routeMux := http.NewServeMux()
+			mux.Handle(prefix+"/", http.StripPrefix(prefix, routeMux))
+			for _, id := range route.Protocols {
+				registrars[id] = protocols.NewRegistrar(routeMux, grpcServer)
+			}
+		}
+	}
+
+	for id := range seenIDs {
+		if _, ok := deps.MountPrefix(id); ok {
+			deps.ServedProtocols = append(deps.ServedProtocols, id)
+		}
+	}
+	slices.Sort(deps.ServedProtocols)
+
+	for _, factory := range factories {
+		id := factory.ID()
+		protocolRegistrar := registrar
+		if len(options.Routes) != 0 {
+			var ok bool
+			if protocolRegistrar, ok = registrars[id]; !ok {
+				// Protocols that no route lists are not served.
+				continue
+			}
+		}
+
+		protocolDeps := deps
+		protocolStats := protocols.Stats(id)
+		uploads := newUploadLimiter(options.MaxConcurrentUploads[id], protocolStats)
+		protocolDeps.HTTP = uploads.client(deps.HTTP)
+		protocolDeps.URLProxy = deps.URLProxy.With(
+			urlproxy.WithHTTPClient(uploads.client(deps.URLProxy.HTTPClient())),
+			urlproxy.WithStats(protocolStats),
+		)
+		protocolDeps.UploadTransport = uploads.transport
+		if maxAge := options.MaxAge[id]; maxAge > 0 {
+			multipart, ok := protocolStorage.(storage.MultipartBlobStorageBackend)
+			if !ok {
+				return nil, nil, fmt.Errorf("%s: max age requires a multipart storage backend", id)
+			}
+			protocolDeps.Storage = storage.NewMaxAgeStorage(multipart, maxAge)
+		}
+		if options.AssertObjectProtocol {
+			multipart, ok := protocolDeps.Storage.(storage.MultipartBlobStorageBackend)
+			if !ok {
+				return nil, nil, fmt.Errorf("%s: object protocol assertions require a multipart storage backend", id)
+			}
+			protocolDeps.Storage = storage.WithCapabilities(&protocolCheckStorage{MultipartBlobStorageBackend: multipart, protocol: id, shared: sharedWith[id]}, storage.CapabilitiesOf(multipart))
+		}
+		if options.AccessLog || topKeys != nil {
+			multipart, ok := protocolDeps.Storage.(storage.MultipartBlobStorageBackend)
+			if !ok {
+				return nil, nil, fmt.Errorf("%s: access logging and top keys require a multipart storage backend", id)
+			}
+			protocolDeps.Storage = storage.WithCapabilities(&accessLogStorage{MultipartBlobStorageBackend: multipart, topKeys: topKeys}, storage.CapabilitiesOf(multipart))
+		}
+
+		protocol, err := factory.New(protocolDeps)
 		if err != nil {
 			return nil, nil, fmt.Errorf("%s: create failed: %w", id, err)
 		}
-		if err := protocol.Register(registrar); err != nil {
+		if err := protocol.Register(protocolRegistrar); err != nil {
 			return nil, nil, fmt.Errorf("%s: register failed: %w", id, err)
 		}
+
+		prefix, _ := deps.MountPrefix(id)
+		discovery.Protocols = append(discovery.Protocols, DiscoveredProtocol{
+			Description: protocols.Describe(factory),
+			Prefix:      prefix,
+		})
 	}
+	mux.Handle("GET "+DiscoveryPath, compressInternal(&discoveryHandler{discovery: discovery}))
 
 	return mux, grpcServer, nil
 }
 
+// routePrefixes validates routes and returns the normalized prefix of every routed
+// protocol. Prefixes must not overlap, since a request could otherwise match more
+// than one route.
+func routePrefixes(routes []Route, knownIDs map[string]struct{}) (map[string]string, error) {
+	prefixes := map[string]string{}
+	var seenPrefixes []string
+
+	for _, route := range routes {
+		prefix := normalizeRoutePrefix(route.Prefix)
+		if !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("route prefix %q must start with \"/\"", route.Prefix)
+		}
+		if prefix == "/" {
+			return nil, fmt.Errorf("route prefix %q must not be the root", route.Prefix)
+		}
+		// Prefixes become ServeMux patterns, where whitespace separates a method and
+		// braces mark wildcards, and unclean paths are redirected away from.
+		if strings.ContainsAny(prefix, "{}") || strings.ContainsFunc(prefix, unicode.IsSpace) {
+			return nil, fmt.Errorf("route prefix %q must not contain whitespace, \"{\" or \"}\"", route.Prefix)
+		}
+		if path.Clean(prefix) != prefix {
+			return nil, fmt.Errorf("route prefix %q must be a clean path", route.Prefix)
+		}
+		for _, other := range seenPrefixes {
+			if routePrefixesOverlap(prefix, other) {
+				return nil, fmt.Errorf("route prefix %q overlaps with %q", prefix, other)
+			}
+		}
+		seenPrefixes = append(seenPrefixes, prefix)
+
+		if len(route.Protocols) == 0 {
+			return nil, fmt.Errorf("route %q has no protocols", prefix)
+		}
+		for _, id := range route.Protocols {
+			if _, ok := knownIDs[id]; !ok {
+				return nil, fmt.Errorf("route %q: unknown protocol %q", prefix, id)
+			}
+			if other, ok := prefixes[id]; ok {
+				return nil, fmt.Errorf("protocol %q is routed under both %q and %q", id, other, prefix)
+			}
+			prefixes[id] = prefix
+		}
+	}
+
+	return prefixes, nil
+}
+
+func normalizeRoutePrefix(prefix string) string {
+	prefix = strings.TrimSpace(prefix)
+	if prefix == "/" {
+		return prefix
+	}
+	return strings.TrimRight(prefix, "/")
+}
+
+func routePrefixesOverlap(a, b string) bool {
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	return a == b || strings.HasPrefix(b, a+"/")
+}
+
 func selectHost(listeners []net.Listener) string {
 	for _, listener := range listeners {
 		if listener == nil {
@@ -254,17 +565,43 @@ func listenUnixSocket(socketPath string) (net.Listener, error) {
 	return listener, nil
 }
 
+// compressInternal gzips the responses of internal endpoints, such as stats and discovery,
+// for clients that accept it, which saves bandwidth for monitoring systems polling them.
+// Cache data is never compressed this way: clients expect it byte for byte, and it's
+// usually compressed already.
+func compressInternal(handler http.Handler) http.Handler {
+	return gzhttp.GzipHandler(handler)
+}
+
 func statsHandler(w http.ResponseWriter, r *http.Request) {
-	writeStatsResponse(w, r)
+	writeStatsResponse(w, r, statsFormatText)
+}
+
+// statsJSONHandler serves the live stats summary for polling, as JSON unless the
+// request asks for text. It only reads the counters, so polling never records hits or
+// misses.
+func statsJSONHandler(w http.ResponseWriter, r *http.Request) {
+	writeStatsResponse(w, r, statsFormatJSON)
 }
 
 func statsResetHandler(w http.ResponseWriter, r *http.Request) {
 	stats.Default().Reset()
-	writeStatsResponse(w, r)
+	writeStatsResponse(w, r, statsFormatText)
 }
 
-func writeStatsResponse(w http.ResponseWriter, r *http.Request) {
-	if acceptsGithubActions(r.Header.Get("Accept")) {
+type statsFormat int
+
+const (
+	statsFormatText statsFormat = iota
+	statsFormatJSON
+	statsFormatGithubActions
+)
+
+// writeStatsResponse writes the stats summary in the format negotiated from the Accept
+// header, or in fallback when the header names none of the supported formats.
+func writeStatsResponse(w http.ResponseWriter, r *http.Request, fallback statsFormat) {
+	switch negotiateStatsFormat(r.Header.Get("Accept"), fallback) {
+	case statsFormatGithubActions:
 		snapshot := stats.Default().Snapshot()
 		if !snapshot.HasActivity() {
 			w.WriteHeader(http.StatusNoContent)
@@ -272,45 +609,60 @@ func writeStatsResponse(w http.ResponseWriter, r *http.Request) {
 		}
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		_, _ = io.WriteString(w, stats.FormatGithubActionsSummary(snapshot))
-		return
-	}
-
-	if acceptsJSON(r.Header.Get("Accept")) {
+	case statsFormatJSON:
 		w.Header().Set("Content-Type", "application/json")
 		if err := json.NewEncoder(w).Encode(stats.Default().Summary()); err != nil {
 			slog.ErrorContext(r.Context(), "failed to encode stats response", "err", err)
 		}
-		return
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = io.WriteString(w, stats.Default().SummaryText())
 	}
-
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	_, _ = io.WriteString(w, stats.Default().SummaryText())
 }
 
-func acceptsJSON(acceptHeader string) bool {
-	if strings.TrimSpace(acceptHeader) == "" {
-		return false
-	}
+// negotiateStatsFormat picks the supported format the Accept header prefers, honoring
+// q-values; on a tie the one listed first wins. Wildcards and unsupported media types
+// leave the choice to fallback.
+func negotiateStatsFormat(acceptHeader string, fallback statsFormat) statsFormat {
+	best, bestQuality := fallback, 0.0
 	for _, part := range strings.Split(acceptHeader, ",") {
-		mediaType := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
-		if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
-			return true
+		mediaType, params, _ := strings.Cut(part, ";")
+		mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+
+		var format statsFormat
+		switch {
+		case strings.Contains(mediaType, "github-actions"):
+			format = statsFormatGithubActions
+		case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+			format = statsFormatJSON
+		case mediaType == "text/plain":
+			format = statsFormatText
+		default:
+			continue
+		}
+
+		if quality := acceptQuality(params); quality > bestQuality {
+			best, bestQuality = format, quality
 		}
 	}
-	return false
+	return best
 }
 
-func acceptsGithubActions(acceptHeader string) bool {
-	if strings.TrimSpace(acceptHeader) == "" {
-		return false
-	}
-	for _, part := range strings.Split(acceptHeader, ",") {
-		mediaType := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
-		if strings.Contains(mediaType, "github-actions") {
-			return true
+// acceptQuality returns the q-value among the parameters of an Accept media range,
+// defaulting to 1. Malformed values count as 0, i.e. not acceptable.
+func acceptQuality(params string) float64 {
+	for _, param := range strings.Split(params, ";") {
+		name, value, _ := strings.Cut(param, "=")
+		if !strings.EqualFold(strings.TrimSpace(name), "q") {
+			continue
+		}
+		quality, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return 0
 		}
+		return quality
 	}
-	return false
+	return 1
 }
 
 // DefaultSocketPath returns the default unix socket path for omni-cache.
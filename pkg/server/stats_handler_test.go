@@ -1,9 +1,11 @@
 package server
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/cirruslabs/omni-cache/pkg/stats"
 	"github.com/stretchr/testify/require"
@@ -19,7 +21,7 @@ func TestStatsHandlerGithubActionsNoActivity(t *testing.T) {
 	req.Header.Set("Accept", "text/vnd.github-actions")
 	recorder := httptest.NewRecorder()
 
-	writeStatsResponse(recorder, req)
+	writeStatsResponse(recorder, req, statsFormatText)
 
 	require.Equal(t, http.StatusNoContent, recorder.Code)
 	require.Empty(t, recorder.Body.String())
@@ -38,8 +40,82 @@ func TestStatsHandlerGithubActionsWithActivity(t *testing.T) {
 	req.Header.Set("Accept", "text/vnd.github-actions")
 	recorder := httptest.NewRecorder()
 
-	writeStatsResponse(recorder, req)
+	writeStatsResponse(recorder, req, statsFormatText)
 
 	require.Equal(t, http.StatusOK, recorder.Code)
 	require.Equal(t, stats.FormatGithubActionsSummary(snapshot), recorder.Body.String())
 }
+
+func TestStatsJSONEndpoint(t *testing.T) {
+	stats.Default().Reset()
+	t.Cleanup(func() {
+		stats.Default().Reset()
+	})
+
+	mux, _, err := createMuxAndGRPCServer("localhost", nil, Options{}, echoFactory{id: "a"})
+	require.NoError(t, err)
+
+	stats.Default().RecordCacheHit()
+	stats.Default().RecordCacheHit()
+	stats.Default().RecordCacheMiss()
+	stats.Default().RecordUpload(1024, time.Second)
+	stats.Default().RecordUpload(2048, time.Second)
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, StatsPath, nil))
+
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+
+	var summary stats.Summary
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &summary))
+	require.Equal(t, stats.Default().Summary(), summary)
+	require.EqualValues(t, 2, summary.CacheHits)
+	require.EqualValues(t, 1, summary.CacheMisses)
+	require.EqualValues(t, 2, summary.Uploads.Count)
+	require.EqualValues(t, 3072, summary.Uploads.Bytes)
+}
+
+func TestStatsEndpointTextPlain(t *testing.T) {
+	stats.Default().Reset()
+	t.Cleanup(func() {
+		stats.Default().Reset()
+	})
+
+	mux, _, err := createMuxAndGRPCServer("localhost", nil, Options{}, echoFactory{id: "a"})
+	require.NoError(t, err)
+
+	stats.Default().RecordCacheHit()
+
+	req := httptest.NewRequest(http.MethodGet, StatsPath, nil)
+	req.Header.Set("Accept", "text/plain")
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, req)
+
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, "text/plain; charset=utf-8", recorder.Header().Get("Content-Type"))
+	require.Equal(t, stats.Default().SummaryText(), recorder.Body.String())
+}
+
+func TestNegotiateStatsFormat(t *testing.T) {
+	for _, tc := range []struct {
+		accept   string
+		fallback statsFormat
+		expected statsFormat
+	}{
+		{"", statsFormatText, statsFormatText},
+		{"", statsFormatJSON, statsFormatJSON},
+		{"*/*", statsFormatJSON, statsFormatJSON},
+		{"text/plain", statsFormatJSON, statsFormatText},
+		{"application/json", statsFormatText, statsFormatJSON},
+		{"application/problem+json", statsFormatText, statsFormatJSON},
+		{"text/html, application/json", statsFormatText, statsFormatJSON},
+		{"text/plain, application/json", statsFormatJSON, statsFormatText},
+		{"application/json;q=0.5, text/plain", statsFormatJSON, statsFormatText},
+		{"text/plain;q=0.2, application/json;q=0.9", statsFormatText, statsFormatJSON},
+		{"application/json;q=0", statsFormatText, statsFormatText},
+		{"text/vnd.github-actions", statsFormatText, statsFormatGithubActions},
+	} {
+		require.Equal(t, tc.expected, negotiateStatsFormat(tc.accept, tc.fallback), "Accept: %q", tc.accept)
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/cirruslabs/omni-cache/pkg/stats"
+)
+
+// TopKeysPath lists the most requested cache keys with their hits, misses and bytes,
+// ordered by the "by" query parameter (requests, hits, misses or bytes) and limited to
+// "limit" keys. DELETE forgets them. It is only served when Options.TopKeys and
+// Options.AdminToken are set.
+const TopKeysPath = "/_admin/top-keys"
+
+const defaultTopKeysLimit = 100
+
+func (options Options) tracksTopKeys() bool {
+	return options.TopKeys > 0 && options.AdminToken != ""
+}
+
+type topKeysResponse struct {
+	Capacity int              `json:"capacity"`
+	By       string           `json:"by"`
+	Keys     []stats.KeyCount `json:"keys"`
+}
+
+type topKeysHandler struct {
+	topKeys *stats.TopKeys
+}
+
+func (h *topKeysHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		h.topKeys.Reset()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	query := r.URL.Query()
+	by := query.Get("by")
+	switch by {
+	case "":
+		by = "requests"
+	case "requests", "hits", "misses", "bytes":
+	default:
+		http.Error(w, "by must be one of requests, hits, misses or bytes", http.StatusBadRequest)
+		return
+	}
+	limit := defaultTopKeysLimit
+	if rawLimit := query.Get("limit"); rawLimit != "" {
+		var err error
+		if limit, err = strconv.Atoi(rawLimit); err != nil || limit <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	response := topKeysResponse{
+		Capacity: h.topKeys.Capacity(),
+		By:       by,
+		Keys:     h.topKeys.Top(by, limit),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		slog.ErrorContext(r.Context(), "failed to encode top keys response", "err", err)
+	}
+}
@@ -0,0 +1,106 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cirruslabs/omni-cache/internal/protocols/http_cache"
+	"github.com/cirruslabs/omni-cache/pkg/protocols/builtin"
+	"github.com/cirruslabs/omni-cache/pkg/server"
+	"github.com/cirruslabs/omni-cache/pkg/stats"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopKeys(t *testing.T) {
+	addr := startBuiltinServer(t, newFilesystemBackend(t), server.Options{TopKeys: 10, AdminToken: "admin"})
+
+	do := func(method string, path string, body string, authorization string) *http.Response {
+		req, err := http.NewRequestWithContext(t.Context(), method, "http://"+addr+path, strings.NewReader(body))
+		require.NoError(t, err)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = resp.Body.Close()
+		})
+		return resp
+	}
+
+	require.Equal(t, http.StatusCreated, do(http.MethodPut, "/hot", "payload", "").StatusCode)
+	// The HEAD only checks that the key exists, so only the GETs download bytes.
+	require.Equal(t, http.StatusOK, do(http.MethodHead, "/hot", "", "").StatusCode)
+	for range 2 {
+		require.Equal(t, http.StatusOK, do(http.MethodGet, "/hot", "", "").StatusCode)
+	}
+	require.Equal(t, http.StatusNotFound, do(http.MethodGet, "/cold", "", "").StatusCode)
+
+	require.Equal(t, http.StatusUnauthorized, do(http.MethodGet, server.TopKeysPath, "", "").StatusCode)
+
+	resp := do(http.MethodGet, server.TopKeysPath, "", "Bearer admin")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var response struct {
+		Capacity int              `json:"capacity"`
+		Keys     []stats.KeyCount `json:"keys"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+	require.Equal(t, 10, response.Capacity)
+	require.Equal(t, []stats.KeyCount{
+		{Key: "hot", Requests: 3, Hits: 3, Bytes: 2 * int64(len("payload"))},
+		{Key: "cold", Requests: 1, Misses: 1},
+	}, response.Keys)
+
+	resp = do(http.MethodGet, server.TopKeysPath+"?by=misses&limit=1", "", "Bearer admin")
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+	require.Len(t, response.Keys, 1)
+	require.Equal(t, "cold", response.Keys[0].Key)
+
+	require.Equal(t, http.StatusBadRequest, do(http.MethodGet, server.TopKeysPath+"?by=nope", "", "Bearer admin").StatusCode)
+	require.Equal(t, http.StatusNoContent, do(http.MethodDelete, server.TopKeysPath, "", "Bearer admin").StatusCode)
+}
+
+func TestTopKeysCountsEachRequestOnce(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	factories := builtin.FactoriesWithConfig(builtin.Config{HTTPCache: http_cache.Options{ContentDisposition: true}})
+	srv, err := server.StartWithOptions(t.Context(), []net.Listener{listener}, newFilesystemBackend(t),
+		server.Options{TopKeys: 10, AdminToken: "admin"}, factories...)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = srv.Close()
+	})
+	baseURL := "http://" + listener.Addr().String()
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodPut, baseURL+"/file", strings.NewReader("payload"))
+	require.NoError(t, err)
+	req.Header.Set("Content-Disposition", `attachment; filename="file.txt"`)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	// Serving the filename looks the key up a second time, which must not count.
+	resp, err = http.Get(baseURL + "/file")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, `attachment; filename=file.txt`, resp.Header.Get("Content-Disposition"))
+
+	req, err = http.NewRequestWithContext(t.Context(), http.MethodGet, baseURL+server.TopKeysPath, nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer admin")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var response struct {
+		Keys []stats.KeyCount `json:"keys"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+	require.Equal(t, []stats.KeyCount{
+		{Key: "file", Requests: 1, Hits: 1, Bytes: int64(len("payload"))},
+	}, response.Keys)
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/cirruslabs/omni-cache/pkg/stats"
+)
+
+// uploadLimiter counts the uploads to storage of one protocol and, when slots is not
+// nil, bounds how many run at once, so that a burst of one protocol's writes can't
+// exhaust the backend for the others.
+type uploadLimiter struct {
+	slots chan struct{}
+	stats *stats.Collector
+}
+
+func newUploadLimiter(maxConcurrent int, collector *stats.Collector) *uploadLimiter {
+	limiter := &uploadLimiter{stats: collector}
+	if maxConcurrent > 0 {
+		limiter.slots = make(chan struct{}, maxConcurrent)
+	}
+	return limiter
+}
+
+// transport wraps next so that the uploads made through it are counted and limited.
+func (l *uploadLimiter) transport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &uploadLimitTransport{next: next, limiter: l}
+}
+
+// client returns a copy of client whose uploads are counted and limited.
+func (l *uploadLimiter) client(client *http.Client) *http.Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	limited := *client
+	limited.Transport = l.transport(client.Transport)
+	return &limited
+}
+
+type uploadLimitTransport struct {
+	next    http.RoundTripper
+	limiter *uploadLimiter
+}
+
+// RoundTrip holds an upload slot for PUT requests, which is how protocols write objects
+// and parts to storage URLs, until the response arrives, by which point the body is sent.
+func (t *uploadLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodPut {
+		return t.next.RoundTrip(req)
+	}
+
+	if slots := t.limiter.slots; slots != nil {
+		t.limiter.stats.AddUploadsWaiting(1)
+		select {
+		case slots <- struct{}{}:
+			t.limiter.stats.AddUploadsWaiting(-1)
+			defer func() {
+				<-slots
+			}()
+		case <-req.Context().Done():
+			t.limiter.stats.AddUploadsWaiting(-1)
+			// A RoundTripper must close the body even when it doesn't send the request.
+			if req.Body != nil {
+				_ = req.Body.Close()
+			}
+			return nil, req.Context().Err()
+		}
+	}
+
+	t.limiter.stats.AddUploadsInFlight(1)
+	defer t.limiter.stats.AddUploadsInFlight(-1)
+	return t.next.RoundTrip(req)
+}
+
+// Unwrap returns the transport uploads are limited on top of, for clients that only
+// download, such as Bazel origin fetches, and need to configure the underlying transport.
+func (t *uploadLimitTransport) Unwrap() http.RoundTripper {
+	return t.next
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cirruslabs/omni-cache/pkg/protocols"
+	"github.com/cirruslabs/omni-cache/pkg/stats"
+	"github.com/stretchr/testify/require"
+)
+
+// uploaderFactory serves POST /{id}/upload, which uploads the request body to target
+// with the protocol's HTTP client.
+type uploaderFactory struct {
+	id     string
+	target string
+}
+
+func (f uploaderFactory) ID() string {
+	return f.id
+}
+
+func (f uploaderFactory) New(deps protocols.Dependencies) (protocols.Protocol, error) {
+	return uploaderProtocol{id: f.id, target: f.target, client: deps.HTTP}, nil
+}
+
+type uploaderProtocol struct {
+	id     string
+	target string
+	client *http.Client
+}
+
+func (p uploaderProtocol) Register(registrar *protocols.Registrar) error {
+	registrar.HTTP().HandleFunc("POST /"+p.id+"/upload", func(w http.ResponseWriter, r *http.Request) {
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodPut, p.target, r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp, err := p.client.Do(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		_ = resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+	})
+	return nil
+}
+
+func TestMaxConcurrentUploadsPerProtocol(t *testing.T) {
+	stats.Default().Reset()
+
+	var inFlight, maxInFlight atomic.Int64
+	release := make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			observed := maxInFlight.Load()
+			if current <= observed || maxInFlight.CompareAndSwap(observed, current) {
+				break
+			}
+		}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(target.Close)
+
+	mux, _, err := createMuxAndGRPCServer("localhost", nil, Options{
+		MaxConcurrentUploads: map[string]int{"limited": 2},
+	}, uploaderFactory{id: "limited", target: target.URL}, uploaderFactory{id: "unlimited", target: target.URL})
+	require.NoError(t, err)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	upload := func(id string) int {
+		resp, err := http.Post(srv.URL+"/"+id+"/upload", "application/octet-stream", strings.NewReader("payload"))
+		if err != nil {
+			return 0
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	const uploads = 5
+	statuses := make(chan int, uploads+1)
+	var wg sync.WaitGroup
+	for range uploads {
+		wg.Go(func() {
+			statuses <- upload("limited")
+		})
+	}
+
+	limited := stats.Default().For("limited")
+	require.Eventually(t, func() bool {
+		snapshot := limited.Snapshot()
+		return snapshot.UploadsInFlight == 2 && snapshot.UploadsWaiting == uploads-2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Another protocol's uploads aren't held up by the limit.
+	wg.Go(func() {
+		statuses <- upload("unlimited")
+	})
+	require.Eventually(t, func() bool {
+		return stats.Default().For("unlimited").Snapshot().UploadsInFlight == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.EqualValues(t, 3, inFlight.Load())
+
+	summary := stats.Default().Summary()
+	require.EqualValues(t, 2, summary.Labels["limited"].UploadsInFlight)
+	require.EqualValues(t, uploads-2, summary.Labels["limited"].UploadsWaiting)
+	require.EqualValues(t, 3, summary.UploadsInFlight)
+
+	close(release)
+	wg.Wait()
+	close(statuses)
+	for status := range statuses {
+		require.Equal(t, http.StatusOK, status)
+	}
+	require.EqualValues(t, 3, maxInFlight.Load())
+	require.Zero(t, limited.Snapshot().UploadsInFlight)
+	require.Zero(t, limited.Snapshot().UploadsWaiting)
+}
+
+func TestMaxConcurrentUploadsValidation(t *testing.T) {
+	_, _, err := createMuxAndGRPCServer("localhost", nil, Options{
+		MaxConcurrentUploads: map[string]int{"missing": 1},
+	}, echoFactory{id: "a"})
+	require.ErrorContains(t, err, `unknown protocol "missing"`)
+
+	_, _, err = createMuxAndGRPCServer("localhost", nil, Options{
+		MaxConcurrentUploads: map[string]int{"a": -1},
+	}, echoFactory{id: "a"})
+	require.ErrorContains(t, err, "must not be negative")
+}
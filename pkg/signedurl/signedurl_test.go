@@ -0,0 +1,82 @@
+package signedurl
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSigner(t *testing.T) *Signer {
+	t.Helper()
+
+	signer, err := NewSigner([]byte("key"), time.Minute)
+	require.NoError(t, err)
+	return signer
+}
+
+func signedRequest(t *testing.T, signer *Signer, rawURL string, signMethod string, method string) *http.Request {
+	t.Helper()
+
+	u, err := url.Parse(rawURL)
+	require.NoError(t, err)
+	signer.Sign(u, signMethod)
+	return httptest.NewRequest(method, u.String(), nil)
+}
+
+func TestSignerRoundTrip(t *testing.T) {
+	signer := newTestSigner(t)
+
+	r := signedRequest(t, signer, "http://cache/entries/v-key?skip-hit-miss=1", http.MethodGet, http.MethodGet)
+	require.True(t, Signed(r))
+	require.Equal(t, "1", r.URL.Query().Get("skip-hit-miss"))
+	require.NoError(t, signer.Verify(r))
+
+	r = signedRequest(t, signer, "http://cache/entries/v-key", http.MethodGet, http.MethodHead)
+	require.NoError(t, signer.Verify(r))
+
+	r = signedRequest(t, signer, "http://cache/entries/v-key", http.MethodPut, http.MethodPut)
+	r.URL.RawQuery += "&comp=block&blockid=AAAA"
+	require.NoError(t, signer.Verify(r))
+
+	require.False(t, Signed(httptest.NewRequest(http.MethodGet, "http://cache/entries/v-key", nil)))
+}
+
+func TestSignerRejectsTamperedRequests(t *testing.T) {
+	signer := newTestSigner(t)
+
+	r := signedRequest(t, signer, "http://cache/entries/v-key", http.MethodGet, http.MethodGet)
+	r.URL.Path = "/entries/other"
+	require.ErrorIs(t, signer.Verify(r), ErrInvalidSignature)
+
+	r = signedRequest(t, signer, "http://cache/entries/v-key", http.MethodGet, http.MethodPut)
+	require.ErrorIs(t, signer.Verify(r), ErrInvalidSignature)
+
+	r = signedRequest(t, signer, "http://cache/entries/v-key", http.MethodGet, http.MethodGet)
+	query := r.URL.Query()
+	query.Set(ExpiresParam, "99999999999")
+	r.URL.RawQuery = query.Encode()
+	require.ErrorIs(t, signer.Verify(r), ErrInvalidSignature)
+
+	other, err := NewSigner([]byte("other key"), time.Minute)
+	require.NoError(t, err)
+	r = signedRequest(t, other, "http://cache/entries/v-key", http.MethodGet, http.MethodGet)
+	require.ErrorIs(t, signer.Verify(r), ErrInvalidSignature)
+}
+
+func TestSignerExpiry(t *testing.T) {
+	signer := newTestSigner(t)
+	issuedAt := time.Unix(1700000000, 0)
+	signer.now = func() time.Time { return issuedAt }
+
+	r := signedRequest(t, signer, "http://cache/entries/v-key", http.MethodGet, http.MethodGet)
+
+	signer.now = func() time.Time { return issuedAt.Add(time.Minute) }
+	require.NoError(t, signer.Verify(r))
+
+	signer.now = func() time.Time { return issuedAt.Add(time.Minute + time.Second) }
+	require.ErrorIs(t, signer.Verify(r), ErrExpired)
+}
@@ -5,7 +5,9 @@ import (
 	"log/slog"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -19,6 +21,22 @@ type Collector struct {
 	cacheMiss atomic.Int64
 	downloads transferCounter
 	uploads   transferCounter
+
+	// uploadsInFlight and uploadsWaiting are gauges of the uploads to storage in
+	// progress and of those waiting for an upload slot, see AddUploadsInFlight.
+	uploadsInFlight atomic.Int64
+	uploadsWaiting  atomic.Int64
+
+	// parent is the collector that also counts everything recorded here; nil for
+	// the top-level collector.
+	parent *Collector
+
+	// hitMissOff and hitMissLabelOnly implement the HitMissMode set for a label.
+	hitMissOff       atomic.Bool
+	hitMissLabelOnly atomic.Bool
+
+	labelsMu sync.Mutex
+	labels   map[string]*Collector
 }
 
 type transferCounter struct {
@@ -28,14 +46,17 @@ type transferCounter struct {
 }
 
 type Snapshot struct {
-	CacheHits   int64
-	CacheMisses int64
-	Downloads   TransferSnapshot
-	Uploads     TransferSnapshot
+	CacheHits       int64
+	CacheMisses     int64
+	Downloads       TransferSnapshot
+	Uploads         TransferSnapshot
+	UploadsInFlight int64
+	UploadsWaiting  int64
 }
 
 func (s Snapshot) HasActivity() bool {
-	return s.CacheHits > 0 || s.CacheMisses > 0 || s.Downloads.Count > 0 || s.Uploads.Count > 0
+	return s.CacheHits > 0 || s.CacheMisses > 0 || s.Downloads.Count > 0 || s.Uploads.Count > 0 ||
+		s.UploadsInFlight > 0 || s.UploadsWaiting > 0
 }
 
 type Summary struct {
@@ -44,6 +65,12 @@ type Summary struct {
 	CacheHitRatePercent float64         `json:"cache_hit_rate_percent"`
 	Downloads           TransferSummary `json:"downloads"`
 	Uploads             TransferSummary `json:"uploads"`
+	// UploadsInFlight and UploadsWaiting are the uploads to storage in progress right
+	// now and those waiting for one of the slots a concurrent upload limit allows.
+	UploadsInFlight int64 `json:"uploads_in_flight"`
+	UploadsWaiting  int64 `json:"uploads_waiting"`
+	// Labels breaks the totals down per label (usually a protocol ID), see Collector.For.
+	Labels map[string]Summary `json:"labels,omitempty"`
 }
 
 type TransferSnapshot struct {
@@ -67,35 +94,156 @@ func Default() *Collector {
 	return &defaultCollector
 }
 
+// For returns the collector for label, such as a protocol ID. Everything recorded
+// through it is also counted in the totals of c. Calling For on a labeled collector
+// returns a sibling label rather than nesting.
+func (c *Collector) For(label string) *Collector {
+	if c.parent != nil {
+		return c.parent.For(label)
+	}
+
+	c.labelsMu.Lock()
+	defer c.labelsMu.Unlock()
+
+	if c.labels == nil {
+		c.labels = map[string]*Collector{}
+	}
+	labeled, ok := c.labels[label]
+	if !ok {
+		labeled = &Collector{parent: c}
+		c.labels[label] = labeled
+	}
+	return labeled
+}
+
+// HitMissMode decides how the cache hits and misses recorded through a labeled collector
+// are counted. Protocols that mostly answer existence checks, such as Bazel's
+// FindMissingBlobs, can otherwise skew the aggregate hit rate.
+type HitMissMode string
+
+const (
+	// HitMissTotals counts hits and misses for the label and in the totals. This is the
+	// default.
+	HitMissTotals HitMissMode = "totals"
+	// HitMissLabelOnly counts hits and misses for the label but leaves them out of the
+	// totals.
+	HitMissLabelOnly HitMissMode = "label"
+	// HitMissOff doesn't count hits and misses at all.
+	HitMissOff HitMissMode = "off"
+)
+
+// ParseHitMissMode parses a mode name. Empty means HitMissTotals.
+func ParseHitMissMode(value string) (HitMissMode, error) {
+	switch mode := HitMissMode(value); mode {
+	case "":
+		return HitMissTotals, nil
+	case HitMissTotals, HitMissLabelOnly, HitMissOff:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown hit/miss mode %q: expected %q, %q or %q",
+			value, HitMissTotals, HitMissLabelOnly, HitMissOff)
+	}
+}
+
+// SetHitMissMode changes how hits and misses recorded through c are counted from now on.
+// Transfers are always counted. It has no effect on the top-level collector.
+func (c *Collector) SetHitMissMode(mode HitMissMode) {
+	c.hitMissOff.Store(mode == HitMissOff)
+	c.hitMissLabelOnly.Store(mode == HitMissLabelOnly)
+}
+
 func (c *Collector) RecordCacheHit() {
+	if c.hitMissOff.Load() {
+		return
+	}
 	c.cacheHits.Add(1)
+	if c.parent != nil && !c.hitMissLabelOnly.Load() {
+		c.parent.RecordCacheHit()
+	}
 }
 
 func (c *Collector) RecordCacheMiss() {
+	if c.hitMissOff.Load() {
+		return
+	}
 	c.cacheMiss.Add(1)
+	if c.parent != nil && !c.hitMissLabelOnly.Load() {
+		c.parent.RecordCacheMiss()
+	}
 }
 
 func (c *Collector) RecordDownload(bytes int64, duration time.Duration) {
 	c.downloads.record(bytes, duration)
+	if c.parent != nil {
+		c.parent.RecordDownload(bytes, duration)
+	}
 }
 
 func (c *Collector) RecordUpload(bytes int64, duration time.Duration) {
 	c.uploads.record(bytes, duration)
+	if c.parent != nil {
+		c.parent.RecordUpload(bytes, duration)
+	}
+}
+
+// AddUploadsInFlight adjusts the number of uploads to storage in progress by delta:
+// +1 when one starts and -1 when it ends.
+func (c *Collector) AddUploadsInFlight(delta int64) {
+	c.uploadsInFlight.Add(delta)
+	if c.parent != nil {
+		c.parent.AddUploadsInFlight(delta)
+	}
 }
 
+// AddUploadsWaiting adjusts the number of uploads waiting for an upload slot by delta.
+func (c *Collector) AddUploadsWaiting(delta int64) {
+	c.uploadsWaiting.Add(delta)
+	if c.parent != nil {
+		c.parent.AddUploadsWaiting(delta)
+	}
+}
+
+// Reset zeroes the counters of c and of all its labels. Gauges, such as the uploads in
+// flight, keep their current values.
 func (c *Collector) Reset() {
 	c.cacheHits.Store(0)
 	c.cacheMiss.Store(0)
 	c.downloads.reset()
 	c.uploads.reset()
+
+	for _, labeled := range c.labeled() {
+		labeled.collector.Reset()
+	}
+}
+
+type labeledCollector struct {
+	label     string
+	collector *Collector
+}
+
+// labeled returns the labeled collectors of c sorted by label.
+func (c *Collector) labeled() []labeledCollector {
+	c.labelsMu.Lock()
+	defer c.labelsMu.Unlock()
+
+	result := make([]labeledCollector, 0, len(c.labels))
+	for label, collector := range c.labels {
+		result = append(result, labeledCollector{label: label, collector: collector})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].label < result[j].label
+	})
+	return result
 }
 
 func (c *Collector) Snapshot() Snapshot {
 	return Snapshot{
-		CacheHits:   c.cacheHits.Load(),
-		CacheMisses: c.cacheMiss.Load(),
-		Downloads:   c.downloads.snapshot(),
-		Uploads:     c.uploads.snapshot(),
+		CacheHits:       c.cacheHits.Load(),
+		CacheMisses:     c.cacheMiss.Load(),
+		Downloads:       c.downloads.snapshot(),
+		Uploads:         c.uploads.snapshot(),
+		UploadsInFlight: c.uploadsInFlight.Load(),
+		UploadsWaiting:  c.uploadsWaiting.Load(),
 	}
 }
 
@@ -108,13 +256,27 @@ func (c *Collector) Summary() Summary {
 		hitRate = (float64(snapshot.CacheHits) / float64(totalLookups)) * 100
 	}
 
-	return Summary{
+	summary := Summary{
 		CacheHits:           snapshot.CacheHits,
 		CacheMisses:         snapshot.CacheMisses,
 		CacheHitRatePercent: hitRate,
 		Downloads:           summarizeTransfer(snapshot.Downloads),
 		Uploads:             summarizeTransfer(snapshot.Uploads),
+		UploadsInFlight:     snapshot.UploadsInFlight,
+		UploadsWaiting:      snapshot.UploadsWaiting,
 	}
+
+	for _, labeled := range c.labeled() {
+		if !labeled.collector.Snapshot().HasActivity() {
+			continue
+		}
+		if summary.Labels == nil {
+			summary.Labels = map[string]Summary{}
+		}
+		summary.Labels[labeled.label] = labeled.collector.Summary()
+	}
+
+	return summary
 }
 
 func (c *Collector) LogSummary() {
@@ -129,6 +291,24 @@ func (c *Collector) LogSummary() {
 		"downloads", formatTransferSummary(snapshot.Downloads),
 		"uploads", formatTransferSummary(snapshot.Uploads),
 	)
+
+	for _, labeled := range c.labeled() {
+		snapshot := labeled.collector.Snapshot()
+		if !snapshot.HasActivity() {
+			continue
+		}
+		totalLookups := snapshot.CacheHits + snapshot.CacheMisses
+
+		slog.Info(
+			"omni-cache stats",
+			"label", labeled.label,
+			"cacheHits", snapshot.CacheHits,
+			"cacheMisses", snapshot.CacheMisses,
+			"cacheHitRate", formatPercent(snapshot.CacheHits, totalLookups),
+			"downloads", formatTransferSummary(snapshot.Downloads),
+			"uploads", formatTransferSummary(snapshot.Uploads),
+		)
+	}
 }
 
 func (c *Collector) SummaryText() string {
@@ -142,6 +322,27 @@ func (c *Collector) SummaryText() string {
 	fmt.Fprintf(&builder, "cache hit rate: %s\n", formatPercent(snapshot.CacheHits, totalLookups))
 	fmt.Fprintf(&builder, "downloads: %s\n", formatTransferSummary(snapshot.Downloads))
 	fmt.Fprintf(&builder, "uploads: %s\n", formatTransferSummary(snapshot.Uploads))
+	fmt.Fprintf(&builder, "uploads in flight: %d (%d waiting)\n", snapshot.UploadsInFlight, snapshot.UploadsWaiting)
+
+	for _, labeled := range c.labeled() {
+		snapshot := labeled.collector.Snapshot()
+		if !snapshot.HasActivity() {
+			continue
+		}
+		totalLookups := snapshot.CacheHits + snapshot.CacheMisses
+
+		fmt.Fprintf(&builder, "%s: hits=%d misses=%d hitRate=%s downloads=%s uploads=%s uploadsInFlight=%d uploadsWaiting=%d\n",
+			labeled.label,
+			snapshot.CacheHits,
+			snapshot.CacheMisses,
+			formatPercent(snapshot.CacheHits, totalLookups),
+			formatTransferSummary(snapshot.Downloads),
+			formatTransferSummary(snapshot.Uploads),
+			snapshot.UploadsInFlight,
+			snapshot.UploadsWaiting,
+		)
+	}
+
 	return builder.String()
 }
 
@@ -161,6 +362,25 @@ func FormatGithubActionsSummary(snapshot Snapshot) string {
 	)
 }
 
+// FormatReport renders snapshot as a short human-readable report for developers.
+// Bytes downloaded from the cache are reported as bytes saved.
+func FormatReport(snapshot Snapshot) string {
+	totalLookups := snapshot.CacheHits + snapshot.CacheMisses
+
+	var builder strings.Builder
+	builder.WriteString("Omni Cache report\n")
+	if !snapshot.HasActivity() {
+		builder.WriteString("  no cache activity\n")
+		return builder.String()
+	}
+	fmt.Fprintf(&builder, "  hits:     %d\n", snapshot.CacheHits)
+	fmt.Fprintf(&builder, "  misses:   %d\n", snapshot.CacheMisses)
+	fmt.Fprintf(&builder, "  hit rate: %s\n", formatPercent(snapshot.CacheHits, totalLookups))
+	fmt.Fprintf(&builder, "  saved:    %s in %d downloads\n", humanize.IBytes(uint64(snapshot.Downloads.Bytes)), snapshot.Downloads.Count)
+	fmt.Fprintf(&builder, "  uploaded: %s in %d uploads\n", humanize.IBytes(uint64(snapshot.Uploads.Bytes)), snapshot.Uploads.Count)
+	return builder.String()
+}
+
 func escapeGithubActionsMessage(message string) string {
 	replacer := strings.NewReplacer(
 		"%", "%25",
@@ -29,6 +29,97 @@ func TestCollectorReset(t *testing.T) {
 	require.Equal(t, time.Duration(0), snapshot.Uploads.Duration)
 }
 
+func TestCollectorLabels(t *testing.T) {
+	collector := &Collector{}
+	gha := collector.For("gha-cache")
+	bazel := collector.For("bazel-remote")
+	require.Same(t, gha, collector.For("gha-cache"))
+	require.Same(t, bazel, gha.For("bazel-remote"))
+
+	gha.RecordCacheHit()
+	gha.RecordCacheMiss()
+	gha.RecordUpload(64, time.Second)
+	bazel.RecordCacheHit()
+	bazel.RecordCacheHit()
+	collector.RecordDownload(128, time.Second)
+
+	require.Equal(t, Snapshot{CacheHits: 1, CacheMisses: 1, Uploads: TransferSnapshot{Count: 1, Bytes: 64, Duration: time.Second}}, gha.Snapshot())
+	require.Equal(t, Snapshot{CacheHits: 2}, bazel.Snapshot())
+
+	summary := collector.Summary()
+	require.EqualValues(t, 3, summary.CacheHits)
+	require.EqualValues(t, 1, summary.CacheMisses)
+	require.EqualValues(t, 1, summary.Downloads.Count)
+	require.EqualValues(t, 1, summary.Uploads.Count)
+	require.Equal(t, map[string]Summary{
+		"bazel-remote": bazel.Summary(),
+		"gha-cache":    gha.Summary(),
+	}, summary.Labels)
+	require.EqualValues(t, 50, summary.Labels["gha-cache"].CacheHitRatePercent)
+
+	text := collector.SummaryText()
+	require.Contains(t, text, "bazel-remote: hits=2 misses=0 hitRate=100.0%")
+	require.Contains(t, text, "gha-cache: hits=1 misses=1 hitRate=50.0%")
+
+	collector.Reset()
+	require.False(t, gha.Snapshot().HasActivity())
+	require.Nil(t, collector.Summary().Labels)
+}
+
+func TestCollectorUploadGauges(t *testing.T) {
+	collector := &Collector{}
+	gha := collector.For("gha-cache")
+
+	gha.AddUploadsInFlight(2)
+	gha.AddUploadsWaiting(1)
+	require.Equal(t, Snapshot{UploadsInFlight: 2, UploadsWaiting: 1}, gha.Snapshot())
+	require.True(t, gha.Snapshot().HasActivity())
+	require.EqualValues(t, 2, collector.Summary().UploadsInFlight)
+	require.EqualValues(t, 1, collector.Summary().Labels["gha-cache"].UploadsWaiting)
+	require.Contains(t, collector.SummaryText(), "uploads in flight: 2 (1 waiting)")
+	require.Contains(t, collector.SummaryText(), "gha-cache: hits=0 misses=0 hitRate=0% downloads=none uploads=none uploadsInFlight=2 uploadsWaiting=1")
+
+	// Gauges describe uploads still running, so resetting the counters keeps them.
+	collector.Reset()
+	require.EqualValues(t, 2, gha.Snapshot().UploadsInFlight)
+
+	gha.AddUploadsInFlight(-2)
+	gha.AddUploadsWaiting(-1)
+	require.Equal(t, Snapshot{}, collector.Snapshot())
+}
+
+func TestCollectorHitMissMode(t *testing.T) {
+	collector := &Collector{}
+	bazel := collector.For("bazel-remote")
+	gha := collector.For("gha-cache")
+	llvm := collector.For("llvm-cache")
+	bazel.SetHitMissMode(HitMissLabelOnly)
+	llvm.SetHitMissMode(HitMissOff)
+
+	for _, labeled := range []*Collector{bazel, gha, llvm} {
+		labeled.RecordCacheHit()
+		labeled.RecordCacheMiss()
+		labeled.RecordDownload(64, time.Second)
+	}
+
+	require.Equal(t, Snapshot{CacheHits: 1, CacheMisses: 1, Downloads: TransferSnapshot{Count: 1, Bytes: 64, Duration: time.Second}}, bazel.Snapshot())
+	require.Equal(t, Snapshot{Downloads: TransferSnapshot{Count: 1, Bytes: 64, Duration: time.Second}}, llvm.Snapshot())
+	snapshot := collector.Snapshot()
+	require.EqualValues(t, 1, snapshot.CacheHits)
+	require.EqualValues(t, 1, snapshot.CacheMisses)
+	require.EqualValues(t, 3, snapshot.Downloads.Count)
+
+	bazel.SetHitMissMode(HitMissTotals)
+	bazel.RecordCacheHit()
+	require.EqualValues(t, 2, collector.Snapshot().CacheHits)
+
+	_, err := ParseHitMissMode("sometimes")
+	require.ErrorContains(t, err, "unknown hit/miss mode")
+	mode, err := ParseHitMissMode("")
+	require.NoError(t, err)
+	require.Equal(t, HitMissTotals, mode)
+}
+
 func TestSnapshotHasActivity(t *testing.T) {
 	require.False(t, Snapshot{}.HasActivity())
 	require.True(t, Snapshot{CacheHits: 1}.HasActivity())
@@ -64,3 +155,36 @@ func TestFormatGithubActionsSummary(t *testing.T) {
 
 	require.Equal(t, expected, FormatGithubActionsSummary(snapshot))
 }
+
+func TestFormatReport(t *testing.T) {
+	require.Equal(t, "Omni Cache report\n  no cache activity\n", FormatReport(Snapshot{}))
+
+	snapshot := Snapshot{
+		CacheHits:   3,
+		CacheMisses: 1,
+		Downloads:   TransferSnapshot{Count: 3, Bytes: 3 * 1024 * 1024, Duration: time.Second},
+		Uploads:     TransferSnapshot{Count: 1, Bytes: 512, Duration: time.Second},
+	}
+
+	require.Equal(t, strings.Join([]string{
+		"Omni Cache report",
+		"  hits:     3",
+		"  misses:   1",
+		"  hit rate: 75.0%",
+		"  saved:    3.0 MiB in 3 downloads",
+		"  uploaded: 512 B in 1 uploads",
+		"",
+	}, "\n"), FormatReport(snapshot))
+}
+
+// BenchmarkCollectorRecordParallel measures what recording stats adds to each request
+// when many requests are served concurrently through a labeled collector.
+func BenchmarkCollectorRecordParallel(b *testing.B) {
+	collector := (&Collector{}).For("bench")
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			collector.RecordCacheHit()
+			collector.RecordDownload(1024, time.Millisecond)
+		}
+	})
+}
@@ -0,0 +1,200 @@
+package stats
+
+import (
+	"container/heap"
+	"hash/maphash"
+	"sort"
+	"sync"
+)
+
+const (
+	// maxTopKeysShards bounds how many independently locked shards a TopKeys is split
+	// into, so that recording requests for different keys rarely contends on a lock.
+	maxTopKeysShards = 16
+	// minTopKeysShardCapacity keeps shards large enough for the space-saving estimates to
+	// stay useful; small trackers use a single shard.
+	minTopKeysShardCapacity = 64
+)
+
+// TopKeys tracks the most requested cache keys in bounded memory using the space-saving
+// algorithm: it keeps at most capacity keys, and a new key replaces the least requested
+// one, inheriting its request count. Counts of keys that were replaced at some point are
+// therefore overestimated by at most KeyCount.Error.
+//
+// Large trackers are split into shards by key hash, each with its own lock and an equal
+// share of the capacity, so that Record stays cheap under concurrent requests.
+type TopKeys struct {
+	capacity int
+	seed     maphash.Seed
+	shards   []topKeysShard
+}
+
+type topKeysShard struct {
+	capacity int
+
+	mu    sync.Mutex
+	keys  map[string]*keyCounter
+	byMin keyCounterHeap
+}
+
+// KeyCount holds the counters of one tracked key.
+type KeyCount struct {
+	Key      string `json:"key"`
+	Requests int64  `json:"requests"`
+	Hits     int64  `json:"hits"`
+	Misses   int64  `json:"misses"`
+	Bytes    int64  `json:"bytes"`
+	// Error bounds how much Requests overestimates the key's actual requests.
+	Error int64 `json:"error,omitempty"`
+}
+
+type keyCounter struct {
+	KeyCount
+	index int
+}
+
+// NewTopKeys returns a tracker that keeps at most capacity keys.
+func NewTopKeys(capacity int) *TopKeys {
+	shardCount := min(max(capacity/minTopKeysShardCapacity, 1), maxTopKeysShards)
+
+	t := &TopKeys{
+		capacity: capacity,
+		seed:     maphash.MakeSeed(),
+		shards:   make([]topKeysShard, shardCount),
+	}
+	for i := range t.shards {
+		shard := &t.shards[i]
+		// Spread the remainder so the shard capacities add up to capacity.
+		shard.capacity = capacity / shardCount
+		if i < capacity%shardCount {
+			shard.capacity++
+		}
+		shard.keys = make(map[string]*keyCounter, shard.capacity)
+	}
+	return t
+}
+
+// Capacity returns the maximum number of tracked keys.
+func (t *TopKeys) Capacity() int {
+	return t.capacity
+}
+
+// Record counts a request for key that hit or missed, and that downloaded bytes of it.
+// Requests that only check whether key exists download none.
+func (t *TopKeys) Record(key string, hit bool, bytes int64) {
+	if t.capacity <= 0 {
+		return
+	}
+
+	t.shard(key).record(key, hit, bytes)
+}
+
+func (t *TopKeys) shard(key string) *topKeysShard {
+	if len(t.shards) == 1 {
+		return &t.shards[0]
+	}
+	return &t.shards[maphash.String(t.seed, key)%uint64(len(t.shards))]
+}
+
+func (s *topKeysShard) record(key string, hit bool, bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter, ok := s.keys[key]
+	switch {
+	case ok:
+	case len(s.keys) < s.capacity:
+		counter = &keyCounter{KeyCount: KeyCount{Key: key}}
+		s.keys[key] = counter
+		heap.Push(&s.byMin, counter)
+	default:
+		// Replace the least requested key, which bounds the new key's overestimate.
+		counter = s.byMin[0]
+		delete(s.keys, counter.Key)
+		counter.KeyCount = KeyCount{Key: key, Requests: counter.Requests, Error: counter.Requests}
+		s.keys[key] = counter
+	}
+
+	counter.Requests++
+	if hit {
+		counter.Hits++
+		counter.Bytes += bytes
+	} else {
+		counter.Misses++
+	}
+	heap.Fix(&s.byMin, counter.index)
+}
+
+// Top returns up to limit tracked keys ordered by the given counter, one of "requests",
+// "hits", "misses" or "bytes". A non-positive limit returns all tracked keys.
+func (t *TopKeys) Top(by string, limit int) []KeyCount {
+	result := []KeyCount{}
+	for i := range t.shards {
+		shard := &t.shards[i]
+		shard.mu.Lock()
+		for _, counter := range shard.keys {
+			result = append(result, counter.KeyCount)
+		}
+		shard.mu.Unlock()
+	}
+
+	value := func(count KeyCount) int64 {
+		switch by {
+		case "hits":
+			return count.Hits
+		case "misses":
+			return count.Misses
+		case "bytes":
+			return count.Bytes
+		default:
+			return count.Requests
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if vi, vj := value(result[i]), value(result[j]); vi != vj {
+			return vi > vj
+		}
+		return result[i].Key < result[j].Key
+	})
+
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	return result
+}
+
+// Reset forgets all tracked keys.
+func (t *TopKeys) Reset() {
+	for i := range t.shards {
+		shard := &t.shards[i]
+		shard.mu.Lock()
+		shard.keys = make(map[string]*keyCounter, shard.capacity)
+		shard.byMin = nil
+		shard.mu.Unlock()
+	}
+}
+
+// keyCounterHeap orders counters by request count, least requested first.
+type keyCounterHeap []*keyCounter
+
+func (h keyCounterHeap) Len() int           { return len(h) }
+func (h keyCounterHeap) Less(i, j int) bool { return h[i].Requests < h[j].Requests }
+
+func (h keyCounterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *keyCounterHeap) Push(x any) {
+	counter := x.(*keyCounter)
+	counter.index = len(*h)
+	*h = append(*h, counter)
+}
+
+func (h *keyCounterHeap) Pop() any {
+	old := *h
+	counter := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return counter
+}
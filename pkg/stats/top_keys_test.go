@@ -0,0 +1,107 @@
+package stats
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopKeysOrdering(t *testing.T) {
+	topKeys := NewTopKeys(10)
+	for range 3 {
+		topKeys.Record("hot", true, 100)
+	}
+	topKeys.Record("big", true, 1000)
+	// An existence check downloads nothing.
+	topKeys.Record("big", true, 0)
+	topKeys.Record("cold", false, 0)
+	topKeys.Record("cold", false, 0)
+
+	require.Equal(t, []KeyCount{
+		{Key: "hot", Requests: 3, Hits: 3, Bytes: 300},
+		{Key: "big", Requests: 2, Hits: 2, Bytes: 1000},
+		{Key: "cold", Requests: 2, Misses: 2},
+	}, topKeys.Top("requests", 0))
+
+	require.Equal(t, "big", topKeys.Top("bytes", 1)[0].Key)
+	require.Equal(t, "cold", topKeys.Top("misses", 1)[0].Key)
+	require.Len(t, topKeys.Top("hits", 2), 2)
+
+	topKeys.Reset()
+	require.Empty(t, topKeys.Top("requests", 0))
+}
+
+func TestTopKeysBoundedMemory(t *testing.T) {
+	topKeys := NewTopKeys(2)
+	for range 5 {
+		topKeys.Record("hot", true, 1)
+	}
+	topKeys.Record("a", false, 0)
+	topKeys.Record("b", false, 0)
+	topKeys.Record("c", false, 0)
+
+	top := topKeys.Top("requests", 0)
+	require.Len(t, top, 2)
+	require.Equal(t, KeyCount{Key: "hot", Requests: 5, Hits: 5, Bytes: 5}, top[0])
+	// "c" replaced "b", which had replaced "a", so its count is an overestimate.
+	require.Equal(t, KeyCount{Key: "c", Requests: 3, Misses: 1, Error: 2}, top[1])
+}
+
+func TestTopKeysDisabled(t *testing.T) {
+	topKeys := NewTopKeys(0)
+	topKeys.Record("key", true, 1)
+	require.Empty(t, topKeys.Top("requests", 0))
+}
+
+func TestTopKeysSharded(t *testing.T) {
+	topKeys := NewTopKeys(2000)
+	require.Len(t, topKeys.shards, maxTopKeysShards)
+
+	var capacity int
+	for i := range topKeys.shards {
+		capacity += topKeys.shards[i].capacity
+	}
+	require.Equal(t, 2000, capacity)
+
+	var wg sync.WaitGroup
+	for worker := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 100 {
+				topKeys.Record(fmt.Sprintf("key-%d", i), worker%2 == 0, 10)
+			}
+		}()
+	}
+	wg.Wait()
+
+	top := topKeys.Top("requests", 0)
+	require.Len(t, top, 100)
+	for _, count := range top {
+		require.Equal(t, KeyCount{Key: count.Key, Requests: 8, Hits: 4, Misses: 4, Bytes: 40}, count)
+	}
+}
+
+// BenchmarkTopKeysRecordParallel measures what tracking top keys adds to each request
+// when many requests are served concurrently.
+func BenchmarkTopKeysRecordParallel(b *testing.B) {
+	keys := make([]string, 10_000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("ac/%064x", i)
+	}
+
+	for _, capacity := range []int{minTopKeysShardCapacity, 1000} {
+		b.Run(fmt.Sprintf("capacity=%d", capacity), func(b *testing.B) {
+			topKeys := NewTopKeys(capacity)
+			b.RunParallel(func(pb *testing.PB) {
+				var i int
+				for pb.Next() {
+					topKeys.Record(keys[i%len(keys)], i%3 != 0, 1024)
+					i++
+				}
+			})
+		})
+	}
+}
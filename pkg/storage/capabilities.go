@@ -0,0 +1,72 @@
+package storage
+
+import "context"
+
+// Capabilities are the optional operations of a backend: Delete makes it a
+// DeletableBlobStorageBackend and List a ListableBlobStorageBackend. A nil operation
+// isn't supported.
+type Capabilities struct {
+	Delete func(ctx context.Context, key string) error
+	List   func(ctx context.Context, prefix string, fn func(ObjectInfo) error) error
+}
+
+// CapabilitiesOf returns the optional operations that backend supports.
+func CapabilitiesOf(backend BlobStorageBackend) Capabilities {
+	var capabilities Capabilities
+	if deletable, ok := backend.(DeletableBlobStorageBackend); ok {
+		capabilities.Delete = deletable.Delete
+	}
+	if listable, ok := backend.(ListableBlobStorageBackend); ok {
+		capabilities.List = listable.List
+	}
+	return capabilities
+}
+
+// WithCapabilities returns wrapper with the operations in capabilities added, so that it
+// implements DeletableBlobStorageBackend and ListableBlobStorageBackend only when it can
+// delete and list. Wrappers pass the CapabilitiesOf the backend they wrap, replacing the
+// operations they change, instead of defining Delete and List themselves.
+func WithCapabilities(wrapper MultipartBlobStorageBackend, capabilities Capabilities) MultipartBlobStorageBackend {
+	switch {
+	case capabilities.Delete != nil && capabilities.List != nil:
+		return &deletableListableBackend{wrapper, capabilities.Delete, capabilities.List}
+	case capabilities.Delete != nil:
+		return &deletableBackend{wrapper, capabilities.Delete}
+	case capabilities.List != nil:
+		return &listableBackend{wrapper, capabilities.List}
+	default:
+		return wrapper
+	}
+}
+
+type deletableBackend struct {
+	MultipartBlobStorageBackend
+	delete func(ctx context.Context, key string) error
+}
+
+func (b *deletableBackend) Delete(ctx context.Context, key string) error {
+	return b.delete(ctx, key)
+}
+
+type listableBackend struct {
+	MultipartBlobStorageBackend
+	list func(ctx context.Context, prefix string, fn func(ObjectInfo) error) error
+}
+
+func (b *listableBackend) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	return b.list(ctx, prefix, fn)
+}
+
+type deletableListableBackend struct {
+	MultipartBlobStorageBackend
+	delete func(ctx context.Context, key string) error
+	list   func(ctx context.Context, prefix string, fn func(ObjectInfo) error) error
+}
+
+func (b *deletableListableBackend) Delete(ctx context.Context, key string) error {
+	return b.delete(ctx, key)
+}
+
+func (b *deletableListableBackend) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	return b.list(ctx, prefix, fn)
+}
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// unlistableStorage hides the List support of the wrapped backend.
+type unlistableStorage struct {
+	MultipartBlobStorageBackend
+}
+
+func (s unlistableStorage) Delete(ctx context.Context, key string) error {
+	return s.MultipartBlobStorageBackend.(DeletableBlobStorageBackend).Delete(ctx, key)
+}
+
+// unwrapCapabilities returns the wrapper that WithCapabilities extended.
+func unwrapCapabilities(backend MultipartBlobStorageBackend) MultipartBlobStorageBackend {
+	switch extended := backend.(type) {
+	case *deletableBackend:
+		return extended.MultipartBlobStorageBackend
+	case *listableBackend:
+		return extended.MultipartBlobStorageBackend
+	case *deletableListableBackend:
+		return extended.MultipartBlobStorageBackend
+	default:
+		return backend
+	}
+}
+
+func TestWrappersKeepCapabilities(t *testing.T) {
+	full := newTestMemoryStorage(t)
+	unlistable := unlistableStorage{full}
+
+	wrappers := map[string]func(MultipartBlobStorageBackend) MultipartBlobStorageBackend{
+		"expiring": func(backend MultipartBlobStorageBackend) MultipartBlobStorageBackend {
+			return NewExpiringStorage(backend, time.Hour)
+		},
+		"max-age": func(backend MultipartBlobStorageBackend) MultipartBlobStorageBackend {
+			return NewMaxAgeStorage(backend, time.Hour)
+		},
+		"url-limit": func(backend MultipartBlobStorageBackend) MultipartBlobStorageBackend {
+			return NewURLLimitStorage(backend, 1)
+		},
+		"long-keys": func(backend MultipartBlobStorageBackend) MultipartBlobStorageBackend {
+			return NewLongKeyStorage(backend, 64, true)
+		},
+		"routing": func(backend MultipartBlobStorageBackend) MultipartBlobStorageBackend {
+			routed, err := NewRoutingStorage(RouteByPrefix(map[string]int{"b/": 1}, 0), full, backend)
+			require.NoError(t, err)
+			return routed
+		},
+	}
+	for name, wrap := range wrappers {
+		t.Run(name, func(t *testing.T) {
+			wrapped := wrap(full)
+			require.Implements(t, (*DeletableBlobStorageBackend)(nil), wrapped)
+			require.Implements(t, (*ListableBlobStorageBackend)(nil), wrapped)
+
+			wrapped = wrap(unlistable)
+			require.Implements(t, (*DeletableBlobStorageBackend)(nil), wrapped)
+			_, listable := wrapped.(ListableBlobStorageBackend)
+			require.False(t, listable)
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// DefaultCommitRetryPolicy is the policy used by the sidecar to retry committing multipart
+// uploads after a failure that may be transient, such as an S3 CompleteMultipartUpload
+// failing under load.
+var DefaultCommitRetryPolicy = RetryPolicy{
+	Retries:   2,
+	BaseDelay: 500 * time.Millisecond,
+}
+
+type commitRetryStorage struct {
+	MultipartBlobStorageBackend
+
+	policy RetryPolicy
+}
+
+// NewCommitRetryStorage wraps backend so that CommitMultipartUpload is retried with
+// backoff according to policy before its error is returned. Errors that can't go away by
+// retrying, such as ErrReadOnly, ErrQuotaExceeded or a 4xx response, are returned as is.
+// A retry that finds the upload gone succeeds when the object is stored, since an earlier
+// attempt may have completed the upload and only failed to deliver its response.
+func NewCommitRetryStorage(backend MultipartBlobStorageBackend, policy RetryPolicy) MultipartBlobStorageBackend {
+	if policy.Retries <= 0 {
+		return backend
+	}
+
+	return WithCapabilities(&commitRetryStorage{
+		MultipartBlobStorageBackend: backend,
+		policy:                      policy,
+	}, CapabilitiesOf(backend))
+}
+
+func (s *commitRetryStorage) CommitMultipartUpload(ctx context.Context, key string, uploadID string, parts []MultipartUploadPart) error {
+	for attempt := 0; ; attempt++ {
+		err := s.MultipartBlobStorageBackend.CommitMultipartUpload(ctx, key, uploadID, parts)
+		if attempt > 0 && isNoSuchUploadError(err) {
+			if _, infoErr := s.MultipartBlobStorageBackend.CacheInfo(ctx, key, nil); infoErr == nil {
+				slog.InfoContext(ctx, "multipart upload was committed by an earlier attempt",
+					"key", key, "attempt", attempt+1)
+				return nil
+			}
+		}
+		if err == nil || attempt >= s.policy.Retries || ctx.Err() != nil || !retryableCommitError(err) {
+			return err
+		}
+
+		slog.WarnContext(ctx, "retrying multipart upload commit after failure",
+			"key", key, "attempt", attempt+1, "err", err)
+
+		if err := SleepContext(ctx, s.policy.Delay(attempt)); err != nil {
+			return err
+		}
+	}
+}
+
+func retryableCommitError(err error) bool {
+	if errors.Is(err, ErrReadOnly) || errors.Is(err, ErrQuotaExceeded) || isNoSuchUploadError(err) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var responseErr *smithyhttp.ResponseError
+	if errors.As(err, &responseErr) {
+		return retryableStatus(responseErr.HTTPStatusCode())
+	}
+	return true
+}
+
+// isNoSuchUploadError reports whether err says that the multipart upload doesn't exist,
+// which is also the case once it was committed.
+func isNoSuchUploadError(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchUpload" {
+		return true
+	}
+
+	var responseErr *smithyhttp.ResponseError
+	return errors.As(err, &responseErr) && responseErr.HTTPStatusCode() == http.StatusNotFound
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/smithy-go"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyCommitStorage fails its first `failures` commits with err.
+type flakyCommitStorage struct {
+	MultipartBlobStorageBackend
+
+	err      error
+	failures int
+	commits  int
+}
+
+func (s *flakyCommitStorage) CommitMultipartUpload(ctx context.Context, key string, uploadID string, parts []MultipartUploadPart) error {
+	s.commits++
+	if s.commits <= s.failures {
+		return s.err
+	}
+	return s.MultipartBlobStorageBackend.CommitMultipartUpload(ctx, key, uploadID, parts)
+}
+
+func TestCommitRetryStorageRetriesTransientFailures(t *testing.T) {
+	ctx := context.Background()
+	inner := &flakyCommitStorage{
+		MultipartBlobStorageBackend: newTestFilesystemStorage(t),
+		err:                         errors.New("connection reset"),
+		failures:                    2,
+	}
+	backend := NewCommitRetryStorage(inner, RetryPolicy{Retries: 2})
+
+	uploadID, err := backend.CreateMultipartUpload(ctx, "artifact", nil)
+	require.NoError(t, err)
+	require.NoError(t, backend.CommitMultipartUpload(ctx, "artifact", uploadID, nil))
+	require.Equal(t, 3, inner.commits)
+}
+
+func TestCommitRetryStorageGivesUp(t *testing.T) {
+	ctx := context.Background()
+	transient := errors.New("connection reset")
+
+	inner := &flakyCommitStorage{MultipartBlobStorageBackend: newTestFilesystemStorage(t), err: transient, failures: 5}
+	backend := NewCommitRetryStorage(inner, RetryPolicy{Retries: 2})
+	require.ErrorIs(t, backend.CommitMultipartUpload(ctx, "artifact", "upload", nil), transient)
+	require.Equal(t, 3, inner.commits)
+
+	inner = &flakyCommitStorage{MultipartBlobStorageBackend: newTestFilesystemStorage(t), err: ErrQuotaExceeded, failures: 5}
+	backend = NewCommitRetryStorage(inner, RetryPolicy{Retries: 2})
+	require.ErrorIs(t, backend.CommitMultipartUpload(ctx, "artifact", "upload", nil), ErrQuotaExceeded)
+	require.Equal(t, 1, inner.commits, "permanent errors are not retried")
+}
+
+// lostResponseStorage commits the first time but reports a failure, as when the response
+// is lost, and then reports the upload as gone.
+type lostResponseStorage struct {
+	MultipartBlobStorageBackend
+
+	commits int
+}
+
+func (s *lostResponseStorage) CommitMultipartUpload(ctx context.Context, key string, uploadID string, parts []MultipartUploadPart) error {
+	s.commits++
+	if s.commits == 1 {
+		if err := s.MultipartBlobStorageBackend.CommitMultipartUpload(ctx, key, uploadID, parts); err != nil {
+			return err
+		}
+		return errors.New("connection reset")
+	}
+	return &smithy.GenericAPIError{Code: "NoSuchUpload", Message: "The specified upload does not exist."}
+}
+
+func TestCommitRetryStorageSucceedsWhenAnEarlierAttemptCommitted(t *testing.T) {
+	ctx := context.Background()
+	inner := &lostResponseStorage{MultipartBlobStorageBackend: newTestFilesystemStorage(t)}
+	backend := NewCommitRetryStorage(inner, RetryPolicy{Retries: 2})
+
+	uploadID, err := backend.CreateMultipartUpload(ctx, "artifact", nil)
+	require.NoError(t, err)
+	require.NoError(t, backend.CommitMultipartUpload(ctx, "artifact", uploadID, nil))
+	require.Equal(t, 2, inner.commits)
+
+	// Without the object, the upload being gone is an error.
+	inner = &lostResponseStorage{MultipartBlobStorageBackend: newTestFilesystemStorage(t), commits: 1}
+	backend = NewCommitRetryStorage(&flakyCommitStorage{
+		MultipartBlobStorageBackend: inner,
+		err:                         errors.New("connection reset"),
+		failures:                    1,
+	}, RetryPolicy{Retries: 2})
+	err = backend.CommitMultipartUpload(ctx, "missing", "upload", nil)
+	require.True(t, isNoSuchUploadError(err))
+	require.Equal(t, 2, inner.commits, "a gone upload is not retried")
+}
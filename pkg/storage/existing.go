@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ExistingObjectPolicy decides what happens when content-addressed data is uploaded to a
+// key that is already stored. Since such keys are derived from the content, the stored
+// object is identical unless the hash collided or something is broken.
+type ExistingObjectPolicy string
+
+const (
+	// OverwriteExisting uploads without looking for an existing object.
+	OverwriteExisting ExistingObjectPolicy = "overwrite"
+	// SkipExisting skips the upload when the key is already stored.
+	SkipExisting ExistingObjectPolicy = "skip"
+	// SkipExistingVerifySize skips the upload when the key is already stored with the
+	// expected size, and fails it with ErrExistingSizeMismatch when the size differs.
+	// Objects uploaded with compression are stored at their compressed size, so this
+	// policy doesn't suit them.
+	SkipExistingVerifySize ExistingObjectPolicy = "verify-size"
+)
+
+// ErrExistingSizeMismatch is returned when a content-addressed key is already stored with
+// a different size than the data being uploaded.
+var ErrExistingSizeMismatch = errors.New("existing object has a different size")
+
+// ParseExistingObjectPolicy parses a policy name. Empty means OverwriteExisting.
+func ParseExistingObjectPolicy(value string) (ExistingObjectPolicy, error) {
+	switch policy := ExistingObjectPolicy(value); policy {
+	case "":
+		return OverwriteExisting, nil
+	case OverwriteExisting, SkipExisting, SkipExistingVerifySize:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown existing object policy %q: expected %q, %q or %q",
+			value, OverwriteExisting, SkipExisting, SkipExistingVerifySize)
+	}
+}
+
+// SkipUpload reports whether uploading sizeBytes of content-addressed data to key can be
+// skipped under policy because the key is already stored.
+func (policy ExistingObjectPolicy) SkipUpload(ctx context.Context, backend BlobStorageBackend, key string, sizeBytes int64) (bool, error) {
+	if policy != SkipExisting && policy != SkipExistingVerifySize {
+		return false, nil
+	}
+
+	info, err := backend.CacheInfo(ctx, key, nil)
+	if IsNotFoundError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if policy == SkipExistingVerifySize && info.SizeBytes != sizeBytes {
+		return false, fmt.Errorf("%w: %q is stored with %d bytes, uploading %d bytes",
+			ErrExistingSizeMismatch, key, info.SizeBytes, sizeBytes)
+	}
+	return true, nil
+}
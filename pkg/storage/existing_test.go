@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseExistingObjectPolicy(t *testing.T) {
+	policy, err := ParseExistingObjectPolicy("")
+	require.NoError(t, err)
+	require.Equal(t, OverwriteExisting, policy)
+
+	policy, err = ParseExistingObjectPolicy("verify-size")
+	require.NoError(t, err)
+	require.Equal(t, SkipExistingVerifySize, policy)
+
+	_, err = ParseExistingObjectPolicy("never")
+	require.Error(t, err)
+}
+
+func TestExistingObjectPolicySkipUpload(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestMemoryStorage(t)
+	require.NoError(t, backend.Put(ctx, "cas/abc", strings.NewReader("12345"), nil))
+
+	skip, err := OverwriteExisting.SkipUpload(ctx, backend, "cas/abc", 5)
+	require.NoError(t, err)
+	require.False(t, skip)
+
+	skip, err = SkipExisting.SkipUpload(ctx, backend, "cas/missing", 5)
+	require.NoError(t, err)
+	require.False(t, skip)
+
+	skip, err = SkipExisting.SkipUpload(ctx, backend, "cas/abc", 4)
+	require.NoError(t, err)
+	require.True(t, skip)
+
+	skip, err = SkipExistingVerifySize.SkipUpload(ctx, backend, "cas/abc", 5)
+	require.NoError(t, err)
+	require.True(t, skip)
+
+	_, err = SkipExistingVerifySize.SkipUpload(ctx, backend, "cas/abc", 4)
+	require.ErrorIs(t, err, ErrExistingSizeMismatch)
+}
@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExpiresAtMetadataKey is the object metadata key holding the Unix time (in seconds)
+// after which an entry written through NewExpiringStorage is treated as missing.
+const ExpiresAtMetadataKey = "omni-cache-expires-at"
+
+type expiringStorage struct {
+	MultipartBlobStorageBackend
+
+	ttl time.Duration
+	now func() time.Time
+}
+
+// NewExpiringStorage wraps backend so that new entries expire ttl after they were uploaded.
+// The expiry is stored in object metadata; CacheInfo and DownloadURLs report expired entries
+// as ErrCacheNotFound. Expired objects are not deleted, so pair this with a bucket lifecycle
+// rule to reclaim space. A non-positive ttl disables expiration.
+func NewExpiringStorage(backend MultipartBlobStorageBackend, ttl time.Duration) MultipartBlobStorageBackend {
+	if ttl <= 0 {
+		return backend
+	}
+
+	return WithCapabilities(&expiringStorage{
+		MultipartBlobStorageBackend: backend,
+		ttl:                         ttl,
+		now:                         time.Now,
+	}, CapabilitiesOf(backend))
+}
+
+func (s *expiringStorage) UploadURL(ctx context.Context, key string, metadata map[string]string) (*URLInfo, error) {
+	return s.MultipartBlobStorageBackend.UploadURL(ctx, key, s.withExpiry(metadata))
+}
+
+func (s *expiringStorage) CreateMultipartUpload(ctx context.Context, key string, metadata map[string]string) (string, error) {
+	return s.MultipartBlobStorageBackend.CreateMultipartUpload(ctx, key, s.withExpiry(metadata))
+}
+
+func (s *expiringStorage) CacheInfo(ctx context.Context, key string, prefixes []string) (*CacheInfo, error) {
+	return cacheInfoSkipping(ctx, s.MultipartBlobStorageBackend, key, prefixes, func(info *CacheInfo) bool {
+		info.Expiry = expiryFromMetadata(info.Metadata)
+		return !s.expired(info.Expiry)
+	})
+}
+
+// DownloadURLs checks the entry's expiry first, which costs an extra metadata lookup.
+func (s *expiringStorage) DownloadURLs(ctx context.Context, key string) ([]*URLInfo, error) {
+	if _, err := s.CacheInfo(ctx, key, nil); err != nil {
+		return nil, err
+	}
+
+	return s.MultipartBlobStorageBackend.DownloadURLs(ctx, key)
+}
+
+// cacheInfoSkipping is backend.CacheInfo for a wrapper that hides entries keep returns
+// false for. When the match is hidden, the prefixes are looked up again one at a time, so
+// that a stale exact key or prefix match falls through to the next prefix. Backends match
+// a prefix with its latest entry only, so a hidden prefix match hides the whole prefix.
+func cacheInfoSkipping(ctx context.Context, backend BlobStorageBackend, key string, prefixes []string, keep func(*CacheInfo) bool) (*CacheInfo, error) {
+	info, err := backend.CacheInfo(ctx, key, prefixes)
+	if err != nil {
+		return nil, err
+	}
+	if keep(info) {
+		return info, nil
+	}
+
+	for _, prefix := range prefixes {
+		if prefix == "" {
+			continue
+		}
+		info, err := backend.CacheInfo(ctx, prefix, []string{prefix})
+		if errors.Is(err, ErrCacheNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if keep(info) {
+			return info, nil
+		}
+	}
+
+	return nil, ErrCacheNotFound
+}
+
+func (s *expiringStorage) withExpiry(metadata map[string]string) map[string]string {
+	result := make(map[string]string, len(metadata)+1)
+	for k, v := range metadata {
+		result[k] = v
+	}
+	result[ExpiresAtMetadataKey] = strconv.FormatInt(s.now().Add(s.ttl).Unix(), 10)
+	return result
+}
+
+func (s *expiringStorage) expired(expiry time.Time) bool {
+	return !expiry.IsZero() && !s.now().Before(expiry)
+}
+
+// expiryFromMetadata returns the expiry recorded in metadata, or the zero time when
+// the entry has none.
+func expiryFromMetadata(metadata map[string]string) time.Time {
+	for k, v := range metadata {
+		if !strings.EqualFold(k, ExpiresAtMetadataKey) {
+			continue
+		}
+		seconds, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return time.Time{}
+		}
+		return time.Unix(seconds, 0)
+	}
+	return time.Time{}
+}
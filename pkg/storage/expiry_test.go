@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpiringStorageMissesAfterTTL(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1_700_000_000, 0)
+	backend := unwrapCapabilities(NewExpiringStorage(newTestFilesystemStorage(t), time.Minute)).(*expiringStorage)
+	backend.now = func() time.Time { return now }
+
+	uploadURL, err := backend.UploadURL(ctx, "gha/key", map[string]string{"version": "1"})
+	require.NoError(t, err)
+	httpPut(t, uploadURL.URL, []byte("payload"))
+
+	info, err := backend.CacheInfo(ctx, "gha/key", nil)
+	require.NoError(t, err)
+	require.Equal(t, now.Add(time.Minute), info.Expiry)
+	require.Equal(t, "1", info.Metadata["version"])
+
+	_, err = backend.DownloadURLs(ctx, "gha/key")
+	require.NoError(t, err)
+
+	now = now.Add(time.Minute)
+
+	_, err = backend.CacheInfo(ctx, "gha/key", nil)
+	require.ErrorIs(t, err, ErrCacheNotFound)
+	_, err = backend.DownloadURLs(ctx, "gha/key")
+	require.ErrorIs(t, err, ErrCacheNotFound)
+}
+
+func TestExpiringStorageMultipartUpload(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1_700_000_000, 0)
+	backend := unwrapCapabilities(NewExpiringStorage(newTestFilesystemStorage(t), time.Hour)).(*expiringStorage)
+	backend.now = func() time.Time { return now }
+
+	uploadID, err := backend.CreateMultipartUpload(ctx, "big/object", nil)
+	require.NoError(t, err)
+	partURL, err := backend.UploadPartURL(ctx, "big/object", uploadID, 1, 4)
+	require.NoError(t, err)
+	resp := httpPut(t, partURL.URL, []byte("data"))
+	require.NoError(t, backend.CommitMultipartUpload(ctx, "big/object", uploadID, []MultipartUploadPart{
+		{PartNumber: 1, ETag: resp.Header.Get("ETag")},
+	}))
+
+	_, err = backend.CacheInfo(ctx, "big/object", nil)
+	require.NoError(t, err)
+
+	now = now.Add(2 * time.Hour)
+	_, err = backend.CacheInfo(ctx, "big/object", nil)
+	require.ErrorIs(t, err, ErrCacheNotFound)
+}
+
+func TestExpiringStorageKeepsEntriesWithoutExpiry(t *testing.T) {
+	ctx := context.Background()
+	inner := newTestFilesystemStorage(t)
+	uploadURL, err := inner.UploadURL(ctx, "legacy", nil)
+	require.NoError(t, err)
+	httpPut(t, uploadURL.URL, []byte("payload"))
+
+	info, err := NewExpiringStorage(inner, time.Minute).CacheInfo(ctx, "legacy", nil)
+	require.NoError(t, err)
+	require.True(t, info.Expiry.IsZero())
+}
+
+func TestExpiringStorageDisabled(t *testing.T) {
+	inner := &manyURLsBackend{}
+	require.Same(t, MultipartBlobStorageBackend(inner), NewExpiringStorage(inner, 0))
+}
+
+func TestExpiringStorageFallsThroughToFreshPrefixMatches(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1_700_000_000, 0)
+	backend := unwrapCapabilities(NewExpiringStorage(newTestFilesystemStorage(t), time.Minute)).(*expiringStorage)
+	backend.now = func() time.Time { return now }
+
+	upload := func(key string) {
+		uploadURL, err := backend.UploadURL(ctx, key, nil)
+		require.NoError(t, err)
+		httpPut(t, uploadURL.URL, []byte("payload"))
+	}
+	upload("linux-exact")
+	upload("windows-old")
+	now = now.Add(30 * time.Second)
+	upload("macos-fresh")
+	now = now.Add(45 * time.Second)
+
+	// The exact key and the first prefix's match are expired, the second prefix's isn't.
+	info, err := backend.CacheInfo(ctx, "linux-exact", []string{"linux-", "windows-", "macos-"})
+	require.NoError(t, err)
+	require.Equal(t, "macos-fresh", info.Key)
+
+	_, err = backend.CacheInfo(ctx, "linux-exact", []string{"linux-", "windows-"})
+	require.ErrorIs(t, err, ErrCacheNotFound)
+}
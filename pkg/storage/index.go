@@ -0,0 +1,211 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// DefaultIndexPrefix is the key prefix under which NewIndexedStorage keeps its index shards.
+const DefaultIndexPrefix = "omni-cache-index/"
+
+const defaultIndexShards = 16
+
+type indexedStorage struct {
+	MultipartBlobStorageBackend
+
+	prefix     string
+	shardLocks []sync.Mutex
+	httpClient *http.Client
+	// inner are the optional operations of the wrapped backend.
+	inner Capabilities
+}
+
+// NewIndexedStorage wraps a backend without native listing so that it supports List. The
+// keys of stored entries are recorded in index objects kept in the backend itself under
+// prefix (DefaultIndexPrefix when empty), spread over shards objects by key hash.
+//
+// Keys are indexed once a multipart upload commit succeeds, and removed on Delete. Single
+// uploads go straight to their upload URL, so their keys are indexed when the URL is
+// issued instead: List looks every indexed key up and skips the ones that were never
+// uploaded. Shards are updated with read-modify-write under a per-shard lock, so
+// concurrent updates from other processes sharing the backend can drop keys from the index.
+//
+// A backend that already supports List is returned unchanged.
+func NewIndexedStorage(backend MultipartBlobStorageBackend, prefix string, shards int) MultipartBlobStorageBackend {
+	if _, ok := backend.(ListableBlobStorageBackend); ok {
+		return backend
+	}
+	if prefix == "" {
+		prefix = DefaultIndexPrefix
+	}
+	if shards <= 0 {
+		shards = defaultIndexShards
+	}
+
+	result := &indexedStorage{
+		MultipartBlobStorageBackend: backend,
+		prefix:                      prefix,
+		shardLocks:                  make([]sync.Mutex, shards),
+		httpClient:                  http.DefaultClient,
+		inner:                       CapabilitiesOf(backend),
+	}
+	capabilities := Capabilities{List: result.list}
+	if result.inner.Delete != nil {
+		capabilities.Delete = result.delete
+	}
+	return WithCapabilities(result, capabilities)
+}
+
+func (s *indexedStorage) UploadURL(ctx context.Context, key string, metadata map[string]string) (*URLInfo, error) {
+	info, err := s.MultipartBlobStorageBackend.UploadURL(ctx, key, metadata)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.updateIndex(ctx, key, true); err != nil {
+		return nil, fmt.Errorf("failed to index %q: %w", key, err)
+	}
+	return info, nil
+}
+
+func (s *indexedStorage) CommitMultipartUpload(ctx context.Context, key string, uploadID string, parts []MultipartUploadPart) error {
+	if err := s.MultipartBlobStorageBackend.CommitMultipartUpload(ctx, key, uploadID, parts); err != nil {
+		return err
+	}
+	if err := s.updateIndex(ctx, key, true); err != nil {
+		return fmt.Errorf("failed to index %q: %w", key, err)
+	}
+	return nil
+}
+
+func (s *indexedStorage) delete(ctx context.Context, key string) error {
+	if err := s.inner.Delete(ctx, key); err != nil {
+		return err
+	}
+	return s.updateIndex(ctx, key, false)
+}
+
+// list calls fn for every indexed key starting with prefix that is still stored, in key order.
+func (s *indexedStorage) list(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	var keys []string
+	for shard := range s.shardLocks {
+		shardKeys, err := s.readShard(ctx, shard)
+		if err != nil {
+			return err
+		}
+		for _, key := range shardKeys {
+			if strings.HasPrefix(key, prefix) && !strings.HasPrefix(key, s.prefix) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		info, err := s.MultipartBlobStorageBackend.CacheInfo(ctx, key, nil)
+		if IsNotFoundError(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(ObjectInfo{Key: key, SizeBytes: info.SizeBytes, LastModified: info.LastModified}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *indexedStorage) shardFor(key string) int {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(len(s.shardLocks)))
+}
+
+func (s *indexedStorage) shardKey(shard int) string {
+	return fmt.Sprintf("%s%d", s.prefix, shard)
+}
+
+// updateIndex adds key to or removes it from its shard, skipping the write when the shard
+// already reflects the change.
+func (s *indexedStorage) updateIndex(ctx context.Context, key string, present bool) error {
+	if strings.HasPrefix(key, s.prefix) {
+		return nil
+	}
+
+	shard := s.shardFor(key)
+	s.shardLocks[shard].Lock()
+	defer s.shardLocks[shard].Unlock()
+
+	keys, err := s.readShard(ctx, shard)
+	if err != nil {
+		return err
+	}
+
+	i, found := slices.BinarySearch(keys, key)
+	switch {
+	case present && !found:
+		keys = slices.Insert(keys, i, key)
+	case !present && found:
+		keys = slices.Delete(keys, i, i+1)
+	default:
+		return nil
+	}
+
+	return s.writeShard(ctx, shard, keys)
+}
+
+// readShard returns the sorted keys recorded in a shard. A missing shard is empty.
+func (s *indexedStorage) readShard(ctx context.Context, shard int) ([]string, error) {
+	urls, err := s.MultipartBlobStorageBackend.DownloadURLs(ctx, s.shardKey(shard))
+	if IsNotFoundError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, info := range urls {
+		body, err := fetchObject(ctx, s.httpClient, info)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		var keys []string
+		for line := range strings.Lines(string(body)) {
+			if line = strings.TrimSuffix(line, "\n"); line != "" {
+				keys = append(keys, line)
+			}
+		}
+		slices.Sort(keys)
+		return slices.Compact(keys), nil
+	}
+	if lastErr == nil {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("failed to read index shard %q: %w", s.shardKey(shard), lastErr)
+}
+
+func (s *indexedStorage) writeShard(ctx context.Context, shard int, keys []string) error {
+	var body bytes.Buffer
+	for _, key := range keys {
+		body.WriteString(key)
+		body.WriteByte('\n')
+	}
+
+	info, err := s.MultipartBlobStorageBackend.UploadURL(ctx, s.shardKey(shard), nil)
+	if err != nil {
+		return err
+	}
+	if err := putObject(ctx, s.httpClient, info, body.Bytes()); err != nil {
+		return fmt.Errorf("failed to write index shard %q: %w", s.shardKey(shard), err)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// plainStorage hides the Delete and List support of the wrapped backend.
+type plainStorage struct {
+	MultipartBlobStorageBackend
+}
+
+func TestIndexedStorageLists(t *testing.T) {
+	ctx := context.Background()
+	backend := NewIndexedStorage(unlistableStorage{newTestFilesystemStorage(t)}, "", 4)
+
+	for key, body := range map[string]string{"cas/a": "1", "cas/b": "22", "ac/c": "333"} {
+		uploadURL, err := backend.UploadURL(ctx, key, nil)
+		require.NoError(t, err)
+		httpPut(t, uploadURL.URL, []byte(body))
+	}
+
+	// An upload URL that was never used is indexed, but not listed.
+	_, err := backend.UploadURL(ctx, "cas/abandoned", nil)
+	require.NoError(t, err)
+
+	uploadID, err := backend.CreateMultipartUpload(ctx, "cas/multipart", nil)
+	require.NoError(t, err)
+	partURL, err := backend.UploadPartURL(ctx, "cas/multipart", uploadID, 1, 4)
+	require.NoError(t, err)
+	resp := httpPut(t, partURL.URL, []byte("part"))
+	require.NoError(t, backend.CommitMultipartUpload(ctx, "cas/multipart", uploadID, []MultipartUploadPart{
+		{PartNumber: 1, ETag: resp.Header.Get("ETag")},
+	}))
+
+	require.Equal(t, map[string]int64{"cas/a": 1, "cas/b": 2, "cas/multipart": 4}, listKeys(t, backend, "cas/"))
+	require.Len(t, listKeys(t, backend, ""), 4)
+
+	require.NoError(t, backend.(DeletableBlobStorageBackend).Delete(ctx, "cas/a"))
+	require.Equal(t, map[string]int64{"cas/b": 2, "cas/multipart": 4}, listKeys(t, backend, "cas/"))
+
+	// The index itself lives in the backend, under its own prefix.
+	indexed := unwrapCapabilities(backend).(*indexedStorage)
+	shardKey := indexed.shardKey(indexed.shardFor("cas/b"))
+	require.True(t, strings.HasPrefix(shardKey, DefaultIndexPrefix))
+	urls, err := backend.DownloadURLs(ctx, shardKey)
+	require.NoError(t, err)
+	require.Contains(t, strings.Split(string(httpGet(t, urls[0].URL)), "\n"), "cas/b")
+	require.NotContains(t, listKeys(t, backend, ""), shardKey)
+}
+
+func TestIndexedStorageForwardsOnlySupportedDeletes(t *testing.T) {
+	backend := NewIndexedStorage(plainStorage{newTestFilesystemStorage(t)}, "", 0)
+	_, ok := backend.(ListableBlobStorageBackend)
+	require.True(t, ok)
+	_, ok = backend.(DeletableBlobStorageBackend)
+	require.False(t, ok)
+}
+
+func TestIndexedStorageKeepsListableBackends(t *testing.T) {
+	backend := newTestFilesystemStorage(t)
+	require.Same(t, backend, NewIndexedStorage(backend, "", 0))
+}
+
+func TestIndexedStorageSkipsFailedCommits(t *testing.T) {
+	ctx := context.Background()
+	backend := NewIndexedStorage(unlistableStorage{newTestFilesystemStorage(t)}, "", 0)
+
+	uploadID, err := backend.CreateMultipartUpload(ctx, "cas/failed", nil)
+	require.NoError(t, err)
+	require.Error(t, backend.CommitMultipartUpload(ctx, "cas/failed", uploadID, []MultipartUploadPart{
+		{PartNumber: 1, ETag: "missing"},
+	}))
+
+	indexed := unwrapCapabilities(backend).(*indexedStorage)
+	keys, err := indexed.readShard(ctx, indexed.shardFor("cas/failed"))
+	require.NoError(t, err)
+	require.NotContains(t, keys, "cas/failed")
+	require.Empty(t, listKeys(t, backend, ""))
+}
@@ -0,0 +1,63 @@
+package storage
+
+import "context"
+
+type layeredStorage struct {
+	MultipartBlobStorageBackend
+
+	readLayers []BlobStorageBackend
+}
+
+// NewLayeredStorage wraps write so that lookups and downloads that miss it fall through
+// to the read layers in order, while uploads, deletes and listings only use write. This
+// lets a per-branch prefix take writes while reads fall back to a shared prefix that is
+// populated elsewhere.
+//
+// CacheInfo looks for the exact key in every layer before falling back to prefixes, so
+// an exact match in a read layer wins over a prefix match in the write layer.
+func NewLayeredStorage(write MultipartBlobStorageBackend, read ...BlobStorageBackend) MultipartBlobStorageBackend {
+	if len(read) == 0 {
+		return write
+	}
+
+	return WithCapabilities(&layeredStorage{
+		MultipartBlobStorageBackend: write,
+		readLayers:                  read,
+	}, CapabilitiesOf(write))
+}
+
+func (s *layeredStorage) layers() []BlobStorageBackend {
+	return append([]BlobStorageBackend{s.MultipartBlobStorageBackend}, s.readLayers...)
+}
+
+func (s *layeredStorage) CacheInfo(ctx context.Context, key string, prefixes []string) (*CacheInfo, error) {
+	for _, layer := range s.layers() {
+		info, err := layer.CacheInfo(ctx, key, nil)
+		if !IsNotFoundError(err) {
+			return info, err
+		}
+	}
+
+	if len(prefixes) == 0 {
+		return nil, ErrCacheNotFound
+	}
+	for _, layer := range s.layers() {
+		info, err := layer.CacheInfo(ctx, key, prefixes)
+		if !IsNotFoundError(err) {
+			return info, err
+		}
+	}
+
+	return nil, ErrCacheNotFound
+}
+
+func (s *layeredStorage) DownloadURLs(ctx context.Context, key string) ([]*URLInfo, error) {
+	for _, layer := range s.layers() {
+		infos, err := layer.DownloadURLs(ctx, key)
+		if !IsNotFoundError(err) {
+			return infos, err
+		}
+	}
+
+	return nil, ErrCacheNotFound
+}
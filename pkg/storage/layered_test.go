@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLayeredStorageFallsThroughToReadLayers(t *testing.T) {
+	ctx := context.Background()
+	branch := newTestFilesystemStorage(t)
+	golden := newTestFilesystemStorage(t)
+	require.NoError(t, golden.Put(ctx, "shared", strings.NewReader("golden"), nil))
+	require.NoError(t, golden.Put(ctx, "both", strings.NewReader("golden"), nil))
+	require.NoError(t, branch.Put(ctx, "both", strings.NewReader("branch!"), nil))
+
+	backend := NewLayeredStorage(branch, golden)
+
+	info, err := backend.CacheInfo(ctx, "shared", nil)
+	require.NoError(t, err)
+	require.EqualValues(t, len("golden"), info.SizeBytes)
+	urls, err := backend.DownloadURLs(ctx, "shared")
+	require.NoError(t, err)
+	goldenURLs, err := golden.DownloadURLs(ctx, "shared")
+	require.NoError(t, err)
+	require.Equal(t, goldenURLs, urls)
+
+	info, err = backend.CacheInfo(ctx, "both", nil)
+	require.NoError(t, err)
+	require.EqualValues(t, len("branch!"), info.SizeBytes)
+
+	_, err = backend.CacheInfo(ctx, "missing", nil)
+	require.ErrorIs(t, err, ErrCacheNotFound)
+	_, err = backend.DownloadURLs(ctx, "missing")
+	require.True(t, IsNotFoundError(err))
+}
+
+func TestLayeredStoragePrefersExactMatches(t *testing.T) {
+	ctx := context.Background()
+	branch := newTestFilesystemStorage(t)
+	golden := newTestFilesystemStorage(t)
+	require.NoError(t, branch.Put(ctx, "deps-old", strings.NewReader("branch"), nil))
+	require.NoError(t, golden.Put(ctx, "deps-new", strings.NewReader("golden"), nil))
+
+	backend := NewLayeredStorage(branch, golden)
+
+	info, err := backend.CacheInfo(ctx, "deps-new", []string{"deps-"})
+	require.NoError(t, err)
+	require.Equal(t, "deps-new", info.Key)
+
+	info, err = backend.CacheInfo(ctx, "deps-missing", []string{"deps-"})
+	require.NoError(t, err)
+	require.Equal(t, "deps-old", info.Key)
+}
+
+func TestLayeredStorageWritesOnlyToWriteLayer(t *testing.T) {
+	ctx := context.Background()
+	branch := newTestFilesystemStorage(t)
+	golden := newTestFilesystemStorage(t)
+	require.NoError(t, golden.Put(ctx, "shared", strings.NewReader("golden"), nil))
+
+	backend := NewLayeredStorage(branch, golden)
+
+	uploadURL, err := backend.UploadURL(ctx, "new", nil)
+	require.NoError(t, err)
+	branchURL, err := branch.UploadURL(ctx, "new", nil)
+	require.NoError(t, err)
+	require.Equal(t, branchURL.URL, uploadURL.URL)
+
+	require.NoError(t, backend.(DeletableBlobStorageBackend).Delete(ctx, "shared"))
+	_, err = golden.CacheInfo(ctx, "shared", nil)
+	require.NoError(t, err)
+
+	var keys []string
+	require.NoError(t, backend.(ListableBlobStorageBackend).List(ctx, "", func(info ObjectInfo) error {
+		keys = append(keys, info.Key)
+		return nil
+	}))
+	require.Empty(t, keys)
+}
@@ -0,0 +1,329 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxS3KeyBytes is the longest object key S3 accepts, including any key prefix.
+const MaxS3KeyBytes = 1024
+
+// DefaultLongKeyPrefix is the key prefix under which NewLongKeyStorage records the
+// original keys of entries stored under a hash.
+const DefaultLongKeyPrefix = "omni-cache-long-keys/"
+
+// ErrKeyTooLong is returned for keys longer than the backend accepts.
+var ErrKeyTooLong = errors.New("key is too long for the storage backend")
+
+// longKeyMarker separates the kept start of a long key from the hash of the full key.
+const longKeyMarker = "~sha256~"
+
+const longKeyHashLength = sha256.Size * 2
+
+type longKeyStorage struct {
+	MultipartBlobStorageBackend
+
+	maxKeyBytes  int
+	hashLongKeys bool
+	prefix       string
+	httpClient   *http.Client
+	// inner are the optional operations of the wrapped backend.
+	inner Capabilities
+}
+
+// NewLongKeyStorage wraps backend so that keys longer than maxKeyBytes fail with
+// ErrKeyTooLong up front, rather than with whatever error the backend reports for them.
+//
+// With hashLongKeys, such keys are stored instead: under as much of the key as fits,
+// followed by a SHA-256 hash of the full key. The full key is recorded in a small object
+// under DefaultLongKeyPrefix, so that CacheInfo and List report entries under the keys
+// they were stored with. Since the start of the key is kept, CacheInfo prefix lookups
+// still find hashed entries, as long as the prefix is no longer than the kept part; List
+// finds them through any prefix.
+//
+// A non-positive maxKeyBytes disables the wrapper.
+func NewLongKeyStorage(backend MultipartBlobStorageBackend, maxKeyBytes int, hashLongKeys bool) MultipartBlobStorageBackend {
+	if maxKeyBytes <= 0 {
+		return backend
+	}
+
+	result := &longKeyStorage{
+		MultipartBlobStorageBackend: backend,
+		maxKeyBytes:                 maxKeyBytes,
+		hashLongKeys:                hashLongKeys,
+		prefix:                      DefaultLongKeyPrefix,
+		httpClient:                  http.DefaultClient,
+		inner:                       CapabilitiesOf(backend),
+	}
+	var capabilities Capabilities
+	if result.inner.Delete != nil {
+		capabilities.Delete = result.delete
+	}
+	if result.inner.List != nil {
+		capabilities.List = result.list
+	}
+	return WithCapabilities(result, capabilities)
+}
+
+// keptBytes is how much of a long key is kept in front of its hash.
+func (s *longKeyStorage) keptBytes() int {
+	return max(s.maxKeyBytes-len(longKeyMarker)-longKeyHashLength, 0)
+}
+
+// storedKey returns the key that key is stored under in the wrapped backend, and the
+// hash it's stored under if it's too long to be stored as is.
+func (s *longKeyStorage) storedKey(key string) (storedKey string, hash string, err error) {
+	if len(key) <= s.maxKeyBytes {
+		return key, "", nil
+	}
+	if !s.hashLongKeys {
+		return "", "", fmt.Errorf("%w: %d bytes, at most %d are supported", ErrKeyTooLong, len(key), s.maxKeyBytes)
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	hash = hex.EncodeToString(sum[:])
+	return truncateUTF8(key, s.keptBytes()) + longKeyMarker + hash, hash, nil
+}
+
+func (s *longKeyStorage) originalKeyKey(hash string) string {
+	return s.prefix + hash
+}
+
+// recordOriginalKey stores the full key of an entry stored under hash. It's written
+// before the entry itself, so that the entry is never found without it.
+func (s *longKeyStorage) recordOriginalKey(ctx context.Context, hash string, key string) error {
+	info, err := s.MultipartBlobStorageBackend.UploadURL(ctx, s.originalKeyKey(hash), nil)
+	if err != nil {
+		return err
+	}
+	if err := putObject(ctx, s.httpClient, info, []byte(key)); err != nil {
+		return fmt.Errorf("failed to record original key of %q: %w", hash, err)
+	}
+	return nil
+}
+
+// originalKey maps a key of the wrapped backend back to the key it was stored with.
+// Keys that don't look hashed, or whose original key can't be found, are returned as is.
+func (s *longKeyStorage) originalKey(ctx context.Context, storedKey string) (string, error) {
+	markerIndex := len(storedKey) - longKeyHashLength - len(longKeyMarker)
+	if markerIndex < 0 || storedKey[markerIndex:markerIndex+len(longKeyMarker)] != longKeyMarker {
+		return storedKey, nil
+	}
+	hash := storedKey[markerIndex+len(longKeyMarker):]
+
+	urls, err := s.MultipartBlobStorageBackend.DownloadURLs(ctx, s.originalKeyKey(hash))
+	if IsNotFoundError(err) {
+		return storedKey, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var lastErr error
+	for _, info := range urls {
+		body, err := fetchObject(ctx, s.httpClient, info)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if sum := sha256.Sum256(body); hex.EncodeToString(sum[:]) != hash {
+			// Not one of ours, but a key that happens to look hashed.
+			return storedKey, nil
+		}
+		return string(body), nil
+	}
+	if lastErr == nil {
+		return storedKey, nil
+	}
+	return "", fmt.Errorf("failed to read original key of %q: %w", storedKey, lastErr)
+}
+
+func (s *longKeyStorage) DownloadURLs(ctx context.Context, key string) ([]*URLInfo, error) {
+	storedKey, _, err := s.storedKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return s.MultipartBlobStorageBackend.DownloadURLs(ctx, storedKey)
+}
+
+func (s *longKeyStorage) UploadURL(ctx context.Context, key string, metadata map[string]string) (*URLInfo, error) {
+	storedKey, hash, err := s.storedKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if hash != "" {
+		if err := s.recordOriginalKey(ctx, hash, key); err != nil {
+			return nil, err
+		}
+	}
+	return s.MultipartBlobStorageBackend.UploadURL(ctx, storedKey, metadata)
+}
+
+func (s *longKeyStorage) CacheInfo(ctx context.Context, key string, prefixes []string) (*CacheInfo, error) {
+	storedKey, _, err := s.storedKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// No stored key starts with a prefix longer than the limit.
+	var lookupPrefixes []string
+	for _, prefix := range prefixes {
+		if len(prefix) <= s.maxKeyBytes {
+			lookupPrefixes = append(lookupPrefixes, prefix)
+		}
+	}
+
+	info, err := s.MultipartBlobStorageBackend.CacheInfo(ctx, storedKey, lookupPrefixes)
+	if err != nil {
+		return nil, err
+	}
+	if !s.hashLongKeys {
+		return info, nil
+	}
+
+	originalKey, err := s.originalKey(ctx, info.Key)
+	if err != nil {
+		return nil, err
+	}
+	resolved := *info
+	resolved.Key = originalKey
+	return &resolved, nil
+}
+
+func (s *longKeyStorage) CreateMultipartUpload(ctx context.Context, key string, metadata map[string]string) (string, error) {
+	storedKey, hash, err := s.storedKey(key)
+	if err != nil {
+		return "", err
+	}
+	if hash != "" {
+		if err := s.recordOriginalKey(ctx, hash, key); err != nil {
+			return "", err
+		}
+	}
+	return s.MultipartBlobStorageBackend.CreateMultipartUpload(ctx, storedKey, metadata)
+}
+
+func (s *longKeyStorage) UploadPartURL(ctx context.Context, key string, uploadID string, partNumber uint32, contentLength uint64) (*URLInfo, error) {
+	storedKey, _, err := s.storedKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return s.MultipartBlobStorageBackend.UploadPartURL(ctx, storedKey, uploadID, partNumber, contentLength)
+}
+
+func (s *longKeyStorage) CommitMultipartUpload(ctx context.Context, key string, uploadID string, parts []MultipartUploadPart) error {
+	storedKey, _, err := s.storedKey(key)
+	if err != nil {
+		return err
+	}
+	return s.MultipartBlobStorageBackend.CommitMultipartUpload(ctx, storedKey, uploadID, parts)
+}
+
+func (s *longKeyStorage) delete(ctx context.Context, key string) error {
+	storedKey, hash, err := s.storedKey(key)
+	if err != nil {
+		return err
+	}
+	if err := s.inner.Delete(ctx, storedKey); err != nil {
+		return err
+	}
+	if hash != "" {
+		if err := s.inner.Delete(ctx, s.originalKeyKey(hash)); err != nil && !IsNotFoundError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// List reports hashed entries under their original keys and skips the objects recording
+// them.
+func (s *longKeyStorage) list(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	// Hashed entries only keep the start of their key, so list by that and filter by
+	// the original keys.
+	listPrefix := prefix
+	if s.hashLongKeys && len(prefix) > s.keptBytes() {
+		listPrefix = truncateUTF8(prefix, s.keptBytes())
+	}
+
+	return s.inner.List(ctx, listPrefix, func(object ObjectInfo) error {
+		if strings.HasPrefix(object.Key, s.prefix) {
+			return nil
+		}
+		if s.hashLongKeys {
+			originalKey, err := s.originalKey(ctx, object.Key)
+			if err != nil {
+				return err
+			}
+			object.Key = originalKey
+		}
+		if !strings.HasPrefix(object.Key, prefix) {
+			return nil
+		}
+		return fn(object)
+	})
+}
+
+// truncateUTF8 shortens s to at most n bytes without splitting a multi-byte character.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// putObject uploads body to an upload URL. It's meant for the small bookkeeping objects
+// that wrappers keep in the backend they wrap.
+func putObject(ctx context.Context, client *http.Client, info *URLInfo, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, info.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range info.ExtraHeaders {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// fetchObject downloads the object behind a download URL.
+func fetchObject(ctx context.Context, client *http.Client, info *URLInfo) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, info.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range info.ExtraHeaders {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
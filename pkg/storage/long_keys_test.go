@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLongKeyStorageRejectsLongKeys(t *testing.T) {
+	ctx := context.Background()
+	backend := NewLongKeyStorage(newTestMemoryStorage(t), 64, false)
+
+	longKey := "gha/" + strings.Repeat("k", 64)
+	_, err := backend.UploadURL(ctx, longKey, nil)
+	require.ErrorIs(t, err, ErrKeyTooLong)
+	_, err = backend.CreateMultipartUpload(ctx, longKey, nil)
+	require.ErrorIs(t, err, ErrKeyTooLong)
+	_, err = backend.CacheInfo(ctx, longKey, nil)
+	require.ErrorIs(t, err, ErrKeyTooLong)
+
+	uploadURL, err := backend.UploadURL(ctx, "gha/short", nil)
+	require.NoError(t, err)
+	httpPut(t, uploadURL.URL, []byte("short"))
+
+	// Prefixes longer than the limit can't match, but don't fail the lookup either.
+	info, err := backend.CacheInfo(ctx, "gha/missing", []string{longKey, "gha/"})
+	require.NoError(t, err)
+	require.Equal(t, "gha/short", info.Key)
+}
+
+func TestLongKeyStorageHashesLongKeys(t *testing.T) {
+	ctx := context.Background()
+	inner := newTestMemoryStorage(t)
+	backend := NewLongKeyStorage(inner, 100, true)
+
+	longKey := "gha/linux-" + strings.Repeat("deps-", 40)
+	otherLongKey := "gha/linux-" + strings.Repeat("deps-", 39) + "other"
+
+	uploadURL, err := backend.UploadURL(ctx, longKey, nil)
+	require.NoError(t, err)
+	httpPut(t, uploadURL.URL, []byte("long"))
+
+	uploadID, err := backend.CreateMultipartUpload(ctx, otherLongKey, nil)
+	require.NoError(t, err)
+	partURL, err := backend.UploadPartURL(ctx, otherLongKey, uploadID, 1, 5)
+	require.NoError(t, err)
+	resp := httpPut(t, partURL.URL, []byte("other"))
+	require.NoError(t, backend.CommitMultipartUpload(ctx, otherLongKey, uploadID, []MultipartUploadPart{
+		{PartNumber: 1, ETag: resp.Header.Get("ETag")},
+	}))
+
+	// Nothing reaches the wrapped backend under a key longer than the limit.
+	for key := range listKeys(t, inner, "") {
+		require.LessOrEqual(t, len(key), 100, key)
+	}
+
+	urls, err := backend.DownloadURLs(ctx, longKey)
+	require.NoError(t, err)
+	require.Equal(t, []byte("long"), httpGet(t, urls[0].URL))
+
+	info, err := backend.CacheInfo(ctx, longKey, nil)
+	require.NoError(t, err)
+	require.Equal(t, longKey, info.Key)
+	require.EqualValues(t, 4, info.SizeBytes)
+
+	// Restore keys find hashed entries under their original key.
+	info, err = backend.CacheInfo(ctx, "gha/missing", []string{"gha/linux-"})
+	require.NoError(t, err)
+	require.Contains(t, []string{longKey, otherLongKey}, info.Key)
+
+	// Listing reports original keys, also through prefixes longer than the kept part of
+	// hashed keys, and hides the recorded original keys.
+	require.Equal(t, map[string]int64{longKey: 4, otherLongKey: 5}, listKeys(t, backend, ""))
+	require.Equal(t, map[string]int64{otherLongKey: 5}, listKeys(t, backend, otherLongKey[:len(otherLongKey)-2]))
+
+	require.NoError(t, backend.(DeletableBlobStorageBackend).Delete(ctx, longKey))
+	_, err = backend.CacheInfo(ctx, longKey, nil)
+	require.ErrorIs(t, err, ErrCacheNotFound)
+	require.Equal(t, map[string]int64{otherLongKey: 5}, listKeys(t, backend, ""))
+	require.Len(t, listKeys(t, inner, DefaultLongKeyPrefix), 1)
+}
+
+func TestTruncateUTF8(t *testing.T) {
+	require.Equal(t, "abc", truncateUTF8("abc", 5))
+	require.Equal(t, "ab", truncateUTF8("abc", 2))
+	require.Equal(t, "a", truncateUTF8("aé", 2))
+	require.Equal(t, "aé", truncateUTF8("aé", 3))
+}
+
+func listKeys(t *testing.T, backend MultipartBlobStorageBackend, prefix string) map[string]int64 {
+	t.Helper()
+
+	keys := map[string]int64{}
+	require.NoError(t, backend.(ListableBlobStorageBackend).List(context.Background(), prefix, func(object ObjectInfo) error {
+		keys[object.Key] = object.SizeBytes
+		return nil
+	}))
+	return keys
+}
@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+type maxAgeStorage struct {
+	MultipartBlobStorageBackend
+
+	maxAge time.Duration
+	now    func() time.Time
+}
+
+// NewMaxAgeStorage wraps backend so that entries last modified more than maxAge ago are
+// reported as ErrCacheNotFound by CacheInfo and DownloadURLs, regardless of how long the
+// backend retains them. Entries without a last-modified time are always served.
+// A non-positive maxAge disables the filter.
+func NewMaxAgeStorage(backend MultipartBlobStorageBackend, maxAge time.Duration) MultipartBlobStorageBackend {
+	if maxAge <= 0 {
+		return backend
+	}
+
+	return WithCapabilities(&maxAgeStorage{
+		MultipartBlobStorageBackend: backend,
+		maxAge:                      maxAge,
+		now:                         time.Now,
+	}, CapabilitiesOf(backend))
+}
+
+func (s *maxAgeStorage) CacheInfo(ctx context.Context, key string, prefixes []string) (*CacheInfo, error) {
+	return cacheInfoSkipping(ctx, s.MultipartBlobStorageBackend, key, prefixes, func(info *CacheInfo) bool {
+		return info.LastModified.IsZero() || s.now().Sub(info.LastModified) <= s.maxAge
+	})
+}
+
+// DownloadURLs checks the entry's age first, which costs an extra metadata lookup.
+func (s *maxAgeStorage) DownloadURLs(ctx context.Context, key string) ([]*URLInfo, error) {
+	if _, err := s.CacheInfo(ctx, key, nil); err != nil {
+		return nil, err
+	}
+
+	return s.MultipartBlobStorageBackend.DownloadURLs(ctx, key)
+}
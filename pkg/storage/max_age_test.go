@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxAgeStorageMissesOldEntries(t *testing.T) {
+	ctx := context.Background()
+	inner := newTestFilesystemStorage(t)
+	require.NoError(t, inner.Put(ctx, "artifact", strings.NewReader("payload"), nil))
+
+	info, err := inner.CacheInfo(ctx, "artifact", nil)
+	require.NoError(t, err)
+	require.False(t, info.LastModified.IsZero())
+
+	backend := unwrapCapabilities(NewMaxAgeStorage(inner, time.Hour)).(*maxAgeStorage)
+
+	backend.now = func() time.Time { return info.LastModified.Add(time.Hour) }
+	_, err = backend.CacheInfo(ctx, "artifact", nil)
+	require.NoError(t, err)
+	_, err = backend.DownloadURLs(ctx, "artifact")
+	require.NoError(t, err)
+
+	backend.now = func() time.Time { return info.LastModified.Add(time.Hour + time.Second) }
+	_, err = backend.CacheInfo(ctx, "artifact", nil)
+	require.ErrorIs(t, err, ErrCacheNotFound)
+	_, err = backend.DownloadURLs(ctx, "artifact")
+	require.ErrorIs(t, err, ErrCacheNotFound)
+}
+
+func TestMaxAgeStorageDisabled(t *testing.T) {
+	inner := &manyURLsBackend{}
+	require.Same(t, MultipartBlobStorageBackend(inner), NewMaxAgeStorage(inner, 0))
+}
+
+func TestMaxAgeStorageFallsThroughToFreshPrefixMatches(t *testing.T) {
+	ctx := context.Background()
+	inner := newTestFilesystemStorage(t)
+	now := time.Now()
+	for key, age := range map[string]time.Duration{
+		"linux-exact": 2 * time.Hour,
+		"windows-old": 2 * time.Hour,
+		"macos-fresh": time.Minute,
+	} {
+		require.NoError(t, inner.Put(ctx, key, strings.NewReader("payload"), nil))
+		blobPath, err := inner.blobPath(key)
+		require.NoError(t, err)
+		require.NoError(t, os.Chtimes(blobPath, now.Add(-age), now.Add(-age)))
+	}
+
+	backend := unwrapCapabilities(NewMaxAgeStorage(inner, time.Hour)).(*maxAgeStorage)
+	backend.now = func() time.Time { return now }
+
+	// The exact key and the first prefix's match are too old, the second prefix's isn't.
+	info, err := backend.CacheInfo(ctx, "linux-exact", []string{"linux-", "windows-", "macos-"})
+	require.NoError(t, err)
+	require.Equal(t, "macos-fresh", info.Key)
+
+	_, err = backend.CacheInfo(ctx, "linux-exact", []string{"linux-", "windows-"})
+	require.ErrorIs(t, err, ErrCacheNotFound)
+}
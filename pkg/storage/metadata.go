@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// DefaultS3MaxMetadataBytes is the S3 limit on user-defined object metadata, measured as
+// the total length of all keys and values.
+const DefaultS3MaxMetadataBytes = 2048
+
+// ErrMetadataTooLarge is returned when the metadata of an upload exceeds the backend's
+// limit, which the backend would otherwise reject only once the upload is attempted.
+var ErrMetadataTooLarge = errors.New("object metadata is too large")
+
+// MetadataSize returns the size of metadata as S3 measures it: the total length of the
+// normalized keys and values.
+func MetadataSize(metadata map[string]string) int {
+	var size int
+	for k, v := range normalizeMetadata(metadata) {
+		size += len(k) + len(v)
+	}
+	return size
+}
+
+// checkMetadataSize fails with ErrMetadataTooLarge when metadata exceeds maxBytes.
+// A non-positive maxBytes disables the check.
+func checkMetadataSize(key string, metadata map[string]string, maxBytes int) error {
+	if maxBytes <= 0 {
+		return nil
+	}
+	if size := MetadataSize(metadata); size > maxBytes {
+		return fmt.Errorf("%w: %q has %d bytes of metadata, the limit is %d", ErrMetadataTooLarge, key, size, maxBytes)
+	}
+	return nil
+}
+
+// normalizeMetadata lowercases the keys of metadata, like S3 stores them, and drops empty
+// keys. It returns nil for empty metadata.
+func normalizeMetadata(metadata map[string]string) map[string]string {
+	if len(metadata) == 0 {
+		return nil
+	}
+
+	normalized := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		if k != "" {
+			normalized[strings.ToLower(k)] = v
+		}
+	}
+	return normalized
+}
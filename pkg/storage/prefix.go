@@ -0,0 +1,30 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// NormalizeKeyPrefix joins prefix segments, such as a deployment prefix and a bucket
+// prefix, into a single key prefix without leading, trailing or repeated slashes.
+// Segments may contain slashes themselves and empty segments are skipped. It rejects
+// "." and ".." path elements, which S3 would store literally while the key is cleaned
+// elsewhere, and control characters.
+func NormalizeKeyPrefix(segments ...string) (string, error) {
+	var elements []string
+	for _, segment := range segments {
+		for _, element := range strings.Split(strings.TrimSpace(segment), "/") {
+			switch {
+			case element == "":
+				continue
+			case element == "." || element == "..":
+				return "", fmt.Errorf("key prefix %q must not contain %q path elements", segment, element)
+			case strings.ContainsFunc(element, unicode.IsControl):
+				return "", fmt.Errorf("key prefix %q must not contain control characters", segment)
+			}
+			elements = append(elements, element)
+		}
+	}
+	return strings.Join(elements, "/"), nil
+}
@@ -0,0 +1,39 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeKeyPrefix(t *testing.T) {
+	for _, tc := range []struct {
+		segments []string
+		expected string
+	}{
+		{nil, ""},
+		{[]string{"", " "}, ""},
+		{[]string{"staging", "my-repo"}, "staging/my-repo"},
+		{[]string{"/prod/", "/my-repo/"}, "prod/my-repo"},
+		{[]string{"", "my-repo"}, "my-repo"},
+		{[]string{"prod", ""}, "prod"},
+		{[]string{"prod//eu", "team/my-repo"}, "prod/eu/team/my-repo"},
+		{[]string{" staging ", "my-repo"}, "staging/my-repo"},
+	} {
+		prefix, err := storage.NormalizeKeyPrefix(tc.segments...)
+		require.NoError(t, err, "%q", tc.segments)
+		require.Equal(t, tc.expected, prefix, "%q", tc.segments)
+	}
+
+	for _, segments := range [][]string{
+		{"staging", ".."},
+		{"./prod"},
+		{"prod/../staging"},
+		{"pr\nod"},
+		{"pr\x00od"},
+	} {
+		_, err := storage.NormalizeKeyPrefix(segments...)
+		require.Error(t, err, "%q", segments)
+	}
+}
@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrQuotaExceeded is returned when an upload targets a namespace that is over its storage quota.
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// Quota limits the total size of objects stored under a key prefix.
+type Quota struct {
+	Prefix     string
+	LimitBytes int64
+}
+
+type quotaStorage struct {
+	MultipartBlobStorageBackend
+
+	listable        ListableBlobStorageBackend
+	refreshInterval time.Duration
+	now             func() time.Time
+	quotas          []*quotaUsage
+}
+
+type quotaUsage struct {
+	Quota
+
+	mu          sync.Mutex
+	usedBytes   int64
+	refreshedAt time.Time
+}
+
+// NewQuotaStorage wraps backend so that new uploads are rejected with ErrQuotaExceeded
+// while the objects under a quota's prefix exceed its limit. Usage is measured by listing
+// the prefix at most once per refreshInterval, so a namespace becomes writable again once
+// eviction frees space and the next listing observes it.
+func NewQuotaStorage(backend MultipartBlobStorageBackend, refreshInterval time.Duration, quotas ...Quota) (MultipartBlobStorageBackend, error) {
+	listable, ok := backend.(ListableBlobStorageBackend)
+	if !ok {
+		return nil, fmt.Errorf("storage: quotas require a backend with listing support")
+	}
+
+	result := &quotaStorage{
+		MultipartBlobStorageBackend: backend,
+		listable:                    listable,
+		refreshInterval:             refreshInterval,
+		now:                         time.Now,
+	}
+	for _, quota := range quotas {
+		if quota.LimitBytes <= 0 {
+			return nil, fmt.Errorf("storage: quota for prefix %q must be positive", quota.Prefix)
+		}
+		result.quotas = append(result.quotas, &quotaUsage{Quota: quota})
+	}
+
+	return WithCapabilities(result, CapabilitiesOf(backend)), nil
+}
+
+func (s *quotaStorage) UploadURL(ctx context.Context, key string, metadata map[string]string) (*URLInfo, error) {
+	if err := s.checkQuota(ctx, key); err != nil {
+		return nil, err
+	}
+	return s.MultipartBlobStorageBackend.UploadURL(ctx, key, metadata)
+}
+
+func (s *quotaStorage) CreateMultipartUpload(ctx context.Context, key string, metadata map[string]string) (string, error) {
+	if err := s.checkQuota(ctx, key); err != nil {
+		return "", err
+	}
+	return s.MultipartBlobStorageBackend.CreateMultipartUpload(ctx, key, metadata)
+}
+
+func (s *quotaStorage) checkQuota(ctx context.Context, key string) error {
+	key = strings.TrimPrefix(key, "/")
+
+	for _, quota := range s.quotas {
+		if !strings.HasPrefix(key, quota.Prefix) {
+			continue
+		}
+
+		usedBytes, err := s.usage(ctx, quota)
+		if err != nil {
+			return fmt.Errorf("measure usage of %q: %w", quota.Prefix, err)
+		}
+		if usedBytes >= quota.LimitBytes {
+			return fmt.Errorf("%w: %q uses %d of %d bytes", ErrQuotaExceeded, quota.Prefix, usedBytes, quota.LimitBytes)
+		}
+	}
+
+	return nil
+}
+
+func (s *quotaStorage) usage(ctx context.Context, quota *quotaUsage) (int64, error) {
+	quota.mu.Lock()
+	defer quota.mu.Unlock()
+
+	if !quota.refreshedAt.IsZero() && s.now().Sub(quota.refreshedAt) < s.refreshInterval {
+		return quota.usedBytes, nil
+	}
+
+	var usedBytes int64
+	err := s.listable.List(ctx, quota.Prefix, func(info ObjectInfo) error {
+		usedBytes += info.SizeBytes
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	quota.usedBytes = usedBytes
+	quota.refreshedAt = s.now()
+	return usedBytes, nil
+}
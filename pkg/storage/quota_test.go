@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type listingBackend struct {
+	MultipartBlobStorageBackend
+
+	objects map[string]int64
+	lists   int
+}
+
+func (b *listingBackend) UploadURL(context.Context, string, map[string]string) (*URLInfo, error) {
+	return &URLInfo{URL: "http://example.com/upload"}, nil
+}
+
+func (b *listingBackend) CreateMultipartUpload(context.Context, string, map[string]string) (string, error) {
+	return "upload-id", nil
+}
+
+func (b *listingBackend) List(_ context.Context, prefix string, fn func(ObjectInfo) error) error {
+	b.lists++
+	for key, size := range b.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if err := fn(ObjectInfo{Key: key, SizeBytes: size}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestQuotaStorageRejectsUploadsOverQuota(t *testing.T) {
+	backend := &listingBackend{objects: map[string]int64{
+		"team-a/one": 60,
+		"team-a/two": 50,
+		"team-b/one": 10,
+	}}
+
+	wrapped, err := NewQuotaStorage(backend, time.Minute,
+		Quota{Prefix: "team-a/", LimitBytes: 100},
+		Quota{Prefix: "team-b/", LimitBytes: 100},
+	)
+	require.NoError(t, err)
+
+	_, err = wrapped.UploadURL(t.Context(), "team-a/three", nil)
+	require.True(t, errors.Is(err, ErrQuotaExceeded))
+
+	_, err = wrapped.CreateMultipartUpload(t.Context(), "team-a/three", nil)
+	require.True(t, errors.Is(err, ErrQuotaExceeded))
+
+	_, err = wrapped.UploadURL(t.Context(), "team-b/two", nil)
+	require.NoError(t, err)
+
+	_, err = wrapped.UploadURL(t.Context(), "unrestricted", nil)
+	require.NoError(t, err)
+
+	// Usage is cached until the refresh interval elapses.
+	require.Equal(t, 2, backend.lists)
+	delete(backend.objects, "team-a/one")
+	_, err = wrapped.UploadURL(t.Context(), "team-a/three", nil)
+	require.True(t, errors.Is(err, ErrQuotaExceeded))
+
+	unwrapCapabilities(wrapped).(*quotaStorage).now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	_, err = wrapped.UploadURL(t.Context(), "team-a/three", nil)
+	require.NoError(t, err)
+}
+
+func TestQuotaStorageRequiresListing(t *testing.T) {
+	_, err := NewQuotaStorage(&nonListingBackend{}, time.Minute, Quota{Prefix: "a/", LimitBytes: 1})
+	require.Error(t, err)
+}
+
+type nonListingBackend struct {
+	MultipartBlobStorageBackend
+}
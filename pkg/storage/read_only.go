@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrReadOnly is returned when a write is attempted against storage wrapped by
+// NewReadOnlyStorage.
+var ErrReadOnly = errors.New("cache is read-only")
+
+type readOnlyStorage struct {
+	MultipartBlobStorageBackend
+}
+
+// NewReadOnlyStorage wraps backend so that lookups, downloads and listings keep working
+// while every upload, multipart operation and delete fails with ErrReadOnly.
+func NewReadOnlyStorage(backend MultipartBlobStorageBackend) MultipartBlobStorageBackend {
+	capabilities := CapabilitiesOf(backend)
+	if capabilities.Delete != nil {
+		capabilities.Delete = func(ctx context.Context, key string) error {
+			return ErrReadOnly
+		}
+	}
+	return WithCapabilities(&readOnlyStorage{MultipartBlobStorageBackend: backend}, capabilities)
+}
+
+func (s *readOnlyStorage) UploadURL(ctx context.Context, key string, metadata map[string]string) (*URLInfo, error) {
+	return nil, ErrReadOnly
+}
+
+func (s *readOnlyStorage) CreateMultipartUpload(ctx context.Context, key string, metadata map[string]string) (string, error) {
+	return "", ErrReadOnly
+}
+
+func (s *readOnlyStorage) UploadPartURL(ctx context.Context, key string, uploadID string, partNumber uint32, contentLength uint64) (*URLInfo, error) {
+	return nil, ErrReadOnly
+}
+
+func (s *readOnlyStorage) CommitMultipartUpload(ctx context.Context, key string, uploadID string, parts []MultipartUploadPart) error {
+	return ErrReadOnly
+}
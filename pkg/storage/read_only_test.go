@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadOnlyStorageRejectsWrites(t *testing.T) {
+	ctx := context.Background()
+	inner := newTestFilesystemStorage(t)
+	require.NoError(t, inner.Put(ctx, "artifact", strings.NewReader("payload"), nil))
+
+	backend := NewReadOnlyStorage(inner)
+
+	info, err := backend.CacheInfo(ctx, "artifact", nil)
+	require.NoError(t, err)
+	require.EqualValues(t, len("payload"), info.SizeBytes)
+	_, err = backend.DownloadURLs(ctx, "artifact")
+	require.NoError(t, err)
+
+	_, err = backend.UploadURL(ctx, "other", nil)
+	require.ErrorIs(t, err, ErrReadOnly)
+	_, err = backend.CreateMultipartUpload(ctx, "other", nil)
+	require.ErrorIs(t, err, ErrReadOnly)
+	_, err = backend.UploadPartURL(ctx, "other", "upload", 1, 1)
+	require.ErrorIs(t, err, ErrReadOnly)
+	require.ErrorIs(t, backend.CommitMultipartUpload(ctx, "other", "upload", nil), ErrReadOnly)
+	require.ErrorIs(t, backend.(DeletableBlobStorageBackend).Delete(ctx, "artifact"), ErrReadOnly)
+
+	_, err = inner.CacheInfo(ctx, "artifact", nil)
+	require.NoError(t, err)
+}
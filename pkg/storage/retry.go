@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy controls how a storage operation is retried after a failure that may be
+// transient.
+type RetryPolicy struct {
+	// Retries is the number of attempts made after the first one. Zero disables retries.
+	Retries int
+	// BaseDelay is the backoff before the first retry. It doubles with every retry and
+	// is jittered so that concurrent operations don't retry in lockstep.
+	BaseDelay time.Duration
+}
+
+// Delay returns the jittered exponential backoff before retry number attempt+1.
+func (policy RetryPolicy) Delay(attempt int) time.Duration {
+	if policy.BaseDelay <= 0 {
+		return 0
+	}
+	delay := policy.BaseDelay << min(attempt, 16)
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// retryableStatus reports whether an HTTP response status may be transient.
+func retryableStatus(status int) bool {
+	return status >= http.StatusInternalServerError ||
+		status == http.StatusTooManyRequests || status == http.StatusRequestTimeout
+}
+
+// SleepContext waits for delay, returning early with the context's error once ctx is done.
+func SleepContext(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// KeyRouter returns the index of the backend that stores key, among the backends passed
+// to NewRoutingStorage.
+type KeyRouter func(key string) int
+
+// RouteByPrefix returns a KeyRouter that routes keys to the backend index of the longest
+// prefix in routes that they start with, and other keys to fallback.
+func RouteByPrefix(routes map[string]int, fallback int) KeyRouter {
+	return func(key string) int {
+		key = strings.TrimPrefix(key, "/")
+
+		index, longest := fallback, -1
+		for prefix, candidate := range routes {
+			if len(prefix) > longest && strings.HasPrefix(key, prefix) {
+				index, longest = candidate, len(prefix)
+			}
+		}
+		return index
+	}
+}
+
+type routingStorage struct {
+	router   KeyRouter
+	backends []MultipartBlobStorageBackend
+	// capabilities are the optional operations of each backend.
+	capabilities []Capabilities
+}
+
+// NewRoutingStorage spreads keys across backends, e.g. buckets in different regions or
+// with separate quotas, as chosen by router. Every operation on a key is dispatched to
+// the backend router selects for it.
+//
+// CacheInfo prefix lookups are routed by the prefix itself, so router should route a
+// prefix the same way as the keys starting with it, as routing by a leading namespace
+// does. List lists every backend, and skips objects that router wouldn't route to the
+// backend they were found in. Delete and List are supported when every backend supports
+// them.
+func NewRoutingStorage(router KeyRouter, backends ...MultipartBlobStorageBackend) (MultipartBlobStorageBackend, error) {
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("storage: routing requires at least one backend")
+	}
+	if router == nil {
+		return nil, fmt.Errorf("storage: routing requires a router")
+	}
+	if len(backends) == 1 {
+		return backends[0], nil
+	}
+
+	result := &routingStorage{router: router, backends: backends}
+	capabilities := Capabilities{Delete: result.delete, List: result.list}
+	for _, backend := range backends {
+		backendCapabilities := CapabilitiesOf(backend)
+		if backendCapabilities.Delete == nil {
+			capabilities.Delete = nil
+		}
+		if backendCapabilities.List == nil {
+			capabilities.List = nil
+		}
+		result.capabilities = append(result.capabilities, backendCapabilities)
+	}
+	return WithCapabilities(result, capabilities), nil
+}
+
+func (s *routingStorage) route(key string) (int, error) {
+	index := s.router(key)
+	if index < 0 || index >= len(s.backends) {
+		return 0, fmt.Errorf("storage: key %q is routed to backend %d, but there are %d backends", key, index, len(s.backends))
+	}
+	return index, nil
+}
+
+func (s *routingStorage) backend(key string) (MultipartBlobStorageBackend, error) {
+	index, err := s.route(key)
+	if err != nil {
+		return nil, err
+	}
+	return s.backends[index], nil
+}
+
+func (s *routingStorage) DownloadURLs(ctx context.Context, key string) ([]*URLInfo, error) {
+	backend, err := s.backend(key)
+	if err != nil {
+		return nil, err
+	}
+	return backend.DownloadURLs(ctx, key)
+}
+
+func (s *routingStorage) UploadURL(ctx context.Context, key string, metadata map[string]string) (*URLInfo, error) {
+	backend, err := s.backend(key)
+	if err != nil {
+		return nil, err
+	}
+	return backend.UploadURL(ctx, key, metadata)
+}
+
+func (s *routingStorage) CacheInfo(ctx context.Context, key string, prefixes []string) (*CacheInfo, error) {
+	keyIndex, err := s.route(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Split the prefixes into runs routed to the same backend, keeping their order.
+	type prefixRun struct {
+		index    int
+		prefixes []string
+	}
+	var runs []prefixRun
+	for _, prefix := range prefixes {
+		index, err := s.route(prefix)
+		if err != nil {
+			return nil, err
+		}
+		if len(runs) == 0 || runs[len(runs)-1].index != index {
+			runs = append(runs, prefixRun{index: index})
+		}
+		runs[len(runs)-1].prefixes = append(runs[len(runs)-1].prefixes, prefix)
+	}
+
+	// The common case of a single backend needs a single lookup.
+	if len(runs) == 0 || (len(runs) == 1 && runs[0].index == keyIndex) {
+		return s.backends[keyIndex].CacheInfo(ctx, key, prefixes)
+	}
+
+	info, err := s.backends[keyIndex].CacheInfo(ctx, key, nil)
+	if !IsNotFoundError(err) {
+		return info, err
+	}
+	for _, run := range runs {
+		info, err := s.backends[run.index].CacheInfo(ctx, key, run.prefixes)
+		if !IsNotFoundError(err) {
+			return info, err
+		}
+	}
+	return nil, ErrCacheNotFound
+}
+
+func (s *routingStorage) CreateMultipartUpload(ctx context.Context, key string, metadata map[string]string) (string, error) {
+	backend, err := s.backend(key)
+	if err != nil {
+		return "", err
+	}
+	return backend.CreateMultipartUpload(ctx, key, metadata)
+}
+
+func (s *routingStorage) UploadPartURL(ctx context.Context, key string, uploadID string, partNumber uint32, contentLength uint64) (*URLInfo, error) {
+	backend, err := s.backend(key)
+	if err != nil {
+		return nil, err
+	}
+	return backend.UploadPartURL(ctx, key, uploadID, partNumber, contentLength)
+}
+
+func (s *routingStorage) CommitMultipartUpload(ctx context.Context, key string, uploadID string, parts []MultipartUploadPart) error {
+	backend, err := s.backend(key)
+	if err != nil {
+		return err
+	}
+	return backend.CommitMultipartUpload(ctx, key, uploadID, parts)
+}
+
+func (s *routingStorage) delete(ctx context.Context, key string) error {
+	index, err := s.route(key)
+	if err != nil {
+		return err
+	}
+	return s.capabilities[index].Delete(ctx, key)
+}
+
+func (s *routingStorage) list(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	for index := range s.backends {
+		err := s.capabilities[index].List(ctx, prefix, func(object ObjectInfo) error {
+			if s.router(object.Key) != index {
+				return nil
+			}
+			return fn(object)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
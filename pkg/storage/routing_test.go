@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoutingStorageDispatchesByKey(t *testing.T) {
+	ctx := context.Background()
+	shared := newTestFilesystemStorage(t)
+	gha := newTestFilesystemStorage(t)
+	bazel := newTestFilesystemStorage(t)
+
+	backend, err := NewRoutingStorage(RouteByPrefix(map[string]int{"gha/": 1, "bazel/": 2, "bazel/cas/": 0}, 0), shared, gha, bazel)
+	require.NoError(t, err)
+
+	for key, body := range map[string]string{"gha/deps-1": "gha", "bazel/ac/abc": "ac", "bazel/cas/abc": "cas", "http/x": "http"} {
+		uploadURL, err := backend.UploadURL(ctx, key, nil)
+		require.NoError(t, err)
+		httpPut(t, uploadURL.URL, []byte(body))
+
+		urls, err := backend.DownloadURLs(ctx, key)
+		require.NoError(t, err)
+		require.Equal(t, body, string(httpGet(t, urls[0].URL)))
+	}
+
+	require.Equal(t, map[string]int64{"gha/deps-1": 3}, listKeys(t, gha, ""))
+	require.Equal(t, map[string]int64{"bazel/ac/abc": 2}, listKeys(t, bazel, ""))
+	require.Equal(t, map[string]int64{"bazel/cas/abc": 3, "http/x": 4}, listKeys(t, shared, ""))
+
+	uploadID, err := backend.CreateMultipartUpload(ctx, "gha/deps-2", nil)
+	require.NoError(t, err)
+	partURL, err := backend.UploadPartURL(ctx, "gha/deps-2", uploadID, 1, 5)
+	require.NoError(t, err)
+	resp := httpPut(t, partURL.URL, []byte("multi"))
+	require.NoError(t, backend.CommitMultipartUpload(ctx, "gha/deps-2", uploadID, []MultipartUploadPart{
+		{PartNumber: 1, ETag: resp.Header.Get("ETag")},
+	}))
+	_, err = gha.CacheInfo(ctx, "gha/deps-2", nil)
+	require.NoError(t, err)
+
+	require.Equal(t, map[string]int64{
+		"gha/deps-1": 3, "gha/deps-2": 5, "bazel/ac/abc": 2, "bazel/cas/abc": 3, "http/x": 4,
+	}, listKeys(t, backend, ""))
+	require.Equal(t, map[string]int64{"bazel/ac/abc": 2, "bazel/cas/abc": 3}, listKeys(t, backend, "bazel/"))
+
+	require.NoError(t, backend.(DeletableBlobStorageBackend).Delete(ctx, "gha/deps-1"))
+	_, err = gha.CacheInfo(ctx, "gha/deps-1", nil)
+	require.ErrorIs(t, err, ErrCacheNotFound)
+}
+
+func TestRoutingStorageCacheInfoPrefixes(t *testing.T) {
+	ctx := context.Background()
+	teamA := newTestFilesystemStorage(t)
+	teamB := newTestFilesystemStorage(t)
+	require.NoError(t, teamA.Put(ctx, "team-a/deps-old", strings.NewReader("a"), nil))
+	require.NoError(t, teamB.Put(ctx, "team-b/deps-old", strings.NewReader("b"), nil))
+	// Not routed to teamB, so it's never found there.
+	require.NoError(t, teamB.Put(ctx, "team-a/stray", strings.NewReader("stray"), nil))
+
+	backend, err := NewRoutingStorage(RouteByPrefix(map[string]int{"team-b/": 1}, 0), teamA, teamB)
+	require.NoError(t, err)
+
+	info, err := backend.CacheInfo(ctx, "team-a/deps-new", []string{"team-a/deps-"})
+	require.NoError(t, err)
+	require.Equal(t, "team-a/deps-old", info.Key)
+
+	// Prefixes are looked up in the backend they're routed to, in order.
+	info, err = backend.CacheInfo(ctx, "team-a/deps-new", []string{"team-b/deps-", "team-a/deps-"})
+	require.NoError(t, err)
+	require.Equal(t, "team-b/deps-old", info.Key)
+
+	_, err = backend.CacheInfo(ctx, "team-a/stray", nil)
+	require.ErrorIs(t, err, ErrCacheNotFound)
+	require.NotContains(t, listKeys(t, backend, ""), "team-a/stray")
+}
+
+func TestRoutingStorageRejectsInvalidRoutes(t *testing.T) {
+	_, err := NewRoutingStorage(RouteByPrefix(nil, 0))
+	require.Error(t, err)
+
+	backend, err := NewRoutingStorage(func(string) int { return 2 }, newTestFilesystemStorage(t), newTestFilesystemStorage(t))
+	require.NoError(t, err)
+	_, err = backend.CacheInfo(context.Background(), "key", nil)
+	require.ErrorContains(t, err, "routed to backend 2")
+}
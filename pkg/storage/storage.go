@@ -5,6 +5,7 @@ import (
 	"errors"
 	"net/url"
 	"strings"
+	"time"
 )
 
 type URLInfo struct {
@@ -37,6 +38,20 @@ type CacheInfo struct {
 	Key       string
 	SizeBytes int64
 	Metadata  map[string]string
+	// LastModified is when the entry was last written, or the zero time if the backend
+	// doesn't report it.
+	LastModified time.Time
+	// Expiry is when the entry stops being served, or the zero time if it never expires.
+	Expiry time.Time
+}
+
+// ObjectInfo describes a stored object returned by a prefix listing.
+type ObjectInfo struct {
+	Key       string
+	SizeBytes int64
+	// LastModified is when the object was last written, or the zero time if the backend
+	// doesn't report it.
+	LastModified time.Time
 }
 
 // ErrCacheNotFound is returned when a cache entry doesn't exist.
@@ -54,6 +69,9 @@ func IsNotFoundError(err error) bool {
 }
 
 type BlobStorageBackend interface {
+	// DownloadURLs returns candidate URLs for key ordered best-first: callers try them in
+	// order and stop at the first one that works, so backends must put the preferred source
+	// (e.g. the nearest mirror) ahead of fallbacks such as a HEAD-only URL.
 	DownloadURLs(ctx context.Context, key string) ([]*URLInfo, error)
 	UploadURL(ctx context.Context, key string, metadate map[string]string) (*URLInfo, error)
 	CacheInfo(ctx context.Context, key string, prefixes []string) (*CacheInfo, error)
@@ -64,6 +82,12 @@ type DeletableBlobStorageBackend interface {
 	Delete(ctx context.Context, key string) error
 }
 
+// ListableBlobStorageBackend extends BlobStorageBackend with prefix listing.
+type ListableBlobStorageBackend interface {
+	// List calls fn for every object whose key starts with prefix.
+	List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error
+}
+
 type MultipartBlobStorageBackend interface {
 	BlobStorageBackend
 
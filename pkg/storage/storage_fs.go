@@ -0,0 +1,494 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	fsObjectsDir      = "objects"
+	fsUploadsDir      = "uploads"
+	fsBlobSuffix      = ".blob"
+	fsMetadataSuffix  = ".meta.json"
+	fsEncodingSuffix  = ".encoding"
+	fsUploadKeyFile   = "key"
+	fsUploadMetaFile  = "metadata.json"
+	fsObjectRoutePath = "/o/"
+	fsPartRoutePath   = "/u/"
+)
+
+// FilesystemStorage stores objects in a local directory and serves them over a
+// loopback HTTP listener, so that it can stand in for S3 wherever download and
+// upload URLs are handed out. Objects live at objects/<key>.blob, with optional
+// metadata at objects/<key>.meta.json and the Content-Encoding they were uploaded
+// with at objects/<key>.encoding.
+type FilesystemStorage struct {
+	root    string
+	baseURL string
+	server  *http.Server
+}
+
+// NewFilesystemStorage creates dir if needed and starts serving it on a loopback port.
+// Call Close to stop the listener.
+func NewFilesystemStorage(dir string) (*FilesystemStorage, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, subdir := range []string{fsObjectsDir, fsUploadsDir} {
+		if err := os.MkdirAll(filepath.Join(root, subdir), 0o755); err != nil {
+			return nil, fmt.Errorf("storage: create %s: %w", subdir, err)
+		}
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("storage: listen: %w", err)
+	}
+
+	result := &FilesystemStorage{
+		root:    root,
+		baseURL: "http://" + listener.Addr().String(),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+fsObjectRoutePath+"{key...}", result.serveObject)
+	mux.HandleFunc("HEAD "+fsObjectRoutePath+"{key...}", result.serveObject)
+	mux.HandleFunc("PUT "+fsObjectRoutePath+"{key...}", result.putObject)
+	mux.HandleFunc("PUT "+fsPartRoutePath+"{uploadID}/{partNumber}", result.putPart)
+	result.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		_ = result.server.Serve(listener)
+	}()
+
+	return result, nil
+}
+
+// Close stops serving the directory.
+func (s *FilesystemStorage) Close() error {
+	return s.server.Close()
+}
+
+// Put writes an object directly, bypassing the HTTP listener.
+func (s *FilesystemStorage) Put(ctx context.Context, key string, r io.Reader, metadata map[string]string) error {
+	blobPath, err := s.blobPath(key)
+	if err != nil {
+		return err
+	}
+	if err := s.writeMetadata(blobPath, metadata); err != nil {
+		return err
+	}
+	return writeFileAtomically(blobPath, r)
+}
+
+func (s *FilesystemStorage) DownloadURLs(ctx context.Context, key string) ([]*URLInfo, error) {
+	blobPath, err := s.blobPath(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(blobPath); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrCacheNotFound
+		}
+		return nil, err
+	}
+
+	return []*URLInfo{{URL: s.objectURL(key)}}, nil
+}
+
+func (s *FilesystemStorage) UploadURL(ctx context.Context, key string, metadata map[string]string) (*URLInfo, error) {
+	blobPath, err := s.blobPath(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.writeMetadata(blobPath, metadata); err != nil {
+		return nil, err
+	}
+
+	return &URLInfo{URL: s.objectURL(key)}, nil
+}
+
+func (s *FilesystemStorage) CacheInfo(ctx context.Context, key string, prefixes []string) (*CacheInfo, error) {
+	info, err := s.cacheInfoForKey(key)
+	if err == nil {
+		return info, nil
+	}
+	if !errors.Is(err, ErrCacheNotFound) {
+		return nil, err
+	}
+
+	for _, prefix := range prefixes {
+		if prefix == "" {
+			continue
+		}
+
+		var (
+			latestKey  string
+			latestTime time.Time
+			found      bool
+		)
+		err := s.walk(prefix, func(objectKey string, fileInfo fs.FileInfo) error {
+			if !found || fileInfo.ModTime().After(latestTime) {
+				latestKey = objectKey
+				latestTime = fileInfo.ModTime()
+				found = true
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			return s.cacheInfoForKey(latestKey)
+		}
+	}
+
+	return nil, ErrCacheNotFound
+}
+
+func (s *FilesystemStorage) Delete(ctx context.Context, key string) error {
+	blobPath, err := s.blobPath(key)
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{blobPath, metadataPath(blobPath), encodingPath(blobPath)} {
+		if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FilesystemStorage) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	return s.walk(prefix, func(objectKey string, fileInfo fs.FileInfo) error {
+		return fn(ObjectInfo{Key: objectKey, SizeBytes: fileInfo.Size(), LastModified: fileInfo.ModTime()})
+	})
+}
+
+func (s *FilesystemStorage) CreateMultipartUpload(ctx context.Context, key string, metadata map[string]string) (string, error) {
+	if _, err := s.blobPath(key); err != nil {
+		return "", err
+	}
+
+	uploadID := uuid.NewString()
+	uploadDir := filepath.Join(s.root, fsUploadsDir, uploadID)
+	if err := os.MkdirAll(uploadDir, 0o755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(uploadDir, fsUploadKeyFile), []byte(key), 0o644); err != nil {
+		return "", err
+	}
+	if len(metadata) > 0 {
+		payload, err := json.Marshal(metadata)
+		if err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(filepath.Join(uploadDir, fsUploadMetaFile), payload, 0o644); err != nil {
+			return "", err
+		}
+	}
+
+	return uploadID, nil
+}
+
+func (s *FilesystemStorage) UploadPartURL(ctx context.Context, key string, uploadID string, partNumber uint32, contentLength uint64) (*URLInfo, error) {
+	if _, err := s.uploadDir(uploadID, key); err != nil {
+		return nil, err
+	}
+
+	partURL := &url.URL{Path: fsPartRoutePath + uploadID + "/" + strconv.FormatUint(uint64(partNumber), 10)}
+	return &URLInfo{URL: s.baseURL + partURL.EscapedPath()}, nil
+}
+
+func (s *FilesystemStorage) CommitMultipartUpload(ctx context.Context, key string, uploadID string, parts []MultipartUploadPart) error {
+	uploadDir, err := s.uploadDir(uploadID, key)
+	if err != nil {
+		return err
+	}
+	blobPath, err := s.blobPath(key)
+	if err != nil {
+		return err
+	}
+
+	readers := make([]io.Reader, 0, len(parts))
+	for _, part := range parts {
+		file, err := os.Open(filepath.Join(uploadDir, strconv.FormatUint(uint64(part.PartNumber), 10)))
+		if err != nil {
+			return fmt.Errorf("storage: part %d of upload %s: %w", part.PartNumber, uploadID, err)
+		}
+		defer file.Close()
+		readers = append(readers, file)
+	}
+
+	var metadata map[string]string
+	if payload, err := os.ReadFile(filepath.Join(uploadDir, fsUploadMetaFile)); err == nil {
+		if err := json.Unmarshal(payload, &metadata); err != nil {
+			return err
+		}
+	}
+	if err := s.writeMetadata(blobPath, metadata); err != nil {
+		return err
+	}
+	if err := os.Remove(encodingPath(blobPath)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := writeFileAtomically(blobPath, io.MultiReader(readers...)); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(uploadDir)
+}
+
+func (s *FilesystemStorage) serveObject(w http.ResponseWriter, r *http.Request) {
+	blobPath, err := s.blobPath(r.PathValue("key"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	file, err := os.Open(blobPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if encoding, err := os.ReadFile(encodingPath(blobPath)); err == nil {
+		w.Header().Set("Content-Encoding", string(encoding))
+	}
+	http.ServeContent(w, r, "", fileInfo.ModTime(), file)
+}
+
+func (s *FilesystemStorage) putObject(w http.ResponseWriter, r *http.Request) {
+	blobPath, err := s.blobPath(r.PathValue("key"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := writeFileAtomically(blobPath, r.Body); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Keep the Content-Encoding the object was uploaded with, like S3 does.
+	if encoding := r.Header.Get("Content-Encoding"); encoding != "" {
+		err = writeFileAtomically(encodingPath(blobPath), strings.NewReader(encoding))
+	} else if err = os.Remove(encodingPath(blobPath)); errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *FilesystemStorage) putPart(w http.ResponseWriter, r *http.Request) {
+	partNumber, err := strconv.ParseUint(r.PathValue("partNumber"), 10, 32)
+	if err != nil || partNumber == 0 {
+		http.Error(w, "invalid part number", http.StatusBadRequest)
+		return
+	}
+	uploadDir, err := s.uploadDir(r.PathValue("uploadID"), "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	hasher := md5.New()
+	partPath := filepath.Join(uploadDir, strconv.FormatUint(partNumber, 10))
+	if err := writeFileAtomically(partPath, io.TeeReader(r.Body, hasher)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", strconv.Quote(hex.EncodeToString(hasher.Sum(nil))))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *FilesystemStorage) cacheInfoForKey(key string) (*CacheInfo, error) {
+	blobPath, err := s.blobPath(key)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, err := os.Stat(blobPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrCacheNotFound
+		}
+		return nil, err
+	}
+
+	info := &CacheInfo{
+		Key:          strings.TrimPrefix(key, "/"),
+		SizeBytes:    fileInfo.Size(),
+		LastModified: fileInfo.ModTime(),
+	}
+	if payload, err := os.ReadFile(metadataPath(blobPath)); err == nil {
+		if err := json.Unmarshal(payload, &info.Metadata); err != nil {
+			return nil, err
+		}
+	}
+
+	return info, nil
+}
+
+// walk calls fn for every stored object whose key starts with prefix.
+func (s *FilesystemStorage) walk(prefix string, fn func(objectKey string, fileInfo fs.FileInfo) error) error {
+	prefix = strings.TrimPrefix(prefix, "/")
+	objectsRoot := filepath.Join(s.root, fsObjectsDir)
+
+	// Only descend into the deepest directory fully named by the prefix.
+	start := objectsRoot
+	if dir := path.Dir(prefix); dir != "." && validKey(dir) {
+		start = filepath.Join(objectsRoot, filepath.FromSlash(dir))
+	}
+
+	err := filepath.WalkDir(start, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() || !strings.HasSuffix(name, fsBlobSuffix) {
+			return nil
+		}
+
+		relative, err := filepath.Rel(objectsRoot, name)
+		if err != nil {
+			return err
+		}
+		objectKey := strings.TrimSuffix(filepath.ToSlash(relative), fsBlobSuffix)
+		if !strings.HasPrefix(objectKey, prefix) {
+			return nil
+		}
+
+		fileInfo, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		return fn(objectKey, fileInfo)
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *FilesystemStorage) blobPath(key string) (string, error) {
+	key = strings.TrimPrefix(key, "/")
+	if !validKey(key) {
+		return "", fmt.Errorf("storage: invalid key %q", key)
+	}
+	return filepath.Join(s.root, fsObjectsDir, filepath.FromSlash(key)) + fsBlobSuffix, nil
+}
+
+func (s *FilesystemStorage) uploadDir(uploadID string, key string) (string, error) {
+	if _, err := uuid.Parse(uploadID); err != nil {
+		return "", fmt.Errorf("storage: invalid upload ID %q", uploadID)
+	}
+
+	uploadDir := filepath.Join(s.root, fsUploadsDir, uploadID)
+	storedKey, err := os.ReadFile(filepath.Join(uploadDir, fsUploadKeyFile))
+	if err != nil {
+		return "", fmt.Errorf("storage: upload %s not found: %w", uploadID, err)
+	}
+	if key != "" && string(storedKey) != key {
+		return "", fmt.Errorf("storage: upload %s belongs to a different key", uploadID)
+	}
+
+	return uploadDir, nil
+}
+
+func (s *FilesystemStorage) objectURL(key string) string {
+	objectURL := &url.URL{Path: fsObjectRoutePath + strings.TrimPrefix(key, "/")}
+	return s.baseURL + objectURL.EscapedPath()
+}
+
+func (s *FilesystemStorage) writeMetadata(blobPath string, metadata map[string]string) error {
+	if len(metadata) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(normalizeMetadata(metadata))
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomically(metadataPath(blobPath), strings.NewReader(string(payload)))
+}
+
+func metadataPath(blobPath string) string {
+	return strings.TrimSuffix(blobPath, fsBlobSuffix) + fsMetadataSuffix
+}
+
+func encodingPath(blobPath string) string {
+	return strings.TrimSuffix(blobPath, fsBlobSuffix) + fsEncodingSuffix
+}
+
+// validKey rejects keys that would escape the objects directory or map
+// ambiguously onto the filesystem.
+func validKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." || strings.ContainsRune(segment, '\\') {
+			return false
+		}
+	}
+	return true
+}
+
+func writeFileAtomically(name string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(name), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmpFile.Name())
+	}()
+
+	if _, err := io.Copy(tmpFile, r); err != nil {
+		_ = tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), name)
+}
@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestFilesystemStorage(t *testing.T) *FilesystemStorage {
+	t.Helper()
+
+	backend, err := NewFilesystemStorage(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = backend.Close()
+	})
+
+	return backend
+}
+
+func httpPut(t *testing.T, rawURL string, body []byte) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPut, rawURL, bytes.NewReader(body))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = resp.Body.Close()
+	})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	return resp
+}
+
+func httpGet(t *testing.T, rawURL string) []byte {
+	t.Helper()
+
+	resp, err := http.Get(rawURL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return body
+}
+
+func TestFilesystemStorageUploadAndDownload(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestFilesystemStorage(t)
+
+	_, err := backend.DownloadURLs(ctx, "gha/key")
+	require.ErrorIs(t, err, ErrCacheNotFound)
+
+	uploadURL, err := backend.UploadURL(ctx, "gha/key", map[string]string{"Version": "1"})
+	require.NoError(t, err)
+	httpPut(t, uploadURL.URL, []byte("payload"))
+
+	urls, err := backend.DownloadURLs(ctx, "gha/key")
+	require.NoError(t, err)
+	require.Len(t, urls, 1)
+	require.Equal(t, []byte("payload"), httpGet(t, urls[0].URL))
+
+	info, err := backend.CacheInfo(ctx, "gha/key", nil)
+	require.NoError(t, err)
+	require.Equal(t, "gha/key", info.Key)
+	require.EqualValues(t, len("payload"), info.SizeBytes)
+	require.Equal(t, map[string]string{"version": "1"}, info.Metadata)
+}
+
+func TestFilesystemStorageNestedKeysDoNotCollide(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestFilesystemStorage(t)
+
+	require.NoError(t, backend.Put(ctx, "a", strings.NewReader("short"), nil))
+	require.NoError(t, backend.Put(ctx, "a/b", strings.NewReader("nested"), nil))
+
+	var keys []string
+	require.NoError(t, backend.List(ctx, "a", func(object ObjectInfo) error {
+		keys = append(keys, object.Key)
+		return nil
+	}))
+	require.ElementsMatch(t, []string{"a", "a/b"}, keys)
+
+	keys = nil
+	require.NoError(t, backend.List(ctx, "a/", func(object ObjectInfo) error {
+		keys = append(keys, object.Key)
+		return nil
+	}))
+	require.Equal(t, []string{"a/b"}, keys)
+
+	require.NoError(t, backend.Delete(ctx, "a"))
+	_, err := backend.CacheInfo(ctx, "a", nil)
+	require.ErrorIs(t, err, ErrCacheNotFound)
+	_, err = backend.CacheInfo(ctx, "a/b", nil)
+	require.NoError(t, err)
+}
+
+func TestFilesystemStorageCacheInfoPrefix(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestFilesystemStorage(t)
+
+	require.NoError(t, backend.Put(ctx, "cache/linux-1", strings.NewReader("v1"), nil))
+
+	info, err := backend.CacheInfo(ctx, "cache/linux-2", []string{"cache/mac", "cache/linux"})
+	require.NoError(t, err)
+	require.Equal(t, "cache/linux-1", info.Key)
+}
+
+func TestFilesystemStorageRejectsTraversal(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestFilesystemStorage(t)
+
+	for _, key := range []string{"", "../escape", "a/../../b", "a//b", "a/"} {
+		_, err := backend.UploadURL(ctx, key, nil)
+		require.Error(t, err, key)
+	}
+}
+
+func TestFilesystemStorageMultipartUpload(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestFilesystemStorage(t)
+
+	uploadID, err := backend.CreateMultipartUpload(ctx, "big/object", map[string]string{"kind": "test"})
+	require.NoError(t, err)
+
+	var parts []MultipartUploadPart
+	for i, chunk := range []string{"hello ", "multipart ", "world"} {
+		partNumber := uint32(i + 1)
+		partURL, err := backend.UploadPartURL(ctx, "big/object", uploadID, partNumber, uint64(len(chunk)))
+		require.NoError(t, err)
+
+		resp := httpPut(t, partURL.URL, []byte(chunk))
+		require.NotEmpty(t, resp.Header.Get("ETag"))
+		parts = append(parts, MultipartUploadPart{PartNumber: partNumber, ETag: resp.Header.Get("ETag")})
+	}
+
+	_, err = backend.UploadPartURL(ctx, "other/object", uploadID, 1, 1)
+	require.Error(t, err)
+
+	require.NoError(t, backend.CommitMultipartUpload(ctx, "big/object", uploadID, parts))
+
+	urls, err := backend.DownloadURLs(ctx, "big/object")
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello multipart world"), httpGet(t, urls[0].URL))
+
+	info, err := backend.CacheInfo(ctx, "big/object", nil)
+	require.NoError(t, err)
+	require.Equal(t, "test", info.Metadata["kind"])
+}
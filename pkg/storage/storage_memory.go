@@ -0,0 +1,380 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	memoryObjectRoutePath = "/o/"
+	memoryPartRoutePath   = "/u/"
+)
+
+// MemoryStorage keeps objects in memory and serves them over a loopback HTTP listener,
+// like FilesystemStorage does for a directory. It suits unit tests and ephemeral caches
+// that don't need to survive a restart; everything is lost on Close.
+type MemoryStorage struct {
+	baseURL string
+	server  *http.Server
+
+	mu      sync.RWMutex
+	objects map[string]*memoryObject
+	uploads map[string]*memoryUpload
+}
+
+type memoryObject struct {
+	data         []byte
+	metadata     map[string]string
+	encoding     string
+	lastModified time.Time
+}
+
+type memoryUpload struct {
+	key      string
+	metadata map[string]string
+	parts    map[uint32][]byte
+}
+
+// NewMemoryStorage starts serving an empty in-memory store on a loopback port. Call Close
+// to stop the listener.
+func NewMemoryStorage() (*MemoryStorage, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("storage: listen: %w", err)
+	}
+
+	result := &MemoryStorage{
+		baseURL: "http://" + listener.Addr().String(),
+		objects: map[string]*memoryObject{},
+		uploads: map[string]*memoryUpload{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+memoryObjectRoutePath+"{key...}", result.serveObject)
+	mux.HandleFunc("HEAD "+memoryObjectRoutePath+"{key...}", result.serveObject)
+	mux.HandleFunc("PUT "+memoryObjectRoutePath+"{key...}", result.putObject)
+	mux.HandleFunc("PUT "+memoryPartRoutePath+"{uploadID}/{partNumber}", result.putPart)
+	result.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		_ = result.server.Serve(listener)
+	}()
+
+	return result, nil
+}
+
+// Close stops serving the store.
+func (s *MemoryStorage) Close() error {
+	return s.server.Close()
+}
+
+// Put writes an object directly, bypassing the HTTP listener.
+func (s *MemoryStorage) Put(ctx context.Context, key string, r io.Reader, metadata map[string]string) error {
+	key, err := memoryKey(key)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = &memoryObject{data: data, metadata: normalizeMetadata(metadata), lastModified: time.Now()}
+	return nil
+}
+
+func (s *MemoryStorage) DownloadURLs(ctx context.Context, key string) ([]*URLInfo, error) {
+	key, err := memoryKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	_, ok := s.objects[key]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, ErrCacheNotFound
+	}
+
+	return []*URLInfo{{URL: s.objectURL(key)}}, nil
+}
+
+// UploadURL returns a URL to PUT the object to. The metadata is applied once the object
+// is uploaded.
+func (s *MemoryStorage) UploadURL(ctx context.Context, key string, metadata map[string]string) (*URLInfo, error) {
+	key, err := memoryKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	uploadURL := &url.URL{Path: memoryObjectRoutePath + key}
+	if len(metadata) > 0 {
+		// Carry the metadata in the URL, like S3 signs it into a presigned URL.
+		query := url.Values{}
+		for k, v := range normalizeMetadata(metadata) {
+			query.Set(k, v)
+		}
+		uploadURL.RawQuery = query.Encode()
+	}
+	return &URLInfo{URL: s.baseURL + uploadURL.String()}, nil
+}
+
+func (s *MemoryStorage) CacheInfo(ctx context.Context, key string, prefixes []string) (*CacheInfo, error) {
+	key, err := memoryKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if object, ok := s.objects[key]; ok {
+		return object.cacheInfo(key), nil
+	}
+
+	for _, prefix := range prefixes {
+		prefix = strings.TrimPrefix(prefix, "/")
+		if prefix == "" {
+			continue
+		}
+
+		var latestKey string
+		var latest *memoryObject
+		for objectKey, object := range s.objects {
+			if strings.HasPrefix(objectKey, prefix) && (latest == nil || object.lastModified.After(latest.lastModified)) {
+				latestKey, latest = objectKey, object
+			}
+		}
+		if latest != nil {
+			return latest.cacheInfo(latestKey), nil
+		}
+	}
+
+	return nil, ErrCacheNotFound
+}
+
+func (s *MemoryStorage) Delete(ctx context.Context, key string) error {
+	key, err := memoryKey(key)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+// List calls fn for every object whose key starts with prefix, in key order.
+func (s *MemoryStorage) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	prefix = strings.TrimPrefix(prefix, "/")
+
+	s.mu.RLock()
+	var objects []ObjectInfo
+	for key, object := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, ObjectInfo{Key: key, SizeBytes: int64(len(object.data)), LastModified: object.lastModified})
+		}
+	}
+	s.mu.RUnlock()
+
+	slices.SortFunc(objects, func(a, b ObjectInfo) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	for _, object := range objects {
+		if err := fn(object); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) CreateMultipartUpload(ctx context.Context, key string, metadata map[string]string) (string, error) {
+	key, err := memoryKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	uploadID := uuid.NewString()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.uploads[uploadID] = &memoryUpload{key: key, metadata: normalizeMetadata(metadata), parts: map[uint32][]byte{}}
+	return uploadID, nil
+}
+
+func (s *MemoryStorage) UploadPartURL(ctx context.Context, key string, uploadID string, partNumber uint32, contentLength uint64) (*URLInfo, error) {
+	s.mu.RLock()
+	_, err := s.upload(uploadID, key)
+	s.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	partURL := &url.URL{Path: memoryPartRoutePath + uploadID + "/" + strconv.FormatUint(uint64(partNumber), 10)}
+	return &URLInfo{URL: s.baseURL + partURL.EscapedPath()}, nil
+}
+
+// CommitMultipartUpload concatenates parts in the given order. Parts with an ETag must
+// match the part that was uploaded.
+func (s *MemoryStorage) CommitMultipartUpload(ctx context.Context, key string, uploadID string, parts []MultipartUploadPart) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	upload, err := s.upload(uploadID, key)
+	if err != nil {
+		return err
+	}
+
+	var data bytes.Buffer
+	for _, part := range parts {
+		partData, ok := upload.parts[part.PartNumber]
+		if !ok {
+			return fmt.Errorf("storage: part %d of upload %s was not uploaded", part.PartNumber, uploadID)
+		}
+		if part.ETag != "" && part.ETag != partETag(partData) {
+			return fmt.Errorf("storage: part %d of upload %s has a different ETag", part.PartNumber, uploadID)
+		}
+		data.Write(partData)
+	}
+
+	s.objects[upload.key] = &memoryObject{data: data.Bytes(), metadata: upload.metadata, lastModified: time.Now()}
+	delete(s.uploads, uploadID)
+	return nil
+}
+
+func (s *MemoryStorage) serveObject(w http.ResponseWriter, r *http.Request) {
+	key, err := memoryKey(r.PathValue("key"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.RLock()
+	object, ok := s.objects[key]
+	s.mu.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if object.encoding != "" {
+		w.Header().Set("Content-Encoding", object.encoding)
+	}
+	http.ServeContent(w, r, "", object.lastModified, bytes.NewReader(object.data))
+}
+
+func (s *MemoryStorage) putObject(w http.ResponseWriter, r *http.Request) {
+	key, err := memoryKey(r.PathValue("key"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var metadata map[string]string
+	for k, values := range r.URL.Query() {
+		if metadata == nil {
+			metadata = map[string]string{}
+		}
+		metadata[k] = values[0]
+	}
+
+	s.mu.Lock()
+	s.objects[key] = &memoryObject{
+		data:     data,
+		metadata: metadata,
+		// Keep the Content-Encoding the object was uploaded with, like S3 does.
+		encoding:     r.Header.Get("Content-Encoding"),
+		lastModified: time.Now(),
+	}
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *MemoryStorage) putPart(w http.ResponseWriter, r *http.Request) {
+	partNumber, err := strconv.ParseUint(r.PathValue("partNumber"), 10, 32)
+	if err != nil || partNumber == 0 {
+		http.Error(w, "invalid part number", http.StatusBadRequest)
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.mu.Lock()
+	upload, err := s.upload(r.PathValue("uploadID"), "")
+	if err == nil {
+		upload.parts[uint32(partNumber)] = data
+	}
+	s.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("ETag", partETag(data))
+	w.WriteHeader(http.StatusOK)
+}
+
+// upload returns the multipart upload with the given ID, checking that it belongs to key
+// unless key is empty. The caller must hold s.mu.
+func (s *MemoryStorage) upload(uploadID string, key string) (*memoryUpload, error) {
+	upload, ok := s.uploads[uploadID]
+	if !ok {
+		return nil, fmt.Errorf("storage: upload %s not found", uploadID)
+	}
+	if key != "" && strings.TrimPrefix(key, "/") != upload.key {
+		return nil, fmt.Errorf("storage: upload %s belongs to a different key", uploadID)
+	}
+	return upload, nil
+}
+
+func (s *MemoryStorage) objectURL(key string) string {
+	objectURL := &url.URL{Path: memoryObjectRoutePath + key}
+	return s.baseURL + objectURL.EscapedPath()
+}
+
+func (object *memoryObject) cacheInfo(key string) *CacheInfo {
+	return &CacheInfo{
+		Key:          key,
+		SizeBytes:    int64(len(object.data)),
+		Metadata:     object.metadata,
+		LastModified: object.lastModified,
+	}
+}
+
+func memoryKey(key string) (string, error) {
+	key = strings.TrimPrefix(key, "/")
+	if key == "" {
+		return "", fmt.Errorf("storage: empty key")
+	}
+	return key, nil
+}
+
+func partETag(data []byte) string {
+	sum := md5.Sum(data)
+	return strconv.Quote(hex.EncodeToString(sum[:]))
+}
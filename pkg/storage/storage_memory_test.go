@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestMemoryStorage(t *testing.T) *MemoryStorage {
+	t.Helper()
+
+	backend, err := NewMemoryStorage()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = backend.Close()
+	})
+
+	return backend
+}
+
+func TestMemoryStorageUploadAndDownload(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestMemoryStorage(t)
+
+	_, err := backend.DownloadURLs(ctx, "gha/key")
+	require.ErrorIs(t, err, ErrCacheNotFound)
+	_, err = backend.CacheInfo(ctx, "gha/key", nil)
+	require.ErrorIs(t, err, ErrCacheNotFound)
+
+	uploadURL, err := backend.UploadURL(ctx, "gha/key", map[string]string{"Version": "1"})
+	require.NoError(t, err)
+	httpPut(t, uploadURL.URL, []byte("payload"))
+
+	urls, err := backend.DownloadURLs(ctx, "gha/key")
+	require.NoError(t, err)
+	require.Len(t, urls, 1)
+	require.Equal(t, []byte("payload"), httpGet(t, urls[0].URL))
+
+	info, err := backend.CacheInfo(ctx, "gha/key", nil)
+	require.NoError(t, err)
+	require.Equal(t, "gha/key", info.Key)
+	require.EqualValues(t, len("payload"), info.SizeBytes)
+	require.Equal(t, map[string]string{"version": "1"}, info.Metadata)
+
+	require.NoError(t, backend.Delete(ctx, "gha/key"))
+	_, err = backend.DownloadURLs(ctx, "gha/key")
+	require.ErrorIs(t, err, ErrCacheNotFound)
+}
+
+func TestMemoryStorageCacheInfoPrefixAndList(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestMemoryStorage(t)
+
+	require.NoError(t, backend.Put(ctx, "cache/linux-1", strings.NewReader("v1"), nil))
+	require.NoError(t, backend.Put(ctx, "cache/linux-0", strings.NewReader("v0"), nil))
+	require.NoError(t, backend.Put(ctx, "other", strings.NewReader("x"), nil))
+
+	info, err := backend.CacheInfo(ctx, "cache/linux-2", []string{"cache/mac", "cache/linux"})
+	require.NoError(t, err)
+	require.Contains(t, []string{"cache/linux-0", "cache/linux-1"}, info.Key)
+
+	var keys []string
+	require.NoError(t, backend.List(ctx, "cache/", func(object ObjectInfo) error {
+		keys = append(keys, object.Key)
+		return nil
+	}))
+	require.Equal(t, []string{"cache/linux-0", "cache/linux-1"}, keys)
+}
+
+func TestMemoryStorageMultipartUpload(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestMemoryStorage(t)
+
+	uploadID, err := backend.CreateMultipartUpload(ctx, "big/object", map[string]string{"kind": "test"})
+	require.NoError(t, err)
+
+	var parts []MultipartUploadPart
+	for i, chunk := range []string{"hello ", "multipart ", "world"} {
+		partNumber := uint32(i + 1)
+		partURL, err := backend.UploadPartURL(ctx, "big/object", uploadID, partNumber, uint64(len(chunk)))
+		require.NoError(t, err)
+
+		resp := httpPut(t, partURL.URL, []byte(chunk))
+		require.NotEmpty(t, resp.Header.Get("ETag"))
+		parts = append(parts, MultipartUploadPart{PartNumber: partNumber, ETag: resp.Header.Get("ETag")})
+	}
+
+	_, err = backend.UploadPartURL(ctx, "other/object", uploadID, 1, 1)
+	require.Error(t, err)
+
+	require.NoError(t, backend.CommitMultipartUpload(ctx, "big/object", uploadID, parts))
+
+	urls, err := backend.DownloadURLs(ctx, "big/object")
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello multipart world"), httpGet(t, urls[0].URL))
+
+	info, err := backend.CacheInfo(ctx, "big/object", nil)
+	require.NoError(t, err)
+	require.Equal(t, "test", info.Metadata["kind"])
+
+	require.Error(t, backend.CommitMultipartUpload(ctx, "big/object", uploadID, parts))
+}
+
+func TestMemoryStorageMultipartUploadOutOfOrderParts(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestMemoryStorage(t)
+
+	uploadID, err := backend.CreateMultipartUpload(ctx, "ooo", nil)
+	require.NoError(t, err)
+
+	partData := map[uint32]string{1: "first ", 2: "second ", 3: "third"}
+	etags := map[uint32]string{}
+	for _, partNumber := range []uint32{3, 1, 2} {
+		partURL, err := backend.UploadPartURL(ctx, "ooo", uploadID, partNumber, uint64(len(partData[partNumber])))
+		require.NoError(t, err)
+		etags[partNumber] = httpPut(t, partURL.URL, []byte(partData[partNumber])).Header.Get("ETag")
+	}
+
+	require.Error(t, backend.CommitMultipartUpload(ctx, "ooo", uploadID, []MultipartUploadPart{
+		{PartNumber: 1, ETag: etags[2]},
+	}))
+
+	require.NoError(t, backend.CommitMultipartUpload(ctx, "ooo", uploadID, []MultipartUploadPart{
+		{PartNumber: 1, ETag: etags[1]},
+		{PartNumber: 2, ETag: etags[2]},
+		{PartNumber: 3, ETag: etags[3]},
+	}))
+
+	urls, err := backend.DownloadURLs(ctx, "ooo")
+	require.NoError(t, err)
+	require.Equal(t, []byte("first second third"), httpGet(t, urls[0].URL))
+}
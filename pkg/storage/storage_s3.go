@@ -4,13 +4,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"path"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
 	"github.com/aws/aws-sdk-go-v2/aws/signer/v4"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
@@ -22,6 +25,9 @@ import (
 const (
 	defaultPresignExpiration = 10 * time.Minute
 	bucketWaitTimeout        = 1 * time.Minute
+
+	// MaxPresignExpiration is the longest expiration S3 accepts for presigned URLs.
+	MaxPresignExpiration = 7 * 24 * time.Hour
 )
 
 type s3Storage struct {
@@ -29,12 +35,147 @@ type s3Storage struct {
 	presignClient *s3.PresignClient
 	bucketName    string
 	prefix        []string
+	skipHeadURL   bool
+
+	presignExpiration time.Duration
+	maxMetadataBytes  int
+
+	sseAlgorithm types.ServerSideEncryption
+	sseKMSKeyID  string
 
-	bucketMu    sync.Mutex
-	bucketReady bool
+	requestRetries S3RetryPolicy
+
+	bucketRetries RetryPolicy
+	bucketMu      sync.Mutex
+	bucketReady   bool
+}
+
+// S3Option configures the S3 storage backend.
+type S3Option func(s *s3Storage)
+
+// WithS3Prefix stores objects under the given key prefix segments.
+func WithS3Prefix(prefix ...string) S3Option {
+	return func(s *s3Storage) {
+		for _, segment := range prefix {
+			segment = strings.Trim(segment, "/")
+			if segment != "" {
+				s.prefix = append(s.prefix, segment)
+			}
+		}
+	}
+}
+
+// WithoutHeadURL makes DownloadURLs return only the presigned GET URL,
+// skipping the extra HEAD presign for clients that never use it.
+func WithoutHeadURL() S3Option {
+	return func(s *s3Storage) {
+		s.skipHeadURL = true
+	}
+}
+
+// WithPresignExpiration sets how long presigned URLs stay valid. Raise it when large
+// objects are transferred over slow links and would otherwise time out mid-transfer.
+// Defaults to 10 minutes; values above MaxPresignExpiration are rejected.
+func WithPresignExpiration(expiration time.Duration) S3Option {
+	return func(s *s3Storage) {
+		s.presignExpiration = expiration
+	}
+}
+
+// WithServerSideEncryption stores new objects with the given server-side encryption
+// algorithm ("AES256", "aws:kms" or "aws:kms:dsse"). kmsKeyID selects the KMS key for the
+// KMS algorithms; when empty, the bucket's default KMS key is used.
+func WithServerSideEncryption(algorithm string, kmsKeyID string) S3Option {
+	return func(s *s3Storage) {
+		s.sseAlgorithm = types.ServerSideEncryption(algorithm)
+		s.sseKMSKeyID = kmsKeyID
+	}
+}
+
+// WithMaxMetadataBytes rejects uploads whose metadata exceeds limit bytes with
+// ErrMetadataTooLarge before anything is sent to S3. Defaults to DefaultS3MaxMetadataBytes;
+// raise it for S3-compatible stores with a higher limit, or pass 0 to disable the check.
+func WithMaxMetadataBytes(limit int) S3Option {
+	return func(s *s3Storage) {
+		s.maxMetadataBytes = limit
+	}
+}
+
+// DefaultBucketRetryPolicy is how checking for and creating the bucket at startup is
+// retried when S3 throttles or fails with a 5xx, which happens when a fleet of instances
+// starts at once against a fresh bucket.
+var DefaultBucketRetryPolicy = RetryPolicy{
+	Retries:   4,
+	BaseDelay: time.Second,
+}
+
+// WithBucketRetries overrides DefaultBucketRetryPolicy. Zero retries fail on the first
+// error.
+func WithBucketRetries(policy RetryPolicy) S3Option {
+	return func(s *s3Storage) {
+		s.bucketRetries = policy
+	}
+}
+
+// S3RetryPolicy configures how the S3 client retries requests that fail with throttling,
+// a 5xx or a network error. Zero fields keep the client's own setting, which the AWS SDK
+// takes from AWS_MAX_ATTEMPTS and AWS_RETRY_MODE.
+type S3RetryPolicy struct {
+	// MaxAttempts is the number of attempts per request, including the first one.
+	MaxAttempts int
+	// Mode is aws.RetryModeStandard, or aws.RetryModeAdaptive to also slow down sending
+	// requests while S3 throttles.
+	Mode aws.RetryMode
+	// MaxBackoff caps the jittered exponential backoff between attempts.
+	MaxBackoff time.Duration
+}
+
+// WithS3Retries configures the retryer of the S3 client with policy.
+func WithS3Retries(policy S3RetryPolicy) S3Option {
+	return func(s *s3Storage) {
+		s.requestRetries = policy
+	}
+}
+
+// retryer returns the retryer for policy, falling back to the settings in options.
+func (policy S3RetryPolicy) retryer(options s3.Options) (aws.Retryer, error) {
+	maxAttempts := policy.MaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = options.RetryMaxAttempts
+	}
+	standardOptions := func(o *retry.StandardOptions) {
+		if maxAttempts > 0 {
+			o.MaxAttempts = maxAttempts
+		}
+		if policy.MaxBackoff > 0 {
+			o.MaxBackoff = policy.MaxBackoff
+			o.Backoff = retry.NewExponentialJitterBackoff(policy.MaxBackoff)
+		}
+	}
+
+	mode := policy.Mode
+	if mode == "" {
+		mode = options.RetryMode
+	}
+	switch mode {
+	case "", aws.RetryModeStandard:
+		return retry.NewStandard(standardOptions), nil
+	case aws.RetryModeAdaptive:
+		return retry.NewAdaptiveMode(func(o *retry.AdaptiveModeOptions) {
+			o.StandardOptions = append(o.StandardOptions, standardOptions)
+		}), nil
+	default:
+		return nil, fmt.Errorf("storage: unsupported S3 retry mode %q, expected %q or %q",
+			mode, aws.RetryModeStandard, aws.RetryModeAdaptive)
+	}
 }
 
 func NewS3Storage(ctx context.Context, client *s3.Client, bucketName string, prefix ...string) (MultipartBlobStorageBackend, error) {
+	return NewS3StorageWithOptions(ctx, client, bucketName, WithS3Prefix(prefix...))
+}
+
+// NewS3StorageWithOptions is like NewS3Storage, but accepts arbitrary options.
+func NewS3StorageWithOptions(ctx context.Context, client *s3.Client, bucketName string, opts ...S3Option) (MultipartBlobStorageBackend, error) {
 	if client == nil {
 		return nil, fmt.Errorf("storage: s3 client must not be nil")
 	}
@@ -45,19 +186,38 @@ func NewS3Storage(ctx context.Context, client *s3.Client, bucketName string, pre
 	}
 	bucketName = strings.ToLower(bucketName)
 
-	normalizedPrefix := make([]string, 0, len(prefix))
-	for _, segment := range prefix {
-		segment = strings.Trim(segment, "/")
-		if segment != "" {
-			normalizedPrefix = append(normalizedPrefix, segment)
-		}
-	}
-
 	result := &s3Storage{
-		client:        client,
-		presignClient: s3.NewPresignClient(client),
-		bucketName:    bucketName,
-		prefix:        normalizedPrefix,
+		client:            client,
+		presignClient:     s3.NewPresignClient(client),
+		bucketName:        bucketName,
+		presignExpiration: defaultPresignExpiration,
+		maxMetadataBytes:  DefaultS3MaxMetadataBytes,
+		bucketRetries:     DefaultBucketRetryPolicy,
+	}
+	for _, opt := range opts {
+		opt(result)
+	}
+	if result.presignExpiration <= 0 || result.presignExpiration > MaxPresignExpiration {
+		return nil, fmt.Errorf("storage: presign expiration %s must be positive and at most %s",
+			result.presignExpiration, MaxPresignExpiration)
+	}
+	if err := result.validateServerSideEncryption(); err != nil {
+		return nil, err
+	}
+	if result.requestRetries != (S3RetryPolicy{}) {
+		if result.requestRetries.MaxAttempts < 0 {
+			return nil, fmt.Errorf("storage: S3 max attempts %d must not be negative", result.requestRetries.MaxAttempts)
+		}
+		retryer, err := result.requestRetries.retryer(client.Options())
+		if err != nil {
+			return nil, err
+		}
+		// The retryer replaces the one the client resolved, so that the mode applies too.
+		result.client = s3.New(client.Options(), func(o *s3.Options) {
+			o.Retryer = retryer
+			o.RetryMaxAttempts = 0
+		})
+		result.presignClient = s3.NewPresignClient(result.client)
 	}
 
 	if err := result.ensureBucketExists(ctx); err != nil {
@@ -66,6 +226,30 @@ func NewS3Storage(ctx context.Context, client *s3.Client, bucketName string, pre
 	return result, nil
 }
 
+func (s *s3Storage) validateServerSideEncryption() error {
+	if s.sseAlgorithm == "" {
+		if s.sseKMSKeyID != "" {
+			return fmt.Errorf("storage: a KMS key ID requires a server-side encryption algorithm")
+		}
+		return nil
+	}
+	if !slices.Contains(s.sseAlgorithm.Values(), s.sseAlgorithm) {
+		return fmt.Errorf("storage: unsupported server-side encryption algorithm %q", s.sseAlgorithm)
+	}
+	if s.sseKMSKeyID != "" && s.sseAlgorithm == types.ServerSideEncryptionAes256 {
+		return fmt.Errorf("storage: a KMS key ID can't be used with %s encryption", s.sseAlgorithm)
+	}
+	return nil
+}
+
+// sseKMSKeyIDInput returns the KMS key ID to pass to requests that create objects.
+func (s *s3Storage) sseKMSKeyIDInput() *string {
+	if s.sseKMSKeyID == "" {
+		return nil
+	}
+	return aws.String(s.sseKMSKeyID)
+}
+
 func (s *s3Storage) ensureBucketExists(ctx context.Context) error {
 	s.bucketMu.Lock()
 	defer s.bucketMu.Unlock()
@@ -74,9 +258,27 @@ func (s *s3Storage) ensureBucketExists(ctx context.Context) error {
 		return nil
 	}
 
+	for attempt := 0; ; attempt++ {
+		err := s.createBucketIfMissing(ctx)
+		if err == nil {
+			s.bucketReady = true
+			return nil
+		}
+		if attempt >= s.bucketRetries.Retries || ctx.Err() != nil || !retryableBucketError(err) {
+			return err
+		}
+
+		slog.WarnContext(ctx, "retrying bucket creation after transient failure",
+			"bucket", s.bucketName, "attempt", attempt+1, "err", err)
+		if err := SleepContext(ctx, s.bucketRetries.Delay(attempt)); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *s3Storage) createBucketIfMissing(ctx context.Context) error {
 	headInput := &s3.HeadBucketInput{Bucket: aws.String(s.bucketName)}
 	if _, err := s.client.HeadBucket(ctx, headInput); err == nil {
-		s.bucketReady = true
 		return nil
 	}
 
@@ -87,20 +289,38 @@ func (s *s3Storage) ensureBucketExists(ctx context.Context) error {
 		var alreadyOwned *types.BucketAlreadyOwnedByYou
 		var alreadyExists *types.BucketAlreadyExists
 
-		if errors.As(err, &alreadyOwned) || errors.As(err, &alreadyExists) {
-			s.bucketReady = true
-			return nil
+		if !errors.As(err, &alreadyOwned) && !errors.As(err, &alreadyExists) {
+			return err
 		}
-		return err
+		// Another instance created the bucket after our HEAD missed it. Like one we
+		// created, it may not be visible to every request yet.
 	}
 
 	waiter := s3.NewBucketExistsWaiter(s.client)
-	if waitErr := waiter.Wait(ctx, headInput, bucketWaitTimeout); waitErr != nil {
-		return waitErr
+	return waiter.Wait(ctx, headInput, bucketWaitTimeout)
+}
+
+// retryableBucketError reports whether checking for or creating the bucket failed in a
+// way that may succeed when retried: throttling, a 5xx, a conflicting concurrent
+// creation or a network error.
+func retryableBucketError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
 	}
 
-	s.bucketReady = true
-	return nil
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "SlowDown", "Throttling", "ThrottlingException", "RequestTimeout", "OperationAborted":
+			return true
+		}
+	}
+
+	var responseErr *smithyhttp.ResponseError
+	if errors.As(err, &responseErr) {
+		return retryableStatus(responseErr.HTTPStatusCode())
+	}
+	return true
 }
 
 func (s *s3Storage) objectKey(key string) string {
@@ -178,6 +398,10 @@ func (s *s3Storage) DownloadURLs(ctx context.Context, key string) ([]*URLInfo, e
 	}
 	urls = append(urls, getInfo)
 
+	if s.skipHeadURL {
+		return urls, nil
+	}
+
 	if headInfo, err := s.presignHead(ctx, objectKey); err == nil {
 		urls = append(urls, headInfo)
 	}
@@ -188,15 +412,9 @@ func (s *s3Storage) DownloadURLs(ctx context.Context, key string) ([]*URLInfo, e
 func (s *s3Storage) UploadURL(ctx context.Context, key string, metadata map[string]string) (*URLInfo, error) {
 	objectKey := s.objectKey(key)
 
-	var objectMetadata map[string]string
-	if len(metadata) > 0 {
-		objectMetadata = make(map[string]string, len(metadata))
-		for k, v := range metadata {
-			if k == "" {
-				continue
-			}
-			objectMetadata[strings.ToLower(k)] = v
-		}
+	objectMetadata := normalizeMetadata(metadata)
+	if err := checkMetadataSize(key, objectMetadata, s.maxMetadataBytes); err != nil {
+		return nil, err
 	}
 
 	putInput := &s3.PutObjectInput{
@@ -204,9 +422,12 @@ func (s *s3Storage) UploadURL(ctx context.Context, key string, metadata map[stri
 		Key:         aws.String(objectKey),
 		Metadata:    objectMetadata,
 		ContentType: aws.String("application/octet-stream"),
+
+		ServerSideEncryption: s.sseAlgorithm,
+		SSEKMSKeyId:          s.sseKMSKeyIDInput(),
 	}
 
-	presigned, err := s.presignClient.PresignPutObject(ctx, putInput, s3.WithPresignExpires(defaultPresignExpiration))
+	presigned, err := s.presignClient.PresignPutObject(ctx, putInput, s3.WithPresignExpires(s.presignExpiration))
 	if err != nil {
 		return nil, err
 	}
@@ -219,13 +440,15 @@ func (s *s3Storage) UploadURL(ctx context.Context, key string, metadata map[stri
 
 	// Ensure callers propagate the headers that were part of the signature.
 	info.ExtraHeaders["Content-Type"] = "application/octet-stream"
+	if s.sseAlgorithm != "" {
+		info.ExtraHeaders["X-Amz-Server-Side-Encryption"] = string(s.sseAlgorithm)
+	}
+	if s.sseKMSKeyID != "" {
+		info.ExtraHeaders["X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"] = s.sseKMSKeyID
+	}
 
-	for k, v := range metadata {
-		if k == "" {
-			continue
-		}
-		headerKey := fmt.Sprintf("x-amz-meta-%s", strings.ToLower(k))
-		info.ExtraHeaders[headerKey] = v
+	for k, v := range objectMetadata {
+		info.ExtraHeaders["x-amz-meta-"+k] = v
 	}
 
 	return info, nil
@@ -240,11 +463,42 @@ func (s *s3Storage) Delete(ctx context.Context, key string) error {
 	return err
 }
 
+func (s *s3Storage) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucketName),
+		Prefix: aws.String(s.objectKey(prefix)),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, object := range page.Contents {
+			if object.Key == nil {
+				continue
+			}
+
+			info := ObjectInfo{
+				Key:          s.trimObjectKey(aws.ToString(object.Key)),
+				SizeBytes:    aws.ToInt64(object.Size),
+				LastModified: aws.ToTime(object.LastModified),
+			}
+			if err := fn(info); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
 func (s *s3Storage) presignGet(ctx context.Context, objectKey string) (*URLInfo, error) {
 	presigned, err := s.presignClient.PresignGetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(s.bucketName),
 		Key:    aws.String(objectKey),
-	}, s3.WithPresignExpires(defaultPresignExpiration))
+	}, s3.WithPresignExpires(s.presignExpiration))
 	if err != nil {
 		return nil, err
 	}
@@ -256,7 +510,7 @@ func (s *s3Storage) presignHead(ctx context.Context, objectKey string) (*URLInfo
 	presigned, err := s.presignClient.PresignHeadObject(ctx, &s3.HeadObjectInput{
 		Bucket: aws.String(s.bucketName),
 		Key:    aws.String(objectKey),
-	}, s3.WithPresignExpires(defaultPresignExpiration))
+	}, s3.WithPresignExpires(s.presignExpiration))
 	if err != nil {
 		return nil, err
 	}
@@ -365,9 +619,10 @@ func (s *s3Storage) cacheInfoForPrefix(ctx context.Context, prefix string) (*Cac
 
 func cacheInfoFromHeadOutput(key string, headOutput *s3.HeadObjectOutput) *CacheInfo {
 	return &CacheInfo{
-		Key:       key,
-		SizeBytes: aws.ToInt64(headOutput.ContentLength),
-		Metadata:  headOutput.Metadata,
+		Key:          key,
+		SizeBytes:    aws.ToInt64(headOutput.ContentLength),
+		Metadata:     headOutput.Metadata,
+		LastModified: aws.ToTime(headOutput.LastModified),
 	}
 }
 
@@ -399,11 +654,19 @@ func isNotFoundError(err error) bool {
 func (s *s3Storage) CreateMultipartUpload(ctx context.Context, key string, metadata map[string]string) (string, error) {
 	objectKey := s.objectKey(key)
 
+	objectMetadata := normalizeMetadata(metadata)
+	if err := checkMetadataSize(key, objectMetadata, s.maxMetadataBytes); err != nil {
+		return "", err
+	}
+
 	createInput := &s3.CreateMultipartUploadInput{
 		Bucket:      aws.String(s.bucketName),
 		Key:         aws.String(objectKey),
-		Metadata:    metadata,
+		Metadata:    objectMetadata,
 		ContentType: aws.String("application/octet-stream"),
+
+		ServerSideEncryption: s.sseAlgorithm,
+		SSEKMSKeyId:          s.sseKMSKeyIDInput(),
 	}
 
 	result, err := s.client.CreateMultipartUpload(ctx, createInput)
@@ -425,7 +688,7 @@ func (s *s3Storage) UploadPartURL(ctx context.Context, key string, uploadID stri
 		ContentLength: aws.Int64(int64(contentLength)),
 	}
 
-	presigned, err := s.presignClient.PresignUploadPart(ctx, uploadPartInput, s3.WithPresignExpires(defaultPresignExpiration))
+	presigned, err := s.presignClient.PresignUploadPart(ctx, uploadPartInput, s3.WithPresignExpires(s.presignExpiration))
 	if err != nil {
 		return nil, err
 	}
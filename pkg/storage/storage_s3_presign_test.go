@@ -0,0 +1,291 @@
+package storage
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/require"
+)
+
+func newPresignOnlyS3Client() *s3.Client {
+	return s3.New(s3.Options{
+		Region:       "us-east-1",
+		Credentials:  credentials.NewStaticCredentialsProvider("id", "secret", ""),
+		BaseEndpoint: aws.String("http://127.0.0.1:1"),
+		UsePathStyle: true,
+	})
+}
+
+func presignedExpires(t *testing.T, info *URLInfo) string {
+	t.Helper()
+
+	parsed, err := url.Parse(info.URL)
+	require.NoError(t, err)
+	return parsed.Query().Get("X-Amz-Expires")
+}
+
+func TestS3PresignExpirationIsApplied(t *testing.T) {
+	ctx := context.Background()
+	client := newPresignOnlyS3Client()
+	backend := &s3Storage{
+		client:            client,
+		presignClient:     s3.NewPresignClient(client),
+		bucketName:        "bucket",
+		presignExpiration: 6 * time.Hour,
+	}
+
+	getURL, err := backend.presignGet(ctx, "key")
+	require.NoError(t, err)
+	require.Equal(t, "21600", presignedExpires(t, getURL))
+
+	headURL, err := backend.presignHead(ctx, "key")
+	require.NoError(t, err)
+	require.Equal(t, "21600", presignedExpires(t, headURL))
+
+	uploadURL, err := backend.UploadURL(ctx, "key", nil)
+	require.NoError(t, err)
+	require.Equal(t, "21600", presignedExpires(t, uploadURL))
+
+	partURL, err := backend.UploadPartURL(ctx, "key", "upload-id", 1, 1024)
+	require.NoError(t, err)
+	require.Equal(t, "21600", presignedExpires(t, partURL))
+}
+
+func TestS3PresignExpirationValidation(t *testing.T) {
+	client := newPresignOnlyS3Client()
+
+	for _, expiration := range []time.Duration{-time.Minute, 0, MaxPresignExpiration + time.Second} {
+		_, err := NewS3StorageWithOptions(context.Background(), client, "bucket", WithPresignExpiration(expiration))
+		require.ErrorContains(t, err, "presign expiration", expiration.String())
+	}
+}
+
+func TestS3ServerSideEncryptionHeaders(t *testing.T) {
+	ctx := context.Background()
+	client := newPresignOnlyS3Client()
+	backend := &s3Storage{
+		client:            client,
+		presignClient:     s3.NewPresignClient(client),
+		bucketName:        "bucket",
+		presignExpiration: time.Hour,
+		sseAlgorithm:      "aws:kms",
+		sseKMSKeyID:       "arn:aws:kms:us-east-1:123456789012:key/cache",
+	}
+
+	uploadURL, err := backend.UploadURL(ctx, "key", nil)
+	require.NoError(t, err)
+	require.Equal(t, "aws:kms", uploadURL.ExtraHeaders["X-Amz-Server-Side-Encryption"])
+	require.Equal(t, "arn:aws:kms:us-east-1:123456789012:key/cache",
+		uploadURL.ExtraHeaders["X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"])
+
+	parsed, err := url.Parse(uploadURL.URL)
+	require.NoError(t, err)
+	require.Contains(t, parsed.Query().Get("X-Amz-SignedHeaders"), "x-amz-server-side-encryption")
+	require.Len(t, uploadURL.ExtraHeaders, 3)
+}
+
+func TestS3ServerSideEncryptionValidation(t *testing.T) {
+	client := newPresignOnlyS3Client()
+
+	for _, opt := range []S3Option{
+		WithServerSideEncryption("aws:unknown", ""),
+		WithServerSideEncryption("AES256", "key-id"),
+		WithServerSideEncryption("", "key-id"),
+	} {
+		_, err := NewS3StorageWithOptions(context.Background(), client, "bucket", opt)
+		require.ErrorContains(t, err, "storage:")
+	}
+}
+
+func TestS3MetadataSizeLimit(t *testing.T) {
+	ctx := context.Background()
+	client := newPresignOnlyS3Client()
+	backend := &s3Storage{
+		client:            client,
+		presignClient:     s3.NewPresignClient(client),
+		bucketName:        "bucket",
+		presignExpiration: time.Hour,
+		maxMetadataBytes:  DefaultS3MaxMetadataBytes,
+	}
+
+	fits := map[string]string{"Filename": strings.Repeat("a", DefaultS3MaxMetadataBytes-len("filename"))}
+	uploadURL, err := backend.UploadURL(ctx, "key", fits)
+	require.NoError(t, err)
+	require.Equal(t, fits["Filename"], uploadURL.ExtraHeaders["x-amz-meta-filename"])
+
+	tooLarge := map[string]string{"filename": fits["Filename"], ExpiresAtMetadataKey: "1700000000"}
+	_, err = backend.UploadURL(ctx, "key", tooLarge)
+	require.ErrorIs(t, err, ErrMetadataTooLarge)
+	_, err = backend.CreateMultipartUpload(ctx, "key", tooLarge)
+	require.ErrorIs(t, err, ErrMetadataTooLarge)
+
+	backend.maxMetadataBytes = 0
+	_, err = backend.UploadURL(ctx, "key", tooLarge)
+	require.NoError(t, err)
+}
+
+func TestS3EnsureBucketExistsRetriesThrottling(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		creates   int
+		bucketSet bool
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch r.Method {
+		case http.MethodHead:
+			if !bucketSet {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case http.MethodPut:
+			creates++
+			if creates <= 2 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				_, _ = w.Write([]byte(`<Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>`))
+				return
+			}
+			bucketSet = true
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	client := s3.New(s3.Options{
+		Region:           "us-east-1",
+		Credentials:      credentials.NewStaticCredentialsProvider("id", "secret", ""),
+		BaseEndpoint:     aws.String(server.URL),
+		UsePathStyle:     true,
+		RetryMaxAttempts: 1,
+	})
+
+	_, err := NewS3StorageWithOptions(context.Background(), client, "bucket",
+		WithBucketRetries(RetryPolicy{Retries: 1}))
+	require.Error(t, err)
+
+	_, err = NewS3StorageWithOptions(context.Background(), client, "bucket",
+		WithBucketRetries(RetryPolicy{Retries: 3}))
+	require.NoError(t, err)
+	require.Equal(t, 3, creates)
+}
+
+// newThrottlingS3Server serves an existing bucket whose objects answer the first throttles
+// HEAD requests with 503 SlowDown and then exist. It returns the number of object HEADs.
+func newThrottlingS3Server(t *testing.T, throttles int) (*httptest.Server, func() int) {
+	t.Helper()
+
+	var (
+		mu    sync.Mutex
+		heads int
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.Method != http.MethodHead || r.URL.Path == "/bucket" {
+			return
+		}
+		heads++
+		if heads <= throttles {
+			w.Header().Set("x-amz-error-code", "SlowDown")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Length", "5")
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return heads
+	}
+}
+
+func newSingleAttemptS3Client(endpoint string) *s3.Client {
+	return s3.New(s3.Options{
+		Region:           "us-east-1",
+		Credentials:      credentials.NewStaticCredentialsProvider("id", "secret", ""),
+		BaseEndpoint:     aws.String(endpoint),
+		UsePathStyle:     true,
+		RetryMaxAttempts: 1,
+	})
+}
+
+func TestS3RetriesAreApplied(t *testing.T) {
+	ctx := context.Background()
+
+	server, heads := newThrottlingS3Server(t, 2)
+	backend, err := NewS3StorageWithOptions(ctx, newSingleAttemptS3Client(server.URL), "bucket")
+	require.NoError(t, err)
+	_, err = backend.CacheInfo(ctx, "key", nil)
+	require.Error(t, err)
+	require.Equal(t, 1, heads())
+
+	for _, mode := range []aws.RetryMode{aws.RetryModeStandard, aws.RetryModeAdaptive} {
+		t.Run(string(mode), func(t *testing.T) {
+			server, heads := newThrottlingS3Server(t, 2)
+			backend, err := NewS3StorageWithOptions(ctx, newSingleAttemptS3Client(server.URL), "bucket",
+				WithS3Retries(S3RetryPolicy{MaxAttempts: 3, Mode: mode, MaxBackoff: time.Millisecond}))
+			require.NoError(t, err)
+
+			info, err := backend.CacheInfo(ctx, "key", nil)
+			require.NoError(t, err)
+			require.EqualValues(t, 5, info.SizeBytes)
+			require.Equal(t, 3, heads())
+		})
+	}
+}
+
+func TestS3RetriesValidation(t *testing.T) {
+	client := newPresignOnlyS3Client()
+
+	_, err := NewS3StorageWithOptions(context.Background(), client, "bucket",
+		WithS3Retries(S3RetryPolicy{Mode: "eager"}))
+	require.ErrorContains(t, err, "unsupported S3 retry mode")
+
+	_, err = NewS3StorageWithOptions(context.Background(), client, "bucket",
+		WithS3Retries(S3RetryPolicy{MaxAttempts: -1}))
+	require.ErrorContains(t, err, "must not be negative")
+}
+
+func TestS3EnsureBucketExistsWaitsForConcurrentlyCreatedBucket(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		heads     int
+		bucketSet bool
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch r.Method {
+		case http.MethodHead:
+			heads++
+			if !bucketSet {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case http.MethodPut:
+			// Another instance won the race, and the bucket only becomes visible now.
+			bucketSet = true
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte(`<Error><Code>BucketAlreadyOwnedByYou</Code><Message>Your previous request to create the named bucket succeeded.</Message></Error>`))
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	_, err := NewS3StorageWithOptions(context.Background(), newSingleAttemptS3Client(server.URL), "bucket",
+		WithBucketRetries(RetryPolicy{}))
+	require.NoError(t, err)
+	require.Equal(t, 2, heads, "the bucket should be checked again after the creation conflict")
+}
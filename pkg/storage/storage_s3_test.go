@@ -3,10 +3,12 @@ package storage_test
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
 	"net/http"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/cirruslabs/omni-cache/internal/testutil"
 	"github.com/cirruslabs/omni-cache/pkg/storage"
@@ -237,6 +239,76 @@ func TestDelete(t *testing.T) {
 	require.NoError(t, deletableStorage.Delete(ctx, key))
 }
 
+func TestList(t *testing.T) {
+	ctx := context.Background()
+	stor := testutil.NewMultipartStorage(t)
+
+	listableStorage, ok := stor.(storage.ListableBlobStorageBackend)
+	require.True(t, ok)
+
+	prefix := "list/" + uuid.NewString() + "/"
+	payloads := map[string][]byte{
+		prefix + "a": []byte("first"),
+		prefix + "b": []byte("second object"),
+	}
+	for key, payload := range payloads {
+		uploadURL, err := stor.UploadURL(ctx, key, nil)
+		require.NoError(t, err)
+		uploadObject(t, uploadURL, payload)
+	}
+
+	listed := map[string]int64{}
+	err := listableStorage.List(ctx, prefix, func(info storage.ObjectInfo) error {
+		listed[info.Key] = info.SizeBytes
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]int64{
+		prefix + "a": int64(len(payloads[prefix+"a"])),
+		prefix + "b": int64(len(payloads[prefix+"b"])),
+	}, listed)
+}
+
+func TestDownloadURLsWithoutHeadURL(t *testing.T) {
+	ctx := context.Background()
+	client := testutil.S3Client(t)
+
+	bucketName := "omni-cache-test-" + strings.ReplaceAll(uuid.NewString(), "-", "")
+	stor, err := storage.NewS3StorageWithOptions(ctx, client, bucketName, storage.WithoutHeadURL())
+	require.NoError(t, err)
+
+	key := "no-head/" + uuid.NewString()
+	uploadURL, err := stor.UploadURL(ctx, key, nil)
+	require.NoError(t, err)
+	uploadObject(t, uploadURL, []byte("payload"))
+
+	urls, err := stor.DownloadURLs(ctx, key)
+	require.NoError(t, err)
+	require.Len(t, urls, 1)
+}
+
+func TestCacheTTL(t *testing.T) {
+	ctx := context.Background()
+	stor := storage.NewExpiringStorage(testutil.NewMultipartStorage(t), 3*time.Second)
+
+	key := "cache-ttl/" + uuid.NewString()
+	uploadURL, err := stor.UploadURL(ctx, key, nil)
+	require.NoError(t, err)
+	uploadObject(t, uploadURL, []byte("short-lived"))
+
+	info, err := stor.CacheInfo(ctx, key, nil)
+	require.NoError(t, err)
+	require.False(t, info.Expiry.IsZero())
+
+	require.Eventually(t, func() bool {
+		_, err := stor.CacheInfo(ctx, key, nil)
+		return errors.Is(err, storage.ErrCacheNotFound)
+	}, 10*time.Second, 100*time.Millisecond)
+
+	_, err = stor.DownloadURLs(ctx, key)
+	require.ErrorIs(t, err, storage.ErrCacheNotFound)
+}
+
 func uploadPart(t *testing.T, urlInfo *storage.URLInfo, data []byte) string {
 	t.Helper()
 
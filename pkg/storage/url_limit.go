@@ -0,0 +1,34 @@
+package storage
+
+import "context"
+
+type urlLimitStorage struct {
+	MultipartBlobStorageBackend
+
+	maxURLs int
+}
+
+// NewURLLimitStorage wraps backend so that DownloadURLs returns at most maxURLs candidates.
+// Because backends order candidates best-first, truncation keeps the preferred URLs and only
+// bounds how long a protocol spends failing over. A non-positive maxURLs disables the limit.
+func NewURLLimitStorage(backend MultipartBlobStorageBackend, maxURLs int) MultipartBlobStorageBackend {
+	if maxURLs <= 0 {
+		return backend
+	}
+
+	return WithCapabilities(&urlLimitStorage{
+		MultipartBlobStorageBackend: backend,
+		maxURLs:                     maxURLs,
+	}, CapabilitiesOf(backend))
+}
+
+func (s *urlLimitStorage) DownloadURLs(ctx context.Context, key string) ([]*URLInfo, error) {
+	urls, err := s.MultipartBlobStorageBackend.DownloadURLs(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(urls) > s.maxURLs {
+		urls = urls[:s.maxURLs]
+	}
+	return urls, nil
+}
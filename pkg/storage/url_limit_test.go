@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type manyURLsBackend struct {
+	MultipartBlobStorageBackend
+}
+
+func (b *manyURLsBackend) DownloadURLs(context.Context, string) ([]*URLInfo, error) {
+	return []*URLInfo{
+		{URL: "http://primary.example.com/object"},
+		{URL: "http://mirror-1.example.com/object"},
+		{URL: "http://mirror-2.example.com/object"},
+	}, nil
+}
+
+func TestURLLimitStorageKeepsBestCandidates(t *testing.T) {
+	backend := NewURLLimitStorage(&manyURLsBackend{}, 2)
+
+	urls, err := backend.DownloadURLs(context.Background(), "key")
+	require.NoError(t, err)
+	require.Len(t, urls, 2)
+	require.Equal(t, "http://primary.example.com/object", urls[0].URL)
+	require.Equal(t, "http://mirror-1.example.com/object", urls[1].URL)
+}
+
+func TestURLLimitStorageDisabled(t *testing.T) {
+	inner := &manyURLsBackend{}
+	require.Same(t, MultipartBlobStorageBackend(inner), NewURLLimitStorage(inner, 0))
+}
@@ -0,0 +1,289 @@
+package urlproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+)
+
+const coalescedReadBufferSize = 32 * 1024
+
+// downloadCoalescer shares one upstream HTTP download between concurrent requests
+// for the same object. The leader spools the body to a temporary file and every
+// participant, including ones that join mid-transfer, streams it from there. The
+// leader's proxy fetches the body, so its slow download policy applies to the
+// shared download.
+type downloadCoalescer struct {
+	spoolDir string
+
+	mu       sync.Mutex
+	inflight map[string]*sharedDownload
+}
+
+type sharedDownload struct {
+	mu      sync.Mutex
+	changed *sync.Cond
+
+	spool   *os.File
+	status  int
+	written int64
+	done    bool
+	err     error
+	readers int
+	cancel  context.CancelFunc
+}
+
+type upstreamStatusError struct {
+	statusCode int
+}
+
+func (err upstreamStatusError) Error() string {
+	return fmt.Sprintf("download returned non-successful status %d", err.statusCode)
+}
+
+func newDownloadCoalescer(spoolDir string) *downloadCoalescer {
+	return &downloadCoalescer{
+		spoolDir: spoolDir,
+		inflight: map[string]*sharedDownload{},
+	}
+}
+
+// coalesceKey identifies the object behind a download URL. Presigned URLs for the
+// same object differ only in their query, so it is dropped. URLs that need extra
+// headers are never shared since the headers may change the response.
+func coalesceKey(info *storage.URLInfo) (string, bool) {
+	if len(info.ExtraHeaders) > 0 {
+		return "", false
+	}
+
+	parsed, err := url.Parse(info.URL)
+	if err != nil || parsed.Host == "" {
+		return "", false
+	}
+	parsed.RawQuery = ""
+	parsed.Fragment = ""
+
+	return parsed.String(), true
+}
+
+// copyShared streams the object behind info into the writer returned by start, sharing
+// the upstream request with concurrent callers for the same key. When no request for it
+// is in flight, p fetches it. start is only called once the upstream has answered with a
+// successful status.
+func (c *downloadCoalescer) copyShared(
+	ctx context.Context,
+	p *Proxy,
+	info *storage.URLInfo,
+	key string,
+	start func(status int) io.Writer,
+) (int64, error) {
+	download, err := c.join(ctx, p, info, key)
+	if err != nil {
+		return 0, err
+	}
+	defer download.leave()
+
+	stop := context.AfterFunc(ctx, download.wake)
+	defer stop()
+
+	status, err := download.waitStatus(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return download.copyTo(ctx, start(status))
+}
+
+func (c *downloadCoalescer) join(ctx context.Context, p *Proxy, info *storage.URLInfo, key string) (*sharedDownload, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if download, ok := c.inflight[key]; ok {
+		download.mu.Lock()
+		// A download whose readers all left is being cancelled; start a fresh one.
+		if download.readers > 0 {
+			download.readers++
+			download.mu.Unlock()
+			return download, nil
+		}
+		download.mu.Unlock()
+	}
+
+	spool, err := os.CreateTemp(c.spoolDir, "omni-cache-download-*")
+	if err != nil {
+		return nil, err
+	}
+
+	fetchCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	download := &sharedDownload{
+		spool:   spool,
+		readers: 1,
+		cancel:  cancel,
+	}
+	download.changed = sync.NewCond(&download.mu)
+	c.inflight[key] = download
+
+	go c.fetch(fetchCtx, p, info, key, download)
+
+	return download, nil
+}
+
+func (c *downloadCoalescer) fetch(ctx context.Context, p *Proxy, info *storage.URLInfo, key string, download *sharedDownload) {
+	defer download.cancel()
+
+	err := func() error {
+		reqCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, info.URL, nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := p.httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		download.setStatus(resp.StatusCode)
+		if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+			return upstreamStatusError{statusCode: resp.StatusCode}
+		}
+
+		_, err = p.copyHTTPBody(ctx, info, resp, cancel, download)
+		return err
+	}()
+
+	// Stop handing this download to new requests before publishing the result, so
+	// late arrivals after completion start their own transfer.
+	c.mu.Lock()
+	if c.inflight[key] == download {
+		delete(c.inflight, key)
+	}
+	c.mu.Unlock()
+
+	download.finish(err)
+}
+
+// Write appends upstream bytes to the spool. Only the fetching goroutine writes.
+func (d *sharedDownload) Write(p []byte) (int, error) {
+	n, err := d.spool.Write(p)
+
+	d.mu.Lock()
+	d.written += int64(n)
+	d.changed.Broadcast()
+	d.mu.Unlock()
+
+	return n, err
+}
+
+func (d *sharedDownload) setStatus(status int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.status = status
+	d.changed.Broadcast()
+}
+
+func (d *sharedDownload) finish(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.done = true
+	d.err = err
+	d.changed.Broadcast()
+	if d.readers == 0 {
+		d.closeSpool()
+	}
+}
+
+func (d *sharedDownload) wake() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.changed.Broadcast()
+}
+
+func (d *sharedDownload) leave() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.readers--
+	if d.readers > 0 {
+		return
+	}
+	if d.done {
+		d.closeSpool()
+	} else {
+		// Nobody is waiting for the bytes anymore; finish closes the spool.
+		d.cancel()
+	}
+}
+
+func (d *sharedDownload) closeSpool() {
+	_ = d.spool.Close()
+	_ = os.Remove(d.spool.Name())
+}
+
+func (d *sharedDownload) waitStatus(ctx context.Context) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for d.status == 0 && !d.done && ctx.Err() == nil {
+		d.changed.Wait()
+	}
+
+	switch {
+	case ctx.Err() != nil:
+		return 0, ctx.Err()
+	case d.status == 0:
+		return 0, d.err
+	case d.status < http.StatusOK || d.status >= http.StatusMultipleChoices:
+		return 0, upstreamStatusError{statusCode: d.status}
+	default:
+		return d.status, nil
+	}
+}
+
+func (d *sharedDownload) copyTo(ctx context.Context, w io.Writer) (int64, error) {
+	buf := make([]byte, coalescedReadBufferSize)
+	var offset int64
+
+	for {
+		d.mu.Lock()
+		for offset >= d.written && !d.done && ctx.Err() == nil {
+			d.changed.Wait()
+		}
+		available, done, err := d.written, d.done, d.err
+		d.mu.Unlock()
+
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return offset, ctxErr
+		}
+		if offset >= available && done {
+			return offset, err
+		}
+
+		for offset < available {
+			chunk := buf[:min(int64(len(buf)), available-offset)]
+			n, err := d.spool.ReadAt(chunk, offset)
+			if n > 0 {
+				if _, err := w.Write(chunk[:n]); err != nil {
+					return offset, err
+				}
+				offset += int64(n)
+			}
+			if err != nil && !(errors.Is(err, io.EOF) && n == len(chunk)) {
+				return offset, err
+			}
+		}
+	}
+}
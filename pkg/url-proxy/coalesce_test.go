@@ -0,0 +1,98 @@
+package urlproxy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadCoalescingSharesUpstreamRequest(t *testing.T) {
+	const clients = 5
+	payload := bytes.Repeat([]byte("0123456789"), 10_000)
+
+	var upstreamRequests atomic.Int32
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequests.Add(1)
+		_, _ = w.Write(payload[:len(payload)/2])
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = w.Write(payload[len(payload)/2:])
+	}))
+	t.Cleanup(upstream.Close)
+
+	proxy := NewProxy(WithDownloadCoalescing(t.TempDir()))
+	key, ok := coalesceKey(&storage.URLInfo{URL: upstream.URL + "/object"})
+	require.True(t, ok)
+
+	var wg sync.WaitGroup
+	results := make([]bytes.Buffer, clients)
+	errs := make([]error, clients)
+	for i := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Each client gets a differently signed URL for the same object.
+			info := &storage.URLInfo{URL: upstream.URL + "/object?signature=" + string(rune('a'+i))}
+			errs[i] = proxy.DownloadToWriter(context.Background(), info, "", &results[i])
+		}()
+	}
+
+	require.Eventually(t, func() bool {
+		proxy.coalescer.mu.Lock()
+		defer proxy.coalescer.mu.Unlock()
+		download, ok := proxy.coalescer.inflight[key]
+		if !ok {
+			return false
+		}
+		download.mu.Lock()
+		defer download.mu.Unlock()
+		return download.readers == clients
+	}, 5*time.Second, 10*time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	require.EqualValues(t, 1, upstreamRequests.Load())
+	for i := range clients {
+		require.NoError(t, errs[i])
+		require.Equal(t, payload, results[i].Bytes())
+	}
+
+	// Once finished, the next request starts a fresh download.
+	var again bytes.Buffer
+	require.NoError(t, proxy.DownloadToWriter(context.Background(), &storage.URLInfo{URL: upstream.URL + "/object"}, "", &again))
+	require.Equal(t, payload, again.Bytes())
+	require.EqualValues(t, 2, upstreamRequests.Load())
+}
+
+func TestDownloadCoalescingProxiesUpstreamErrors(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	t.Cleanup(upstream.Close)
+
+	proxy := NewProxy(WithDownloadCoalescing(t.TempDir()))
+
+	recorder := httptest.NewRecorder()
+	require.False(t, proxy.ProxyDownloadFromURL(context.Background(), recorder, &storage.URLInfo{URL: upstream.URL + "/missing"}, ""))
+
+	var buffer bytes.Buffer
+	err := proxy.DownloadToWriter(context.Background(), &storage.URLInfo{URL: upstream.URL + "/missing"}, "", &buffer)
+	require.ErrorContains(t, err, "non-successful status 404")
+}
+
+func TestCoalesceKeySkipsExtraHeaders(t *testing.T) {
+	_, ok := coalesceKey(&storage.URLInfo{
+		URL:          "https://example.com/object",
+		ExtraHeaders: map[string]string{"Range": "bytes=0-10"},
+	})
+	require.False(t, ok)
+}
@@ -0,0 +1,86 @@
+package urlproxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	backend, err := storage.NewFilesystemStorage(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = backend.Close()
+	})
+
+	proxy := NewProxy(WithCompression(CompressionZstd))
+
+	for name, size := range map[string]int{"buffered": 64 * 1024, "spooled": uploadRetryBufferLimit + 1} {
+		t.Run(name, func(t *testing.T) {
+			payload := bytes.Repeat([]byte("go build cache object "), size/22+1)[:size]
+			key := "compressed/" + name
+
+			uploadURL, err := backend.UploadURL(ctx, key, nil)
+			require.NoError(t, err)
+			require.NoError(t, proxy.UploadFromReader(ctx, uploadURL, key, bytes.NewReader(payload), int64(len(payload))))
+
+			// The stored object is compressed and keeps its content encoding.
+			urls, err := backend.DownloadURLs(ctx, key)
+			require.NoError(t, err)
+			resp, err := http.Get(urls[0].URL)
+			require.NoError(t, err)
+			stored, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.NoError(t, resp.Body.Close())
+			require.Equal(t, CompressionZstd, resp.Header.Get("Content-Encoding"))
+			require.Less(t, len(stored), len(payload)/10)
+
+			// Downloads are decompressed, with or without compression or coalescing enabled.
+			for _, downloader := range []*Proxy{proxy, NewProxy(), NewProxy(WithDownloadCoalescing(t.TempDir()))} {
+				var body bytes.Buffer
+				require.NoError(t, downloader.DownloadToWriter(ctx, urls[0], key, &body))
+				require.Equal(t, payload, body.Bytes())
+
+				recorder := httptest.NewRecorder()
+				require.True(t, downloader.ProxyDownloadFromURL(ctx, recorder, urls[0], key))
+				require.Equal(t, payload, recorder.Body.Bytes())
+			}
+		})
+	}
+}
+
+func TestUncompressedUploadClearsContentEncoding(t *testing.T) {
+	ctx := context.Background()
+	backend, err := storage.NewFilesystemStorage(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = backend.Close()
+	})
+
+	upload := func(proxy *Proxy, payload []byte) {
+		uploadURL, err := backend.UploadURL(ctx, "key", nil)
+		require.NoError(t, err)
+		require.NoError(t, proxy.UploadFromReader(ctx, uploadURL, "key", bytes.NewReader(payload), int64(len(payload))))
+	}
+	upload(NewProxy(WithCompression(CompressionZstd)), []byte("compressed"))
+	upload(NewProxy(), []byte("plain"))
+
+	urls, err := backend.DownloadURLs(ctx, "key")
+	require.NoError(t, err)
+	var body bytes.Buffer
+	require.NoError(t, NewProxy().DownloadToWriter(ctx, urls[0], "key", &body))
+	require.Equal(t, "plain", body.String())
+}
+
+func TestValidateCompression(t *testing.T) {
+	require.NoError(t, ValidateCompression(""))
+	require.NoError(t, ValidateCompression(CompressionZstd))
+	require.Error(t, ValidateCompression("gzip"))
+}
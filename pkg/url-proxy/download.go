@@ -2,13 +2,15 @@ package urlproxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
 	"net/http"
+	"strconv"
 	"time"
 
-	"github.com/cirruslabs/omni-cache/pkg/stats"
 	"github.com/cirruslabs/omni-cache/pkg/storage"
 	bytestream "google.golang.org/genproto/googleapis/bytestream"
 )
@@ -29,7 +31,14 @@ func (p *Proxy) ProxyDownloadFromURL(ctx context.Context, w http.ResponseWriter,
 }
 
 func (p *Proxy) proxyHTTPDownload(ctx context.Context, w http.ResponseWriter, info *storage.URLInfo) bool {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, info.URL, nil)
+	if key, ok := p.coalesceKey(info); ok {
+		return p.proxyCoalescedHTTPDownload(ctx, w, info, key)
+	}
+
+	reqCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, info.URL, nil)
 	if err != nil {
 		slog.ErrorContext(ctx, "failed to create cache proxy request", "url", info.URL, "err", err)
 		return false
@@ -48,26 +57,82 @@ func (p *Proxy) proxyHTTPDownload(ctx context.Context, w http.ResponseWriter, in
 		slog.ErrorContext(ctx, "proxy cache request returned non-successful status", "url", info.URL, "statusCode", resp.StatusCode)
 		return false
 	}
+	if resp.StatusCode == http.StatusPartialContent && isZstdEncoded(resp) {
+		// A range of the compressed bytes means nothing to the client, so it gets the
+		// whole decoded object instead, which a server may always answer a range with.
+		slog.InfoContext(ctx, "proxy cache request returned a range of a compressed object, downloading all of it", "url", info.URL)
+		resp.Body.Close()
+		return p.proxyHTTPDownload(ctx, w, withoutRangeHeaders(info))
+	}
+	copyRangeHeaders(w, resp)
 	w.WriteHeader(resp.StatusCode)
 	startedAt := time.Now()
-	bytesRead, err := io.Copy(w, resp.Body)
+	bytesRead, err := p.copyHTTPBody(ctx, info, resp, cancel, NewFlushingResponseWriter(w, p.flushPolicy))
 	if err != nil {
 		slog.ErrorContext(ctx, "proxy cache download failed", "url", info.URL, "err", err)
 		return false
 	}
 
-	stats.Default().RecordDownload(bytesRead, time.Since(startedAt))
+	p.stats.RecordDownload(bytesRead, time.Since(startedAt))
 	slog.InfoContext(ctx, "proxy cache succeeded", "url", info.URL, "bytesProxied", bytesRead)
 	return true
 }
 
+// copyRangeHeaders passes the headers describing a ranged response on to the client. Range
+// requests are made by adding Range to URLInfo.ExtraHeaders. Compressed objects are served
+// decoded, so their ranges don't apply to what the client receives and none are passed on.
+func copyRangeHeaders(w http.ResponseWriter, resp *http.Response) {
+	if isZstdEncoded(resp) {
+		return
+	}
+	for _, name := range []string{"Accept-Ranges", "Content-Range"} {
+		if value := resp.Header.Get(name); value != "" {
+			w.Header().Set(name, value)
+		}
+	}
+	if resp.StatusCode == http.StatusPartialContent && resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+}
+
+// withoutRangeHeaders returns info without the Range and If-Range headers of a range request.
+func withoutRangeHeaders(info *storage.URLInfo) *storage.URLInfo {
+	whole := *info
+	whole.ExtraHeaders = maps.Clone(info.ExtraHeaders)
+	delete(whole.ExtraHeaders, "Range")
+	delete(whole.ExtraHeaders, "If-Range")
+	return &whole
+}
+
+func (p *Proxy) proxyCoalescedHTTPDownload(ctx context.Context, w http.ResponseWriter, info *storage.URLInfo, key string) bool {
+	var startedAt time.Time
+	bytesRead, err := p.coalescer.copyShared(ctx, p, info, key, func(status int) io.Writer {
+		w.WriteHeader(status)
+		startedAt = time.Now()
+		return NewFlushingResponseWriter(w, p.flushPolicy)
+	})
+	if err != nil {
+		var statusErr upstreamStatusError
+		if errors.As(err, &statusErr) {
+			slog.ErrorContext(ctx, "proxy cache request returned non-successful status", "url", info.URL, "statusCode", statusErr.statusCode)
+		} else {
+			slog.ErrorContext(ctx, "proxy cache download failed", "url", info.URL, "err", err)
+		}
+		return false
+	}
+
+	p.stats.RecordDownload(bytesRead, time.Since(startedAt))
+	slog.InfoContext(ctx, "proxy cache succeeded", "url", info.URL, "bytesProxied", bytesRead, "coalesced", true)
+	return true
+}
+
 func (p *Proxy) proxyGRPCDownload(ctx context.Context, w http.ResponseWriter, info *storage.URLInfo, resourceName string) bool {
-	client, closer, err := newByteStreamClientFromURL(ctx, info, p.grpcDialOptions...)
+	client, release, err := p.byteStreamClient(ctx, info)
 	if err != nil {
 		slog.ErrorContext(ctx, "failed to dial bytestream download", "url", info.URL, "err", err)
 		return false
 	}
-	defer closer.Close()
+	defer release()
 
 	if resourceName == "" {
 		slog.ErrorContext(ctx, "bytestream download requires non-empty resource name", "url", info.URL)
@@ -82,6 +147,7 @@ func (p *Proxy) proxyGRPCDownload(ctx context.Context, w http.ResponseWriter, in
 		return false
 	}
 
+	w = NewFlushingResponseWriter(w, p.flushPolicy)
 	startedAt := time.Now()
 	var bytesRead int64
 	for {
@@ -107,7 +173,7 @@ func (p *Proxy) proxyGRPCDownload(ctx context.Context, w http.ResponseWriter, in
 	}
 
 	if bytesRead > 0 {
-		stats.Default().RecordDownload(bytesRead, time.Since(startedAt))
+		p.stats.RecordDownload(bytesRead, time.Since(startedAt))
 	}
 	slog.InfoContext(ctx, "proxy cache gRPC download succeeded", "url", info.URL, "bytesProxied", bytesRead)
 	return bytesRead > 0
@@ -131,7 +197,22 @@ func (p *Proxy) DownloadToWriter(ctx context.Context, info *storage.URLInfo, res
 }
 
 func (p *Proxy) downloadHTTPToWriter(ctx context.Context, info *storage.URLInfo, w io.Writer) error {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, info.URL, nil)
+	if key, ok := p.coalesceKey(info); ok {
+		var startedAt time.Time
+		bytesRead, err := p.coalescer.copyShared(ctx, p, info, key, func(int) io.Writer {
+			startedAt = time.Now()
+			return w
+		})
+		if err == nil {
+			p.stats.RecordDownload(bytesRead, time.Since(startedAt))
+		}
+		return err
+	}
+
+	reqCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, info.URL, nil)
 	if err != nil {
 		return err
 	}
@@ -150,23 +231,31 @@ func (p *Proxy) downloadHTTPToWriter(ctx context.Context, info *storage.URLInfo,
 	}
 
 	startedAt := time.Now()
-	bytesRead, err := io.Copy(w, resp.Body)
+	bytesRead, err := p.copyHTTPBody(ctx, info, resp, cancel, w)
 	if err == nil {
-		stats.Default().RecordDownload(bytesRead, time.Since(startedAt))
+		p.stats.RecordDownload(bytesRead, time.Since(startedAt))
 	}
 	return err
 }
 
+// coalesceKey reports whether info should go through the download coalescer.
+func (p *Proxy) coalesceKey(info *storage.URLInfo) (string, bool) {
+	if p.coalescer == nil {
+		return "", false
+	}
+	return coalesceKey(info)
+}
+
 func (p *Proxy) downloadGRPCToWriter(ctx context.Context, info *storage.URLInfo, resourceName string, w io.Writer) error {
 	if resourceName == "" {
 		return fmt.Errorf("bytestream download requires non-empty resource name")
 	}
 
-	client, closer, err := newByteStreamClientFromURL(ctx, info, p.grpcDialOptions...)
+	client, release, err := p.byteStreamClient(ctx, info)
 	if err != nil {
 		return err
 	}
-	defer closer.Close()
+	defer release()
 
 	stream, err := client.Read(ctx, &bytestream.ReadRequest{
 		ResourceName: resourceName,
@@ -196,6 +285,6 @@ func (p *Proxy) downloadGRPCToWriter(ctx context.Context, info *storage.URLInfo,
 		bytesRead += int64(len(msg.GetData()))
 	}
 
-	stats.Default().RecordDownload(bytesRead, time.Since(startedAt))
+	p.stats.RecordDownload(bytesRead, time.Since(startedAt))
 	return nil
 }
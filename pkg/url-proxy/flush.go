@@ -0,0 +1,82 @@
+package urlproxy
+
+import (
+	"net/http"
+	"time"
+)
+
+// FlushPolicy controls how often streamed download responses are flushed to the client.
+// A flush happens once Bytes have been written or Interval has passed since the last
+// flush, whichever comes first. A zero field disables that trigger; the zero FlushPolicy
+// leaves buffering entirely to the HTTP server.
+type FlushPolicy struct {
+	Interval time.Duration
+	Bytes    int64
+}
+
+// DefaultFlushPolicy keeps progress steady for clients downloading large artifacts.
+var DefaultFlushPolicy = FlushPolicy{
+	Interval: 250 * time.Millisecond,
+	Bytes:    1024 * 1024,
+}
+
+// Enabled reports whether the policy ever triggers a flush.
+func (policy FlushPolicy) Enabled() bool {
+	return policy.Interval > 0 || policy.Bytes > 0
+}
+
+type flushingResponseWriter struct {
+	http.ResponseWriter
+
+	flusher     http.Flusher
+	policy      FlushPolicy
+	now         func() time.Time
+	pending     int64
+	lastFlushAt time.Time
+}
+
+// NewFlushingResponseWriter wraps w so that writes are flushed according to policy.
+// w is returned unchanged when the policy is disabled or w cannot flush.
+func NewFlushingResponseWriter(w http.ResponseWriter, policy FlushPolicy) http.ResponseWriter {
+	if !policy.Enabled() {
+		return w
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return w
+	}
+
+	return &flushingResponseWriter{
+		ResponseWriter: w,
+		flusher:        flusher,
+		policy:         policy,
+		now:            time.Now,
+		lastFlushAt:    time.Now(),
+	}
+}
+
+func (w *flushingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.pending += int64(n)
+	if err != nil {
+		return n, err
+	}
+
+	if (w.policy.Bytes > 0 && w.pending >= w.policy.Bytes) ||
+		(w.policy.Interval > 0 && w.pending > 0 && w.now().Sub(w.lastFlushAt) >= w.policy.Interval) {
+		w.Flush()
+	}
+
+	return n, nil
+}
+
+func (w *flushingResponseWriter) Flush() {
+	w.flusher.Flush()
+	w.pending = 0
+	w.lastFlushAt = w.now()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *flushingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,46 @@
+package urlproxy
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlushingResponseWriterFlushesAfterBytes(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	w := NewFlushingResponseWriter(recorder, FlushPolicy{Bytes: 4})
+
+	_, err := w.Write([]byte("abc"))
+	require.NoError(t, err)
+	require.False(t, recorder.Flushed)
+
+	_, err = w.Write([]byte("d"))
+	require.NoError(t, err)
+	require.True(t, recorder.Flushed)
+}
+
+func TestFlushingResponseWriterFlushesAfterInterval(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	w := NewFlushingResponseWriter(recorder, FlushPolicy{Interval: time.Second}).(*flushingResponseWriter)
+
+	now := time.Unix(0, 0)
+	w.now = func() time.Time { return now }
+	w.lastFlushAt = now
+
+	_, err := w.Write([]byte("a"))
+	require.NoError(t, err)
+	require.False(t, recorder.Flushed)
+
+	now = now.Add(time.Second)
+	_, err = w.Write([]byte("b"))
+	require.NoError(t, err)
+	require.True(t, recorder.Flushed)
+	require.Equal(t, "ab", recorder.Body.String())
+}
+
+func TestFlushingResponseWriterDisabled(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	require.Same(t, recorder, NewFlushingResponseWriter(recorder, FlushPolicy{}))
+}
@@ -2,15 +2,19 @@ package urlproxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/url"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/cirruslabs/omni-cache/pkg/storage"
 	bytestream "google.golang.org/genproto/googleapis/bytestream"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/metadata"
@@ -24,46 +28,126 @@ func isGRPCScheme(scheme string) bool {
 	return scheme == "grpc" || scheme == "grpcs" || scheme == "unix"
 }
 
-func newByteStreamClientFromURL(ctx context.Context, info *storage.URLInfo, extraDialOpts ...grpc.DialOption) (bytestream.ByteStreamClient, io.Closer, error) {
+// DefaultGRPCDialTimeout is how long ByteStream transfers wait for a gRPC connection by default.
+const DefaultGRPCDialTimeout = 10 * time.Second
+
+// errGRPCUnreachable is returned when a connection to a gRPC target can't be established.
+var errGRPCUnreachable = errors.New("gRPC target is unreachable")
+
+// WithGRPCDialTimeout bounds how long ByteStream transfers wait for a gRPC connection before
+// failing, so that a stale unix socket or a server that isn't up doesn't block the request.
+// A non-positive timeout leaves connecting to the first call, as gRPC does by default.
+// Defaults to DefaultGRPCDialTimeout.
+func WithGRPCDialTimeout(timeout time.Duration) ProxyOption {
+	return func(p *Proxy) {
+		p.grpcDialTimeout = timeout
+	}
+}
+
+// grpcTarget is the address and transport security of a gRPC URL.
+type grpcTarget struct {
+	address string
+	secure  bool
+	// socketPath is the path of unix socket targets.
+	socketPath string
+}
+
+func parseGRPCTarget(info *storage.URLInfo) (grpcTarget, error) {
 	if info == nil {
-		return nil, io.NopCloser(strings.NewReader("")), fmt.Errorf("url info is nil")
+		return grpcTarget{}, fmt.Errorf("url info is nil")
 	}
 
 	u, err := url.Parse(info.URL)
 	if err != nil {
-		return nil, io.NopCloser(strings.NewReader("")), err
+		return grpcTarget{}, err
 	}
 
 	scheme := strings.ToLower(u.Scheme)
+	if scheme == "unix" {
+		socketPath := u.Path
+		if u.Opaque != "" {
+			socketPath = u.Opaque
+		}
+		return grpcTarget{address: u.String(), socketPath: socketPath}, nil
+	}
+
+	host := u.Hostname()
+	if host == "" {
+		return grpcTarget{}, fmt.Errorf("gRPC URL %q does not include host", u.String())
+	}
+
+	port := u.Port()
+	if port == "" {
+		if scheme == "grpcs" {
+			port = "443"
+		} else {
+			port = "80"
+		}
+	}
+
+	return grpcTarget{address: net.JoinHostPort(host, port), secure: scheme == "grpcs"}, nil
+}
+
+func (target grpcTarget) key() string {
+	if target.secure {
+		return "grpcs " + target.address
+	}
+	return "grpc " + target.address
+}
+
+func (target grpcTarget) dial(extraDialOpts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	if target.socketPath != "" {
+		if info, err := os.Stat(target.socketPath); err != nil {
+			return nil, fmt.Errorf("%w: unix socket %s: %w", errGRPCUnreachable, target.socketPath, err)
+		} else if info.Mode().Type() != os.ModeSocket {
+			return nil, fmt.Errorf("%w: %s is not a unix socket", errGRPCUnreachable, target.socketPath)
+		}
+	}
 
 	creds := insecure.NewCredentials()
-	if scheme == "grpcs" {
+	if target.secure {
 		creds = credentials.NewClientTLSFromCert(nil, "")
 	}
 
-	var address string
-	switch scheme {
-	case "unix":
-		address = u.String()
-	default:
-		host := u.Hostname()
-		if host == "" {
-			return nil, io.NopCloser(strings.NewReader("")), fmt.Errorf("gRPC URL %q does not include host", u.String())
-		}
+	opts := append([]grpc.DialOption{grpc.WithTransportCredentials(creds)}, extraDialOpts...)
+	return grpc.NewClient(target.address, opts...)
+}
 
-		port := u.Port()
-		if port == "" {
-			if scheme == "grpcs" {
-				port = "443"
-			} else {
-				port = "80"
+// awaitConnection connects conn and waits up to timeout for it to become ready, failing
+// early when the connection attempt fails.
+func (target grpcTarget) awaitConnection(ctx context.Context, conn *grpc.ClientConn, timeout time.Duration) error {
+	if timeout <= 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	conn.Connect()
+	for {
+		state := conn.GetState()
+		switch state {
+		case connectivity.Ready:
+			return nil
+		case connectivity.TransientFailure, connectivity.Shutdown:
+			return fmt.Errorf("%w: failed to connect to %s", errGRPCUnreachable, target.address)
+		}
+		if !conn.WaitForStateChange(ctx, state) {
+			if ctx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("%w: no connection to %s within %s", errGRPCUnreachable, target.address, timeout)
 			}
+			return ctx.Err()
 		}
+	}
+}
 
-		address = net.JoinHostPort(host, port)
+func newByteStreamClientFromURL(ctx context.Context, info *storage.URLInfo, dialTimeout time.Duration, extraDialOpts ...grpc.DialOption) (bytestream.ByteStreamClient, io.Closer, error) {
+	target, err := parseGRPCTarget(info)
+	if err != nil {
+		return nil, io.NopCloser(strings.NewReader("")), err
 	}
 
-	opts := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	var opts []grpc.DialOption
 	if md := metadata.New(info.ExtraHeaders); len(md) > 0 {
 		opts = append(opts,
 			grpc.WithUnaryInterceptor(func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, callOpts ...grpc.CallOption) error {
@@ -77,10 +161,14 @@ func newByteStreamClientFromURL(ctx context.Context, info *storage.URLInfo, extr
 
 	opts = append(opts, extraDialOpts...)
 
-	conn, err := grpc.NewClient(address, opts...)
+	conn, err := target.dial(opts...)
 	if err != nil {
 		return nil, io.NopCloser(strings.NewReader("")), err
 	}
+	if err := target.awaitConnection(ctx, conn, dialTimeout); err != nil {
+		_ = conn.Close()
+		return nil, io.NopCloser(strings.NewReader("")), err
+	}
 
 	client := bytestream.NewByteStreamClient(conn)
 
@@ -0,0 +1,152 @@
+package urlproxy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+	bytestream "google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// WithGRPCConnectionPool makes ByteStream transfers reuse gRPC connections to the same
+// target instead of dialing a new connection for every transfer. A connection is closed
+// once it has been unused for idleTimeout. Copies of the proxy made with With share the
+// pool, so they should not change the gRPC dial options. Disabled by default.
+func WithGRPCConnectionPool(idleTimeout time.Duration) ProxyOption {
+	return func(p *Proxy) {
+		if idleTimeout <= 0 {
+			p.grpcConns = nil
+			return
+		}
+		p.grpcConns = newGRPCConnPool(idleTimeout)
+	}
+}
+
+type grpcConnPool struct {
+	idleTimeout time.Duration
+
+	mu    sync.Mutex
+	conns map[string]*pooledGRPCConn
+}
+
+type pooledGRPCConn struct {
+	conn      *grpc.ClientConn
+	refs      int
+	idleTimer *time.Timer
+}
+
+func newGRPCConnPool(idleTimeout time.Duration) *grpcConnPool {
+	return &grpcConnPool{idleTimeout: idleTimeout, conns: map[string]*pooledGRPCConn{}}
+}
+
+// acquire returns a connection to target, dialing one if none is pooled, along with a
+// function that hands it back to the pool.
+func (pool *grpcConnPool) acquire(target grpcTarget, dialOpts []grpc.DialOption) (*grpc.ClientConn, func(), error) {
+	key := target.key()
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pooled, ok := pool.conns[key]
+	if !ok {
+		conn, err := target.dial(dialOpts...)
+		if err != nil {
+			return nil, nil, err
+		}
+		pooled = &pooledGRPCConn{conn: conn}
+		pool.conns[key] = pooled
+	}
+	if pooled.idleTimer != nil {
+		pooled.idleTimer.Stop()
+		pooled.idleTimer = nil
+	}
+	pooled.refs++
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			pool.release(key, pooled)
+		})
+	}
+	return pooled.conn, release, nil
+}
+
+func (pool *grpcConnPool) release(key string, pooled *pooledGRPCConn) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pooled.refs--
+	if pooled.refs > 0 {
+		return
+	}
+	pooled.idleTimer = time.AfterFunc(pool.idleTimeout, func() {
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+
+		if pooled.refs > 0 || pool.conns[key] != pooled {
+			return
+		}
+		delete(pool.conns, key)
+		_ = pooled.conn.Close()
+	})
+}
+
+// size returns the number of pooled connections.
+func (pool *grpcConnPool) size() int {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	return len(pool.conns)
+}
+
+// byteStreamClient returns a ByteStream client for info and a function that releases it.
+// Pooled connections are shared by transfers with different headers, so the headers are
+// attached to each call instead of to the connection.
+func (p *Proxy) byteStreamClient(ctx context.Context, info *storage.URLInfo) (bytestream.ByteStreamClient, func(), error) {
+	if p.grpcConns == nil {
+		client, closer, err := newByteStreamClientFromURL(ctx, info, p.grpcDialTimeout, p.grpcDialOptions...)
+		if err != nil {
+			return nil, nil, err
+		}
+		return client, func() { _ = closer.Close() }, nil
+	}
+
+	target, err := parseGRPCTarget(info)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, release, err := p.grpcConns.acquire(target, p.grpcDialOptions)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := target.awaitConnection(ctx, conn, p.grpcDialTimeout); err != nil {
+		release()
+		return nil, nil, err
+	}
+
+	var client bytestream.ByteStreamClient = bytestream.NewByteStreamClient(conn)
+	if md := metadata.New(info.ExtraHeaders); len(md) > 0 {
+		client = metadataByteStreamClient{ByteStreamClient: client, md: md}
+	}
+	return client, release, nil
+}
+
+// metadataByteStreamClient sends md as the metadata of every call.
+type metadataByteStreamClient struct {
+	bytestream.ByteStreamClient
+	md metadata.MD
+}
+
+func (c metadataByteStreamClient) Read(ctx context.Context, in *bytestream.ReadRequest, opts ...grpc.CallOption) (bytestream.ByteStream_ReadClient, error) {
+	return c.ByteStreamClient.Read(metadata.NewOutgoingContext(ctx, c.md), in, opts...)
+}
+
+func (c metadataByteStreamClient) Write(ctx context.Context, opts ...grpc.CallOption) (bytestream.ByteStream_WriteClient, error) {
+	return c.ByteStreamClient.Write(metadata.NewOutgoingContext(ctx, c.md), opts...)
+}
+
+func (c metadataByteStreamClient) QueryWriteStatus(ctx context.Context, in *bytestream.QueryWriteStatusRequest, opts ...grpc.CallOption) (*bytestream.QueryWriteStatusResponse, error) {
+	return c.ByteStreamClient.QueryWriteStatus(metadata.NewOutgoingContext(ctx, c.md), in, opts...)
+}
@@ -0,0 +1,89 @@
+package urlproxy
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+func countingDialer(dials *atomic.Int32) grpc.DialOption {
+	return grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		dials.Add(1)
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", addr)
+	})
+}
+
+func TestGRPCConnectionPoolReusesConnections(t *testing.T) {
+	srv := &testByteStreamServer{readChunks: [][]byte{[]byte("pooled")}}
+	address := startByteStreamServer(t, srv)
+
+	var dials atomic.Int32
+	proxy := NewProxy(WithGRPCDialOptions(countingDialer(&dials)), WithGRPCConnectionPool(time.Minute))
+
+	for _, tenant := range []string{"a", "b", "c"} {
+		info := &storage.URLInfo{URL: "grpc://" + address, ExtraHeaders: map[string]string{"X-Tenant": tenant}}
+
+		var downloaded bytes.Buffer
+		require.NoError(t, proxy.DownloadToWriter(t.Context(), info, "cache-key", &downloaded))
+		require.Equal(t, "pooled", downloaded.String())
+		require.Equal(t, []string{tenant}, srv.readMD.Get("x-tenant"))
+
+		require.NoError(t, proxy.UploadFromReader(t.Context(), info, "cache-key", bytes.NewReader([]byte("data")), 4))
+		require.Equal(t, []string{tenant}, srv.writeMD.Get("x-tenant"))
+	}
+
+	require.EqualValues(t, 1, dials.Load())
+	require.Equal(t, 1, proxy.grpcConns.size())
+}
+
+func TestGRPCConnectionPoolClosesIdleConnections(t *testing.T) {
+	srv := &testByteStreamServer{readChunks: [][]byte{[]byte("idle")}}
+	address := startByteStreamServer(t, srv)
+
+	var dials atomic.Int32
+	proxy := NewProxy(WithGRPCDialOptions(countingDialer(&dials)), WithGRPCConnectionPool(50*time.Millisecond))
+	info := &storage.URLInfo{URL: "grpc://" + address}
+
+	var downloaded bytes.Buffer
+	require.NoError(t, proxy.DownloadToWriter(t.Context(), info, "cache-key", &downloaded))
+	require.Equal(t, 1, proxy.grpcConns.size())
+
+	require.Eventually(t, func() bool {
+		return proxy.grpcConns.size() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	downloaded.Reset()
+	require.NoError(t, proxy.DownloadToWriter(t.Context(), info, "cache-key", &downloaded))
+	require.EqualValues(t, 2, dials.Load())
+}
+
+// BenchmarkGRPCSmallDownloads compares many small sequential ByteStream downloads with a
+// connection per transfer against pooled connections.
+func BenchmarkGRPCSmallDownloads(b *testing.B) {
+	srv := &testByteStreamServer{readChunks: [][]byte{bytes.Repeat([]byte("x"), 1024)}}
+	address := startByteStreamServer(b, srv)
+	info := &storage.URLInfo{URL: "grpc://" + address}
+
+	for name, proxy := range map[string]*Proxy{
+		"dial-per-transfer": NewProxy(),
+		"pooled":            NewProxy(WithGRPCConnectionPool(time.Minute)),
+	} {
+		b.Run(name, func(b *testing.B) {
+			var downloaded bytes.Buffer
+			for b.Loop() {
+				downloaded.Reset()
+				if err := proxy.DownloadToWriter(b.Context(), info, "cache-key", &downloaded); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
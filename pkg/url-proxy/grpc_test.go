@@ -11,6 +11,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
@@ -87,7 +88,7 @@ func (s *testByteStreamServer) QueryWriteStatus(_ context.Context, _ *bytestream
 	}, nil
 }
 
-func startByteStreamServerWithListener(t *testing.T, lis net.Listener, srv bytestream.ByteStreamServer) string {
+func startByteStreamServerWithListener(t testing.TB, lis net.Listener, srv bytestream.ByteStreamServer) string {
 	server := grpc.NewServer()
 	bytestream.RegisterByteStreamServer(server, srv)
 
@@ -101,7 +102,7 @@ func startByteStreamServerWithListener(t *testing.T, lis net.Listener, srv bytes
 	return lis.Addr().String()
 }
 
-func startByteStreamServer(t *testing.T, srv bytestream.ByteStreamServer) string {
+func startByteStreamServer(t testing.TB, srv bytestream.ByteStreamServer) string {
 	t.Helper()
 
 	lis, err := net.Listen("tcp", "127.0.0.1:0")
@@ -318,3 +319,46 @@ func TestProxyDownloadFromURL_GRPC_Error(t *testing.T) {
 	// but no bytes should have been written to the body.
 	require.Empty(t, rr.Body.String())
 }
+
+func TestProxyGRPCUnreachableUnixSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix sockets are not supported on Windows")
+	}
+
+	dir := shortTempDir(t)
+
+	// A listener that accepts connections but never speaks gRPC, like a hung server.
+	hungSocketPath := filepath.Join(dir, "hung.sock")
+	lis, err := net.Listen("unix", hungSocketPath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = lis.Close()
+	})
+
+	regularFilePath := filepath.Join(dir, "regular")
+	require.NoError(t, os.WriteFile(regularFilePath, nil, 0o600))
+
+	proxy := NewProxy(WithGRPCDialTimeout(200 * time.Millisecond))
+
+	for _, socketPath := range []string{filepath.Join(dir, "missing.sock"), regularFilePath, hungSocketPath} {
+		info := &storage.URLInfo{URL: "unix://" + socketPath}
+
+		startedAt := time.Now()
+		err := proxy.DownloadToWriter(t.Context(), info, "cache-key", io.Discard)
+		require.ErrorIs(t, err, errGRPCUnreachable)
+		require.ErrorContains(t, err, socketPath)
+		require.Less(t, time.Since(startedAt), 5*time.Second)
+
+		rr := httptest.NewRecorder()
+		require.False(t, proxy.ProxyDownloadFromURL(t.Context(), rr, info, "cache-key"))
+		require.Empty(t, rr.Body.String())
+
+		rr = httptest.NewRecorder()
+		require.False(t, proxy.ProxyUploadToURL(t.Context(), rr, info, UploadResource{
+			Body:          bytes.NewReader([]byte("payload")),
+			ContentLength: 7,
+			ResourceName:  "cache-key",
+		}))
+		require.Equal(t, http.StatusBadGateway, rr.Code)
+	}
+}
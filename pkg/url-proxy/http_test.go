@@ -11,6 +11,7 @@ import (
 
 	"github.com/stretchr/testify/require"
 
+	"github.com/cirruslabs/omni-cache/pkg/stats"
 	"github.com/cirruslabs/omni-cache/pkg/storage"
 )
 
@@ -104,3 +105,26 @@ func TestProxyUploadToURL_CustomHTTPClient(t *testing.T) {
 	require.Equal(t, "application/octet-stream", recordingTransport.lastReq.Header.Get("Content-Type"))
 	require.Equal(t, http.StatusCreated, rec.Code)
 }
+
+func TestProxyRecordsTransfersWithItsStats(t *testing.T) {
+	transport := &recordingRoundTripper{responseBody: []byte("downloaded")}
+	downloads := &stats.Collector{}
+	proxy := NewProxy(WithHTTPClient(&http.Client{Transport: transport}), WithStats(downloads))
+
+	rec := httptest.NewRecorder()
+	require.True(t, proxy.ProxyDownloadFromURL(context.Background(), rec, &storage.URLInfo{URL: "http://example.com/cache"}, "res"))
+
+	uploads := &stats.Collector{}
+	err := proxy.With(WithStats(uploads)).UploadFromReader(context.Background(), &storage.URLInfo{URL: "http://example.com/cache"}, "res", bytes.NewReader([]byte("uploaded")), int64(len("uploaded")))
+	require.NoError(t, err)
+
+	require.Equal(t, stats.TransferSnapshot{Count: 1, Bytes: int64(len("downloaded"))}, withoutDuration(downloads.Snapshot().Downloads))
+	require.Zero(t, downloads.Snapshot().Uploads.Count)
+	require.Equal(t, stats.TransferSnapshot{Count: 1, Bytes: int64(len("uploaded"))}, withoutDuration(uploads.Snapshot().Uploads))
+	require.Zero(t, uploads.Snapshot().Downloads.Count)
+}
+
+func withoutDuration(snapshot stats.TransferSnapshot) stats.TransferSnapshot {
+	snapshot.Duration = 0
+	return snapshot
+}
@@ -2,7 +2,10 @@ package urlproxy
 
 import (
 	"net/http"
+	"slices"
+	"time"
 
+	"github.com/cirruslabs/omni-cache/pkg/stats"
 	"google.golang.org/grpc"
 )
 
@@ -10,6 +13,14 @@ import (
 type Proxy struct {
 	httpClient      *http.Client
 	grpcDialOptions []grpc.DialOption
+	flushPolicy     FlushPolicy
+	coalescer       *downloadCoalescer
+	uploadRetries   UploadRetryPolicy
+	slowDownloads   SlowDownloadPolicy
+	compression     string
+	grpcConns       *grpcConnPool
+	grpcDialTimeout time.Duration
+	stats           *stats.Collector
 }
 
 type ProxyOption func(*Proxy)
@@ -28,9 +39,38 @@ func WithGRPCDialOptions(opts ...grpc.DialOption) ProxyOption {
 	}
 }
 
+// WithFlushPolicy sets how often proxied downloads are flushed to the client. Defaults to DefaultFlushPolicy.
+func WithFlushPolicy(policy FlushPolicy) ProxyOption {
+	return func(p *Proxy) {
+		p.flushPolicy = policy
+	}
+}
+
+// WithDownloadCoalescing makes concurrent HTTP downloads of the same object share a single
+// upstream request. The body is spooled to a temporary file in spoolDir (os.TempDir when
+// empty) so that requests joining mid-transfer can catch up.
+func WithDownloadCoalescing(spoolDir string) ProxyOption {
+	return func(p *Proxy) {
+		p.coalescer = newDownloadCoalescer(spoolDir)
+	}
+}
+
+// WithStats records the proxy's downloads and uploads in collector, such as the one of the
+// protocol the proxy serves. Defaults to stats.Default().
+func WithStats(collector *stats.Collector) ProxyOption {
+	return func(p *Proxy) {
+		p.stats = collector
+	}
+}
+
 // NewProxy builds a Proxy configured via provided options.
 func NewProxy(opts ...ProxyOption) *Proxy {
-	p := &Proxy{}
+	p := &Proxy{
+		flushPolicy:     DefaultFlushPolicy,
+		uploadRetries:   DefaultUploadRetryPolicy,
+		grpcDialTimeout: DefaultGRPCDialTimeout,
+		stats:           stats.Default(),
+	}
 	for _, opt := range opts {
 		opt(p)
 	}
@@ -39,3 +79,21 @@ func NewProxy(opts ...ProxyOption) *Proxy {
 	}
 	return p
 }
+
+// HTTPClient returns the HTTP client used for HTTP transfers.
+func (p *Proxy) HTTPClient() *http.Client {
+	return p.httpClient
+}
+
+// With returns a copy of p with opts applied. Coalesced downloads stay shared with p.
+func (p *Proxy) With(opts ...ProxyOption) *Proxy {
+	clone := *p
+	clone.grpcDialOptions = slices.Clone(p.grpcDialOptions)
+	for _, opt := range opts {
+		opt(&clone)
+	}
+	if clone.httpClient == nil {
+		clone.httpClient = http.DefaultClient
+	}
+	return &clone
+}
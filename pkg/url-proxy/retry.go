@@ -0,0 +1,146 @@
+package urlproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+)
+
+// UploadRetryPolicy controls how HTTP uploads are retried after transient failures:
+// a 500, 502, 503 or 504 response, or a network timeout or reset.
+type UploadRetryPolicy struct {
+	// Retries is the number of attempts made after the first one. Zero disables retries.
+	Retries int
+	// BaseDelay is the backoff before the first retry. It doubles with every retry and
+	// is jittered so that concurrent uploads don't retry in lockstep.
+	BaseDelay time.Duration
+}
+
+// DefaultUploadRetryPolicy is the upload retry policy used when none is configured.
+var DefaultUploadRetryPolicy = UploadRetryPolicy{
+	Retries:   2,
+	BaseDelay: 250 * time.Millisecond,
+}
+
+// uploadRetryBufferLimit bounds how much of a non-seekable upload body is buffered in
+// memory so that it can be replayed. Larger bodies, and bodies of unknown length, are
+// sent once.
+const uploadRetryBufferLimit = 8 * 1024 * 1024
+
+// WithUploadRetries sets how many times an HTTP upload is retried after a transient failure
+// and the initial backoff between attempts. Zero retries disables retrying.
+func WithUploadRetries(retries int, baseDelay time.Duration) ProxyOption {
+	return func(p *Proxy) {
+		p.uploadRetries = UploadRetryPolicy{Retries: max(retries, 0), BaseDelay: baseDelay}
+	}
+}
+
+// putWithRetries uploads body to info with a PUT request, retrying transient failures.
+// A non-empty contentEncoding is sent as the Content-Encoding header.
+// Seekable bodies are rewound for every attempt. Other bodies are buffered in memory
+// when their length is known and at most uploadRetryBufferLimit, and are otherwise sent
+// only once. It returns the final response and how many body bytes its request read.
+func (p *Proxy) putWithRetries(ctx context.Context, info *storage.URLInfo, body io.Reader, contentLength int64, contentEncoding string) (*http.Response, int64, error) {
+	body, rewind, err := replayableBody(body, contentLength, p.uploadRetries.Retries > 0)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		bodyReader := &countingReader{reader: body}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, info.URL, bufio.NewReader(bodyReader))
+		if err != nil {
+			return nil, 0, err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		if contentEncoding != "" {
+			req.Header.Set("Content-Encoding", contentEncoding)
+		}
+		if contentLength >= 0 {
+			req.ContentLength = contentLength
+		}
+		for k, v := range info.ExtraHeaders {
+			req.Header.Set(k, v)
+		}
+
+		resp, err := p.httpClient.Do(req)
+		if attempt >= p.uploadRetries.Retries || rewind == nil || ctx.Err() != nil || !retryableUpload(resp, err) {
+			return resp, bodyReader.Bytes(), err
+		}
+
+		attrs := []any{"uploadURL", info.URL, "attempt", attempt + 1}
+		if err != nil {
+			attrs = append(attrs, "err", err)
+		} else {
+			attrs = append(attrs, "statusCode", resp.StatusCode)
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+		slog.WarnContext(ctx, "retrying cache upload after transient failure", attrs...)
+
+		if err := storage.SleepContext(ctx, storage.RetryPolicy(p.uploadRetries).Delay(attempt)); err != nil {
+			return nil, 0, err
+		}
+		if err := rewind(); err != nil {
+			return nil, 0, err
+		}
+	}
+}
+
+// replayableBody returns a body that can be sent again after calling rewind. rewind is nil
+// when the body can't be replayed or replaying isn't wanted.
+func replayableBody(body io.Reader, contentLength int64, wanted bool) (io.Reader, func() error, error) {
+	if !wanted {
+		return body, nil, nil
+	}
+
+	if seeker, ok := body.(io.ReadSeeker); ok {
+		start, err := seeker.Seek(0, io.SeekCurrent)
+		if err == nil {
+			return body, func() error {
+				_, err := seeker.Seek(start, io.SeekStart)
+				return err
+			}, nil
+		}
+	}
+
+	if contentLength < 0 || contentLength > uploadRetryBufferLimit {
+		return body, nil, nil
+	}
+
+	buffered, err := io.ReadAll(io.LimitReader(body, contentLength))
+	if err != nil {
+		return nil, nil, err
+	}
+	reader := bytes.NewReader(buffered)
+	return reader, func() error {
+		_, err := reader.Seek(0, io.SeekStart)
+		return err
+	}, nil
+}
+
+func retryableUpload(resp *http.Response, err error) bool {
+	if err != nil {
+		var netErr net.Error
+		return (errors.As(err, &netErr) && netErr.Timeout()) ||
+			errors.Is(err, syscall.ECONNRESET) ||
+			errors.Is(err, io.ErrUnexpectedEOF) ||
+			errors.Is(err, io.EOF)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,109 @@
+package urlproxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+)
+
+// flakyUploadServer fails the first failures uploads with status and records the
+// body of every attempt.
+func flakyUploadServer(t *testing.T, failures int, status int) (*httptest.Server, *atomic.Int32, *[]string) {
+	t.Helper()
+
+	var attempts atomic.Int32
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if int(attempts.Add(1)) <= failures {
+			w.WriteHeader(status)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &attempts, &bodies
+}
+
+// onlyReader hides any io.Seeker implementation of the wrapped reader.
+type onlyReader struct {
+	io.Reader
+}
+
+func TestProxyUploadToURLRetriesTransientStatus(t *testing.T) {
+	server, attempts, bodies := flakyUploadServer(t, 1, http.StatusServiceUnavailable)
+	proxy := NewProxy(WithUploadRetries(2, time.Millisecond))
+
+	recorder := httptest.NewRecorder()
+	ok := proxy.ProxyUploadToURL(context.Background(), recorder, &storage.URLInfo{URL: server.URL}, UploadResource{
+		Body:          onlyReader{strings.NewReader("payload")},
+		ContentLength: int64(len("payload")),
+		ResourceName:  "key",
+	})
+
+	require.True(t, ok)
+	require.Equal(t, http.StatusCreated, recorder.Code)
+	require.EqualValues(t, 2, attempts.Load())
+	require.Equal(t, []string{"payload", "payload"}, *bodies)
+}
+
+func TestUploadFromReaderRetriesSeekableBody(t *testing.T) {
+	server, attempts, bodies := flakyUploadServer(t, 2, http.StatusBadGateway)
+	proxy := NewProxy(WithUploadRetries(2, time.Millisecond))
+
+	err := proxy.UploadFromReader(context.Background(), &storage.URLInfo{URL: server.URL}, "key",
+		strings.NewReader("payload"), -1)
+
+	require.NoError(t, err)
+	require.EqualValues(t, 3, attempts.Load())
+	require.Equal(t, []string{"payload", "payload", "payload"}, *bodies)
+}
+
+func TestUploadRetriesGiveUp(t *testing.T) {
+	server, attempts, _ := flakyUploadServer(t, 10, http.StatusServiceUnavailable)
+	proxy := NewProxy(WithUploadRetries(2, time.Millisecond))
+
+	recorder := httptest.NewRecorder()
+	ok := proxy.ProxyUploadToURL(context.Background(), recorder, &storage.URLInfo{URL: server.URL}, UploadResource{
+		Body:          strings.NewReader("payload"),
+		ContentLength: int64(len("payload")),
+		ResourceName:  "key",
+	})
+
+	require.False(t, ok)
+	require.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	require.EqualValues(t, 3, attempts.Load())
+}
+
+func TestUploadDoesNotRetryClientErrors(t *testing.T) {
+	server, attempts, _ := flakyUploadServer(t, 1, http.StatusForbidden)
+	proxy := NewProxy(WithUploadRetries(2, time.Millisecond))
+
+	err := proxy.UploadFromReader(context.Background(), &storage.URLInfo{URL: server.URL}, "key",
+		strings.NewReader("payload"), int64(len("payload")))
+
+	require.Error(t, err)
+	require.EqualValues(t, 1, attempts.Load())
+}
+
+func TestUploadDoesNotRetryBodiesOfUnknownLength(t *testing.T) {
+	server, attempts, _ := flakyUploadServer(t, 1, http.StatusServiceUnavailable)
+	proxy := NewProxy(WithUploadRetries(2, time.Millisecond))
+
+	err := proxy.UploadFromReader(context.Background(), &storage.URLInfo{URL: server.URL}, "key",
+		onlyReader{strings.NewReader("payload")}, -1)
+
+	require.Error(t, err)
+	require.EqualValues(t, 1, attempts.Load())
+}
@@ -0,0 +1,236 @@
+package urlproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+)
+
+// SlowDownloadPolicy lets a proxied HTTP download that progresses too slowly switch to
+// parallel ranged requests for the rest of the object. It only applies when the upstream
+// reports the object size and advertises "Accept-Ranges: bytes". The zero policy never
+// switches.
+type SlowDownloadPolicy struct {
+	// GracePeriod is how long a download runs before its throughput is first checked. It
+	// is also the window over which throughput is measured afterwards.
+	GracePeriod time.Duration
+	// MinBytesPerSecond is the throughput below which the download is switched.
+	MinBytesPerSecond int64
+	// Parallelism is how many ranged requests run at once. Defaults to 4.
+	Parallelism int
+	// ChunkSize is the size of each ranged request. Defaults to 8 MiB. At most
+	// Parallelism chunks are held in memory at a time.
+	ChunkSize int64
+}
+
+const (
+	defaultSlowDownloadParallelism = 4
+	defaultSlowDownloadChunkSize   = 8 * 1024 * 1024
+)
+
+// Enabled reports whether the policy ever switches a download.
+func (policy SlowDownloadPolicy) Enabled() bool {
+	return policy.GracePeriod > 0 && policy.MinBytesPerSecond > 0
+}
+
+// WithSlowDownloadFallback sets when slow HTTP downloads switch to parallel ranged
+// requests. Disabled by default.
+func WithSlowDownloadFallback(policy SlowDownloadPolicy) ProxyOption {
+	return func(p *Proxy) {
+		p.slowDownloads = policy
+	}
+}
+
+// copyHTTPBody copies the body of a successful upstream response to w, decompressing it
+// when it was uploaded with compression. cancel aborts the request that produced resp.
+// When the slow download policy kicks in, the request is aborted and the remainder of the
+// object is fetched with parallel ranged requests. Compressed bodies are never switched.
+func (p *Proxy) copyHTTPBody(ctx context.Context, info *storage.URLInfo, resp *http.Response, cancel context.CancelFunc, w io.Writer) (int64, error) {
+	if isZstdEncoded(resp) {
+		body, err := decodedBody(resp)
+		if err != nil {
+			return 0, err
+		}
+		defer body.Close()
+		return io.Copy(w, body)
+	}
+
+	policy := p.slowDownloads
+	if !policy.Enabled() || resp.StatusCode != http.StatusOK || resp.ContentLength <= 0 || resp.Header.Get("Accept-Ranges") != "bytes" {
+		return io.Copy(w, resp.Body)
+	}
+
+	monitor := newThroughputMonitor(resp.Body, policy, cancel)
+	written, err := io.Copy(w, monitor)
+	monitor.stop()
+	if err == nil || !monitor.slow.Load() || ctx.Err() != nil {
+		return written, err
+	}
+
+	slog.WarnContext(ctx, "switching slow cache download to parallel ranged requests",
+		"url", info.URL, "bytesProxied", written, "bytesRemaining", resp.ContentLength-written)
+
+	remaining, err := p.downloadRanges(ctx, info, resp.Header.Get("ETag"), written, resp.ContentLength, w)
+	return written + remaining, err
+}
+
+// throughputMonitor counts the bytes read from a response body and cancels the request
+// once fewer than MinBytesPerSecond were read over a GracePeriod window.
+type throughputMonitor struct {
+	reader io.Reader
+	read   atomic.Int64
+	slow   atomic.Bool
+
+	mu       sync.Mutex
+	timer    *time.Timer
+	lastRead int64
+	stopped  bool
+}
+
+func newThroughputMonitor(reader io.Reader, policy SlowDownloadPolicy, cancel context.CancelFunc) *throughputMonitor {
+	monitor := &throughputMonitor{reader: reader}
+	minBytes := int64(float64(policy.MinBytesPerSecond) * policy.GracePeriod.Seconds())
+
+	monitor.mu.Lock()
+	defer monitor.mu.Unlock()
+	monitor.timer = time.AfterFunc(policy.GracePeriod, func() {
+		monitor.mu.Lock()
+		defer monitor.mu.Unlock()
+		if monitor.stopped {
+			return
+		}
+
+		read := monitor.read.Load()
+		if read-monitor.lastRead < minBytes {
+			monitor.slow.Store(true)
+			cancel()
+			return
+		}
+		monitor.lastRead = read
+		monitor.timer.Reset(policy.GracePeriod)
+	})
+
+	return monitor
+}
+
+func (monitor *throughputMonitor) Read(p []byte) (int, error) {
+	n, err := monitor.reader.Read(p)
+	monitor.read.Add(int64(n))
+	return n, err
+}
+
+func (monitor *throughputMonitor) stop() {
+	monitor.mu.Lock()
+	defer monitor.mu.Unlock()
+
+	monitor.stopped = true
+	monitor.timer.Stop()
+}
+
+type rangeResult struct {
+	data []byte
+	err  error
+}
+
+// downloadRanges fetches bytes [offset, size) of the object behind info with parallel
+// ranged requests and writes them to w in order. A non-empty etag must match the object,
+// so that a concurrent overwrite is detected instead of mixing two versions.
+func (p *Proxy) downloadRanges(ctx context.Context, info *storage.URLInfo, etag string, offset int64, size int64, w io.Writer) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	parallelism := p.slowDownloads.Parallelism
+	if parallelism <= 0 {
+		parallelism = defaultSlowDownloadParallelism
+	}
+	chunkSize := p.slowDownloads.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultSlowDownloadChunkSize
+	}
+
+	var results []chan rangeResult
+	for start := offset; start < size; start += chunkSize {
+		results = append(results, make(chan rangeResult, 1))
+	}
+
+	// Every started fetch holds a slot until its chunk has been written, which bounds
+	// how many chunks are buffered.
+	slots := make(chan struct{}, parallelism)
+	go func() {
+		for i, result := range results {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+
+			start := offset + int64(i)*chunkSize
+			end := min(start+chunkSize, size)
+			go func() {
+				data, err := p.fetchRange(ctx, info, etag, start, end)
+				result <- rangeResult{data: data, err: err}
+			}()
+		}
+	}()
+
+	var written int64
+	for _, result := range results {
+		var chunk rangeResult
+		select {
+		case chunk = <-result:
+		case <-ctx.Done():
+			return written, ctx.Err()
+		}
+		if chunk.err != nil {
+			return written, chunk.err
+		}
+
+		n, err := w.Write(chunk.data)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		<-slots
+	}
+
+	return written, nil
+}
+
+// fetchRange returns bytes [start, end) of the object behind info.
+func (p *Proxy) fetchRange(ctx context.Context, info *storage.URLInfo, etag string, start int64, end int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, info.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range info.ExtraHeaders {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+	if etag != "" {
+		req.Header.Set("If-Match", etag)
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("ranged download of bytes %d-%d returned status %d", start, end-1, resp.StatusCode)
+	}
+
+	data := make([]byte, end-start)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, fmt.Errorf("ranged download of bytes %d-%d failed: %w", start, end-1, err)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,107 @@
+package urlproxy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cirruslabs/omni-cache/pkg/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// stallingServer sends the first stallAfter bytes of payload to plain GET requests and then
+// stalls until the client gives up, while serving ranged requests normally.
+func stallingServer(t *testing.T, payload []byte, stallAfter int, etag func() string) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+
+	var rangedRequests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag())
+		if r.Header.Get("Range") != "" {
+			rangedRequests.Add(1)
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(payload))
+			return
+		}
+
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+		_, _ = w.Write(payload[:stallAfter])
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &rangedRequests
+}
+
+func TestSlowDownloadSwitchesToRangedRequests(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	server, rangedRequests := stallingServer(t, payload, 1000, func() string { return `"v1"` })
+
+	proxy := NewProxy(WithSlowDownloadFallback(SlowDownloadPolicy{
+		GracePeriod:       50 * time.Millisecond,
+		MinBytesPerSecond: 1024 * 1024,
+		Parallelism:       3,
+		ChunkSize:         10000,
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var body bytes.Buffer
+	require.NoError(t, proxy.DownloadToWriter(ctx, &storage.URLInfo{URL: server.URL}, "", &body))
+	require.Equal(t, payload, body.Bytes())
+	// The remaining 64536 bytes are fetched in chunks of 10000 bytes.
+	require.EqualValues(t, 7, rangedRequests.Load())
+}
+
+func TestSlowDownloadAppliesToCoalescedDownloads(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	server, rangedRequests := stallingServer(t, payload, 1000, func() string { return `"v1"` })
+
+	proxy := NewProxy(WithDownloadCoalescing(t.TempDir()), WithSlowDownloadFallback(SlowDownloadPolicy{
+		GracePeriod:       50 * time.Millisecond,
+		MinBytesPerSecond: 1024 * 1024,
+		ChunkSize:         10000,
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var body bytes.Buffer
+	require.NoError(t, proxy.DownloadToWriter(ctx, &storage.URLInfo{URL: server.URL}, "", &body))
+	require.Equal(t, payload, body.Bytes())
+	require.EqualValues(t, 7, rangedRequests.Load())
+}
+
+func TestSlowDownloadDetectsChangedObject(t *testing.T) {
+	payload := bytes.Repeat([]byte("x"), 32*1024)
+	var version atomic.Int64
+	server, _ := stallingServer(t, payload, 1000, func() string {
+		return `"v` + strconv.FormatInt(version.Add(1), 10) + `"`
+	})
+
+	proxy := NewProxy(WithSlowDownloadFallback(SlowDownloadPolicy{
+		GracePeriod:       50 * time.Millisecond,
+		MinBytesPerSecond: 1024 * 1024,
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var body bytes.Buffer
+	err := proxy.DownloadToWriter(ctx, &storage.URLInfo{URL: server.URL}, "", &body)
+	require.ErrorContains(t, err, "returned status 412")
+	require.Equal(t, 1000, body.Len())
+}
+
+func TestSlowDownloadPolicyDisabledByDefault(t *testing.T) {
+	require.False(t, SlowDownloadPolicy{}.Enabled())
+	require.False(t, SlowDownloadPolicy{GracePeriod: time.Second}.Enabled())
+	require.False(t, NewProxy().slowDownloads.Enabled())
+}
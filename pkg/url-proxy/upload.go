@@ -3,15 +3,16 @@ package urlproxy
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"time"
 
+	"github.com/cirruslabs/omni-cache/pkg/errdetail"
 	bytestream "google.golang.org/genproto/googleapis/bytestream"
 
-	"github.com/cirruslabs/omni-cache/pkg/stats"
 	"github.com/cirruslabs/omni-cache/pkg/storage"
 )
 
@@ -37,23 +38,12 @@ func (p *Proxy) ProxyUploadToURL(ctx context.Context, w http.ResponseWriter, inf
 }
 
 func (p *Proxy) proxyHTTPUpload(ctx context.Context, w http.ResponseWriter, info *storage.URLInfo, resource UploadResource) bool {
-	bodyReader := &countingReader{reader: resource.Body}
-	req, err := http.NewRequestWithContext(ctx, http.MethodPut, info.URL, bufio.NewReader(bodyReader))
-	if err != nil {
-		slog.ErrorContext(ctx, "cache upload request creation failed", "resourceName", resource.ResourceName, "uploadURL", info.URL, "err", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return false
-	}
-	req.Header.Set("Content-Type", "application/octet-stream")
-	req.ContentLength = resource.ContentLength
-	for k, v := range info.ExtraHeaders {
-		req.Header.Set(k, v)
-	}
-
 	startedAt := time.Now()
-	resp, err := p.httpClient.Do(req)
+	resp, bytesSent, err := p.putWithRetries(ctx, info, resource.Body, resource.ContentLength, "")
 	if err != nil {
-		errorMsg := fmt.Sprintf("Failed to proxy upload of %s cache! %s", resource.ResourceName, err)
+		errorMsg := errdetail.Message(ctx,
+			fmt.Sprintf("Failed to proxy upload of %s cache! %s", resource.ResourceName, err),
+			fmt.Sprintf("Failed to proxy upload of %s cache!", resource.ResourceName))
 		slog.ErrorContext(ctx, "failed to proxy cache upload", "resourceName", resource.ResourceName, "uploadURL", info.URL, "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(errorMsg))
@@ -69,7 +59,7 @@ func (p *Proxy) proxyHTTPUpload(ctx context.Context, w http.ResponseWriter, info
 			"status", resp.Status,
 			"statusCode", resp.StatusCode,
 			"uploadURL", info.URL,
-			"requestHeaders", req.Header,
+			"requestHeaders", resp.Request.Header,
 		)
 
 		body, bodyErr := io.ReadAll(resp.Body)
@@ -88,24 +78,28 @@ func (p *Proxy) proxyHTTPUpload(ctx context.Context, w http.ResponseWriter, info
 	}
 
 	if resp.StatusCode < http.StatusBadRequest {
-		uploadedBytes := bodyReader.Bytes()
+		uploadedBytes := bytesSent
 		if uploadedBytes == 0 && resource.ContentLength > 0 {
 			uploadedBytes = resource.ContentLength
 		}
-		stats.Default().RecordUpload(uploadedBytes, time.Since(startedAt))
+		p.stats.RecordUpload(uploadedBytes, time.Since(startedAt))
 	}
 
 	return resp.StatusCode < 400
 }
 
 func (p *Proxy) proxyGRPCUpload(ctx context.Context, w http.ResponseWriter, info *storage.URLInfo, resource UploadResource) bool {
-	client, closer, err := newByteStreamClientFromURL(ctx, info, p.grpcDialOptions...)
+	client, release, err := p.byteStreamClient(ctx, info)
 	if err != nil {
 		slog.ErrorContext(ctx, "failed to dial bytestream upload", "resourceName", resource.ResourceName, "uploadURL", info.URL, "err", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		if errors.Is(err, errGRPCUnreachable) {
+			w.WriteHeader(http.StatusBadGateway)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
 		return false
 	}
-	defer closer.Close()
+	defer release()
 
 	resourceName := resource.ResourceName
 	if resourceName == "" {
@@ -181,7 +175,7 @@ func (p *Proxy) proxyGRPCUpload(ctx context.Context, w http.ResponseWriter, info
 	}
 
 	w.WriteHeader(http.StatusCreated)
-	stats.Default().RecordUpload(written, time.Since(startedAt))
+	p.stats.RecordUpload(written, time.Since(startedAt))
 	return true
 }
 
@@ -203,21 +197,18 @@ func (p *Proxy) UploadFromReader(ctx context.Context, info *storage.URLInfo, res
 }
 
 func (p *Proxy) uploadHTTPFromReader(ctx context.Context, info *storage.URLInfo, body io.Reader, contentLength int64) error {
-	bodyReader := &countingReader{reader: body}
-	req, err := http.NewRequestWithContext(ctx, http.MethodPut, info.URL, bufio.NewReader(bodyReader))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Content-Type", "application/octet-stream")
-	if contentLength >= 0 {
-		req.ContentLength = contentLength
-	}
-	for k, v := range info.ExtraHeaders {
-		req.Header.Set(k, v)
+	var contentEncoding string
+	if p.compression == CompressionZstd {
+		compressed, compressedLength, release, err := compressBody(body, contentLength)
+		if err != nil {
+			return fmt.Errorf("compress upload: %w", err)
+		}
+		defer release()
+		body, contentLength, contentEncoding = compressed, compressedLength, CompressionZstd
 	}
 
 	startedAt := time.Now()
-	resp, err := p.httpClient.Do(req)
+	resp, bytesSent, err := p.putWithRetries(ctx, info, body, contentLength, contentEncoding)
 	if err != nil {
 		return err
 	}
@@ -227,11 +218,11 @@ func (p *Proxy) uploadHTTPFromReader(ctx context.Context, info *storage.URLInfo,
 		return fmt.Errorf("upload returned status %d", resp.StatusCode)
 	}
 
-	uploadedBytes := bodyReader.Bytes()
+	uploadedBytes := bytesSent
 	if uploadedBytes == 0 && contentLength > 0 {
 		uploadedBytes = contentLength
 	}
-	stats.Default().RecordUpload(uploadedBytes, time.Since(startedAt))
+	p.stats.RecordUpload(uploadedBytes, time.Since(startedAt))
 	return nil
 }
 
@@ -240,11 +231,11 @@ func (p *Proxy) uploadGRPCFromReader(ctx context.Context, info *storage.URLInfo,
 		return fmt.Errorf("bytestream upload requires non-empty resource name")
 	}
 
-	client, closer, err := newByteStreamClientFromURL(ctx, info, p.grpcDialOptions...)
+	client, release, err := p.byteStreamClient(ctx, info)
 	if err != nil {
 		return err
 	}
-	defer closer.Close()
+	defer release()
 
 	stream, err := client.Write(ctx)
 	if err != nil {
@@ -295,6 +286,6 @@ func (p *Proxy) uploadGRPCFromReader(ctx context.Context, info *storage.URLInfo,
 		return fmt.Errorf("bytestream committed size differs from bytes sent")
 	}
 
-	stats.Default().RecordUpload(written, time.Since(startedAt))
+	p.stats.RecordUpload(written, time.Since(startedAt))
 	return nil
 }